@@ -5,9 +5,10 @@
 PREFIX=/tmp/$(uuidgen)
 mkdir -p $PREFIX/netapp
 cp "$1" $PREFIX/netapp/chwrap
-for BIN in apt blkid blockdev cat dd df dnf docker free iscsiadm ls lsblk lsscsi mkdir mkfs.ext3 mkfs.ext4 \
-mkfs.xfs mount mount.nfs mount.nfs4 mpathconf multipath multipathd pgrep resize2fs rmdir rpcinfo stat systemctl umount \
-xfs_growfs yum ; do
+for BIN in apt blkid blockdev cat cryptsetup dd df dmsetup dnf docker dumpe2fs findmnt free fstrim iscsiadm ls \
+lsblk lsscsi mkdir mkfs.ext3 mkfs.ext4 mkfs.xfs mount mount.nfs mount.nfs4 mpathconf mpathpersist multipath \
+multipathd nsenter nvme pgrep resize2fs rmdir rpcinfo sg_persist stat systemctl tune2fs udevadm umount xfs_admin \
+xfs_growfs xfs_quota yum zfs zpool ; do
   ln -s chwrap $PREFIX/netapp/$BIN
 done
 tar --owner=0 --group=0 -C $PREFIX -cf "$2" netapp
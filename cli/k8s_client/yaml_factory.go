@@ -1224,6 +1224,8 @@ spec:
             add: ["SYS_ADMIN"]
           allowPrivilegeEscalation: true
         image: {TRIDENT_IMAGE}
+        ports:
+        - containerPort: 8001
         command:
         - /trident_orchestrator
         args:
@@ -1234,6 +1236,8 @@ spec:
         - "--csi_role=node"
         - "--log_format={LOG_FORMAT}"
         - "--node_prep={NODE_PREP}"
+        - "--metrics"
+        - "--csi_iscsi_session_monitor_interval=1m"
         {DEBUG}
         env:
         - name: KUBE_NODE_NAME
@@ -1362,6 +1366,8 @@ spec:
             add: ["SYS_ADMIN"]
           allowPrivilegeEscalation: true
         image: {TRIDENT_IMAGE}
+        ports:
+        - containerPort: 8001
         command:
         - /trident_orchestrator
         args:
@@ -1372,6 +1378,8 @@ spec:
         - "--csi_role=node"
         - "--log_format={LOG_FORMAT}"
         - "--node_prep={NODE_PREP}"
+        - "--metrics"
+        - "--csi_iscsi_session_monitor_interval=1m"
         {DEBUG}
         env:
         - name: KUBE_NODE_NAME
@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -2805,18 +2804,13 @@ func (o *TridentOrchestrator) AttachVolume(
 		return utils.VolumeDeletingError(fmt.Sprintf("volume %s is deleting", volumeName))
 	}
 
-	hostMountpoint := mountpoint
-	isDockerPluginModeSet := false
-	if os.Getenv(config.DockerPluginModeEnvVariable) != "" {
-		isDockerPluginModeSet = true
-		hostMountpoint = filepath.Join("/host", mountpoint)
-	}
+	// The mountpoint is named as the host sees it, which in Docker plugin mode isn't where this process sees it
+	hostMountpoint := utils.LocalPath(mountpoint)
 
 	Logc(ctx).WithFields(log.Fields{
-		"volume":                volumeName,
-		"mountpoint":            mountpoint,
-		"hostMountpoint":        hostMountpoint,
-		"isDockerPluginModeSet": isDockerPluginModeSet,
+		"volume":         volumeName,
+		"mountpoint":     mountpoint,
+		"hostMountpoint": hostMountpoint,
 	}).Debug("Mounting volume.")
 
 	// Ensure mount point exists and is a directory
@@ -2833,16 +2827,11 @@ func (o *TridentOrchestrator) AttachVolume(
 	}
 
 	// Check if volume is already mounted
-	dfOutput, dfOuputErr := utils.GetDFOutput(ctx)
-	if dfOuputErr != nil {
-		err = fmt.Errorf("error checking if %v is already mounted: %v", mountpoint, dfOuputErr)
-		return err
-	}
-	for _, e := range dfOutput {
-		if e.Target == mountpoint {
-			Logc(ctx).Debugf("%v is already mounted", mountpoint)
-			return nil
-		}
+	if mounted, err := utils.IsMounted(ctx, "", mountpoint); err != nil {
+		return fmt.Errorf("error checking if %v is already mounted: %v", mountpoint, err)
+	} else if mounted {
+		Logc(ctx).Debugf("%v is already mounted", mountpoint)
+		return nil
 	}
 
 	if publishInfo.FilesystemType == "nfs" {
@@ -2879,7 +2868,7 @@ func (o *TridentOrchestrator) DetachVolume(ctx context.Context, volumeName, moun
 	}).Debug("Unmounting volume.")
 
 	// Check if the mount point exists, so we know that it's attached and must be cleaned up
-	_, err = os.Stat(mountpoint)
+	_, err = os.Stat(utils.LocalPath(mountpoint))
 	if err != nil {
 		// Not attached, so nothing to do
 		return nil
@@ -2891,7 +2880,7 @@ func (o *TridentOrchestrator) DetachVolume(ctx context.Context, volumeName, moun
 	}
 
 	// Best effort removal of the mount point
-	os.Remove(mountpoint)
+	os.Remove(utils.LocalPath(mountpoint))
 	return nil
 }
 
@@ -3804,6 +3793,18 @@ func (o *TridentOrchestrator) AddNode(
 	defer o.mutex.Unlock()
 	defer o.updateMetrics()
 
+	// Refuse a node whose initiator name another node already uses, as they would steal each other's sessions
+	registeredIQNs := make(map[string]string, len(o.nodes))
+	for _, registeredNode := range o.nodes {
+		if registeredNode.IQN != "" {
+			registeredIQNs[registeredNode.IQN] = registeredNode.Name
+		}
+	}
+	if err = utils.CheckInitiatorIQN(node.IQN, node.Name, registeredIQNs); err != nil {
+		Logc(ctx).WithField("node", node.Name).WithError(err).Error("Could not add node.")
+		return err
+	}
+
 	if node.NodePrep != nil && node.NodePrep.Enabled {
 		// Check if node prep status has changed
 		oldNode, found := o.nodes[node.Name]
@@ -2609,6 +2609,25 @@ func TestAddNode(t *testing.T) {
 	}
 }
 
+func TestAddNodeWithDuplicateIQN(t *testing.T) {
+	orchestrator := getOrchestrator()
+	if err := orchestrator.AddNode(ctx(), &utils.Node{Name: "node1", IQN: "myIQN"}, nil); err != nil {
+		t.Fatalf("adding node failed; %v", err)
+	}
+
+	// A cloned node with the same IQN is refused, but the original may register again
+	err := orchestrator.AddNode(ctx(), &utils.Node{Name: "node2", IQN: "myiqn"}, nil)
+	if !utils.IsDuplicateInitiatorError(err) {
+		t.Errorf("expected duplicate initiator error, got %v", err)
+	}
+	if _, ok := orchestrator.nodes["node2"]; ok {
+		t.Error("node with duplicate IQN was added")
+	}
+	if err = orchestrator.AddNode(ctx(), &utils.Node{Name: "node1", IQN: "myIQN"}, nil); err != nil {
+		t.Errorf("re-adding node failed; %v", err)
+	}
+}
+
 func TestGetNode(t *testing.T) {
 	orchestrator := getOrchestrator()
 	expectedNode := &utils.Node{
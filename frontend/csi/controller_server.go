@@ -4,6 +4,7 @@ package csi
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math"
 	"strconv"
@@ -311,6 +312,34 @@ func stashIscsiTargetPortals(publishInfo map[string]string, volumePublishInfo *u
 	}
 }
 
+// stashIscsiAdditionalTargets adds any additional targets through which the LUN is mapped to the publish context.
+func stashIscsiAdditionalTargets(publishInfo map[string]string, volumePublishInfo *utils.VolumePublishInfo) error {
+
+	if len(volumePublishInfo.IscsiAdditionalTargets) == 0 {
+		return nil
+	}
+	targetsBytes, err := json.Marshal(volumePublishInfo.IscsiAdditionalTargets)
+	if err != nil {
+		return fmt.Errorf("could not marshal additional iSCSI targets; %v", err)
+	}
+	publishInfo["iscsiAdditionalTargets"] = string(targetsBytes)
+	return nil
+}
+
+// stashSCSITimeouts adds the SCSI timeouts to set on each path of the LUN, if any, to the publish context.
+func stashSCSITimeouts(publishInfo map[string]string, volumePublishInfo *utils.VolumePublishInfo) error {
+
+	if volumePublishInfo.SCSITimeouts == nil || volumePublishInfo.SCSITimeouts.IsZero() {
+		return nil
+	}
+	timeoutsBytes, err := json.Marshal(volumePublishInfo.SCSITimeouts)
+	if err != nil {
+		return fmt.Errorf("could not marshal SCSI timeouts; %v", err)
+	}
+	publishInfo["scsiTimeouts"] = string(timeoutsBytes)
+	return nil
+}
+
 func (p *Plugin) ControllerPublishVolume(
 	ctx context.Context, req *csi.ControllerPublishVolumeRequest,
 ) (*csi.ControllerPublishVolumeResponse, error) {
@@ -382,11 +411,18 @@ func (p *Plugin) ControllerPublishVolume(
 		publishInfo["nfsPath"] = volume.Config.AccessInfo.NfsPath
 	} else if volume.Config.Protocol == tridentconfig.Block {
 		stashIscsiTargetPortals(publishInfo, volumePublishInfo)
+		if err := stashIscsiAdditionalTargets(publishInfo, volumePublishInfo); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err := stashSCSITimeouts(publishInfo, volumePublishInfo); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 		publishInfo["iscsiTargetIqn"] = volume.Config.AccessInfo.IscsiTargetIQN
 		publishInfo["iscsiLunNumber"] = strconv.Itoa(int(volume.Config.AccessInfo.IscsiLunNumber))
 		publishInfo["iscsiInterface"] = volume.Config.AccessInfo.IscsiInterface
 		publishInfo["iscsiLunSerial"] = volume.Config.AccessInfo.IscsiLunSerial
 		publishInfo["iscsiIgroup"] = volume.Config.AccessInfo.IscsiIgroup
+		publishInfo["volumeSize"] = volume.Config.Size
 		// Encrypt and add CHAP credentials if they're needed
 		if volumePublishInfo.UseCHAP {
 			if p.aesKey != nil {
@@ -402,6 +438,17 @@ func (p *Plugin) ControllerPublishVolume(
 		publishInfo["filesystemType"] = volumePublishInfo.FilesystemType
 		publishInfo["useCHAP"] = strconv.FormatBool(volumePublishInfo.UseCHAP)
 		publishInfo["sharedTarget"] = strconv.FormatBool(volumePublishInfo.SharedTarget)
+		// A LUN the hypervisor presents to the node as a local disk is found by its identity rather than logged in to
+		if volumePublishInfo.IsPreAttached() {
+			publishInfo["preAttachedDeviceWwn"] = volumePublishInfo.PreAttachedDeviceWWN
+			publishInfo["preAttachedDeviceSerial"] = volumePublishInfo.PreAttachedDeviceSerial
+		}
+		// An NVMe namespace is reached by connecting to its subsystem over FC rather than logging in to a target
+		if volumePublishInfo.IsNVMe() {
+			publishInfo["nvmeSubsystemNqn"] = volumePublishInfo.NVMeSubsystemNQN
+			publishInfo["nvmeNamespaceUuid"] = volumePublishInfo.NVMeNamespaceUUID
+			publishInfo["nvmeTargetPorts"] = strings.Join(volumePublishInfo.NVMeTargetPorts, ",")
+		}
 	}
 
 	return &csi.ControllerPublishVolumeResponse{PublishContext: publishInfo}, nil
@@ -4,6 +4,7 @@ package csi
 
 import (
 	"context"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	log "github.com/sirupsen/logrus"
@@ -29,6 +30,14 @@ func (p *Plugin) Probe(
 		return &csi.ProbeResponse{}, status.Error(codes.FailedPrecondition, err.Error())
 	}
 
+	// Nodes must also be able to run host commands and reach the daemons volumes depend on
+	if p.role == CSINode || p.role == CSIAllInOne {
+		if health := utils.HealthCheck(ctx, detachJournalPath); !health.Healthy {
+			return &csi.ProbeResponse{}, status.Error(codes.FailedPrecondition,
+				"node is unhealthy; "+strings.Join(health.Failures(), "; "))
+		}
+	}
+
 	return &csi.ProbeResponse{}, nil
 }
 
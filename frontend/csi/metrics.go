@@ -0,0 +1,142 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package csi
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/netapp/trident/config"
+	"github.com/netapp/trident/utils"
+)
+
+var (
+	iscsiSessionHealthyGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: config.OrchestratorName,
+			Subsystem: "node",
+			Name:      "iscsi_session_healthy",
+			Help:      "Whether each iSCSI session passed its most recent health check",
+		},
+		[]string{"sid", "target_iqn", "portal"},
+	)
+	iscsiSessionErrorsGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: config.OrchestratorName,
+			Subsystem: "node",
+			Name:      "iscsi_session_errors",
+			Help:      "Errors of each type seen on each iSCSI session, as of its most recent health check",
+		},
+		[]string{"sid", "target_iqn", "portal", "type"},
+	)
+	iscsiSessionBytesGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: config.OrchestratorName,
+			Subsystem: "node",
+			Name:      "iscsi_session_bytes",
+			Help:      "Data bytes transferred in each direction on each iSCSI session, as of its most recent health check",
+		},
+		[]string{"sid", "target_iqn", "portal", "direction"},
+	)
+	fstrimLastTrimGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: config.OrchestratorName,
+			Subsystem: "node",
+			Name:      "fstrim_last_trim_timestamp_seconds",
+			Help:      "When each mounted volume was last trimmed in the background",
+		},
+		[]string{"volume"},
+	)
+	fstrimTrimmedBytesGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: config.OrchestratorName,
+			Subsystem: "node",
+			Name:      "fstrim_trimmed_bytes",
+			Help:      "Bytes discarded by the most recent background trim of each mounted volume",
+		},
+		[]string{"volume"},
+	)
+	fstrimSuccessGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: config.OrchestratorName,
+			Subsystem: "node",
+			Name:      "fstrim_success",
+			Help:      "Whether the most recent background trim of each mounted volume succeeded",
+		},
+		[]string{"volume"},
+	)
+	mountOptionDriftGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: config.OrchestratorName,
+			Subsystem: "node",
+			Name:      "mount_option_drift",
+			Help:      "Whether each mount of a volume lacked desired options that could not be restored by remounting",
+		},
+		[]string{"volume", "mountpoint"},
+	)
+)
+
+// updateISCSISessionMetrics replaces the iSCSI session health and statistics metrics with the results of a session
+// health check.
+func updateISCSISessionMetrics(health []utils.ISCSISessionHealth) {
+
+	iscsiSessionHealthyGauge.Reset()
+	iscsiSessionErrorsGauge.Reset()
+	iscsiSessionBytesGauge.Reset()
+	for _, session := range health {
+		healthy := 0.0
+		if session.Healthy {
+			healthy = 1.0
+		}
+		iscsiSessionHealthyGauge.WithLabelValues(session.SID, session.TargetIQN, session.Portal).Set(healthy)
+
+		for errorType, count := range map[string]uint64{
+			"timeout":    session.TimeoutErrors,
+			"digest":     session.DigestErrors,
+			"format":     session.FormatErrors,
+			"connection": session.ConnectionFailures,
+		} {
+			iscsiSessionErrorsGauge.WithLabelValues(session.SID, session.TargetIQN, session.Portal, errorType).Set(
+				float64(count))
+		}
+		iscsiSessionBytesGauge.WithLabelValues(session.SID, session.TargetIQN, session.Portal, "tx").Set(
+			float64(session.TxBytes))
+		iscsiSessionBytesGauge.WithLabelValues(session.SID, session.TargetIQN, session.Portal, "rx").Set(
+			float64(session.RxBytes))
+	}
+}
+
+// updateTrimMetrics replaces the background trim metrics with the latest results of the trim scheduler.  Volumes
+// not yet trimmed are omitted.
+func updateTrimMetrics(results []utils.TrimResult) {
+
+	fstrimLastTrimGauge.Reset()
+	fstrimTrimmedBytesGauge.Reset()
+	fstrimSuccessGauge.Reset()
+	for _, result := range results {
+		if result.LastTrim.IsZero() {
+			continue
+		}
+		success := 0.0
+		if result.Error == "" {
+			success = 1.0
+		}
+		fstrimLastTrimGauge.WithLabelValues(result.VolumeID).Set(float64(result.LastTrim.Unix()))
+		fstrimTrimmedBytesGauge.WithLabelValues(result.VolumeID).Set(float64(result.TrimmedBytes))
+		fstrimSuccessGauge.WithLabelValues(result.VolumeID).Set(success)
+	}
+}
+
+// updateMountDriftMetrics replaces the mount option drift metrics with the drift found by the mount reconciler.
+// Mounts that were remounted with their desired options are reported as no longer drifted.
+func updateMountDriftMetrics(drift []utils.MountDrift) {
+
+	mountOptionDriftGauge.Reset()
+	for _, mount := range drift {
+		drifted := 1.0
+		if mount.Remounted {
+			drifted = 0.0
+		}
+		mountOptionDriftGauge.WithLabelValues(mount.VolumeID, mount.Mountpoint).Set(drifted)
+	}
+}
@@ -22,14 +22,21 @@ import (
 	tridentconfig "github.com/netapp/trident/config"
 	. "github.com/netapp/trident/logger"
 	"github.com/netapp/trident/utils"
+	"github.com/netapp/trident/utils/mount"
 )
 
 const (
 	tridentDeviceInfoPath      = "/var/lib/trident/tracking"
+	detachJournalPath          = "/var/lib/trident/detach"
 	fsRaw                      = "raw"
-	lockID                     = "csi_node_server"
 	volumePublishInfoFilename  = "volumePublishInfo.json"
 	nodePrepBreadcrumbFilename = "nodePrepInfo.json"
+	topologySegmentPrefix      = "topology.trident.netapp.io/"
+	attachProgressInterval     = 30 * time.Second
+
+	// fstrimIntervalAttribute is the volume attribute overriding the node's background trim interval for a
+	// volume, as a duration such as "24h"; a negative duration excludes the volume from background trims
+	fstrimIntervalAttribute = "fstrimInterval"
 )
 
 var (
@@ -40,9 +47,19 @@ func (p *Plugin) NodeStageVolume(
 	ctx context.Context, req *csi.NodeStageVolumeRequest,
 ) (*csi.NodeStageVolumeResponse, error) {
 
-	lockContext := "NodeStageVolume-" + req.GetVolumeId()
-	utils.Lock(ctx, lockContext, lockID)
-	defer utils.Unlock(ctx, lockContext, lockID)
+	// kubelet reissues a NodeStage that outlives its deadline, so join the first attempt rather than racing it
+	result, err := utils.CoalesceOperation(ctx, "NodeStageVolume-"+req.GetVolumeId()+"-"+req.GetStagingTargetPath(),
+		func(ctx context.Context) (interface{}, error) {
+			return utils.RunHostOperation(ctx, utils.HostOperationAttach, req.GetVolumeId(),
+				func() (interface{}, error) { return p.nodeStageVolume(ctx, req) })
+		})
+	response, _ := result.(*csi.NodeStageVolumeResponse)
+	return response, err
+}
+
+func (p *Plugin) nodeStageVolume(
+	ctx context.Context, req *csi.NodeStageVolumeRequest,
+) (*csi.NodeStageVolumeResponse, error) {
 
 	fields := log.Fields{"Method": "NodeStageVolume", "Type": "CSI_Node"}
 	Logc(ctx).WithFields(fields).Debug(">>>> NodeStageVolume")
@@ -52,6 +69,12 @@ func (p *Plugin) NodeStageVolume(
 	case string(tridentconfig.File):
 		return p.nodeStageNFSVolume(ctx, req)
 	case string(tridentconfig.Block):
+		if req.PublishContext["preAttachedDeviceWwn"] != "" || req.PublishContext["preAttachedDeviceSerial"] != "" {
+			return p.nodeStagePreAttachedVolume(ctx, req)
+		}
+		if req.PublishContext["nvmeSubsystemNqn"] != "" {
+			return p.nodeStageNVMeVolume(ctx, req)
+		}
 		return p.nodeStageISCSIVolume(ctx, req)
 	default:
 		return nil, status.Error(codes.InvalidArgument, "unknown protocol")
@@ -62,9 +85,19 @@ func (p *Plugin) NodeUnstageVolume(
 	ctx context.Context, req *csi.NodeUnstageVolumeRequest,
 ) (*csi.NodeUnstageVolumeResponse, error) {
 
-	lockContext := "NodeUnstageVolume-" + req.GetVolumeId()
-	utils.Lock(ctx, lockContext, lockID)
-	defer utils.Unlock(ctx, lockContext, lockID)
+	result, err := utils.CoalesceOperation(ctx,
+		"NodeUnstageVolume-"+req.GetVolumeId()+"-"+req.GetStagingTargetPath(),
+		func(ctx context.Context) (interface{}, error) {
+			return utils.RunHostOperation(ctx, utils.HostOperationDetach, req.GetVolumeId(),
+				func() (interface{}, error) { return p.nodeUnstageVolume(ctx, req) })
+		})
+	response, _ := result.(*csi.NodeUnstageVolumeResponse)
+	return response, err
+}
+
+func (p *Plugin) nodeUnstageVolume(
+	ctx context.Context, req *csi.NodeUnstageVolumeRequest,
+) (*csi.NodeUnstageVolumeResponse, error) {
 
 	fields := log.Fields{"Method": "NodeUnstageVolume", "Type": "CSI_Node"}
 	Logc(ctx).WithFields(fields).Debug(">>>> NodeUnstageVolume")
@@ -89,6 +122,12 @@ func (p *Plugin) NodeUnstageVolume(
 	case tridentconfig.File:
 		return p.nodeUnstageNFSVolume(ctx, req)
 	case tridentconfig.Block:
+		if publishInfo.IsPreAttached() {
+			return p.nodeUnstagePreAttachedVolume(ctx, req, publishInfo)
+		}
+		if publishInfo.IsNVMe() {
+			return p.nodeUnstageNVMeVolume(ctx, req, publishInfo)
+		}
 		return p.nodeUnstageISCSIVolume(ctx, req, publishInfo)
 	default:
 		return nil, status.Error(codes.InvalidArgument, "unknown protocol")
@@ -99,9 +138,15 @@ func (p *Plugin) NodePublishVolume(
 	ctx context.Context, req *csi.NodePublishVolumeRequest,
 ) (*csi.NodePublishVolumeResponse, error) {
 
-	lockContext := "NodePublishVolume-" + req.GetVolumeId()
-	utils.Lock(ctx, lockContext, lockID)
-	defer utils.Unlock(ctx, lockContext, lockID)
+	result, err := utils.RunHostOperation(ctx, utils.HostOperationAttach, req.GetVolumeId(),
+		func() (interface{}, error) { return p.nodePublishVolume(ctx, req) })
+	response, _ := result.(*csi.NodePublishVolumeResponse)
+	return response, err
+}
+
+func (p *Plugin) nodePublishVolume(
+	ctx context.Context, req *csi.NodePublishVolumeRequest,
+) (*csi.NodePublishVolumeResponse, error) {
 
 	fields := log.Fields{"Method": "NodePublishVolume", "Type": "CSI_Node"}
 	Logc(ctx).WithFields(fields).Debug(">>>> NodePublishVolume")
@@ -121,9 +166,15 @@ func (p *Plugin) NodeUnpublishVolume(
 	ctx context.Context, req *csi.NodeUnpublishVolumeRequest,
 ) (*csi.NodeUnpublishVolumeResponse, error) {
 
-	lockContext := "NodeUnpublishVolume-" + req.GetVolumeId()
-	utils.Lock(ctx, lockContext, lockID)
-	defer utils.Unlock(ctx, lockContext, lockID)
+	result, err := utils.RunHostOperation(ctx, utils.HostOperationDetach, req.GetVolumeId(),
+		func() (interface{}, error) { return p.nodeUnpublishVolume(ctx, req) })
+	response, _ := result.(*csi.NodeUnpublishVolumeResponse)
+	return response, err
+}
+
+func (p *Plugin) nodeUnpublishVolume(
+	ctx context.Context, req *csi.NodeUnpublishVolumeRequest,
+) (*csi.NodeUnpublishVolumeResponse, error) {
 
 	fields := log.Fields{"Method": "NodeUnpublishVolume", "Type": "CSI_Node"}
 	Logc(ctx).WithFields(fields).Debug(">>>> NodeUnpublishVolume")
@@ -139,43 +190,15 @@ func (p *Plugin) NodeUnpublishVolume(
 		return nil, status.Error(codes.InvalidArgument, "no target path provided")
 	}
 
-	isDir, err := utils.IsLikelyDir(targetPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			Logc(ctx).WithFields(fields).Infof("target path (%s) not found; volume is not mounted.", targetPath)
-			return &csi.NodeUnpublishVolumeResponse{}, nil
-		} else {
-			return nil, status.Errorf(codes.Internal,
-				"could not check if the target path (%s) is a directory; %s", targetPath, err)
-		}
-	}
-
-	var notMountPoint bool
-	if isDir {
-		notMountPoint, err = utils.IsLikelyNotMountPoint(targetPath)
-	} else {
-		var mounted bool
-		mounted, err = utils.IsMounted(ctx, "", targetPath)
-		notMountPoint = !mounted
-	}
-
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, status.Error(codes.NotFound, "target path not found")
-		} else {
-			return nil, status.Errorf(codes.Internal, "unable to check if targetPath (%s) is mounted or not; %s",
-				targetPath, err)
+	if err := utils.UnpublishVolume(ctx, targetPath); err != nil {
+		if utils.IsNotFoundError(err) {
+			return nil, status.Error(codes.NotFound, "volume not mounted")
 		}
+		Logc(ctx).WithFields(log.Fields{"path": targetPath, "error": err}).Error("unable to unpublish volume.")
+		return nil, status.Errorf(codes.Internal, "unable to unpublish volume; %s", err)
 	}
-
-	if notMountPoint {
-		return nil, status.Error(codes.NotFound, "volume not mounted")
-	}
-
-	if err = utils.Umount(ctx, targetPath); err != nil {
-		Logc(ctx).WithFields(log.Fields{"path": targetPath, "error": err}).Error("unable to unmount volume.")
-		return nil, status.Errorf(codes.InvalidArgument, "unable to unmount volume; %s", err)
-	}
+	utils.UntrackTrimMount(ctx, req.VolumeId, targetPath)
+	utils.UntrackMountOptions(ctx, targetPath)
 
 	// As per the CSI spec SP i.e. Trident is responsible for deleting the target path,
 	// however today Kubernetes performs this deletion. Here we are making best efforts
@@ -183,7 +206,7 @@ func (p *Plugin) NodeUnpublishVolume(
 	// NodeUnpublishVolume again and usually deletion goes through in the second attempt.
 	// As a viable solution making it run as a goroutine
 	go func() {
-		if err = utils.DeleteResourceAtPath(ctx, targetPath); err != nil {
+		if err := utils.DeleteResourceAtPath(ctx, targetPath); err != nil {
 			Logc(ctx).Debugf("Unable to delete resource at target path: %s; %s", targetPath, err)
 		}
 	}()
@@ -257,6 +280,19 @@ func (p *Plugin) NodeExpandVolume(
 	ctx context.Context, req *csi.NodeExpandVolumeRequest,
 ) (*csi.NodeExpandVolumeResponse, error) {
 
+	result, err := utils.CoalesceOperation(ctx, "NodeExpandVolume-"+req.GetVolumeId()+"-"+req.GetVolumePath(),
+		func(ctx context.Context) (interface{}, error) {
+			return utils.RunHostOperation(ctx, utils.HostOperationAttach, req.GetVolumeId(),
+				func() (interface{}, error) { return p.nodeExpandVolume(ctx, req) })
+		})
+	response, _ := result.(*csi.NodeExpandVolumeResponse)
+	return response, err
+}
+
+func (p *Plugin) nodeExpandVolume(
+	ctx context.Context, req *csi.NodeExpandVolumeRequest,
+) (*csi.NodeExpandVolumeResponse, error) {
+
 	fields := log.Fields{"Method": "NodeExpandVolume", "Type": "CSI_Node"}
 	Logc(ctx).WithFields(fields).Debug(">>>> NodeExpandVolume")
 	defer Logc(ctx).WithFields(fields).Debug("<<<< NodeExpandVolume")
@@ -317,6 +353,14 @@ func (p *Plugin) NodeExpandVolume(
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
 
+	// A disk the hypervisor presents is resized by the hypervisor, which this node can't ask to do so
+	if publishInfo.IsPreAttached() {
+		return nil, status.Error(codes.Unimplemented, "expanding pre-attached volumes is not supported")
+	}
+	if publishInfo.IsNVMe() {
+		return nil, status.Error(codes.Unimplemented, "expanding NVMe volumes is not supported")
+	}
+
 	lunID := int(publishInfo.IscsiLunNumber)
 
 	Logc(ctx).WithFields(log.Fields{
@@ -331,8 +375,15 @@ func (p *Plugin) NodeExpandVolume(
 	if utils.IsAlreadyAttached(ctx, lunID, publishInfo.IscsiTargetIQN) {
 
 		// Rescan device to detect increased size
-		if err = utils.ISCSIRescanDevices(
-			ctx, publishInfo.IscsiTargetIQN, publishInfo.IscsiLunNumber, requiredBytes); err != nil {
+		droppedPaths, err := utils.ISCSIRescanDevices(
+			ctx, publishInfo.IscsiTargetIQN, publishInfo.IscsiLunNumber, requiredBytes)
+		if len(droppedPaths) > 0 {
+			Logc(ctx).WithFields(log.Fields{
+				"device":       publishInfo.DevicePath,
+				"droppedPaths": droppedPaths,
+			}).Warning("Dropped failed paths while scanning device.")
+		}
+		if err != nil {
 			Logc(ctx).WithFields(log.Fields{
 				"device": publishInfo.DevicePath,
 				"error":  err,
@@ -342,20 +393,25 @@ func (p *Plugin) NodeExpandVolume(
 
 		// Expand filesystem
 		if publishInfo.FilesystemType != fsRaw {
-			filesystemSize, err := utils.ExpandISCSIFilesystem(ctx, publishInfo, stagingTargetPath)
+			resizeResult, err := utils.ExpandISCSIFilesystem(ctx, publishInfo, stagingTargetPath)
 			if err != nil {
 				Logc(ctx).WithFields(log.Fields{
 					"device":         publishInfo.DevicePath,
 					"filesystemType": publishInfo.FilesystemType,
+					"preExpandSize":  resizeResult.PreExpandSize,
+					"deviceSize":     resizeResult.DeviceSize,
 					"error":          err,
 				}).Error("Unable to expand filesystem.")
 				return nil, status.Error(codes.Internal, err.Error())
 			}
 			Logc(ctx).WithFields(log.Fields{
-				"filesystemSize": filesystemSize,
+				"preExpandSize":  resizeResult.PreExpandSize,
+				"postExpandSize": resizeResult.PostExpandSize,
+				"deviceSize":     resizeResult.DeviceSize,
+				"duration":       resizeResult.Duration,
 				"requiredBytes":  requiredBytes,
 				"limitBytes":     limitBytes,
-			}).Debug("Filesystem size after expand.")
+			}).Info("Expanded filesystem.")
 		}
 	} else {
 		Logc(ctx).WithField("devicePath", publishInfo.DevicePath).Error("Unable to expand volume as device is not attached.")
@@ -390,10 +446,52 @@ func (p *Plugin) NodeGetInfo(
 	defer Logc(ctx).WithFields(fields).Debug("<<<< NodeGetInfo")
 
 	topology := &csi.Topology{
-		Segments: topologyLabels,
+		Segments: p.nodeTopologySegments(ctx),
+	}
+
+	// Report the attach limit so the scheduler doesn't place more volumes here than the node can attach
+	maxVolumes := int64(utils.GetAttachLimits().MaxLUNs)
+
+	return &csi.NodeGetInfoResponse{
+		NodeId:             p.nodeName,
+		MaxVolumesPerNode:  maxVolumes,
+		AccessibleTopology: topology,
+	}, nil
+}
+
+// nodeTopologySegments returns the CSI topology segments for this node, which are the topology labels
+// reported by the controller plus, if enabled, a segment for each storage protocol and storage subnet the host
+// supports.  The storage subnets include the configured storage networks the host has a route toward.
+func (p *Plugin) nodeTopologySegments(ctx context.Context) map[string]string {
+
+	segments := make(map[string]string)
+	for k, v := range topologyLabels {
+		segments[k] = v
+	}
+	if !p.reportNodeTopology {
+		return segments
+	}
+
+	nodeTopology, err := utils.GetNodeTopology(ctx, utils.GetStorageCIDRs(), topologyLabels)
+	if err != nil {
+		Logc(ctx).WithError(err).Warn("Could not discover node topology; reporting topology labels only.")
+		return segments
+	}
+
+	for _, protocol := range nodeTopology.Protocols {
+		segments[topologySegmentPrefix+"protocol-"+protocol] = "true"
+	}
+	for _, subnet := range nodeTopology.Subnets {
+		// Label names may not contain the '/' or ':' found in CIDRs, and are limited to 63 characters
+		name := "subnet-" + strings.NewReplacer("/", "-", ":", "-").Replace(subnet)
+		if len(name) > 63 {
+			Logc(ctx).WithField("subnet", subnet).Debug("Subnet too long for a topology segment, skipping.")
+			continue
+		}
+		segments[topologySegmentPrefix+name] = "true"
 	}
 
-	return &csi.NodeGetInfoResponse{NodeId: p.nodeName, AccessibleTopology: topology}, nil
+	return segments
 }
 
 func (p *Plugin) nodeGetInfo(ctx context.Context) *utils.Node {
@@ -428,6 +526,11 @@ func (p *Plugin) nodeGetInfo(ctx context.Context) *utils.Node {
 	} else {
 		iscsiWWN = iscsiWWNs[0]
 		Logc(ctx).WithField("IQN", iscsiWWN).Info("Discovered iSCSI initiator name.")
+
+		// The controller refuses to register a node with a default initiator name, so explain why here too
+		if err = utils.CheckInitiatorIQN(iscsiWWN, p.nodeName, nil); err != nil {
+			Logc(ctx).WithError(err).Error("iSCSI initiator name is not unique.")
+		}
 	}
 
 	ips, err := utils.GetIPAddresses(ctx)
@@ -439,12 +542,24 @@ func (p *Plugin) nodeGetInfo(ctx context.Context) *utils.Node {
 		Logc(ctx).WithField("IP Addresses", ips).Info("Discovered IP addresses.")
 	}
 
+	// Report which protocols and filesystems the host supports, so the controller can label the node by them
+	capabilities := utils.Capabilities(ctx)
+	for capability, status := range capabilities {
+		if !status.Supported {
+			Logc(ctx).WithFields(log.Fields{
+				"capability":  capability,
+				"diagnostics": status.Diagnostics,
+			}).Info("Host capability not supported.")
+		}
+	}
+
 	node := &utils.Node{
-		Name:     p.nodeName,
-		IQN:      iscsiWWN,
-		IPs:      ips,
-		NodePrep: p.nodePrep,
-		HostInfo: p.hostInfo,
+		Name:         p.nodeName,
+		IQN:          iscsiWWN,
+		IPs:          ips,
+		NodePrep:     p.nodePrep,
+		HostInfo:     p.hostInfo,
+		Capabilities: capabilities,
 	}
 	return node
 }
@@ -461,6 +576,14 @@ func (p *Plugin) nodeRegisterWithController(ctx context.Context, timeout time.Du
 		if err == nil {
 			topologyLabels = nodeDetails.TopologyLabels
 			node.TopologyLabels = nodeDetails.TopologyLabels
+		} else if utils.IsDuplicateInitiatorError(err) {
+			// Registration can't succeed with this initiator name, so replace it if allowed, else give up
+			iqn, regenerateErr := p.regenerateInitiatorIQN(ctx, node.IQN)
+			if regenerateErr != nil {
+				Logc(ctx).WithError(regenerateErr).Error("Could not replace iSCSI initiator name.")
+				return backoff.Permanent(err)
+			}
+			node.IQN = iqn
 		}
 		return err
 	}
@@ -489,6 +612,20 @@ func (p *Plugin) nodeRegisterWithController(ctx context.Context, timeout time.Du
 	}
 }
 
+// regenerateInitiatorIQN replaces this node's iSCSI initiator name, which the controller refused as a default or
+// a duplicate, if initiator name regeneration is enabled.
+func (p *Plugin) regenerateInitiatorIQN(ctx context.Context, iqn string) (string, error) {
+
+	host := p.hostInfo
+	if host == nil {
+		var err error
+		if host, err = utils.GetHostSystemInfo(ctx); err != nil {
+			return "", err
+		}
+	}
+	return utils.RegenerateInitiatorIQN(ctx, *host, iqn)
+}
+
 func (p *Plugin) nodeStageNFSVolume(ctx context.Context, req *csi.NodeStageVolumeRequest,
 ) (*csi.NodeStageVolumeResponse, error) {
 
@@ -774,35 +911,14 @@ func (p *Plugin) nodePublishNFSVolume(
 	ctx context.Context, req *csi.NodePublishVolumeRequest,
 ) (*csi.NodePublishVolumeResponse, error) {
 
-	targetPath := req.GetTargetPath()
-	notMnt, err := utils.IsLikelyNotMountPoint(targetPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			if err := os.MkdirAll(targetPath, 0750); err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
-			}
-			notMnt = true
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
-		}
-	}
-
-	if !notMnt {
-		return &csi.NodePublishVolumeResponse{}, nil
-	}
-
 	publishInfo, err := p.readStagedDeviceInfo(ctx, req.StagingTargetPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	if req.GetReadonly() {
-		mountOptions := strings.Split(publishInfo.MountOptions, ",")
-		mountOptions = append(mountOptions, "ro")
-		publishInfo.MountOptions = strings.Join(mountOptions, ",")
-	}
-
-	err = utils.AttachNFSVolume(ctx, req.VolumeContext["internalName"], req.TargetPath, publishInfo)
+	// A volume already mounted keeps its mount, but options changed since are reconciled with it
+	volumeName := req.VolumeContext["internalName"]
+	err = utils.PublishVolume(ctx, volumeName, req.TargetPath, publishInfo, req.GetReadonly())
 	if err != nil {
 		if os.IsPermission(err) {
 			return nil, status.Error(codes.PermissionDenied, err.Error())
@@ -812,10 +928,27 @@ func (p *Plugin) nodePublishNFSVolume(
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	trackPublishedMountOptions(ctx, req, "nfs", publishInfo.MountOptions)
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// trackPublishedMountOptions has the mount reconciler check a published mount's options against those desired for
+// it.  Mount flags in the request, as from a PV's mount options, replace the volume's own options, as they do when
+// the volume is published, so that options changed since it was mounted reach the mount.
+func trackPublishedMountOptions(ctx context.Context, req *csi.NodePublishVolumeRequest, fstype, options string) {
+
+	if volumeMount := req.GetVolumeCapability().GetMount(); volumeMount != nil && len(volumeMount.MountFlags) > 0 {
+		options = strings.Join(volumeMount.MountFlags, ",")
+	}
+	if req.GetReadonly() {
+		options = mount.MergeOptions(fstype, options, "ro")
+	} else {
+		options = mount.MergeOptions(fstype, options)
+	}
+	utils.TrackMountOptions(ctx, req.VolumeId, req.TargetPath, options)
+}
+
 func unstashIscsiTargetPortals(publishInfo *utils.VolumePublishInfo, reqPublishInfo map[string]string) error {
 
 	count, err := strconv.Atoi(reqPublishInfo["iscsiTargetPortalCount"])
@@ -838,38 +971,45 @@ func unstashIscsiTargetPortals(publishInfo *utils.VolumePublishInfo, reqPublishI
 	return nil
 }
 
-func (p *Plugin) nodeStageISCSIVolume(
-	ctx context.Context, req *csi.NodeStageVolumeRequest,
-) (*csi.NodeStageVolumeResponse, error) {
-
-	var err error
-	var fstype string
+// unstashIscsiAdditionalTargets reads any additional targets through which the LUN is mapped from the publish
+// context.  Older controllers don't send them, in which case only the primary target is used.
+func unstashIscsiAdditionalTargets(publishInfo *utils.VolumePublishInfo, reqPublishInfo map[string]string) error {
 
-	if p.nodePrep.Enabled {
-		p.nodePrepForISCSI(ctx)
+	targets, ok := reqPublishInfo["iscsiAdditionalTargets"]
+	if !ok || targets == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(targets), &publishInfo.IscsiAdditionalTargets); err != nil {
+		return fmt.Errorf("could not parse additional iSCSI targets; %v", err)
 	}
+	return nil
+}
 
-	mountCapability := req.GetVolumeCapability().GetMount()
-	blockCapability := req.GetVolumeCapability().GetBlock()
+// unstashSCSITimeouts reads the SCSI timeouts to set on each path of the LUN, if any, from the publish context.
+func unstashSCSITimeouts(publishInfo *utils.VolumePublishInfo, reqPublishInfo map[string]string) error {
 
-	if mountCapability == nil && blockCapability == nil {
-		return nil, status.Error(codes.InvalidArgument, "mount or block capability required")
-	} else if mountCapability != nil && blockCapability != nil {
-		return nil, status.Error(codes.InvalidArgument, "mixed block and mount capabilities")
+	timeouts, ok := reqPublishInfo["scsiTimeouts"]
+	if !ok || timeouts == "" {
+		return nil
 	}
-
-	if mountCapability != nil && mountCapability.GetFsType() != "" {
-		fstype = mountCapability.GetFsType()
+	publishInfo.SCSITimeouts = &utils.SCSITimeoutProfile{}
+	if err := json.Unmarshal([]byte(timeouts), publishInfo.SCSITimeouts); err != nil {
+		return fmt.Errorf("could not parse SCSI timeouts; %v", err)
 	}
+	return nil
+}
 
-	if fstype == "" {
-		fstype = req.PublishContext["filesystemType"]
+func (p *Plugin) nodeStageISCSIVolume(
+	ctx context.Context, req *csi.NodeStageVolumeRequest,
+) (*csi.NodeStageVolumeResponse, error) {
+
+	if p.nodePrep.Enabled {
+		p.nodePrepForISCSI(ctx)
 	}
 
-	if fstype == fsRaw && mountCapability != nil {
-		return nil, status.Error(codes.InvalidArgument, "mount capability requested with raw blocks")
-	} else if fstype != fsRaw && blockCapability != nil {
-		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("block capability requested with %s", fstype))
+	fstype, err := getBlockStageFilesystemType(req)
+	if err != nil {
+		return nil, err
 	}
 
 	useCHAP, err := strconv.ParseBool(req.PublishContext["useCHAP"])
@@ -892,12 +1032,19 @@ func (p *Plugin) nodeStageISCSIVolume(
 		FilesystemType: fstype,
 		UseCHAP:        useCHAP,
 		SharedTarget:   sharedTarget,
+		MultiAttach:    isMultiNodeAccessMode(req),
 	}
 
 	err = unstashIscsiTargetPortals(publishInfo, req.PublishContext)
 	if nil != err {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	if err = unstashIscsiAdditionalTargets(publishInfo, req.PublishContext); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err = unstashSCSITimeouts(publishInfo, req.PublishContext); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	publishInfo.MountOptions = req.PublishContext["mountOptions"]
 	publishInfo.IscsiTargetIQN = req.PublishContext["iscsiTargetIqn"]
 	publishInfo.IscsiLunNumber = int32(lunID)
@@ -905,6 +1052,10 @@ func (p *Plugin) nodeStageISCSIVolume(
 	publishInfo.IscsiInterface = req.PublishContext["iscsiInterface"]
 	publishInfo.IscsiIgroup = req.PublishContext["iscsiIgroup"]
 
+	if publishInfo.VolumeSize, err = getStageVolumeSize(req); err != nil {
+		return nil, err
+	}
+
 	if useCHAP {
 		publishInfo.IscsiUsername = req.PublishContext["iscsiUsername"]
 		publishInfo.IscsiInitiatorSecret = req.PublishContext["iscsiInitiatorSecret"]
@@ -925,8 +1076,139 @@ func (p *Plugin) nodeStageISCSIVolume(
 		}
 	}
 
+	// Any earlier detach of the volume is moot once it's staged again
+	if err = p.detachJournal.Discard(ctx, req.GetVolumeId()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	volumeName := req.VolumeContext["internalName"]
+	attachCtx := withStageProgress(ctx, volumeName)
+
 	// Perform the login/rescan/discovery/(optionally)format, mount & get the device back in the publish info
-	if err := utils.AttachISCSIVolume(ctx, req.VolumeContext["internalName"], "", publishInfo); err != nil {
+	if err := utils.StageVolume(attachCtx, volumeName, publishInfo); err != nil {
+		if utils.IsNodeSaturatedError(err) {
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		} else if utils.IsFormatFailedError(err) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		} else if utils.IsDeviceNotReadyError(err) {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	volumeId, stagingTargetPath, err := p.getVolumeIdAndStagingPath(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Save the device info to the staging path for use in the publish & unstage calls
+	if err := p.writeStagedDeviceInfo(ctx, stagingTargetPath, publishInfo, volumeId); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// getBlockStageFilesystemType returns the filesystem type a block volume is to be staged with, checking it against
+// the requested volume capability.
+func getBlockStageFilesystemType(req *csi.NodeStageVolumeRequest) (string, error) {
+
+	var fstype string
+
+	mountCapability := req.GetVolumeCapability().GetMount()
+	blockCapability := req.GetVolumeCapability().GetBlock()
+
+	if mountCapability == nil && blockCapability == nil {
+		return "", status.Error(codes.InvalidArgument, "mount or block capability required")
+	} else if mountCapability != nil && blockCapability != nil {
+		return "", status.Error(codes.InvalidArgument, "mixed block and mount capabilities")
+	}
+
+	if mountCapability != nil && mountCapability.GetFsType() != "" {
+		fstype = mountCapability.GetFsType()
+	}
+
+	if fstype == "" {
+		fstype = req.PublishContext["filesystemType"]
+	}
+
+	if fstype == fsRaw && mountCapability != nil {
+		return "", status.Error(codes.InvalidArgument, "mount capability requested with raw blocks")
+	} else if fstype != fsRaw && blockCapability != nil {
+		return "", status.Error(codes.InvalidArgument, fmt.Sprintf("block capability requested with %s", fstype))
+	}
+
+	return fstype, nil
+}
+
+// isMultiNodeAccessMode returns true if a volume may be staged on more than one node, in which case it mustn't be
+// formatted or otherwise modified as if this node owned it.
+func isMultiNodeAccessMode(req *csi.NodeStageVolumeRequest) bool {
+	switch req.GetVolumeCapability().GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		return true
+	}
+	return false
+}
+
+// getStageVolumeSize returns the volume size from the publish context.  Older controllers don't send it, in which
+// case zero is returned and the device size check is skipped.
+func getStageVolumeSize(req *csi.NodeStageVolumeRequest) (int64, error) {
+	volumeSize, ok := req.PublishContext["volumeSize"]
+	if !ok || volumeSize == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(volumeSize, 10, 64)
+	if err != nil {
+		return 0, status.Error(codes.Internal, err.Error())
+	}
+	return size, nil
+}
+
+// withStageProgress returns a context under which a long attach logs that it is still working rather than hung,
+// as when formatting a large volume takes minutes.
+func withStageProgress(ctx context.Context, volumeName string) context.Context {
+	return utils.WithAttachProgress(ctx, attachProgressInterval, func(stage string, elapsed time.Duration) {
+		fields := log.Fields{
+			"volume":  volumeName,
+			"stage":   stage,
+			"elapsed": elapsed.Round(time.Second).String(),
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			fields["remaining"] = time.Until(deadline).Round(time.Second).String()
+		}
+		Logc(ctx).WithFields(fields).Info("Still staging volume.")
+	})
+}
+
+// nodeStagePreAttachedVolume stages a LUN that the hypervisor already presents to this node as a local disk, such
+// as a virtio-blk or virtio-scsi device, finding it by its WWN or serial number rather than logging in to it.
+func (p *Plugin) nodeStagePreAttachedVolume(
+	ctx context.Context, req *csi.NodeStageVolumeRequest,
+) (*csi.NodeStageVolumeResponse, error) {
+
+	fstype, err := getBlockStageFilesystemType(req)
+	if err != nil {
+		return nil, err
+	}
+
+	publishInfo := &utils.VolumePublishInfo{
+		Localhost:      true,
+		FilesystemType: fstype,
+		MultiAttach:    isMultiNodeAccessMode(req),
+	}
+	publishInfo.MountOptions = req.PublishContext["mountOptions"]
+	publishInfo.PreAttachedDeviceWWN = req.PublishContext["preAttachedDeviceWwn"]
+	publishInfo.PreAttachedDeviceSerial = req.PublishContext["preAttachedDeviceSerial"]
+	if publishInfo.VolumeSize, err = getStageVolumeSize(req); err != nil {
+		return nil, err
+	}
+
+	volumeName := req.VolumeContext["internalName"]
+	if err = utils.AttachPreAttachedVolume(withStageProgress(ctx, volumeName), volumeName, "",
+		publishInfo); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
@@ -943,33 +1225,456 @@ func (p *Plugin) nodeStageISCSIVolume(
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// nodeUnstagePreAttachedVolume unstages a LUN that the hypervisor presents to this node as a local disk.  The disk
+// stays attached until the hypervisor detaches it, so only what staging did on this node is undone.
+func (p *Plugin) nodeUnstagePreAttachedVolume(
+	ctx context.Context, req *csi.NodeUnstageVolumeRequest, publishInfo *utils.VolumePublishInfo,
+) (*csi.NodeUnstageVolumeResponse, error) {
+
+	volumeId, stagingTargetPath, err := p.getVolumeIdAndStagingPath(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = utils.ExportZpool(ctx, publishInfo); err != nil && !p.unsafeDetach {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err = utils.ReleaseMultiAttachDevice(ctx, publishInfo); err != nil {
+		Logc(ctx).WithError(err).Warning("Could not release fencing of shared LUN.")
+	}
+
+	// Delete the device info we saved to the staging path so unstage can succeed
+	if err = p.clearStagedDeviceInfo(ctx, stagingTargetPath, volumeId); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// Ensure that the temporary mount point created during a filesystem expand operation is removed.
+	if err = utils.UmountAndRemoveTemporaryMountPoint(ctx, stagingTargetPath); err != nil {
+		Logc(ctx).WithField("stagingTargetPath", stagingTargetPath).Errorf(
+			"Failed to remove directory in staging target path; %s", err)
+		return nil, status.Errorf(codes.Internal, "failed to remove temporary directory in staging target path "+
+			"%s; %s", stagingTargetPath, err)
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// nodeStageNVMeVolume stages an NVMe namespace reached over Fibre Channel, connecting to its subsystem rather than
+// logging in to an iSCSI target.
+func (p *Plugin) nodeStageNVMeVolume(
+	ctx context.Context, req *csi.NodeStageVolumeRequest,
+) (*csi.NodeStageVolumeResponse, error) {
+
+	fstype, err := getBlockStageFilesystemType(req)
+	if err != nil {
+		return nil, err
+	}
+
+	publishInfo := &utils.VolumePublishInfo{
+		Localhost:      true,
+		FilesystemType: fstype,
+		MultiAttach:    isMultiNodeAccessMode(req),
+	}
+	publishInfo.MountOptions = req.PublishContext["mountOptions"]
+	publishInfo.NVMeSubsystemNQN = req.PublishContext["nvmeSubsystemNqn"]
+	publishInfo.NVMeNamespaceUUID = req.PublishContext["nvmeNamespaceUuid"]
+	if targetPorts := req.PublishContext["nvmeTargetPorts"]; targetPorts != "" {
+		publishInfo.NVMeTargetPorts = strings.Split(targetPorts, ",")
+	}
+	if publishInfo.VolumeSize, err = getStageVolumeSize(req); err != nil {
+		return nil, err
+	}
+
+	volumeName := req.VolumeContext["internalName"]
+	if err = utils.AttachNVMeVolume(withStageProgress(ctx, volumeName), volumeName, "", publishInfo); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	volumeId, stagingTargetPath, err := p.getVolumeIdAndStagingPath(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Save the device info to the staging path for use in the publish & unstage calls
+	if err := p.writeStagedDeviceInfo(ctx, stagingTargetPath, publishInfo, volumeId); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// nodeUnstageNVMeVolume unstages an NVMe namespace, disconnecting from its subsystem once no other namespace of the
+// subsystem is presented to this node.
+func (p *Plugin) nodeUnstageNVMeVolume(
+	ctx context.Context, req *csi.NodeUnstageVolumeRequest, publishInfo *utils.VolumePublishInfo,
+) (*csi.NodeUnstageVolumeResponse, error) {
+
+	volumeId, stagingTargetPath, err := p.getVolumeIdAndStagingPath(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = utils.ExportZpool(ctx, publishInfo); err != nil && !p.unsafeDetach {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err = utils.ReleaseMultiAttachDevice(ctx, publishInfo); err != nil {
+		Logc(ctx).WithError(err).Warning("Could not release fencing of shared namespace.")
+	}
+	if err = utils.DetachNVMeVolume(ctx, publishInfo); err != nil && !p.unsafeDetach {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// Delete the device info we saved to the staging path so unstage can succeed
+	if err = p.clearStagedDeviceInfo(ctx, stagingTargetPath, volumeId); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// Ensure that the temporary mount point created during a filesystem expand operation is removed.
+	if err = utils.UmountAndRemoveTemporaryMountPoint(ctx, stagingTargetPath); err != nil {
+		Logc(ctx).WithField("stagingTargetPath", stagingTargetPath).Errorf(
+			"Failed to remove directory in staging target path; %s", err)
+		return nil, status.Errorf(codes.Internal, "failed to remove temporary directory in staging target path "+
+			"%s; %s", stagingTargetPath, err)
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
 func (p *Plugin) nodeUnstageISCSIVolume(
 	ctx context.Context, req *csi.NodeUnstageVolumeRequest, publishInfo *utils.VolumePublishInfo,
 ) (*csi.NodeUnstageVolumeResponse, error) {
 
+	volumeId, stagingTargetPath, err := p.getVolumeIdAndStagingPath(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the detach before changing anything, so that if it's interrupted it can be resumed, here or by
+	// the recovery scan, rather than mistaken for a volume that was never detached
+	entry, err := p.detachJournal.Begin(ctx, volumeId, stagingTargetPath, publishInfo)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if err = p.detachISCSIVolume(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// Stages of an iSCSI detach, as recorded in the detach journal
+const (
+	detachStageRelease      = "release"
+	detachStageRemoveDevice = "removeDevice"
+	detachStageLogout       = "logout"
+	detachStageClearStaging = "clearStaging"
+)
+
+// detachISCSIVolume runs the stages of an iSCSI detach that the journal entry doesn't record as complete,
+// recording each as it completes, and removes the entry once they all have.
+func (p *Plugin) detachISCSIVolume(ctx context.Context, entry *utils.DetachJournalEntry) error {
+
+	publishInfo := entry.PublishInfo
+
+	// runStage runs a stage unless it completed before, and records it unless it failed
+	runStage := func(stage string, run func() error) error {
+		if entry.IsComplete(stage) {
+			return nil
+		}
+		if err := run(); err != nil {
+			return err
+		}
+		return p.detachJournal.Complete(ctx, entry, stage)
+	}
+
+	// fence asks the detach fencer whether a failed stage may be forced through because this node has been fenced
+	// from the LUN, which lets the workload move even though I/O to the LUN is stuck
+	fence := func(stage, targetIQN string, lun int32, err error) bool {
+		return utils.FenceFailedDetach(ctx, utils.DetachFailure{
+			VolumeID:    entry.VolumeID,
+			Stage:       stage,
+			TargetIQN:   targetIQN,
+			LUN:         int(lun),
+			PublishInfo: publishInfo,
+			Err:         err,
+		}) == utils.DetachFenceForce
+	}
+
+	err := runStage(detachStageRelease, func() error {
+		// A zpool must be exported before its LUN goes away, or it can't be imported cleanly elsewhere
+		if err := utils.ExportZpool(ctx, publishInfo); err != nil && !p.unsafeDetach {
+			if !fence(detachStageRelease, publishInfo.IscsiTargetIQN, publishInfo.IscsiLunNumber, err) {
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+
+		// Give up this node's claim on a shared LUN while it can still be reached
+		if err := utils.ReleaseMultiAttachDevice(ctx, publishInfo); err != nil {
+			Logc(ctx).WithError(err).Warning("Could not release fencing of shared LUN.")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
 	// Delete the device from the host
-	err := utils.PrepareDeviceForRemoval(ctx, int(publishInfo.IscsiLunNumber), publishInfo.IscsiTargetIQN,
-		p.unsafeDetach)
-	if nil != err && !p.unsafeDetach {
+	err = runStage(detachStageRemoveDevice+"/"+publishInfo.IscsiTargetIQN, func() error {
+		err := utils.PrepareDeviceForRemoval(ctx, int(publishInfo.IscsiLunNumber), publishInfo.IscsiTargetIQN,
+			p.unsafeDetach)
+		if nil != err && !p.unsafeDetach {
+			if !fence(detachStageRemoveDevice, publishInfo.IscsiTargetIQN, publishInfo.IscsiLunNumber, err) {
+				return err
+			}
+			// The node is fenced, so I/O still pending may be discarded
+			if err = utils.PrepareDeviceForRemoval(ctx, int(publishInfo.IscsiLunNumber),
+				publishInfo.IscsiTargetIQN, true); err != nil {
+				Logc(ctx).WithError(err).Warning("Could not remove all devices of fenced LUN.")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The multipath device is gone, so remove the paths through any additional targets and log out of them
+	for _, target := range publishInfo.IscsiAdditionalTargets {
+		err = runStage(detachStageRemoveDevice+"/"+target.IQN, func() error {
+			err := utils.PrepareDeviceForRemoval(ctx, int(target.LunNumber), target.IQN, p.unsafeDetach)
+			if nil != err && !p.unsafeDetach {
+				if !fence(detachStageRemoveDevice, target.IQN, target.LunNumber, err) {
+					return err
+				}
+				if err = utils.PrepareDeviceForRemoval(ctx, int(target.LunNumber), target.IQN, true); err != nil {
+					Logc(ctx).WithError(err).Warning("Could not remove all devices of fenced LUN.")
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		p.logoutISCSITargetIfUnused(ctx, target.IQN, target.Portals, publishInfo.SharedTarget)
+	}
+
+	err = runStage(detachStageLogout, func() error {
+		p.logoutISCSITargetIfUnused(ctx, publishInfo.IscsiTargetIQN,
+			append([]string{publishInfo.IscsiTargetPortal}, publishInfo.IscsiPortals...), publishInfo.SharedTarget)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	stagingTargetPath := entry.StagingTargetPath
+	err = runStage(detachStageClearStaging, func() error {
+		// Delete the device info we saved to the staging path so unstage can succeed
+		if err := p.clearStagedDeviceInfo(ctx, stagingTargetPath, entry.VolumeID); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		// Ensure that the temporary mount point created during a filesystem expand operation is removed.
+		if err := utils.UmountAndRemoveTemporaryMountPoint(ctx, stagingTargetPath); err != nil {
+			Logc(ctx).WithField("stagingTargetPath", stagingTargetPath).Errorf(
+				"Failed to remove directory in staging target path; %s", err)
+			return fmt.Errorf("failed to remove temporary directory in staging target path %s; %s",
+				stagingTargetPath, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.detachJournal.Finish(ctx, entry)
+}
+
+// getTrackedStagingPaths returns the staging target paths of the volumes staged on this node, by volume ID,
+// according to their tracking files.
+func (p *Plugin) getTrackedStagingPaths(ctx context.Context) (map[string]string, error) {
+
+	files, err := ioutil.ReadDir(tridentDeviceInfoPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]string{}, nil
+		}
 		return nil, err
 	}
 
+	stagingTargetPaths := make(map[string]string)
+	for _, file := range files {
+		if file.IsDir() || file.Name() == nodePrepBreadcrumbFilename || path.Ext(file.Name()) != ".json" {
+			continue
+		}
+		volumeID := strings.TrimSuffix(file.Name(), ".json")
+		stagingTargetPath, err := p.readStagedTrackingFile(ctx, volumeID)
+		if err != nil {
+			continue
+		}
+		stagingTargetPaths[volumeID] = stagingTargetPath
+	}
+	return stagingTargetPaths, nil
+}
+
+// getTrackedISCSITargets returns the IQNs of the targets of the iSCSI volumes staged on this node, according to
+// their tracking files.
+func (p *Plugin) getTrackedISCSITargets(ctx context.Context) ([]string, error) {
+
+	stagingTargetPaths, err := p.getTrackedStagingPaths(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	iqns := make([]string, 0)
+	for volumeID, stagingTargetPath := range stagingTargetPaths {
+		publishInfo, err := p.readStagedDeviceInfo(ctx, stagingTargetPath)
+		if err != nil {
+			Logc(ctx).WithField("volumeID", volumeID).WithError(err).Debug("Could not read staged device info.")
+			continue
+		}
+		if publishInfo.IscsiTargetIQN == "" {
+			continue
+		}
+		if !utils.StringInSlice(publishInfo.IscsiTargetIQN, iqns) {
+			iqns = append(iqns, publishInfo.IscsiTargetIQN)
+		}
+		for _, target := range publishInfo.IscsiAdditionalTargets {
+			if !utils.StringInSlice(target.IQN, iqns) {
+				iqns = append(iqns, target.IQN)
+			}
+		}
+	}
+	return iqns, nil
+}
+
+// reconcileISCSIStartup makes sure that iscsid won't log in to the targets of staged volumes when this node boots,
+// leaving that to the stage calls made once this plugin has started.
+func (p *Plugin) reconcileISCSIStartup(ctx context.Context) {
+
+	if !utils.ISCSISupported(ctx) {
+		return
+	}
+
+	_, _ = utils.RunHostOperation(ctx, utils.HostOperationReconcile, "", func() (interface{}, error) {
+		iqns, err := p.getTrackedISCSITargets(ctx)
+		if err != nil {
+			Logc(ctx).WithError(err).Warning("Could not list iSCSI targets of staged volumes.")
+			return nil, nil
+		}
+		if _, err = utils.EnsureManualISCSIStartup(ctx, iqns); err != nil {
+			Logc(ctx).WithError(err).Warning("Could not verify iSCSI startup modes.")
+		}
+		return nil, nil
+	})
+}
+
+// trackStagedSCSITimeouts resumes applying the SCSI timeout profiles of staged iSCSI volumes to their LUNs' paths,
+// which this node plugin otherwise only remembers from when it staged them.
+func (p *Plugin) trackStagedSCSITimeouts(ctx context.Context) {
+
+	stagingTargetPaths, err := p.getTrackedStagingPaths(ctx)
+	if err != nil {
+		Logc(ctx).WithError(err).Warning("Could not list staged volumes.")
+		return
+	}
+
+	for volumeID, stagingTargetPath := range stagingTargetPaths {
+		volumeCtx := WithLogFields(ctx, log.Fields{LogFieldVolumeID: volumeID})
+		publishInfo, err := p.readStagedDeviceInfo(volumeCtx, stagingTargetPath)
+		if err != nil || publishInfo.IscsiTargetIQN == "" || publishInfo.SCSITimeouts == nil {
+			continue
+		}
+		if err = utils.TrackSCSITimeouts(volumeCtx, publishInfo); err != nil {
+			Logc(volumeCtx).WithError(err).Warning("Could not set SCSI timeouts.")
+		}
+	}
+}
+
+// removeUdevRulesIfUnused removes the host's udev rules for Trident's LUNs when this node plugin stops with no
+// volumes staged, as when Trident is uninstalled.  The rules are kept while any are staged, so that their LUNs'
+// paths are tuned as the host re-adds them, as when it reboots.
+func (p *Plugin) removeUdevRulesIfUnused(ctx context.Context) {
+
+	if stagingTargetPaths, err := p.getTrackedStagingPaths(ctx); err != nil || len(stagingTargetPaths) > 0 {
+		return
+	}
+	if err := utils.RemoveUdevRules(ctx); err != nil {
+		Logc(ctx).WithError(err).Warning("Could not remove udev rules.")
+	}
+}
+
+// removeStaleTemporaryMountPoints removes the temporary mountpoints of staged volumes, such as those made to grow
+// their filesystems, that a crash or restart of this node plugin left behind.  No operation that could be using
+// one runs until this node plugin starts serving requests.
+func (p *Plugin) removeStaleTemporaryMountPoints(ctx context.Context) {
+
+	stagingTargetPaths, err := p.getTrackedStagingPaths(ctx)
+	if err != nil {
+		Logc(ctx).WithError(err).Warning("Could not list staged volumes.")
+		return
+	}
+
+	for volumeID, stagingTargetPath := range stagingTargetPaths {
+		volumeCtx := WithLogFields(ctx, log.Fields{LogFieldVolumeID: volumeID})
+		if err = utils.UmountAndRemoveTemporaryMountPoint(volumeCtx, stagingTargetPath); err != nil {
+			Logc(volumeCtx).WithError(err).Warning("Could not remove temporary mountpoints.")
+		}
+	}
+}
+
+// recoverInterruptedDetaches completes the iSCSI detaches that the detach journal shows were interrupted, as by
+// a crash or restart of this node plugin.  A detach that fails again is left in the journal, to be resumed by
+// the next NodeUnstageVolume of the volume.
+func (p *Plugin) recoverInterruptedDetaches(ctx context.Context) {
+
+	entries, err := p.detachJournal.Pending(ctx)
+	if err != nil {
+		Logc(ctx).WithError(err).Error("Could not read detach journal.")
+		return
+	}
+
+	for _, entry := range entries {
+		entryCtx := WithLogFields(ctx, log.Fields{LogFieldVolumeID: entry.VolumeID})
+		Logc(entryCtx).WithFields(log.Fields{
+			"started":   entry.Started,
+			"completed": entry.Completed,
+		}).Info("Completing interrupted detach.")
+
+		if entry.PublishInfo == nil {
+			Logc(entryCtx).Warning("Detach journal entry has no publish info, discarding it.")
+			_ = p.detachJournal.Discard(entryCtx, entry.VolumeID)
+			continue
+		}
+		_, err := utils.RunHostOperation(entryCtx, utils.HostOperationDetach, entry.VolumeID,
+			func() (interface{}, error) { return nil, p.detachISCSIVolume(entryCtx, entry) })
+		if err != nil {
+			Logc(entryCtx).WithError(err).Warning("Could not complete interrupted detach.")
+		}
+	}
+}
+
+// logoutISCSITargetIfUnused logs out of a target's portals if the target isn't shared, or if no mounts of any
+// device on the shared target remain.
+func (p *Plugin) logoutISCSITargetIfUnused(ctx context.Context, targetIQN string, portals []string, sharedTarget bool) {
+
 	// Get map of hosts and sessions for given Target IQN
-	hostSessionMap := utils.GetISCSIHostSessionMapForTarget(ctx, publishInfo.IscsiTargetIQN)
+	hostSessionMap := utils.GetISCSIHostSessionMapForTarget(ctx, targetIQN)
 	if len(hostSessionMap) == 0 {
-		Logc(ctx).Warnf("no iSCSI hosts found for target %s", publishInfo.IscsiTargetIQN)
+		Logc(ctx).Warnf("no iSCSI hosts found for target %s", targetIQN)
 	}
 
 	// Logout of the iSCSI session if appropriate for each applicable host
 	logout := false
 	for hostNumber, sessionNumber := range hostSessionMap {
-		if !publishInfo.SharedTarget {
+		if !sharedTarget {
 			// Always log out of a non-shared target
 			logout = true
 			break
 		} else {
 			// Log out of a shared target if no mounts to that target remain
-			anyMounts, err := utils.ISCSITargetHasMountedDevice(ctx, publishInfo.IscsiTargetIQN)
+			anyMounts, err := utils.ISCSITargetHasMountedDevice(ctx, targetIQN)
 			if logout = (err == nil) && !anyMounts && utils.SafeToLogOut(ctx, hostNumber, sessionNumber); logout {
 				break
 			}
@@ -979,35 +1684,12 @@ func (p *Plugin) nodeUnstageISCSIVolume(
 	if logout {
 		Logc(ctx).Debug("Safe to log out")
 
-		if err := utils.ISCSILogout(ctx, publishInfo.IscsiTargetIQN, publishInfo.IscsiTargetPortal); err != nil {
-			Logc(ctx).Error(err)
-		}
-		for _, portal := range publishInfo.IscsiPortals {
-			if err := utils.ISCSILogout(ctx, publishInfo.IscsiTargetIQN, portal); err != nil {
+		for _, portal := range portals {
+			if err := utils.ISCSILogout(ctx, targetIQN, portal); err != nil {
 				Logc(ctx).Error(err)
 			}
 		}
 	}
-
-	volumeId, stagingTargetPath, err := p.getVolumeIdAndStagingPath(req)
-	if err != nil {
-		return nil, err
-	}
-
-	// Delete the device info we saved to the staging path so unstage can succeed
-	if err := p.clearStagedDeviceInfo(ctx, stagingTargetPath, volumeId); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	// Ensure that the temporary mount point created during a filesystem expand operation is removed.
-	if err := utils.UmountAndRemoveTemporaryMountPoint(ctx, stagingTargetPath); err != nil {
-		Logc(ctx).WithField("stagingTargetPath", stagingTargetPath).Errorf(
-			"Failed to remove directory in staging target path; %s", err)
-		return nil, fmt.Errorf("failed to remove temporary directory in staging target path %s; %s",
-			stagingTargetPath, err)
-	}
-
-	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 func (p *Plugin) nodePublishISCSIVolume(
@@ -1022,37 +1704,62 @@ func (p *Plugin) nodePublishISCSIVolume(
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	if req.GetReadonly() {
-		mountOptions := strings.Split(publishInfo.MountOptions, ",")
-		mountOptions = append(mountOptions, "ro")
-		publishInfo.MountOptions = strings.Join(mountOptions, ",")
+	volumeName := req.VolumeContext["internalName"]
+	err = utils.PublishVolume(ctx, volumeName, req.TargetPath, publishInfo, req.GetReadonly())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to publish volume; %s", err)
+	}
+
+	// Only a filesystem mounted from the LUN's device has its options reconciled and is trimmed
+	if publishInfo.FilesystemType != fsRaw && publishInfo.Zpool == "" {
+		trackPublishedMountOptions(ctx, req, publishInfo.FilesystemType, publishInfo.MountOptions)
+
+		// Trimming returns space freed by deleted files to a thin LUN, so it's only useful on writable mounts
+		if publishInfo.SupportsDiscard && !req.GetReadonly() && !publishInfo.ReadOnlyClone {
+			var interval time.Duration
+			if value, ok := req.VolumeContext[fstrimIntervalAttribute]; ok {
+				if interval, err = time.ParseDuration(value); err != nil {
+					Logc(ctx).WithField(fstrimIntervalAttribute, value).Warning(
+						"Invalid trim interval; using the node's default.")
+					interval = 0
+				}
+			}
+			utils.TrackTrimMount(ctx, req.VolumeId, req.TargetPath, interval)
+		}
 	}
 
-	isRawBlock := publishInfo.FilesystemType == fsRaw
-	if isRawBlock {
+	return &csi.NodePublishVolumeResponse{}, nil
+}
 
-		if len(publishInfo.MountOptions) > 0 {
-			mountOptions := strings.Split(publishInfo.MountOptions, ",")
-			mountOptions = append(mountOptions, "bind")
-			publishInfo.MountOptions = strings.Join(mountOptions, ",")
-		} else {
-			publishInfo.MountOptions = "bind"
-		}
+// AdoptExistingAttachment takes over an iSCSI volume attached and mounted on this node by something other than
+// Trident, recording it at its staging path as if Trident had staged it, so that its publish, resize, and unstage
+// work from then on.  The publish info describes the LUN expected at the mountpoint, as the publish context
+// would; the adoption fails without recording anything if the mount doesn't match it.
+func (p *Plugin) AdoptExistingAttachment(
+	ctx context.Context, volumeID, stagingTargetPath, mountpoint string, publishInfo *utils.VolumePublishInfo,
+) error {
 
-		// Place the block device at the target path for the raw-block
-		err = utils.MountDevice(ctx, publishInfo.DevicePath, req.TargetPath, publishInfo.MountOptions, true)
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "unable to bind mount raw device; %s", err)
+	fields := log.Fields{"volumeID": volumeID, "stagingTargetPath": stagingTargetPath, "mountpoint": mountpoint}
+	Logc(ctx).WithFields(fields).Debug(">>>> AdoptExistingAttachment")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< AdoptExistingAttachment")
+
+	_, err := utils.RunHostOperation(ctx, utils.HostOperationAttach, volumeID, func() (interface{}, error) {
+
+		if err := utils.AdoptExistingAttachment(ctx, volumeID, mountpoint, publishInfo); err != nil {
+			return nil, err
 		}
-	} else {
-		// Mount the device
-		err = utils.MountDevice(ctx, publishInfo.DevicePath, req.TargetPath, publishInfo.MountOptions, false)
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "unable to mount device; %s", err)
+
+		// Any earlier detach of the volume is moot once it's adopted
+		if err := p.detachJournal.Discard(ctx, volumeID); err != nil {
+			return nil, err
 		}
-	}
 
-	return &csi.NodePublishVolumeResponse{}, nil
+		if err := utils.EnsureDirExists(ctx, stagingTargetPath); err != nil {
+			return nil, err
+		}
+		return nil, p.writeStagedDeviceInfo(ctx, stagingTargetPath, publishInfo, volumeID)
+	})
+	return err
 }
 
 func (p *Plugin) writeStagedDeviceInfo(
@@ -1203,7 +1910,9 @@ func (p *Plugin) clearStagedTrackingFile(ctx context.Context, volumeId string) e
 }
 
 func (p *Plugin) getVolumeProtocolFromPublishInfo(publishInfo *utils.VolumePublishInfo) (tridentconfig.Protocol, error) {
-	if publishInfo.VolumeAccessInfo.NfsServerIP != "" && publishInfo.VolumeAccessInfo.IscsiTargetIQN == "" {
+	if (publishInfo.IsPreAttached() || publishInfo.IsNVMe()) && publishInfo.VolumeAccessInfo.NfsServerIP == "" {
+		return tridentconfig.Block, nil
+	} else if publishInfo.VolumeAccessInfo.NfsServerIP != "" && publishInfo.VolumeAccessInfo.IscsiTargetIQN == "" {
 		return tridentconfig.File, nil
 	} else if publishInfo.VolumeAccessInfo.IscsiTargetIQN != "" && publishInfo.VolumeAccessInfo.NfsServerIP == "" {
 		return tridentconfig.Block, nil
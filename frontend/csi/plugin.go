@@ -38,6 +38,12 @@ type Plugin struct {
 
 	unsafeDetach bool
 
+	// reportNodeTopology adds this node's storage protocols and subnets to the topology labels it reports
+	reportNodeTopology bool
+
+	// detachJournal records the progress of iSCSI detaches so interrupted ones can be completed
+	detachJournal *utils.DetachJournal
+
 	hostInfo *utils.HostSystem
 	nodePrep *utils.NodePrep
 
@@ -103,21 +109,23 @@ func NewControllerPlugin(
 
 func NewNodePlugin(
 	nodeName, endpoint, caCert, clientCert, clientKey, aesKeyFile string, orchestrator core.Orchestrator,
-	unsafeDetach, nodePrep bool,
+	unsafeDetach, nodePrep, reportNodeTopology bool,
 ) (*Plugin, error) {
 
 	ctx := GenerateRequestContext(context.Background(), "", ContextSourceInternal)
 
 	p := &Plugin{
-		orchestrator: orchestrator,
-		name:         Provisioner,
-		nodeName:     nodeName,
-		version:      tridentconfig.OrchestratorVersion.ShortString(),
-		endpoint:     endpoint,
-		role:         CSINode,
-		unsafeDetach: unsafeDetach,
-		opCache:      sync.Map{},
-		nodePrep:     &utils.NodePrep{Enabled: nodePrep},
+		orchestrator:       orchestrator,
+		name:               Provisioner,
+		nodeName:           nodeName,
+		version:            tridentconfig.OrchestratorVersion.ShortString(),
+		endpoint:           endpoint,
+		role:               CSINode,
+		unsafeDetach:       unsafeDetach,
+		reportNodeTopology: reportNodeTopology,
+		detachJournal:      utils.NewDetachJournal(detachJournalPath),
+		opCache:            sync.Map{},
+		nodePrep:           &utils.NodePrep{Enabled: nodePrep},
 	}
 
 	// Initialize node prep statuses
@@ -172,22 +180,24 @@ func NewNodePlugin(
 func NewAllInOnePlugin(
 	nodeName, endpoint, caCert, clientCert, clientKey, aesKeyFile string,
 	orchestrator core.Orchestrator, helper *helpers.HybridPlugin,
-	unsafeDetach, nodePrep bool,
+	unsafeDetach, nodePrep, reportNodeTopology bool,
 ) (*Plugin, error) {
 
 	ctx := GenerateRequestContext(context.Background(), "", ContextSourceInternal)
 
 	p := &Plugin{
-		orchestrator: orchestrator,
-		name:         Provisioner,
-		nodeName:     nodeName,
-		version:      tridentconfig.OrchestratorVersion.ShortString(),
-		endpoint:     endpoint,
-		role:         CSIAllInOne,
-		unsafeDetach: unsafeDetach,
-		helper:       *helper,
-		opCache:      sync.Map{},
-		nodePrep:     &utils.NodePrep{Enabled: nodePrep},
+		orchestrator:       orchestrator,
+		name:               Provisioner,
+		nodeName:           nodeName,
+		version:            tridentconfig.OrchestratorVersion.ShortString(),
+		endpoint:           endpoint,
+		role:               CSIAllInOne,
+		unsafeDetach:       unsafeDetach,
+		reportNodeTopology: reportNodeTopology,
+		detachJournal:      utils.NewDetachJournal(detachJournalPath),
+		helper:             *helper,
+		opCache:            sync.Map{},
+		nodePrep:           &utils.NodePrep{Enabled: nodePrep},
 	}
 
 	// Initialize node prep statuses
@@ -248,7 +258,15 @@ func (p *Plugin) Activate() error {
 
 		Logc(ctx).Info("Activating CSI frontend.")
 		if p.role == CSINode || p.role == CSIAllInOne {
+			p.recoverInterruptedDetaches(ctx)
+			p.removeStaleTemporaryMountPoints(ctx)
+			p.reconcileISCSIStartup(ctx)
+			p.trackStagedSCSITimeouts(ctx)
+			utils.InstallUdevRules(ctx)
 			p.nodeRegisterWithController(ctx, 0) // Retry indefinitely
+			utils.StartISCSISessionMonitor(ctx, updateISCSISessionMetrics)
+			utils.StartTrimScheduler(ctx, updateTrimMetrics)
+			utils.StartMountReconciler(ctx, updateMountDriftMetrics)
 		}
 		p.grpc.Start(p.endpoint, p, p, p)
 	}()
@@ -259,6 +277,12 @@ func (p *Plugin) Deactivate() error {
 	ctx := GenerateRequestContext(context.Background(), "", ContextSourceInternal)
 
 	Logc(ctx).Info("Deactivating CSI frontend.")
+	utils.StopISCSISessionMonitor()
+	utils.StopTrimScheduler()
+	utils.StopMountReconciler()
+	if p.role == CSINode || p.role == CSIAllInOne {
+		p.removeUdevRulesIfUnused(ctx)
+	}
 	p.grpc.GracefulStop()
 	return nil
 }
@@ -113,6 +113,7 @@ func (c *RestClient) InvokeAPI(
 
 type CreateNodeResponse struct {
 	TopologyLabels map[string]string `json:"topologyLabels"`
+	Error          string            `json:"error,omitempty"`
 }
 
 // CreateNode registers the node with the CSI controller server
@@ -130,7 +131,9 @@ func (c *RestClient) CreateNode(ctx context.Context, node *utils.Node) (CreateNo
 		return createResponse, fmt.Errorf("could not parse node : %s; %v", string(respBody), err)
 	}
 
-	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+	if resp.StatusCode == http.StatusConflict {
+		return createResponse, utils.DuplicateInitiatorError(createResponse.Error)
+	} else if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
 		return createResponse, fmt.Errorf("could not add CSI node")
 	}
 	return createResponse, nil
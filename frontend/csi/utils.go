@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 
 	. "github.com/netapp/trident/logger"
@@ -54,6 +55,12 @@ func NewNodeServiceCapability(cap csi.NodeServiceCapability_RPC_Type) *csi.NodeS
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 
 	ctx = GenerateRequestContext(ctx, "", ContextSourceCSI)
+
+	// Tag everything logged on behalf of a volume request with the volume's ID
+	if volumeRequest, ok := req.(interface{ GetVolumeId() string }); ok && volumeRequest.GetVolumeId() != "" {
+		ctx = WithLogFields(ctx, log.Fields{LogFieldVolumeID: volumeRequest.GetVolumeId()})
+	}
+
 	Logc(ctx).Debugf("GRPC call: %s", info.FullMethod)
 	Logc(ctx).Debugf("GRPC request: %+v", req)
 	resp, err := handler(ctx, req)
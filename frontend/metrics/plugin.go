@@ -4,6 +4,7 @@ package metrics
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -11,8 +12,16 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/netapp/trident/config"
+	. "github.com/netapp/trident/logger"
+	"github.com/netapp/trident/utils"
 )
 
+// ISCSISessionsPath serves the health and statistics of this host's iSCSI sessions as JSON
+const ISCSISessionsPath = "/iscsi/sessions"
+
+// TrimResultsPath serves the most recent background trim of each mounted volume as JSON
+const TrimResultsPath = "/fstrim"
+
 type Server struct {
 	server *http.Server
 }
@@ -20,10 +29,15 @@ type Server struct {
 // NewMetricsServer see also: https://godoc.org/github.com/prometheus/client_golang/prometheus/promauto
 func NewMetricsServer(address, port string) *Server {
 
+	mux := http.NewServeMux()
+	mux.Handle("/", promhttp.Handler())
+	mux.HandleFunc(ISCSISessionsPath, getISCSISessions)
+	mux.HandleFunc(TrimResultsPath, getTrimResults)
+
 	metricsServer := &Server{
 		server: &http.Server{
 			Addr:         fmt.Sprintf("%s:%s", address, port),
-			Handler:      promhttp.Handler(),
+			Handler:      mux,
 			ReadTimeout:  config.HTTPTimeout,
 			WriteTimeout: config.HTTPTimeout,
 		},
@@ -45,6 +59,47 @@ func (s *Server) Activate() error {
 	return nil
 }
 
+// getISCSISessions writes the health and statistics of each iSCSI session, such as error and byte counts, so
+// that they can be correlated with application latency on this node.  They're as the session monitor last found
+// them, and unavailable if it isn't running.
+func getISCSISessions(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := GenerateRequestContext(r.Context(), "", ContextSourceREST)
+	sessions, monitored := utils.GetISCSISessionHealth()
+	if !monitored {
+		http.Error(w, "the iSCSI session monitor is not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		Logc(ctx).WithError(err).Error("Could not write iSCSI sessions.")
+	}
+}
+
+// getTrimResults writes when each volume tracked by the trim scheduler was last trimmed, how much was trimmed, and
+// any error.
+func getTrimResults(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := GenerateRequestContext(r.Context(), "", ContextSourceREST)
+	results := utils.GetTrimResults()
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		Logc(ctx).WithError(err).Error("Could not write trim results.")
+	}
+}
+
 func (s *Server) Deactivate() error {
 	log.WithField("address", s.server.Addr).Info("Deactivating metrics frontend.")
 	ctx, cancel := context.WithTimeout(context.Background(), config.HTTPTimeout)
@@ -37,6 +37,8 @@ func httpStatusCodeForAdd(err error) int {
 		return http.StatusServiceUnavailable
 	} else if utils.IsBootstrapError(err) {
 		return http.StatusInternalServerError
+	} else if utils.IsDuplicateInitiatorError(err) {
+		return http.StatusConflict
 	} else {
 		return http.StatusBadRequest
 	}
@@ -8,9 +8,55 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// defaultLogger is used for contexts that don't carry their own logger.  Nil means the global logrus logger.
+var defaultLogger *log.Logger
+
+// SetDefaultLogger routes log output for contexts that don't carry their own logger to the specified logger.
+// Passing nil restores the global logrus logger.  It should be called once at startup.
+func SetDefaultLogger(logger *log.Logger) {
+	defaultLogger = logger
+}
+
+// WithLogger returns a context whose log output goes to the specified entry, including any fields it carries.
+// Embedding applications may use this to route output to their own backend (via logrus hooks or formatters),
+// to change the level for a single operation, or to attach fields such as a volume name.
+func WithLogger(ctx context.Context, entry *log.Entry) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, ContextKeyLogger, entry)
+}
+
+// WithLogFields returns a context whose log output includes the specified fields in addition to any already
+// attached to the context's logger.  Operations that work on a volume, device or target should attach fields
+// identifying it, named with the LogField constants, when they start, rather than each function they call
+// logging its own subset; the fields then appear on every line logged for the operation, so interleaved
+// operations can be told apart.
+func WithLogFields(ctx context.Context, fields log.Fields) context.Context {
+	return WithLogger(ctx, contextLogger(ctx).WithFields(fields))
+}
+
+// contextLogger returns the entry attached to the context, else an entry on the default logger.
+func contextLogger(ctx context.Context) *log.Entry {
+	if ctx != nil {
+		if entry, ok := ctx.Value(ContextKeyLogger).(*log.Entry); ok && entry != nil {
+			return entry
+		}
+	}
+	if defaultLogger != nil {
+		return log.NewEntry(defaultLogger)
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// Logc returns an entry for logging on behalf of the context, carrying its logger's fields and its request ID
+// and source.
 func Logc(ctx context.Context) *log.Entry {
 
-	return log.WithFields(log.Fields{
+	if ctx == nil {
+		return contextLogger(ctx)
+	}
+	return contextLogger(ctx).WithFields(log.Fields{
 		"requestID":     ctx.Value(ContextKeyRequestID),
 		"requestSource": ctx.Value(ContextKeyRequestSource),
 	})
@@ -0,0 +1,84 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package logger
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLogger(buf *bytes.Buffer) *log.Logger {
+	logger := log.New()
+	logger.Out = buf
+	logger.Level = log.DebugLevel
+	logger.Formatter = &log.TextFormatter{DisableTimestamp: true, DisableColors: true}
+	return logger
+}
+
+func TestLogcWithLogger(t *testing.T) {
+
+	var buf bytes.Buffer
+	logger := newTestLogger(&buf)
+
+	ctx := GenerateRequestContext(context.Background(), "1234", ContextSourceCSI)
+	ctx = WithLogger(ctx, log.NewEntry(logger))
+	ctx = WithLogFields(ctx, log.Fields{"volume": "pvc-1"})
+
+	Logc(ctx).Debug("Attaching volume.")
+
+	assert.Contains(t, buf.String(), "Attaching volume.")
+	assert.Contains(t, buf.String(), "volume=pvc-1")
+	assert.Contains(t, buf.String(), "requestID=1234")
+	assert.Contains(t, buf.String(), "requestSource=CSI")
+}
+
+func TestSetDefaultLogger(t *testing.T) {
+
+	var buf bytes.Buffer
+	SetDefaultLogger(newTestLogger(&buf))
+	defer SetDefaultLogger(nil)
+
+	ctx := GenerateRequestContext(context.Background(), "5678", ContextSourceInternal)
+	Logc(ctx).Debug("Using default logger.")
+
+	assert.Contains(t, buf.String(), "Using default logger.")
+	assert.Contains(t, buf.String(), "requestID=5678")
+}
+
+func TestWithLogFieldsNested(t *testing.T) {
+
+	var buf bytes.Buffer
+	ctx := GenerateRequestContext(context.Background(), "1234", ContextSourceCSI)
+	ctx = WithLogger(ctx, log.NewEntry(newTestLogger(&buf)))
+	ctx = WithLogFields(ctx, log.Fields{LogFieldVolumeID: "pvc-1"})
+
+	// Fields attached deeper in an operation add to those attached at its entry point
+	attachCtx := WithLogFields(ctx, log.Fields{LogFieldTargetIQN: "iqn.x", LogFieldLUN: 3})
+	Logc(attachCtx).Debug("Attaching volume.")
+
+	assert.Contains(t, buf.String(), "volumeID=pvc-1")
+	assert.Contains(t, buf.String(), "targetIQN=iqn.x")
+	assert.Contains(t, buf.String(), "lunID=3")
+	assert.Contains(t, buf.String(), "requestID=1234")
+
+	// The outer context is unchanged
+	buf.Reset()
+	Logc(ctx).Debug("Staged volume.")
+	assert.Contains(t, buf.String(), "volumeID=pvc-1")
+	assert.NotContains(t, buf.String(), "targetIQN")
+}
+
+func TestLogcNilContext(t *testing.T) {
+
+	var buf bytes.Buffer
+	SetDefaultLogger(newTestLogger(&buf))
+	defer SetDefaultLogger(nil)
+
+	//nolint:staticcheck
+	Logc(nil).Debug("No context.")
+	assert.Contains(t, buf.String(), "No context.")
+}
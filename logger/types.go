@@ -3,6 +3,7 @@ package logger
 const (
 	ContextKeyRequestID     ContextKey = "requestID"
 	ContextKeyRequestSource ContextKey = "requestSource"
+	ContextKeyLogger        ContextKey = "logger"
 
 	ContextSourceCRD      = "CRD"
 	ContextSourceREST     = "REST"
@@ -12,5 +13,16 @@ const (
 	ContextSourceInternal = "Internal"
 )
 
+// Names of the log fields that identify what an operation is working on.  Entry points attach them to the
+// context with WithLogFields, so that every line logged beneath them carries the same names and values.
+const (
+	LogFieldVolume    = "volume"
+	LogFieldVolumeID  = "volumeID"
+	LogFieldTargetIQN = "targetIQN"
+	LogFieldLUN       = "lunID"
+	LogFieldPortal    = "targetPortal"
+	LogFieldDevice    = "device"
+)
+
 // ContextKey is used for context.Context value. The value requires a key that is not primitive type.
 type ContextKey string // ContextKeyRequestID is the ContextKey for RequestID
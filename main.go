@@ -31,6 +31,7 @@ import (
 	"github.com/netapp/trident/frontend/rest"
 	"github.com/netapp/trident/logging"
 	persistentstore "github.com/netapp/trident/persistent_store"
+	"github.com/netapp/trident/utils"
 )
 
 var (
@@ -60,6 +61,81 @@ var (
 	csiRole     = flag.String("csi_role", "", fmt.Sprintf("CSI role to play: '%s' or '%s'", csi.CSIController, csi.CSINode))
 
 	csiUnsafeNodeDetach = flag.Bool("csi_unsafe_detach", false, "Prefer to detach successfully rather than safely")
+	csiNodeTopology     = flag.Bool("csi_node_topology", false,
+		"Report each node's storage protocols and storage subnets as topology segments")
+
+	csiMaxVolumes   = flag.Int("csi_max_volumes", 0, "Maximum iSCSI LUNs attached per node (0 for no limit)")
+	csiMaxSessions  = flag.Int("csi_max_iscsi_sessions", 0, "Maximum iSCSI sessions per node (0 for no limit)")
+	csiMaxDMDevices = flag.Int("csi_max_dm_devices", 0, "Maximum devicemapper devices per node (0 for no limit)")
+
+	csiSessionMonitorInterval = flag.Duration("csi_iscsi_session_monitor_interval", 0,
+		"Interval between iSCSI session health checks (0 to disable)")
+	csiRecoverHostServices = flag.Bool("csi_recover_host_services", false,
+		"Start enabled host services, such as iscsid and multipathd, that are found not running")
+	csiRegenerateInitiatorIQN = flag.Bool("csi_regenerate_initiator_iqn", false,
+		"Replace this node's iSCSI initiator name if it is a distro default or is shared with another node")
+	csiMaxConcurrentOperations = flag.Int("csi_max_concurrent_operations", 0,
+		"Maximum host operations, such as attaches and detaches, run at once (0 for no limit)")
+	csiMaxConcurrentAttaches = flag.Int("csi_max_concurrent_attaches", 0,
+		"Maximum attaches run at once (0 to bound them only by csi_max_concurrent_operations)")
+	csiMaxConcurrentDetaches = flag.Int("csi_max_concurrent_detaches", 0,
+		"Maximum detaches run at once (0 to bound them only by csi_max_concurrent_operations)")
+	csiTemporaryMountDir = flag.String("csi_temporary_mount_dir", "",
+		"Directory in which to mount filesystems temporarily to grow them, or beneath each staging path if relative")
+	csiUdevRules = flag.Bool("csi_udev_rules", false,
+		"Install host udev rules that tune NetApp LUNs' devices, and attached LUNs' SCSI timeouts, as paths are added")
+	csiUdevScheduler = flag.String("csi_udev_scheduler", "",
+		"I/O scheduler the udev rules set on NetApp LUNs' paths (empty to leave it as the host sets it)")
+	csiUdevReadAheadKB = flag.Int("csi_udev_read_ahead_kb", 0,
+		"Readahead the udev rules set on NetApp LUNs' devices (0 to leave it as the host sets it)")
+	csiRemediateMultipathBlacklist = flag.Bool("csi_remediate_multipath_blacklist", false,
+		"Add a multipath blacklist exception for NetApp LUNs if the host's multipath configuration blacklists them")
+	logFullCommandOutput = flag.Bool("log_full_command_output", false,
+		"Log the whole output of host commands rather than just its head and tail")
+	logToHostJournal = flag.Bool("log_to_host_journal", false,
+		"Also record host commands and attach/detach outcomes in the host's systemd journal")
+	nfsLockPolicy = flag.String("nfs_lock_policy", string(utils.NFSLockPolicyIgnore),
+		"Action when NFSv3 locking is needed but rpc.statd is not running (ignore, require, nolock)")
+	unmountTerminateCommands = flag.String("unmount_terminate_commands", "",
+		"Comma-separated commands of processes that may be sent SIGTERM when they keep a volume from unmounting")
+	unmountLazy = flag.Bool("unmount_lazy", false,
+		"Lazily unmount volumes that stay busy, leaving the kernel to finish once they are no longer in use")
+	fstrimInterval = flag.Duration("fstrim_interval", 0,
+		"Interval between background trims of each mounted block volume (0 to disable)")
+	fstrimMaxLoad = flag.Float64("fstrim_max_load", 0,
+		"One-minute load average above which background trims are postponed (0 for no limit)")
+	fstrimMaxConcurrent = flag.Int("fstrim_max_concurrent", 1,
+		"Maximum background trims run at once")
+	mountReconcileInterval = flag.Duration("mount_reconcile_interval", 0,
+		"Interval between checks of mounted volumes' options against those desired (0 to disable)")
+	mountReconcileRemount = flag.Bool("mount_reconcile_remount", false,
+		"Remount mounted volumes whose options have drifted when that is safe, rather than only reporting them")
+	multiAttachPolicy = flag.String("multi_attach_policy", string(utils.MultiAttachPolicyVerify),
+		"Filesystem checks on LUNs attached to multiple nodes (verify, skip, format)")
+	forceZpoolImport = flag.Bool("force_zpool_import", false,
+		"Import zpools last used by another node; only safe if each LUN is mapped to one node at a time")
+	fsMismatchPolicy = flag.String("fs_mismatch_policy", string(utils.FilesystemMismatchPolicyFail),
+		"Handling of LUNs formatted with another filesystem than requested (fail, mount-existing, reformat-if-empty)")
+	requireFSMarker = flag.Bool("require_fs_marker", false,
+		"Refuse to use filesystems found on attached LUNs that were not created by Trident")
+	dnsTimeout = flag.Duration("dns_timeout", 5*time.Second,
+		"Timeout for resolving the hostnames of iSCSI portals and NFS servers")
+	dnsAddressPreference = flag.String("dns_address_preference", string(utils.AddressPreferenceSystem),
+		"Address family used for portal and NFS server hostnames (system, ipv4, ipv6, ipv4-only, ipv6-only)")
+	dnsCacheTTL = flag.Duration("dns_cache_ttl", 30*time.Second,
+		"How long resolved portal and NFS server hostnames are reused before being resolved again (0 to disable)")
+	reservationKey = flag.Uint64("multi_attach_reservation_key", 0,
+		"SCSI persistent reservation key with which to fence LUNs attached to multiple nodes (0 to disable)")
+	detachFenceCommand = flag.String("detach_fence_command", "",
+		"Command that fences this node from a LUN whose detach is stuck, after which the detach is forced")
+	noPathQueueingPolicy = flag.String("no_path_queueing_policy", string(utils.NoPathQueueingPolicyKeep),
+		"When a detach may fail the I/O queued to a multipath device with no working paths (keep, force, always)")
+	iscsiScanPolicy = flag.String("iscsi_scan_policy", string(utils.ISCSIScanPolicyManual),
+		"Who scans iSCSI targets for LUNs: Trident, for just the LUNs it attaches, or the initiator (manual, auto)")
+	iscsiLoginUnreachablePortals = flag.Bool("iscsi_login_unreachable_portals", false,
+		"Log in to every iSCSI portal, even those this host has no route toward")
+	storageCIDRs = flag.String("storage_cidrs", "",
+		"Comma-separated storage networks reached through a gateway, whose iSCSI portals are logged in to")
 
 	nodePrep = flag.Bool("node_prep", true, "Attempt to install required packages on nodes.")
 
@@ -234,6 +310,91 @@ func main() {
 		log.Fatal(err)
 	}
 
+	var terminateCommands []string
+	if *unmountTerminateCommands != "" {
+		terminateCommands = strings.Split(*unmountTerminateCommands, ",")
+	}
+
+	var storageNetworks []string
+	if *storageCIDRs != "" {
+		storageNetworks = strings.Split(*storageCIDRs, ",")
+	}
+
+	var fencingHook utils.FencingHook
+	if *reservationKey != 0 {
+		fencingHook = utils.PersistentReservationFencer{Key: *reservationKey}
+	}
+
+	var detachFencer utils.DetachFencer
+	if *detachFenceCommand != "" {
+		detachFencer = utils.CommandDetachFencer{Command: *detachFenceCommand}
+	}
+
+	// Configure host interaction explicitly rather than relying on import-time environment detection
+	err = utils.Init(utils.Config{
+		DockerPluginMode: os.Getenv(config.DockerPluginModeEnvVariable) != "",
+		AttachLimits: utils.AttachLimits{
+			MaxSessions:  *csiMaxSessions,
+			MaxLUNs:      *csiMaxVolumes,
+			MaxDMDevices: *csiMaxDMDevices,
+		},
+		SessionMonitorInterval: *csiSessionMonitorInterval,
+		RecoverHostServices:    *csiRecoverHostServices,
+		RegenerateInitiatorIQN: *csiRegenerateInitiatorIQN,
+		TemporaryMountDir:      *csiTemporaryMountDir,
+		NFSLockPolicy:          utils.NFSLockPolicy(*nfsLockPolicy),
+		ISCSIScanPolicy:        utils.ISCSIScanPolicy(*iscsiScanPolicy),
+		MultiAttachPolicy:      utils.MultiAttachPolicy(*multiAttachPolicy),
+		ForceZpoolImport:       *forceZpoolImport,
+		NoPathQueueingPolicy:   utils.NoPathQueueingPolicy(*noPathQueueingPolicy),
+		FencingHook:            fencingHook,
+		DetachFencer:           detachFencer,
+		LogFullCommandOutput:   *logFullCommandOutput,
+		LogToHostJournal:       *logToHostJournal,
+
+		FilesystemMismatchPolicy: utils.FilesystemMismatchPolicy(*fsMismatchPolicy),
+		RequireFilesystemMarker:  *requireFSMarker,
+
+		HostResolutionPolicy: utils.HostResolutionPolicy{
+			Timeout:    *dnsTimeout,
+			Preference: utils.AddressPreference(*dnsAddressPreference),
+			CacheTTL:   *dnsCacheTTL,
+		},
+
+		UnmountPolicy: utils.UnmountPolicy{
+			TerminateCommands: terminateCommands,
+			Lazy:              *unmountLazy,
+		},
+		TrimPolicy: utils.TrimPolicy{
+			Interval:       *fstrimInterval,
+			MaxLoadAverage: *fstrimMaxLoad,
+			MaxConcurrent:  *fstrimMaxConcurrent,
+		},
+		MountReconcilePolicy: utils.MountReconcilePolicy{
+			Interval: *mountReconcileInterval,
+			Remount:  *mountReconcileRemount,
+		},
+		UdevRulesPolicy: utils.UdevRulesPolicy{
+			Enabled:     *csiUdevRules,
+			Scheduler:   *csiUdevScheduler,
+			ReadAheadKB: *csiUdevReadAheadKB,
+		},
+		HostOperationPolicy: utils.HostOperationPolicy{
+			MaxConcurrent: *csiMaxConcurrentOperations,
+			MaxConcurrentByClass: map[utils.HostOperationClass]int{
+				utils.HostOperationAttach: *csiMaxConcurrentAttaches,
+				utils.HostOperationDetach: *csiMaxConcurrentDetaches,
+			},
+		},
+
+		RemediateMultipathBlacklist:    *csiRemediateMultipathBlacklist,
+		DisablePortalReachabilityCheck: *iscsiLoginUnreachablePortals,
+		StorageCIDRs:                   storageNetworks,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Set log level
 	err = logging.InitLogLevel(*debug, *logLevel)
 	if err != nil {
@@ -391,10 +552,11 @@ func main() {
 			csiFrontend, err = csi.NewControllerPlugin(*csiNodeName, *csiEndpoint, *aesKey, orchestrator, &hybridPlugin)
 		case csi.CSINode:
 			csiFrontend, err = csi.NewNodePlugin(*csiNodeName, *csiEndpoint, *httpsCACert, *httpsClientCert,
-				*httpsClientKey, *aesKey, orchestrator, *csiUnsafeNodeDetach, *nodePrep)
+				*httpsClientKey, *aesKey, orchestrator, *csiUnsafeNodeDetach, *nodePrep, *csiNodeTopology)
 		case csi.CSIAllInOne:
 			csiFrontend, err = csi.NewAllInOnePlugin(*csiNodeName, *csiEndpoint, *httpsCACert, *httpsClientCert,
-				*httpsClientKey, *aesKey, orchestrator, &hybridPlugin, *csiUnsafeNodeDetach, *nodePrep)
+				*httpsClientKey, *aesKey, orchestrator, &hybridPlugin, *csiUnsafeNodeDetach, *nodePrep,
+				*csiNodeTopology)
 		}
 		if err != nil {
 			log.Fatalf("Unable to start the CSI frontend. %v", err)
@@ -52,6 +52,11 @@ func (in *TridentNode) Apply(persistent *utils.Node) error {
 		return err
 	}
 	in.HostInfo.Raw = hostInfo
+	capabilities, err := json.Marshal(persistent.Capabilities)
+	if err != nil {
+		return err
+	}
+	in.Capabilities.Raw = capabilities
 
 	return nil
 }
@@ -79,6 +84,12 @@ func (in *TridentNode) Persistent() (*utils.Node, error) {
 			return persistent, err
 		}
 	}
+	if string(in.Capabilities.Raw) != "" {
+		err := json.Unmarshal(in.Capabilities.Raw, &persistent.Capabilities)
+		if err != nil {
+			return persistent, err
+		}
+	}
 
 	return persistent, nil
 }
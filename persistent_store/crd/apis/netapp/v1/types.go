@@ -149,6 +149,8 @@ type TridentNode struct {
 	NodePrep runtime.RawExtension `json:"nodePrep,omitempty"`
 	// HostInfo contains information about the node's host machine
 	HostInfo runtime.RawExtension `json:"hostInfo,omitempty"`
+	// Capabilities reports the storage protocols and filesystems the node's host supports
+	Capabilities runtime.RawExtension `json:"capabilities,omitempty"`
 }
 
 // TridentNodeList is a list of TridentNode objects.
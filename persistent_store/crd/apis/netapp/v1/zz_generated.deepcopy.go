@@ -86,6 +86,7 @@ func (in *TridentNode) DeepCopyInto(out *TridentNode) {
 	}
 	in.NodePrep.DeepCopyInto(&out.NodePrep)
 	in.HostInfo.DeepCopyInto(&out.HostInfo)
+	in.Capabilities.DeepCopyInto(&out.Capabilities)
 	return
 }
 
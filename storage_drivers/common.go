@@ -209,7 +209,7 @@ func CheckSupportedFilesystem(ctx context.Context, fs string, volumeInternalName
 
 	fstype := strings.ToLower(fs)
 	switch fstype {
-	case FsXfs, FsExt3, FsExt4, FsRaw:
+	case FsXfs, FsExt3, FsExt4, FsRaw, FsZFS:
 		Logc(ctx).WithFields(log.Fields{"fileSystemType": fstype, "name": volumeInternalName}).Debug("Filesystem format.")
 		return fstype, nil
 	default:
@@ -34,6 +34,7 @@ const (
 	FsExt3 = "ext3"
 	FsExt4 = "ext4"
 	FsRaw  = "raw"
+	FsZFS  = "zfs"
 )
 
 // Default Filesystem value
@@ -817,6 +817,7 @@ func PublishLUN(
 		publishInfo.IscsiInterface = "default"
 	}
 	publishInfo.SharedTarget = true
+	publishInfo.SCSITimeouts = config.SCSITimeouts
 
 	return nil
 }
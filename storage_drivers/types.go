@@ -123,6 +123,8 @@ type OntapStorageDriverConfig struct {
 	ClientPrivateKey          string                   `json:"clientPrivateKey"`
 	ClientCertificate         string                   `json:"clientCertificate"`
 	TrustedCACertificate      string                   `json:"trustedCACertificate"`
+	// SCSITimeouts, if set, are applied by each node to the paths of the LUNs it attaches
+	SCSITimeouts *utils.SCSITimeoutProfile `json:"scsiTimeouts,omitempty"`
 }
 
 // String makes OntapStorageDriverConfig satisfy the Stringer interface.
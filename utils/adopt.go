@@ -0,0 +1,132 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// AdoptExistingAttachment takes over an iSCSI volume that something else, such as a previous tool or an
+// administrator, attached to this host and mounted.  It checks that the mount is of the LUN described by the publish
+// info, through a live session to its target, and completes the publish info as AttachISCSIVolume would have, so
+// that once the caller records it the volume can be published, resized, and detached like any other.  Nothing on
+// the host is changed, except that a shared LUN is registered with the fencing hook.
+func AdoptExistingAttachment(
+	ctx context.Context, volumeName, mountpoint string, publishInfo *VolumePublishInfo,
+) (err error) {
+
+	ctx = WithLogFields(ctx, log.Fields{LogFieldVolume: volumeName})
+
+	fields := log.Fields{"mountpoint": mountpoint, "targetIQN": publishInfo.IscsiTargetIQN}
+	Logc(ctx).WithFields(fields).Debug(">>>> adopt.AdoptExistingAttachment")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< adopt.AdoptExistingAttachment")
+	defer func() { journalHostOutcome(ctx, "Adoption of iSCSI volume", err) }()
+
+	if publishInfo.IscsiTargetIQN == "" {
+		return fmt.Errorf("cannot adopt volume %s; only iSCSI volumes may be adopted", volumeName)
+	}
+
+	mounts, err := GetMountInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list mounts; %v", err)
+	}
+	target, err := filepath.EvalSymlinks(mountpoint)
+	if err != nil {
+		target = mountpoint
+	}
+	var mount *MountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint == target {
+			mount = &mounts[i]
+		}
+	}
+	if mount == nil {
+		return fmt.Errorf("cannot adopt volume %s; nothing is mounted at %s", volumeName, mountpoint)
+	}
+
+	deviceName := getMountedDeviceName(ctx, *mount)
+	if deviceName == "" {
+		return fmt.Errorf("cannot adopt volume %s; %s is not a device mount", volumeName, mountpoint)
+	}
+
+	fstype := mount.FsType
+	if fstype == "devtmpfs" {
+		fstype = fsRaw
+	}
+	return adoptISCSIDevice(ctx, volumeName, deviceName, fstype, publishInfo)
+}
+
+// adoptISCSIDevice checks that a mounted device is the LUN described by the publish info and fills in the
+// device's details.
+func adoptISCSIDevice(
+	ctx context.Context, volumeName, deviceName, fstype string, publishInfo *VolumePublishInfo,
+) error {
+
+	devices, err := FindISCSIDevices(ctx, ISCSIDeviceFilter{IQN: publishInfo.IscsiTargetIQN})
+	if err != nil {
+		return err
+	}
+
+	var deviceInfo *ScsiDeviceInfo
+	for _, device := range devices {
+		if device.MultipathDevice == deviceName || StringInSlice(deviceName, device.Devices) {
+			deviceInfo = device
+			break
+		}
+	}
+	if deviceInfo == nil {
+		return fmt.Errorf("cannot adopt volume %s; device %s is not attached through target %s", volumeName,
+			deviceName, publishInfo.IscsiTargetIQN)
+	}
+
+	if deviceInfo.LUN != strconv.Itoa(int(publishInfo.IscsiLunNumber)) {
+		return fmt.Errorf("cannot adopt volume %s; device %s is LUN %s rather than LUN %d", volumeName, deviceName,
+			deviceInfo.LUN, publishInfo.IscsiLunNumber)
+	}
+
+	// Detaching flushes and removes the multipath device, which mustn't be bypassed by a mount of one of its paths
+	if deviceInfo.MultipathDevice != "" && deviceInfo.MultipathDevice != deviceName {
+		return fmt.Errorf("cannot adopt volume %s; path %s is mounted rather than multipath device %s", volumeName,
+			deviceName, deviceInfo.MultipathDevice)
+	}
+
+	if publishInfo.FilesystemType != "" && publishInfo.FilesystemType != fstype {
+		return fmt.Errorf("cannot adopt volume %s; it is mounted as %s rather than %s", volumeName, fstype,
+			publishInfo.FilesystemType)
+	}
+
+	devicePath := "/dev/" + deviceName
+	if deviceInfo.MultipathDevice != "" {
+		devicePath = getMultipathDevicePath(ctx, deviceInfo.MultipathDevice)
+	}
+
+	if publishInfo.VolumeSize > 0 && !disableDeviceSizeCheck {
+		if err := verifyDeviceSize(ctx, devicePath, publishInfo.VolumeSize); err != nil {
+			return err
+		}
+	}
+
+	publishInfo.DevicePath = devicePath
+	publishInfo.FilesystemType = fstype
+	publishInfo.SupportsDiscard = deviceInfo.SupportsDiscard
+
+	if publishInfo.MultiAttach && fencingHook != nil {
+		if err := fencingHook.Register(ctx, devicePath, publishInfo); err != nil {
+			return fmt.Errorf("could not fence adopted LUN %s, device %s; %v", volumeName, deviceName, err)
+		}
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"devicePath": devicePath,
+		"fsType":     fstype,
+		"lun":        deviceInfo.LUN,
+	}).Info("Adopted existing iSCSI attachment.")
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Block devices are told apart by what sysfs says of them rather than by their kernel names, since names like sdb,
+// vdb, nvme0n1 and dm-0 only hint at the driver behind a device, and the same device is known by its major:minor
+// number wherever it appears, whether in mountinfo, a device node, or /sys/dev/block.
+
+// getBlockDeviceNameByID returns the kernel name of the block device with a major:minor number.
+func getBlockDeviceNameByID(deviceID string) (string, error) {
+	link, err := os.Readlink(chrootPathPrefix + "/sys/dev/block/" + deviceID)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(link), nil
+}
+
+// getDeviceNodeID returns the major:minor number of the block device a node like /dev/sdb or /dev/mapper/mpatha
+// refers to.
+func getDeviceNodeID(devicePath string) (string, error) {
+	info, err := os.Stat(devicePath)
+	if err != nil {
+		return "", err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return "", fmt.Errorf("%s is not a block device", devicePath)
+	}
+	rdev := uint64(stat.Rdev)
+	return fmt.Sprintf("%d:%d", unix.Major(rdev), unix.Minor(rdev)), nil
+}
+
+// getFileDeviceID returns the major:minor number of the device holding the filesystem a file is on, which is the
+// device number mountinfo lists for the filesystem's mounts.
+func getFileDeviceID(filePath string) (string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("could not stat %s", filePath)
+	}
+	dev := uint64(stat.Dev)
+	return fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev)), nil
+}
+
+// getBlockDeviceNameForPath returns the kernel name of the block device a node refers to, as sysfs knows it by
+// its major:minor number, or failing that by resolving the node's symlinks.
+func getBlockDeviceNameForPath(devicePath string) (string, error) {
+	if deviceID, err := getDeviceNodeID(devicePath); err == nil {
+		if name, err := getBlockDeviceNameByID(deviceID); err == nil {
+			return name, nil
+		}
+	}
+	device, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(device), nil
+}
+
+// isDeviceMapperDevice reports whether a block device is a device mapper device, which sysfs marks with a dm
+// directory.  Device mapper's major number is assigned when it loads, so it can't be told by number alone.
+func isDeviceMapperDevice(name string) bool {
+	return PathExists(chrootPathPrefix + "/sys/block/" + name + "/dm")
+}
+
+// isMultipathDevice reports whether a block device is a device mapper multipath device.
+func isMultipathDevice(name string) bool {
+	uuid, err := ioutil.ReadFile(chrootPathPrefix + "/sys/block/" + name + "/dm/uuid")
+	return err == nil && strings.HasPrefix(strings.TrimSpace(string(uuid)), "mpath-")
+}
+
+// isDiskDevice reports whether a block device is a disk on some bus, such as a SCSI, virtio or NVMe disk, rather
+// than a device stacked on other devices or a virtual device like a loop or ram device.
+func isDiskDevice(name string) bool {
+	return !isDeviceMapperDevice(name) && PathExists(chrootPathPrefix+"/sys/block/"+name+"/device")
+}
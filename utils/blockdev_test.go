@@ -0,0 +1,76 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockDeviceClassification(t *testing.T) {
+	log.Debug("Running TestBlockDeviceClassification...")
+
+	dir, err := ioutil.TempDir("", "TestBlockDeviceClassification")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	writeFile := func(name, content string) {
+		assert.NoError(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644))
+	}
+	makeDir := func(name string) {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, name), 0755))
+	}
+
+	// A multipath device over an NVMe namespace and a virtio disk, with a dm-crypt device on top, and a loop device
+	for _, device := range []string{"nvme0n1", "vdb"} {
+		makeDir("sys/block/" + device + "/device")
+		makeDir("sys/block/dm-0/slaves/" + device)
+	}
+	writeFile("sys/block/dm-0/dm/uuid", "mpath-3600a098038303634722b4d59614c6f42\n")
+	writeFile("sys/block/dm-1/dm/uuid", "CRYPT-LUKS2-0123456789abcdef-luks-pv\n")
+	makeDir("sys/block/dm-1/slaves/dm-0")
+	makeDir("sys/block/loop0")
+	makeDir("sys/dev/block")
+	assert.NoError(t, os.Symlink("../../devices/pci0000:00/nvme/nvme0/nvme0n1",
+		path.Join(dir, "sys/dev/block/259:0")))
+
+	assert.True(t, isDiskDevice("nvme0n1"))
+	assert.True(t, isDiskDevice("vdb"))
+	assert.False(t, isDiskDevice("dm-0"))
+	assert.False(t, isDiskDevice("loop0"))
+
+	assert.True(t, isDeviceMapperDevice("dm-0"))
+	assert.True(t, isDeviceMapperDevice("dm-1"))
+	assert.False(t, isDeviceMapperDevice("vdb"))
+
+	assert.True(t, isMultipathDevice("dm-0"))
+	assert.False(t, isMultipathDevice("dm-1"))
+	assert.False(t, isMultipathDevice("nvme0n1"))
+
+	ctx := context.TODO()
+	assert.ElementsMatch(t, []string{"nvme0n1", "vdb"}, findDevicesForMultipathDevice(ctx, "dm-0"))
+	assert.Empty(t, findDevicesForMultipathDevice(ctx, "dm-1"))
+
+	name, err := getBlockDeviceNameByID("259:0")
+	assert.NoError(t, err)
+	assert.Equal(t, "nvme0n1", name)
+	_, err = getBlockDeviceNameByID("259:1")
+	assert.Error(t, err)
+
+	// A regular file has no major:minor number, so it is known only by its resolved path
+	_, err = getDeviceNodeID(path.Join(dir, "sys/block/dm-0/dm/uuid"))
+	assert.Error(t, err)
+	name, err = getBlockDeviceNameForPath(path.Join(dir, "sys/block/dm-0/dm/uuid"))
+	assert.NoError(t, err)
+	assert.Equal(t, "uuid", name)
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+	"github.com/netapp/trident/utils/mount"
+)
+
+// A raw block volume is published by bind mounting its device node, such as a LUN's multipath device, onto a file
+// at the target path, which the container runtime then passes to the pod as a device.  The file is only a
+// placeholder for the bind mount: while the device is bound there, the target shows the device node's own
+// ownership and mode, as udev set them.  The placeholder itself is created readable and writable only by its
+// owner, so that nothing written to an unpublished target can be mistaken for the volume's data.
+
+// PublishBlockDevice bind mounts a block device onto a file at a target path, creating the file if needed, with
+// any further mount options.  A target to which the same device is already bound is left as it is.
+func PublishBlockDevice(ctx context.Context, device, targetPath, options string) error {
+
+	fields := log.Fields{"device": device, "targetPath": targetPath, "options": options}
+	Logc(ctx).WithFields(fields).Debug(">>>> blockpublish.PublishBlockDevice")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< blockpublish.PublishBlockDevice")
+
+	deviceID, err := getDeviceNodeID(LocalPath(device))
+	if err != nil {
+		return fmt.Errorf("cannot publish %s; %v", device, err)
+	}
+	if err = ensureBlockTargetFile(ctx, targetPath); err != nil {
+		return err
+	}
+
+	mounted, err := IsMounted(ctx, "", targetPath)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		if targetID, err := getDeviceNodeID(LocalPath(targetPath)); err != nil || targetID != deviceID {
+			return fmt.Errorf("%s is already published with a device other than %s", targetPath, device)
+		}
+		Logc(ctx).WithFields(fields).Debug("Device is already published.")
+		return nil
+	}
+
+	if _, err = execMountCommand(ctx, "mount", 0, "-o", mount.MergeOptions("", options, "bind"), device,
+		targetPath); err != nil {
+		return fmt.Errorf("could not bind mount %s at %s; %v", device, targetPath, err)
+	}
+
+	// The device is bound by its node, so one that changed underneath the node isn't published in its place
+	if targetID, err := getDeviceNodeID(LocalPath(targetPath)); err != nil || targetID != deviceID {
+		if _, umountErr := execMountCommand(ctx, "umount", 10, targetPath); umountErr != nil {
+			Logc(ctx).WithFields(fields).WithError(umountErr).Warning("Could not unmount mismatched device.")
+		}
+		return fmt.Errorf("device bound at %s is not %s (%s)", targetPath, device, deviceID)
+	}
+
+	Logc(ctx).WithFields(fields).Debug("Published block device.")
+	return nil
+}
+
+// ensureBlockTargetFile makes sure a target path is a regular file onto which a device may be bound, or a device
+// already bound there, creating an empty placeholder file if nothing is there.
+func ensureBlockTargetFile(ctx context.Context, targetPath string) error {
+
+	info, err := os.Lstat(LocalPath(targetPath))
+	if os.IsNotExist(err) {
+		file, err := os.OpenFile(LocalPath(targetPath), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil && !os.IsExist(err) {
+			return fmt.Errorf("could not create block volume target %s; %v", targetPath, err)
+		} else if err == nil {
+			_ = file.Close()
+			Logc(ctx).WithField("targetPath", targetPath).Debug("Created block volume target.")
+			return nil
+		}
+		info, err = os.Lstat(LocalPath(targetPath))
+	}
+	if err != nil {
+		return fmt.Errorf("could not check block volume target %s; %v", targetPath, err)
+	}
+
+	mode := info.Mode()
+	if !mode.IsRegular() && (mode&os.ModeDevice == 0 || mode&os.ModeCharDevice != 0) {
+		return fmt.Errorf("block volume target %s is not a file (%v)", targetPath, mode)
+	}
+	return nil
+}
+
+// UnpublishBlockDevice undoes PublishBlockDevice, unmounting whatever device is bound at a target path and
+// removing the placeholder file.  A target that doesn't exist is already unpublished.
+func UnpublishBlockDevice(ctx context.Context, targetPath string) error {
+
+	fields := log.Fields{"targetPath": targetPath}
+	Logc(ctx).WithFields(fields).Debug(">>>> blockpublish.UnpublishBlockDevice")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< blockpublish.UnpublishBlockDevice")
+
+	info, err := os.Lstat(LocalPath(targetPath))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not check block volume target %s; %v", targetPath, err)
+	} else if info.IsDir() {
+		return fmt.Errorf("block volume target %s is a directory", targetPath)
+	}
+
+	mounted, err := IsMounted(ctx, "", targetPath)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		if err = Umount(ctx, targetPath); err != nil {
+			return err
+		}
+	}
+
+	if err = os.Remove(LocalPath(targetPath)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove block volume target %s; %v", targetPath, err)
+	}
+
+	Logc(ctx).WithFields(fields).Debug("Unpublished block device.")
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnsureBlockTargetFile(t *testing.T) {
+	log.Debug("Running TestEnsureBlockTargetFile...")
+
+	dir, err := ioutil.TempDir("", "TestEnsureBlockTargetFile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.TODO()
+
+	// A missing target is created as a placeholder only its owner may use, and an existing file is accepted
+	target := path.Join(dir, "pvc-1")
+	assert.NoError(t, ensureBlockTargetFile(ctx, target))
+	info, err := os.Stat(target)
+	assert.NoError(t, err)
+	assert.True(t, info.Mode().IsRegular())
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.NoError(t, ensureBlockTargetFile(ctx, target))
+
+	// Directories and symlinks are not block volume targets
+	assert.Error(t, ensureBlockTargetFile(ctx, dir))
+	link := path.Join(dir, "link")
+	assert.NoError(t, os.Symlink(target, link))
+	assert.Error(t, ensureBlockTargetFile(ctx, link))
+
+	// Nor can a device be bound onto one by MountDevice
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{Executor: recorder}))
+	defer func() { _ = Init(Config{}) }()
+	assert.Error(t, MountDevice(ctx, "/dev/dm-0", path.Join(dir, "missing/pvc-2"), "bind", true))
+	assert.Empty(t, recorder.commands)
+}
+
+func TestPublishBlockDeviceNotBlockDevice(t *testing.T) {
+	log.Debug("Running TestPublishBlockDeviceNotBlockDevice...")
+
+	dir, err := ioutil.TempDir("", "TestPublishBlockDeviceNotBlockDevice")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{Executor: recorder}))
+	defer func() { _ = Init(Config{}) }()
+
+	// Only a block device is published, and its target isn't created unless it is
+	device := path.Join(dir, "dm-0")
+	assert.NoError(t, ioutil.WriteFile(device, nil, 0600))
+	target := path.Join(dir, "pvc-1")
+	assert.Error(t, PublishBlockDevice(context.TODO(), device, target, ""))
+	assert.False(t, PathExists(target))
+	assert.Empty(t, recorder.commands)
+}
+
+func TestUnpublishBlockDevice(t *testing.T) {
+	log.Debug("Running TestUnpublishBlockDevice...")
+
+	dir, err := ioutil.TempDir("", "TestUnpublishBlockDevice")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mountinfo := path.Join(dir, "proc/1/mountinfo")
+	assert.NoError(t, os.MkdirAll(path.Dir(mountinfo), 0755))
+	assert.NoError(t, ioutil.WriteFile(mountinfo, nil, 0644))
+
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{DockerPluginMode: true, HostRoot: dir, Executor: recorder}))
+	defer func() { _ = Init(Config{}) }()
+
+	ctx := context.TODO()
+	target := "/pods/volumeDevices/pvc-1"
+	assert.NoError(t, os.MkdirAll(path.Join(dir, path.Dir(target)), 0755))
+
+	// A target that's gone is already unpublished, and a directory is not a block volume target
+	assert.NoError(t, UnpublishBlockDevice(ctx, target))
+	assert.Error(t, UnpublishBlockDevice(ctx, path.Dir(target)))
+
+	// A bound device is unmounted before its placeholder is removed
+	assert.NoError(t, ensureBlockTargetFile(ctx, target))
+	assert.NoError(t, ioutil.WriteFile(mountinfo, []byte("100 29 0:6 /dm-0 "+target+
+		" rw,nosuid shared:1 - devtmpfs udev rw\n"), 0644))
+	assert.NoError(t, UnpublishBlockDevice(ctx, target))
+	assert.Equal(t, []string{"umount " + target}, recorder.commands)
+	assert.False(t, PathExists(path.Join(dir, target)))
+
+	// An unmounted placeholder is just removed
+	recorder.commands = nil
+	assert.NoError(t, ioutil.WriteFile(mountinfo, nil, 0644))
+	assert.NoError(t, ensureBlockTargetFile(ctx, target))
+	assert.NoError(t, UnpublishBlockDevice(ctx, target))
+	assert.Empty(t, recorder.commands)
+	assert.False(t, PathExists(path.Join(dir, target)))
+}
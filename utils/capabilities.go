@@ -0,0 +1,199 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// Capability is a storage protocol, filesystem, or other host feature that volumes may depend on.
+type Capability string
+
+const (
+	CapabilityISCSI     = Capability("iscsi")
+	CapabilityNVMeTCP   = Capability("nvme-tcp")
+	CapabilityNVMeFC    = Capability("nvme-fc")
+	CapabilityFC        = Capability("fc")
+	CapabilityNFS3      = Capability("nfs3")
+	CapabilityNFS41     = Capability("nfs4.1")
+	CapabilitySMB       = Capability("smb")
+	CapabilityXFS       = Capability("xfs")
+	CapabilityExt4      = Capability("ext4")
+	CapabilityBtrfs     = Capability("btrfs")
+	CapabilityLUKS      = Capability("luks")
+	CapabilityMultipath = Capability("multipath")
+)
+
+// CapabilityStatus reports whether a host has a capability.  Diagnostics explains how that was determined, such
+// as the version of the tool found or the reason the capability is missing.
+type CapabilityStatus struct {
+	Supported   bool   `json:"supported"`
+	Diagnostics string `json:"diagnostics,omitempty"`
+}
+
+// CapabilitySet holds the status of every capability of a host.
+type CapabilitySet map[Capability]CapabilityStatus
+
+// Supported returns true if the set reports the capability as supported.
+func (s CapabilitySet) Supported(capability Capability) bool {
+	return s[capability].Supported
+}
+
+// Labels returns a label for each capability, named by appending the capability to the prefix, whose value is
+// "true" or "false".
+func (s CapabilitySet) Labels(prefix string) map[string]string {
+	labels := make(map[string]string, len(s))
+	for capability, status := range s {
+		labels[prefix+string(capability)] = fmt.Sprintf("%t", status.Supported)
+	}
+	return labels
+}
+
+// capabilityChecks determine whether this host has each capability
+var capabilityChecks = map[Capability]func(ctx context.Context) CapabilityStatus{
+	CapabilityISCSI:     checkISCSICapability,
+	CapabilityNVMeTCP:   checkNVMeTCPCapability,
+	CapabilityNVMeFC:    checkNVMeFCCapability,
+	CapabilityFC:        checkFCCapability,
+	CapabilityNFS3:      func(context.Context) CapabilityStatus { return checkHostToolCapability("mount.nfs") },
+	CapabilityNFS41:     func(context.Context) CapabilityStatus { return checkHostToolCapability("mount.nfs4") },
+	CapabilitySMB:       func(context.Context) CapabilityStatus { return checkHostToolCapability("mount.cifs") },
+	CapabilityXFS:       func(context.Context) CapabilityStatus { return checkHostToolCapability("mkfs.xfs") },
+	CapabilityExt4:      func(context.Context) CapabilityStatus { return checkHostToolCapability("mkfs.ext4") },
+	CapabilityBtrfs:     func(context.Context) CapabilityStatus { return checkHostToolCapability("mkfs.btrfs") },
+	CapabilityLUKS:      func(context.Context) CapabilityStatus { return checkHostToolCapability("cryptsetup") },
+	CapabilityMultipath: checkMultipathCapability,
+}
+
+// lookPath finds a tool in this process's PATH
+var lookPath = exec.LookPath
+
+// Capabilities checks which storage protocols, filesystems, and other host features this host supports.
+func Capabilities(ctx context.Context) CapabilitySet {
+
+	Logc(ctx).Debug(">>>> capabilities.Capabilities")
+	defer Logc(ctx).Debug("<<<< capabilities.Capabilities")
+
+	capabilities := make(CapabilitySet, len(capabilityChecks))
+	for capability := range capabilityChecks {
+		capabilities[capability] = checkCapability(ctx, capability)
+	}
+	return capabilities
+}
+
+// checkCapability checks whether this host supports a single capability.
+func checkCapability(ctx context.Context, capability Capability) CapabilityStatus {
+
+	check, ok := capabilityChecks[capability]
+	if !ok {
+		return CapabilityStatus{Diagnostics: fmt.Sprintf("unknown capability %s", capability)}
+	}
+
+	status := check(ctx)
+	Logc(ctx).WithFields(log.Fields{
+		"capability":  capability,
+		"supported":   status.Supported,
+		"diagnostics": status.Diagnostics,
+	}).Debug("Checked host capability.")
+	return status
+}
+
+// findHostTool returns the path to a tool, looking first in this process's PATH and then in the host's usual
+// binary directories, which differ from this process's when it runs in a container.
+func findHostTool(name string) (string, bool) {
+
+	if toolPath, err := lookPath(name); err == nil {
+		return toolPath, true
+	}
+	for _, dir := range []string{"/sbin", "/usr/sbin", "/bin", "/usr/bin"} {
+		if toolPath := path.Join(chrootPathPrefix+dir, name); PathExists(toolPath) {
+			return toolPath, true
+		}
+	}
+	return "", false
+}
+
+// checkHostToolCapability reports a capability that needs only a host tool, such as a mount helper or mkfs.
+func checkHostToolCapability(name string) CapabilityStatus {
+	if toolPath, ok := findHostTool(name); ok {
+		return CapabilityStatus{Supported: true, Diagnostics: fmt.Sprintf("found %s", toolPath)}
+	}
+	return CapabilityStatus{Diagnostics: fmt.Sprintf("%s not found", name)}
+}
+
+func checkISCSICapability(ctx context.Context) CapabilityStatus {
+	out, err := execIscsiadmCommand(ctx, "-V")
+	if err != nil {
+		return CapabilityStatus{Diagnostics: fmt.Sprintf("iscsiadm not usable; %v", err)}
+	}
+	return CapabilityStatus{Supported: true, Diagnostics: strings.TrimSpace(string(out))}
+}
+
+func checkNVMeTCPCapability(_ context.Context) CapabilityStatus {
+	if _, ok := findHostTool("nvme"); !ok {
+		return CapabilityStatus{Diagnostics: "nvme not found"}
+	}
+	if !PathExists(chrootPathPrefix + "/sys/module/nvme_tcp") {
+		return CapabilityStatus{Diagnostics: "nvme_tcp kernel module not loaded"}
+	}
+	return CapabilityStatus{Supported: true, Diagnostics: "found nvme and nvme_tcp kernel module"}
+}
+
+// checkNVMeFCCapability looks for what FC-NVMe needs: nvme-cli, the nvme_fc kernel module, and an FC host adapter.
+// Whether an adapter's driver has FC-NVMe enabled (such as lpfc's lpfc_enable_fc4_type) can't be told from here;
+// if it hasn't, no NVMe target ports are found when attaching.
+func checkNVMeFCCapability(ctx context.Context) CapabilityStatus {
+	if _, ok := findHostTool("nvme"); !ok {
+		return CapabilityStatus{Diagnostics: "nvme not found"}
+	}
+	if !PathExists(chrootPathPrefix + "/sys/module/nvme_fc") {
+		return CapabilityStatus{Diagnostics: "nvme_fc kernel module not loaded"}
+	}
+	if fc := checkFCCapability(ctx); !fc.Supported {
+		return fc
+	}
+	return CapabilityStatus{Supported: true, Diagnostics: "found nvme, nvme_fc kernel module, and FC hosts"}
+}
+
+// checkFCCapability looks for FC host adapters, including FCoE hosts on converged adapters, at least one of which
+// must be online.  The diagnostics name each host, and explain why any that aren't online aren't.
+func checkFCCapability(ctx context.Context) CapabilityStatus {
+	hosts, err := listFCHosts(ctx)
+	if err != nil || len(hosts) == 0 {
+		return CapabilityStatus{Diagnostics: "no FC host adapters"}
+	}
+	online := make([]string, 0, len(hosts))
+	problems := make([]string, 0)
+	for _, host := range hosts {
+		if problem := fcHostProblem(ctx, host); problem != "" {
+			problems = append(problems, problem)
+		} else if host.FCoE {
+			online = append(online, host.Name+" (FCoE)")
+		} else {
+			online = append(online, host.Name)
+		}
+	}
+	if len(online) == 0 {
+		return CapabilityStatus{Diagnostics: "no FC host is online: " + strings.Join(problems, "; ")}
+	}
+	diagnostics := "FC hosts " + strings.Join(online, ", ")
+	if len(problems) > 0 {
+		diagnostics += "; " + strings.Join(problems, "; ")
+	}
+	return CapabilityStatus{Supported: true, Diagnostics: diagnostics}
+}
+
+func checkMultipathCapability(ctx context.Context) CapabilityStatus {
+	if multipathdIsRunning(ctx) {
+		return CapabilityStatus{Supported: true, Diagnostics: "multipathd is running"}
+	}
+	return CapabilityStatus{Diagnostics: "multipathd is not running"}
+}
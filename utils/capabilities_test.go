@@ -0,0 +1,93 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapabilities(t *testing.T) {
+	log.Debug("Running TestCapabilities...")
+
+	dir, err := ioutil.TempDir("", "TestCapabilities")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: recorder}))
+	defer func() { _ = Init(Config{}) }()
+
+	// Only tools in the host's own directories are found, not those of the test's PATH
+	lookPath = func(name string) (string, error) { return "", exec.ErrNotFound }
+	defer func() { lookPath = exec.LookPath }()
+
+	for _, tool := range []string{"sbin/mount.nfs", "usr/sbin/mkfs.xfs", "usr/bin/nvme"} {
+		assert.NoError(t, os.MkdirAll(path.Dir(path.Join(dir, tool)), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, tool), nil, 0755))
+	}
+	for _, host := range []string{"host4", "host3"} {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/class/fc_host", host), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/class/fc_host", host, "port_state"),
+			[]byte("Online\n"), 0644))
+	}
+
+	capabilities := Capabilities(context.TODO())
+	assert.Len(t, capabilities, len(capabilityChecks))
+
+	// The executor runs iscsiadm successfully, but finds no multipathd
+	assert.True(t, capabilities.Supported(CapabilityISCSI))
+	assert.False(t, capabilities.Supported(CapabilityMultipath))
+
+	assert.True(t, capabilities.Supported(CapabilityNFS3))
+	assert.Equal(t, "found "+path.Join(dir, "sbin/mount.nfs"), capabilities[CapabilityNFS3].Diagnostics)
+	assert.False(t, capabilities.Supported(CapabilityNFS41))
+	assert.Equal(t, "mount.nfs4 not found", capabilities[CapabilityNFS41].Diagnostics)
+	assert.True(t, capabilities.Supported(CapabilityXFS))
+	assert.False(t, capabilities.Supported(CapabilityExt4))
+
+	// NVMe over TCP needs the kernel module as well as the CLI
+	assert.False(t, capabilities.Supported(CapabilityNVMeTCP))
+	assert.Equal(t, "nvme_tcp kernel module not loaded", capabilities[CapabilityNVMeTCP].Diagnostics)
+	assert.Equal(t, "nvme_fc kernel module not loaded", capabilities[CapabilityNVMeFC].Diagnostics)
+
+	assert.True(t, capabilities.Supported(CapabilityFC))
+	assert.Equal(t, "FC hosts host3, host4", capabilities[CapabilityFC].Diagnostics)
+
+	// An FCoE host that's down is reported, with lldpad if its driver needs it, and FC needs a host that's online
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/class/fc_host/host5"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/class/fc_host/host5/port_state"), []byte("Linkdown\n"),
+		0644))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/class/scsi_host/host5"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/class/scsi_host/host5/proc_name"), []byte("bnx2fc\n"),
+		0644))
+	assert.Equal(t, "FC hosts host3, host4; host5 is linkdown; its FCoE driver bnx2fc needs lldpad to negotiate "+
+		"DCB, and lldpad is not running", checkCapability(context.TODO(), CapabilityFC).Diagnostics)
+	for _, host := range []string{"host3", "host4"} {
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/class/fc_host", host, "port_state"),
+			[]byte("Linkdown\n"), 0644))
+	}
+	assert.False(t, checkCapability(context.TODO(), CapabilityFC).Supported)
+	for _, host := range []string{"host3", "host4"} {
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/class/fc_host", host, "port_state"),
+			[]byte("Online\n"), 0644))
+	}
+
+	// FC-NVMe needs FC hosts as well as the nvme_fc kernel module
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/module/nvme_fc"), 0755))
+	assert.True(t, checkCapability(context.TODO(), CapabilityNVMeFC).Supported)
+
+	labels := capabilities.Labels("trident.netapp.io/")
+	assert.Equal(t, "true", labels["trident.netapp.io/nfs3"])
+	assert.Equal(t, "false", labels["trident.netapp.io/smb"])
+
+	assert.Equal(t, []string{"iscsi", "nfs", "fc"}, getNodeProtocols(context.TODO()))
+	assert.False(t, checkCapability(context.TODO(), Capability("bogus")).Supported)
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// Clock tells the time and waits.  The waits of this package's retry loops are made on it, so that tests can
+// substitute a clock that fast-forwards through them instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the wall clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+var clock Clock = realClock{}
+
+// newExponentialBackOff returns an exponential backoff with the library's defaults, whose elapsed time is measured
+// on this package's clock.
+func newExponentialBackOff() *backoff.ExponentialBackOff {
+	b := backoff.NewExponentialBackOff()
+	b.Clock = clock
+	b.Reset()
+	return b
+}
+
+// retryNotify is backoff.RetryNotify, waiting between attempts on this package's clock.
+func retryNotify(operation backoff.Operation, b backoff.BackOff, notify backoff.Notify) error {
+	return backoff.RetryNotifyWithTimer(operation, b, notify, &clockTimer{})
+}
+
+// clockTimer is a backoff.Timer that fires on this package's clock.
+type clockTimer struct {
+	c <-chan time.Time
+}
+
+func (t *clockTimer) Start(duration time.Duration) { t.c = clock.After(duration) }
+func (t *clockTimer) Stop()                        {}
+func (t *clockTimer) C() <-chan time.Time          { return t.c }
@@ -0,0 +1,73 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a Clock whose waits return at once, advancing its time by the duration waited.
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Sleep(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+func TestRetryNotifyOnFakeClock(t *testing.T) {
+	log.Debug("Running TestRetryNotifyOnFakeClock...")
+
+	fake := newFakeClock()
+	assert.NoError(t, Init(Config{Clock: fake}))
+	defer func() { _ = Init(Config{}) }()
+
+	start := fake.Now()
+	attempts := 0
+	b := newExponentialBackOff()
+	b.InitialInterval = time.Second
+	b.MaxElapsedTime = time.Minute
+
+	// The retries give up once a minute has passed on the fake clock, without a minute passing in fact
+	began := time.Now()
+	err := retryNotify(func() error {
+		attempts++
+		return errors.New("not yet")
+	}, b, func(error, time.Duration) {})
+	assert.Error(t, err)
+	assert.True(t, attempts > 1)
+	assert.True(t, fake.Now().Sub(start) >= time.Minute)
+	assert.True(t, time.Since(began) < 10*time.Second)
+
+	// A missing device is waited for on the fake clock too
+	start = fake.Now()
+	assert.Error(t, waitForDevice(context.TODO(), "/dev/missing"))
+	assert.True(t, fake.Now().Sub(start) >= multipathDeviceDiscoveryTimeoutSecs*time.Second)
+}
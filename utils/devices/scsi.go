@@ -0,0 +1,92 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+// Package devices lists the host's block devices from sysfs, so that nodes without lsscsi are supported.  It
+// imports nothing from package utils, which attaches and removes devices using it, so that it can be used and
+// tested on its own.
+package devices
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// SCSIDevice describes a SCSI device as sysfs shows it, much as lsscsi lists it, so that devices can be listed
+// on hosts without lsscsi.
+type SCSIDevice struct {
+	// Address is the device's host:channel:target:lun
+	Address  string `json:"address"`
+	Vendor   string `json:"vendor"`
+	Model    string `json:"model"`
+	Revision string `json:"revision"`
+	State    string `json:"state"`
+	// Device is the name of the device's block device, such as sdb, if it has one
+	Device string `json:"device,omitempty"`
+}
+
+// ListSCSIDevices returns the SCSI devices of the host whose root is at hostRoot, ordered by address.  Attributes
+// that can't be read within the timeout, as of a device in a hung state or being removed, are left empty.
+func ListSCSIDevices(ctx context.Context, hostRoot string, readTimeout time.Duration) ([]SCSIDevice, error) {
+
+	classDir := hostRoot + "/sys/class/scsi_device"
+	entries, err := ioutil.ReadDir(classDir)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]SCSIDevice, 0, len(entries))
+	for _, entry := range entries {
+		deviceDir := path.Join(classDir, entry.Name(), "device")
+		readAttribute := func(attribute string) string {
+			return readAttributeWithTimeout(ctx, path.Join(deviceDir, attribute), readTimeout)
+		}
+
+		device := SCSIDevice{
+			Address:  entry.Name(),
+			Vendor:   readAttribute("vendor"),
+			Model:    readAttribute("model"),
+			Revision: readAttribute("rev"),
+			State:    readAttribute("state"),
+		}
+		if blocks, err := ioutil.ReadDir(path.Join(deviceDir, "block")); err == nil && len(blocks) > 0 {
+			device.Device = blocks[0].Name()
+		}
+		devices = append(devices, device)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Address < devices[j].Address })
+	return devices, nil
+}
+
+// readAttributeWithTimeout reads a sysfs attribute in a separate goroutine, so that a device in a hung state can't
+// block the caller indefinitely, returning an empty string if it can't be read in time.
+func readAttributeWithTimeout(ctx context.Context, filename string, timeout time.Duration) string {
+
+	done := make(chan string, 1)
+	go func() {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			done <- ""
+			return
+		}
+		done <- strings.TrimSpace(string(content))
+	}()
+
+	select {
+	case <-time.After(timeout):
+		Logc(ctx).WithFields(log.Fields{
+			"file":    filename,
+			"timeout": timeout,
+		}).Error("Timed out reading file.")
+		return ""
+	case value := <-done:
+		return value
+	}
+}
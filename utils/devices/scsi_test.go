@@ -0,0 +1,44 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package devices
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListSCSIDevices(t *testing.T) {
+	log.Debug("Running TestListSCSIDevices...")
+
+	dir, err := ioutil.TempDir("", "TestListSCSIDevices")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	addDevice := func(address string, attributes map[string]string, block string) {
+		deviceDir := path.Join(dir, "sys/class/scsi_device", address, "device")
+		assert.NoError(t, os.MkdirAll(deviceDir, 0755))
+		for attribute, value := range attributes {
+			assert.NoError(t, ioutil.WriteFile(path.Join(deviceDir, attribute), []byte(value+"\n"), 0644))
+		}
+		if block != "" {
+			assert.NoError(t, os.MkdirAll(path.Join(deviceDir, "block", block), 0755))
+		}
+	}
+	addDevice("3:0:0:1", map[string]string{"vendor": "NETAPP  ", "model": "LUN C-Mode", "rev": "9800",
+		"state": "running"}, "sdc")
+	addDevice("2:0:0:1", map[string]string{"vendor": "NETAPP", "state": "offline"}, "")
+
+	devices, err := ListSCSIDevices(context.TODO(), dir, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []SCSIDevice{
+		{Address: "2:0:0:1", Vendor: "NETAPP", State: "offline"},
+		{Address: "3:0:0:1", Vendor: "NETAPP", Model: "LUN C-Mode", Revision: "9800", State: "running", Device: "sdc"},
+	}, devices)
+}
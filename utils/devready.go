@@ -0,0 +1,137 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// While an array fails over, it may briefly export a LUN read-only, or fail its paths, and a LUN attached then
+// gets devices that mkfs and mount fail on with errors that don't say why.  So an attached LUN's devices are
+// checked before anything is written to them: the multipath device, if any, must be writable, not suspended, and
+// have a working path, and at least one of its paths must be writable and running.  A device that isn't ready is
+// rescanned, which picks up the write protection the array reports once the failover is over, and checked again
+// for a while before the attach fails with an error saying which devices aren't ready.
+
+// deviceReadyTimeout bounds how long an attach waits for a LUN's devices to become ready.
+const deviceReadyTimeout = 20 * time.Second
+
+// ensureDeviceReady waits for an attached LUN's devices to be ready to be written to, recovering its paths while
+// they aren't.  Read-only devices are accepted if the LUN is attached read-only.
+func ensureDeviceReady(ctx context.Context, deviceInfo *ScsiDeviceInfo, readOnly bool) error {
+
+	fields := log.Fields{"devices": deviceInfo.Devices, "multipathDevice": deviceInfo.MultipathDevice}
+	Logc(ctx).WithFields(fields).Debug(">>>> devready.ensureDeviceReady")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< devready.ensureDeviceReady")
+
+	checkReady := func() error {
+		problems := getDeviceReadinessProblems(ctx, deviceInfo, readOnly)
+		if len(problems) == 0 {
+			return nil
+		}
+		recoverDevicePaths(ctx, deviceInfo)
+		return DeviceNotReadyError(fmt.Sprintf("devices of LUN %s are not ready; %s", deviceInfo.LUN,
+			strings.Join(problems, ", ")))
+	}
+
+	readyNotify := func(err error, duration time.Duration) {
+		Logc(ctx).WithFields(fields).WithField("increment", duration).WithError(err).Debug(
+			"Devices not ready yet, waiting.")
+	}
+
+	readyBackoff := newExponentialBackOff()
+	readyBackoff.InitialInterval = 1 * time.Second
+	readyBackoff.Multiplier = 1.414 // approx sqrt(2)
+	readyBackoff.RandomizationFactor = 0.1
+	readyBackoff.MaxElapsedTime = deviceReadyTimeout
+
+	if err := retryNotify(checkReady, readyBackoff, readyNotify); err != nil {
+		Logc(ctx).WithFields(fields).WithError(err).Error("Devices did not become ready.")
+		journalHostOperation(ctx, log.ErrorLevel, "Attached LUN's devices did not become ready.",
+			log.Fields{"error": err.Error()})
+		return err
+	}
+	return nil
+}
+
+// getDeviceReadinessProblems returns what keeps an attached LUN's devices from being ready to be written to, as
+// in "dm-3: read-only", or nothing if they're ready.  Write protection is read from each device's ro attribute,
+// which is what the BLKROGET ioctl reports.
+func getDeviceReadinessProblems(ctx context.Context, deviceInfo *ScsiDeviceInfo, readOnly bool) []string {
+
+	problems := make([]string, 0)
+
+	if multipathDevice := deviceInfo.MultipathDevice; multipathDevice != "" {
+		if ro, _ := readSysfsAttribute(ctx, multipathDevice, "ro"); ro == "1" && !readOnly {
+			problems = append(problems, multipathDevice+": read-only")
+		}
+		if suspended, _ := readSysfsAttribute(ctx, multipathDevice, "dm/suspended"); suspended == "1" {
+			problems = append(problems, multipathDevice+": suspended")
+		}
+		if state, err := getMultipathQueueingState(ctx, multipathDevice); err == nil && state.ActivePaths == 0 &&
+			state.FailedPaths > 0 {
+			problems = append(problems, multipathDevice+": no working paths")
+		}
+	}
+
+	pathProblems := make([]string, 0, len(deviceInfo.Devices))
+	for _, path := range deviceInfo.Devices {
+		if problem := getPathReadinessProblem(ctx, path, readOnly); problem != "" {
+			pathProblems = append(pathProblems, path+": "+problem)
+		}
+	}
+	// A LUN with one usable path can be written to, and multipathd recovers the others
+	if len(deviceInfo.Devices) > 0 && len(pathProblems) == len(deviceInfo.Devices) {
+		sort.Strings(pathProblems)
+		problems = append(problems, pathProblems...)
+	}
+
+	return problems
+}
+
+// getPathReadinessProblem returns what keeps a path of a LUN, such as sdb, from being written to, or an empty
+// string if nothing does.  A path whose state can't be read is assumed to be running.
+func getPathReadinessProblem(ctx context.Context, path string, readOnly bool) string {
+	if ro, _ := readSysfsAttribute(ctx, path, "ro"); ro == "1" && !readOnly {
+		return "read-only"
+	}
+	if state, err := readSysfsAttribute(ctx, path, "device/state"); err == nil && state != "running" {
+		return state
+	}
+	return ""
+}
+
+// recoverDevicePaths rescans each path of a LUN that isn't ready, so that the kernel reads its write protection
+// and capacity from the array again, and has multipath reload the LUN's map if a path is ready but the multipath
+// device is still read-only, since a map keeps the write protection its paths had when it was loaded.
+func recoverDevicePaths(ctx context.Context, deviceInfo *ScsiDeviceInfo) {
+
+	readyPath := false
+	for _, path := range deviceInfo.Devices {
+		if getPathReadinessProblem(ctx, path, false) == "" {
+			readyPath = true
+			continue
+		}
+		if err := rescanOneLun(ctx, chrootPathPrefix+"/sys/block/"+path+"/device"); err != nil {
+			Logc(ctx).WithField("device", path).WithError(err).Debug("Could not rescan path.")
+		}
+	}
+
+	if multipathDevice := deviceInfo.MultipathDevice; multipathDevice != "" && readyPath {
+		if ro, _ := readSysfsAttribute(ctx, multipathDevice, "ro"); ro == "1" {
+			if _, err := execCommandWithTimeout(ctx, "multipath", 10, true, "-r",
+				"/dev/"+multipathDevice); err != nil {
+				Logc(ctx).WithField("multipathDevice", multipathDevice).WithError(err).Debug(
+					"Could not reload multipath map.")
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnsureDeviceReady(t *testing.T) {
+	log.Debug("Running TestEnsureDeviceReady...")
+
+	dir, err := ioutil.TempDir("", "TestEnsureDeviceReady")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: recorder, Clock: newFakeClock()}))
+	defer func() { _ = Init(Config{}) }()
+
+	setPath := func(device, ro, state string) {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block", device, "device"), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/block", device, "ro"), []byte(ro+"\n"), 0644))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/block", device, "device/state"), []byte(state+"\n"),
+			0644))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/block", device, "device/rescan"), nil, 0644))
+	}
+	rescans := func(device string) int {
+		content, err := ioutil.ReadFile(path.Join(dir, "sys/block", device, "device/rescan"))
+		assert.NoError(t, err)
+		return len(content)
+	}
+
+	ctx := context.TODO()
+	deviceInfo := &ScsiDeviceInfo{LUN: "1", Devices: []string{"sdb", "sdc"}}
+
+	// One writable, running path is enough
+	setPath("sdb", "1", "running")
+	setPath("sdc", "0", "running")
+	assert.NoError(t, ensureDeviceReady(ctx, deviceInfo, false))
+
+	// A LUN with no usable path isn't ready, and its paths are rescanned while it's waited for
+	setPath("sdc", "0", "offline")
+	err = ensureDeviceReady(ctx, deviceInfo, false)
+	assert.True(t, IsDeviceNotReadyError(err))
+	assert.Contains(t, err.Error(), "sdb: read-only")
+	assert.Contains(t, err.Error(), "sdc: offline")
+	assert.True(t, rescans("sdb") > 1)
+
+	// Read-only paths are fine for a LUN attached read-only
+	setPath("sdc", "1", "running")
+	assert.NoError(t, ensureDeviceReady(ctx, deviceInfo, true))
+
+	// A read-only multipath device is reloaded once one of its paths is writable again
+	setPath("sdc", "0", "running")
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block/dm-3/dm"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/block/dm-3/ro"), []byte("1\n"), 0644))
+	deviceInfo.MultipathDevice = "dm-3"
+	recorder.commands = nil
+	assert.True(t, IsDeviceNotReadyError(ensureDeviceReady(ctx, deviceInfo, false)))
+	assert.Contains(t, recorder.commands, "multipath -r /dev/dm-3")
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
@@ -315,3 +316,147 @@ func IsTempOperatorError(err error) bool {
 	_, ok := err.(*tempOperatorError)
 	return ok
 }
+
+/////////////////////////////////////////////////////////////////////////////
+// nodeSaturatedError
+/////////////////////////////////////////////////////////////////////////////
+
+type nodeSaturatedError struct {
+	message string
+}
+
+func (e *nodeSaturatedError) Error() string { return e.message }
+
+func NodeSaturatedError(message string) error {
+	return &nodeSaturatedError{message}
+}
+
+func IsNodeSaturatedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// An attach's error may carry the kernel's messages about the LUN
+	var saturatedErr *nodeSaturatedError
+	return errors.As(err, &saturatedErr)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// duplicateInitiatorError
+/////////////////////////////////////////////////////////////////////////////
+
+type duplicateInitiatorError struct {
+	message string
+}
+
+func (e *duplicateInitiatorError) Error() string { return e.message }
+
+func DuplicateInitiatorError(message string) error {
+	return &duplicateInitiatorError{message}
+}
+
+func IsDuplicateInitiatorError(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, ok := err.(*duplicateInitiatorError)
+	return ok
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// mountBusyError
+/////////////////////////////////////////////////////////////////////////////
+
+type mountBusyError struct {
+	message string
+}
+
+func (e *mountBusyError) Error() string { return e.message }
+
+func MountBusyError(message string) error {
+	return &mountBusyError{message}
+}
+
+func IsMountBusyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, ok := err.(*mountBusyError)
+	return ok
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// formatFailedError
+/////////////////////////////////////////////////////////////////////////////
+
+// formatFailedError is a failure to make a filesystem that would recur however often it was retried.
+type formatFailedError struct {
+	message string
+}
+
+func (e *formatFailedError) Error() string { return e.message }
+
+func FormatFailedError(message string) error {
+	return &formatFailedError{message}
+}
+
+func IsFormatFailedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// The failure is wrapped in the error of the attach that formats the LUN
+	var formatErr *formatFailedError
+	return errors.As(err, &formatErr)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// deviceNotReadyError
+/////////////////////////////////////////////////////////////////////////////
+
+// deviceNotReadyError is an attach's failure because the LUN's devices are read-only or their paths have failed.
+type deviceNotReadyError struct {
+	message string
+}
+
+func (e *deviceNotReadyError) Error() string { return e.message }
+
+func DeviceNotReadyError(message string) error {
+	return &deviceNotReadyError{message}
+}
+
+func IsDeviceNotReadyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// An attach's error may carry the kernel's messages about the LUN
+	var notReadyErr *deviceNotReadyError
+	return errors.As(err, &notReadyErr)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// kernelMessagesError
+/////////////////////////////////////////////////////////////////////////////
+
+// kernelMessagesError is an error of a host operation with the kernel's log messages about the devices involved.
+type kernelMessagesError struct {
+	err      error
+	messages []string
+}
+
+func (e *kernelMessagesError) Error() string {
+	return fmt.Sprintf("%v; kernel messages: %s", e.err, strings.Join(e.messages, " | "))
+}
+
+func (e *kernelMessagesError) Unwrap() error { return e.err }
+
+func KernelMessagesError(err error, messages []string) error {
+	return &kernelMessagesError{err, messages}
+}
+
+// GetKernelMessages returns the kernel's log messages attached to an error, if any.
+func GetKernelMessages(err error) []string {
+	var kernelErr *kernelMessagesError
+	if errors.As(err, &kernelErr) {
+		return kernelErr.messages
+	}
+	return nil
+}
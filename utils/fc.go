@@ -0,0 +1,305 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// FC host adapters list each of their local ports in /sys/class/fc_host, as hostN, and each remote port they've
+// logged in to in /sys/class/fc_remote_ports, as rport-H:B-R, where H is the number of the host that sees it.  A
+// remote port's roles tell whether it's an FCP (SCSI) target, an NVMe target, or both.
+//
+// FCoE hosts on converged adapters are listed alongside native FC hosts, and are told apart by their SCSI host's
+// driver.  Their ports stay down until the adapter has found an FCoE forwarder on the converged network, which
+// needs DCB to have been negotiated with the switch: by the adapter's firmware for fnic and qedf, but by lldpad on
+// the host for software FCoE and bnx2fc.  Both kinds of host are rescanned through their SCSI host's scan file,
+// and never by a LIP, which on a converged adapter resets the link for all of its traffic.
+
+const (
+	fcHostClassDir       = "/sys/class/fc_host"
+	fcRemotePortClassDir = "/sys/class/fc_remote_ports"
+
+	fcPortStateOnline = "Online"
+	fcRoleNVMeTarget  = "NVMe Target"
+	fcRoleFCPTarget   = "FCP Target"
+)
+
+// fcoeDrivers are the drivers of FCoE hosts, each mapped to whether it relies on lldpad to negotiate DCB
+var fcoeDrivers = map[string]bool{
+	"fcoe":   true,
+	"bnx2fc": true,
+	"fnic":   false,
+	"qedf":   false,
+}
+
+// fcPort is a local or remote FC port.  Host is the FC host the port is, or through which it's seen.  Driver is
+// the driver of a local port's SCSI host, and FCoE is set if it's an FCoE host.
+type fcPort struct {
+	Name      string
+	Host      string
+	NodeName  string
+	PortName  string
+	PortState string
+	Roles     []string
+	Driver    string
+	FCoE      bool
+}
+
+// FCPath is a path to an FCP target port: the FC host and remote port it runs through, and the SCSI channel and
+// target numbers at which the target's LUNs are found through it.
+type FCPath struct {
+	Host       string `json:"host"`
+	RemotePort string `json:"remotePort"`
+	TargetWWPN string `json:"targetWwpn"`
+	Channel    string `json:"channel"`
+	TargetID   string `json:"targetId"`
+	FCoE       bool   `json:"fcoe,omitempty"`
+}
+
+// address returns the port's address as the kernel's NVMe FC transport and nvme-cli give it, such as
+// "nn-0x20000090fa942779:pn-0x10000090fa942779".
+func (p fcPort) address() string {
+	return "nn-" + p.NodeName + ":pn-" + p.PortName
+}
+
+// online returns true if the port can carry traffic.
+func (p fcPort) online() bool {
+	return p.PortState == fcPortStateOnline
+}
+
+// hasRole returns true if a remote port has a role, such as NVMe Target.
+func (p fcPort) hasRole(role string) bool {
+	return StringInSlice(role, p.Roles)
+}
+
+// listFCHosts returns the local ports of this host's FC host adapters, sorted by name.
+func listFCHosts(ctx context.Context) ([]fcPort, error) {
+
+	names, err := listFCClass(fcHostClassDir)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make([]fcPort, 0, len(names))
+	for _, name := range names {
+		host := fcPort{Name: name, Host: name}
+		readFCPortAttributes(ctx, path.Join(chrootPathPrefix+fcHostClassDir, name), &host)
+		driver, err := readFileWithTimeout(ctx, chrootPathPrefix+"/sys/class/scsi_host/"+name+"/proc_name")
+		if err == nil {
+			host.Driver = strings.TrimSpace(string(driver))
+			_, host.FCoE = fcoeDrivers[host.Driver]
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// fcHostProblem explains why an FC host can't carry traffic, or returns an empty string if it can.  An FCoE host
+// whose driver needs lldpad is most often down because lldpad isn't running.
+func fcHostProblem(ctx context.Context, host fcPort) string {
+
+	if host.online() {
+		return ""
+	}
+	state := strings.ToLower(host.PortState)
+	if state == "" {
+		state = "in an unknown state"
+	}
+	problem := fmt.Sprintf("%s is %s", host.Name, state)
+	if host.FCoE && fcoeDrivers[host.Driver] && !lldpadIsRunning(ctx) {
+		problem += fmt.Sprintf("; its FCoE driver %s needs lldpad to negotiate DCB, and lldpad is not running",
+			host.Driver)
+	}
+	return problem
+}
+
+// lldpadIsRunning returns true if the LLDP agent, which negotiates DCB for FCoE, is running on the host.
+func lldpadIsRunning(ctx context.Context) bool {
+	out, err := execCommand(ctx, "pgrep", "-x", "lldpad")
+	if err != nil {
+		Logc(ctx).WithError(err).Debug("lldpad is not running.")
+		return false
+	}
+	return pidRegex.MatchString(strings.TrimSpace(string(out)))
+}
+
+// DiscoverFCPaths returns the paths from this host's online FC hosts, FCoE hosts included, to the online FCP
+// target ports with the WWPNs given.  If there are none, the error says why, such as that every FC host is down
+// and why it is.
+func DiscoverFCPaths(ctx context.Context, targetWWPNs []string) ([]FCPath, error) {
+
+	Logc(ctx).WithField("targetWWPNs", targetWWPNs).Debug(">>>> fc.DiscoverFCPaths")
+	defer Logc(ctx).Debug("<<<< fc.DiscoverFCPaths")
+
+	hosts, err := listFCHosts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list FC hosts; %v", err)
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("no FC host adapters")
+	}
+	rports, err := listFCRemotePorts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list FC remote ports; %v", err)
+	}
+
+	onlineHosts := make(map[string]fcPort)
+	problems := make([]string, 0)
+	for _, host := range hosts {
+		if problem := fcHostProblem(ctx, host); problem != "" {
+			Logc(ctx).WithFields(log.Fields{
+				"host":   host.Name,
+				"driver": host.Driver,
+				"fcoe":   host.FCoE,
+			}).Warning("FC host is not online; " + problem + ".")
+			problems = append(problems, problem)
+			continue
+		}
+		onlineHosts[host.Name] = host
+	}
+	if len(onlineHosts) == 0 {
+		return nil, fmt.Errorf("no FC host is online: %s", strings.Join(problems, "; "))
+	}
+
+	wwpns := make([]string, 0, len(targetWWPNs))
+	for _, wwpn := range targetWWPNs {
+		wwpns = append(wwpns, normalizeWWPN(wwpn))
+	}
+
+	paths := make([]FCPath, 0)
+	for _, rport := range rports {
+		host, ok := onlineHosts[rport.Host]
+		if !ok || !rport.online() || !rport.hasRole(fcRoleFCPTarget) {
+			continue
+		}
+		if !StringInSlice(normalizeWWPN(rport.PortName), wwpns) {
+			continue
+		}
+		targetID, err := readFileWithTimeout(ctx, path.Join(chrootPathPrefix+fcRemotePortClassDir, rport.Name,
+			"scsi_target_id"))
+		if err != nil || strings.TrimSpace(string(targetID)) == "-1" {
+			continue
+		}
+		// Remote ports are named rport-H:C-N, where C is the SCSI channel
+		channel := "0"
+		if hostChannel := strings.SplitN(rport.Name, ":", 2); len(hostChannel) == 2 {
+			channel = strings.SplitN(hostChannel[1], "-", 2)[0]
+		}
+		paths = append(paths, FCPath{
+			Host:       host.Name,
+			RemotePort: rport.Name,
+			TargetWWPN: rport.PortName,
+			Channel:    channel,
+			TargetID:   strings.TrimSpace(string(targetID)),
+			FCoE:       host.FCoE,
+		})
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no online FC host is logged in to target ports %v", targetWWPNs)
+	}
+
+	Logc(ctx).WithField("paths", paths).Debug("Discovered FC paths.")
+	return paths, nil
+}
+
+// RescanFCPaths asks the SCSI host of each path to scan its target for a LUN.
+func RescanFCPaths(ctx context.Context, paths []FCPath, lunID int) error {
+
+	for _, fcPath := range paths {
+		filename := chrootPathPrefix + "/sys/class/scsi_host/" + fcPath.Host + "/scan"
+		scanCmd := fmt.Sprintf("%s %s %d", fcPath.Channel, fcPath.TargetID, lunID)
+		f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+		if err == nil {
+			_, err = f.WriteString(scanCmd)
+			f.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("could not scan %s for LUN %d; %v", fcPath.RemotePort, lunID, err)
+		}
+		Logc(ctx).WithFields(log.Fields{
+			"scanCmd":  scanCmd,
+			"scanFile": filename,
+		}).Debug("Invoked single-LUN scan.")
+	}
+	return nil
+}
+
+// normalizeWWPN puts a WWPN into one form whether it's given as sysfs lists it, as in "0x2005d039ea1c7b6a", or
+// with colons, as in "20:05:d0:39:ea:1c:7b:6a".
+func normalizeWWPN(wwpn string) string {
+	wwpn = strings.ToLower(strings.TrimSpace(wwpn))
+	return strings.ReplaceAll(strings.TrimPrefix(wwpn, "0x"), ":", "")
+}
+
+// listFCRemotePorts returns the remote ports that this host's FC host adapters have logged in to, sorted by name.
+func listFCRemotePorts(ctx context.Context) ([]fcPort, error) {
+
+	names, err := listFCClass(fcRemotePortClassDir)
+	if err != nil {
+		return nil, err
+	}
+
+	rports := make([]fcPort, 0, len(names))
+	for _, name := range names {
+		hostNumber := strings.SplitN(strings.TrimPrefix(name, "rport-"), ":", 2)[0]
+		rport := fcPort{Name: name, Host: "host" + hostNumber}
+		dir := path.Join(chrootPathPrefix+fcRemotePortClassDir, name)
+		readFCPortAttributes(ctx, dir, &rport)
+		if roles, err := readFileWithTimeout(ctx, path.Join(dir, "roles")); err == nil {
+			for _, role := range strings.Split(string(roles), ",") {
+				if role = strings.TrimSpace(role); role != "" {
+					rport.Roles = append(rport.Roles, role)
+				}
+			}
+		}
+		rports = append(rports, rport)
+	}
+	return rports, nil
+}
+
+// listFCClass returns the sorted names of the entries in an FC sysfs class, or none if the class doesn't exist
+// because no FC driver is loaded.
+func listFCClass(dir string) ([]string, error) {
+
+	entries, err := ioutil.ReadDir(chrootPathPrefix + dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// readFCPortAttributes fills in the names and state of an FC port from its sysfs directory.  Attributes that
+// can't be read are left empty.
+func readFCPortAttributes(ctx context.Context, dir string, port *fcPort) {
+	for attribute, value := range map[string]*string{
+		"node_name":  &port.NodeName,
+		"port_name":  &port.PortName,
+		"port_state": &port.PortState,
+	} {
+		if content, err := readFileWithTimeout(ctx, path.Join(dir, attribute)); err == nil {
+			*value = strings.TrimSpace(string(content))
+		}
+	}
+	port.NodeName = strings.ToLower(port.NodeName)
+	port.PortName = strings.ToLower(port.PortName)
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// lldpadExecutor reports lldpad as running if it's set to.
+type lldpadExecutor struct {
+	recordingExecutor
+	running bool
+}
+
+func (e *lldpadExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	if cmd.Name == "pgrep" && e.running {
+		return []byte("1234\n"), nil
+	}
+	return nil, nil
+}
+
+func TestDiscoverFCPaths(t *testing.T) {
+	log.Debug("Running TestDiscoverFCPaths...")
+
+	dir, err := ioutil.TempDir("", "TestDiscoverFCPaths")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	executor := &lldpadExecutor{}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: executor}))
+	defer func() { _ = Init(Config{}) }()
+
+	writeFile := func(name, content string) {
+		assert.NoError(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644))
+	}
+
+	_, err = DiscoverFCPaths(context.TODO(), []string{"0x2005d039ea1c7b6a"})
+	assert.Error(t, err)
+
+	// host3 is an lpfc HBA and host4 a bnx2fc FCoE host, each logged in to a port of the target
+	writeFile("sys/class/fc_host/host3/port_state", "Online\n")
+	writeFile("sys/class/scsi_host/host3/proc_name", "lpfc\n")
+	writeFile("sys/class/fc_host/host4/port_state", "Linkdown\n")
+	writeFile("sys/class/scsi_host/host4/proc_name", "bnx2fc\n")
+	rports := map[string]string{"rport-3:0-1": "0x2005d039ea1c7b6a", "rport-4:0-0": "0x2006d039ea1c7b6a"}
+	for rport, wwpn := range rports {
+		writeFile("sys/class/fc_remote_ports/"+rport+"/port_name", wwpn+"\n")
+		writeFile("sys/class/fc_remote_ports/"+rport+"/port_state", "Online\n")
+		writeFile("sys/class/fc_remote_ports/"+rport+"/roles", "FCP Target\n")
+		writeFile("sys/class/fc_remote_ports/"+rport+"/scsi_target_id", "2\n")
+	}
+	targets := []string{"20:05:d0:39:ea:1c:7b:6a", "0x2006D039EA1C7B6A"}
+
+	// The FCoE host is down while lldpad isn't running to negotiate DCB
+	paths, err := DiscoverFCPaths(context.TODO(), targets)
+	assert.NoError(t, err)
+	assert.Equal(t, []FCPath{{
+		Host: "host3", RemotePort: "rport-3:0-1", TargetWWPN: "0x2005d039ea1c7b6a", Channel: "0", TargetID: "2",
+	}}, paths)
+
+	writeFile("sys/class/fc_host/host3/port_state", "Linkdown\n")
+	_, err = DiscoverFCPaths(context.TODO(), targets)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "lldpad is not running")
+
+	// Once its port is up, the FCoE host's path is found as any other's
+	executor.running = true
+	writeFile("sys/class/fc_host/host3/port_state", "Online\n")
+	writeFile("sys/class/fc_host/host4/port_state", "Online\n")
+	paths, err = DiscoverFCPaths(context.TODO(), targets)
+	assert.NoError(t, err)
+	assert.Len(t, paths, 2)
+	assert.Equal(t, FCPath{
+		Host: "host4", RemotePort: "rport-4:0-0", TargetWWPN: "0x2006d039ea1c7b6a", Channel: "0", TargetID: "2",
+		FCoE: true,
+	}, paths[1])
+
+	// Paths are rescanned through their SCSI hosts' scan files
+	writeFile("sys/class/scsi_host/host3/scan", "")
+	writeFile("sys/class/scsi_host/host4/scan", "")
+	assert.NoError(t, RescanFCPaths(context.TODO(), paths, 7))
+	scan, err := ioutil.ReadFile(path.Join(dir, "sys/class/scsi_host/host4/scan"))
+	assert.NoError(t, err)
+	assert.Equal(t, "0 2 7", string(scan))
+
+	// Ports that aren't FCP targets, or aren't the ones asked for, aren't paths
+	writeFile("sys/class/fc_remote_ports/rport-3:0-1/roles", "NVMe Target\n")
+	paths, err = DiscoverFCPaths(context.TODO(), targets[:1])
+	assert.Error(t, err)
+	assert.Empty(t, paths)
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+// Package fs identifies the filesystems on the host's devices by reading their superblocks, so that nodes
+// without blkid, such as distroless or musl-based images and many arm64 ones, are supported.  It imports nothing
+// from package utils, which formats and mounts devices using it, so that it can be used and tested on its own.
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// Filesystems not recognized here are left to blkid.  Every field is decoded with an explicit byte order, as each
+// filesystem defines it, so probing gives the same result on any architecture.
+
+// ProbeSize is how much of the start of a device is read to identify its filesystem.  It holds every superblock
+// probed, and is what a device must be all zeros over to be considered unformatted.
+const ProbeSize = 2 * 1024 * 1024
+
+// ZFSMemberType is the type, as blkid reports it, of a device belonging to a zpool.
+const ZFSMemberType = "zfs_member"
+
+// Probe describes the filesystem found at the start of a device.  A device with no filesystem recognized has an
+// empty type, and is zeroed if it's all zeros as far as it was read.
+type Probe struct {
+	Type   string
+	UUID   string
+	Label  string
+	Zeroed bool
+}
+
+// TimeoutError is returned when a device doesn't answer a read in time.
+type TimeoutError struct {
+	Device string
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out reading %s", e.Device)
+}
+
+// probers identify filesystems from the start of a device, in the order they're tried.  ZFS is tried last, since
+// its labels outlast a filesystem created over them.
+var probers = []func(head []byte) *Probe{
+	probeLUKS,
+	probeXFS,
+	probeExt,
+	probeBtrfs,
+	probeSwap,
+	probeZFS,
+}
+
+// ProbeDevice identifies the filesystem on a device, given by its path in this process's filesystem, from its
+// superblock.  The read is abandoned, with a TimeoutError, if the device doesn't answer within the timeout.
+func ProbeDevice(ctx context.Context, device string, timeout time.Duration) (*Probe, error) {
+
+	Logc(ctx).WithField("device", device).Debug(">>>> fs.ProbeDevice")
+	defer Logc(ctx).Debug("<<<< fs.ProbeDevice")
+
+	head, err := ReadDeviceHead(ctx, device, ProbeSize, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	probe := Identify(head)
+	Logc(ctx).WithFields(log.Fields{
+		"device": device,
+		"fstype": probe.Type,
+		"zeroed": probe.Zeroed,
+	}).Debug("Probed device.")
+
+	return probe, nil
+}
+
+// Identify identifies the filesystem at the start of a device, which must be at least ProbeSize bytes.
+func Identify(head []byte) *Probe {
+	for _, prober := range probers {
+		if probe := prober(head); probe != nil {
+			return probe
+		}
+	}
+	return &Probe{Zeroed: len(bytes.Trim(head, "\x00")) == 0}
+}
+
+// ReadDeviceHead reads the first bytes of a device in a separate goroutine, so that a device in a hung state
+// can't block the caller indefinitely.  A device shorter than the read is an error.
+func ReadDeviceHead(ctx context.Context, device string, size int, timeout time.Duration) ([]byte, error) {
+
+	type readResult struct {
+		head []byte
+		err  error
+	}
+	done := make(chan readResult, 1)
+
+	go func() {
+		disk, err := os.Open(device)
+		if err != nil {
+			done <- readResult{err: err}
+			return
+		}
+		defer disk.Close()
+
+		head := make([]byte, size)
+		if _, err = io.ReadFull(disk, head); err != nil {
+			err = fmt.Errorf("could not read %d bytes from device %s; %v", size, device, err)
+		}
+		done <- readResult{head: head, err: err}
+	}()
+
+	select {
+	case <-time.After(timeout):
+		Logc(ctx).WithFields(log.Fields{"device": device, "timeout": timeout}).Error("Timed out reading device.")
+		return nil, &TimeoutError{Device: device}
+	case result := <-done:
+		return result.head, result.err
+	}
+}
+
+// probeLUKS identifies a LUKS header, which is at the start of the device in both LUKS1 and LUKS2.
+func probeLUKS(head []byte) *Probe {
+	if !bytes.HasPrefix(head, []byte("LUKS\xba\xbe")) {
+		return nil
+	}
+	return &Probe{Type: "crypto_LUKS", UUID: cString(head[168:208])}
+}
+
+// probeXFS identifies an XFS superblock, which is at the start of the device and big-endian.
+func probeXFS(head []byte) *Probe {
+	if !bytes.HasPrefix(head, []byte("XFSB")) {
+		return nil
+	}
+	return &Probe{Type: "xfs", UUID: formatUUID(head[32:48]), Label: cString(head[108:120])}
+}
+
+const (
+	extSuperblockOffset     = 1024
+	extMagic                = 0xEF53
+	extFeatureCompatJournal = 0x0004
+	extFeatureIncompatJDev  = 0x0008
+	// ext3 supports no incompatible features but filetype, recover and meta_bg, and no read-only compatible
+	// features but sparse_super, large_file and btree_dir; a filesystem with any other is ext4
+	ext3FeatureIncompatSupported = 0x0002 | 0x0004 | 0x0010
+	ext3FeatureROCompatSupported = 0x0001 | 0x0002 | 0x0004
+)
+
+// probeExt identifies an ext2, ext3 or ext4 superblock, which is 1 KiB into the device and little-endian, and
+// tells the three apart by their features as blkid does.
+func probeExt(head []byte) *Probe {
+
+	sb := head[extSuperblockOffset : extSuperblockOffset+1024]
+	if binary.LittleEndian.Uint16(sb[56:58]) != extMagic {
+		return nil
+	}
+
+	compat := binary.LittleEndian.Uint32(sb[92:96])
+	incompat := binary.LittleEndian.Uint32(sb[96:100])
+	roCompat := binary.LittleEndian.Uint32(sb[100:104])
+
+	probe := &Probe{UUID: formatUUID(sb[104:120]), Label: cString(sb[120:136])}
+	switch {
+	case incompat&extFeatureIncompatJDev != 0:
+		probe.Type = "jbd"
+	case incompat&^ext3FeatureIncompatSupported != 0 || roCompat&^ext3FeatureROCompatSupported != 0:
+		probe.Type = "ext4"
+	case compat&extFeatureCompatJournal != 0:
+		probe.Type = "ext3"
+	default:
+		probe.Type = "ext2"
+	}
+	return probe
+}
+
+// probeBtrfs identifies a btrfs superblock, which is 64 KiB into the device.
+func probeBtrfs(head []byte) *Probe {
+	sb := head[64*1024 : 68*1024]
+	if !bytes.Equal(sb[64:72], []byte("_BHRfS_M")) {
+		return nil
+	}
+	return &Probe{Type: "btrfs", UUID: formatUUID(sb[32:48]), Label: cString(sb[299:555])}
+}
+
+// swapPageSizes are the page sizes swap areas may be made with.  The swap signature ends the first page, whose
+// size depends on the architecture, and arm64 kernels may use 16 or 64 KiB pages.
+var swapPageSizes = []int{4 * 1024, 16 * 1024, 64 * 1024}
+
+// probeSwap identifies a swap area, whose header follows the first 1 KiB of the device.
+func probeSwap(head []byte) *Probe {
+	for _, pageSize := range swapPageSizes {
+		signature := string(head[pageSize-10 : pageSize])
+		if signature == "SWAPSPACE2" || signature == "SWAP-SPACE" {
+			return &Probe{Type: "swap", UUID: formatUUID(head[1036:1052]), Label: cString(head[1052:1068])}
+		}
+	}
+	return nil
+}
+
+const (
+	zfsUberblockMagic  = 0x00bab10c
+	zfsUberblockOffset = 128 * 1024
+	zfsUberblockSize   = 1024
+	zfsUberblockCount  = 128
+)
+
+// probeZFS identifies a ZFS pool member from the uberblocks in its first label, which are written in the byte
+// order of the host that wrote them.
+func probeZFS(head []byte) *Probe {
+	for i := 0; i < zfsUberblockCount; i++ {
+		offset := zfsUberblockOffset + i*zfsUberblockSize
+		magic := head[offset : offset+8]
+		if binary.LittleEndian.Uint64(magic) == zfsUberblockMagic ||
+			binary.BigEndian.Uint64(magic) == zfsUberblockMagic {
+			return &Probe{Type: ZFSMemberType}
+		}
+	}
+	return nil
+}
+
+// formatUUID formats 16 bytes as a UUID, or returns an empty string if they're all zeros.
+func formatUUID(b []byte) string {
+	if len(bytes.Trim(b, "\x00")) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// cString returns the NUL-terminated string at the start of a field.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package fs
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+var testFilesystemUUID = []byte{0x0a, 0x1b, 0x2c, 0x3d, 0x4e, 0x5f, 0x60, 0x71, 0x82, 0x93, 0xa4, 0xb5, 0xc6, 0xd7,
+	0xe8, 0xf9}
+
+func TestProbeDevice(t *testing.T) {
+	log.Debug("Running TestProbeDevice...")
+
+	const uuid, label = "0a1b2c3d-4e5f-6071-8293-a4b5c6d7e8f9", "tr-00000001"
+
+	newHead := func() []byte { return make([]byte, ProbeSize) }
+	newExtHead := func(compat, incompat, roCompat uint32) []byte {
+		head := newHead()
+		sb := head[extSuperblockOffset:]
+		binary.LittleEndian.PutUint16(sb[56:], extMagic)
+		binary.LittleEndian.PutUint32(sb[92:], compat)
+		binary.LittleEndian.PutUint32(sb[96:], incompat)
+		binary.LittleEndian.PutUint32(sb[100:], roCompat)
+		copy(sb[104:], testFilesystemUUID)
+		copy(sb[120:], label)
+		return head
+	}
+
+	xfs := newHead()
+	copy(xfs, "XFSB")
+	copy(xfs[32:], testFilesystemUUID)
+	copy(xfs[108:], "data")
+
+	btrfs := newHead()
+	copy(btrfs[64*1024+32:], testFilesystemUUID)
+	copy(btrfs[64*1024+64:], "_BHRfS_M")
+
+	// The swap signature ends the first page, which is larger on some arm64 kernels
+	swap4k, swap16k, swap64k := newHead(), newHead(), newHead()
+	copy(swap4k[4096-10:], "SWAPSPACE2")
+	copy(swap16k[16*1024-10:], "SWAP-SPACE")
+	copy(swap16k[1052:], "swap16k")
+	copy(swap64k[64*1024-10:], "SWAPSPACE2")
+	copy(swap64k[1036:], testFilesystemUUID)
+
+	// Uberblocks are written in the byte order of the host that wrote them
+	zfsLittle, zfsBig := newHead(), newHead()
+	binary.LittleEndian.PutUint64(zfsLittle[zfsUberblockOffset+3*zfsUberblockSize:], zfsUberblockMagic)
+	binary.BigEndian.PutUint64(zfsBig[zfsUberblockOffset:], zfsUberblockMagic)
+
+	data := newHead()
+	copy(data[ProbeSize-4:], "data")
+
+	tests := map[string]struct {
+		head     []byte
+		expected Probe
+	}{
+		"XFS":        {xfs, Probe{Type: "xfs", UUID: uuid, Label: "data"}},
+		"ext2":       {newExtHead(0, 0x0002, 0x0001), Probe{Type: "ext2", UUID: uuid, Label: label}},
+		"ext3":       {newExtHead(0x0004, 0x0002, 0x0003), Probe{Type: "ext3", UUID: uuid, Label: label}},
+		"ext4":       {newExtHead(0x0004, 0x02c2, 0x0003), Probe{Type: "ext4", UUID: uuid, Label: label}},
+		"btrfs":      {btrfs, Probe{Type: "btrfs", UUID: uuid}},
+		"swap 4k":    {swap4k, Probe{Type: "swap"}},
+		"swap 16k":   {swap16k, Probe{Type: "swap", Label: "swap16k"}},
+		"swap 64k":   {swap64k, Probe{Type: "swap", UUID: uuid}},
+		"ZFS little": {zfsLittle, Probe{Type: ZFSMemberType}},
+		"ZFS big":    {zfsBig, Probe{Type: ZFSMemberType}},
+		"zeroed":     {newHead(), Probe{Zeroed: true}},
+		"data":       {data, Probe{}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, *Identify(test.head))
+		})
+	}
+
+	// Swap areas made on this host, with its page size, are recognized
+	assert.Contains(t, swapPageSizes, os.Getpagesize())
+
+	// Devices must be at least as long as the probe
+	dir, err := ioutil.TempDir("", "TestProbeDevice")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sdb"), xfs, 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sdc"), xfs[:4096], 0644))
+
+	probe, err := ProbeDevice(context.TODO(), path.Join(dir, "sdb"), time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "xfs", probe.Type)
+	_, err = ProbeDevice(context.TODO(), path.Join(dir, "sdc"), time.Second)
+	assert.Error(t, err)
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+const (
+	mib = int64(1) << 20
+	gib = int64(1) << 30
+	tib = int64(1) << 40
+	eib = int64(1) << 60
+
+	// ext4MaxSize32Bit is the largest ext3/ext4 filesystem whose 4KiB blocks are numbered in 32 bits
+	ext4MaxSize32Bit = 16 * tib
+	// ext4BigallocThreshold is the size above which ext4 allocates in clusters rather than blocks, keeping the
+	// bitmaps, and so the time to mount and check the filesystem, manageable
+	ext4BigallocThreshold   = 256 * tib
+	ext4BigallocClusterSize = 64 * 1024
+
+	ext4Feature64Bit    = "64bit"
+	ext4FeatureBigalloc = "bigalloc"
+)
+
+// filesystemSizeLimit bounds the size of a filesystem of some type.  Sizes outside Min and Max can't be formatted
+// or grown to, and sizes above Supported work but are beyond what distributions support.
+type filesystemSizeLimit struct {
+	Min       int64
+	Max       int64
+	Supported int64
+}
+
+var filesystemSizeLimits = map[string]filesystemSizeLimit{
+	"xfs":  {Min: 300 * mib, Max: math.MaxInt64, Supported: 1024 * tib},
+	"ext3": {Min: 1 * mib, Max: ext4MaxSize32Bit, Supported: ext4MaxSize32Bit},
+	"ext4": {Min: 1 * mib, Max: eib, Supported: 50 * tib},
+}
+
+// validateFilesystemSize checks that a filesystem of some type may have the given size, logging a warning if the
+// size is beyond what is supported.  Unknown sizes and filesystem types aren't checked.
+func validateFilesystemSize(ctx context.Context, fstype string, size int64) error {
+
+	limit, ok := filesystemSizeLimits[fstype]
+	if !ok || size <= 0 {
+		return nil
+	}
+
+	if size < limit.Min {
+		return fmt.Errorf("%d bytes is smaller than the minimum %s filesystem size of %d bytes", size, fstype,
+			limit.Min)
+	} else if size > limit.Max {
+		return fmt.Errorf("%d bytes is larger than the maximum %s filesystem size of %d bytes", size, fstype,
+			limit.Max)
+	} else if size > limit.Supported {
+		Logc(ctx).WithFields(log.Fields{
+			"fsType":    fstype,
+			"size":      size,
+			"supported": limit.Supported,
+		}).Warning("Filesystem size is larger than supported.")
+	}
+	return nil
+}
+
+// getExtFeaturesForSize returns the ext4 features a filesystem of the given size must be created with.  Recent
+// mke2fs versions enable 64bit by default, but older ones, or a mke2fs.conf that disables it, would create a
+// filesystem that can't ever be grown past 16TiB.
+func getExtFeaturesForSize(fstype string, size int64) []string {
+
+	features := make([]string, 0)
+	if fstype != "ext4" {
+		return features
+	}
+	if size > ext4MaxSize32Bit {
+		features = append(features, ext4Feature64Bit)
+	}
+	if size > ext4BigallocThreshold {
+		features = append(features, ext4FeatureBigalloc)
+	}
+	return features
+}
+
+// getExtFilesystemFeatures returns the features of the ext3/ext4 filesystem on a device.
+func getExtFilesystemFeatures(ctx context.Context, device string) ([]string, error) {
+
+	out, err := execCommandWithTimeout(ctx, "dumpe2fs", 30, false, "-h", device)
+	if err != nil {
+		return nil, fmt.Errorf("could not read filesystem features of %s; %v", device, err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "Filesystem features:") {
+			return strings.Fields(strings.TrimPrefix(line, "Filesystem features:")), nil
+		}
+	}
+	return nil, fmt.Errorf("could not find filesystem features of %s", device)
+}
+
+// validateFilesystemResize checks that the filesystem on a device may be grown to the given size, before it is
+// grown.  An ext3/ext4 filesystem without the 64bit feature can't be grown past 16TiB, and resize2fs can
+// only add the feature to an unmounted filesystem, so this is found out here rather than halfway through a resize.
+func validateFilesystemResize(ctx context.Context, fstype, device string, size int64) error {
+
+	if err := validateFilesystemSize(ctx, fstype, size); err != nil {
+		return err
+	}
+
+	if (fstype == "ext3" || fstype == "ext4") && size > ext4MaxSize32Bit {
+		features, err := getExtFilesystemFeatures(ctx, device)
+		if err != nil {
+			return err
+		}
+		if !StringInSlice(ext4Feature64Bit, features) {
+			return fmt.Errorf("cannot grow the %s filesystem on %s to %d bytes; it lacks the %s feature needed "+
+				"beyond %d bytes", fstype, device, size, ext4Feature64Bit, ext4MaxSize32Bit)
+		}
+	}
+	return nil
+}
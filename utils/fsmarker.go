@@ -0,0 +1,120 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// Each filesystem created on a LUN is labelled with a marker naming the volume it was created for, so that a
+// filesystem found on a later attach can be told apart from one that was already there, as in support cases, and
+// a filesystem of unknown origin needn't be adopted.  Labels are short, at most 12 characters for XFS and 16 for
+// ext3/ext4, so the marker holds a hash of the volume's name rather than the name itself.  A clone carries the
+// marker of the volume it was cloned from.
+
+// filesystemMarkerPrefix begins the label of every filesystem this package creates.
+const filesystemMarkerPrefix = "tr-"
+
+// FilesystemOrigin says who created the filesystem found on an attached LUN.
+type FilesystemOrigin string
+
+const (
+	// FilesystemOriginVolume is a filesystem created for the volume being attached
+	FilesystemOriginVolume FilesystemOrigin = "volume"
+	// FilesystemOriginOtherVolume is a filesystem created for another volume, such as the source of a clone
+	FilesystemOriginOtherVolume FilesystemOrigin = "other-volume"
+	// FilesystemOriginForeign is a filesystem without a marker, created elsewhere or before markers were recorded
+	FilesystemOriginForeign FilesystemOrigin = "foreign"
+)
+
+var requireFilesystemMarker bool
+
+// filesystemMarker returns the label given to a filesystem created for a volume.
+func filesystemMarker(name string) string {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(name))
+	return fmt.Sprintf("%s%08x", filesystemMarkerPrefix, hash.Sum32())
+}
+
+// getFilesystemOrigin returns the origin of a filesystem with a label, as created for a volume.
+func getFilesystemOrigin(name, label string) FilesystemOrigin {
+	switch {
+	case label == filesystemMarker(name):
+		return FilesystemOriginVolume
+	case strings.HasPrefix(label, filesystemMarkerPrefix) && len(label) == len(filesystemMarker(name)):
+		return FilesystemOriginOtherVolume
+	default:
+		return FilesystemOriginForeign
+	}
+}
+
+// checkFilesystemMarker reads the marker of the filesystem on a device of a volume and sets the publish info's
+// filesystem origin from it.  A filesystem without a marker, or whose marker can't be read, is refused if markers
+// are required.
+func checkFilesystemMarker(ctx context.Context, name, device string, publishInfo *VolumePublishInfo) error {
+
+	label, err := getFilesystemLabel(ctx, device)
+	if err != nil {
+		publishInfo.FilesystemOrigin = ""
+		if requireFilesystemMarker {
+			return fmt.Errorf("could not read label of filesystem on device %s; %v", device, err)
+		}
+		Logc(ctx).WithField("device", device).WithError(err).Warning("Could not read filesystem label.")
+		return nil
+	}
+
+	origin := getFilesystemOrigin(name, label)
+	publishInfo.FilesystemOrigin = origin
+
+	fields := log.Fields{"volume": name, "device": device, "label": label, "origin": origin}
+	switch origin {
+	case FilesystemOriginVolume:
+		Logc(ctx).WithFields(fields).Debug("Filesystem was created for this volume.")
+	case FilesystemOriginOtherVolume:
+		Logc(ctx).WithFields(fields).Info("Filesystem was created for another volume.")
+	default:
+		if requireFilesystemMarker {
+			Logc(ctx).WithFields(fields).Error("Filesystem was not created by Trident, not using it.")
+			return fmt.Errorf("filesystem on device %s was not created by Trident", device)
+		}
+		Logc(ctx).WithFields(fields).Info("Filesystem was not created by Trident.")
+	}
+	return nil
+}
+
+// getFilesystemLabel returns the label of the filesystem on a device, which is empty if it has none.
+func getFilesystemLabel(ctx context.Context, device string) (string, error) {
+
+	if probe, err := ProbeFilesystem(ctx, device); err == nil && probe.Type != "" {
+		return probe.Label, nil
+	}
+
+	out, err := execCommandWithTimeout(ctx, "blkid", 5, true, "-s", "LABEL", "-o", "value", device)
+	if err != nil {
+		// blkid exits with 2 when the filesystem has no label
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// withFilesystemLabel returns mkfs arguments, which end with the device, that also label the filesystem.  Both
+// mkfs.xfs and mke2fs take the label with -L.
+func withFilesystemLabel(args []string, label string) []string {
+	if len(args) == 0 || label == "" {
+		return args
+	}
+	labelled := make([]string, 0, len(args)+2)
+	labelled = append(labelled, args[:len(args)-1]...)
+	return append(labelled, "-L", label, args[len(args)-1])
+}
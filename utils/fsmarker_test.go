@@ -0,0 +1,29 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilesystemMarker(t *testing.T) {
+	log.Debug("Running TestFilesystemMarker...")
+
+	marker := filesystemMarker("pvc-0a1b2c3d-4e5f-6789-abcd-ef0123456789")
+	assert.Regexp(t, "^tr-[0-9a-f]{8}$", marker)
+	assert.True(t, len(marker) <= 12, "marker must fit an XFS label")
+	assert.Equal(t, marker, filesystemMarker("pvc-0a1b2c3d-4e5f-6789-abcd-ef0123456789"))
+
+	assert.Equal(t, FilesystemOriginVolume, getFilesystemOrigin("vol1", filesystemMarker("vol1")))
+	assert.Equal(t, FilesystemOriginOtherVolume, getFilesystemOrigin("vol1", filesystemMarker("vol2")))
+	assert.Equal(t, FilesystemOriginForeign, getFilesystemOrigin("vol1", ""))
+	assert.Equal(t, FilesystemOriginForeign, getFilesystemOrigin("vol1", "tr-backup"))
+	assert.Equal(t, FilesystemOriginForeign, getFilesystemOrigin("vol1", "data"))
+
+	assert.Equal(t, []string{"-F", "-E", "nodiscard", "-L", "tr-00000001", "/dev/sdb"},
+		withFilesystemLabel([]string{"-F", "-E", "nodiscard", "/dev/sdb"}, "tr-00000001"))
+	assert.Equal(t, []string{"-f", "/dev/sdb"}, withFilesystemLabel([]string{"-f", "/dev/sdb"}, ""))
+}
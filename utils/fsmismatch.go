@@ -0,0 +1,131 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+	"github.com/netapp/trident/utils/mount"
+)
+
+// FilesystemMismatchPolicy determines what happens when an attached LUN already carries a filesystem of a type
+// other than the one requested, as when a volume is restored from a backup of a volume with another filesystem.
+// LUNs attached to more than one node and read-only clones are never reformatted, whatever the policy.
+type FilesystemMismatchPolicy string
+
+const (
+	// FilesystemMismatchPolicyFail fails the attach
+	FilesystemMismatchPolicyFail FilesystemMismatchPolicy = "fail"
+	// FilesystemMismatchPolicyMountExisting mounts the existing filesystem, as its own type, and logs a warning
+	FilesystemMismatchPolicyMountExisting FilesystemMismatchPolicy = "mount-existing"
+	// FilesystemMismatchPolicyReformatIfEmpty formats the LUN with the requested filesystem if the existing one
+	// holds no files, and otherwise fails the attach
+	FilesystemMismatchPolicyReformatIfEmpty FilesystemMismatchPolicy = "reformat-if-empty"
+)
+
+var filesystemMismatchPolicy = FilesystemMismatchPolicyFail
+
+func validateFilesystemMismatchPolicy(policy FilesystemMismatchPolicy) error {
+	switch policy {
+	case FilesystemMismatchPolicyFail, FilesystemMismatchPolicyMountExisting, FilesystemMismatchPolicyReformatIfEmpty:
+		return nil
+	default:
+		return fmt.Errorf("invalid filesystem mismatch policy: %s", policy)
+	}
+}
+
+// resolveFilesystemMismatch applies the filesystem mismatch policy to a device whose existing filesystem isn't
+// the one the publish info requests.  It returns the filesystem type the device is to be treated as having: the
+// existing one, which the publish info's filesystem type is then set to, or none if the device is to be formatted.
+func resolveFilesystemMismatch(
+	ctx context.Context, device, existingFstype string, publishInfo *VolumePublishInfo,
+) (string, error) {
+
+	logFields := log.Fields{
+		"device":          device,
+		"existingFstype":  existingFstype,
+		"requestedFstype": publishInfo.FilesystemType,
+		"policy":          filesystemMismatchPolicy,
+	}
+	Logc(ctx).WithFields(logFields).Debug(">>>> fsmismatch.resolveFilesystemMismatch")
+	defer Logc(ctx).WithFields(logFields).Debug("<<<< fsmismatch.resolveFilesystemMismatch")
+
+	switch filesystemMismatchPolicy {
+	case FilesystemMismatchPolicyMountExisting:
+		Logc(ctx).WithFields(logFields).Warning("LUN already formatted with a different file system type; " +
+			"using the existing file system.")
+		publishInfo.FilesystemType = existingFstype
+		return existingFstype, nil
+
+	case FilesystemMismatchPolicyReformatIfEmpty:
+		if publishInfo.MultiAttach || publishInfo.ReadOnlyClone {
+			return existingFstype, fmt.Errorf("already formatted with other filesystem: %s; not reformatting a "+
+				"shared LUN or read-only clone", existingFstype)
+		}
+		empty, err := isFilesystemEmpty(ctx, device, existingFstype)
+		if err != nil {
+			return existingFstype, fmt.Errorf("already formatted with other filesystem: %s; could not determine "+
+				"whether it is empty; %v", existingFstype, err)
+		} else if !empty {
+			return existingFstype, fmt.Errorf("already formatted with other filesystem: %s, which is not empty",
+				existingFstype)
+		}
+		Logc(ctx).WithFields(logFields).Warning("LUN already formatted with a different, empty file system; " +
+			"reformatting it.")
+		return "", nil
+
+	default:
+		Logc(ctx).WithFields(logFields).Error("LUN already formatted with a different file system type.")
+		return existingFstype, fmt.Errorf("already formatted with other filesystem: %s", existingFstype)
+	}
+}
+
+// isFilesystemEmpty reports whether the filesystem on a device holds no files other than an empty lost+found.  The
+// filesystem is mounted read-only, without replaying its journal, at a temporary mountpoint on the host to look.
+func isFilesystemEmpty(ctx context.Context, device, fstype string) (bool, error) {
+
+	mountPoint, err := newUnstagedTemporaryMountPoint(ctx, "fs-check-")
+	if err != nil {
+		return false, err
+	}
+	localMountPoint := LocalPath(mountPoint)
+
+	options := mount.MergeOptions("", "", readOnlyCloneMountOptions(fstype)...)
+	if err = MountDevice(ctx, device, mountPoint, options, false); err != nil {
+		_ = removeMountPointDir(ctx, localMountPoint)
+		return false, err
+	}
+	defer func() {
+		err := Umount(ctx, mountPoint)
+		if err == nil {
+			err = removeMountPointDir(ctx, localMountPoint)
+		}
+		if err != nil {
+			Logc(ctx).WithField("mountPoint", mountPoint).WithError(err).Warning(
+				"Could not remove temporary mountpoint.")
+		}
+	}()
+
+	entries, err := ioutil.ReadDir(localMountPoint)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.Name() != "lost+found" || !entry.IsDir() {
+			return false, nil
+		}
+		// fsck puts what it recovers in lost+found, which is otherwise empty
+		if lostFound, err := ioutil.ReadDir(path.Join(localMountPoint, entry.Name())); err != nil {
+			return false, err
+		} else if len(lostFound) > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveFilesystemMismatch(t *testing.T) {
+	log.Debug("Running TestResolveFilesystemMismatch...")
+
+	defer func() { _ = Init(Config{}) }()
+	ctx := context.TODO()
+
+	assert.Error(t, Init(Config{FilesystemMismatchPolicy: "ignore"}))
+
+	// The default fails the attach and leaves the requested filesystem type
+	assert.NoError(t, Init(Config{}))
+	publishInfo := &VolumePublishInfo{FilesystemType: "ext4"}
+	fstype, err := resolveFilesystemMismatch(ctx, "/dev/dm-0", "xfs", publishInfo)
+	assert.EqualError(t, err, "already formatted with other filesystem: xfs")
+	assert.Equal(t, "xfs", fstype)
+	assert.Equal(t, "ext4", publishInfo.FilesystemType)
+
+	// The existing filesystem can be used instead of the requested one
+	assert.NoError(t, Init(Config{FilesystemMismatchPolicy: FilesystemMismatchPolicyMountExisting}))
+	fstype, err = resolveFilesystemMismatch(ctx, "/dev/dm-0", "xfs", publishInfo)
+	assert.NoError(t, err)
+	assert.Equal(t, "xfs", fstype)
+	assert.Equal(t, "xfs", publishInfo.FilesystemType)
+
+	// Shared LUNs and read-only clones are never reformatted, so nothing is mounted to look at them
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{FilesystemMismatchPolicy: FilesystemMismatchPolicyReformatIfEmpty,
+		Executor: recorder}))
+	for _, publishInfo := range []*VolumePublishInfo{
+		{FilesystemType: "ext4", MultiAttach: true},
+		{FilesystemType: "ext4", ReadOnlyClone: true},
+	} {
+		fstype, err = resolveFilesystemMismatch(ctx, "/dev/dm-0", "xfs", publishInfo)
+		assert.Error(t, err)
+		assert.Equal(t, "xfs", fstype)
+	}
+	assert.Empty(t, recorder.commands)
+}
+
+// mountingExecutor simulates mounting a filesystem holding some files: mount creates them at the mountpoint, made
+// beneath the host root, and umount removes them.  Names ending in a slash are directories.
+type mountingExecutor struct {
+	recordingExecutor
+	hostRoot string
+	files    []string
+}
+
+func (e *mountingExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	switch cmd.Name {
+	case "mount":
+		mountPoint := path.Join(e.hostRoot, cmd.Args[len(cmd.Args)-1])
+		for _, file := range e.files {
+			if strings.HasSuffix(file, "/") {
+				if err := os.MkdirAll(path.Join(mountPoint, file), 0755); err != nil {
+					return nil, err
+				}
+			} else if err := ioutil.WriteFile(path.Join(mountPoint, file), nil, 0644); err != nil {
+				return nil, err
+			}
+		}
+	case "umount":
+		entries, err := ioutil.ReadDir(path.Join(e.hostRoot, cmd.Args[0]))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if err = os.RemoveAll(path.Join(e.hostRoot, cmd.Args[0], entry.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+func TestReformatIfEmpty(t *testing.T) {
+	log.Debug("Running TestReformatIfEmpty...")
+
+	defer func() { _ = Init(Config{}) }()
+
+	for _, test := range []struct {
+		name   string
+		files  []string
+		format bool
+	}{
+		{"empty", nil, true},
+		{"empty lost+found", []string{"lost+found/"}, true},
+		{"recovered files", []string{"lost+found/", "lost+found/#12"}, false},
+		{"files", []string{"lost+found/", "data"}, false},
+		{"lost+found file", []string{"lost+found"}, false},
+	} {
+		dir, err := ioutil.TempDir("", "TestReformatIfEmpty")
+		assert.NoError(t, err)
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "dev"), 0755))
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "proc"), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "dev", "dm-7"), nil, 0644))
+
+		executor := &mountingExecutor{hostRoot: dir, files: test.files}
+		assert.NoError(t, Init(Config{DockerPluginMode: true, HostRoot: dir, Executor: executor,
+			FilesystemMismatchPolicy: FilesystemMismatchPolicyReformatIfEmpty}))
+
+		// The filesystem was found on the multipath device itself, so that's the device looked at and formatted
+		publishInfo := &VolumePublishInfo{FilesystemType: "ext4"}
+		err = setUpAttachedDevice(context.TODO(), "pvc-1", "", "/dev/mapper/3600a0980", "dm-7", "xfs", false,
+			publishInfo)
+
+		commands := executor.commands
+		if assert.True(t, len(commands) >= 2, test.name) {
+			assert.True(t, strings.HasPrefix(commands[0], "mount -o ro,nouuid,norecovery /dev/dm-7 "+
+				unstagedTemporaryMountDir+"/fs-check-"), commands[0])
+			assert.True(t, strings.HasPrefix(commands[1], "umount "+unstagedTemporaryMountDir+"/fs-check-"),
+				commands[1])
+		}
+		if test.format {
+			assert.NoError(t, err, test.name)
+			if assert.Len(t, commands, 3, test.name) {
+				assert.True(t, strings.HasPrefix(commands[2], "mkfs.ext4 "), commands[2])
+				assert.True(t, strings.HasSuffix(commands[2], " /dev/dm-7"), commands[2])
+			}
+			assert.Equal(t, FilesystemOriginVolume, publishInfo.FilesystemOrigin, test.name)
+		} else {
+			assert.EqualError(t, err, "LUN pvc-1, device dm-7 already formatted with other filesystem: xfs, "+
+				"which is not empty", test.name)
+			assert.Len(t, commands, 2, test.name)
+		}
+		assert.Equal(t, "ext4", publishInfo.FilesystemType, test.name)
+
+		// The temporary mountpoint is removed once the filesystem is unmounted
+		mountPoints, err := ioutil.ReadDir(path.Join(dir, unstagedTemporaryMountDir))
+		assert.NoError(t, err)
+		assert.Empty(t, mountPoints, test.name)
+
+		_ = os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+
+	"github.com/netapp/trident/utils/fs"
+)
+
+// FilesystemProbe describes the filesystem found at the start of a device.
+//
+// Deprecated: use fs.Probe.
+type FilesystemProbe = fs.Probe
+
+// ProbeFilesystem identifies the filesystem on a device from its superblock, without running blkid.  The device
+// is read beneath the host root, and the read is abandoned, with a TimeoutError, if the device doesn't answer in
+// time.
+func ProbeFilesystem(ctx context.Context, device string) (*FilesystemProbe, error) {
+	probe, err := fs.ProbeDevice(ctx, chrootPathPrefix+device, deviceReadTimeout)
+	return probe, fsError(err)
+}
+
+// readDeviceHead reads the first bytes of a device, failing with a TimeoutError if it doesn't answer in time.
+func readDeviceHead(ctx context.Context, device string, size int) ([]byte, error) {
+	head, err := fs.ReadDeviceHead(ctx, device, size, deviceReadTimeout)
+	return head, fsError(err)
+}
+
+// fsError returns a TimeoutError in place of the fs package's, so that callers can tell it apart.
+func fsError(err error) error {
+	if timeoutErr, ok := err.(*fs.TimeoutError); ok {
+		return TimeoutError(timeoutErr.Error())
+	}
+	return err
+}
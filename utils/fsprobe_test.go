@@ -0,0 +1,89 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netapp/trident/utils/fs"
+)
+
+func TestProbeFilesystem(t *testing.T) {
+	log.Debug("Running TestProbeFilesystem...")
+
+	// Devices are read beneath the host root
+	dir, err := ioutil.TempDir("", "TestProbeFilesystem")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	xfs := make([]byte, fs.ProbeSize)
+	copy(xfs, "XFSB")
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "dev"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "dev/sdb"), xfs, 0644))
+
+	probe, err := ProbeFilesystem(context.TODO(), "/dev/sdb")
+	assert.NoError(t, err)
+	assert.Equal(t, "xfs", probe.Type)
+	_, err = ProbeFilesystem(context.TODO(), "/dev/sdc")
+	assert.Error(t, err)
+
+	assert.True(t, IsTimeoutError(fsError(&fs.TimeoutError{Device: "/dev/sdb"})))
+	assert.False(t, IsTimeoutError(fsError(os.ErrNotExist)))
+}
+
+// blkidExecutor answers blkid with its output, or as if blkid weren't installed if it has none.
+type blkidExecutor struct {
+	recordingExecutor
+	output string
+}
+
+func (e *blkidExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	if e.output == "" {
+		return nil, exec.ErrNotFound
+	}
+	return []byte(e.output), nil
+}
+
+func TestGetFSTypeWithoutBlkid(t *testing.T) {
+	log.Debug("Running TestGetFSTypeWithoutBlkid...")
+
+	dir, err := ioutil.TempDir("", "TestGetFSTypeWithoutBlkid")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	executor := &blkidExecutor{output: "/dev/sdb: UUID=\"a1b2\" TYPE=\"LVM2_member\"\n"}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: executor}))
+	defer func() { _ = Init(Config{}) }()
+
+	xfs, data := make([]byte, fs.ProbeSize), make([]byte, fs.ProbeSize)
+	copy(xfs, "XFSB")
+	copy(data[fs.ProbeSize-4:], "data")
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "dev"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "dev/sdb"), make([]byte, fs.ProbeSize), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "dev/sdc"), xfs, 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "dev/sdd"), data, 0644))
+
+	// blkid, which knows signatures the probe doesn't, is trusted over a probe that finds only zeros
+	fstype, err := getFSType(context.TODO(), "/dev/sdb")
+	assert.NoError(t, err)
+	assert.Equal(t, "LVM2_member", fstype)
+
+	// Without blkid, the probe decides
+	executor.output = ""
+	for device, expected := range map[string]string{"/dev/sdb": "", "/dev/sdc": "xfs", "/dev/sdd": unknownFstype} {
+		fstype, err = getFSType(context.TODO(), device)
+		assert.NoError(t, err, device)
+		assert.Equal(t, expected, fstype, device)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// filesystemOverheadFraction is the largest fraction of a device that a filesystem's metadata, such as ext4's
+	// inode tables and journal, may plausibly keep from the size the filesystem reports
+	filesystemOverheadFraction = 0.1
+)
+
+// FilesystemResizeResult describes a completed filesystem resize.
+type FilesystemResizeResult struct {
+	// PreExpandSize and PostExpandSize are the sizes the filesystem reported before and after the resize
+	PreExpandSize  int64 `json:"preExpandSize"`
+	PostExpandSize int64 `json:"postExpandSize"`
+	// DeviceSize is the size of the device beneath the filesystem
+	DeviceSize int64         `json:"deviceSize"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// filesystemGrowthExpected returns whether a device is larger than a filesystem on it by more than the filesystem's
+// metadata could account for, so that resizing the filesystem should have grown it.
+func filesystemGrowthExpected(filesystemSize, deviceSize int64) bool {
+	overhead := int64(float64(deviceSize) * filesystemOverheadFraction)
+	if overhead < deviceSizeMismatchDelta {
+		overhead = deviceSizeMismatchDelta
+	}
+	return deviceSize-filesystemSize > overhead
+}
+
+// checkFilesystemGrew returns an error if a resize left a filesystem the same size although its device has room for
+// it to grow.  Resize utilities can exit successfully having done nothing, as when the kernel hasn't yet seen the
+// device's new size.
+func checkFilesystemGrew(devicePath string, result FilesystemResizeResult) error {
+
+	if result.PostExpandSize != result.PreExpandSize ||
+		!filesystemGrowthExpected(result.PreExpandSize, result.DeviceSize) {
+		return nil
+	}
+	return fmt.Errorf("filesystem on device %s is still %d bytes after resizing, although the device is %d bytes",
+		devicePath, result.PostExpandSize, result.DeviceSize)
+}
+
+// journalFilesystemResize records the outcome of a filesystem resize in the host journal.
+func journalFilesystemResize(ctx context.Context, result FilesystemResizeResult, err error) {
+	if err != nil {
+		journalHostOutcome(ctx, "Filesystem resize", err)
+		return
+	}
+	journalHostOperation(ctx, log.InfoLevel, "Filesystem resize succeeded.", log.Fields{
+		"preExpandSize":  result.PreExpandSize,
+		"postExpandSize": result.PostExpandSize,
+		"deviceSize":     result.DeviceSize,
+		"duration":       result.Duration,
+	})
+}
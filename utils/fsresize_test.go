@@ -0,0 +1,37 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilesystemGrowthExpected(t *testing.T) {
+	log.Debug("Running TestFilesystemGrowthExpected...")
+
+	// Metadata keeps the filesystem a little smaller than its device
+	assert.False(t, filesystemGrowthExpected(10*gib-300*mib, 10*gib))
+	assert.False(t, filesystemGrowthExpected(1*gib-60*mib, 1*gib))
+	assert.True(t, filesystemGrowthExpected(10*gib-300*mib, 20*gib))
+	assert.True(t, filesystemGrowthExpected(300*mib, 500*mib))
+}
+
+func TestCheckFilesystemGrew(t *testing.T) {
+	log.Debug("Running TestCheckFilesystemGrew...")
+
+	// A filesystem that grew, or that already fills its device, was resized
+	assert.NoError(t, checkFilesystemGrew("/dev/dm-3", FilesystemResizeResult{
+		PreExpandSize: 10 * gib, PostExpandSize: 20 * gib, DeviceSize: 20 * gib,
+	}))
+	assert.NoError(t, checkFilesystemGrew("/dev/dm-3", FilesystemResizeResult{
+		PreExpandSize: 20*gib - 500*mib, PostExpandSize: 20*gib - 500*mib, DeviceSize: 20 * gib,
+	}))
+
+	// One that didn't grow into a larger device wasn't
+	assert.Error(t, checkFilesystemGrew("/dev/dm-3", FilesystemResizeResult{
+		PreExpandSize: 10 * gib, PostExpandSize: 10 * gib, DeviceSize: 20 * gib,
+	}))
+}
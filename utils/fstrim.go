@@ -0,0 +1,290 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+const (
+	// trimSchedulerCheckInterval is how often the trim scheduler looks for mounts due to be trimmed
+	trimSchedulerCheckInterval = time.Minute
+	defaultTrimTimeout         = 30 * time.Minute
+)
+
+var fstrimBytesRegex = regexp.MustCompile(`\((\d+) bytes\)`)
+
+// TrimPolicy controls the background trim scheduler, which runs fstrim on tracked mounts so that space freed by
+// deleted files is returned to thinly provisioned LUNs without each node needing its own cron job.
+type TrimPolicy struct {
+	// Interval is how often each tracked mount is trimmed unless its volume says otherwise; zero disables trimming
+	Interval time.Duration
+	// MaxLoadAverage postpones trims while the host's one-minute load average is above it; zero means no limit
+	MaxLoadAverage float64
+	// MaxConcurrent is how many mounts may be trimmed at once; zero means one
+	MaxConcurrent int
+	// Timeout bounds a single fstrim run; zero selects 30 minutes
+	Timeout time.Duration
+}
+
+var trimPolicy TrimPolicy
+
+// TrimResult reports the most recent trim of a tracked volume.
+type TrimResult struct {
+	VolumeID     string        `json:"volumeID"`
+	Mountpoint   string        `json:"mountpoint"`
+	LastTrim     time.Time     `json:"lastTrim,omitempty"`
+	Duration     time.Duration `json:"duration,omitempty"`
+	TrimmedBytes int64         `json:"trimmedBytes"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// trimVolume is a volume tracked by the trim scheduler, with the mountpoints through which it may be trimmed.
+// Trimming any one of them trims the whole filesystem.
+type trimVolume struct {
+	mountpoints []string
+	interval    time.Duration
+	running     bool
+	result      TrimResult
+}
+
+// trimScheduler periodically trims tracked volumes.
+type trimScheduler struct {
+	lock     sync.Mutex
+	volumes  map[string]*trimVolume
+	stopChan chan struct{}
+}
+
+var fstrimScheduler = &trimScheduler{volumes: make(map[string]*trimVolume)}
+
+// TrackTrimMount adds a mount of a volume to those the trim scheduler trims.  The interval overrides that of the
+// trim policy for the volume if positive, and excludes the volume from trimming if negative.
+func TrackTrimMount(ctx context.Context, volumeID, mountpoint string, interval time.Duration) {
+
+	fstrimScheduler.lock.Lock()
+	defer fstrimScheduler.lock.Unlock()
+
+	volume, ok := fstrimScheduler.volumes[volumeID]
+	if !ok {
+		volume = &trimVolume{result: TrimResult{VolumeID: volumeID}}
+		fstrimScheduler.volumes[volumeID] = volume
+	}
+	volume.interval = interval
+	if !StringInSlice(mountpoint, volume.mountpoints) {
+		volume.mountpoints = append(volume.mountpoints, mountpoint)
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"volumeID":   volumeID,
+		"mountpoint": mountpoint,
+		"interval":   interval,
+	}).Debug("Tracking mount for trimming.")
+}
+
+// UntrackTrimMount removes a mount of a volume from those the trim scheduler trims, and forgets the volume once
+// it has no tracked mounts.
+func UntrackTrimMount(ctx context.Context, volumeID, mountpoint string) {
+
+	fstrimScheduler.lock.Lock()
+	defer fstrimScheduler.lock.Unlock()
+
+	volume, ok := fstrimScheduler.volumes[volumeID]
+	if !ok {
+		return
+	}
+	mountpoints := make([]string, 0, len(volume.mountpoints))
+	for _, m := range volume.mountpoints {
+		if m != mountpoint {
+			mountpoints = append(mountpoints, m)
+		}
+	}
+	volume.mountpoints = mountpoints
+	if len(mountpoints) == 0 {
+		delete(fstrimScheduler.volumes, volumeID)
+	}
+
+	Logc(ctx).WithFields(log.Fields{"volumeID": volumeID, "mountpoint": mountpoint}).Debug(
+		"No longer tracking mount for trimming.")
+}
+
+// StartTrimScheduler starts trimming tracked mounts according to the trim policy, calling onUpdate (if not nil)
+// with the results whenever a round of trims finishes.  It does nothing if trimming is disabled or the scheduler
+// is already running.
+func StartTrimScheduler(ctx context.Context, onUpdate func([]TrimResult)) {
+
+	if trimPolicy.Interval == 0 {
+		return
+	}
+
+	fstrimScheduler.lock.Lock()
+	defer fstrimScheduler.lock.Unlock()
+
+	if fstrimScheduler.stopChan != nil {
+		return
+	}
+	stopChan := make(chan struct{})
+	fstrimScheduler.stopChan = stopChan
+
+	Logc(ctx).WithField("interval", trimPolicy.Interval).Info("Starting trim scheduler.")
+
+	go func() {
+		ticker := time.NewTicker(trimSchedulerCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-ticker.C:
+				if fstrimScheduler.trimDue(ctx, time.Now()) > 0 && onUpdate != nil {
+					onUpdate(GetTrimResults())
+				}
+			}
+		}
+	}()
+}
+
+// StopTrimScheduler stops the trim scheduler if it is running.  Trims already running are left to finish.
+func StopTrimScheduler() {
+
+	fstrimScheduler.lock.Lock()
+	defer fstrimScheduler.lock.Unlock()
+
+	if fstrimScheduler.stopChan != nil {
+		close(fstrimScheduler.stopChan)
+		fstrimScheduler.stopChan = nil
+	}
+}
+
+// GetTrimResults returns the most recent trim result of each tracked volume, in order of volume ID.
+func GetTrimResults() []TrimResult {
+
+	fstrimScheduler.lock.Lock()
+	defer fstrimScheduler.lock.Unlock()
+
+	results := make([]TrimResult, 0, len(fstrimScheduler.volumes))
+	for _, volume := range fstrimScheduler.volumes {
+		result := volume.result
+		if result.Mountpoint == "" && len(volume.mountpoints) > 0 {
+			result.Mountpoint = volume.mountpoints[0]
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].VolumeID < results[j].VolumeID })
+	return results
+}
+
+// trimDue trims the tracked volumes whose intervals have elapsed, at most the policy's maximum at once, unless
+// the host is too busy.  It returns how many volumes were trimmed.
+func (s *trimScheduler) trimDue(ctx context.Context, now time.Time) int {
+
+	if trimPolicy.MaxLoadAverage > 0 {
+		if load, err := getLoadAverage(); err != nil {
+			Logc(ctx).WithError(err).Debug("Could not read load average.")
+		} else if load > trimPolicy.MaxLoadAverage {
+			Logc(ctx).WithFields(log.Fields{"load": load, "maxLoad": trimPolicy.MaxLoadAverage}).Debug(
+				"Postponing trims while host is busy.")
+			return 0
+		}
+	}
+
+	type trimTask struct {
+		volumeID, mountpoint string
+	}
+
+	s.lock.Lock()
+	tasks := make([]trimTask, 0)
+	for volumeID, volume := range s.volumes {
+		interval := volume.interval
+		if interval == 0 {
+			interval = trimPolicy.Interval
+		}
+		if interval < 0 || volume.running || len(volume.mountpoints) == 0 || now.Before(volume.result.LastTrim.Add(interval)) {
+			continue
+		}
+		volume.running = true
+		tasks = append(tasks, trimTask{volumeID, volume.mountpoints[0]})
+	}
+	s.lock.Unlock()
+
+	maxConcurrent := trimPolicy.MaxConcurrent
+	if maxConcurrent == 0 {
+		maxConcurrent = 1
+	}
+	semaphore := make(chan struct{}, maxConcurrent)
+
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(task trimTask) {
+			defer func() { <-semaphore; wg.Done() }()
+
+			result := fstrimMount(ctx, task.volumeID, task.mountpoint)
+
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			if volume, ok := s.volumes[task.volumeID]; ok {
+				volume.running = false
+				volume.result = result
+			}
+		}(task)
+	}
+	wg.Wait()
+
+	return len(tasks)
+}
+
+// fstrimMount runs fstrim on a mountpoint.
+func fstrimMount(ctx context.Context, volumeID, mountpoint string) TrimResult {
+
+	ctx = WithLogFields(ctx, log.Fields{LogFieldVolume: volumeID})
+
+	timeout := trimPolicy.Timeout
+	if timeout == 0 {
+		timeout = defaultTrimTimeout
+	}
+
+	result := TrimResult{VolumeID: volumeID, Mountpoint: mountpoint, LastTrim: time.Now()}
+	out, err := execCommandWithTimeout(ctx, "fstrim", timeout/time.Second, true, "-v", mountpoint)
+	result.Duration = time.Since(result.LastTrim)
+	if err != nil {
+		result.Error = err.Error()
+		Logc(ctx).WithField("mountpoint", mountpoint).WithError(err).Warning("Could not trim mount.")
+		return result
+	}
+
+	if matches := fstrimBytesRegex.FindStringSubmatch(string(out)); matches != nil {
+		result.TrimmedBytes, _ = strconv.ParseInt(matches[1], 10, 64)
+	}
+	Logc(ctx).WithFields(log.Fields{
+		"mountpoint":   mountpoint,
+		"trimmedBytes": result.TrimmedBytes,
+		"duration":     result.Duration,
+	}).Debug("Trimmed mount.")
+	return result
+}
+
+// getLoadAverage returns the host's one-minute load average.
+func getLoadAverage() (float64, error) {
+	content, err := ioutil.ReadFile(chrootPathPrefix + "/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected load average: %q", content)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
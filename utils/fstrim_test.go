@@ -0,0 +1,88 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// fstrimExecutor simulates fstrim, which fails on /mnt/bad.
+type fstrimExecutor struct {
+	recordingExecutor
+}
+
+func (e *fstrimExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	if cmd.Args[len(cmd.Args)-1] == "/mnt/bad" {
+		return []byte("fstrim: /mnt/bad: the discard operation is not supported\n"), errors.New("exit status 1")
+	}
+	return []byte(cmd.Args[len(cmd.Args)-1] + ": 1 MiB (1048576 bytes) trimmed\n"), nil
+}
+
+func TestTrimDue(t *testing.T) {
+	log.Debug("Running TestTrimDue...")
+
+	dir, err := ioutil.TempDir("", "TestTrimDue")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "proc"), 0755))
+
+	executor := &fstrimExecutor{}
+	assert.NoError(t, Init(Config{
+		HostRoot:   dir,
+		Executor:   executor,
+		TrimPolicy: TrimPolicy{Interval: time.Hour, MaxLoadAverage: 4},
+	}))
+	defer func() { _ = Init(Config{}) }()
+	defer func() { fstrimScheduler.volumes = make(map[string]*trimVolume) }()
+
+	ctx := context.TODO()
+	TrackTrimMount(ctx, "vol1", "/mnt/a", 0)
+	TrackTrimMount(ctx, "vol1", "/mnt/b", 0)
+	TrackTrimMount(ctx, "vol2", "/mnt/bad", 0)
+	TrackTrimMount(ctx, "vol3", "/mnt/c", -1)
+	TrackTrimMount(ctx, "vol4", "/mnt/d", 4*time.Hour)
+
+	// Nothing is trimmed while the host is busy
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "proc/loadavg"), []byte("6.50 3.00 1.00 2/300 1234\n"), 0644))
+	now := time.Now()
+	assert.Equal(t, 0, fstrimScheduler.trimDue(ctx, now))
+	assert.Empty(t, executor.commands)
+
+	// Each volume is trimmed once, through one of its mounts, unless it's excluded
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "proc/loadavg"), []byte("0.50 0.40 0.30 2/300 1234\n"), 0644))
+	assert.Equal(t, 3, fstrimScheduler.trimDue(ctx, now))
+	assert.ElementsMatch(t, []string{"fstrim -v /mnt/a", "fstrim -v /mnt/bad", "fstrim -v /mnt/d"}, executor.commands)
+
+	results := GetTrimResults()
+	assert.Len(t, results, 4)
+	assert.Equal(t, "vol1", results[0].VolumeID)
+	assert.Equal(t, int64(1048576), results[0].TrimmedBytes)
+	assert.Empty(t, results[0].Error)
+	assert.False(t, results[0].LastTrim.IsZero())
+	assert.Equal(t, "/mnt/bad", results[1].Mountpoint)
+	assert.NotEmpty(t, results[1].Error)
+	assert.True(t, results[2].LastTrim.IsZero())
+
+	// Volumes are trimmed again only once their intervals elapse
+	executor.commands = nil
+	assert.Equal(t, 2, fstrimScheduler.trimDue(ctx, time.Now().Add(2*time.Hour)))
+	assert.ElementsMatch(t, []string{"fstrim -v /mnt/a", "fstrim -v /mnt/bad"}, executor.commands)
+
+	// A volume is trimmed through its remaining mount, and forgotten with its last
+	UntrackTrimMount(ctx, "vol1", "/mnt/a")
+	executor.commands = nil
+	assert.Equal(t, 2, fstrimScheduler.trimDue(ctx, time.Now().Add(3*time.Hour)))
+	assert.ElementsMatch(t, []string{"fstrim -v /mnt/b", "fstrim -v /mnt/bad"}, executor.commands)
+	UntrackTrimMount(ctx, "vol1", "/mnt/b")
+	assert.Len(t, GetTrimResults(), 3)
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	. "github.com/netapp/trident/logger"
+)
+
+const (
+	// healthCheckTimeoutSecs bounds each command run by a health check, so probes fail rather than hang
+	healthCheckTimeoutSecs = 5
+
+	HealthCheckExec       = "exec"
+	HealthCheckISCSID     = "iscsid"
+	HealthCheckMultipathd = "multipathd"
+	HealthCheckStateDir   = "stateDir"
+)
+
+// HealthStatus reports the result of each check made by HealthCheck.  It's healthy if every check is.
+type HealthStatus struct {
+	Healthy bool                         `json:"healthy"`
+	Checks  map[string]HealthCheckResult `json:"checks"`
+}
+
+// HealthCheckResult reports the result of a single health check.
+type HealthCheckResult struct {
+	Healthy  bool          `json:"healthy"`
+	Message  string        `json:"message,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Failures returns a description of each failed check, in order of check name.
+func (s HealthStatus) Failures() []string {
+	failures := make([]string, 0)
+	for name, result := range s.Checks {
+		if !result.Healthy {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, result.Message))
+		}
+	}
+	sort.Strings(failures)
+	return failures
+}
+
+// HealthCheck quickly checks that this package can do its work on this host, for liveness and readiness probes:
+// that commands can be run on the host, that the daemons volumes depend on respond, and that the state directory,
+// if any, is writable.  Daemons are only checked on hosts set up to run them, so iscsid is checked only if
+// iscsiadm is installed, and multipathd only if multipath is configured.
+func HealthCheck(ctx context.Context, stateDir string) HealthStatus {
+
+	Logc(ctx).Debug(">>>> health.HealthCheck")
+	defer Logc(ctx).Debug("<<<< health.HealthCheck")
+
+	checks := map[string]func(context.Context) error{
+		HealthCheckExec: checkExecHealth,
+	}
+	if _, ok := findHostTool("iscsiadm"); ok {
+		checks[HealthCheckISCSID] = checkISCSIDHealth
+	}
+	if PathExists(chrootPathPrefix + "/etc/multipath.conf") {
+		checks[HealthCheckMultipathd] = checkMultipathdHealth
+	}
+	if stateDir != "" {
+		checks[HealthCheckStateDir] = func(ctx context.Context) error { return checkStateDirHealth(stateDir) }
+	}
+
+	status := HealthStatus{Healthy: true, Checks: make(map[string]HealthCheckResult, len(checks))}
+	for name, check := range checks {
+		start := time.Now()
+		err := check(ctx)
+		result := HealthCheckResult{Healthy: err == nil, Duration: time.Since(start)}
+		if err != nil {
+			result.Message = err.Error()
+			status.Healthy = false
+		}
+		status.Checks[name] = result
+	}
+
+	if !status.Healthy {
+		Logc(ctx).WithField("failures", strings.Join(status.Failures(), "; ")).Warning("Health check failed.")
+	} else {
+		Logc(ctx).WithField("checks", len(status.Checks)).Debug("Health check passed.")
+	}
+
+	return status
+}
+
+// checkExecHealth runs a trivial command on the host, which fails if the executor or namespace entry is broken.
+// The command must be one chwrap ships, as the node images have nothing else to run, so it stats the root
+// directory, which is the host's once chwrap has entered it.
+func checkExecHealth(ctx context.Context) error {
+	if _, err := execCommandWithTimeout(ctx, "stat", healthCheckTimeoutSecs, false, "/"); err != nil {
+		return fmt.Errorf("could not run commands on the host; %v", err)
+	}
+	return nil
+}
+
+// checkISCSIDHealth lists iSCSI sessions, which iscsiadm gets from iscsid, so it fails if iscsid doesn't respond.
+// Having no sessions is healthy.
+func checkISCSIDHealth(ctx context.Context) error {
+	_, err := execCommandWithTimeout(ctx, "iscsiadm", healthCheckTimeoutSecs, false, "-m", "session")
+	if err == nil {
+		return nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if exitErr.ProcessState.Sys().(syscall.WaitStatus).ExitStatus() == iSCSIErrNoObjsFound {
+			return nil
+		}
+	}
+	return fmt.Errorf("iscsid did not respond; %v", err)
+}
+
+// checkMultipathdHealth asks multipathd for its state, which fails if it isn't running or doesn't respond.
+func checkMultipathdHealth(ctx context.Context) error {
+	out, err := execCommandWithTimeout(ctx, "multipathd", healthCheckTimeoutSecs, false, "show", "daemon")
+	if err != nil {
+		return fmt.Errorf("multipathd did not respond; %v", err)
+	} else if !pidRunningOrIdleRegex.MatchString(string(out)) {
+		return fmt.Errorf("multipathd is not running; %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// checkStateDirHealth creates the state directory if needed and writes and removes a file in it.
+func checkStateDirHealth(stateDir string) error {
+
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return fmt.Errorf("could not create state directory %s; %v", stateDir, err)
+	}
+
+	f, err := ioutil.TempFile(stateDir, ".health")
+	if err != nil {
+		return fmt.Errorf("state directory %s is not writable; %v", stateDir, err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.WriteString(time.Now().UTC().String()); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("could not write to state directory %s; %v", stateDir, err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("could not write to state directory %s; %v", stateDir, err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// healthExecutor simulates a host whose multipathd isn't running.
+type healthExecutor struct {
+	recordingExecutor
+}
+
+func (e *healthExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	if cmd.Name == "multipathd" {
+		return []byte("error receiving packet\n"), errors.New("exit status 1")
+	}
+	return nil, nil
+}
+
+func TestHealthCheck(t *testing.T) {
+	log.Debug("Running TestHealthCheck...")
+
+	dir, err := ioutil.TempDir("", "TestHealthCheck")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	lookPath = func(name string) (string, error) { return "", exec.ErrNotFound }
+	defer func() { lookPath = exec.LookPath }()
+
+	ctx := context.TODO()
+	stateDir := path.Join(dir, "state")
+	executor := &healthExecutor{}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: executor}))
+	defer func() { _ = Init(Config{}) }()
+
+	// Without iSCSI or multipath set up, only running commands and the state directory are checked
+	status := HealthCheck(ctx, stateDir)
+	assert.True(t, status.Healthy)
+	assert.Len(t, status.Checks, 2)
+	assert.True(t, status.Checks[HealthCheckStateDir].Healthy)
+	assert.Equal(t, []string{"stat /"}, executor.commands)
+	files, err := ioutil.ReadDir(stateDir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	// With iSCSI and multipath set up, their daemons must respond
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sbin"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sbin/iscsiadm"), nil, 0755))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "etc"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "etc/multipath.conf"), nil, 0644))
+	executor.commands = nil
+	status = HealthCheck(ctx, "")
+	assert.False(t, status.Healthy)
+	assert.True(t, status.Checks[HealthCheckExec].Healthy)
+	assert.True(t, status.Checks[HealthCheckISCSID].Healthy)
+	assert.False(t, status.Checks[HealthCheckMultipathd].Healthy)
+	assert.NotContains(t, status.Checks, HealthCheckStateDir)
+	assert.Equal(t, []string{"multipathd: multipathd did not respond; exit status 1"}, status.Failures())
+	assert.ElementsMatch(t, []string{"stat /", "iscsiadm -m session", "multipathd show daemon"}, executor.commands)
+
+	// A state directory that can't be written to fails the check
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "file"), nil, 0644))
+	assert.Error(t, checkStateDirHealth(path.Join(dir, "file")))
+}
+
+func TestCheckExecHealthDefaultExecutor(t *testing.T) {
+	log.Debug("Running TestCheckExecHealthDefaultExecutor...")
+
+	// The probe runs a real command, which must exist wherever the default executor runs it
+	assert.NoError(t, Init(Config{}))
+	assert.NoError(t, checkExecHealth(context.TODO()))
+}
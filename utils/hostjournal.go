@@ -0,0 +1,195 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+const (
+	// journalSocketPath is where journald accepts entries in its native protocol
+	journalSocketPath = "/run/systemd/journal/socket"
+	// journalIdentifier is the SYSLOG_IDENTIFIER of entries written to the host journal
+	journalIdentifier = "trident"
+	// redactedValue replaces secrets in commands recorded in the host journal
+	redactedValue = "<redacted>"
+)
+
+// hostJournal mirrors commands run on the host, and the outcome of attaches and detaches, to the host's journal,
+// so that host changes made by this package appear alongside kernel and iscsid messages; nil disables it.
+var hostJournal *journalWriter
+
+// journalWriter sends entries to journald over its native protocol socket.
+type journalWriter struct {
+	socketPath string
+	mutex      sync.Mutex
+	conn       *net.UnixConn
+}
+
+func newJournalWriter(socketPath string) *journalWriter {
+	return &journalWriter{socketPath: socketPath}
+}
+
+// send writes an entry to the journal, connecting to journald if not connected already.  An entry journald
+// can't be reached for is dropped, as the same information is in this package's own log.
+func (w *journalWriter) send(level log.Level, message string, fields log.Fields) error {
+
+	entry := encodeJournalEntry(level, message, fields)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.conn == nil {
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: w.socketPath, Net: "unixgram"})
+		if err != nil {
+			return fmt.Errorf("could not connect to journald at %s; %v", w.socketPath, err)
+		}
+		w.conn = conn
+	}
+
+	if _, err := w.conn.Write(entry); err != nil {
+		// Reconnect next time, in case journald was restarted
+		_ = w.conn.Close()
+		w.conn = nil
+		return fmt.Errorf("could not write to journald; %v", err)
+	}
+	return nil
+}
+
+// journalPriority maps a log level to a syslog priority.
+func journalPriority(level log.Level) int {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return 2
+	case log.ErrorLevel:
+		return 3
+	case log.WarnLevel:
+		return 4
+	case log.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// encodeJournalEntry encodes an entry in journald's native protocol.  Field names are upper-cased, with
+// characters journald doesn't allow replaced by underscores, and values spanning lines are length-prefixed.
+func encodeJournalEntry(level log.Level, message string, fields log.Fields) []byte {
+
+	var b bytes.Buffer
+	writeField := func(name, value string) {
+		if !strings.Contains(value, "\n") {
+			fmt.Fprintf(&b, "%s=%s\n", name, value)
+			return
+		}
+		b.WriteString(name + "\n")
+		_ = binary.Write(&b, binary.LittleEndian, uint64(len(value)))
+		b.WriteString(value + "\n")
+	}
+
+	writeField("MESSAGE", message)
+	writeField("PRIORITY", fmt.Sprintf("%d", journalPriority(level)))
+	writeField("SYSLOG_IDENTIFIER", journalIdentifier)
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if value := fields[name]; value != nil {
+			writeField(journalFieldName(name), fmt.Sprintf("%v", value))
+		}
+	}
+
+	return b.Bytes()
+}
+
+// journalFieldName converts a log field name to a journal field name, which may contain only upper-case
+// letters, digits, and underscores, and mustn't begin with an underscore, as those are set by journald itself.
+func journalFieldName(name string) string {
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	return "TRIDENT_" + strings.TrimLeft(mapped, "_")
+}
+
+// journalHostOperation records a host operation in the host journal, with the fields attached to the context,
+// if writing to the host journal is enabled.
+func journalHostOperation(ctx context.Context, level log.Level, message string, fields log.Fields) {
+
+	if hostJournal == nil {
+		return
+	}
+
+	entry := Logc(ctx).WithFields(fields)
+	if err := hostJournal.send(level, message, entry.Data); err != nil {
+		Logc(ctx).WithError(err).Debug("Could not write to host journal.")
+	}
+}
+
+// journalHostOutcome records whether an attach, detach, or other change to the host succeeded in the host journal.
+func journalHostOutcome(ctx context.Context, operation string, err error) {
+	if err != nil {
+		journalHostOperation(ctx, log.ErrorLevel, operation+" failed.", log.Fields{"error": err})
+	} else {
+		journalHostOperation(ctx, log.InfoLevel, operation+" succeeded.", nil)
+	}
+}
+
+// journalCommand records a command run on the host in the host journal.
+func journalCommand(ctx context.Context, name string, args []string, err error) {
+
+	if hostJournal == nil {
+		return
+	}
+
+	fields := log.Fields{"command": name + " " + strings.Join(redactCommandArgs(args), " ")}
+	if err != nil {
+		fields["error"] = err
+		journalHostOperation(ctx, log.WarnLevel, "Host command failed.", fields)
+	} else {
+		journalHostOperation(ctx, log.InfoLevel, "Host command succeeded.", fields)
+	}
+}
+
+// redactCommandArgs returns a copy of a command's arguments with the values of iscsiadm settings whose names
+// mention a password, such as CHAP secrets, replaced, since the host journal is kept and readable by others.
+func redactCommandArgs(args []string) []string {
+
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+
+	secret := false
+	for i, arg := range redacted {
+		switch {
+		case arg == "-n" || arg == "--name":
+			secret = i+1 < len(redacted) && strings.Contains(redacted[i+1], "password")
+		case secret && (arg == "-v" || arg == "--value") && i+1 < len(redacted):
+			redacted[i+1] = redactedValue
+			secret = false
+		case secret && strings.HasPrefix(arg, "--value="):
+			redacted[i] = "--value=" + redactedValue
+			secret = false
+		}
+	}
+	return redacted
+}
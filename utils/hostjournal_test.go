@@ -0,0 +1,83 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	. "github.com/netapp/trident/logger"
+)
+
+func TestHostJournal(t *testing.T) {
+	log.Debug("Running TestHostJournal...")
+
+	dir, err := ioutil.TempDir("", "TestHostJournal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socketPath := path.Join(dir, journalSocketPath)
+	assert.NoError(t, os.MkdirAll(path.Dir(socketPath), 0755))
+	journald, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	assert.NoError(t, err)
+	defer journald.Close()
+
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: recorder, LogToHostJournal: true}))
+	defer func() { _ = Init(Config{}) }()
+
+	receive := func() string {
+		buf := make([]byte, 65536)
+		_ = journald.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := journald.Read(buf)
+		assert.NoError(t, err)
+		return string(buf[:n])
+	}
+
+	ctx := WithLogFields(context.TODO(), log.Fields{LogFieldVolume: "pvc-1"})
+
+	// Commands are recorded with any CHAP secrets redacted
+	_, err = execCommand(ctx, "iscsiadm", "-m", "node", "--op=update", "--name", "node.session.auth.password",
+		"--value=secret")
+	assert.NoError(t, err)
+	entry := receive()
+	assert.Contains(t, entry, "MESSAGE=Host command succeeded.\n")
+	assert.Contains(t, entry, "PRIORITY=6\n")
+	assert.Contains(t, entry, "SYSLOG_IDENTIFIER=trident\n")
+	assert.Contains(t, entry, "TRIDENT_VOLUME=pvc-1\n")
+	assert.Contains(t, entry,
+		"TRIDENT_COMMAND=iscsiadm -m node --op=update --name node.session.auth.password --value=<redacted>\n")
+	assert.NotContains(t, entry, "secret")
+
+	journalHostOutcome(ctx, "Attach of iSCSI volume", errors.New("no devices"))
+	entry = receive()
+	assert.Contains(t, entry, "MESSAGE=Attach of iSCSI volume failed.\n")
+	assert.Contains(t, entry, "PRIORITY=3\n")
+	assert.Contains(t, entry, "TRIDENT_ERROR=no devices\n")
+
+	// Values spanning lines are length-prefixed
+	encoded := string(encodeJournalEntry(log.WarnLevel, "two\nlines", nil))
+	assert.True(t, strings.HasPrefix(encoded, "MESSAGE\n\x09\x00\x00\x00\x00\x00\x00\x00two\nlines\n"))
+
+	assert.Equal(t, "TRIDENT_TARGETIQN", journalFieldName("targetIQN"))
+	assert.Equal(t, "TRIDENT_FIELDS_TIME", journalFieldName("_fields.time"))
+	assert.Equal(t, []string{"-n", "discovery.sendtargets.auth.password_in", "-v", redactedValue},
+		redactCommandArgs([]string{"-n", "discovery.sendtargets.auth.password_in", "-v", "secret"}))
+	assert.Equal(t, []string{"-n", "node.session.timeo.replacement_timeout", "-v", "5"},
+		redactCommandArgs([]string{"-n", "node.session.timeo.replacement_timeout", "-v", "5"}))
+
+	// Without journald, host operations carry on
+	assert.NoError(t, journald.Close())
+	_, err = execCommand(ctx, "iscsiadm", "-m", "session")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// A Docker managed plugin runs in a mount namespace of its own, seeing the host's root filesystem at the host root.
+// Docker names mountpoints as the host sees them, and mounts made in the plugin's namespace are seen by the host
+// only if they happen to fall beneath a path whose mounts propagate.  So in Docker plugin mode, mountpoints are
+// taken to be host-relative: mount and umount run in the host's mount namespace, where those paths are meaningful,
+// while this process checks and creates mountpoints through the host root.
+
+var dockerPluginMode bool
+
+// LocalPath returns the path at which this process sees a path on the host.  It is the host path itself unless
+// running as a Docker managed plugin.
+func LocalPath(hostPath string) string {
+	if !dockerPluginMode || chrootPathPrefix == "" {
+		return hostPath
+	}
+	return filepath.Join(chrootPathPrefix, hostPath)
+}
+
+// hostInitMountNamespace is the mount namespace of the host's init process, as the host sees it.
+const hostInitMountNamespace = "/proc/1/ns/mnt"
+
+// hostMountNamespace returns the path to the host's mount namespace when running as a Docker managed plugin, or
+// an empty string if mounts are made in this process's own mount namespace.  A multithreaded process can't enter
+// another mount namespace itself, so commands enter it with nsenter, which the plugin image gets from the host
+// through chwrap.  Since chwrap runs nsenter chrooted into the host's root, the namespace is named by its path on
+// the host rather than through the host root.
+func hostMountNamespace() string {
+	if !dockerPluginMode {
+		return ""
+	}
+	return hostInitMountNamespace
+}
+
+// hostMountinfoPath returns the mountinfo file that lists the host's mounts with host-relative mountpoints.
+func hostMountinfoPath() string {
+	if !dockerPluginMode {
+		return procSelfMountinfoPath
+	}
+	return chrootPathPrefix + "/proc/1/mountinfo"
+}
+
+// execMountCommand runs a command that mounts or unmounts filesystems, such as mount or umount, in the host's
+// mount namespace, so that paths among its arguments are host-relative.  A zero timeout means no limit.
+func execMountCommand(
+	ctx context.Context, name string, timeoutSeconds time.Duration, args ...string,
+) ([]byte, error) {
+
+	command := Command{
+		Name:           name,
+		Args:           args,
+		MountNamespace: hostMountNamespace(),
+		Timeout:        timeoutSeconds * time.Second,
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"command":        name,
+		"args":           args,
+		"mountNamespace": command.MountNamespace,
+	}).Debug(">>>> hostmount.execMountCommand.")
+
+	out, err := executor.Execute(ctx, command)
+	journalCommand(ctx, name, args, err)
+
+	Logc(ctx).WithFields(log.Fields{
+		"command": name,
+		"output":  sanitizeCommandOutput(out),
+		"error":   err,
+	}).Debug("<<<< hostmount.execMountCommand.")
+
+	return out, err
+}
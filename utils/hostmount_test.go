@@ -0,0 +1,150 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// commandExecutor records the commands it's asked to run, including their namespaces.
+type commandExecutor struct {
+	commands []Command
+}
+
+func (e *commandExecutor) Execute(_ context.Context, cmd Command) ([]byte, error) {
+	e.commands = append(e.commands, cmd)
+	return nil, nil
+}
+
+func TestLocalPath(t *testing.T) {
+	log.Debug("Running TestLocalPath...")
+
+	defer func() { _ = Init(Config{}) }()
+
+	assert.NoError(t, Init(Config{HostRoot: "/rootfs"}))
+	assert.Equal(t, "/var/lib/docker-volumes/vol", LocalPath("/var/lib/docker-volumes/vol"))
+	assert.Empty(t, hostMountNamespace())
+	assert.Equal(t, procSelfMountinfoPath, hostMountinfoPath())
+
+	assert.NoError(t, Init(Config{DockerPluginMode: true}))
+	assert.Equal(t, "/host/var/lib/docker-volumes/vol", LocalPath("/var/lib/docker-volumes/vol"))
+	assert.Equal(t, "/proc/1/ns/mnt", hostMountNamespace())
+	assert.Equal(t, "/host/proc/1/mountinfo", hostMountinfoPath())
+}
+
+func TestMountDockerPluginMode(t *testing.T) {
+	log.Debug("Running TestMountDockerPluginMode...")
+
+	dir, err := ioutil.TempDir("", "TestMountDockerPluginMode")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mountinfo := path.Join(dir, "proc/1/mountinfo")
+	assert.NoError(t, os.MkdirAll(path.Dir(mountinfo), 0755))
+	assert.NoError(t, ioutil.WriteFile(mountinfo, nil, 0644))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/dev/block"), 0755))
+	assert.NoError(t, os.Symlink("../../devices/virtual/block/dm-0", path.Join(dir, "sys/dev/block/253:0")))
+
+	executor := &commandExecutor{}
+	assert.NoError(t, Init(Config{DockerPluginMode: true, HostRoot: dir, Executor: executor}))
+	defer func() { _ = Init(Config{}) }()
+
+	ctx := context.TODO()
+	mountpoint := "/var/lib/docker/plugins/1234/propagated-mount/netapp/vol1"
+	namespace := "/proc/1/ns/mnt"
+
+	// The mountpoint is created where this process sees it, and mounted in the host's namespace by its host path
+	assert.NoError(t, MountDevice(ctx, "/dev/dm-0", mountpoint, "", false))
+	assert.DirExists(t, path.Join(dir, mountpoint))
+	assert.Len(t, executor.commands, 1)
+	assert.Equal(t, "mount", executor.commands[0].Name)
+	assert.Equal(t, []string{"/dev/dm-0", mountpoint}, executor.commands[0].Args)
+	assert.Equal(t, namespace, executor.commands[0].MountNamespace)
+
+	// A mount listed among the host's mounts isn't made again
+	assert.NoError(t, ioutil.WriteFile(mountinfo, []byte("100 29 253:0 / "+mountpoint+
+		" rw,relatime shared:1 - ext4 /dev/dm-0 rw\n"), 0644))
+	executor.commands = nil
+	mounted, err := IsMounted(ctx, "", mountpoint)
+	assert.NoError(t, err)
+	assert.True(t, mounted)
+	assert.NoError(t, MountDevice(ctx, "/dev/dm-0", mountpoint, "", false))
+	assert.Empty(t, executor.commands)
+
+	assert.NoError(t, Umount(ctx, mountpoint))
+	assert.Len(t, executor.commands, 1)
+	assert.Equal(t, "umount", executor.commands[0].Name)
+	assert.Equal(t, []string{mountpoint}, executor.commands[0].Args)
+	assert.Equal(t, namespace, executor.commands[0].MountNamespace)
+
+	executor.commands = nil
+	assert.NoError(t, mountNFSPath(ctx, "10.0.0.1:/vol1", mountpoint, "vers=4.1"))
+	assert.Len(t, executor.commands, 2)
+	assert.Equal(t, []string{"-p", path.Join(dir, mountpoint)}, executor.commands[0].Args)
+	assert.Empty(t, executor.commands[0].MountNamespace)
+	assert.Equal(t, []string{"-t", "nfs", "-o", "vers=4.1", "10.0.0.1:/vol1", mountpoint}, executor.commands[1].Args)
+	assert.Equal(t, namespace, executor.commands[1].MountNamespace)
+
+	// Outside Docker plugin mode, mounts are made in this process's own namespace
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: executor}))
+	executor.commands = nil
+	assert.NoError(t, Umount(ctx, mountpoint))
+	assert.Len(t, executor.commands, 1)
+	assert.Empty(t, executor.commands[0].MountNamespace)
+}
+
+// chwrapBinaries returns the host commands chwrap/make-tarball.sh links to chwrap, which are the only ones the
+// node images can run.
+func chwrapBinaries(t *testing.T) map[string]bool {
+
+	script, err := ioutil.ReadFile("../chwrap/make-tarball.sh")
+	assert.NoError(t, err)
+
+	list := string(script)
+	list = list[strings.Index(list, "for BIN in")+len("for BIN in"):]
+	list = strings.ReplaceAll(list[:strings.Index(list, "; do")], "\\\n", " ")
+
+	binaries := make(map[string]bool)
+	for _, binary := range strings.Fields(list) {
+		binaries[binary] = true
+	}
+	return binaries
+}
+
+func TestMountDockerPluginModeCommands(t *testing.T) {
+	log.Debug("Running TestMountDockerPluginModeCommands...")
+
+	// Mounts in Docker plugin mode run through nsenter, which the plugin image only has through chwrap
+	command := Command{Name: "mount", MountNamespace: hostInitMountNamespace}
+	assert.NotNil(t, command.nsenterArgs())
+	assert.True(t, chwrapBinaries(t)["nsenter"])
+}
+
+func TestChwrapHostCommands(t *testing.T) {
+	log.Debug("Running TestChwrapHostCommands...")
+
+	// Host commands run by this package, which are found only if chwrap links them
+	binaries := chwrapBinaries(t)
+	for _, command := range []string{
+		"sg_persist", "mpathpersist",
+		"zpool", "zfs",
+		"tune2fs", "xfs_admin",
+		"cryptsetup",
+		"findmnt", "xfs_quota",
+		"fstrim",
+		"dumpe2fs",
+		"dmsetup",
+		"udevadm",
+		"nvme",
+	} {
+		assert.True(t, binaries[command], "%s is not shipped through chwrap", command)
+	}
+}
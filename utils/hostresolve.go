@@ -0,0 +1,268 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+	"github.com/netapp/trident/utils/iscsi"
+)
+
+// iSCSI portals and NFS servers may be named by hostname rather than address.  Left to iscsiadm and mount, such a
+// name is resolved anew by each command, with no bound on how long that takes or control over which address is
+// used, and iscsiadm reports the resulting sessions by address, which no longer matches the name.  So names are
+// resolved here before they're used, with a timeout and a preference between IPv4 and IPv6, and the addresses
+// are cached, both to spare the resolver and so that a name can still be matched to sessions by the addresses it
+// was resolved to.
+
+const defaultHostResolutionTimeout = 5 * time.Second
+
+// HostResolutionPolicy controls how hostnames naming iSCSI portals and NFS servers are resolved.
+type HostResolutionPolicy struct {
+	// Timeout bounds each lookup; zero selects 5 seconds
+	Timeout time.Duration
+	// Preference selects among a hostname's addresses by family
+	Preference AddressPreference
+	// CacheTTL is how long a hostname's addresses are used without looking it up again; zero looks it up every
+	// time.  Addresses past their TTL are still used if a lookup fails.
+	CacheTTL time.Duration
+}
+
+// AddressPreference determines which of a hostname's addresses is used.
+type AddressPreference string
+
+const (
+	// AddressPreferenceSystem uses the first address the resolver returns
+	AddressPreferenceSystem AddressPreference = "system"
+	// AddressPreferenceIPv4 uses an IPv4 address if there is one, and otherwise an IPv6 one
+	AddressPreferenceIPv4 AddressPreference = "ipv4"
+	// AddressPreferenceIPv6 uses an IPv6 address if there is one, and otherwise an IPv4 one
+	AddressPreferenceIPv6 AddressPreference = "ipv6"
+	// AddressPreferenceIPv4Only uses only IPv4 addresses
+	AddressPreferenceIPv4Only AddressPreference = "ipv4-only"
+	// AddressPreferenceIPv6Only uses only IPv6 addresses
+	AddressPreferenceIPv6Only AddressPreference = "ipv6-only"
+)
+
+func validateAddressPreference(preference AddressPreference) error {
+	switch preference {
+	case AddressPreferenceSystem, AddressPreferenceIPv4, AddressPreferenceIPv6, AddressPreferenceIPv4Only,
+		AddressPreferenceIPv6Only:
+		return nil
+	default:
+		return fmt.Errorf("invalid address preference: %s", preference)
+	}
+}
+
+// HostResolver looks up the addresses of hostnames, as *net.Resolver does.
+type HostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var (
+	hostResolutionPolicy = HostResolutionPolicy{
+		Timeout:    defaultHostResolutionTimeout,
+		Preference: AddressPreferenceSystem,
+	}
+	hostResolver    HostResolver = net.DefaultResolver
+	hostResolutions              = newHostResolutionCache()
+)
+
+// hostResolution is the addresses a hostname was last resolved to, in order of preference.
+type hostResolution struct {
+	addresses  []net.IPAddr
+	resolvedAt time.Time
+}
+
+// hostResolutionCache holds the addresses hostnames were last resolved to, by lowercase hostname.
+type hostResolutionCache struct {
+	mutex   sync.Mutex
+	entries map[string]hostResolution
+}
+
+func newHostResolutionCache() *hostResolutionCache {
+	return &hostResolutionCache{entries: make(map[string]hostResolution)}
+}
+
+func (c *hostResolutionCache) get(host string) (hostResolution, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	resolution, ok := c.entries[strings.ToLower(host)]
+	return resolution, ok
+}
+
+func (c *hostResolutionCache) put(host string, resolution hostResolution) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[strings.ToLower(host)] = resolution
+}
+
+// resolveHost returns the preferred address of a host, which is returned as is if it's already an address.
+func resolveHost(ctx context.Context, host string) (net.IPAddr, error) {
+
+	if ip := net.ParseIP(host); ip != nil {
+		return net.IPAddr{IP: ip}, nil
+	}
+
+	fields := log.Fields{"host": host, "preference": hostResolutionPolicy.Preference}
+
+	cached, isCached := hostResolutions.get(host)
+	if isCached && clock.Now().Sub(cached.resolvedAt) < hostResolutionPolicy.CacheTTL {
+		return cached.addresses[0], nil
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, hostResolutionPolicy.Timeout)
+	defer cancel()
+
+	var addresses []net.IPAddr
+	found, err := hostResolver.LookupIPAddr(lookupCtx, host)
+	if err == nil {
+		if addresses = orderAddresses(found, hostResolutionPolicy.Preference); len(addresses) == 0 {
+			err = fmt.Errorf("no addresses allowed by preference %s among %v", hostResolutionPolicy.Preference,
+				found)
+		}
+	}
+	if err != nil {
+		// The address a host last had is more likely to work than none at all while the resolver is unavailable
+		if isCached {
+			Logc(ctx).WithFields(fields).WithField("address", cached.addresses[0].String()).WithError(err).Warning(
+				"Could not resolve hostname, using the address it last resolved to.")
+			return cached.addresses[0], nil
+		}
+		Logc(ctx).WithFields(fields).WithError(err).Error("Could not resolve hostname.")
+		return net.IPAddr{}, fmt.Errorf("could not resolve %s; %v", host, err)
+	}
+
+	hostResolutions.put(host, hostResolution{addresses: addresses, resolvedAt: clock.Now()})
+
+	Logc(ctx).WithFields(fields).WithFields(log.Fields{
+		"address":   addresses[0].String(),
+		"addresses": addresses,
+	}).Debug("Resolved hostname.")
+
+	return addresses[0], nil
+}
+
+// orderAddresses returns the addresses a preference allows, in the order it prefers them, keeping the resolver's
+// order within each family.
+func orderAddresses(addresses []net.IPAddr, preference AddressPreference) []net.IPAddr {
+
+	var ipv4, ipv6 []net.IPAddr
+	for _, address := range addresses {
+		if address.IP.To4() != nil {
+			ipv4 = append(ipv4, address)
+		} else {
+			ipv6 = append(ipv6, address)
+		}
+	}
+
+	switch preference {
+	case AddressPreferenceIPv4:
+		return append(ipv4, ipv6...)
+	case AddressPreferenceIPv6:
+		return append(ipv6, ipv4...)
+	case AddressPreferenceIPv4Only:
+		return ipv4
+	case AddressPreferenceIPv6Only:
+		return ipv6
+	default:
+		return addresses
+	}
+}
+
+// cachedHostAddresses returns the addresses a hostname was last resolved to, if it has been.
+func cachedHostAddresses(host string) []net.IPAddr {
+	resolution, _ := hostResolutions.get(host)
+	return resolution.addresses
+}
+
+// resolvePortal returns an iSCSI portal with its hostname, if it has one, replaced by its preferred address.
+func resolvePortal(ctx context.Context, portal string) (string, error) {
+
+	p := iscsi.ParsePortal(portal)
+	if p.Host == "" || p.IP() != nil {
+		return portal, nil
+	}
+
+	address, err := resolveHost(ctx, p.Host)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve iSCSI portal %s; %v", portal, err)
+	}
+	p.Host, p.Zone = address.IP.String(), address.Zone
+	resolved := p.StringWithTag()
+
+	Logc(ctx).WithFields(log.Fields{"portal": portal, "address": resolved}).Info("Resolved iSCSI portal.")
+
+	return resolved, nil
+}
+
+// resolveISCSIPortals replaces the hostnames of a volume's iSCSI portals, on every target through which its LUN
+// is mapped, with their preferred addresses.
+func resolveISCSIPortals(ctx context.Context, publishInfo *VolumePublishInfo) error {
+
+	var err error
+	if publishInfo.IscsiTargetPortal, err = resolvePortal(ctx, publishInfo.IscsiTargetPortal); err != nil {
+		return err
+	}
+	for i, portal := range publishInfo.IscsiPortals {
+		if publishInfo.IscsiPortals[i], err = resolvePortal(ctx, portal); err != nil {
+			return err
+		}
+	}
+	for i := range publishInfo.IscsiAdditionalTargets {
+		portals := publishInfo.IscsiAdditionalTargets[i].Portals
+		for j, portal := range portals {
+			if portals[j], err = resolvePortal(ctx, portal); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolveNFSServer returns an NFS server, as it appears in an export path, with its hostname, if it has one,
+// replaced by its preferred address.  A server whose name the mount needs, to find its Kerberos principal or to
+// verify its TLS certificate, keeps its name.
+func resolveNFSServer(ctx context.Context, server, options string) (string, error) {
+
+	host := strings.Trim(server, "[]")
+	if host == "" || net.ParseIP(host) != nil || nfsNeedsServerName(options) {
+		return server, nil
+	}
+
+	address, err := resolveHost(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve NFS server %s; %v", server, err)
+	}
+
+	resolved := address.IP.String()
+	if address.IP.To4() == nil {
+		resolved = "[" + address.String() + "]"
+	}
+
+	Logc(ctx).WithFields(log.Fields{"server": server, "address": resolved}).Info("Resolved NFS server.")
+
+	return resolved, nil
+}
+
+// nfsNeedsServerName returns whether mount options secure an NFS mount in a way that needs the server's name.
+func nfsNeedsServerName(options string) bool {
+	for _, option := range strings.Split(options, ",") {
+		option = strings.TrimSpace(option)
+		if strings.HasPrefix(option, "sec=krb5") {
+			return true
+		}
+		if strings.HasPrefix(option, "xprtsec=") && option != "xprtsec=none" {
+			return true
+		}
+	}
+	return false
+}
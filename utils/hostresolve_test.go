@@ -0,0 +1,160 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeResolver answers lookups from a map of hostnames to addresses, and counts them.
+type fakeResolver struct {
+	hosts   map[string][]string
+	lookups int
+}
+
+func (r *fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups++
+	addresses, ok := r.hosts[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	result := make([]net.IPAddr, 0, len(addresses))
+	for _, address := range addresses {
+		result = append(result, net.IPAddr{IP: net.ParseIP(address)})
+	}
+	return result, nil
+}
+
+func TestResolveHostPreference(t *testing.T) {
+	log.Debug("Running TestResolveHostPreference...")
+
+	resolver := &fakeResolver{hosts: map[string][]string{
+		"dual": {"2001:db8::1", "10.0.0.1"},
+		"v4":   {"10.0.0.2"},
+	}}
+
+	tests := []struct {
+		preference AddressPreference
+		host       string
+		expected   string
+	}{
+		{AddressPreferenceSystem, "dual", "2001:db8::1"},
+		{AddressPreferenceIPv4, "dual", "10.0.0.1"},
+		{AddressPreferenceIPv6, "dual", "2001:db8::1"},
+		{AddressPreferenceIPv6, "v4", "10.0.0.2"},
+		{AddressPreferenceIPv4Only, "dual", "10.0.0.1"},
+		{AddressPreferenceIPv6Only, "v4", ""},
+	}
+	for _, test := range tests {
+		t.Run(string(test.preference)+"/"+test.host, func(t *testing.T) {
+			assert.NoError(t, Init(Config{
+				HostResolver:         resolver,
+				HostResolutionPolicy: HostResolutionPolicy{Preference: test.preference},
+			}))
+			defer func() { _ = Init(Config{}) }()
+
+			address, err := resolveHost(context.TODO(), test.host)
+			if test.expected == "" {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, address.IP.String())
+		})
+	}
+
+	assert.Error(t, Init(Config{HostResolutionPolicy: HostResolutionPolicy{Preference: "ipv5"}}))
+	assert.Error(t, Init(Config{HostResolutionPolicy: HostResolutionPolicy{Timeout: -time.Second}}))
+}
+
+func TestResolveHostCache(t *testing.T) {
+	log.Debug("Running TestResolveHostCache...")
+
+	fake := newFakeClock()
+	resolver := &fakeResolver{hosts: map[string][]string{"svm": {"10.0.0.1"}}}
+	assert.NoError(t, Init(Config{
+		Clock:                fake,
+		HostResolver:         resolver,
+		HostResolutionPolicy: HostResolutionPolicy{CacheTTL: time.Minute},
+	}))
+	defer func() { _ = Init(Config{}) }()
+
+	// Addresses aren't looked up, and hostnames are looked up once within the TTL, regardless of case
+	address, err := resolveHost(context.TODO(), "10.0.0.9")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.9", address.IP.String())
+	_, err = resolveHost(context.TODO(), "svm")
+	assert.NoError(t, err)
+	_, err = resolveHost(context.TODO(), "SVM")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, resolver.lookups)
+
+	// Past the TTL the hostname is looked up again
+	fake.Sleep(2 * time.Minute)
+	resolver.hosts["svm"] = []string{"10.0.0.2"}
+	address, err = resolveHost(context.TODO(), "svm")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", address.IP.String())
+	assert.Equal(t, 2, resolver.lookups)
+
+	// If the lookup fails, the address the hostname last had is used
+	fake.Sleep(2 * time.Minute)
+	delete(resolver.hosts, "svm")
+	address, err = resolveHost(context.TODO(), "svm")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", address.IP.String())
+
+	_, err = resolveHost(context.TODO(), "unknown")
+	assert.Error(t, err)
+}
+
+func TestResolvePortals(t *testing.T) {
+	log.Debug("Running TestResolvePortals...")
+
+	resolver := &fakeResolver{hosts: map[string][]string{
+		"svm-a": {"10.0.0.1"},
+		"svm-b": {"2001:db8::2"},
+	}}
+	assert.NoError(t, Init(Config{HostResolver: resolver}))
+	defer func() { _ = Init(Config{}) }()
+
+	publishInfo := &VolumePublishInfo{}
+	publishInfo.IscsiTargetPortal = "svm-a:3260"
+	publishInfo.IscsiPortals = []string{"10.0.0.5", "svm-b"}
+	publishInfo.IscsiAdditionalTargets = []IscsiTarget{{Portals: []string{"svm-b:3261"}}}
+
+	assert.NoError(t, resolveISCSIPortals(context.TODO(), publishInfo))
+	assert.Equal(t, "10.0.0.1:3260", publishInfo.IscsiTargetPortal)
+	assert.Equal(t, []string{"10.0.0.5", "[2001:db8::2]"}, publishInfo.IscsiPortals)
+	assert.Equal(t, []string{"[2001:db8::2]:3261"}, publishInfo.IscsiAdditionalTargets[0].Portals)
+
+	publishInfo.IscsiTargetPortal = "unknown"
+	assert.Error(t, resolveISCSIPortals(context.TODO(), publishInfo))
+
+	// Sessions, which iscsiadm reports by address, match the hostnames resolved to them
+	assert.True(t, portalMatches("10.0.0.1:3260,1028", "svm-a"))
+	assert.True(t, portalMatches("[2001:db8::2]:3260,1029", "SVM-B:3260"))
+	assert.False(t, portalMatches("10.0.0.3:3260,1028", "svm-a"))
+	assert.False(t, portalMatches("10.0.0.1:3260,1028", "svm-c"))
+
+	// NFS servers keep their names if the mount needs them
+	server, err := resolveNFSServer(context.TODO(), "svm-b", "vers=4.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::2]", server)
+	server, err = resolveNFSServer(context.TODO(), "svm-a", "vers=4.1,sec=krb5p")
+	assert.NoError(t, err)
+	assert.Equal(t, "svm-a", server)
+	server, err = resolveNFSServer(context.TODO(), "svm-a", "xprtsec=tls")
+	assert.NoError(t, err)
+	assert.Equal(t, "svm-a", server)
+	server, err = resolveNFSServer(context.TODO(), "svm-a", "xprtsec=none")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", server)
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// inFlightOperation is an operation being run on behalf of one or more callers.
+type inFlightOperation struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+type inFlightOperations struct {
+	mutex      sync.Mutex
+	operations map[string]*inFlightOperation
+}
+
+var inFlight = &inFlightOperations{operations: make(map[string]*inFlightOperation)}
+
+// CoalesceOperation runs an operation identified by key, unless an operation with the same key is already in
+// flight, in which case it waits for that one to finish and returns its result rather than running the operation
+// again.  This keeps a retried request, such as a NodeStage that kubelet reissues while the first attempt is
+// still formatting, from working on the same device concurrently.  The operation runs on a context with the
+// values of the first caller's, such as its log fields, but not its deadline or cancellation, so that it isn't
+// failed for callers still waiting by the first caller giving up.  Each caller, the first included, stops waiting
+// with its context's error if its context is done first; the operation itself runs on.
+func CoalesceOperation(
+	ctx context.Context, key string, operation func(context.Context) (interface{}, error),
+) (interface{}, error) {
+
+	inFlight.mutex.Lock()
+	op, ok := inFlight.operations[key]
+	if ok {
+		inFlight.mutex.Unlock()
+		Logc(ctx).WithField("operation", key).Info("Identical operation in flight, waiting for its result.")
+	} else {
+		op = &inFlightOperation{done: make(chan struct{})}
+		inFlight.operations[key] = op
+		inFlight.mutex.Unlock()
+
+		go func() {
+			result, err := operation(detachedContext{ctx})
+			inFlight.mutex.Lock()
+			delete(inFlight.operations, key)
+			inFlight.mutex.Unlock()
+			op.result, op.err = result, err
+			close(op.done)
+		}()
+	}
+
+	select {
+	case <-op.done:
+		return op.result, op.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// detachedContext has the values of a context, but never a deadline and is never done.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalesceOperation(t *testing.T) {
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var once sync.Once
+	runs := 0
+
+	operation := func(context.Context) (interface{}, error) {
+		runs++
+		once.Do(func() { close(started) })
+		<-release
+		return "staged", errors.New("partial")
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 2)
+	errs := make([]error, 2)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], errs[0] = CoalesceOperation(ctx(), "stage-vol1", operation)
+	}()
+	<-started
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[1], errs[1] = CoalesceOperation(ctx(), "stage-vol1", operation)
+	}()
+
+	// An operation with a different key runs on its own
+	result, err := CoalesceOperation(ctx(), "stage-vol2", func(context.Context) (interface{}, error) { return "other", nil })
+	assert.NoError(t, err)
+	assert.Equal(t, "other", result)
+
+	// Give the second caller time to join
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, 1, runs)
+	assert.Equal(t, []interface{}{"staged", "staged"}, results)
+	assert.EqualError(t, errs[0], "partial")
+	assert.EqualError(t, errs[1], "partial")
+
+	// Once finished, the operation runs again
+	result, err = CoalesceOperation(ctx(), "stage-vol1", func(context.Context) (interface{}, error) { return "again", nil })
+	assert.NoError(t, err)
+	assert.Equal(t, "again", result)
+}
+
+func TestCoalesceOperationContextDone(t *testing.T) {
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		_, _ = CoalesceOperation(ctx(), "expand-vol1", func(context.Context) (interface{}, error) {
+			close(started)
+			<-release
+			return nil, nil
+		})
+	}()
+	<-started
+
+	waitCtx, cancel := context.WithTimeout(ctx(), 10*time.Millisecond)
+	defer cancel()
+	_, err := CoalesceOperation(waitCtx, "expand-vol1", func(context.Context) (interface{}, error) {
+		t.Error("Expected the in-flight operation to be joined.")
+		return nil, nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	close(release)
+	<-done
+}
+
+func TestCoalesceOperationFirstCallerDone(t *testing.T) {
+
+	type key struct{}
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	// The first caller gives up while the operation is still running
+	firstCtx, cancel := context.WithCancel(context.WithValue(ctx(), key{}, "pvc-1"))
+	var operationCtx context.Context
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err := CoalesceOperation(firstCtx, "stage-vol1", func(ctx context.Context) (interface{}, error) {
+		operationCtx = ctx
+		close(started)
+		<-release
+		return "staged", nil
+	})
+	assert.Equal(t, context.Canceled, err)
+
+	// The operation's context has the first caller's values but isn't done with it
+	assert.Equal(t, "pvc-1", operationCtx.Value(key{}))
+	assert.NoError(t, operationCtx.Err())
+
+	// A caller that joins gets the operation's result
+	var result interface{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result, err = CoalesceOperation(ctx(), "stage-vol1", func(context.Context) (interface{}, error) {
+			t.Error("Expected the in-flight operation to be joined.")
+			return nil, nil
+		})
+	}()
+
+	// Give the caller time to join
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-done
+	assert.NoError(t, err)
+	assert.Equal(t, "staged", result)
+}
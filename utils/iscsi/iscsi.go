@@ -0,0 +1,88 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+// Package iscsi holds the host-independent parts of Trident's iSCSI support: parsing and comparing portals, and
+// parsing what iscsiadm reports.  It imports nothing from package utils, which attaches LUNs using it, so that
+// it can be used and tested on its own.
+package iscsi
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// NodeRecord contains information about a record in the iSCSI node database.
+type NodeRecord struct {
+	Portal     string
+	TPGT       string
+	TargetName string
+}
+
+var nodeRecordRegex = regexp.MustCompile(`^([^,]+),(\d+)\s+(.+)$`)
+
+// ParseNodeRecords parses the output of iscsiadm -m node into node records.
+func ParseNodeRecords(output string) ([]NodeRecord, error) {
+	records := make([]NodeRecord, 0)
+	for _, line := range strings.Split(output, "\n") {
+		if 0 == len(line) {
+			continue
+		}
+		matches := nodeRecordRegex.FindStringSubmatch(line)
+		if 4 != len(matches) {
+			return nil, fmt.Errorf("failed to parse node list: \"%s\"", line)
+		}
+		records = append(records, NodeRecord{
+			Portal:     matches[1],
+			TPGT:       matches[2],
+			TargetName: matches[3],
+		})
+	}
+	return records, nil
+}
+
+// ParseSessionStats extracts the numeric statistics from the output of iscsiadm -m session -s.
+func ParseSessionStats(stats string) map[string]uint64 {
+
+	values := make(map[string]uint64)
+	for _, line := range strings.Split(stats, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(strings.TrimSpace(fields[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		values[fields[0]] = value
+	}
+	return values
+}
+
+// minManualScanVersion is the first open-iscsi release whose node records accept node.session.scan
+var minManualScanVersion = []int{2, 0, 873}
+
+// VersionSupportsManualScan parses the output of 'iscsiadm -V', such as "iscsiadm version 2.0-874" or
+// "iscsiadm version 2.1.4", and returns true if that version supports manual scanning.  Versions that can't be
+// parsed are assumed to support it, being more likely new than old.
+func VersionSupportsManualScan(versionOutput string) bool {
+
+	fields := strings.Fields(versionOutput)
+	if len(fields) == 0 {
+		return true
+	}
+	parts := strings.FieldsFunc(fields[len(fields)-1], func(r rune) bool { return r == '.' || r == '-' })
+	for i, minimum := range minManualScanVersion {
+		if i >= len(parts) {
+			return false
+		}
+		part, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return true
+		}
+		if part != minimum {
+			return part > minimum
+		}
+	}
+	return true
+}
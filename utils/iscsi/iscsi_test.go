@@ -0,0 +1,74 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package iscsi
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNodeRecords(t *testing.T) {
+	log.Debug("Running TestParseNodeRecords...")
+
+	output := "" +
+		"203.0.113.1:3260,1024 iqn.1992-08.com.netapp:foo\n" +
+		"[fd20:8b1e:b258:2000:f816:3eff:feec:2]:3260,1038 iqn.1992-08.com.netapp:bar\n"
+
+	records, err := ParseNodeRecords(output)
+	assert.NoError(t, err)
+	assert.Equal(t, []NodeRecord{
+		{Portal: "203.0.113.1:3260", TPGT: "1024", TargetName: "iqn.1992-08.com.netapp:foo"},
+		{Portal: "[fd20:8b1e:b258:2000:f816:3eff:feec:2]:3260", TPGT: "1038", TargetName: "iqn.1992-08.com.netapp:bar"},
+	}, records)
+
+	records, err = ParseNodeRecords("")
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+
+	_, err = ParseNodeRecords("Foobar\n")
+	assert.Error(t, err)
+}
+
+func TestParseSessionStats(t *testing.T) {
+	log.Debug("Running TestParseSessionStats...")
+
+	stats := `Stats for session [sid: 3, target: iqn.1992-08.com.netapp:sn.1, portal: 10.0.0.1,3260]
+iSCSI SNMP:
+	txdata_octets: 6400
+	rxdata_octets: 117248
+	digest_err: 2
+	timeout_err: 17
+	format_err: 1
+iSCSI Extended:
+	tx_sendpage_failures: 0
+`
+	values := ParseSessionStats(stats)
+	assert.Equal(t, uint64(17), values["timeout_err"])
+	assert.Equal(t, uint64(2), values["digest_err"])
+	assert.Equal(t, uint64(1), values["format_err"])
+	assert.Equal(t, uint64(6400), values["txdata_octets"])
+	assert.Equal(t, uint64(117248), values["rxdata_octets"])
+	assert.Equal(t, uint64(0), values["tx_sendpage_failures"])
+
+	assert.Empty(t, ParseSessionStats(""))
+}
+
+func TestVersionSupportsManualScan(t *testing.T) {
+	log.Debug("Running TestVersionSupportsManualScan...")
+
+	versions := map[string]bool{
+		"iscsiadm version 2.0-870.3\n": false,
+		"iscsiadm version 2.0-873":     true,
+		"iscsiadm version 2.0-874":     true,
+		"iscsiadm version 2.1.4":       true,
+		"iscsiadm version 6.2.0.874-2": true,
+		"iscsiadm version 2.0":         false,
+		"iscsiadm version unknown":     true,
+		"":                             true,
+	}
+	for version, supported := range versions {
+		assert.Equal(t, supported, VersionSupportsManualScan(version), version)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package iscsi
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultPort is the port iSCSI targets listen on unless configured otherwise.
+const DefaultPort = "3260"
+
+// Portal is an iSCSI portal, as configured for a volume or reported by iscsiadm, such as "10.0.0.1",
+// "10.0.0.1:3260,1028", "[2001:db8::1]:3261", or "fe80::1%eth0".  Parsing a portal once, rather than slicing
+// its string wherever it's used, keeps IPv6 brackets, zones, ports, and target portal group tags from being
+// handled differently by discovery, session matching, and login.
+type Portal struct {
+	// Host is an IP address, without brackets or zone, or a hostname
+	Host string
+	// Zone is the IPv6 zone of a link-local address, if any
+	Zone string
+	// Port is empty if the portal didn't specify one
+	Port string
+	// Tag is the target portal group tag reported by iscsiadm, if any
+	Tag string
+}
+
+// ParsePortal parses an iSCSI portal.  An IPv6 address without brackets is taken to have no port, as its last
+// group can't be told apart from one.
+func ParsePortal(portal string) Portal {
+
+	var p Portal
+
+	portal = strings.TrimSpace(portal)
+	if i := strings.LastIndex(portal, ","); i >= 0 {
+		portal, p.Tag = portal[:i], portal[i+1:]
+	}
+
+	switch {
+	case strings.HasPrefix(portal, "["):
+		if host, port, err := net.SplitHostPort(portal); err == nil {
+			p.Host, p.Port = host, port
+		} else {
+			p.Host = strings.Trim(portal, "[]")
+		}
+	case strings.Count(portal, ":") >= 2:
+		p.Host = portal
+	default:
+		if host, port, err := net.SplitHostPort(portal); err == nil {
+			p.Host, p.Port = host, port
+		} else {
+			p.Host = portal
+		}
+	}
+
+	if i := strings.Index(p.Host, "%"); i >= 0 {
+		p.Host, p.Zone = p.Host[:i], p.Host[i+1:]
+	}
+
+	return p
+}
+
+// IP returns the portal's IP address, or nil if its host is a hostname.
+func (p Portal) IP() net.IP {
+	return net.ParseIP(p.Host)
+}
+
+// IsIPv6 returns true if the portal's host is an IPv6 address, which alone among hosts may contain colons.
+func (p Portal) IsIPv6() bool {
+	return strings.Contains(p.Host, ":")
+}
+
+// IsLinkLocal returns true if the portal's host is an IPv6 link-local address, which is reachable only through the
+// interface named by its zone.
+func (p Portal) IsLinkLocal() bool {
+	ip := p.IP()
+	return ip != nil && ip.To4() == nil && ip.IsLinkLocalUnicast()
+}
+
+// NeedsZone returns true if the portal is an IPv6 link-local address without the zone needed to reach it.
+func (p Portal) NeedsZone() bool {
+	return p.IsLinkLocal() && p.Zone == ""
+}
+
+// WithZoneOf returns the portal with the zone of another portal if it needs one.  Targets report their link-local
+// portals without a zone, which are reached through the same interface as the portal that reported them.
+func (p Portal) WithZoneOf(other Portal) Portal {
+	if p.NeedsZone() && other.IsLinkLocal() {
+		p.Zone = other.Zone
+	}
+	return p
+}
+
+// HostString returns the portal's host, with its zone, enclosed in square brackets if it's an IPv6 address.
+func (p Portal) HostString() string {
+	host := p.Host
+	if p.Zone != "" {
+		host += "%" + p.Zone
+	}
+	if p.IsIPv6() {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// String returns the portal as iscsiadm accepts it, without the target portal group tag.
+func (p Portal) String() string {
+	if p.Port == "" {
+		return p.HostString()
+	}
+	host := p.Host
+	if p.Zone != "" {
+		host += "%" + p.Zone
+	}
+	return net.JoinHostPort(host, p.Port)
+}
+
+// StringWithTag returns the portal as iscsiadm reports it, with the target portal group tag if it has one.
+func (p Portal) StringWithTag() string {
+	if p.Tag == "" {
+		return p.String()
+	}
+	return p.String() + "," + p.Tag
+}
+
+// WithDefaultPort returns the portal with the default iSCSI port if it doesn't specify one.
+func (p Portal) WithDefaultPort() Portal {
+	if p.Port == "" {
+		p.Port = DefaultPort
+	}
+	return p
+}
+
+// Equal returns true if both portals have the same host, zone, and port, comparing IP addresses structurally so
+// that equivalent IPv6 forms are equal.  A portal without a port is equal to one with the default port.  Target
+// portal group tags are ignored.
+func (p Portal) Equal(other Portal) bool {
+	return p.sameHost(other) && p.WithDefaultPort().Port == other.WithDefaultPort().Port
+}
+
+// Matches returns true if the portal, as reported by iscsiadm, matches a requested portal.  The hosts must be
+// equal, and the ports must be too unless the requested portal doesn't specify one.
+func (p Portal) Matches(requested Portal) bool {
+	if !p.sameHost(requested) {
+		return false
+	}
+	return requested.Port == "" || p.WithDefaultPort().Port == requested.Port
+}
+
+func (p Portal) sameHost(other Portal) bool {
+	if p.Zone != "" && other.Zone != "" && p.Zone != other.Zone {
+		return false
+	}
+	ip, otherIP := p.IP(), other.IP()
+	if ip != nil && otherIP != nil {
+		return ip.Equal(otherIP)
+	}
+	return strings.EqualFold(p.Host, other.Host)
+}
+
+// InSubnet returns true if the portal's IP address is within the subnet.  A portal whose host is a hostname is
+// in no subnet.
+func (p Portal) InSubnet(subnet *net.IPNet) bool {
+	ip := p.IP()
+	return ip != nil && subnet != nil && subnet.Contains(ip)
+}
+
+// FilterPortalsBySubnet returns the portals whose IP addresses are within any of the subnets, in their original
+// order.
+func FilterPortalsBySubnet(portals []string, subnets []*net.IPNet) []string {
+	filtered := make([]string, 0, len(portals))
+	for _, portal := range portals {
+		p := ParsePortal(portal)
+		for _, subnet := range subnets {
+			if p.InSubnet(subnet) {
+				filtered = append(filtered, portal)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// ValidatePortalZones checks that no portal is an IPv6 link-local address without a zone, such as "fe80::1" rather
+// than "fe80::1%eth0", since the host couldn't tell through which interface to reach it.
+func ValidatePortalZones(portals []string) error {
+	for _, portal := range portals {
+		if ParsePortal(portal).NeedsZone() {
+			return fmt.Errorf("iSCSI portal %s is an IPv6 link-local address without a zone naming the interface "+
+				"to reach it through, as in fe80::1%%eth0", portal)
+		}
+	}
+	return nil
+}
+
+// ZoneInterfaceUp returns true if the network interface named by an IPv6 zone, by name or index, exists and is up.
+func ZoneInterfaceUp(zone string) (bool, error) {
+	var iface *net.Interface
+	var err error
+	if index, convErr := strconv.Atoi(zone); convErr == nil {
+		iface, err = net.InterfaceByIndex(index)
+	} else {
+		iface, err = net.InterfaceByName(zone)
+	}
+	if err != nil {
+		return false, err
+	}
+	return iface.Flags&net.FlagUp != 0, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package iscsi
+
+import (
+	"net"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortal(t *testing.T) {
+	log.Debug("Running TestParsePortal...")
+
+	tests := []struct {
+		Input  string
+		Portal Portal
+		String string
+	}{
+		{"10.0.0.1", Portal{Host: "10.0.0.1"}, "10.0.0.1"},
+		{" 10.0.0.1:3261 ", Portal{Host: "10.0.0.1", Port: "3261"}, "10.0.0.1:3261"},
+		{"10.0.0.1:3260,1028", Portal{Host: "10.0.0.1", Port: "3260", Tag: "1028"}, "10.0.0.1:3260"},
+		{"2001:db8::1", Portal{Host: "2001:db8::1"}, "[2001:db8::1]"},
+		{"[2001:db8::1]", Portal{Host: "2001:db8::1"}, "[2001:db8::1]"},
+		{"[2001:db8::1]:3260,1038", Portal{Host: "2001:db8::1", Port: "3260", Tag: "1038"}, "[2001:db8::1]:3260"},
+		{"fe80::1%eth0", Portal{Host: "fe80::1", Zone: "eth0"}, "[fe80::1%eth0]"},
+		{"[fe80::1%eth0]:3260", Portal{Host: "fe80::1", Zone: "eth0", Port: "3260"}, "[fe80::1%eth0]:3260"},
+		{"iscsi.example.com:3262", Portal{Host: "iscsi.example.com", Port: "3262"}, "iscsi.example.com:3262"},
+	}
+	for _, testCase := range tests {
+		portal := ParsePortal(testCase.Input)
+		assert.Equal(t, testCase.Portal, portal, "Portal %s not correctly parsed", testCase.Input)
+		assert.Equal(t, testCase.String, portal.String(), "Portal %s not correctly formatted", testCase.Input)
+	}
+
+	assert.Nil(t, ParsePortal("iscsi.example.com").IP())
+	assert.True(t, ParsePortal("[2001:db8::1]:3260").IsIPv6())
+	assert.False(t, ParsePortal("10.0.0.1:3260").IsIPv6())
+	assert.Equal(t, "[fe80::1%eth0]", ParsePortal("[fe80::1%eth0]:3260,1").HostString())
+}
+
+func TestPortalEqual(t *testing.T) {
+	log.Debug("Running TestPortalEqual...")
+
+	tests := []struct {
+		A     string
+		B     string
+		Equal bool
+	}{
+		{"10.0.0.1", "10.0.0.1:3260", true},
+		{"10.0.0.1:3260,1028", "10.0.0.1:3260,1029", true},
+		{"10.0.0.1", "10.0.0.1:3261", false},
+		{"[2001:db8::1]:3260", "2001:db8:0::1", true},
+		{"fe80::1%eth0", "fe80::1%eth1", false},
+		{"fe80::1%eth0", "fe80::1", true},
+		{"ISCSI.example.com", "iscsi.example.com:3260", true},
+	}
+	for _, testCase := range tests {
+		assert.Equal(t, testCase.Equal, ParsePortal(testCase.A).Equal(ParsePortal(testCase.B)),
+			"Unexpected equality of %s and %s", testCase.A, testCase.B)
+	}
+}
+
+func TestFilterPortalsBySubnet(t *testing.T) {
+	log.Debug("Running TestFilterPortalsBySubnet...")
+
+	_, subnet4, _ := net.ParseCIDR("10.0.0.0/24")
+	_, subnet6, _ := net.ParseCIDR("2001:db8::/64")
+
+	portals := []string{"10.0.0.1:3260", "10.0.1.1", "[2001:db8::1]:3260,1", "2001:db8:1::1", "iscsi.example.com"}
+
+	assert.Equal(t, []string{"10.0.0.1:3260", "[2001:db8::1]:3260,1"},
+		FilterPortalsBySubnet(portals, []*net.IPNet{subnet4, subnet6}))
+	assert.Equal(t, []string{"10.0.0.1:3260"}, FilterPortalsBySubnet(portals, []*net.IPNet{subnet4}))
+	assert.Empty(t, FilterPortalsBySubnet(portals, nil))
+}
+
+func TestPortalZones(t *testing.T) {
+	log.Debug("Running TestPortalZones...")
+
+	assert.True(t, ParsePortal("[fe80::1%ens192]:3260").IsLinkLocal())
+	assert.False(t, ParsePortal("[fe80::1%ens192]:3260").NeedsZone())
+	assert.True(t, ParsePortal("[fe80::1]:3260").NeedsZone())
+	assert.False(t, ParsePortal("[fd00::1]:3260").NeedsZone())
+	assert.False(t, ParsePortal("169.254.0.1").NeedsZone())
+
+	zoned := ParsePortal("fe80::1%ens192")
+	assert.Equal(t, "[fe80::2%ens192]:3260,1",
+		ParsePortal("[fe80::2]:3260,1").WithZoneOf(zoned).StringWithTag())
+	assert.Equal(t, "[fe80::2%ens224]:3260", ParsePortal("[fe80::2%ens224]:3260").WithZoneOf(zoned).String())
+	assert.Equal(t, "[fd00::2]:3260", ParsePortal("[fd00::2]:3260").WithZoneOf(zoned).StringWithTag())
+
+	assert.NoError(t, ValidatePortalZones([]string{"10.0.0.1", "[fe80::1%ens192]:3260", "fd00::1"}))
+	assert.Error(t, ValidatePortalZones([]string{"10.0.0.1", "[fe80::1]:3260"}))
+}
@@ -0,0 +1,281 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// iscsidConfFile holds the iSCSI daemon's defaults for new node records
+const iscsidConfFile = "/etc/iscsi/iscsid.conf"
+
+const (
+	initiatorNameKey         = "InitiatorName"
+	initiatorAliasKey        = "InitiatorAlias"
+	iscsidNodeStartupKey     = "node.startup"
+	iscsidReplacementTimeout = "node.session.timeo.replacement_timeout"
+	iscsidAuthMethodKey      = "node.session.auth.authmethod"
+	iscsidUsernameKey        = "node.session.auth.username"
+	iscsidPasswordKey        = "node.session.auth.password"
+)
+
+// iscsiConfigSetting is a key and value of an open-iscsi configuration file.
+type iscsiConfigSetting struct {
+	key, value string
+}
+
+// parseISCSIConfig returns the settings of an open-iscsi configuration file, such as initiatorname.iscsi or
+// iscsid.conf, whose lines are "key = value" pairs, with whitespace around either optional, or comments starting
+// with '#'.  As with iscsid, a setting given more than once takes its last value.
+func parseISCSIConfig(content []byte) map[string]string {
+
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		if key, value, ok := parseISCSIConfigLine(scanner.Text()); ok {
+			settings[key] = value
+		}
+	}
+	return settings
+}
+
+// parseISCSIConfigLine returns the key and value of a line of an open-iscsi configuration file, or false if the
+// line is blank, a comment, or malformed.
+func parseISCSIConfigLine(line string) (string, string, bool) {
+
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	i := strings.Index(line, "=")
+	if i <= 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]), true
+}
+
+// updateISCSIConfig returns an open-iscsi configuration file with settings changed, leaving its comments and other
+// settings as they were.  Every line giving a setting is rewritten, and settings not yet given are appended, in
+// the form "key<separator>value".
+func updateISCSIConfig(content []byte, separator string, settings []iscsiConfigSetting) []byte {
+
+	written := make(map[string]bool, len(settings))
+	var buf bytes.Buffer
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if key, _, ok := parseISCSIConfigLine(line); ok {
+			for _, setting := range settings {
+				if setting.key == key {
+					line = setting.key + separator + setting.value
+					written[key] = true
+					break
+				}
+			}
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+
+	for _, setting := range settings {
+		if !written[setting.key] {
+			buf.WriteString(setting.key + separator + setting.value + "\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+// replaceISCSIConfigFile updates the settings of an open-iscsi configuration file on the host, replacing the file
+// atomically so that the daemon never finds it partly written.  A missing file is created.  It returns true if
+// the file changed.
+func replaceISCSIConfigFile(
+	ctx context.Context, filename, separator string, settings []iscsiConfigSetting,
+) (bool, error) {
+
+	filename = chrootPathPrefix + filename
+	perm := os.FileMode(0644)
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("could not read %s; %v", filename, err)
+	} else if err == nil {
+		if info, err := os.Stat(filename); err == nil {
+			perm = info.Mode().Perm()
+		}
+	}
+
+	updated := updateISCSIConfig(content, separator, settings)
+	if bytes.Equal(content, updated) {
+		return false, nil
+	}
+
+	tempFilename := filename + ".tmp"
+	if err = ioutil.WriteFile(tempFilename, updated, perm); err != nil {
+		return false, fmt.Errorf("could not write %s; %v", filename, err)
+	}
+	if err = os.Rename(tempFilename, filename); err != nil {
+		_ = os.Remove(tempFilename)
+		return false, fmt.Errorf("could not write %s; %v", filename, err)
+	}
+
+	keys := make([]string, 0, len(settings))
+	for _, setting := range settings {
+		keys = append(keys, setting.key)
+	}
+	Logc(ctx).WithFields(log.Fields{"file": filename, "keys": keys}).Debug("Updated iSCSI configuration file.")
+	return true, nil
+}
+
+// InitiatorNameConfig is the content of /etc/iscsi/initiatorname.iscsi.
+type InitiatorNameConfig struct {
+	Name  string
+	Alias string
+}
+
+// ParseInitiatorNameConfig parses the content of an initiatorname.iscsi file.
+func ParseInitiatorNameConfig(content []byte) InitiatorNameConfig {
+	settings := parseISCSIConfig(content)
+	return InitiatorNameConfig{Name: settings[initiatorNameKey], Alias: settings[initiatorAliasKey]}
+}
+
+// ReadInitiatorNameConfig reads the host's initiatorname.iscsi file.
+func ReadInitiatorNameConfig(ctx context.Context) (InitiatorNameConfig, error) {
+
+	Logc(ctx).Debug(">>>> iscsiconf.ReadInitiatorNameConfig")
+	defer Logc(ctx).Debug("<<<< iscsiconf.ReadInitiatorNameConfig")
+
+	content, err := ioutil.ReadFile(chrootPathPrefix + initiatorNameFile)
+	if err != nil {
+		return InitiatorNameConfig{}, err
+	}
+	return ParseInitiatorNameConfig(content), nil
+}
+
+// WriteInitiatorNameConfig sets the initiator name, and the alias if not empty, in the host's initiatorname.iscsi
+// file, keeping any comments.  The iSCSI daemon must be restarted for the change to take effect.  It returns true
+// if the file changed.
+func WriteInitiatorNameConfig(ctx context.Context, config InitiatorNameConfig) (bool, error) {
+
+	Logc(ctx).WithField("name", config.Name).Debug(">>>> iscsiconf.WriteInitiatorNameConfig")
+	defer Logc(ctx).Debug("<<<< iscsiconf.WriteInitiatorNameConfig")
+
+	if config.Name == "" || strings.ContainsAny(config.Name, " \t\n") {
+		return false, fmt.Errorf("invalid iSCSI initiator name: %q", config.Name)
+	}
+	if strings.Contains(config.Alias, "\n") {
+		return false, fmt.Errorf("invalid iSCSI initiator alias: %q", config.Alias)
+	}
+
+	settings := []iscsiConfigSetting{{initiatorNameKey, config.Name}}
+	if config.Alias != "" {
+		settings = append(settings, iscsiConfigSetting{initiatorAliasKey, config.Alias})
+	}
+	return replaceISCSIConfigFile(ctx, initiatorNameFile, "=", settings)
+}
+
+// ISCSIDConfig holds the settings of /etc/iscsi/iscsid.conf that matter to this package.  They're the defaults
+// given to node records when targets are discovered.  Empty or zero values are absent or left unchanged.
+type ISCSIDConfig struct {
+	// NodeStartup is "automatic" to log in to targets when iscsid starts, or "manual"
+	NodeStartup string
+	// ReplacementTimeout is how many seconds I/O is queued for a failed session before being failed upward
+	ReplacementTimeout int
+	// AuthMethod is "CHAP" to authenticate sessions with the username and password, or "None"
+	AuthMethod string
+	Username   string
+	Password   string
+}
+
+// String describes the settings without the CHAP password.
+func (c ISCSIDConfig) String() string {
+	password := ""
+	if c.Password != "" {
+		password = redactedValue
+	}
+	return fmt.Sprintf("{NodeStartup:%s ReplacementTimeout:%d AuthMethod:%s Username:%s Password:%s}",
+		c.NodeStartup, c.ReplacementTimeout, c.AuthMethod, c.Username, password)
+}
+
+// GoString keeps %#v from printing the CHAP password.
+func (c ISCSIDConfig) GoString() string {
+	return c.String()
+}
+
+// ParseISCSIDConfig parses the content of an iscsid.conf file.
+func ParseISCSIDConfig(content []byte) (ISCSIDConfig, error) {
+
+	settings := parseISCSIConfig(content)
+	config := ISCSIDConfig{
+		NodeStartup: settings[iscsidNodeStartupKey],
+		AuthMethod:  settings[iscsidAuthMethodKey],
+		Username:    settings[iscsidUsernameKey],
+		Password:    settings[iscsidPasswordKey],
+	}
+	if value, ok := settings[iscsidReplacementTimeout]; ok {
+		timeout, err := strconv.Atoi(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid %s: %q", iscsidReplacementTimeout, value)
+		}
+		config.ReplacementTimeout = timeout
+	}
+	return config, nil
+}
+
+// ReadISCSIDConfig reads the host's iscsid.conf file.
+func ReadISCSIDConfig(ctx context.Context) (ISCSIDConfig, error) {
+
+	Logc(ctx).Debug(">>>> iscsiconf.ReadISCSIDConfig")
+	defer Logc(ctx).Debug("<<<< iscsiconf.ReadISCSIDConfig")
+
+	content, err := ioutil.ReadFile(chrootPathPrefix + iscsidConfFile)
+	if err != nil {
+		return ISCSIDConfig{}, err
+	}
+	return ParseISCSIDConfig(content)
+}
+
+// UpdateISCSIDConfig sets the non-empty settings of a config in the host's iscsid.conf file, keeping its other
+// settings and comments.  They apply to node records created afterward, and the iSCSI daemon must be restarted
+// for them to take effect.  It returns true if the file changed.
+func UpdateISCSIDConfig(ctx context.Context, config ISCSIDConfig) (bool, error) {
+
+	Logc(ctx).WithField("config", config).Debug(">>>> iscsiconf.UpdateISCSIDConfig")
+	defer Logc(ctx).Debug("<<<< iscsiconf.UpdateISCSIDConfig")
+
+	settings := make([]iscsiConfigSetting, 0)
+	for _, setting := range []iscsiConfigSetting{
+		{iscsidNodeStartupKey, config.NodeStartup},
+		{iscsidAuthMethodKey, config.AuthMethod},
+		{iscsidUsernameKey, config.Username},
+		{iscsidPasswordKey, config.Password},
+	} {
+		if strings.Contains(setting.value, "\n") {
+			return false, fmt.Errorf("invalid %s", setting.key)
+		} else if setting.value != "" {
+			settings = append(settings, setting)
+		}
+	}
+	if config.ReplacementTimeout < 0 {
+		return false, fmt.Errorf("invalid %s: %d", iscsidReplacementTimeout, config.ReplacementTimeout)
+	} else if config.ReplacementTimeout > 0 {
+		settings = append(settings,
+			iscsiConfigSetting{iscsidReplacementTimeout, strconv.Itoa(config.ReplacementTimeout)})
+	}
+	if len(settings) == 0 {
+		return false, nil
+	}
+
+	return replaceISCSIConfigFile(ctx, iscsidConfFile, " = ", settings)
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInitiatorNameConfig(t *testing.T) {
+	log.Debug("Running TestParseInitiatorNameConfig...")
+
+	tests := []struct {
+		Content  string
+		Expected InitiatorNameConfig
+	}{
+		{"InitiatorName=iqn.1994-05.com.redhat:abc\n", InitiatorNameConfig{Name: "iqn.1994-05.com.redhat:abc"}},
+		{"## DO NOT EDIT OR REMOVE THIS FILE!\n## InitiatorName=iqn.old\n\n  InitiatorName = iqn.new  \n" +
+			"InitiatorAlias=node1\n", InitiatorNameConfig{Name: "iqn.new", Alias: "node1"}},
+		{"InitiatorName=iqn.first\nInitiatorName=iqn.second", InitiatorNameConfig{Name: "iqn.second"}},
+		{"# InitiatorName=iqn.commented\ngarbage\n", InitiatorNameConfig{}},
+		{"", InitiatorNameConfig{}},
+	}
+	for _, testCase := range tests {
+		assert.Equal(t, testCase.Expected, ParseInitiatorNameConfig([]byte(testCase.Content)), testCase.Content)
+	}
+}
+
+func TestWriteInitiatorNameConfig(t *testing.T) {
+	log.Debug("Running TestWriteInitiatorNameConfig...")
+
+	dir, err := ioutil.TempDir("", "TestWriteInitiatorNameConfig")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "etc/iscsi"), 0755))
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	ctx := context.TODO()
+	filename := path.Join(dir, "etc/iscsi/initiatorname.iscsi")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("## Generated at install\nInitiatorName=iqn.old\n"), 0600))
+
+	changed, err := WriteInitiatorNameConfig(ctx, InitiatorNameConfig{Name: "iqn.new", Alias: "node1"})
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	content, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "## Generated at install\nInitiatorName=iqn.new\nInitiatorAlias=node1\n", string(content))
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	config, err := ReadInitiatorNameConfig(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, InitiatorNameConfig{Name: "iqn.new", Alias: "node1"}, config)
+	iqns, err := GetInitiatorIqns(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"iqn.new"}, iqns)
+
+	// Writing the same name again changes nothing
+	changed, err = WriteInitiatorNameConfig(ctx, InitiatorNameConfig{Name: "iqn.new"})
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	_, err = WriteInitiatorNameConfig(ctx, InitiatorNameConfig{})
+	assert.Error(t, err)
+	_, err = WriteInitiatorNameConfig(ctx, InitiatorNameConfig{Name: "iqn.a b"})
+	assert.Error(t, err)
+}
+
+func TestISCSIDConfig(t *testing.T) {
+	log.Debug("Running TestISCSIDConfig...")
+
+	dir, err := ioutil.TempDir("", "TestISCSIDConfig")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "etc/iscsi"), 0755))
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	ctx := context.TODO()
+	filename := path.Join(dir, "etc/iscsi/iscsid.conf")
+	original := `# To request that the iscsi initd scripts startup a session set to "automatic".
+# node.startup = automatic
+#
+# To manually startup the session set to "manual". The default is manual.
+node.startup = manual
+
+node.session.timeo.replacement_timeout = 120
+node.session.auth.authmethod = CHAP
+node.session.auth.username = user
+node.session.auth.password = secret
+node.session.queue_depth = 32
+`
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(original), 0600))
+
+	config, err := ReadISCSIDConfig(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, ISCSIDConfig{
+		NodeStartup:        "manual",
+		ReplacementTimeout: 120,
+		AuthMethod:         "CHAP",
+		Username:           "user",
+		Password:           "secret",
+	}, config)
+	assert.NotContains(t, config.String(), "secret")
+	assert.NotContains(t, fmt.Sprintf("%+v %#v", config, config), "secret")
+
+	// Only the given settings change, in place, and comments and other settings are kept
+	changed, err := UpdateISCSIDConfig(ctx, ISCSIDConfig{NodeStartup: "automatic", ReplacementTimeout: 5})
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	content, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, `# To request that the iscsi initd scripts startup a session set to "automatic".
+# node.startup = automatic
+#
+# To manually startup the session set to "manual". The default is manual.
+node.startup = automatic
+
+node.session.timeo.replacement_timeout = 5
+node.session.auth.authmethod = CHAP
+node.session.auth.username = user
+node.session.auth.password = secret
+node.session.queue_depth = 32
+`, string(content))
+
+	changed, err = UpdateISCSIDConfig(ctx, ISCSIDConfig{NodeStartup: "automatic"})
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	_, err = UpdateISCSIDConfig(ctx, ISCSIDConfig{ReplacementTimeout: -1})
+	assert.Error(t, err)
+
+	_, err = ParseISCSIDConfig([]byte("node.session.timeo.replacement_timeout = soon\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+const detachJournalSuffix = ".json"
+
+// DetachJournal is a write-ahead journal of volume detaches.  A detach is recorded before its first stage runs,
+// and each stage is recorded once it completes, so a detach interrupted by a crash can later be told apart from
+// one that never started, and resumed without repeating stages that can't be repeated, such as removing devices
+// that are already gone.  Each detach is kept in its own file, which is replaced atomically on every update.
+type DetachJournal struct {
+	dir string
+}
+
+// DetachJournalEntry records a detach in progress.
+type DetachJournalEntry struct {
+	VolumeID          string             `json:"volumeID"`
+	StagingTargetPath string             `json:"stagingTargetPath"`
+	PublishInfo       *VolumePublishInfo `json:"publishInfo"`
+	Started           time.Time          `json:"started"`
+	// Completed lists the stages that have completed, in order
+	Completed []string `json:"completed"`
+}
+
+// IsComplete returns true if the specified stage of the detach has completed.
+func (e *DetachJournalEntry) IsComplete(stage string) bool {
+	return StringInSlice(stage, e.Completed)
+}
+
+// NewDetachJournal returns a journal kept in the specified directory, which is created when first needed.
+func NewDetachJournal(dir string) *DetachJournal {
+	return &DetachJournal{dir: dir}
+}
+
+func (j *DetachJournal) filename(volumeID string) string {
+	return path.Join(j.dir, url.PathEscape(volumeID)+detachJournalSuffix)
+}
+
+// Begin records the start of a volume's detach.  If the journal already holds an unfinished detach of the
+// volume, that entry is returned instead, so the detach resumes after its completed stages.
+func (j *DetachJournal) Begin(
+	ctx context.Context, volumeID, stagingTargetPath string, publishInfo *VolumePublishInfo,
+) (*DetachJournalEntry, error) {
+
+	entry, err := j.read(j.filename(volumeID))
+	if err == nil {
+		Logc(ctx).WithFields(log.Fields{
+			"volumeID":  volumeID,
+			"started":   entry.Started,
+			"completed": entry.Completed,
+		}).Info("Resuming interrupted detach.")
+		return entry, nil
+	} else if !os.IsNotExist(err) {
+		Logc(ctx).WithField("volumeID", volumeID).WithError(err).Warning("Discarding unreadable detach journal entry.")
+	}
+
+	entry = &DetachJournalEntry{
+		VolumeID:          volumeID,
+		StagingTargetPath: stagingTargetPath,
+		PublishInfo:       publishInfo,
+		Started:           time.Now(),
+		Completed:         make([]string, 0),
+	}
+	if err = j.write(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Complete records that a stage of a detach has completed.
+func (j *DetachJournal) Complete(ctx context.Context, entry *DetachJournalEntry, stage string) error {
+
+	Logc(ctx).WithFields(log.Fields{"volumeID": entry.VolumeID, "stage": stage}).Debug("Detach stage completed.")
+
+	if entry.IsComplete(stage) {
+		return nil
+	}
+	entry.Completed = append(entry.Completed, stage)
+	return j.write(entry)
+}
+
+// Finish removes a completed detach from the journal.
+func (j *DetachJournal) Finish(ctx context.Context, entry *DetachJournalEntry) error {
+	return j.Discard(ctx, entry.VolumeID)
+}
+
+// Discard removes any detach of a volume from the journal, finished or not, as when the volume is staged again.
+func (j *DetachJournal) Discard(ctx context.Context, volumeID string) error {
+
+	if err := os.Remove(j.filename(volumeID)); err != nil && !os.IsNotExist(err) {
+		Logc(ctx).WithField("volumeID", volumeID).WithError(err).Error("Could not remove detach journal entry.")
+		return fmt.Errorf("could not remove detach journal entry for volume %s; %v", volumeID, err)
+	}
+	return nil
+}
+
+// Pending returns the detaches in the journal that haven't finished.
+func (j *DetachJournal) Pending(ctx context.Context) ([]*DetachJournalEntry, error) {
+
+	entries := make([]*DetachJournalEntry, 0)
+
+	files, err := ioutil.ReadDir(j.dir)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read detach journal; %v", err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), detachJournalSuffix) {
+			continue
+		}
+		entry, err := j.read(path.Join(j.dir, file.Name()))
+		if err != nil {
+			Logc(ctx).WithField("file", file.Name()).WithError(err).Warning("Skipping unreadable detach journal entry.")
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (j *DetachJournal) read(filename string) (*DetachJournalEntry, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	entry := &DetachJournalEntry{}
+	if err = json.Unmarshal(content, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// write replaces an entry's file atomically, syncing both the file and the directory, so that after a crash
+// the file holds either the previous or the new entry in full.
+func (j *DetachJournal) write(entry *DetachJournalEntry) error {
+
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(j.dir, 0700); err != nil {
+		return fmt.Errorf("could not create detach journal directory; %v", err)
+	}
+
+	filename := j.filename(entry.VolumeID)
+	tempFile, err := ioutil.TempFile(j.dir, ".tmp-")
+	if err != nil {
+		return fmt.Errorf("could not write detach journal entry; %v", err)
+	}
+	defer os.Remove(tempFile.Name()) //nolint
+
+	if _, err = tempFile.Write(content); err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), filename)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write detach journal entry; %v", err)
+	}
+
+	if dir, err := os.Open(j.dir); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
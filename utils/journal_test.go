@@ -0,0 +1,72 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetachJournal(t *testing.T) {
+	log.Debug("Running TestDetachJournal...")
+
+	dir, err := ioutil.TempDir("", "TestDetachJournal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	journal := NewDetachJournal(path.Join(dir, "detach"))
+	ctx := context.TODO()
+
+	// An empty journal, whose directory doesn't exist yet, has nothing pending
+	pending, err := journal.Pending(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	publishInfo := &VolumePublishInfo{DevicePath: "/dev/dm-0"}
+	entry, err := journal.Begin(ctx, "pvc-1", "/staging/pvc-1", publishInfo)
+	assert.NoError(t, err)
+	assert.NoError(t, journal.Complete(ctx, entry, "release"))
+	assert.NoError(t, journal.Complete(ctx, entry, "removeDevice"))
+	assert.NoError(t, journal.Complete(ctx, entry, "removeDevice"))
+
+	// A crash here leaves the detach in the journal, with its completed stages
+	pending, err = journal.Pending(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, "pvc-1", pending[0].VolumeID)
+	assert.Equal(t, "/staging/pvc-1", pending[0].StagingTargetPath)
+	assert.Equal(t, "/dev/dm-0", pending[0].PublishInfo.DevicePath)
+	assert.Equal(t, []string{"release", "removeDevice"}, pending[0].Completed)
+
+	// Beginning the detach again resumes it
+	resumed, err := journal.Begin(ctx, "pvc-1", "/staging/pvc-1", publishInfo)
+	assert.NoError(t, err)
+	assert.True(t, resumed.IsComplete("removeDevice"))
+	assert.False(t, resumed.IsComplete("logout"))
+
+	assert.NoError(t, journal.Finish(ctx, resumed))
+	pending, err = journal.Pending(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	// Volume IDs can't escape the journal directory, and discarding a missing entry is fine
+	_, err = journal.Begin(ctx, "../pvc/2", "/staging/pvc-2", publishInfo)
+	assert.NoError(t, err)
+	files, err := ioutil.ReadDir(path.Join(dir, "detach"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.NoError(t, journal.Discard(ctx, "../pvc/2"))
+	assert.NoError(t, journal.Discard(ctx, "../pvc/2"))
+
+	// Unreadable entries are skipped
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "detach", "bad.json"), []byte("{"), 0600))
+	pending, err = journal.Pending(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
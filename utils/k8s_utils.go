@@ -17,6 +17,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	. "github.com/netapp/trident/logger"
+	"github.com/netapp/trident/utils/mount"
 )
 
 const (
@@ -24,8 +25,6 @@ const (
 	maxListTries = 3
 	// Number of fields per line in /proc/mounts as per the fstab man page.
 	expectedNumProcMntFieldsPerLine = 6
-	// Number of fields per line in /proc/self/mountinfo as per the fstab man page.
-	expectedNumProcSelfMntInfoFieldsPerLine = 11
 	// Location of the mount file to use
 	procMountsPath = "/proc/mounts"
 	// Location of the mount file to use
@@ -42,18 +41,43 @@ type MountPoint struct {
 	Pass   int
 }
 
-// This represents a single line in /proc/self/mountinfo.
-type MountInfo struct {
-	MountId      int
-	ParentId     int
-	DeviceId     string
-	Root         string
-	MountPoint   string
-	MountOptions []string
-	//OptionalFields []string
-	FsType       string
-	MountSource  string
-	SuperOptions []string
+// MountInfo represents a single line in /proc/self/mountinfo.
+//
+// Deprecated: use mount.Info.
+type MountInfo = mount.Info
+
+// MountsUnderPath returns the mounts whose mount points are at or beneath the specified path.
+//
+// Deprecated: use mount.UnderPath.
+func MountsUnderPath(mounts []MountInfo, path string) []MountInfo {
+	return mount.UnderPath(mounts, path)
+}
+
+// MountsOfDevice returns the mounts of the specified device, matched by its major:minor number where the device
+// node can be read, and otherwise by resolving symlinks such as /dev/mapper or /dev/disk/by-id paths on both sides.
+func MountsOfDevice(mounts []MountInfo, device string) []MountInfo {
+	deviceID, _ := getDeviceNodeID(device)
+	if resolvedDevice, err := filepath.EvalSymlinks(device); err == nil {
+		device = resolvedDevice
+	}
+	result := make([]MountInfo, 0)
+	for _, mount := range mounts {
+		if deviceID != "" && mount.DeviceId == deviceID {
+			result = append(result, mount)
+			continue
+		}
+		if !strings.HasPrefix(mount.MountSource, "/dev/") {
+			continue
+		}
+		source := mount.MountSource
+		if resolvedSource, err := filepath.EvalSymlinks(source); err == nil {
+			source = resolvedSource
+		}
+		if source == device {
+			result = append(result, mount)
+		}
+	}
+	return result
 }
 
 // IsLikelyDir determines if mountpoint is a directory
@@ -84,47 +108,125 @@ func IsLikelyNotMountPoint(mountpoint string) (bool, error) {
 	return true, nil
 }
 
-func GetDeviceNameFromMount(ctx context.Context, mountpath string) (string, int, error) {
+// MountedDevice describes the device behind a mount.
+type MountedDevice struct {
+	// Name is the device's kernel name, such as sdb, dm-0, or sdb1
+	Name string
+	// DeviceId is the device's major:minor number
+	DeviceId string
+	// Root is the directory of the device's filesystem that is mounted, which is "/" unless the mount binds a
+	// subdirectory, as for a subpath publish
+	Root string
+	// Raw is true if the device node itself is bind mounted from devtmpfs, as for a raw block volume
+	Raw bool
+	// RefCount is the number of mounts of the device, of its whole filesystem or of any subdirectory
+	RefCount int
+}
+
+// GetMountedDevice finds the device mounted at a path, from the path's mount in /proc/self/mountinfo.  The device
+// is identified by its major:minor number rather than by the mount source, which is the same for a bind mount of
+// a subdirectory as for the filesystem it came from, and may name a device node that has since been renamed.
+func GetMountedDevice(ctx context.Context, mountpath string) (*MountedDevice, error) {
 
 	fields := log.Fields{"mountpath": mountpath}
-	Logc(ctx).WithFields(fields).Debug(">>>> k8s_utils.GetDeviceNameFromMount")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< k8s_utils.GetDeviceNameFromMount")
+	Logc(ctx).WithFields(fields).Debug(">>>> k8s_utils.GetMountedDevice")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< k8s_utils.GetMountedDevice")
 
-	mps, err := listProcMounts(procMountsPath)
+	mounts, err := listProcSelfMountinfo(procSelfMountinfoPath)
 	if err != nil {
-		return "", 0, err
+		return nil, err
+	}
+
+	device, err := getMountedDevice(ctx, mounts, mountpath)
+	if err != nil {
+		return nil, err
 	}
 
-	// Find the device name.
-	// FIXME if multiple devices mounted on the same mount path, only the first one is returned
-	device := ""
+	Logc(ctx).WithFields(log.Fields{
+		"mountpath": mountpath,
+		"device":    device.Name,
+		"deviceId":  device.DeviceId,
+		"root":      device.Root,
+		"refCount":  device.RefCount,
+	}).Debug("Found device from mountpath.")
+
+	return device, nil
+}
+
+// getMountedDevice finds the device mounted at a path among the given mounts.
+func getMountedDevice(ctx context.Context, mounts []MountInfo, mountpath string) (*MountedDevice, error) {
+
 	// If mountPath is symlink, need get its target path.
-	slTarget, err := filepath.EvalSymlinks(mountpath)
+	target, err := filepath.EvalSymlinks(mountpath)
 	if err != nil {
-		slTarget = mountpath
+		target = filepath.Clean(mountpath)
 	}
-	for i := range mps {
-		if mps[i].Path == slTarget {
-			device = mps[i].Device
-			break
+
+	// Of several mounts at the same path, the last one mounted hides the others
+	var mount *MountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint == target {
+			mount = &mounts[i]
 		}
 	}
+	if mount == nil {
+		return nil, fmt.Errorf("nothing is mounted at %s", mountpath)
+	}
 
-	// Find all references to the device.
-	refCount := 0
-	for i := range mps {
-		if mps[i].Device == device {
-			refCount++
+	device := &MountedDevice{DeviceId: mount.DeviceId, Root: mount.Root}
+
+	if mount.FsType == "devtmpfs" {
+		// The mount's root is the device node, and every bind mount of it shares devtmpfs's device number
+		device.Raw = true
+		device.Name = strings.TrimPrefix(mount.Root, "/")
+		for _, m := range mounts {
+			if m.FsType == "devtmpfs" && m.Root == mount.Root {
+				device.RefCount++
+			}
 		}
+		return device, nil
 	}
 
-	Logc(ctx).WithFields(log.Fields{
-		"mountpath": mountpath,
-		"device":    device,
-		"refCount":  refCount,
-	}).Debug("Found device from mountpath.")
+	device.Name = getBlockDeviceName(ctx, *mount)
+	if device.Name == "" {
+		return nil, fmt.Errorf("%s is not a device mount", mountpath)
+	}
+	for _, m := range mounts {
+		if m.DeviceId == mount.DeviceId {
+			device.RefCount++
+		}
+	}
+	return device, nil
+}
+
+// getBlockDeviceName returns the kernel name of the block device behind a mount, as sysfs knows it by its
+// major:minor number, or failing that by resolving the mount source.  An empty string is returned if the mount
+// isn't backed by a block device.
+func getBlockDeviceName(ctx context.Context, mount MountInfo) string {
 
-	return device, refCount, nil
+	if name, err := getBlockDeviceNameByID(mount.DeviceId); err == nil {
+		return name
+	} else if !os.IsNotExist(err) {
+		Logc(ctx).WithField("deviceId", mount.DeviceId).WithError(err).Debug("Could not look up block device.")
+	}
+
+	if strings.HasPrefix(mount.MountSource, "/dev/") {
+		if device, err := filepath.EvalSymlinks(mount.MountSource); err == nil {
+			return strings.TrimPrefix(device, "/dev/")
+		}
+	}
+	return ""
+}
+
+// GetDeviceNameFromMount returns the path of the device mounted at a path, and the number of mounts of the
+// device, as found by GetMountedDevice.
+func GetDeviceNameFromMount(ctx context.Context, mountpath string) (string, int, error) {
+
+	device, err := GetMountedDevice(ctx, mountpath)
+	if err != nil {
+		return "", 0, err
+	}
+	return "/dev/" + device.Name, device.RefCount, nil
 }
 
 // listProcSelfMountinfo (Available since Linux 2.6.26) lists information about mount points
@@ -138,56 +240,31 @@ func listProcSelfMountinfo(mountFilePath string) ([]MountInfo, error) {
 	return parseProcSelfMountinfo(content)
 }
 
-// parseProcSelfMountinfo parses the output of /proc/self/mountinfo file into a slice of MountInfo struct
+// parseProcSelfMountinfo parses the output of /proc/self/mountinfo file into a slice of MountInfo struct,
+// skipping mounts whose root has been deleted
 func parseProcSelfMountinfo(content []byte) ([]MountInfo, error) {
-	out := make([]MountInfo, 0)
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		if line == "" {
-			// The last split() item is empty string following the last \n
-			continue
-		}
-		fields := strings.Fields(line)
-		fieldLines := len(fields)
-		expectedFieldsPerLine := expectedNumProcSelfMntInfoFieldsPerLine
-		if fieldLines > expectedFieldsPerLine || fieldLines < (expectedFieldsPerLine-1) {
-			return nil, fmt.Errorf("wrong number of fields (expected %d or %d, got %d): %s", expectedFieldsPerLine,
-				expectedFieldsPerLine-1, len(fields), line)
-		}
-
+	mounts, err := mount.ParseInfo(content)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]MountInfo, 0, len(mounts))
+	for _, mount := range mounts {
 		// If root value is marked deleted, skip the entry
-		if strings.Contains(fields[3], "deleted") {
+		if strings.Contains(mount.Root, "deleted") {
 			continue
 		}
-
-		mp := MountInfo{
-			DeviceId:     fields[2],
-			Root:         fields[3],
-			MountPoint:   fields[4],
-			MountOptions: strings.Split(fields[5], ","),
-		}
-
-		mountId, err := strconv.Atoi(fields[0])
-		if err != nil {
-			return nil, err
-		}
-		mp.MountId = mountId
-
-		parentId, err := strconv.Atoi(fields[1])
-		if err != nil {
-			return nil, err
-		}
-		mp.ParentId = parentId
-
-		mp.FsType = fields[fieldLines-3]
-		mp.MountSource = fields[fieldLines-2]
-		mp.SuperOptions = strings.Split(fields[fieldLines-1], ",")
-
-		out = append(out, mp)
+		out = append(out, mount)
 	}
 	return out, nil
 }
 
+// ParseMountInfo parses the contents of a /proc/[pid]/mountinfo file.
+//
+// Deprecated: use mount.ParseInfo.
+func ParseMountInfo(content []byte) ([]MountInfo, error) {
+	return mount.ParseInfo(content)
+}
+
 func listProcMounts(mountFilePath string) ([]MountPoint, error) {
 	content, err := ConsistentRead(mountFilePath, maxListTries)
 	if err != nil {
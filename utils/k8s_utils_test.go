@@ -0,0 +1,86 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProcSelfMountinfoSkipsDeleted(t *testing.T) {
+	content := []byte(`22 1 8:1 / / rw - ext4 /dev/sda1 rw
+23 22 8:2 /gone//deleted /mnt rw - ext4 /dev/sda2 rw
+`)
+	mounts, err := parseProcSelfMountinfo(content)
+	assert.NoError(t, err)
+	assert.Len(t, mounts, 1)
+	assert.Equal(t, "/", mounts[0].MountPoint)
+}
+
+func TestMountsOfDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mountinfo")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	device := filepath.Join(dir, "sdb")
+	link := filepath.Join(dir, "dm-link")
+	assert.NoError(t, ioutil.WriteFile(device, nil, 0600))
+	assert.NoError(t, os.Symlink(device, link))
+
+	mounts := []MountInfo{
+		{MountPoint: "/a", MountSource: "/dev/sda"},
+		{MountPoint: "/b", MountSource: "tmpfs"},
+	}
+	assert.Empty(t, MountsOfDevice(mounts, link))
+
+	// Sources outside /dev are ignored, so only the exact /dev path matches here
+	mounts = append(mounts, MountInfo{MountPoint: "/c", MountSource: "/dev/sda"})
+	result := MountsOfDevice(mounts, "/dev/sda")
+	assert.Len(t, result, 2)
+	assert.Equal(t, "/a", result[0].MountPoint)
+	assert.Equal(t, "/c", result[1].MountPoint)
+}
+
+func TestGetMountedDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mountinfo")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "sys/dev/block"), 0755))
+	assert.NoError(t, os.Symlink("../../devices/virtual/block/dm-3", filepath.Join(dir, "sys/dev/block/253:3")))
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	mounts, err := ParseMountInfo([]byte(
+		"100 29 253:3 / /var/lib/kubelet/plugins/pv/globalmount rw,relatime shared:1 - ext4 /dev/mapper/mpatha rw\n" +
+			"101 29 253:3 /data/sub /var/lib/kubelet/pods/p1/volumes/pv rw,relatime - ext4 /dev/mapper/mpatha rw\n" +
+			"102 29 0:5 /sdc /var/lib/kubelet/pods/p2/volumeDevices/pv rw - devtmpfs udev rw\n" +
+			"103 29 0:50 / /mnt/nfs rw - nfs4 10.0.0.1:/vol rw\n"))
+	assert.NoError(t, err)
+
+	ctx := context.TODO()
+
+	// A bind mount of a subdirectory is of the same device, not of whatever its mount source names
+	device, err := getMountedDevice(ctx, mounts, "/var/lib/kubelet/pods/p1/volumes/pv/")
+	assert.NoError(t, err)
+	assert.Equal(t, &MountedDevice{Name: "dm-3", DeviceId: "253:3", Root: "/data/sub", RefCount: 2}, device)
+
+	device, err = getMountedDevice(ctx, mounts, "/var/lib/kubelet/plugins/pv/globalmount")
+	assert.NoError(t, err)
+	assert.Equal(t, "/", device.Root)
+	assert.Equal(t, "dm-3", device.Name)
+
+	device, err = getMountedDevice(ctx, mounts, "/var/lib/kubelet/pods/p2/volumeDevices/pv")
+	assert.NoError(t, err)
+	assert.Equal(t, &MountedDevice{Name: "sdc", DeviceId: "0:5", Root: "/sdc", Raw: true, RefCount: 1}, device)
+
+	_, err = getMountedDevice(ctx, mounts, "/mnt/nfs")
+	assert.Error(t, err)
+	_, err = getMountedDevice(ctx, mounts, "/mnt/none")
+	assert.Error(t, err)
+}
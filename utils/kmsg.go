@@ -0,0 +1,241 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// SCSI and block layer errors, such as I/O errors and path failures, are logged by the kernel rather than reported
+// to the commands that attach and detach volumes.  So when an attach, detach or resize fails, the kernel's log is
+// read for messages about the devices involved, logged since the operation started, and they're attached to the
+// error returned.
+
+const (
+	// kernelLogDiagnosticLines bounds how many kernel messages are attached to an error
+	kernelLogDiagnosticLines = 20
+	// kernelLogClockSlack allows for the kernel's log timestamps and the uptime not quite agreeing
+	kernelLogClockSlack = time.Second
+	// kmsgRecordSize is larger than any record /dev/kmsg returns, each of which must be read whole
+	kmsgRecordSize = 8192
+)
+
+// kernelMessage is a record from the kernel's log buffer.
+type kernelMessage struct {
+	// Timestamp is the time since boot at which the message was logged
+	Timestamp time.Duration
+	Text      string
+}
+
+// String formats a kernel message as dmesg does.
+func (m kernelMessage) String() string {
+	return fmt.Sprintf("[%12.6f] %s", m.Timestamp.Seconds(), m.Text)
+}
+
+// parseKernelMessage parses a record read from /dev/kmsg, of the form "priority,sequence,timestamp,flags[,...];text".
+// Continuation lines of key=value pairs, which begin with a space, aren't records.
+func parseKernelMessage(record string) (kernelMessage, bool) {
+
+	if strings.HasPrefix(record, " ") {
+		return kernelMessage{}, false
+	}
+	separator := strings.Index(record, ";")
+	if separator < 0 {
+		return kernelMessage{}, false
+	}
+	prefix := strings.Split(record[:separator], ",")
+	if len(prefix) < 3 {
+		return kernelMessage{}, false
+	}
+	timestamp, err := strconv.ParseInt(prefix[2], 10, 64)
+	if err != nil {
+		return kernelMessage{}, false
+	}
+	return kernelMessage{Timestamp: time.Duration(timestamp) * time.Microsecond, Text: record[separator+1:]}, true
+}
+
+// getUptime returns the time since the host booted, the clock against which kernel messages are timestamped.
+func getUptime() (time.Duration, error) {
+
+	content, err := ioutil.ReadFile(chrootPathPrefix + "/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("could not parse uptime %q", content)
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse uptime %q; %v", content, err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// readKernelMessages returns the messages in the kernel's log buffer that were logged since a time.  Each read of
+// /dev/kmsg returns one whole record, and EAGAIN once the buffer is exhausted.  The file is read with system calls
+// rather than through os.File, which would wait for more records to be logged instead of returning EAGAIN.
+func readKernelMessages(since time.Time) ([]kernelMessage, error) {
+
+	uptime, err := getUptime()
+	if err != nil {
+		return nil, fmt.Errorf("could not get uptime; %v", err)
+	}
+	sinceBoot := uptime - time.Since(since) - kernelLogClockSlack
+
+	fd, err := syscall.Open(chrootPathPrefix+"/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open kernel log; %v", err)
+	}
+	defer syscall.Close(fd)
+
+	messages := make([]kernelMessage, 0)
+	addMessage := func(line string) {
+		if message, ok := parseKernelMessage(line); ok && message.Timestamp >= sinceBoot {
+			messages = append(messages, message)
+		}
+	}
+
+	buffer := make([]byte, kmsgRecordSize)
+	pending := ""
+	for {
+		n, err := syscall.Read(fd, buffer)
+		if err == syscall.EPIPE || err == syscall.EINTR {
+			// EPIPE means a record was overwritten before it could be read, and reading resumes with the next
+			continue
+		} else if err == syscall.EAGAIN || (err == nil && n == 0) {
+			break
+		} else if err != nil {
+			return messages, fmt.Errorf("could not read kernel log; %v", err)
+		}
+
+		// Each read returns a record, with any continuation lines, but a regular file may return several
+		pending += string(buffer[:n])
+		for newline := strings.Index(pending, "\n"); newline >= 0; newline = strings.Index(pending, "\n") {
+			addMessage(pending[:newline])
+			pending = pending[newline+1:]
+		}
+	}
+	addMessage(pending)
+
+	return messages, nil
+}
+
+// matchKernelMessages returns the last of the messages, at most maxLines of them, that mention any of the subjects
+// as a whole word, so that sdb doesn't match sdba.
+func matchKernelMessages(messages []string, subjects []string, maxLines int) []string {
+
+	quoted := make([]string, 0, len(subjects))
+	for _, subject := range subjects {
+		if subject != "" {
+			quoted = append(quoted, regexp.QuoteMeta(subject))
+		}
+	}
+	if len(quoted) == 0 {
+		return []string{}
+	}
+	subjectRegex := regexp.MustCompile(`(^|[^\w-])(` + strings.Join(quoted, "|") + `)($|[^\w-])`)
+
+	matches := make([]string, 0)
+	for _, message := range messages {
+		if message = strings.TrimSpace(message); message != "" && subjectRegex.MatchString(message) {
+			matches = append(matches, message)
+		}
+	}
+	if len(matches) > maxLines {
+		matches = matches[len(matches)-maxLines:]
+	}
+	return matches
+}
+
+// kernelLogCorrelation marks the start of an operation whose failure is to be correlated with the kernel's log.
+type kernelLogCorrelation struct {
+	start time.Time
+}
+
+func startKernelLogCorrelation() kernelLogCorrelation {
+	return kernelLogCorrelation{start: time.Now()}
+}
+
+// annotate returns an operation's error with the kernel's messages about the subjects, such as device names,
+// that were logged during the operation.  The error is returned as is if there are none, or if the kernel's log
+// can't be read, which is logged but not treated as an error since the messages are only diagnostics.
+func (c kernelLogCorrelation) annotate(ctx context.Context, err error, subjects []string) error {
+
+	if err == nil || len(subjects) == 0 {
+		return err
+	}
+
+	messages, readErr := readKernelMessages(c.start)
+	if readErr != nil {
+		Logc(ctx).WithError(readErr).Debug("Could not read kernel log.")
+	}
+	lines := make([]string, 0, len(messages))
+	for _, message := range messages {
+		lines = append(lines, message.String())
+	}
+
+	matches := matchKernelMessages(lines, subjects, kernelLogDiagnosticLines)
+	if len(matches) == 0 {
+		return err
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"subjects":       subjects,
+		"kernelMessages": matches,
+	}).Warning("Kernel logged messages about the devices of a failed operation.")
+
+	return KernelMessagesError(err, matches)
+}
+
+// deviceKernelLogSubjects returns the names by which the kernel's messages may refer to a device given by path: the
+// path's own name, as in "dm-3", and the name of the kernel device it resolves to.
+func deviceKernelLogSubjects(devicePath string) []string {
+
+	subjects := []string{path.Base(devicePath)}
+	if name, err := getBlockDeviceNameForPath(devicePath); err == nil && !StringInSlice(name, subjects) {
+		subjects = append(subjects, name)
+	}
+	return subjects
+}
+
+// iscsiKernelLogSubjects returns the names by which the kernel's messages may refer to an iSCSI LUN: its devices,
+// its SCSI address through each host, as in "3:0:0:1", and the hosts and sessions through which it's reached.
+func iscsiKernelLogSubjects(hostSessionMap map[int]int, lun string, devices ...string) []string {
+
+	subjects := make([]string, 0)
+	for _, device := range devices {
+		if device != "" {
+			subjects = append(subjects, device)
+		}
+	}
+	for host, session := range hostSessionMap {
+		subjects = append(subjects,
+			fmt.Sprintf("%d:0:0:%s", host, lun),
+			fmt.Sprintf("host%d", host),
+			fmt.Sprintf("session%d", session),
+			fmt.Sprintf("connection%d:0", session))
+	}
+	return subjects
+}
+
+// scsiDeviceKernelLogSubjects returns the names by which the kernel's messages may refer to a SCSI LUN's devices.
+func scsiDeviceKernelLogSubjects(deviceInfo *ScsiDeviceInfo) []string {
+	if deviceInfo == nil {
+		return nil
+	}
+	devices := append([]string{deviceInfo.MultipathDevice}, deviceInfo.Devices...)
+	return iscsiKernelLogSubjects(deviceInfo.HostSessionMap, deviceInfo.LUN, devices...)
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const testKmsgRecords = `6,90,1000000000,-;sd 3:0:0:1: [sdb] Synchronizing SCSI cache
+ SUBSYSTEM=scsi
+ DEVICE=+scsi:3:0:0:1
+3,101,1010000001,-;sd 3:0:0:1: [sdb] tag#0 FAILED Result: hostbyte=DID_TRANSPORT_DISRUPTED driverbyte=DRIVER_OK
+ SUBSYSTEM=scsi
+ DEVICE=+scsi:3:0:0:1
+3,102,1010000002,-;blk_update_request: I/O error, dev sdb, sector 2048 op 0x0:(READ) flags 0x0 phys_seg 1 prio class 0
+6,103,1010000003,-;sdba: detected capacity change from 0 to 1073741824
+3,104,1011000004,-;connection5:0: ping timeout of 5 secs expired
+3,105,1012000005,-;device-mapper: multipath: 253:3: Failing path 8:16.
+`
+
+func TestParseKernelMessage(t *testing.T) {
+	log.Debug("Running TestParseKernelMessage...")
+
+	message, ok := parseKernelMessage("3,102,1010000002,-;blk_update_request: I/O error, dev sdb, sector 2048")
+	assert.True(t, ok)
+	assert.Equal(t, 1010000002*time.Microsecond, message.Timestamp)
+	assert.Equal(t, "blk_update_request: I/O error, dev sdb, sector 2048", message.Text)
+	assert.Equal(t, "[ 1010.000002] blk_update_request: I/O error, dev sdb, sector 2048", message.String())
+
+	for _, record := range []string{" SUBSYSTEM=scsi", " DEVICE=+scsi:3:0:0:1", "no separator", "3,102;text", ""} {
+		_, ok = parseKernelMessage(record)
+		assert.False(t, ok, record)
+	}
+}
+
+func TestMatchKernelMessages(t *testing.T) {
+	log.Debug("Running TestMatchKernelMessages...")
+
+	messages := []string{
+		"[ 1010.000001] sd 3:0:0:1: [sdb] 41943040 512-byte logical blocks: (21.5 GB/20.0 GiB)",
+		"[ 1010.000002] sdb: detected capacity change from 10737418240 to 21474836480",
+		"[ 1010.000003] sdba: detected capacity change from 0 to 1073741824",
+		"[ 1011.000004] EXT4-fs (dm-3): resizing filesystem from 2621440 to 5242880 blocks",
+		"[ 1011.000005] EXT4-fs warning (device dm-3): ext4_resize_fs:2042: can't read last block, resize aborted",
+		"[ 1012.000006] dm-30: detected capacity change from 0 to 1073741824",
+	}
+
+	assert.Equal(t, messages[:2], matchKernelMessages(messages, []string{"sdb"}, 10))
+	assert.Equal(t, messages[4:5], matchKernelMessages(messages, []string{"dm-3", "mpatha"}, 1))
+	assert.Empty(t, matchKernelMessages(messages, []string{"sdc"}, 10))
+	assert.Empty(t, matchKernelMessages(messages, []string{""}, 10))
+}
+
+func TestKernelLogCorrelation(t *testing.T) {
+	log.Debug("Running TestKernelLogCorrelation...")
+
+	dir, err := ioutil.TempDir("", "TestKernelLogCorrelation")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "proc"), 0755))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "dev"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "proc/uptime"), []byte("1015.00 4000.00\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "dev/kmsg"), []byte(testKmsgRecords), 0644))
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	// The operation started ten seconds ago, so the message logged fifteen seconds ago is left out
+	kernelLog := kernelLogCorrelation{start: time.Now().Add(-10 * time.Second)}
+	messages, err := readKernelMessages(kernelLog.start)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 5)
+
+	ctx := context.TODO()
+	subjects := iscsiKernelLogSubjects(map[int]int{3: 5}, "1", "sdb", "")
+	err = kernelLog.annotate(ctx, errors.New("flush failed"), subjects)
+	assert.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "flush failed; kernel messages: "))
+	assert.Equal(t, []string{
+		"[ 1010.000001] sd 3:0:0:1: [sdb] tag#0 FAILED Result: hostbyte=DID_TRANSPORT_DISRUPTED driverbyte=DRIVER_OK",
+		"[ 1010.000002] blk_update_request: I/O error, dev sdb, sector 2048 op 0x0:(READ) flags 0x0 phys_seg 1 " +
+			"prio class 0",
+		"[ 1011.000004] connection5:0: ping timeout of 5 secs expired",
+	}, GetKernelMessages(err))
+
+	// Errors about devices the kernel said nothing of, and successes, are returned as they are
+	plainErr := errors.New("flush failed")
+	assert.Equal(t, plainErr, kernelLog.annotate(ctx, plainErr, []string{"sdc"}))
+	assert.Nil(t, GetKernelMessages(plainErr))
+	assert.NoError(t, kernelLog.annotate(ctx, nil, subjects))
+
+	// An unreadable kernel log doesn't hide the error
+	assert.NoError(t, os.Remove(path.Join(dir, "dev/kmsg")))
+	assert.Equal(t, plainErr, kernelLog.annotate(ctx, plainErr, subjects))
+}
@@ -0,0 +1,298 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+	"github.com/netapp/trident/utils/mount"
+)
+
+// LocalQuotaMode selects how a local volume's size is enforced.
+type LocalQuotaMode string
+
+const (
+	// LocalQuotaProject limits the volume's directory with an XFS project quota, which requires the base
+	// directory's filesystem to be mounted with the prjquota option
+	LocalQuotaProject LocalQuotaMode = "project"
+	// LocalQuotaLoopFile backs the volume with a sparse file of its size, formatted and loop-mounted on its
+	// directory, which works on any filesystem
+	LocalQuotaLoopFile LocalQuotaMode = "loopfile"
+	// LocalQuotaNone doesn't limit the volume's size
+	LocalQuotaNone LocalQuotaMode = "none"
+
+	localVolumeImageSuffix = ".img"
+	localVolumeDefaultFS   = "ext4"
+)
+
+var localVolumeNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// LocalVolume is a directory-backed volume on a node, for clusters without external storage such as those used
+// for development and testing.  Its data is kept in a directory named for it within the base directory.
+type LocalVolume struct {
+	Name      string
+	BaseDir   string
+	SizeBytes int64
+	QuotaMode LocalQuotaMode
+	// FilesystemType is the filesystem created in a loop file; empty selects ext4
+	FilesystemType string
+}
+
+// Dir returns the directory holding the volume's data.
+func (v LocalVolume) Dir() string {
+	return path.Join(v.BaseDir, v.Name)
+}
+
+func (v LocalVolume) imageFile() string {
+	return path.Join(v.BaseDir, v.Name+localVolumeImageSuffix)
+}
+
+// projectID returns the XFS project ID of the volume, derived from its name so that it needn't be recorded.
+// IDs are drawn from 31 bits, making collisions between the few volumes of a node unlikely.
+func (v LocalVolume) projectID() uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(v.Name))
+	if id := h.Sum32() & 0x7fffffff; id != 0 {
+		return id
+	}
+	return 1
+}
+
+func (v LocalVolume) validate() error {
+	if !localVolumeNameRegex.MatchString(v.Name) {
+		return fmt.Errorf("invalid local volume name: %q", v.Name)
+	}
+	if v.BaseDir == "" || !path.IsAbs(v.BaseDir) || strings.ContainsAny(v.BaseDir, " \t\n") {
+		return fmt.Errorf("invalid local volume base directory: %q", v.BaseDir)
+	}
+	switch v.QuotaMode {
+	case LocalQuotaProject, LocalQuotaLoopFile:
+		if v.SizeBytes <= 0 {
+			return fmt.Errorf("invalid local volume size: %d", v.SizeBytes)
+		}
+	case LocalQuotaNone:
+	default:
+		return fmt.Errorf("invalid local volume quota mode: %s", v.QuotaMode)
+	}
+	return nil
+}
+
+// CreateLocalVolumeDir creates a local volume's directory and limits it to the volume's size.  Creating a volume
+// that already exists reapplies its limit, and remounts its loop file if the node has rebooted, without
+// touching its data.
+func CreateLocalVolumeDir(ctx context.Context, volume LocalVolume) error {
+
+	fields := log.Fields{"name": volume.Name, "baseDir": volume.BaseDir, "quotaMode": volume.QuotaMode}
+	Logc(ctx).WithFields(fields).Debug(">>>> localvolume.CreateLocalVolumeDir")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< localvolume.CreateLocalVolumeDir")
+
+	if err := volume.validate(); err != nil {
+		return err
+	}
+
+	if err := EnsureDirExists(ctx, volume.Dir()); err != nil {
+		return err
+	}
+
+	switch volume.QuotaMode {
+	case LocalQuotaProject:
+		return setLocalVolumeProjectQuota(ctx, volume, volume.SizeBytes)
+	case LocalQuotaLoopFile:
+		return mountLocalVolumeLoopFile(ctx, volume)
+	}
+	return nil
+}
+
+// DeleteLocalVolumeDir removes a local volume, with its data and any quota or loop file.
+func DeleteLocalVolumeDir(ctx context.Context, volume LocalVolume) error {
+
+	fields := log.Fields{"name": volume.Name, "baseDir": volume.BaseDir, "quotaMode": volume.QuotaMode}
+	Logc(ctx).WithFields(fields).Debug(">>>> localvolume.DeleteLocalVolumeDir")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< localvolume.DeleteLocalVolumeDir")
+
+	if err := volume.validate(); err != nil {
+		return err
+	}
+
+	switch volume.QuotaMode {
+	case LocalQuotaProject:
+		if _, err := os.Stat(volume.Dir()); err == nil {
+			if err = setLocalVolumeProjectQuota(ctx, volume, 0); err != nil {
+				return err
+			}
+		}
+	case LocalQuotaLoopFile:
+		if mounted, err := IsMounted(ctx, "", volume.Dir()); err != nil {
+			return err
+		} else if mounted {
+			if err = Umount(ctx, volume.Dir()); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(volume.imageFile()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove local volume image %s; %v", volume.imageFile(), err)
+		}
+	}
+
+	if err := os.RemoveAll(volume.Dir()); err != nil {
+		return fmt.Errorf("could not remove local volume directory %s; %v", volume.Dir(), err)
+	}
+	return nil
+}
+
+// PublishLocalVolume bind-mounts a local volume's directory at a target path, read-only if requested.
+func PublishLocalVolume(ctx context.Context, volume LocalVolume, targetPath, options string, readOnly bool) error {
+
+	fields := log.Fields{"name": volume.Name, "targetPath": targetPath, "readOnly": readOnly}
+	Logc(ctx).WithFields(fields).Debug(">>>> localvolume.PublishLocalVolume")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< localvolume.PublishLocalVolume")
+
+	if err := volume.validate(); err != nil {
+		return err
+	}
+
+	// A loop file is unmounted by a reboot, and its empty mountpoint mustn't be published in its place
+	if volume.QuotaMode == LocalQuotaLoopFile {
+		if err := mountLocalVolumeLoopFile(ctx, volume); err != nil {
+			return err
+		}
+	} else if _, err := os.Stat(volume.Dir()); err != nil {
+		return fmt.Errorf("local volume %s not found; %v", volume.Name, err)
+	}
+
+	if mounted, err := IsMounted(ctx, "", targetPath); err != nil {
+		return err
+	} else if mounted {
+		Logc(ctx).WithFields(fields).Debug("Local volume already published.")
+		return nil
+	}
+
+	if err := EnsureDirExists(ctx, targetPath); err != nil {
+		return err
+	}
+
+	required := []string{"bind"}
+	if readOnly {
+		required = append(required, "ro")
+	}
+	mountOptions := mount.MergeOptions("", options, required...)
+	if out, err := execCommand(ctx, "mount", "-o", mountOptions, volume.Dir(), targetPath); err != nil {
+		Logc(ctx).WithFields(fields).WithField("output", string(out)).Debug("Mount failed.")
+		return fmt.Errorf("error publishing local volume %s on %s: %v", volume.Name, targetPath, err)
+	}
+
+	return nil
+}
+
+// UnpublishLocalVolume unmounts a local volume from a target path and removes the target directory.
+func UnpublishLocalVolume(ctx context.Context, targetPath string) error {
+
+	fields := log.Fields{"targetPath": targetPath}
+	Logc(ctx).WithFields(fields).Debug(">>>> localvolume.UnpublishLocalVolume")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< localvolume.UnpublishLocalVolume")
+
+	if mounted, err := IsMounted(ctx, "", targetPath); err != nil {
+		return err
+	} else if mounted {
+		if err = Umount(ctx, targetPath); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(targetPath); os.IsNotExist(err) {
+		return nil
+	}
+	return removeMountPointDir(ctx, targetPath)
+}
+
+// setLocalVolumeProjectQuota assigns a local volume's directory to its XFS project and sets the project's hard
+// block limit, where zero removes the limit.
+func setLocalVolumeProjectQuota(ctx context.Context, volume LocalVolume, sizeBytes int64) error {
+
+	out, err := execCommand(ctx, "findmnt", "-n", "-o", "TARGET,FSTYPE", "--target", volume.BaseDir)
+	if err != nil {
+		return fmt.Errorf("could not find filesystem of %s; %v", volume.BaseDir, err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return fmt.Errorf("could not find filesystem of %s; unexpected findmnt output %q", volume.BaseDir, out)
+	} else if fields[1] != "xfs" {
+		return fmt.Errorf("project quotas require an xfs filesystem, but %s is on %s", volume.BaseDir, fields[1])
+	}
+	mountpoint := fields[0]
+
+	id := volume.projectID()
+	if sizeBytes > 0 {
+		command := fmt.Sprintf("project -s -p %s %d", volume.Dir(), id)
+		if _, err := execCommand(ctx, "xfs_quota", "-x", "-c", command, mountpoint); err != nil {
+			return fmt.Errorf("could not set project of %s; %v", volume.Dir(), err)
+		}
+	}
+
+	command := fmt.Sprintf("limit -p bhard=%d %d", sizeBytes, id)
+	if _, err := execCommand(ctx, "xfs_quota", "-x", "-c", command, mountpoint); err != nil {
+		return fmt.Errorf("could not set project quota of %s; %v", volume.Dir(), err)
+	}
+
+	Logc(ctx).WithFields(log.Fields{"dir": volume.Dir(), "project": id, "size": sizeBytes}).Debug(
+		"Set local volume project quota.")
+	return nil
+}
+
+// mountLocalVolumeLoopFile creates and formats a local volume's loop file if it doesn't yet exist, and mounts it
+// on the volume's directory if it isn't mounted already.
+func mountLocalVolumeLoopFile(ctx context.Context, volume LocalVolume) error {
+
+	fstype := volume.FilesystemType
+	if fstype == "" {
+		fstype = localVolumeDefaultFS
+	}
+
+	image := volume.imageFile()
+	if f, err := os.OpenFile(image, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600); err == nil {
+		// A sparse file only uses space as it's written
+		err = f.Truncate(volume.SizeBytes)
+		_ = f.Close()
+		if err == nil {
+			err = validateFilesystemSize(ctx, fstype, volume.SizeBytes)
+		}
+		if err == nil {
+			var command string
+			var args []string
+			if command, args, err = getMkfsCommand(fstype, image, volume.SizeBytes, formatPolicy); err == nil {
+				_, err = execCommandWithProgress(ctx, command, formatPolicy.Timeout, formatPolicy.ProgressInterval,
+					args...)
+			}
+		}
+		if err != nil {
+			_ = os.Remove(image)
+			return fmt.Errorf("could not create local volume image %s; %v", image, err)
+		}
+	} else if !os.IsExist(err) {
+		return fmt.Errorf("could not create local volume image %s; %v", image, err)
+	}
+
+	if mounted, err := IsMounted(ctx, "", volume.Dir()); err != nil {
+		return err
+	} else if mounted {
+		return nil
+	}
+
+	if err := EnsureDirExists(ctx, volume.Dir()); err != nil {
+		return err
+	}
+	if out, err := execCommand(ctx, "mount", "-t", fstype, "-o", "loop", image, volume.Dir()); err != nil {
+		Logc(ctx).WithField("output", string(out)).Debug("Mount failed.")
+		return fmt.Errorf("error mounting local volume image %s on %s: %v", image, volume.Dir(), err)
+	}
+	return nil
+}
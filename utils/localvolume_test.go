@@ -0,0 +1,116 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// xfsBaseDirExecutor simulates a base directory on an xfs filesystem mounted at /data.
+type xfsBaseDirExecutor struct {
+	recordingExecutor
+}
+
+func (e *xfsBaseDirExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	if cmd.Name == "findmnt" {
+		return []byte("/data xfs\n"), nil
+	}
+	return nil, nil
+}
+
+func TestLocalVolumeValidate(t *testing.T) {
+	log.Debug("Running TestLocalVolumeValidate...")
+
+	tests := []struct {
+		Volume LocalVolume
+		Valid  bool
+	}{
+		{LocalVolume{Name: "pvc-1", BaseDir: "/data", QuotaMode: LocalQuotaNone}, true},
+		{LocalVolume{Name: "pvc-1", BaseDir: "/data", QuotaMode: LocalQuotaProject, SizeBytes: 1024}, true},
+		{LocalVolume{Name: "pvc-1", BaseDir: "/data", QuotaMode: LocalQuotaLoopFile}, false},
+		{LocalVolume{Name: "../pvc-1", BaseDir: "/data", QuotaMode: LocalQuotaNone}, false},
+		{LocalVolume{Name: "pvc-1", BaseDir: "data", QuotaMode: LocalQuotaNone}, false},
+		{LocalVolume{Name: "pvc-1", BaseDir: "/data", QuotaMode: "other"}, false},
+	}
+	for _, testCase := range tests {
+		err := testCase.Volume.validate()
+		assert.Equal(t, testCase.Valid, err == nil, "%+v", testCase.Volume)
+	}
+}
+
+func TestLocalVolumeProjectQuota(t *testing.T) {
+	log.Debug("Running TestLocalVolumeProjectQuota...")
+
+	dir, err := ioutil.TempDir("", "TestLocalVolumeProjectQuota")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	executor := &xfsBaseDirExecutor{}
+	assert.NoError(t, Init(Config{Executor: executor}))
+	defer func() { _ = Init(Config{}) }()
+
+	ctx := context.TODO()
+	volume := LocalVolume{Name: "pvc-1", BaseDir: dir, QuotaMode: LocalQuotaProject, SizeBytes: 1 << 30}
+	id := volume.projectID()
+
+	assert.NoError(t, CreateLocalVolumeDir(ctx, volume))
+	assert.DirExists(t, volume.Dir())
+	assert.Equal(t, []string{
+		"findmnt -n -o TARGET,FSTYPE --target " + dir,
+		fmt.Sprintf("xfs_quota -x -c project -s -p %s %d /data", volume.Dir(), id),
+		fmt.Sprintf("xfs_quota -x -c limit -p bhard=1073741824 %d /data", id),
+	}, executor.commands)
+
+	executor.commands = nil
+	assert.NoError(t, DeleteLocalVolumeDir(ctx, volume))
+	assert.NoDirExists(t, volume.Dir())
+	assert.Contains(t, executor.commands, fmt.Sprintf("xfs_quota -x -c limit -p bhard=0 %d /data", id))
+}
+
+func TestLocalVolumeLoopFile(t *testing.T) {
+	log.Debug("Running TestLocalVolumeLoopFile...")
+
+	dir, err := ioutil.TempDir("", "TestLocalVolumeLoopFile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{Executor: recorder}))
+	defer func() { _ = Init(Config{}) }()
+
+	ctx := context.TODO()
+	volume := LocalVolume{Name: "pvc-1", BaseDir: dir, QuotaMode: LocalQuotaLoopFile, SizeBytes: 1 << 20}
+	image := path.Join(dir, "pvc-1.img")
+
+	assert.NoError(t, CreateLocalVolumeDir(ctx, volume))
+	info, err := os.Stat(image)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<20), info.Size())
+	assert.Equal(t, []string{"mkfs.ext4 -F " + image, "mount -t ext4 -o loop " + image + " " + volume.Dir()},
+		recorder.commands)
+
+	// The existing image is mounted again rather than reformatted
+	recorder.commands = nil
+	targetPath := path.Join(dir, "pod")
+	assert.NoError(t, PublishLocalVolume(ctx, volume, targetPath, "", true))
+	assert.Equal(t, []string{
+		"mount -t ext4 -o loop " + image + " " + volume.Dir(),
+		"mount -o bind,ro " + volume.Dir() + " " + targetPath,
+	}, recorder.commands)
+
+	assert.NoError(t, UnpublishLocalVolume(ctx, targetPath))
+	assert.NoDirExists(t, targetPath)
+
+	assert.NoError(t, DeleteLocalVolumeDir(ctx, volume))
+	assert.NoFileExists(t, image)
+	assert.NoDirExists(t, volume.Dir())
+}
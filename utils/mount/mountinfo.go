@@ -0,0 +1,122 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+// Package mount holds the host-independent parts of Trident's mount handling: parsing mountinfo, matching
+// mountpoints, and merging mount options.  It imports nothing from package utils, which mounts volumes using it,
+// so that it can be used and tested on its own.
+package mount
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Info represents a single line in /proc/[pid]/mountinfo.
+type Info struct {
+	MountId        int
+	ParentId       int
+	DeviceId       string
+	Root           string
+	MountPoint     string
+	MountOptions   []string
+	OptionalFields []string
+	FsType         string
+	MountSource    string
+	SuperOptions   []string
+}
+
+// HasOption returns true if the specified option is among the mount's per-mount or superblock options.
+func (m Info) HasOption(option string) bool {
+	return inSlice(option, m.MountOptions) || inSlice(option, m.SuperOptions)
+}
+
+// IsReadOnly returns true if either the mount or its superblock is read-only.
+func (m Info) IsReadOnly() bool {
+	return m.HasOption("ro")
+}
+
+// ParseInfo parses the contents of a /proc/[pid]/mountinfo file, as described in the kernel's
+// Documentation/filesystems/proc.rst.  Each line holds the mount ID, parent ID, major:minor, root, mount point,
+// and mount options, then zero or more optional fields terminated by a "-" separator, then the filesystem type,
+// mount source, and superblock options.  Spaces, tabs, newlines, and backslashes in paths are octal-escaped by
+// the kernel and are unescaped here.
+func ParseInfo(content []byte) ([]Info, error) {
+	out := make([]Info, 0)
+	lines := strings.Split(string(content), "\n")
+	for _, line := range lines {
+		if line == "" {
+			// The last split() item is empty string following the last \n
+			continue
+		}
+		fields := strings.Fields(line)
+
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		// Older kernels may omit the superblock options when there are none
+		if separator == -1 || len(fields)-separator-1 < 2 || len(fields)-separator-1 > 3 {
+			return nil, fmt.Errorf("malformed mountinfo line: %s", line)
+		}
+
+		mp := Info{
+			DeviceId:       fields[2],
+			Root:           unescapeField(fields[3]),
+			MountPoint:     unescapeField(fields[4]),
+			MountOptions:   strings.Split(fields[5], ","),
+			OptionalFields: append([]string{}, fields[6:separator]...),
+			FsType:         fields[separator+1],
+			MountSource:    unescapeField(fields[separator+2]),
+		}
+		if len(fields) > separator+3 {
+			mp.SuperOptions = strings.Split(fields[separator+3], ",")
+		}
+
+		mountId, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		mp.MountId = mountId
+
+		parentId, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		mp.ParentId = parentId
+
+		out = append(out, mp)
+	}
+	return out, nil
+}
+
+// unescapeField replaces the kernel's three-digit octal escapes, as in "\040" for a space, with the
+// characters they represent.
+func unescapeField(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+	var buf strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if value, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				buf.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		buf.WriteByte(field[i])
+	}
+	return buf.String()
+}
+
+func inSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
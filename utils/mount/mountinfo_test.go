@@ -0,0 +1,53 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package mount
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInfo(t *testing.T) {
+	log.Debug("Running TestParseInfo...")
+
+	content := []byte(`22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro
+35 22 0:30 / /var/lib/kubelet/pods/a\040b/volumes rw,nosuid master:7 shared:9 - tmpfs tmpfs rw
+36 22 8:16 / /mnt/tab\011new\012line\134 ro,relatime - xfs /dev/sdb ro,attr2
+37 22 0:31 / /mnt/nosuper rw - nfs4 10.0.0.1:/share
+`)
+
+	mounts, err := ParseInfo(content)
+	assert.NoError(t, err)
+	assert.Len(t, mounts, 4)
+
+	assert.Equal(t, 22, mounts[0].MountId)
+	assert.Equal(t, 1, mounts[0].ParentId)
+	assert.Equal(t, "8:1", mounts[0].DeviceId)
+	assert.Equal(t, []string{"shared:1"}, mounts[0].OptionalFields)
+	assert.Equal(t, "ext4", mounts[0].FsType)
+	assert.Equal(t, "/dev/sda1", mounts[0].MountSource)
+	assert.Equal(t, []string{"rw", "errors=remount-ro"}, mounts[0].SuperOptions)
+
+	assert.Equal(t, "/var/lib/kubelet/pods/a b/volumes", mounts[1].MountPoint)
+	assert.Equal(t, []string{"master:7", "shared:9"}, mounts[1].OptionalFields)
+
+	assert.Equal(t, "/mnt/tab\tnew\nline\\", mounts[2].MountPoint)
+	assert.Empty(t, mounts[2].OptionalFields)
+	assert.True(t, mounts[2].IsReadOnly())
+	assert.True(t, mounts[2].HasOption("attr2"))
+	assert.False(t, mounts[0].IsReadOnly())
+
+	assert.Nil(t, mounts[3].SuperOptions)
+	assert.Equal(t, "10.0.0.1:/share", mounts[3].MountSource)
+
+	for _, bad := range []string{
+		"22 1 8:1 / / rw shared:1 ext4 /dev/sda1 rw\n",
+		"22 1 8:1 / / rw - ext4\n",
+		"x 1 8:1 / / rw - ext4 /dev/sda1 rw\n",
+	} {
+		_, err = ParseInfo([]byte(bad))
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package mount
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Match selects how a requested mountpoint is compared with the mountpoints in /proc/self/mountinfo.
+type Match int
+
+const (
+	// MountpointExact matches only a mount at exactly the requested path.
+	MountpointExact Match = iota
+	// MountpointOrChild matches a mount at the requested path or at any path beneath it.
+	MountpointOrChild
+)
+
+// NormalizeMountpoint cleans the supplied path and resolves any symlinks in it, so that it may be compared with
+// the canonical paths the kernel reports.  If the path cannot be resolved, the cleaned path is returned.
+func NormalizeMountpoint(mountpoint string) string {
+	mountpoint = filepath.Clean(mountpoint)
+	if resolved, err := filepath.EvalSymlinks(mountpoint); err == nil {
+		return resolved
+	}
+	return mountpoint
+}
+
+// MountpointMatches returns true if the mounted path matches the requested path according to the match mode.
+// Both paths are expected to be normalized.
+func MountpointMatches(mountedPath, mountpoint string, match Match) bool {
+	if mountedPath == mountpoint {
+		return true
+	}
+	if match == MountpointOrChild {
+		return strings.HasPrefix(mountedPath, strings.TrimSuffix(mountpoint, "/")+"/")
+	}
+	return false
+}
+
+// UnderPath returns the mounts whose mount points are at or beneath the specified path.
+func UnderPath(mounts []Info, path string) []Info {
+	path = filepath.Clean(path)
+	result := make([]Info, 0)
+	for _, mount := range mounts {
+		if MountpointMatches(mount.MountPoint, path, MountpointOrChild) {
+			result = append(result, mount)
+		}
+	}
+	return result
+}
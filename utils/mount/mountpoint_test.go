@@ -0,0 +1,77 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package mount
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountpointMatches(t *testing.T) {
+	log.Debug("Running TestMountpointMatches...")
+
+	tests := []struct {
+		MountedPath string
+		Mountpoint  string
+		Match       Match
+		Expected    bool
+	}{
+		{"/var/lib/foo", "/var/lib/foo", MountpointExact, true},
+		{"/var/lib/foo2", "/var/lib/foo", MountpointExact, false},
+		{"/var/lib/foo/bar", "/var/lib/foo", MountpointExact, false},
+		{"/var/lib", "/var/lib/foo", MountpointExact, false},
+		{"/var/lib/foo", "/var/lib/foo", MountpointOrChild, true},
+		{"/var/lib/foo/bar", "/var/lib/foo", MountpointOrChild, true},
+		{"/var/lib/foo2", "/var/lib/foo", MountpointOrChild, false},
+		{"/var/lib", "/var/lib/foo", MountpointOrChild, false},
+		{"/var", "/", MountpointOrChild, true},
+	}
+	for _, testCase := range tests {
+		assert.Equal(t, testCase.Expected,
+			MountpointMatches(testCase.MountedPath, testCase.Mountpoint, testCase.Match),
+			"Unexpected match for %s against %s (%d)", testCase.MountedPath, testCase.Mountpoint, testCase.Match)
+	}
+}
+
+func TestNormalizeMountpoint(t *testing.T) {
+	log.Debug("Running TestNormalizeMountpoint...")
+
+	dir, err := ioutil.TempDir("", "mountpoint")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	assert.NoError(t, err)
+
+	target := path.Join(dir, "target")
+	link := path.Join(dir, "link")
+	assert.NoError(t, os.Mkdir(target, 0755))
+	assert.NoError(t, os.Symlink(target, link))
+
+	assert.Equal(t, target, NormalizeMountpoint(link+"/"))
+	assert.Equal(t, target, NormalizeMountpoint(dir+"/./target"))
+	assert.Equal(t, "/does/not/exist", NormalizeMountpoint("/does/not//exist/"))
+}
+
+func TestUnderPath(t *testing.T) {
+	log.Debug("Running TestUnderPath...")
+
+	mounts := []Info{
+		{MountPoint: "/"},
+		{MountPoint: "/var/lib/kubelet"},
+		{MountPoint: "/var/lib/kubelet/pods/x"},
+		{MountPoint: "/var/lib/kubeletfoo"},
+	}
+
+	result := UnderPath(mounts, "/var/lib/kubelet/")
+	assert.Len(t, result, 2)
+	assert.Equal(t, "/var/lib/kubelet", result[0].MountPoint)
+	assert.Equal(t, "/var/lib/kubelet/pods/x", result[1].MountPoint)
+
+	assert.Len(t, UnderPath(mounts, "/"), 4)
+}
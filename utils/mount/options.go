@@ -0,0 +1,68 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package mount
+
+import "strings"
+
+// defaultOptions maps filesystem types to the mount options applied unless overridden by the user
+var defaultOptions = make(map[string]string)
+
+// SetDefaultOptions sets the comma-separated mount options, by filesystem type, that MergeOptions applies unless
+// overridden.  It's called by utils.Init with the node's configured defaults.
+func SetDefaultOptions(options map[string]string) {
+	defaultOptions = make(map[string]string, len(options))
+	for fstype, fstypeOptions := range options {
+		defaultOptions[fstype] = fstypeOptions
+	}
+}
+
+// mountOptionGroups maps mount options to the group of mutually exclusive options they belong to, so that a
+// later option in a group overrides an earlier one.  Options of the form key=value are grouped by key.
+var mountOptionGroups = map[string]string{
+	"ro": "rw", "rw": "rw",
+	"atime": "atime", "noatime": "atime", "relatime": "atime", "norelatime": "atime", "strictatime": "atime",
+	"diratime": "diratime", "nodiratime": "diratime",
+	"discard": "discard", "nodiscard": "discard",
+	"exec": "exec", "noexec": "exec",
+	"suid": "suid", "nosuid": "suid",
+	"dev": "dev", "nodev": "dev",
+	"sync": "sync", "async": "sync",
+	"lock": "lock", "nolock": "lock",
+}
+
+// MergeOptions combines mount options, in increasing order of precedence, from the default mount options
+// for the filesystem type, the user's options, and any options the caller requires, such as "ro" or "bind".  An
+// option overrides any earlier option it conflicts with, such as "rw" and "ro" or "atime" and "noatime", and
+// duplicates are dropped.  Option strings may be comma-separated and prefixed with "-o ".
+func MergeOptions(fstype, userOptions string, requiredOptions ...string) string {
+
+	merged := make([]string, 0)
+	groupIndex := make(map[string]int)
+
+	add := func(options string) {
+		for _, option := range strings.Split(strings.TrimPrefix(strings.TrimSpace(options), "-o "), ",") {
+			option = strings.TrimSpace(option)
+			if option == "" {
+				continue
+			}
+			group, ok := mountOptionGroups[option]
+			if !ok {
+				group = strings.SplitN(option, "=", 2)[0]
+			}
+			if i, ok := groupIndex[group]; ok {
+				merged[i] = option
+				continue
+			}
+			groupIndex[group] = len(merged)
+			merged = append(merged, option)
+		}
+	}
+
+	add(defaultOptions[fstype])
+	add(userOptions)
+	for _, option := range requiredOptions {
+		add(option)
+	}
+
+	return strings.Join(merged, ",")
+}
@@ -0,0 +1,36 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package mount
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeOptions(t *testing.T) {
+	log.Debug("Running TestMergeOptions...")
+
+	defer SetDefaultOptions(nil)
+	SetDefaultOptions(map[string]string{"xfs": "noatime,discard"})
+
+	tests := []struct {
+		FsType   string
+		Options  string
+		Required []string
+		Expected string
+	}{
+		{"ext4", "", nil, ""},
+		{"ext4", "-o ro,noatime", nil, "ro,noatime"},
+		{"xfs", "", nil, "noatime,discard"},
+		{"xfs", "relatime,nodiscard", nil, "relatime,nodiscard"},
+		{"xfs", "rw,context=foo", []string{"ro", "nouuid"}, "noatime,discard,ro,context=foo,nouuid"},
+		{"raw", "ro", []string{"bind", "ro"}, "ro,bind"},
+		{"nfs", "nfsvers=3,ro", []string{"nfsvers=4.1"}, "nfsvers=4.1,ro"},
+	}
+	for _, testCase := range tests {
+		assert.Equal(t, testCase.Expected, MergeOptions(testCase.FsType, testCase.Options, testCase.Required...),
+			"Unexpected options for %s %s %v", testCase.FsType, testCase.Options, testCase.Required)
+	}
+}
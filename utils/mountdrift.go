@@ -0,0 +1,308 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// A volume's mount options are applied only when it's mounted, so options changed since, as on its StorageClass,
+// never reach its existing mounts, and a filesystem that the kernel made read-only after errors stays that way
+// unnoticed.  The mount reconciler periodically compares each tracked mount's options, as mountinfo lists them,
+// with those desired for it, and remounts it if that's safe, or reports the drift otherwise.  Only the per-mount
+// flags are compared, since filesystem-specific options are often listed differently than they're given, as
+// NFS lists nfsvers=3 as vers=3.
+
+// mountFlagConflicts maps each per-mount flag that's compared to the flags it replaces.
+var mountFlagConflicts = map[string][]string{
+	"ro":         {"rw"},
+	"rw":         {"ro"},
+	"noatime":    {"relatime", "strictatime"},
+	"relatime":   {"noatime", "strictatime"},
+	"nodiratime": nil,
+	"nodev":      nil,
+	"nosuid":     nil,
+	"noexec":     nil,
+}
+
+// MountReconcilePolicy controls the mount reconciler.
+type MountReconcilePolicy struct {
+	// Interval is how often tracked mounts are checked; zero disables the reconciler
+	Interval time.Duration
+	// Remount corrects drifted mounts by remounting them when that's safe, rather than only reporting drift
+	Remount bool
+}
+
+var mountReconcilePolicy MountReconcilePolicy
+
+// MountDrift describes how a tracked mount's options differ from those desired for it.
+type MountDrift struct {
+	VolumeID   string `json:"volumeID"`
+	Mountpoint string `json:"mountpoint"`
+	// Missing lists the desired flags that the mount lacks
+	Missing []string `json:"missing"`
+	// Remounted is true if the mount was remounted with the desired flags
+	Remounted bool      `json:"remounted"`
+	CheckedAt time.Time `json:"checkedAt"`
+	// Error explains why a drifted mount wasn't remounted, or why its remount failed
+	Error string `json:"error,omitempty"`
+}
+
+// trackedMount is a mount whose options the mount reconciler checks.
+type trackedMount struct {
+	volumeID string
+	options  string
+}
+
+// mountReconciler periodically checks the options of tracked mounts, by mountpoint.
+type mountReconciler struct {
+	lock     sync.Mutex
+	mounts   map[string]trackedMount
+	drift    map[string]MountDrift
+	stopChan chan struct{}
+}
+
+var mountOptionReconciler = &mountReconciler{
+	mounts: make(map[string]trackedMount),
+	drift:  make(map[string]MountDrift),
+}
+
+// TrackMountOptions adds a mount of a volume to those the mount reconciler checks, or updates the comma-separated
+// options desired for it.
+func TrackMountOptions(ctx context.Context, volumeID, mountpoint, options string) {
+
+	mountOptionReconciler.lock.Lock()
+	defer mountOptionReconciler.lock.Unlock()
+
+	mountOptionReconciler.mounts[mountpoint] = trackedMount{volumeID: volumeID, options: options}
+
+	Logc(ctx).WithFields(log.Fields{
+		"volumeID":   volumeID,
+		"mountpoint": mountpoint,
+		"options":    options,
+	}).Debug("Tracking mount options.")
+}
+
+// UntrackMountOptions removes a mount from those the mount reconciler checks.
+func UntrackMountOptions(ctx context.Context, mountpoint string) {
+
+	mountOptionReconciler.lock.Lock()
+	defer mountOptionReconciler.lock.Unlock()
+
+	delete(mountOptionReconciler.mounts, mountpoint)
+	delete(mountOptionReconciler.drift, mountpoint)
+
+	Logc(ctx).WithField("mountpoint", mountpoint).Debug("No longer tracking mount options.")
+}
+
+// StartMountReconciler starts checking tracked mounts at the policy's interval, calling onUpdate (if not nil) with
+// the drift found by each check.  It does nothing if the reconciler is disabled or already running.
+func StartMountReconciler(ctx context.Context, onUpdate func([]MountDrift)) {
+
+	if mountReconcilePolicy.Interval == 0 {
+		return
+	}
+
+	mountOptionReconciler.lock.Lock()
+	defer mountOptionReconciler.lock.Unlock()
+
+	if mountOptionReconciler.stopChan != nil {
+		return
+	}
+	stopChan := make(chan struct{})
+	mountOptionReconciler.stopChan = stopChan
+
+	Logc(ctx).WithFields(log.Fields{
+		"interval": mountReconcilePolicy.Interval,
+		"remount":  mountReconcilePolicy.Remount,
+	}).Info("Starting mount reconciler.")
+
+	go func() {
+		ticker := time.NewTicker(mountReconcilePolicy.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-ticker.C:
+				drift := ReconcileMountOptions(ctx)
+				if onUpdate != nil {
+					onUpdate(drift)
+				}
+			}
+		}
+	}()
+}
+
+// StopMountReconciler stops the mount reconciler if it is running.
+func StopMountReconciler() {
+
+	mountOptionReconciler.lock.Lock()
+	defer mountOptionReconciler.lock.Unlock()
+
+	if mountOptionReconciler.stopChan != nil {
+		close(mountOptionReconciler.stopChan)
+		mountOptionReconciler.stopChan = nil
+	}
+}
+
+// ReconcileMountOptions checks each tracked mount now, remounting drifted mounts if the policy allows and it's
+// safe, and returns the drift found, in order of mountpoint.  Mounts that aren't mounted are skipped.
+func ReconcileMountOptions(ctx context.Context) []MountDrift {
+
+	mountOptionReconciler.lock.Lock()
+	mounts := make(map[string]trackedMount, len(mountOptionReconciler.mounts))
+	for mountpoint, mount := range mountOptionReconciler.mounts {
+		mounts[mountpoint] = mount
+	}
+	mountOptionReconciler.lock.Unlock()
+
+	drifts := make(map[string]MountDrift)
+	for mountpoint, mount := range mounts {
+		_, _ = RunHostOperation(ctx, HostOperationReconcile, mount.volumeID, func() (interface{}, error) {
+			if drift := reconcileMount(ctx, mount.volumeID, mountpoint, mount.options); drift != nil {
+				drifts[mountpoint] = *drift
+			}
+			return nil, nil
+		})
+	}
+
+	mountOptionReconciler.lock.Lock()
+	defer mountOptionReconciler.lock.Unlock()
+
+	mountOptionReconciler.drift = make(map[string]MountDrift, len(drifts))
+	results := make([]MountDrift, 0, len(drifts))
+	for mountpoint, drift := range drifts {
+		// A mount untracked while it was checked is no longer of interest
+		if _, ok := mountOptionReconciler.mounts[mountpoint]; ok {
+			mountOptionReconciler.drift[mountpoint] = drift
+			results = append(results, drift)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Mountpoint < results[j].Mountpoint })
+	return results
+}
+
+// reconcileMount compares a mount's flags with those desired for it, and remounts it with them if the policy
+// allows and it's safe.  It returns nil if the mount isn't mounted or hasn't drifted.
+func reconcileMount(ctx context.Context, volumeID, mountpoint, options string) *MountDrift {
+
+	ctx = WithLogFields(ctx, log.Fields{LogFieldVolume: volumeID})
+	fields := log.Fields{"mountpoint": mountpoint, "options": options}
+
+	mounts, err := listProcSelfMountinfo(hostMountinfoPath())
+	if err != nil {
+		Logc(ctx).WithFields(fields).WithError(err).Debug("Could not read mountinfo.")
+		return nil
+	}
+	var mount *MountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint == mountpoint {
+			mount = &mounts[i]
+		}
+	}
+	if mount == nil {
+		return nil
+	}
+
+	missing := getMissingMountFlags(desiredMountFlags(options), *mount)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	drift := &MountDrift{VolumeID: volumeID, Mountpoint: mountpoint, Missing: missing, CheckedAt: time.Now()}
+	fields["missing"] = missing
+	fields["mountOptions"] = mount.MountOptions
+
+	if !mountReconcilePolicy.Remount {
+		drift.Error = "remounting is disabled"
+	} else if StringInSlice("rw", missing) && StringInSlice("ro", mount.SuperOptions) {
+		// The filesystem itself is read-only, as after errors or when its device became read-only
+		drift.Error = "filesystem is read-only; it must be checked before it's made writable again"
+	} else {
+		remountOptions := getRemountOptions(mount.MountOptions, missing)
+		if _, err = execMountCommand(ctx, "mount", 10, "-o", "remount,bind,"+strings.Join(remountOptions, ","),
+			mountpoint); err != nil {
+			drift.Error = fmt.Sprintf("could not remount; %v", err)
+		} else {
+			drift.Remounted = true
+		}
+	}
+
+	if drift.Remounted {
+		Logc(ctx).WithFields(fields).Info("Remounted mount whose options had drifted.")
+		journalHostOperation(ctx, log.InfoLevel, "Remounted mount whose options had drifted.", fields)
+	} else {
+		Logc(ctx).WithFields(fields).WithField("reason", drift.Error).Warning("Mount options have drifted.")
+	}
+	return drift
+}
+
+// desiredMountFlags returns the per-mount flags among comma-separated mount options.  A mount not desired to be
+// read-only is desired to be writable.
+func desiredMountFlags(options string) []string {
+
+	flags := make([]string, 0)
+	for _, option := range strings.Split(options, ",") {
+		option = strings.TrimSpace(option)
+		if _, ok := mountFlagConflicts[option]; ok && !StringInSlice(option, flags) {
+			flags = append(flags, option)
+		}
+	}
+	if !StringInSlice("ro", flags) && !StringInSlice("rw", flags) {
+		flags = append([]string{"rw"}, flags...)
+	}
+	return flags
+}
+
+// getMissingMountFlags returns the desired flags that a mount lacks.  A mount is writable only if neither it nor
+// its filesystem is read-only.
+func getMissingMountFlags(desired []string, mount MountInfo) []string {
+
+	missing := make([]string, 0)
+	for _, flag := range desired {
+		satisfied := StringInSlice(flag, mount.MountOptions)
+		if flag == "rw" {
+			satisfied = !mount.IsReadOnly()
+		}
+		if !satisfied {
+			missing = append(missing, flag)
+		}
+	}
+	return missing
+}
+
+// getRemountOptions returns the per-mount flags with which to remount a mount so that it has the missing flags.
+// A bind remount replaces all of a mount's per-mount flags, so those it has that the missing flags don't replace
+// are kept.  Only the mount changes, not the filesystem, which may be mounted elsewhere too.
+func getRemountOptions(current, missing []string) []string {
+
+	options := make([]string, 0, len(current)+len(missing))
+	for _, option := range current {
+		if _, ok := mountFlagConflicts[option]; !ok || StringInSlice(option, options) {
+			continue
+		}
+		replaced := false
+		for _, flag := range missing {
+			replaced = replaced || StringInSlice(option, mountFlagConflicts[flag])
+		}
+		if !replaced {
+			options = append(options, option)
+		}
+	}
+	for _, flag := range missing {
+		if !StringInSlice(flag, options) {
+			options = append(options, flag)
+		}
+	}
+	return options
+}
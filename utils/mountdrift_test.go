@@ -0,0 +1,80 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRemountOptions(t *testing.T) {
+	log.Debug("Running TestGetRemountOptions...")
+
+	assert.Equal(t, []string{"nosuid", "rw"}, getRemountOptions([]string{"ro", "nosuid"}, []string{"rw"}))
+	assert.Equal(t, []string{"rw", "nodev", "noatime"},
+		getRemountOptions([]string{"rw", "nodev", "relatime"}, []string{"noatime"}))
+
+	mount := MountInfo{MountOptions: []string{"rw", "relatime"}, SuperOptions: []string{"ro"}}
+	assert.Equal(t, []string{"rw", "noatime"}, getMissingMountFlags(desiredMountFlags("noatime,_netdev"), mount))
+	assert.Equal(t, []string{"ro"}, getMissingMountFlags(desiredMountFlags("ro,discard"), mount))
+}
+
+func TestReconcileMountOptions(t *testing.T) {
+	log.Debug("Running TestReconcileMountOptions...")
+
+	dir, err := ioutil.TempDir("", "TestReconcileMountOptions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mountinfo := path.Join(dir, "proc/1/mountinfo")
+	assert.NoError(t, os.MkdirAll(path.Dir(mountinfo), 0755))
+	assert.NoError(t, ioutil.WriteFile(mountinfo, []byte(
+		"100 29 253:0 / /mnt/vol1 ro,nosuid,relatime shared:1 - ext4 /dev/dm-0 rw\n"+
+			"101 29 253:1 / /mnt/vol2 ro,relatime shared:2 - ext4 /dev/dm-1 ro,errors=remount-ro\n"+
+			"102 29 253:2 / /mnt/vol3 rw,noatime shared:3 - xfs /dev/dm-2 rw\n"), 0644))
+
+	recorder := &recordingExecutor{}
+	policy := MountReconcilePolicy{Remount: true}
+	assert.NoError(t, Init(Config{DockerPluginMode: true, HostRoot: dir, Executor: recorder,
+		MountReconcilePolicy: policy}))
+	defer func() { _ = Init(Config{}) }()
+
+	ctx := context.TODO()
+	TrackMountOptions(ctx, "vol1", "/mnt/vol1", "noatime")
+	TrackMountOptions(ctx, "vol2", "/mnt/vol2", "")
+	TrackMountOptions(ctx, "vol3", "/mnt/vol3", "noatime,discard")
+	TrackMountOptions(ctx, "vol4", "/mnt/vol4", "ro")
+	for _, mountpoint := range []string{"/mnt/vol1", "/mnt/vol2", "/mnt/vol3", "/mnt/vol4"} {
+		defer UntrackMountOptions(ctx, mountpoint)
+	}
+
+	// A mount made read-only is made writable again, but not one whose filesystem went read-only
+	drift := ReconcileMountOptions(ctx)
+	assert.Len(t, drift, 2)
+	assert.Equal(t, "vol1", drift[0].VolumeID)
+	assert.Equal(t, []string{"rw", "noatime"}, drift[0].Missing)
+	assert.True(t, drift[0].Remounted)
+	assert.Equal(t, "vol2", drift[1].VolumeID)
+	assert.False(t, drift[1].Remounted)
+	assert.NotEmpty(t, drift[1].Error)
+	assert.Equal(t, []string{"mount -o remount,bind,nosuid,rw,noatime /mnt/vol1"}, recorder.commands)
+
+	// Without remounting, drift is only reported
+	recorder.commands = nil
+	mountReconcilePolicy.Remount = false
+	drift = ReconcileMountOptions(ctx)
+	assert.Len(t, drift, 2)
+	assert.False(t, drift[0].Remounted)
+	assert.Empty(t, recorder.commands)
+
+	UntrackMountOptions(ctx, "/mnt/vol1")
+	assert.Len(t, ReconcileMountOptions(ctx), 1)
+
+	assert.Error(t, Init(Config{MountReconcilePolicy: MountReconcilePolicy{Interval: -1}}))
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NFS and SMB mounts are made by mount helpers that report bad options and missing credentials poorly, if at all,
+// and in Docker plugin mode they run in the host's mount namespace, where any file they're pointed at, such as a
+// Kerberos keytab or an SMB credentials file, must exist on the host rather than in the plugin's filesystem.  So
+// options are checked here before mounting, with files looked up through the host root.
+
+// nfsMountVersions are the NFS versions mount.nfs accepts.
+var nfsMountVersions = []string{"3", "3.0", "4", "4.0", "4.1", "4.2"}
+
+// hostKeytabPath is the keytab from which the host's gssd gets the machine credentials for Kerberos NFS mounts.
+const hostKeytabPath = "/etc/krb5.keytab"
+
+// splitMountOptions splits comma-separated mount options, which may be prefixed with "-o ", into their names and
+// values, failing on empty or malformed options.
+func splitMountOptions(options string) ([][2]string, error) {
+
+	options = strings.TrimPrefix(strings.TrimSpace(options), "-o ")
+	if options == "" {
+		return nil, nil
+	}
+
+	var split [][2]string
+	for _, option := range strings.Split(options, ",") {
+		if option == "" || strings.ContainsAny(option, " \t\n\"'") {
+			return nil, fmt.Errorf("invalid mount option %q in %q", option, options)
+		}
+		nameValue := strings.SplitN(option, "=", 2)
+		if nameValue[0] == "" {
+			return nil, fmt.Errorf("invalid mount option %q in %q", option, options)
+		}
+		if len(nameValue) == 1 {
+			nameValue = append(nameValue, "")
+		}
+		split = append(split, [2]string{nameValue[0], nameValue[1]})
+	}
+	return split, nil
+}
+
+// ValidateNFSMountOptions checks NFS mount options before they're passed to mount: that they're well formed,
+// that any NFS version and security flavor is one mount.nfs supports, and that the host has a keytab if a
+// Kerberos flavor is requested.
+func ValidateNFSMountOptions(options string) error {
+
+	split, err := splitMountOptions(options)
+	if err != nil {
+		return err
+	}
+	if _, err = GetNFSVersionFromMountOptions(options, "", nfsMountVersions); err != nil {
+		return err
+	}
+
+	kerberos := false
+	for _, option := range split {
+		if option[0] != "sec" {
+			continue
+		}
+		for _, flavor := range strings.Split(option[1], ":") {
+			switch flavor {
+			case "sys", "none":
+			case "krb5", "krb5i", "krb5p":
+				kerberos = true
+			default:
+				return fmt.Errorf("invalid NFS security flavor %q in %q", flavor, options)
+			}
+		}
+	}
+
+	if kerberos && !PathExists(chrootPathPrefix+hostKeytabPath) {
+		return fmt.Errorf("NFS mount options %q require Kerberos, but the host has no keytab at %s", options,
+			hostKeytabPath)
+	}
+	return nil
+}
+
+// ValidateSMBMountOptions checks SMB mount options before they're passed to mount.cifs: that they're well formed
+// and that they name credentials without revealing them.  Credentials must come from a credentials file, which
+// must be given by its absolute path on the host, exist, and be readable only by its owner, or from Kerberos;
+// a password among the options would be visible in the host's process list and logs.  Guest mounts need none.
+func ValidateSMBMountOptions(options string) error {
+
+	split, err := splitMountOptions(options)
+	if err != nil {
+		return err
+	}
+
+	credentials, kerberos, guest := "", false, false
+	for _, option := range split {
+		switch option[0] {
+		case "password", "pass", "password2":
+			return errors.New("SMB mount options must not include a password; use a credentials file")
+		case "credentials", "cred":
+			credentials = option[1]
+		case "sec":
+			kerberos = strings.HasPrefix(option[1], "krb5")
+		case "guest":
+			guest = true
+		}
+	}
+
+	switch {
+	case credentials != "":
+		return validateSMBCredentialsFile(credentials)
+	case kerberos, guest:
+		return nil
+	default:
+		return errors.New("SMB mount options must name a credentials file, or use Kerberos or guest access")
+	}
+}
+
+// validateSMBCredentialsFile checks that an SMB credentials file, named by its path on the host, exists and is
+// readable only by its owner.
+func validateSMBCredentialsFile(credentials string) error {
+
+	if !filepath.IsAbs(credentials) {
+		return fmt.Errorf("SMB credentials file %s must be an absolute path on the host", credentials)
+	}
+
+	info, err := os.Stat(chrootPathPrefix + credentials)
+	if err != nil {
+		return fmt.Errorf("could not find SMB credentials file %s on the host; %v", credentials, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("SMB credentials file %s is not a regular file", credentials)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("SMB credentials file %s is accessible to others than its owner (mode %v)", credentials,
+			info.Mode().Perm())
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateNFSMountOptions(t *testing.T) {
+	log.Debug("Running TestValidateNFSMountOptions...")
+
+	dir, err := ioutil.TempDir("", "TestValidateNFSMountOptions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, Init(Config{DockerPluginMode: true, HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	assert.NoError(t, ValidateNFSMountOptions(""))
+	assert.NoError(t, ValidateNFSMountOptions("-o vers=4.1,hard,sec=sys"))
+	assert.NoError(t, ValidateNFSMountOptions("nfsvers=3,nolock"))
+	assert.Error(t, ValidateNFSMountOptions("vers=5"))
+	assert.Error(t, ValidateNFSMountOptions("vers=4.1,,hard"))
+	assert.Error(t, ValidateNFSMountOptions("vers=4.1, hard"))
+	assert.Error(t, ValidateNFSMountOptions("=4.1"))
+	assert.Error(t, ValidateNFSMountOptions("sec=krb6"))
+
+	// Kerberos needs the host's keytab, which is looked for through the host root
+	assert.Error(t, ValidateNFSMountOptions("vers=4.1,sec=krb5p"))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "etc"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, hostKeytabPath), nil, 0600))
+	assert.NoError(t, ValidateNFSMountOptions("vers=4.1,sec=krb5p:krb5i"))
+}
+
+func TestValidateSMBMountOptions(t *testing.T) {
+	log.Debug("Running TestValidateSMBMountOptions...")
+
+	dir, err := ioutil.TempDir("", "TestValidateSMBMountOptions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, Init(Config{DockerPluginMode: true, HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "etc/smb"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "etc/smb/private"), nil, 0600))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "etc/smb/shared"), nil, 0644))
+
+	assert.NoError(t, ValidateSMBMountOptions("vers=3.0,credentials=/etc/smb/private"))
+	assert.NoError(t, ValidateSMBMountOptions("sec=krb5,cruid=1000"))
+	assert.NoError(t, ValidateSMBMountOptions("guest"))
+
+	// Credentials must be given, must not be revealed, and must be kept private in a file on the host
+	assert.Error(t, ValidateSMBMountOptions("vers=3.0"))
+	assert.Error(t, ValidateSMBMountOptions("username=admin,password=secret"))
+	assert.Error(t, ValidateSMBMountOptions("credentials=etc/smb/private"))
+	assert.Error(t, ValidateSMBMountOptions("credentials=/etc/smb/missing"))
+	assert.Error(t, ValidateSMBMountOptions("credentials=/etc/smb/shared"))
+	assert.Error(t, ValidateSMBMountOptions("credentials=/etc/smb"))
+	assert.Error(t, ValidateSMBMountOptions("guest,,vers=3.0"))
+}
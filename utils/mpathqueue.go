@@ -0,0 +1,198 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// A multipath device with the queue_if_no_path feature, as NetApp's recommended no_path_retry "queue" sets, holds
+// I/O while it has no working paths rather than failing it.  That protects data through a brief outage, but if the
+// paths never return, flushing the device or unmounting its filesystem waits forever for the queued I/O.  Such a
+// device is detected before it's flushed, and queueing is disabled, failing the queued I/O, if the no-path
+// queueing policy allows.
+
+// NoPathQueueingPolicy determines whether a detach may disable queueing on a multipath device that has no working
+// paths, failing the I/O queued to it so the detach can complete.
+type NoPathQueueingPolicy string
+
+const (
+	// NoPathQueueingPolicyKeep never disables queueing; a detach fails at once instead of hanging
+	NoPathQueueingPolicyKeep NoPathQueueingPolicy = "keep"
+	// NoPathQueueingPolicyForce disables queueing when a detach is forced, as when unsafe or once the node is fenced
+	NoPathQueueingPolicyForce NoPathQueueingPolicy = "force"
+	// NoPathQueueingPolicyAlways disables queueing whenever a detach finds a device with no working paths,
+	// including when unmounting its filesystem hangs
+	NoPathQueueingPolicyAlways NoPathQueueingPolicy = "always"
+)
+
+var noPathQueueingPolicy = NoPathQueueingPolicyKeep
+
+func validateNoPathQueueingPolicy(policy NoPathQueueingPolicy) error {
+	switch policy {
+	case NoPathQueueingPolicyKeep, NoPathQueueingPolicyForce, NoPathQueueingPolicyAlways:
+		return nil
+	default:
+		return fmt.Errorf("invalid no-path queueing policy: %s", policy)
+	}
+}
+
+// multipathPathStateRegex matches a path in a multipath device's status, as in "8:16 A 0", with its major:minor
+// number and whether it's active or failed
+var multipathPathStateRegex = regexp.MustCompile(`(?:^|\s)(\d+:\d+) ([AF]) `)
+
+// multipathQueueingState describes whether a multipath device queues I/O while it has no working paths, and
+// whether it has any.
+type multipathQueueingState struct {
+	QueueIfNoPath bool
+	ActivePaths   int
+	FailedPaths   int
+}
+
+// stuck returns whether I/O to the device would wait indefinitely.
+func (s multipathQueueingState) stuck() bool {
+	return s.QueueIfNoPath && s.ActivePaths == 0
+}
+
+// parseMultipathFeatures returns whether a multipath device's table, as listed by dmsetup table, has the
+// queue_if_no_path feature.  The table lists the device's features, after their count, following the target type,
+// as in "0 2097152 multipath 1 queue_if_no_path 1 alua 1 1 service-time 0 2 1 8:16 1 1 8:32 1 1".
+func parseMultipathFeatures(table string) (bool, error) {
+
+	fields := strings.Fields(table)
+	for i, field := range fields {
+		if field != "multipath" || i+1 >= len(fields) {
+			continue
+		}
+		count, err := strconv.Atoi(fields[i+1])
+		if err != nil || i+2+count > len(fields) {
+			return false, fmt.Errorf("could not parse multipath table %q", table)
+		}
+		for _, feature := range fields[i+2 : i+2+count] {
+			if feature == "queue_if_no_path" {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("not a multipath table: %q", table)
+}
+
+// parseMultipathPathStates counts the active and failed paths in a multipath device's status, as listed by dmsetup
+// status, as in "0 2097152 multipath 2 0 0 0 1 1 A 0 2 0 8:16 F 1 8:32 A 0".
+func parseMultipathPathStates(status string) (active, failed int) {
+	for _, match := range multipathPathStateRegex.FindAllStringSubmatch(status+" ", -1) {
+		if match[2] == "A" {
+			active++
+		} else {
+			failed++
+		}
+	}
+	return active, failed
+}
+
+// getMultipathQueueingState reads whether a multipath device, such as dm-3, queues I/O while it has no working
+// paths, and how many paths are working.
+func getMultipathQueueingState(ctx context.Context, multipathDevice string) (multipathQueueingState, error) {
+
+	var state multipathQueueingState
+	devicePath := "/dev/" + multipathDevice
+
+	table, err := execCommandWithTimeout(ctx, "dmsetup", 10, false, "table", devicePath)
+	if err != nil {
+		return state, fmt.Errorf("could not read table of %s; %v", devicePath, err)
+	}
+	if state.QueueIfNoPath, err = parseMultipathFeatures(string(table)); err != nil {
+		return state, err
+	}
+
+	status, err := execCommandWithTimeout(ctx, "dmsetup", 10, false, "status", devicePath)
+	if err != nil {
+		return state, fmt.Errorf("could not read status of %s; %v", devicePath, err)
+	}
+	state.ActivePaths, state.FailedPaths = parseMultipathPathStates(string(status))
+
+	return state, nil
+}
+
+// disableMultipathQueueing makes a multipath device fail I/O while it has no working paths, failing any I/O
+// already queued.  This is what multipathd's disablequeueing command does, but it doesn't depend on multipathd.
+func disableMultipathQueueing(ctx context.Context, multipathDevice string) error {
+
+	devicePath := "/dev/" + multipathDevice
+	if _, err := execCommandWithTimeout(ctx, "dmsetup", 10, true, "message", devicePath, "0",
+		"fail_if_no_path"); err != nil {
+		return fmt.Errorf("could not disable queueing on %s; %v", devicePath, err)
+	}
+	journalHostOperation(ctx, log.WarnLevel, "Disabled queueing on multipath device with no working paths.",
+		log.Fields{"multipathDevice": multipathDevice})
+	return nil
+}
+
+// ensureMultipathDeviceNotStuck checks, before a multipath device is flushed, that I/O to it won't wait forever
+// because it queues I/O and has no working paths.  If it would, queueing is disabled if the no-path queueing
+// policy allows for a detach that is or isn't forced, and an error is returned otherwise.  A device whose state
+// can't be read is assumed not to be stuck.
+func ensureMultipathDeviceNotStuck(ctx context.Context, multipathDevice string, force bool) error {
+
+	fields := log.Fields{"multipathDevice": multipathDevice, "force": force, "policy": noPathQueueingPolicy}
+	Logc(ctx).WithFields(fields).Debug(">>>> mpathqueue.ensureMultipathDeviceNotStuck")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< mpathqueue.ensureMultipathDeviceNotStuck")
+
+	state, err := getMultipathQueueingState(ctx, multipathDevice)
+	if err != nil {
+		Logc(ctx).WithFields(fields).WithError(err).Debug("Could not read multipath queueing state.")
+		return nil
+	}
+	if !state.stuck() {
+		return nil
+	}
+
+	fields["failedPaths"] = state.FailedPaths
+	if noPathQueueingPolicy == NoPathQueueingPolicyAlways || (noPathQueueingPolicy == NoPathQueueingPolicyForce &&
+		force) {
+		Logc(ctx).WithFields(fields).Warning("Multipath device has no working paths and queues I/O; " +
+			"disabling queueing, which fails the I/O queued to it.")
+		return disableMultipathQueueing(ctx, multipathDevice)
+	}
+
+	Logc(ctx).WithFields(fields).Error("Multipath device has no working paths and queues I/O; " +
+		"not flushing it, as that would wait until a path returns.")
+	return fmt.Errorf("multipath device %s has no working paths and queues I/O (queue_if_no_path), so it can't "+
+		"be flushed until a path returns; the no-path queueing policy %s doesn't allow disabling queueing",
+		multipathDevice, noPathQueueingPolicy)
+}
+
+// unstickMountedMultipathDevice disables queueing on the multipath device mounted at a mountpoint, if the no-path
+// queueing policy always allows it and the device has no working paths, so that an unmount that timed out waiting
+// on the device's queued I/O may complete when retried.  It returns whether queueing was disabled.
+func unstickMountedMultipathDevice(ctx context.Context, mountpoint string) bool {
+
+	if noPathQueueingPolicy != NoPathQueueingPolicyAlways {
+		return false
+	}
+
+	mountedDevice, err := GetMountedDevice(ctx, mountpoint)
+	if err != nil || !isMultipathDevice(mountedDevice.Name) {
+		return false
+	}
+
+	state, err := getMultipathQueueingState(ctx, mountedDevice.Name)
+	if err != nil || !state.stuck() {
+		return false
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"mountpoint":      mountpoint,
+		"multipathDevice": mountedDevice.Name,
+	}).Warning("Unmount is waiting on a multipath device with no working paths; disabling queueing.")
+	return disableMultipathQueueing(ctx, mountedDevice.Name) == nil
+}
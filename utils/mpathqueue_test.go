@@ -0,0 +1,108 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// dmsetupExecutor simulates dmsetup listing a multipath device's table and status.
+type dmsetupExecutor struct {
+	recordingExecutor
+	table, status string
+}
+
+func (e *dmsetupExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	if cmd.Name == "dmsetup" && len(cmd.Args) > 0 {
+		switch cmd.Args[0] {
+		case "table":
+			return []byte(e.table), nil
+		case "status":
+			return []byte(e.status), nil
+		}
+	}
+	return nil, nil
+}
+
+func TestParseMultipathFeatures(t *testing.T) {
+	log.Debug("Running TestParseMultipathFeatures...")
+
+	queueing, err := parseMultipathFeatures(
+		"0 2097152 multipath 1 queue_if_no_path 1 alua 1 1 service-time 0 2 1 8:16 1 1 8:32 1 1\n")
+	assert.NoError(t, err)
+	assert.True(t, queueing)
+
+	queueing, err = parseMultipathFeatures("0 2097152 multipath 0 1 alua 1 1 service-time 0 1 1 8:16 1 1\n")
+	assert.NoError(t, err)
+	assert.False(t, queueing)
+
+	for _, table := range []string{"", "0 2097152 linear 8:16 0", "0 2097152 multipath 3 queue_if_no_path"} {
+		_, err = parseMultipathFeatures(table)
+		assert.Error(t, err, table)
+	}
+}
+
+func TestParseMultipathPathStates(t *testing.T) {
+	log.Debug("Running TestParseMultipathPathStates...")
+
+	active, failed := parseMultipathPathStates("0 2097152 multipath 2 0 0 0 1 1 A 0 2 0 8:16 F 1 8:32 A 0\n")
+	assert.Equal(t, 1, active)
+	assert.Equal(t, 1, failed)
+
+	active, failed = parseMultipathPathStates("0 2097152 multipath 2 0 0 0 1 1 A 0 2 0 8:16 F 1 8:32 F 1")
+	assert.Equal(t, 0, active)
+	assert.Equal(t, 2, failed)
+}
+
+func TestEnsureMultipathDeviceNotStuck(t *testing.T) {
+	log.Debug("Running TestEnsureMultipathDeviceNotStuck...")
+
+	ctx := context.TODO()
+	disable := "dmsetup message /dev/dm-3 0 fail_if_no_path"
+	executor := &dmsetupExecutor{
+		table:  "0 2097152 multipath 1 queue_if_no_path 1 alua 1 1 service-time 0 2 1 8:16 1 1 8:32 1 1\n",
+		status: "0 2097152 multipath 2 0 0 0 1 1 E 0 2 0 8:16 F 1 8:32 F 1\n",
+	}
+	defer func() { _ = Init(Config{}) }()
+
+	tests := []struct {
+		policy  NoPathQueueingPolicy
+		force   bool
+		disable bool
+	}{
+		{NoPathQueueingPolicyKeep, false, false},
+		{NoPathQueueingPolicyKeep, true, false},
+		{NoPathQueueingPolicyForce, false, false},
+		{NoPathQueueingPolicyForce, true, true},
+		{NoPathQueueingPolicyAlways, false, true},
+	}
+	for _, test := range tests {
+		executor.commands = nil
+		assert.NoError(t, Init(Config{Executor: executor, NoPathQueueingPolicy: test.policy}))
+		err := ensureMultipathDeviceNotStuck(ctx, "dm-3", test.force)
+		if test.disable {
+			assert.NoError(t, err, test.policy)
+			assert.Contains(t, executor.commands, disable, test.policy)
+		} else {
+			assert.Error(t, err, test.policy)
+			assert.NotContains(t, executor.commands, disable, test.policy)
+		}
+	}
+
+	// A device with a working path, or that fails I/O with none, is flushed as it is
+	executor.status = "0 2097152 multipath 2 0 0 0 1 1 A 0 2 0 8:16 F 1 8:32 A 0\n"
+	executor.commands = nil
+	assert.NoError(t, Init(Config{Executor: executor}))
+	assert.NoError(t, ensureMultipathDeviceNotStuck(ctx, "dm-3", false))
+	executor.table = "0 2097152 multipath 0 1 alua 1 1 service-time 0 2 1 8:16 1 1 8:32 1 1\n"
+	executor.status = "0 2097152 multipath 2 0 0 0 1 1 E 0 2 0 8:16 F 1 8:32 F 1\n"
+	assert.NoError(t, ensureMultipathDeviceNotStuck(ctx, "dm-3", false))
+	assert.NotContains(t, executor.commands, disable)
+
+	assert.Error(t, Init(Config{NoPathQueueingPolicy: "sometimes"}))
+}
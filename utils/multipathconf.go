@@ -0,0 +1,142 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+const (
+	// multipathConfDir is where multipathd reads configuration drop-ins, in addition to /etc/multipath.conf
+	multipathConfDir = "/etc/multipath/conf.d"
+	// multipathBlacklistExceptionFile is the drop-in that excepts NetApp LUNs from the host's blacklist
+	multipathBlacklistExceptionFile = "trident-blacklist-exceptions.conf"
+
+	netappSCSIVendor = "NETAPP"
+
+	// netappBlacklistExceptions excepts NetApp LUNs, by their NAA WWIDs and by their SCSI vendor and product, from
+	// any blacklist of either.  Blacklists of device nodes or udev properties aren't excepted, since an
+	// exception broad enough to cover them would cover other vendors' devices too.
+	netappBlacklistExceptions = `# Written by Trident so that NetApp LUNs get multipath devices.
+blacklist_exceptions {
+    wwid "^3600a098"
+    device {
+        vendor "NETAPP"
+        product "LUN.*"
+    }
+}
+`
+)
+
+var remediateMultipathBlacklist bool
+
+// getMultipathBlacklistReason returns why multipath blacklists a device like sdx, as multipath's check of the
+// device reports it, or an empty string if it doesn't.
+func getMultipathBlacklistReason(ctx context.Context, device string) string {
+
+	// A blacklisted device fails the check, so the output matters rather than the error
+	out, _ := execCommandWithTimeout(ctx, "multipath", 10, false, "-v3", "-c", "/dev/"+device)
+
+	for _, line := range strings.Split(string(out), "\n") {
+		// Verbose lines may be prefixed with a timestamp, as in "Oct 15 10:00:00 | sdb: wwid 3600a... blacklisted"
+		if i := strings.LastIndex(line, " | "); i >= 0 {
+			line = line[i+3:]
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, device+":") && strings.Contains(line, "blacklisted") {
+			return strings.TrimSpace(strings.TrimPrefix(line, device+":"))
+		}
+	}
+	return ""
+}
+
+// resolveMultipathBlacklist finds out whether a LUN's devices are missing a multipath device because multipath's
+// configuration blacklists them, as distro defaults that blacklist everything do, rather than leaving the attach
+// to silently proceed on one path.  If remediation is enabled and the LUN is NetApp's, a blacklist exception is
+// written, multipathd is reconfigured, and true is returned if a multipath device then appears.  Otherwise an
+// error explains the blacklisting.  False and no error are returned if the devices aren't blacklisted.
+func resolveMultipathBlacklist(ctx context.Context, devices []string) (bool, error) {
+
+	fields := log.Fields{"devices": devices}
+	Logc(ctx).WithFields(fields).Debug(">>>> multipathconf.resolveMultipathBlacklist")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< multipathconf.resolveMultipathBlacklist")
+
+	if len(devices) == 0 {
+		return false, nil
+	}
+	device := devices[0]
+
+	reason := getMultipathBlacklistReason(ctx, device)
+	if reason == "" {
+		return false, nil
+	}
+	fields["reason"] = reason
+
+	vendor, _ := ioutil.ReadFile(chrootPathPrefix + "/sys/block/" + device + "/device/vendor")
+	isNetApp := strings.TrimSpace(string(vendor)) == netappSCSIVendor
+
+	if !remediateMultipathBlacklist || !isNetApp {
+		Logc(ctx).WithFields(fields).Error("Multipath configuration blacklists LUN.")
+		return false, fmt.Errorf("multipath configuration blacklists device %s (%s), so the LUN would have "+
+			"only one path; add a blacklist exception for it to the host's multipath configuration", device, reason)
+	}
+
+	Logc(ctx).WithFields(fields).Warning("Multipath configuration blacklists LUN, adding a blacklist exception.")
+
+	if err := writeMultipathBlacklistException(ctx); err != nil {
+		return false, err
+	}
+	if _, err := execCommandWithTimeout(ctx, "multipathd", 30, true, "reconfigure"); err != nil {
+		return false, fmt.Errorf("could not reconfigure multipathd; %v", err)
+	}
+	for _, device := range devices {
+		if _, err := execCommandWithTimeout(ctx, "multipathd", 10, true, "add", "path", device); err != nil {
+			Logc(ctx).WithField("device", device).WithError(err).Warning("Could not add path to multipathd.")
+		}
+	}
+
+	if reason = getMultipathBlacklistReason(ctx, device); reason != "" {
+		return false, fmt.Errorf("multipath configuration still blacklists device %s (%s) after adding an "+
+			"exception for NetApp LUNs; it must be excepted in the host's multipath configuration", device, reason)
+	}
+
+	multipathDevice := waitForMultipathDeviceForDevices(ctx, devices)
+	return multipathDevice != "", nil
+}
+
+// writeMultipathBlacklistException writes the drop-in that excepts NetApp LUNs from multipath's blacklist, if it
+// isn't there already.
+func writeMultipathBlacklistException(ctx context.Context) error {
+
+	dir := chrootPathPrefix + multipathConfDir
+	filename := path.Join(dir, multipathBlacklistExceptionFile)
+
+	if content, err := ioutil.ReadFile(filename); err == nil && string(content) == netappBlacklistExceptions {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create %s; %v", dir, err)
+	}
+	tempFilename := filename + ".tmp"
+	if err := ioutil.WriteFile(tempFilename, []byte(netappBlacklistExceptions), 0644); err != nil {
+		return fmt.Errorf("could not write %s; %v", filename, err)
+	}
+	if err := os.Rename(tempFilename, filename); err != nil {
+		_ = os.Remove(tempFilename)
+		return fmt.Errorf("could not write %s; %v", filename, err)
+	}
+
+	Logc(ctx).WithField("file", filename).Info("Wrote multipath blacklist exception for NetApp LUNs.")
+	journalHostOperation(ctx, log.InfoLevel, "Wrote multipath blacklist exception.", log.Fields{"file": filename})
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// multipathBlacklistExecutor simulates a host whose multipath configuration blacklists every WWID until multipathd
+// is reconfigured with an exception.
+type multipathBlacklistExecutor struct {
+	recordingExecutor
+	reconfigured bool
+}
+
+func (e *multipathBlacklistExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	switch {
+	case cmd.Name == "pgrep":
+		return []byte("42\n"), nil
+	case cmd.Name == "multipathd" && len(cmd.Args) > 0 && cmd.Args[0] == "reconfigure":
+		e.reconfigured = true
+	case cmd.Name == "multipath" && !e.reconfigured:
+		return []byte("Oct 15 10:00:00 | sdb: udev property ID_WWN whitelisted\n" +
+			"Oct 15 10:00:00 | sdb: wwid 3600a098038303634722b4d59614c6f42 blacklisted\n"), nil
+	}
+	return nil, nil
+}
+
+func TestResolveMultipathBlacklist(t *testing.T) {
+	log.Debug("Running TestResolveMultipathBlacklist...")
+
+	dir, err := ioutil.TempDir("", "TestResolveMultipathBlacklist")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for _, device := range []string{"sdb", "sdc"} {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block", device, "device"), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/block", device, "device/vendor"),
+			[]byte("NETAPP  \n"), 0644))
+	}
+
+	ctx := context.TODO()
+	devices := []string{"sdb", "sdc"}
+	conf := path.Join(dir, multipathConfDir, multipathBlacklistExceptionFile)
+
+	// Without remediation, the blacklisting is reported rather than degrading to a single path
+	executor := &multipathBlacklistExecutor{}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: executor}))
+	defer func() { _ = Init(Config{}) }()
+
+	resolved, err := resolveMultipathBlacklist(ctx, devices)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "wwid 3600a098038303634722b4d59614c6f42 blacklisted")
+	assert.False(t, resolved)
+	assert.NoFileExists(t, conf)
+
+	// With remediation, an exception is written and the multipath device appears once multipathd is reconfigured
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block/sdb/holders/dm-3"), 0755))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block/dm-3/dm"), 0755))
+	executor = &multipathBlacklistExecutor{}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: executor, RemediateMultipathBlacklist: true}))
+
+	resolved, err = resolveMultipathBlacklist(ctx, devices)
+	assert.NoError(t, err)
+	assert.True(t, resolved)
+	content, err := ioutil.ReadFile(conf)
+	assert.NoError(t, err)
+	assert.Equal(t, netappBlacklistExceptions, string(content))
+	assert.Contains(t, executor.commands, "multipathd reconfigure")
+	assert.Contains(t, executor.commands, "multipathd add path sdc")
+
+	// Devices that aren't blacklisted are left alone
+	resolved, err = resolveMultipathBlacklist(ctx, devices)
+	assert.NoError(t, err)
+	assert.False(t, resolved)
+
+	// Other vendors' LUNs aren't excepted
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/block/sdb/device/vendor"), []byte("OTHER\n"), 0644))
+	executor = &multipathBlacklistExecutor{}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: executor, RemediateMultipathBlacklist: true}))
+	_, err = resolveMultipathBlacklist(ctx, devices)
+	assert.Error(t, err)
+	assert.NotContains(t, executor.commands, "multipathd reconfigure")
+}
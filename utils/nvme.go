@@ -0,0 +1,471 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// An NVMe namespace is reached through the controllers of the subsystem that exports it, one controller for each
+// pair of local and remote FC ports connected.  Subsystems are listed in /sys/class/nvme-subsystem, each linking to
+// its controllers.  With the kernel's native NVMe multipathing, a namespace is one disk, such as nvme0n1, listed in
+// its subsystem's directory, whose paths through each controller are hidden disks like nvme0c1n1.  Without it,
+// each controller presents its own disk for the namespace, listed in the controller's directory, and dm-multipath
+// combines them as it does the paths of a SCSI LUN.
+
+const (
+	nvmeSubsystemClassDir = "/sys/class/nvme-subsystem"
+	nvmeTimeoutSecs       = 30
+)
+
+var (
+	nvmeControllerRegex = regexp.MustCompile(`^nvme[0-9]+$`)
+	nvmeNamespaceRegex  = regexp.MustCompile(`^nvme[0-9]+n[0-9]+$`)
+)
+
+// nvmeFCPath is a pair of local and remote FC ports, by their addresses, through which an NVMe subsystem may be
+// connected to.
+type nvmeFCPath struct {
+	HostTraddr string
+	Traddr     string
+}
+
+// AttachNVMeVolume attaches an NVMe namespace over Fibre Channel.  The node connects to the namespace's subsystem
+// through each FC path to it, waits for the namespace's disk, and then formats and mounts it as an iSCSI LUN would
+// be.  The device path is set on the in-out publishInfo parameter so that it may be mounted later instead.
+func AttachNVMeVolume(ctx context.Context, name, mountpoint string, publishInfo *VolumePublishInfo) (err error) {
+
+	ctx = WithLogFields(ctx, log.Fields{
+		LogFieldVolume:  name,
+		"subsystemNQN":  publishInfo.NVMeSubsystemNQN,
+		"namespaceUUID": publishInfo.NVMeNamespaceUUID,
+	})
+
+	Logc(ctx).Debug(">>>> nvme.AttachNVMeVolume")
+	defer Logc(ctx).Debug("<<<< nvme.AttachNVMeVolume")
+	defer func() { journalHostOutcome(ctx, "Attach of NVMe volume", err) }()
+
+	if !publishInfo.IsNVMe() || publishInfo.NVMeNamespaceUUID == "" {
+		return fmt.Errorf("volume %s has no NVMe subsystem NQN and namespace UUID", name)
+	}
+	if capability := checkCapability(ctx, CapabilityNVMeFC); !capability.Supported {
+		return fmt.Errorf("unable to attach: FC-NVMe not supported on host; %s", capability.Diagnostics)
+	}
+
+	latency := &AttachLatency{}
+	publishInfo.AttachLatency = latency
+	attachStart := time.Now()
+	defer func() {
+		latency.Total = time.Since(attachStart)
+		logSlowAttach(ctx, name, latency)
+	}()
+
+	stage := startAttachStage(ctx, "login")
+	err = connectNVMeFCSubsystem(ctx, publishInfo.NVMeAccessInfo)
+	latency.Login = stage.end()
+	if err != nil {
+		return err
+	}
+
+	stage = startAttachStage(ctx, "scanWait")
+	deviceToUse, err := waitForNVMeNamespace(ctx, publishInfo.NVMeAccessInfo)
+	latency.ScanWait = stage.end()
+	if err != nil {
+		return err
+	}
+
+	devicePath := "/dev/" + deviceToUse
+	if isMultipathDevice(deviceToUse) {
+		devicePath = getMultipathDevicePath(ctx, deviceToUse)
+	}
+	if err = waitForDevice(ctx, devicePath); err != nil {
+		return fmt.Errorf("could not find device %v; %s", devicePath, err)
+	}
+
+	if publishInfo.VolumeSize > 0 && !disableDeviceSizeCheck {
+		if err = verifyDeviceSize(ctx, devicePath, publishInfo.VolumeSize); err != nil {
+			return err
+		}
+	}
+
+	skipFSCheck := publishInfo.MultiAttach && multiAttachPolicy == MultiAttachPolicySkip
+	var existingFstype string
+	if publishInfo.FilesystemType != fsRaw && !skipFSCheck {
+		stage = startAttachStage(ctx, "blkid")
+		existingFstype, err = getFSType(ctx, "/dev/"+deviceToUse)
+		latency.Blkid = stage.end()
+		if err != nil {
+			return fmt.Errorf("could not get filesystem type of device %s; %v", deviceToUse, err)
+		}
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"device": deviceToUse,
+		"fsType": existingFstype,
+	}).Debug("Found NVMe namespace.")
+
+	// Return the device in the publish info in case the mount will be done later
+	publishInfo.DevicePath = devicePath
+	publishInfo.SupportsDiscard = deviceSupportsDiscard(ctx, deviceToUse)
+
+	if publishInfo.MultiAttach && fencingHook != nil {
+		if err = fencingHook.Register(ctx, devicePath, publishInfo); err != nil {
+			return fmt.Errorf("could not fence namespace %s, device %s; %v", name, deviceToUse, err)
+		}
+	}
+
+	return setUpAttachedDevice(ctx, name, mountpoint, devicePath, deviceToUse, existingFstype, skipFSCheck,
+		publishInfo)
+}
+
+// DetachNVMeVolume flushes the device of an NVMe namespace that is no longer mounted, and disconnects this node
+// from the namespace's subsystem unless the subsystem presents other namespaces to it, which other volumes may be
+// using.  The namespace itself is left for the storage to unmap.
+func DetachNVMeVolume(ctx context.Context, publishInfo *VolumePublishInfo) (err error) {
+
+	ctx = WithLogFields(ctx, log.Fields{
+		"subsystemNQN":  publishInfo.NVMeSubsystemNQN,
+		"namespaceUUID": publishInfo.NVMeNamespaceUUID,
+	})
+
+	Logc(ctx).Debug(">>>> nvme.DetachNVMeVolume")
+	defer Logc(ctx).Debug("<<<< nvme.DetachNVMeVolume")
+	defer func() { journalHostOutcome(ctx, "Detach of NVMe volume", err) }()
+
+	if publishInfo.DevicePath != "" {
+		device := publishInfo.DevicePath
+		if resolved, err := filepath.EvalSymlinks(chrootPathPrefix + device); err == nil {
+			device = path.Base(resolved)
+		}
+		if isMultipathDevice(device) {
+			err = multipathFlushDevice(ctx, &ScsiDeviceInfo{MultipathDevice: device}, false)
+		} else {
+			err = flushOneDevice(ctx, publishInfo.DevicePath)
+		}
+		if err != nil {
+			return fmt.Errorf("could not flush device %s; %v", publishInfo.DevicePath, err)
+		}
+	}
+
+	namespaces, err := findNVMeNamespaceDisks(ctx, publishInfo.NVMeSubsystemNQN, "")
+	if err != nil {
+		return err
+	}
+	others := make([]string, 0)
+	for _, disk := range namespaces {
+		uuid, err := readNVMeNamespaceUUID(ctx, disk.dir)
+		if err != nil || uuid != strings.ToLower(publishInfo.NVMeNamespaceUUID) {
+			others = append(others, disk.name)
+		}
+	}
+	if len(others) > 0 {
+		Logc(ctx).WithField("namespaces", others).Debug("Subsystem presents other namespaces, staying connected.")
+		return nil
+	}
+
+	if _, err = execCommandWithTimeout(ctx, "nvme", nvmeTimeoutSecs, true, "disconnect", "-n",
+		publishInfo.NVMeSubsystemNQN); err != nil {
+		return fmt.Errorf("could not disconnect from NVMe subsystem %s; %v", publishInfo.NVMeSubsystemNQN, err)
+	}
+	return nil
+}
+
+// connectNVMeFCSubsystem connects this node to an NVMe subsystem through each pair of online local and remote FC
+// ports not already connected.  Connections fail through remote ports that don't export the subsystem, so it's
+// enough that one succeeds, or that the subsystem was already connected through one.
+func connectNVMeFCSubsystem(ctx context.Context, info NVMeAccessInfo) error {
+
+	paths, err := discoverNVMeFCPaths(ctx, info.NVMeTargetPorts)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return errors.New("no online FC path to an NVMe target port")
+	}
+
+	controllers, err := getNVMeFCControllers(ctx, info.NVMeSubsystemNQN)
+	if err != nil {
+		return err
+	}
+
+	connected := 0
+	var connectErr error
+	for _, fcPath := range paths {
+		fields := log.Fields{"hostTraddr": fcPath.HostTraddr, "traddr": fcPath.Traddr}
+
+		// The kernel reconnects controllers that have lost their connection, and refuses another to the same ports
+		if state, ok := controllers[fcPath]; ok {
+			Logc(ctx).WithFields(fields).WithField("state", state).Debug("NVMe subsystem already connected.")
+			if state == "live" {
+				connected++
+			}
+			continue
+		}
+
+		if _, err = execCommandWithTimeout(ctx, "nvme", nvmeTimeoutSecs, true, "connect", "-t", "fc",
+			"-a", fcPath.Traddr, "-w", fcPath.HostTraddr, "-n", info.NVMeSubsystemNQN); err != nil {
+			Logc(ctx).WithFields(fields).WithError(err).Debug("Could not connect to NVMe subsystem.")
+			connectErr = err
+			continue
+		}
+		Logc(ctx).WithFields(fields).Info("Connected to NVMe subsystem.")
+		connected++
+	}
+
+	if connected == 0 {
+		return fmt.Errorf("could not connect to NVMe subsystem %s through any of %d FC paths; %v",
+			info.NVMeSubsystemNQN, len(paths), connectErr)
+	}
+	return nil
+}
+
+// discoverNVMeFCPaths returns a path through each online NVMe target port that an online FC host of this node is
+// logged in to, limited to the target ports given, if any.
+func discoverNVMeFCPaths(ctx context.Context, targetPorts []string) ([]nvmeFCPath, error) {
+
+	hosts, err := listFCHosts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list FC hosts; %v", err)
+	}
+	rports, err := listFCRemotePorts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list FC remote ports; %v", err)
+	}
+
+	onlineHosts := make(map[string]fcPort)
+	for _, host := range hosts {
+		if host.online() {
+			onlineHosts[host.Name] = host
+		}
+	}
+
+	targetPorts = lowerStrings(targetPorts)
+	paths := make([]nvmeFCPath, 0)
+	for _, rport := range rports {
+		host, ok := onlineHosts[rport.Host]
+		if !ok || !rport.online() || !rport.hasRole(fcRoleNVMeTarget) {
+			continue
+		}
+		if len(targetPorts) > 0 && !StringInSlice(rport.address(), targetPorts) {
+			continue
+		}
+		paths = append(paths, nvmeFCPath{HostTraddr: host.address(), Traddr: rport.address()})
+	}
+
+	Logc(ctx).WithField("paths", paths).Debug("Discovered NVMe FC paths.")
+	return paths, nil
+}
+
+// lowerStrings returns the strings in lower case.
+func lowerStrings(values []string) []string {
+	lowered := make([]string, 0, len(values))
+	for _, value := range values {
+		lowered = append(lowered, strings.ToLower(strings.TrimSpace(value)))
+	}
+	return lowered
+}
+
+// getNVMeFCControllers returns the state, such as "live" or "connecting", of each FC controller of an NVMe
+// subsystem, by the path it connects through.
+func getNVMeFCControllers(ctx context.Context, nqn string) (map[nvmeFCPath]string, error) {
+
+	subsystems, err := findNVMeSubsystems(ctx, nqn)
+	if err != nil {
+		return nil, err
+	}
+
+	controllers := make(map[nvmeFCPath]string)
+	for _, subsystem := range subsystems {
+		entries, err := ioutil.ReadDir(subsystem)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !nvmeControllerRegex.MatchString(entry.Name()) {
+				continue
+			}
+			dir := path.Join(subsystem, entry.Name())
+			if transport, _ := readNVMeAttribute(ctx, dir, "transport"); transport != "fc" {
+				continue
+			}
+			address, _ := readNVMeAttribute(ctx, dir, "address")
+			state, _ := readNVMeAttribute(ctx, dir, "state")
+			controllers[parseNVMeFCAddress(address)] = state
+		}
+	}
+	return controllers, nil
+}
+
+// parseNVMeFCAddress parses the address of an FC controller, as "traddr=nn-0x...:pn-0x...,host_traddr=nn-0x...".
+func parseNVMeFCAddress(address string) nvmeFCPath {
+	var fcPath nvmeFCPath
+	for _, field := range strings.Split(address, ",") {
+		keyValue := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		switch keyValue[0] {
+		case "traddr":
+			fcPath.Traddr = strings.ToLower(keyValue[1])
+		case "host_traddr":
+			fcPath.HostTraddr = strings.ToLower(keyValue[1])
+		}
+	}
+	return fcPath
+}
+
+// findNVMeSubsystems returns the sysfs directories of the subsystems with an NQN.  A subsystem is normally listed
+// once, but is listed again for each connection made while native multipathing is off.
+func findNVMeSubsystems(ctx context.Context, nqn string) ([]string, error) {
+
+	entries, err := ioutil.ReadDir(chrootPathPrefix + nvmeSubsystemClassDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	subsystems := make([]string, 0)
+	for _, entry := range entries {
+		dir := path.Join(chrootPathPrefix+nvmeSubsystemClassDir, entry.Name())
+		if subsystemNQN, err := readNVMeAttribute(ctx, dir, "subsysnqn"); err == nil && subsystemNQN == nqn {
+			subsystems = append(subsystems, dir)
+		}
+	}
+	return subsystems, nil
+}
+
+// nvmeNamespaceDisk is the disk of a namespace, by name and sysfs directory.
+type nvmeNamespaceDisk struct {
+	name string
+	dir  string
+}
+
+// findNVMeNamespaceDisks returns the disks of a subsystem's namespaces, or of one namespace if its UUID is given:
+// with native multipathing, one disk for each namespace, listed under the subsystem, and otherwise a disk for each
+// namespace listed under each of the subsystem's controllers.
+func findNVMeNamespaceDisks(ctx context.Context, nqn, uuid string) ([]nvmeNamespaceDisk, error) {
+
+	subsystems, err := findNVMeSubsystems(ctx, nqn)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]nvmeNamespaceDisk, 0)
+	for _, subsystem := range subsystems {
+		entries, err := ioutil.ReadDir(subsystem)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			dir := path.Join(subsystem, entry.Name())
+			switch {
+			case nvmeNamespaceRegex.MatchString(entry.Name()):
+				candidates = append(candidates, nvmeNamespaceDisk{name: entry.Name(), dir: dir})
+			case nvmeControllerRegex.MatchString(entry.Name()):
+				controllerEntries, err := ioutil.ReadDir(dir)
+				if err != nil {
+					continue
+				}
+				for _, controllerEntry := range controllerEntries {
+					if nvmeNamespaceRegex.MatchString(controllerEntry.Name()) {
+						candidates = append(candidates, nvmeNamespaceDisk{
+							name: controllerEntry.Name(),
+							dir:  path.Join(dir, controllerEntry.Name()),
+						})
+					}
+				}
+			}
+		}
+	}
+
+	disks := make([]nvmeNamespaceDisk, 0)
+	for _, candidate := range candidates {
+		if uuid != "" {
+			if diskUUID, err := readNVMeNamespaceUUID(ctx, candidate.dir); err != nil || diskUUID != uuid {
+				continue
+			}
+		}
+		disks = append(disks, candidate)
+	}
+	return disks, nil
+}
+
+// readNVMeNamespaceUUID returns the UUID of a namespace from its disk's sysfs directory.
+func readNVMeNamespaceUUID(ctx context.Context, dir string) (string, error) {
+	uuid, err := readNVMeAttribute(ctx, dir, "uuid")
+	return strings.ToLower(uuid), err
+}
+
+// readNVMeAttribute reads an attribute of an NVMe subsystem, controller or namespace from its sysfs directory.
+func readNVMeAttribute(ctx context.Context, dir, attribute string) (string, error) {
+	content, err := readFileWithTimeout(ctx, path.Join(dir, attribute))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// findNVMeNamespace returns the kernel name of the disk of an NVMe namespace, or of the multipath device holding
+// its disks if native multipathing is off.  An error is returned unless the disks found all belong to exactly one
+// device.
+func findNVMeNamespace(ctx context.Context, info NVMeAccessInfo) (string, error) {
+
+	disks, err := findNVMeNamespaceDisks(ctx, info.NVMeSubsystemNQN, strings.ToLower(info.NVMeNamespaceUUID))
+	if err != nil {
+		return "", err
+	}
+	if len(disks) == 0 {
+		return "", fmt.Errorf("NVMe subsystem %s presents no namespace with UUID %s", info.NVMeSubsystemNQN,
+			info.NVMeNamespaceUUID)
+	}
+
+	names := make([]string, 0, len(disks))
+	for _, disk := range disks {
+		names = append(names, disk.name)
+	}
+	devices := combineMultipathDisks(ctx, names)
+	if len(devices) > 1 {
+		return "", fmt.Errorf("disks %v are all of NVMe namespace %s but aren't paths of one multipath device",
+			names, info.NVMeNamespaceUUID)
+	}
+	return devices[0], nil
+}
+
+// waitForNVMeNamespace waits for the disk of an NVMe namespace, which appears shortly after the subsystem is
+// connected to, and returns its kernel name.
+func waitForNVMeNamespace(ctx context.Context, info NVMeAccessInfo) (string, error) {
+
+	var device string
+	findDevice := func() (err error) {
+		device, err = findNVMeNamespace(ctx, info)
+		return err
+	}
+	findNotify := func(err error, duration time.Duration) {
+		Logc(ctx).WithField("increment", duration).WithError(err).Debug("NVMe namespace not found yet.")
+	}
+
+	findBackoff := newExponentialBackOff()
+	findBackoff.InitialInterval = 1 * time.Second
+	findBackoff.Multiplier = 1.414 // approx sqrt(2)
+	findBackoff.RandomizationFactor = 0.1
+	findBackoff.MaxElapsedTime = multipathDeviceDiscoveryTimeoutSecs * time.Second
+
+	if err := retryNotify(findDevice, findBackoff, findNotify); err != nil {
+		return "", err
+	}
+	return device, nil
+}
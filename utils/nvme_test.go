@@ -0,0 +1,173 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testNVMeNQN      = "nqn.1992-08.com.netapp:sn.0123:subsystem.node1"
+	testNVMeHostPort = "nn-0x20000090fa942779:pn-0x10000090fa942779"
+	testNVMeTarget1  = "nn-0x2004d039ea1c7b6a:pn-0x2005d039ea1c7b6a"
+	testNVMeTarget2  = "nn-0x2004d039ea1c7b6a:pn-0x2006d039ea1c7b6a"
+)
+
+// makeNVMeFCHost creates an online FC host seeing two NVMe target ports and an FCP target port, and a subsystem
+// connected through the first of them, in a fake sysfs.
+func makeNVMeFCHost(t *testing.T, dir string) {
+
+	writeFile := func(name, content string) {
+		assert.NoError(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644))
+	}
+
+	writeFile("sys/class/fc_host/host3/node_name", "0x20000090FA942779\n")
+	writeFile("sys/class/fc_host/host3/port_name", "0x10000090FA942779\n")
+	writeFile("sys/class/fc_host/host3/port_state", "Online\n")
+	for rport, port := range map[string]string{"rport-3:0-1": "2005", "rport-3:0-2": "2006", "rport-3:0-3": "2007"} {
+		writeFile("sys/class/fc_remote_ports/"+rport+"/node_name", "0x2004d039ea1c7b6a\n")
+		writeFile("sys/class/fc_remote_ports/"+rport+"/port_name", "0x"+port+"d039ea1c7b6a\n")
+		writeFile("sys/class/fc_remote_ports/"+rport+"/port_state", "Online\n")
+		writeFile("sys/class/fc_remote_ports/"+rport+"/roles", "NVMe Target, NVMe Discovery\n")
+	}
+	writeFile("sys/class/fc_remote_ports/rport-3:0-3/roles", "FCP Target\n")
+
+	subsystem := "sys/class/nvme-subsystem/nvme-subsys0/"
+	writeFile(subsystem+"subsysnqn", testNVMeNQN+"\n")
+	writeFile(subsystem+"nvme0/transport", "fc\n")
+	writeFile(subsystem+"nvme0/address", "traddr="+testNVMeTarget1+",host_traddr="+testNVMeHostPort+"\n")
+	writeFile(subsystem+"nvme0/state", "live\n")
+}
+
+func TestDiscoverNVMeFCPaths(t *testing.T) {
+	log.Debug("Running TestDiscoverNVMeFCPaths...")
+
+	dir, err := ioutil.TempDir("", "TestDiscoverNVMeFCPaths")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	// No FC driver, no paths
+	paths, err := discoverNVMeFCPaths(context.TODO(), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, paths)
+
+	// Only online NVMe target ports seen by online hosts are used, limited to the target ports given
+	makeNVMeFCHost(t, dir)
+	paths, err = discoverNVMeFCPaths(context.TODO(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []nvmeFCPath{
+		{HostTraddr: testNVMeHostPort, Traddr: testNVMeTarget1},
+		{HostTraddr: testNVMeHostPort, Traddr: testNVMeTarget2},
+	}, paths)
+
+	paths, err = discoverNVMeFCPaths(context.TODO(), []string{"NN-0x2004D039EA1C7B6A:PN-0x2006D039EA1C7B6A"})
+	assert.NoError(t, err)
+	assert.Equal(t, []nvmeFCPath{{HostTraddr: testNVMeHostPort, Traddr: testNVMeTarget2}}, paths)
+
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/class/fc_host/host3/port_state"), []byte("Linkdown\n"),
+		0644))
+	paths, err = discoverNVMeFCPaths(context.TODO(), nil)
+	assert.NoError(t, err)
+	assert.Empty(t, paths)
+}
+
+func TestConnectNVMeFCSubsystem(t *testing.T) {
+	log.Debug("Running TestConnectNVMeFCSubsystem...")
+
+	dir, err := ioutil.TempDir("", "TestConnectNVMeFCSubsystem")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: recorder}))
+	defer func() { _ = Init(Config{}) }()
+
+	assert.Error(t, connectNVMeFCSubsystem(context.TODO(), NVMeAccessInfo{NVMeSubsystemNQN: testNVMeNQN}))
+
+	// Only the path not yet connected is connected
+	makeNVMeFCHost(t, dir)
+	assert.NoError(t, connectNVMeFCSubsystem(context.TODO(), NVMeAccessInfo{NVMeSubsystemNQN: testNVMeNQN}))
+	assert.Equal(t, []string{
+		"nvme connect -t fc -a " + testNVMeTarget2 + " -w " + testNVMeHostPort + " -n " + testNVMeNQN,
+	}, recorder.commands)
+}
+
+func TestFindNVMeNamespace(t *testing.T) {
+	log.Debug("Running TestFindNVMeNamespace...")
+
+	dir, err := ioutil.TempDir("", "TestFindNVMeNamespace")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: recorder}))
+	defer func() { _ = Init(Config{}) }()
+
+	writeFile := func(name, content string) {
+		assert.NoError(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644))
+	}
+	makeNVMeFCHost(t, dir)
+	subsystem := "sys/class/nvme-subsystem/nvme-subsys0/"
+	info := NVMeAccessInfo{
+		NVMeSubsystemNQN:  testNVMeNQN,
+		NVMeNamespaceUUID: "C2D1A4E2-5B8E-4D3A-9C31-8F6A0B1E2D3C",
+	}
+
+	_, err = findNVMeNamespace(context.TODO(), info)
+	assert.Error(t, err)
+
+	// With native multipathing, the namespace is one disk under the subsystem, and its paths are hidden
+	writeFile(subsystem+"nvme0n1/uuid", "c2d1a4e2-5b8e-4d3a-9c31-8f6a0b1e2d3c\n")
+	writeFile(subsystem+"nvme0n2/uuid", "0f4e6c1a-2b3d-4e5f-8a9b-0c1d2e3f4a5b\n")
+	writeFile(subsystem+"nvme0/nvme0c0n1/uuid", "c2d1a4e2-5b8e-4d3a-9c31-8f6a0b1e2d3c\n")
+	device, err := findNVMeNamespace(context.TODO(), info)
+	assert.NoError(t, err)
+	assert.Equal(t, "nvme0n1", device)
+
+	// The subsystem stays connected while it presents another namespace
+	assert.NoError(t, DetachNVMeVolume(context.TODO(), &VolumePublishInfo{
+		VolumeAccessInfo: VolumeAccessInfo{NVMeAccessInfo: info},
+	}))
+	assert.Empty(t, recorder.commands)
+	assert.NoError(t, os.RemoveAll(path.Join(dir, subsystem+"nvme0n2")))
+	assert.NoError(t, DetachNVMeVolume(context.TODO(), &VolumePublishInfo{
+		VolumeAccessInfo: VolumeAccessInfo{NVMeAccessInfo: info},
+	}))
+	assert.Equal(t, []string{"nvme disconnect -n " + testNVMeNQN}, recorder.commands)
+
+	// Without it, each controller presents a disk, which must have been combined by multipath
+	assert.NoError(t, os.RemoveAll(path.Join(dir, subsystem+"nvme0n1")))
+	writeFile(subsystem+"nvme0/nvme0n1/uuid", "c2d1a4e2-5b8e-4d3a-9c31-8f6a0b1e2d3c\n")
+	writeFile(subsystem+"nvme1/nvme1n1/uuid", "c2d1a4e2-5b8e-4d3a-9c31-8f6a0b1e2d3c\n")
+	_, err = findNVMeNamespace(context.TODO(), info)
+	assert.Error(t, err)
+
+	for _, disk := range []string{"nvme0n1", "nvme1n1"} {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block", disk, "holders/dm-2"), 0755))
+	}
+	writeFile("sys/block/dm-2/dm/uuid", "mpath-eui.00a1b2c3d4e5f6070a0b0c0d0e0f1011\n")
+	device, err = findNVMeNamespace(context.TODO(), info)
+	assert.NoError(t, err)
+	assert.Equal(t, "dm-2", device)
+}
+
+func TestParseNVMeFCAddress(t *testing.T) {
+	log.Debug("Running TestParseNVMeFCAddress...")
+
+	assert.Equal(t, nvmeFCPath{HostTraddr: testNVMeHostPort, Traddr: testNVMeTarget1},
+		parseNVMeFCAddress("traddr="+testNVMeTarget1+",host_traddr="+testNVMeHostPort))
+	assert.Equal(t, nvmeFCPath{Traddr: testNVMeTarget1}, parseNVMeFCAddress("TRADDR=x,traddr="+testNVMeTarget1))
+	assert.Equal(t, nvmeFCPath{}, parseNVMeFCAddress(""))
+}
@@ -5,6 +5,7 @@ package utils
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -18,52 +19,386 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/cenkalti/backoff/v4"
 	log "github.com/sirupsen/logrus"
 
 	. "github.com/netapp/trident/logger"
+	"github.com/netapp/trident/utils/iscsi"
+	"github.com/netapp/trident/utils/mount"
 )
 
 const (
+	iSCSIErrFatalLogin                  = 19
 	iSCSIErrNoObjsFound                 = 21
 	iSCSIDeviceDiscoveryTimeoutSecs     = 90
 	multipathDeviceDiscoveryTimeoutSecs = 90
 	resourceDeletionTimeoutSecs         = 40
+	targetMigrationJoinTimeoutSecs      = 60
+	deviceSizeMismatchDelta             = 50000000 // 50mb
 	fsRaw                               = "raw"
-	temporaryMountDir                   = "/tmp_mnt"
 	unknownFstype                       = "<unknown>"
 )
 
-var xtermControlRegex = regexp.MustCompile(`\x1B\[[0-9;]*[a-zA-Z]`)
-var portalPortPattern = regexp.MustCompile(`.+:\d+$`)
+var xtermControlRegex = regexp.MustCompile(`\x1B(\[[0-9;?]*[ -/]*[@-~]|\][^\x07\x1B]*(\x07|\x1B\\)|[@-_])`)
+var controlCharRegex = regexp.MustCompile(`[\x00-\x08\x0B-\x1F\x7F]`)
 var pidRunningOrIdleRegex = regexp.MustCompile(`pid \d+ (running|idle)`)
 var pidRegex = regexp.MustCompile(`^\d+$`)
 var chrootPathPrefix string
+var deviceReadTimeout = defaultDeviceReadTimeout
+var slowAttachThreshold = defaultSlowAttachThreshold
+var formatPolicy = FormatPolicy{ProgressInterval: defaultFormatProgressInterval}
+
+var attachLimits AttachLimits
+
+var sessionMonitorInterval time.Duration
+
+// allDevicesScanWait and anyDeviceScanWait bound how long to wait for every path to a LUN to appear after a
+// scan, then for any path to appear
+var allDevicesScanWait = 5 * time.Second
+var anyDeviceScanWait = (iSCSIDeviceDiscoveryTimeoutSecs - 5) * time.Second
+
+// autoScanWait bounds how long to wait, polling every autoScanPollInterval, for the initiator's own scan to find
+// a LUN under automatic scanning before scanning for it
+var autoScanWait = 3 * time.Second
+var autoScanPollInterval = 500 * time.Millisecond
+
+var recoverHostServices bool
+var regenerateInitiatorIQN bool
+var disableNativeFilesystemResize bool
+var disableDeviceSizeCheck bool
+var disablePortalReachabilityCheck bool
+var storageCIDRs []*net.IPNet
+var logFullCommandOutput bool
+
+const (
+	dockerPluginHostRoot          = "/host"
+	defaultDeviceReadTimeout      = 10 * time.Second
+	defaultSlowAttachThreshold    = 30 * time.Second
+	defaultFormatProgressInterval = 30 * time.Second
+	defaultUnmountGracePeriod     = 5 * time.Second
+	iSCSIDeviceSnapshotMaxAge     = time.Second
+	commandOutputLogHead          = 2048
+	commandOutputLogTail          = 2048
+)
+
+// Config controls how this package interacts with the host.  Zero values select the defaults.
+type Config struct {
+	// HostRoot is the path at which the host's root filesystem is visible, if other than "/"
+	HostRoot string
+	// DockerPluginMode indicates running as a Docker managed plugin, which sees the host's root filesystem at
+	// /host unless HostRoot says otherwise
+	DockerPluginMode bool
+	// DeviceReadTimeout bounds reads of device and sysfs files that can hang on a dead path
+	DeviceReadTimeout time.Duration
+	// MultipathPolicy is applied when a LUN is left with a single path despite multipathd running
+	MultipathPolicy MultipathPolicy
+	// NoPathQueueingPolicy decides whether a detach may disable queueing on a multipath device with no working paths
+	NoPathQueueingPolicy NoPathQueueingPolicy
+	// ISCSILoginPolicy bounds iSCSI portal logins
+	ISCSILoginPolicy ISCSILoginPolicy
+	// ISCSIScanPolicy controls whether the initiator scans targets for LUNs itself or leaves it to this package
+	ISCSIScanPolicy ISCSIScanPolicy
+	// ISCSIInterfaces defines iscsiadm interfaces, by name, to be created if a volume uses one that doesn't exist
+	ISCSIInterfaces map[string]ISCSIInterface
+	// TemporaryMountDir is where filesystems are mounted temporarily to grow them, each at a uniquely named
+	// mountpoint; a relative path names mountpoints beneath each volume's staging path, and empty selects tmp_mnt
+	TemporaryMountDir string
+	// DisableNativeFilesystemResize always grows filesystems with the resize utilities rather than ioctls
+	DisableNativeFilesystemResize bool
+	// DisableDeviceSizeCheck skips verifying that an attached LUN is at least the expected volume size
+	DisableDeviceSizeCheck bool
+	// DisablePortalReachabilityCheck logs in to every iSCSI portal, even those this host has no route toward
+	DisablePortalReachabilityCheck bool
+	// StorageCIDRs are storage networks this host reaches through a gateway; a portal elsewhere is considered
+	// reachable only if the host is attached to its subnet
+	StorageCIDRs []string
+	// FormatPolicy controls how new filesystems are created
+	FormatPolicy FormatPolicy
+	// UUIDConflictPolicy is applied when an attached filesystem has the same UUID as a mounted one
+	UUIDConflictPolicy UUIDConflictPolicy
+	// MultiAttachPolicy controls how the filesystem on a LUN attached to more than one node is checked
+	MultiAttachPolicy MultiAttachPolicy
+	// ForceZpoolImport imports zpools still marked as in use by another host, as one that died, which is safe only
+	// if the storage never maps a LUN to more than one node at a time
+	ForceZpoolImport bool
+	// FilesystemMismatchPolicy is applied when an attached LUN has a filesystem of another type than requested
+	FilesystemMismatchPolicy FilesystemMismatchPolicy
+	// RequireFilesystemMarker refuses to use a filesystem found on an attached LUN unless Trident created it
+	RequireFilesystemMarker bool
+	// FencingHook fences LUNs attached to more than one node; nil leaves them unfenced
+	FencingHook FencingHook
+	// DetachFencer decides whether a detach stuck on pending I/O may be forced once this node is fenced; nil
+	// leaves such detaches to be retried
+	DetachFencer DetachFencer
+	// DefaultMountOptions maps filesystem types to comma-separated mount options that apply unless overridden
+	DefaultMountOptions map[string]string
+	// SlowAttachThreshold is the attach duration above which a per-stage latency breakdown is logged
+	SlowAttachThreshold time.Duration
+	// AttachLimits are the per-node maximums beyond which attaches are refused
+	AttachLimits AttachLimits
+	// SessionMonitorInterval is how often the iSCSI session monitor checks session health; zero disables it
+	SessionMonitorInterval time.Duration
+	// RecoverHostServices starts enabled host services, such as iscsid and multipathd, found not running when needed
+	RecoverHostServices bool
+	// RemediateMultipathBlacklist adds a multipath blacklist exception for NetApp LUNs found blacklisted by the host
+	RemediateMultipathBlacklist bool
+	// RegenerateInitiatorIQN allows replacing the host's iSCSI initiator name if it's a default or a duplicate
+	RegenerateInitiatorIQN bool
+	// NFSLockPolicy is applied when an NFSv3 volume is mounted with locking but rpc.statd isn't working
+	NFSLockPolicy NFSLockPolicy
+	// UnmountPolicy controls escalation when a filesystem can't be unmounted because processes are using it
+	UnmountPolicy UnmountPolicy
+	// TrimPolicy controls the background scheduler that trims tracked mounts; its zero value disables it
+	TrimPolicy TrimPolicy
+	// MountReconcilePolicy controls the reconciler that remounts tracked mounts whose options have drifted
+	MountReconcilePolicy MountReconcilePolicy
+	// UdevRulesPolicy controls the host udev rules that tune NetApp LUNs' devices; its zero value removes them
+	UdevRulesPolicy UdevRulesPolicy
+	// HostOperationPolicy bounds how many host operations, such as attaches and detaches, run at once
+	HostOperationPolicy HostOperationPolicy
+	// LogFullCommandOutput logs the whole output of external commands instead of just its head and tail
+	LogFullCommandOutput bool
+	// LogToHostJournal also records commands run on the host, and attach and detach outcomes, in the host's journal
+	LogToHostJournal bool
+	// HostResolutionPolicy controls how hostnames naming iSCSI portals and NFS servers are resolved
+	HostResolutionPolicy HostResolutionPolicy
+	// HostResolver looks up hostnames; nil selects the system resolver
+	HostResolver HostResolver
+	// Logger receives log output for contexts that don't carry their own logger; nil leaves it unchanged
+	Logger *log.Logger
+	// Executor runs external commands; nil selects one that runs them on the host
+	Executor Executor
+	// Clock times the waits between retries; nil selects the wall clock
+	Clock Clock
+}
+
+// Init configures this package.  It should be called once at startup, before any volumes are attached, and
+// overrides everything detected from the environment at import time.
+func Init(config Config) error {
+
+	if config.DeviceReadTimeout < 0 {
+		return fmt.Errorf("invalid device read timeout: %v", config.DeviceReadTimeout)
+	} else if config.DeviceReadTimeout == 0 {
+		config.DeviceReadTimeout = defaultDeviceReadTimeout
+	}
+	if config.UUIDConflictPolicy == "" {
+		config.UUIDConflictPolicy = UUIDConflictPolicyNoUUID
+	} else if err := validateUUIDConflictPolicy(config.UUIDConflictPolicy); err != nil {
+		return err
+	}
+	if config.MultiAttachPolicy == "" {
+		config.MultiAttachPolicy = MultiAttachPolicyVerify
+	} else if err := validateMultiAttachPolicy(config.MultiAttachPolicy); err != nil {
+		return err
+	}
+	if config.FilesystemMismatchPolicy == "" {
+		config.FilesystemMismatchPolicy = FilesystemMismatchPolicyFail
+	} else if err := validateFilesystemMismatchPolicy(config.FilesystemMismatchPolicy); err != nil {
+		return err
+	}
+	if config.FormatPolicy.Timeout < 0 {
+		return fmt.Errorf("invalid format timeout: %v", config.FormatPolicy.Timeout)
+	}
+	if config.FormatPolicy.ProgressInterval < 0 {
+		return fmt.Errorf("invalid format progress interval: %v", config.FormatPolicy.ProgressInterval)
+	} else if config.FormatPolicy.ProgressInterval == 0 {
+		config.FormatPolicy.ProgressInterval = defaultFormatProgressInterval
+	}
+	if config.SlowAttachThreshold < 0 {
+		return fmt.Errorf("invalid slow attach threshold: %v", config.SlowAttachThreshold)
+	} else if config.SlowAttachThreshold == 0 {
+		config.SlowAttachThreshold = defaultSlowAttachThreshold
+	}
+	if config.NFSLockPolicy == "" {
+		config.NFSLockPolicy = NFSLockPolicyIgnore
+	} else if err := validateNFSLockPolicy(config.NFSLockPolicy); err != nil {
+		return err
+	}
+	if config.UnmountPolicy.TerminateGracePeriod < 0 {
+		return fmt.Errorf("invalid unmount terminate grace period: %v", config.UnmountPolicy.TerminateGracePeriod)
+	} else if config.UnmountPolicy.TerminateGracePeriod == 0 {
+		config.UnmountPolicy.TerminateGracePeriod = defaultUnmountGracePeriod
+	}
+	if config.MultipathPolicy == "" {
+		config.MultipathPolicy = MultipathPolicyDegraded
+	} else if err := validateMultipathPolicy(config.MultipathPolicy); err != nil {
+		return err
+	}
+	if config.NoPathQueueingPolicy == "" {
+		config.NoPathQueueingPolicy = NoPathQueueingPolicyKeep
+	} else if err := validateNoPathQueueingPolicy(config.NoPathQueueingPolicy); err != nil {
+		return err
+	}
+	if config.ISCSILoginPolicy == (ISCSILoginPolicy{}) {
+		config.ISCSILoginPolicy = defaultISCSILoginPolicy
+	} else if err := validateISCSILoginPolicy(config.ISCSILoginPolicy); err != nil {
+		return err
+	}
+	if config.ISCSIScanPolicy == "" {
+		config.ISCSIScanPolicy = ISCSIScanPolicyManual
+	} else if err := validateISCSIScanPolicy(config.ISCSIScanPolicy); err != nil {
+		return err
+	}
+	for name, iface := range config.ISCSIInterfaces {
+		if name == "" || name == defaultISCSIInterface || iface.Transport == "" {
+			return fmt.Errorf("invalid iSCSI interface %q: %+v", name, iface)
+		}
+	}
+	if config.TemporaryMountDir == "" {
+		config.TemporaryMountDir = defaultTemporaryMountDir
+	} else if err := validateTemporaryMountDir(config.TemporaryMountDir); err != nil {
+		return err
+	}
+	cidrs := make([]*net.IPNet, 0, len(config.StorageCIDRs))
+	for _, cidr := range config.StorageCIDRs {
+		_, subnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return fmt.Errorf("invalid storage CIDR %q; %v", cidr, err)
+		}
+		cidrs = append(cidrs, subnet)
+	}
+	if config.SessionMonitorInterval < 0 {
+		return fmt.Errorf("invalid session monitor interval: %v", config.SessionMonitorInterval)
+	}
+	if config.AttachLimits.MaxSessions < 0 || config.AttachLimits.MaxLUNs < 0 || config.AttachLimits.MaxDMDevices < 0 {
+		return fmt.Errorf("invalid attach limits: %+v", config.AttachLimits)
+	}
+	if config.TrimPolicy.Interval < 0 || config.TrimPolicy.MaxLoadAverage < 0 || config.TrimPolicy.MaxConcurrent < 0 ||
+		config.TrimPolicy.Timeout < 0 {
+		return fmt.Errorf("invalid trim policy: %+v", config.TrimPolicy)
+	}
+	if config.MountReconcilePolicy.Interval < 0 {
+		return fmt.Errorf("invalid mount reconcile interval: %v", config.MountReconcilePolicy.Interval)
+	}
+	if err := validateUdevRulesPolicy(config.UdevRulesPolicy); err != nil {
+		return err
+	}
+	if config.HostOperationPolicy.MaxConcurrent < 0 {
+		return fmt.Errorf("invalid host operation policy: %+v", config.HostOperationPolicy)
+	}
+	for _, limit := range config.HostOperationPolicy.MaxConcurrentByClass {
+		if limit < 0 {
+			return fmt.Errorf("invalid host operation policy: %+v", config.HostOperationPolicy)
+		}
+	}
+
+	if config.HostResolutionPolicy.Timeout < 0 || config.HostResolutionPolicy.CacheTTL < 0 {
+		return fmt.Errorf("invalid host resolution policy: %+v", config.HostResolutionPolicy)
+	} else if config.HostResolutionPolicy.Timeout == 0 {
+		config.HostResolutionPolicy.Timeout = defaultHostResolutionTimeout
+	}
+	if config.HostResolutionPolicy.Preference == "" {
+		config.HostResolutionPolicy.Preference = AddressPreferenceSystem
+	} else if err := validateAddressPreference(config.HostResolutionPolicy.Preference); err != nil {
+		return err
+	}
+
+	hostRoot := strings.TrimSuffix(config.HostRoot, "/")
+	if config.HostRoot == "" && config.DockerPluginMode {
+		hostRoot = dockerPluginHostRoot
+	}
+
+	chrootPathPrefix = hostRoot
+	dockerPluginMode = config.DockerPluginMode
+	deviceReadTimeout = config.DeviceReadTimeout
+	slowAttachThreshold = config.SlowAttachThreshold
+	formatPolicy = config.FormatPolicy
+	uuidConflictPolicy = config.UUIDConflictPolicy
+	multiAttachPolicy = config.MultiAttachPolicy
+	forceZpoolImport = config.ForceZpoolImport
+	filesystemMismatchPolicy = config.FilesystemMismatchPolicy
+	requireFilesystemMarker = config.RequireFilesystemMarker
+	fencingHook = config.FencingHook
+	detachFencer = config.DetachFencer
+	mount.SetDefaultOptions(config.DefaultMountOptions)
+	multipathPolicy = config.MultipathPolicy
+	noPathQueueingPolicy = config.NoPathQueueingPolicy
+	iscsiLoginPolicy = config.ISCSILoginPolicy
+	iscsiScanPolicy = config.ISCSIScanPolicy
+	manualScanSupport = &manualScanSupportCheck{}
+	iscsiInterfaces = make(map[string]ISCSIInterface, len(config.ISCSIInterfaces))
+	for name, iface := range config.ISCSIInterfaces {
+		iscsiInterfaces[name] = iface
+	}
+	temporaryMountDir = config.TemporaryMountDir
+	disableNativeFilesystemResize = config.DisableNativeFilesystemResize
+	disableDeviceSizeCheck = config.DisableDeviceSizeCheck
+	disablePortalReachabilityCheck = config.DisablePortalReachabilityCheck
+	storageCIDRs = cidrs
+	attachLimits = config.AttachLimits
+	sessionMonitorInterval = config.SessionMonitorInterval
+	recoverHostServices = config.RecoverHostServices
+	remediateMultipathBlacklist = config.RemediateMultipathBlacklist
+	regenerateInitiatorIQN = config.RegenerateInitiatorIQN
+	nfsLockPolicy = config.NFSLockPolicy
+	unmountPolicy = config.UnmountPolicy
+	unmountPolicy.TerminateCommands = append([]string(nil), config.UnmountPolicy.TerminateCommands...)
+	trimPolicy = config.TrimPolicy
+	mountReconcilePolicy = config.MountReconcilePolicy
+	udevRulesPolicy = config.UdevRulesPolicy
+	hostOperationPolicy := HostOperationPolicy{
+		MaxConcurrent:        config.HostOperationPolicy.MaxConcurrent,
+		MaxConcurrentByClass: make(map[HostOperationClass]int, len(config.HostOperationPolicy.MaxConcurrentByClass)),
+	}
+	for class, limit := range config.HostOperationPolicy.MaxConcurrentByClass {
+		hostOperationPolicy.MaxConcurrentByClass[class] = limit
+	}
+	hostOperations = newHostOperationQueue(hostOperationPolicy)
+	logFullCommandOutput = config.LogFullCommandOutput
+	hostJournal = nil
+	if config.LogToHostJournal {
+		hostJournal = newJournalWriter(chrootPathPrefix + journalSocketPath)
+	}
+	hostResolutionPolicy = config.HostResolutionPolicy
+	hostResolver = config.HostResolver
+	if hostResolver == nil {
+		hostResolver = net.DefaultResolver
+	}
+	hostResolutions = newHostResolutionCache()
+	executor = config.Executor
+	if executor == nil {
+		executor = osExecutor{}
+	}
+	clock = config.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	if config.Logger != nil {
+		SetDefaultLogger(config.Logger)
+	}
+
+	return nil
+}
 
 func IPv6Check(ip string) bool {
 	return strings.Count(ip, ":") >= 2
 }
 
+// init detects Docker plugin mode from the environment at import time.
+//
+// Deprecated: this is retained only for compatibility; callers should use Init, which overrides it.
 func init() {
-	if os.Getenv("DOCKER_PLUGIN_MODE") != "" {
-		chrootPathPrefix = "/host"
-	} else {
-		chrootPathPrefix = ""
-	}
+	_ = Init(Config{DockerPluginMode: os.Getenv("DOCKER_PLUGIN_MODE") != ""})
 }
 
 // Attach the volume to the local host.  This method must be able to accomplish its task using only the data passed in.
 // It may be assumed that this method always runs on the host to which the volume will be attached.
-func AttachNFSVolume(ctx context.Context, name, mountpoint string, publishInfo *VolumePublishInfo) error {
+func AttachNFSVolume(ctx context.Context, name, mountpoint string, publishInfo *VolumePublishInfo) (err error) {
+
+	var exportPath = fmt.Sprintf("%s:%s", publishInfo.NfsServerIP, publishInfo.NfsPath)
+	ctx = WithLogFields(ctx, log.Fields{LogFieldVolume: name, "exportPath": exportPath})
 
 	Logc(ctx).Debug(">>>> osutils.AttachNFSVolume")
 	defer Logc(ctx).Debug("<<<< osutils.AttachNFSVolume")
+	defer func() { journalHostOutcome(ctx, "Attach of NFS volume", err) }()
 
-	var exportPath = fmt.Sprintf("%s:%s", publishInfo.NfsServerIP, publishInfo.NfsPath)
-	var options = publishInfo.MountOptions
+	var options = mount.MergeOptions("nfs", publishInfo.MountOptions)
 
 	Logc(ctx).WithFields(log.Fields{
 		"volume":     name,
@@ -72,6 +407,28 @@ func AttachNFSVolume(ctx context.Context, name, mountpoint string, publishInfo *
 		"options":    options,
 	}).Debug("Publishing NFS volume.")
 
+	if err = ValidateNFSMountOptions(options); err != nil {
+		return err
+	}
+
+	// NFSv3 locking silently fails without a working rpc.statd, so check it before mounting
+	options, err = ensureNFSLocking(ctx, options)
+	if err != nil {
+		return err
+	}
+
+	// NFS over TLS mounts hang or fail with an unhelpful EINVAL if the node can't perform the TLS handshake
+	if err = ensureNFSTLS(ctx, options); err != nil {
+		return err
+	}
+
+	// Resolve a server named by hostname here, so the lookup is bounded and the address mounted is the one logged
+	server, err := resolveNFSServer(ctx, publishInfo.NfsServerIP, options)
+	if err != nil {
+		return err
+	}
+	exportPath = fmt.Sprintf("%s:%s", server, publishInfo.NfsPath)
+
 	return mountNFSPath(ctx, exportPath, mountpoint, options)
 }
 
@@ -79,36 +436,68 @@ func AttachNFSVolume(ctx context.Context, name, mountpoint string, publishInfo *
 // It may be assumed that this method always runs on the host to which the volume will be attached.  If the mountpoint
 // parameter is specified, the volume will be mounted.  The device path is set on the in-out publishInfo parameter
 // so that it may be mounted later instead.
-func AttachISCSIVolume(ctx context.Context, name, mountpoint string, publishInfo *VolumePublishInfo) error {
+func AttachISCSIVolume(ctx context.Context, name, mountpoint string, publishInfo *VolumePublishInfo) (err error) {
+
+	var lunID = int(publishInfo.IscsiLunNumber)
+
+	// Identify the volume on every line logged while attaching it
+	ctx = WithLogFields(ctx, log.Fields{
+		LogFieldVolume:    name,
+		LogFieldTargetIQN: publishInfo.IscsiTargetIQN,
+		LogFieldLUN:       lunID,
+	})
 
 	Logc(ctx).Debug(">>>> osutils.AttachISCSIVolume")
 	defer Logc(ctx).Debug("<<<< osutils.AttachISCSIVolume")
+	defer func() { journalHostOutcome(ctx, "Attach of iSCSI volume", err) }()
 
-	var err error
-	var lunID = int(publishInfo.IscsiLunNumber)
+	// Attach what the kernel logged about the LUN's devices, or its sessions if none were found, to any error
+	var deviceInfo *ScsiDeviceInfo
+	kernelLog := startKernelLogCorrelation()
+	defer func() {
+		if err == nil {
+			return
+		}
+		if deviceInfo != nil {
+			err = kernelLog.annotate(ctx, err, scsiDeviceKernelLogSubjects(deviceInfo))
+		} else {
+			err = kernelLog.annotate(ctx, err, iscsiKernelLogSubjects(
+				GetISCSIHostSessionMapForTarget(ctx, publishInfo.IscsiTargetIQN), strconv.Itoa(lunID)))
+		}
+	}()
+
+	// Track the time spent in each stage, and report a breakdown if the attach as a whole is slow
+	latency := &AttachLatency{}
+	publishInfo.AttachLatency = latency
+	attachStart := time.Now()
+	defer func() {
+		latency.Total = time.Since(attachStart)
+		logSlowAttach(ctx, name, latency)
+	}()
+
+	// Portals named by hostname are resolved once here, rather than by each iscsiadm command, so that every login
+	// goes to the same address and sessions can be matched to the portals they were made to
+	if err = resolveISCSIPortals(ctx, publishInfo); err != nil {
+		return err
+	}
 
 	var bkportal []string
-	var portalIps []string
 	bkportal = append(bkportal, ensureHostportFormatted(publishInfo.IscsiTargetPortal))
-	portalIps = append(portalIps, getHostportIP(publishInfo.IscsiTargetPortal))
-
 	for _, p := range publishInfo.IscsiPortals {
 		bkportal = append(bkportal, ensureHostportFormatted(p))
-		portalIps = append(portalIps, getHostportIP(p))
 	}
 
+	targets := getISCSITargets(publishInfo)
+
 	var targetIQN = publishInfo.IscsiTargetIQN
-	var username = publishInfo.IscsiUsername                  // unidirectional CHAP field
-	var initiatorSecret = publishInfo.IscsiInitiatorSecret    // unidirectional CHAP field
-	var targetUsername = publishInfo.IscsiTargetUsername      // bidirectional CHAP field
-	var targetInitiatorSecret = publishInfo.IscsiTargetSecret // bidirectional CHAP field
+	var username = publishInfo.IscsiUsername             // unidirectional CHAP field
+	var targetUsername = publishInfo.IscsiTargetUsername // bidirectional CHAP field
 	var iscsiInterface = publishInfo.IscsiInterface
 	var lunSerial = publishInfo.IscsiLunSerial
 	var fstype = publishInfo.FilesystemType
-	var options = publishInfo.MountOptions
 
 	if iscsiInterface == "" {
-		iscsiInterface = "default"
+		iscsiInterface = defaultISCSIInterface
 	}
 
 	Logc(ctx).WithFields(log.Fields{
@@ -117,87 +506,97 @@ func AttachISCSIVolume(ctx context.Context, name, mountpoint string, publishInfo
 		"lunID":          lunID,
 		"targetPortals":  bkportal,
 		"targetIQN":      targetIQN,
+		"targetCount":    len(targets),
 		"iscsiInterface": iscsiInterface,
 		"fstype":         fstype,
 	}).Debug("Attaching iSCSI volume.")
 
+	if err = validateCHAPCredentials(publishInfo); err != nil {
+		return err
+	}
+	if err = iscsi.ValidatePortalZones(bkportal); err != nil {
+		return err
+	}
+
 	if !ISCSISupported(ctx) {
 		err := errors.New("unable to attach: open-iscsi tools not found on host")
 		Logc(ctx).Errorf("Unable to attach volume: open-iscsi utils not found")
 		return err
 	}
 
-	// Ensure we are logged into correct portals
-	if publishInfo.UseCHAP {
-		bkPortalsToLogin, err := portalsToLogin(ctx, targetIQN, bkportal)
-		if err != nil {
-			return err
-		}
+	// Refuse the attach up front rather than letting the initiator fail partway through
+	if err = CheckNodeAttachCapacity(ctx, publishInfo); err != nil {
+		return err
+	}
 
-		for _, portal := range bkPortalsToLogin {
-			err = loginWithChap(
-				ctx, targetIQN, portal, username, initiatorSecret, targetUsername,
-				targetInitiatorSecret, iscsiInterface, false)
-			if err != nil {
-				Logc(ctx).Errorf("Failed to login with CHAP credentials: %+v ", err)
-				return fmt.Errorf("iSCSI login error: %v", err)
+	// Logins hang or fail if iscsid has crashed
+	recoverHostService(ctx, "iscsid")
+
+	// Warn if an existing session doesn't match the volume's CHAP credentials, since it would be reused as is
+	if publishInfo.UseCHAP {
+		if authInfo, err := GetSessionAuthInfo(ctx, targetIQN); err != nil {
+			Logc(ctx).WithError(err).Warning("Could not check authentication of existing iSCSI sessions.")
+		} else {
+			for _, session := range authInfo {
+				if !session.UseCHAP || session.Username != username || session.TargetUsername != targetUsername {
+					Logc(ctx).WithFields(log.Fields{
+						"targetIQN": targetIQN,
+						"SID":       session.SID,
+						"useCHAP":   session.UseCHAP,
+					}).Warning("Existing iSCSI session does not match the volume's CHAP credentials.")
+				}
 			}
 		}
-	} else {
-		portalIpsToLogin, err := portalsIpsToLogin(ctx, targetIQN, portalIps)
-		if err != nil {
-			return err
-		}
+	}
 
-		err = EnsureISCSISessions(ctx, targetIQN, iscsiInterface, portalIpsToLogin)
-		if err != nil {
-			return fmt.Errorf("iSCSI session error: %v", err)
+	// Ensure we are logged into correct portals of each target
+	stage := startAttachStage(ctx, "login")
+	for _, target := range targets {
+		if err = ensureISCSILogins(ctx, publishInfo, target.IQN, target.Portals); err != nil {
+			break
 		}
 	}
-
-	// First attempt to fix invalid serials by rescanning them
-	err = handleInvalidSerials(ctx, lunID, targetIQN, lunSerial, rescanOneLun)
+	latency.Login = stage.end()
 	if err != nil {
 		return err
 	}
 
-	// Then attempt to fix invalid serials by purging them (to be scanned
-	// again later)
-	err = handleInvalidSerials(ctx, lunID, targetIQN, lunSerial, purgeOneLun)
-	if err != nil {
-		return err
+	stage = startAttachStage(ctx, "scanWait")
+	for _, target := range targets {
+		if err = scanISCSITargetForLUN(ctx, int(target.LunNumber), target.IQN, lunSerial); err != nil {
+			break
+		}
 	}
-
-	// If LUN isn't present, scan the target and wait for the device(s) to appear
-	// if not attached need to scan
-	shouldScan := !IsAlreadyAttached(ctx, lunID, targetIQN)
-	err = waitForDeviceScanIfNeeded(ctx, lunID, targetIQN, shouldScan)
+	latency.ScanWait = stage.end()
 	if err != nil {
-		Logc(ctx).Errorf("Could not find iSCSI device: %+v", err)
 		return err
 	}
 
-	// At this point if the serials are still invalid, give up so the
-	// caller can retry (invoking the remediation steps above in the
-	// process, if they haven't already been run).
-	failHandler := func(ctx context.Context, path string) error {
-		Logc(ctx).Error("Detected LUN serial number mismatch, attaching volume would risk data corruption, giving up")
-		return fmt.Errorf("LUN serial number mismatch, kernel has stale cached data")
-	}
-	err = handleInvalidSerials(ctx, lunID, targetIQN, lunSerial, failHandler)
-	if err != nil {
-		return err
+	stage = startAttachStage(ctx, "multipathWait")
+	publishInfo.Degraded = false
+	for _, target := range targets {
+		var degraded bool
+		if degraded, err = waitForMultipathDeviceForLUN(ctx, int(target.LunNumber), target.IQN); err != nil {
+			break
+		}
+		publishInfo.Degraded = publishInfo.Degraded || degraded
+		if err = resolveStaleMultipathDevice(ctx, int(target.LunNumber), target.IQN); err != nil {
+			break
+		}
 	}
-
-	err = waitForMultipathDeviceForLUN(ctx, lunID, targetIQN)
+	latency.MultipathWait = stage.end()
 	if err != nil {
 		return err
 	}
 
 	// Lookup all the SCSI device information, and include filesystem type only if not raw block volume
-	needFSType := fstype != fsRaw
+	// and not a shared LUN whose filesystem isn't to be checked
+	skipFSCheck := publishInfo.MultiAttach && multiAttachPolicy == MultiAttachPolicySkip
+	needFSType := fstype != fsRaw && !skipFSCheck
 
-	deviceInfo, err := getDeviceInfoForLUN(ctx, lunID, targetIQN, needFSType)
+	stage = startAttachStage(ctx, "blkid")
+	deviceInfo, err = getDeviceInfoForLUN(ctx, lunID, targetIQN, needFSType)
+	latency.Blkid = stage.end()
 	if err != nil {
 		return fmt.Errorf("error getting iSCSI device information: %v", err)
 	} else if deviceInfo == nil {
@@ -212,6 +611,16 @@ func AttachISCSIVolume(ctx context.Context, name, mountpoint string, publishInfo
 		"iqn":             deviceInfo.IQN,
 	}).Debug("Found device.")
 
+	// The paths through any additional targets must have been combined into the same multipath device
+	if err = verifyISCSITargetsShareMultipathDevice(ctx, deviceInfo, targets[1:]); err != nil {
+		return err
+	}
+
+	// Set the timeouts that bound how quickly a failing path is given up on
+	if err = TrackSCSITimeouts(ctx, publishInfo); err != nil {
+		return fmt.Errorf("could not set SCSI timeouts of LUN %d; %v", lunID, err)
+	}
+
 	// Make sure we use the proper device (multipath if in use)
 	deviceToUse := deviceInfo.Devices[0]
 	if deviceInfo.MultipathDevice != "" {
@@ -221,42 +630,149 @@ func AttachISCSIVolume(ctx context.Context, name, mountpoint string, publishInfo
 		return fmt.Errorf("could not determine device to use for %v", name)
 	}
 	devicePath := "/dev/" + deviceToUse
+	if deviceInfo.MultipathDevice != "" {
+		// Record the stable mapper path, since dm-N names may change across reboots
+		devicePath = getMultipathDevicePath(ctx, deviceInfo.MultipathDevice)
+	}
 	if err := waitForDevice(ctx, devicePath); err != nil {
 		return fmt.Errorf("could not find device %v; %s", devicePath, err)
 	}
 
+	// A LUN exported read-only or with failed paths, as during a failover, would fail mkfs or mount confusingly
+	if err := ensureDeviceReady(ctx, deviceInfo, publishInfo.ReadOnlyClone); err != nil {
+		return err
+	}
+
+	// Catch a mis-mapped LUN or an incomplete array-side resize before anything is written to the device
+	if publishInfo.VolumeSize > 0 && !disableDeviceSizeCheck {
+		if err := verifyDeviceSize(ctx, devicePath, publishInfo.VolumeSize); err != nil {
+			return err
+		}
+	}
+
 	// Return the device in the publish info in case the mount will be done later
 	publishInfo.DevicePath = devicePath
+	publishInfo.SupportsDiscard = deviceInfo.SupportsDiscard
+
+	// Fence a shared LUN before this node reads or writes anything on it
+	if publishInfo.MultiAttach && fencingHook != nil {
+		if err := fencingHook.Register(ctx, devicePath, publishInfo); err != nil {
+			return fmt.Errorf("could not fence LUN %s, device %s; %v", name, deviceToUse, err)
+		}
+	}
+
+	return setUpAttachedDevice(ctx, name, mountpoint, devicePath, deviceToUse, deviceInfo.Filesystem, skipFSCheck,
+		publishInfo)
+}
+
+// setUpAttachedDevice readies the device of an attached volume: it creates a zpool or filesystem on the device if
+// it has none yet, checks any filesystem it has against the one requested, and mounts it if a mountpoint is given.
+// The existing filesystem type is as blkid found it on /dev/<deviceToUse>, and isn't checked at all if skipFSCheck
+// is set; one of another type than requested is handled as the filesystem mismatch policy says.  That device is the
+// one inspected and formatted, while devicePath, which may be a multipath alias of it, is the one mounted.
+func setUpAttachedDevice(
+	ctx context.Context, name, mountpoint, devicePath, deviceToUse, existingFstype string, skipFSCheck bool,
+	publishInfo *VolumePublishInfo,
+) error {
+
+	var fstype = publishInfo.FilesystemType
+	var options = publishInfo.MountOptions
+	var device = "/dev/" + deviceToUse
+	var stage *attachStage
+	var err error
+
+	latency := publishInfo.AttachLatency
+	if latency == nil {
+		latency = &AttachLatency{}
+	}
 
 	if fstype == fsRaw {
 		return nil
 	}
 
-	existingFstype := deviceInfo.Filesystem
-	if existingFstype == "" {
-		Logc(ctx).WithFields(log.Fields{"volume": name, "fstype": fstype}).Debug("Formatting LUN.")
-		err := formatVolume(ctx, devicePath, fstype)
+	// A zpool takes the place of a filesystem, and is mounted by name rather than by device
+	if fstype == fsZFS {
+		stage = startAttachStage(ctx, "mkfs")
+		err = attachZpool(ctx, name, devicePath, existingFstype, publishInfo)
+		latency.Mkfs = stage.end()
 		if err != nil {
-			return fmt.Errorf("error formatting LUN %s, device %s: %v", name, deviceToUse, err)
+			return fmt.Errorf("LUN %s, device %s: %v", name, deviceToUse, err)
+		}
+		if mountpoint != "" {
+			stage = startAttachStage(ctx, "mount")
+			err = MountZpool(ctx, publishInfo.Zpool, mountpoint, mount.MergeOptions(fstype, options))
+			latency.Mount = stage.end()
+			if err != nil {
+				return fmt.Errorf("error mounting LUN %v, mountpoint %v; %s", name, mountpoint, err)
+			}
+		}
+		return nil
+	}
+
+	// A filesystem of another type is used, reformatted or refused as the filesystem mismatch policy says
+	if !skipFSCheck && existingFstype != "" && existingFstype != unknownFstype && existingFstype != fstype {
+		if existingFstype, err = resolveFilesystemMismatch(ctx, device, existingFstype, publishInfo); err != nil {
+			return fmt.Errorf("LUN %s, device %s %v", name, deviceToUse, err)
 		}
-	} else if existingFstype != unknownFstype && existingFstype != fstype {
+		fstype = publishInfo.FilesystemType
+	}
+
+	if skipFSCheck {
 		Logc(ctx).WithFields(log.Fields{
-			"volume":          name,
-			"existingFstype":  existingFstype,
-			"requestedFstype": fstype,
-		}).Error("LUN already formatted with a different file system type.")
-		return fmt.Errorf("LUN %s, device %s already formatted with other filesystem: %s",
-			name, deviceToUse, existingFstype)
+			"volume": name,
+			"fstype": fstype,
+		}).Debug("LUN is attached to multiple nodes, not checking its filesystem.")
+	} else if existingFstype == "" {
+		if publishInfo.ReadOnlyClone {
+			return fmt.Errorf("read-only clone %s, device %s has no filesystem", name, deviceToUse)
+		}
+		// Another node may be using the LUN already, so creating a filesystem could destroy its data
+		if publishInfo.MultiAttach && multiAttachPolicy != MultiAttachPolicyFormat {
+			return fmt.Errorf("LUN %s, device %s is attached to multiple nodes and has no filesystem; "+
+				"not formatting it", name, deviceToUse)
+		}
+		Logc(ctx).WithFields(log.Fields{"volume": name, "fstype": fstype}).Debug("Formatting LUN.")
+		stage = startAttachStage(ctx, "mkfs")
+		err := formatVolume(ctx, device, fstype, filesystemMarker(name))
+		latency.Mkfs = stage.end()
+		if err != nil {
+			return fmt.Errorf("error formatting LUN %s, device %s: %w", name, deviceToUse, err)
+		}
+		publishInfo.FilesystemOrigin = FilesystemOriginVolume
 	} else {
 		Logc(ctx).WithFields(log.Fields{
 			"volume": name,
-			"fstype": deviceInfo.Filesystem,
+			"fstype": existingFstype,
 		}).Debug("LUN already formatted.")
+
+		if err = checkFilesystemMarker(ctx, name, devicePath, publishInfo); err != nil {
+			return fmt.Errorf("LUN %s, device %s: %v", name, deviceToUse, err)
+		}
+
+		if publishInfo.ReadOnlyClone {
+			options = mount.MergeOptions("", options, readOnlyCloneMountOptions(existingFstype)...)
+			publishInfo.MountOptions = options
+		} else {
+			// A clone carries its source's filesystem UUID, which XFS refuses to mount alongside the source.  The
+			// UUID of a shared LUN is never changed, since other nodes may have it mounted.
+			policy := uuidConflictPolicy
+			if publishInfo.MultiAttach && policy == UUIDConflictPolicyRegenerate {
+				policy = UUIDConflictPolicyNoUUID
+			}
+			options, err = resolveFilesystemUUIDConflict(ctx, devicePath, existingFstype, options, policy)
+			if err != nil {
+				return fmt.Errorf("LUN %s, device %s: %v", name, deviceToUse, err)
+			}
+			publishInfo.MountOptions = options
+		}
 	}
 
 	// Optionally mount the device
 	if mountpoint != "" {
-		if err := MountDevice(ctx, devicePath, mountpoint, options, false); err != nil {
+		stage = startAttachStage(ctx, "mount")
+		err := MountDevice(ctx, devicePath, mountpoint, mount.MergeOptions(fstype, options), false)
+		latency.Mount = stage.end()
+		if err != nil {
 			return fmt.Errorf("error mounting LUN %v, device %v, mountpoint %v; %s",
 				name, deviceToUse, mountpoint, err)
 		}
@@ -265,2242 +781,5518 @@ func AttachISCSIVolume(ctx context.Context, name, mountpoint string, publishInfo
 	return nil
 }
 
-// DFInfo data structure for wrapping the parsed output from the 'df' command
-type DFInfo struct {
-	Target string
-	Source string
+// readOnlyCloneMountOptions returns the options that mount a snapshot clone's filesystem read-only without
+// writing to it.  A snapshot of a mounted filesystem has an unclean journal, and replaying it, which mounting
+// normally does even read-only, fails on a read-only device.  XFS also needs nouuid, as the clone has its
+// source's UUID and the source may be mounted.
+func readOnlyCloneMountOptions(fstype string) []string {
+	switch fstype {
+	case "xfs":
+		return []string{"ro", "nouuid", "norecovery"}
+	case "ext3", "ext4":
+		return []string{"ro", "noload"}
+	default:
+		return []string{"ro"}
+	}
 }
 
-// GetDFOutput returns parsed DF output
-func GetDFOutput(ctx context.Context) ([]DFInfo, error) {
-
-	Logc(ctx).Debug(">>>> osutils.GetDFOutput")
-	defer Logc(ctx).Debug("<<<< osutils.GetDFOutput")
+// AttachProgressFunc is called while an attach stage, such as "mkfs", is still running, with how long it has run.
+type AttachProgressFunc func(stage string, elapsed time.Duration)
 
-	var result []DFInfo
-	out, err := execCommand(ctx, "df", "--output=target,source")
-	if err != nil {
-		// df returns an error if there's a stale file handle that we can
-		// safely ignore. There may be other reasons. Consider it a warning if
-		// it printed anything to stdout.
-		if len(out) == 0 {
-			Logc(ctx).Error("Error encountered gathering df output.")
-			return nil, err
-		}
-	}
+type attachProgressKey struct{}
 
-	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
-	for _, l := range lines {
+type attachProgress struct {
+	interval time.Duration
+	callback AttachProgressFunc
+}
 
-		a := strings.Fields(l)
-		if len(a) > 1 {
-			result = append(result, DFInfo{
-				Target: a[0],
-				Source: a[1],
-			})
-		}
-	}
-	if len(result) > 1 {
-		return result[1:], nil
-	}
-	return result, nil
+// WithAttachProgress returns a context under which AttachISCSIVolume calls callback every interval while a stage
+// is running, so a caller can report that a long attach, such as one formatting a large volume, is still working.
+func WithAttachProgress(ctx context.Context, interval time.Duration, callback AttachProgressFunc) context.Context {
+	return context.WithValue(ctx, attachProgressKey{}, attachProgress{interval: interval, callback: callback})
 }
 
-// GetInitiatorIqns returns parsed contents of /etc/iscsi/initiatorname.iscsi
-func GetInitiatorIqns(ctx context.Context) ([]string, error) {
+// attachStage times one stage of an attach, reporting progress while it runs if the context asks for it.
+type attachStage struct {
+	start time.Time
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
 
-	Logc(ctx).Debug(">>>> osutils.GetInitiatorIqns")
-	defer Logc(ctx).Debug("<<<< osutils.GetInitiatorIqns")
+func startAttachStage(ctx context.Context, name string) *attachStage {
 
-	iqns := make([]string, 0)
+	stage := &attachStage{start: time.Now(), done: make(chan struct{})}
 
-	out, err := execCommand(ctx, "cat", "/etc/iscsi/initiatorname.iscsi")
-	if err != nil {
-		Logc(ctx).WithField("Error", err).Warn("Could not read initiatorname.iscsi; perhaps iSCSI is not installed?")
-		return nil, err
-	}
-	lines := strings.Split(string(out), "\n")
-	for _, l := range lines {
-		if strings.Contains(l, "InitiatorName=") {
-			iqns = append(iqns, strings.Split(l, "=")[1])
-		}
+	progress, ok := ctx.Value(attachProgressKey{}).(attachProgress)
+	if !ok || progress.interval <= 0 || progress.callback == nil {
+		return stage
 	}
-	return iqns, nil
-}
 
-// GetIPAddresses returns the sorted list of Global Unicast IP addresses available to Trident
-func GetIPAddresses(ctx context.Context) ([]string, error) {
+	ticker := time.NewTicker(progress.interval)
+	stage.wg.Add(1)
+	go func() {
+		defer stage.wg.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				progress.callback(name, time.Since(stage.start))
+			case <-stage.done:
+				return
+			}
+		}
+	}()
 
-	Logc(ctx).Debug(">>>> osutils.GetIPAddresses")
-	defer Logc(ctx).Debug("<<<< osutils.GetIPAddresses")
+	return stage
+}
 
-	ipAddrs := make([]string, 0)
-	addrsMap := make(map[string]struct{})
+// end stops progress reporting, returning once no callback is running, and returns how long the stage took.
+func (s *attachStage) end() time.Duration {
+	close(s.done)
+	s.wg.Wait()
+	return time.Since(s.start)
+}
 
-	// Get the set of potentially viable IP addresses for this host in an OS-appropriate way.
-	addrs, err := getIPAddresses(ctx)
-	if err != nil {
-		err = fmt.Errorf("could not gather system IP addresses; %v", err)
-		Logc(ctx).Error(err)
-		return nil, err
+// logSlowAttach logs a per-stage latency breakdown if an attach took longer than the slow attach threshold,
+// so operators can tell whether the array, the fabric, or the host is slow.
+func logSlowAttach(ctx context.Context, name string, latency *AttachLatency) {
+
+	if latency.Total < slowAttachThreshold {
+		return
 	}
 
-	// Strip netmask and use a map to ensure addresses are deduplicated.
-	for _, addr := range addrs {
+	Logc(ctx).WithFields(log.Fields{
+		"volume":        name,
+		"total":         latency.Total.String(),
+		"threshold":     slowAttachThreshold.String(),
+		"login":         latency.Login.String(),
+		"scanWait":      latency.ScanWait.String(),
+		"multipathWait": latency.MultipathWait.String(),
+		"blkid":         latency.Blkid.String(),
+		"mkfs":          latency.Mkfs.String(),
+		"mount":         latency.Mount.String(),
+	}).Warning("Slow iSCSI attach.")
+}
 
-		// net.Addr are of form 1.2.3.4/32, but IP needs 1.2.3.4, so we must strip the netmask (also works for IPv6)
-		parsedAddr := net.ParseIP(strings.Split(addr.String(), "/")[0])
+// GetAttachLimits returns the per-node attach limits this package was configured with.
+func GetAttachLimits() AttachLimits {
+	return attachLimits
+}
 
-		Logc(ctx).WithField("IPAddress", parsedAddr.String()).Debug("Discovered potentially viable IP address.")
+// GetStorageCIDRs returns the configured storage networks.
+func GetStorageCIDRs() []string {
+	cidrs := make([]string, 0, len(storageCIDRs))
+	for _, cidr := range storageCIDRs {
+		cidrs = append(cidrs, cidr.String())
+	}
+	return cidrs
+}
 
-		addrsMap[parsedAddr.String()] = struct{}{}
+// GetNodeAttachUsage counts the iSCSI sessions, attached iSCSI LUNs, and devicemapper devices on this host.
+// A multipath LUN counts once regardless of how many paths it has.
+func GetNodeAttachUsage(ctx context.Context) (NodeAttachUsage, error) {
+
+	Logc(ctx).Debug(">>>> osutils.GetNodeAttachUsage")
+	defer Logc(ctx).Debug("<<<< osutils.GetNodeAttachUsage")
+
+	var usage NodeAttachUsage
+
+	sessions, err := ioutil.ReadDir(chrootPathPrefix + "/sys/class/iscsi_session/")
+	if err != nil && !os.IsNotExist(err) {
+		return usage, err
 	}
+	usage.Sessions = len(sessions)
 
-	for addr := range addrsMap {
-		ipAddrs = append(ipAddrs, addr)
+	// Without sessions there can be no attached iSCSI LUNs
+	if usage.Sessions > 0 {
+		devices, err := GetISCSIDevices(ctx)
+		if err != nil {
+			return usage, err
+		}
+		luns := make(map[string]struct{})
+		for _, device := range devices {
+			if device.MultipathDevice != "" {
+				luns[device.MultipathDevice] = struct{}{}
+			} else if len(device.Devices) > 0 {
+				luns[device.Devices[0]] = struct{}{}
+			}
+		}
+		usage.LUNs = len(luns)
 	}
-	sort.Strings(ipAddrs)
-	return ipAddrs, nil
-}
 
-// PathExists returns true if the file/directory at the specified path exists,
-// false otherwise or if an error occurs.
-func PathExists(path string) bool {
-	if _, err := os.Stat(path); err == nil {
-		return true
+	blockDevices, err := ioutil.ReadDir(chrootPathPrefix + "/sys/block/")
+	if err != nil && !os.IsNotExist(err) {
+		return usage, err
 	}
-	return false
+	for _, blockDevice := range blockDevices {
+		if isDeviceMapperDevice(blockDevice.Name()) {
+			usage.DMDevices++
+		}
+	}
+
+	return usage, nil
 }
 
-// EnsureFileExists makes sure that file of given name exists
-func EnsureFileExists(ctx context.Context, path string) error {
+// CheckNodeAttachCapacity returns a NodeSaturatedError if attaching the volume described by the publish info
+// would exceed any of the configured per-node attach limits.  Volumes that are already attached always pass.
+func CheckNodeAttachCapacity(ctx context.Context, publishInfo *VolumePublishInfo) error {
 
-	fields := log.Fields{"path": path}
-	if info, err := os.Stat(path); err == nil {
-		if info.IsDir() {
-			Logc(ctx).WithFields(fields).Error("Path exists but is a directory")
-			return fmt.Errorf("path exists but is a directory: %s", path)
-		}
+	if attachLimits == (AttachLimits{}) {
+		return nil
+	}
+	if IsAlreadyAttached(ctx, int(publishInfo.IscsiLunNumber), publishInfo.IscsiTargetIQN) {
 		return nil
-	} else if !os.IsNotExist(err) {
-		Logc(ctx).WithFields(fields).Errorf("Can't determine if file exists; %s", err)
-		return fmt.Errorf("can't determine if file %s exists; %s", path, err)
 	}
 
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC, 0600)
-	if nil != err {
-		Logc(ctx).WithFields(fields).Errorf("OpenFile failed; %s", err)
-		return fmt.Errorf("failed to create file %s; %s", path, err)
+	usage, err := GetNodeAttachUsage(ctx)
+	if err != nil {
+		Logc(ctx).WithError(err).Warning("Could not determine node attach usage; not enforcing attach limits.")
+		return nil
 	}
-	file.Close()
 
-	return nil
-}
+	newSessions := 0
+	for _, target := range getISCSITargets(publishInfo) {
+		var portals []string
+		for _, portal := range target.Portals {
+			portals = append(portals, formatPortal(portal))
+		}
+		if toLogin, err := portalsToLogin(ctx, target.IQN, portals); err == nil {
+			newSessions += len(toLogin)
+		}
+	}
 
-// DeleteResourceAtPath makes sure that given named file or (empty) directory is removed
-func DeleteResourceAtPath(ctx context.Context, resource string) error {
-	return waitForResourceDeletionAtPath(ctx, resource)
+	return checkAttachLimits(ctx, attachLimits, usage, newSessions)
 }
 
-// waitForResourceDeletionAtPath accepts a resource name and waits until it is deleted and returns error if it times out
-func waitForResourceDeletionAtPath(ctx context.Context, resource string) error {
-
-	fields := log.Fields{"resource": resource}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.waitForResourceDeletionAtPath")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.waitForResourceDeletionAtPath")
-
-	maxDuration := resourceDeletionTimeoutSecs * time.Second
+// checkAttachLimits returns a NodeSaturatedError if adding one LUN, one devicemapper device, and the specified
+// number of sessions to the current usage would exceed any of the limits.
+func checkAttachLimits(ctx context.Context, limits AttachLimits, usage NodeAttachUsage, newSessions int) error {
 
-	checkResourceDeletion := func() error {
-		if _, err := os.Stat(resource); err == nil {
-			if err = os.Remove(resource); err != nil {
-				Logc(ctx).WithFields(fields).Debugf("Failed to remove resource, %s", err)
-				return fmt.Errorf("failed to remove resource %s; %s", resource, err)
-			}
-			return nil
-		} else if !os.IsNotExist(err) {
-			Logc(ctx).WithFields(fields).Debugf("Can't determine if resource exists; %s", err)
-			return fmt.Errorf("can't determine if resource %s exists; %s", resource, err)
-		}
+	var exceeded []string
+	if limits.MaxLUNs > 0 && usage.LUNs+1 > limits.MaxLUNs {
+		exceeded = append(exceeded, fmt.Sprintf("%d of %d LUNs attached", usage.LUNs, limits.MaxLUNs))
+	}
+	if limits.MaxDMDevices > 0 && usage.DMDevices+1 > limits.MaxDMDevices {
+		exceeded = append(exceeded, fmt.Sprintf("%d of %d devicemapper devices in use",
+			usage.DMDevices, limits.MaxDMDevices))
+	}
+	if limits.MaxSessions > 0 && usage.Sessions+newSessions > limits.MaxSessions {
+		exceeded = append(exceeded, fmt.Sprintf("%d of %d iSCSI sessions in use, %d more needed",
+			usage.Sessions, limits.MaxSessions, newSessions))
+	}
 
+	if len(exceeded) == 0 {
 		return nil
 	}
 
-	deleteNotify := func(err error, duration time.Duration) {
-		Logc(ctx).WithField("increment", duration).Debug("Resource not deleted yet, waiting.")
-	}
+	Logc(ctx).WithFields(log.Fields{
+		"limits":      limits,
+		"usage":       usage,
+		"newSessions": newSessions,
+	}).Error("Node attach limits reached.")
+	return NodeSaturatedError(fmt.Sprintf("node saturated; %s", strings.Join(exceeded, ", ")))
+}
 
-	deleteBackoff := backoff.NewExponentialBackOff()
-	deleteBackoff.InitialInterval = 1 * time.Second
-	deleteBackoff.Multiplier = 1.414 // approx sqrt(2)
-	deleteBackoff.RandomizationFactor = 0.1
-	deleteBackoff.MaxElapsedTime = maxDuration
+// getISCSITargets returns the targets through which a volume's LUN is mapped, starting with the primary target
+// and its portals, followed by any additional targets not already listed.
+func getISCSITargets(publishInfo *VolumePublishInfo) []IscsiTarget {
 
-	// Run the check using an exponential backoff
-	if err := backoff.RetryNotify(checkResourceDeletion, deleteBackoff, deleteNotify); err != nil {
-		return fmt.Errorf("could not delete resource after %3.2f seconds", maxDuration.Seconds())
-	} else {
-		Logc(ctx).WithField("resource", resource).Debug("Resource deleted.")
-		return nil
+	targets := []IscsiTarget{{
+		IQN:       publishInfo.IscsiTargetIQN,
+		Portals:   append([]string{publishInfo.IscsiTargetPortal}, publishInfo.IscsiPortals...),
+		LunNumber: publishInfo.IscsiLunNumber,
+	}}
+
+	for _, target := range publishInfo.IscsiAdditionalTargets {
+		duplicate := false
+		for _, existing := range targets {
+			duplicate = duplicate || existing.IQN == target.IQN
+		}
+		if !duplicate && target.IQN != "" && len(target.Portals) > 0 {
+			targets = append(targets, target)
+		}
 	}
+
+	return targets
 }
 
-// EnsureDirExists makes sure that given directory structure exists
-func EnsureDirExists(ctx context.Context, path string) error {
+// scanISCSITargetForLUN makes the LUN's devices on a target present with the expected serial number, rescanning
+// or purging stale devices as needed and scanning the target if the LUN isn't yet attached.
+func scanISCSITargetForLUN(ctx context.Context, lunID int, targetIQN, lunSerial string) error {
 
-	fields := log.Fields{
-		"path": path,
+	// First attempt to fix invalid serials by rescanning them
+	err := handleInvalidSerials(ctx, lunID, targetIQN, lunSerial, rescanOneLun)
+	if err != nil {
+		return err
 	}
-	if info, err := os.Stat(path); err == nil {
-		if !info.IsDir() {
-			Logc(ctx).WithFields(fields).Error("Path exists but is not a directory")
-			return fmt.Errorf("path exists but is not a directory: %s", path)
-		}
-		return nil
-	} else if !os.IsNotExist(err) {
-		Logc(ctx).WithFields(fields).Errorf("Can't determine if directory exists; %s", err)
-		return fmt.Errorf("can't determine if directory %s exists; %s", path, err)
+
+	// Then attempt to fix invalid serials by purging them (to be scanned
+	// again later)
+	err = handleInvalidSerials(ctx, lunID, targetIQN, lunSerial, purgeOneLun)
+	if err != nil {
+		return err
 	}
 
-	err := os.MkdirAll(path, 0755)
+	// If LUN isn't present, scan the target and wait for the device(s) to appear
+	// if not attached need to scan
+	shouldScan := !IsAlreadyAttached(ctx, lunID, targetIQN)
+	err = waitForDeviceScanIfNeeded(ctx, lunID, targetIQN, shouldScan)
 	if err != nil {
-		Logc(ctx).WithFields(fields).Errorf("Mkdir failed; %s", err)
-		return fmt.Errorf("failed to mkdir %s; %s", path, err)
+		Logc(ctx).Errorf("Could not find iSCSI device: %+v", err)
+		return err
 	}
 
-	return nil
+	// At this point if the serials are still invalid, give up so the
+	// caller can retry (invoking the remediation steps above in the
+	// process, if they haven't already been run).
+	failHandler := func(ctx context.Context, path string) error {
+		Logc(ctx).Error("Detected LUN serial number mismatch, attaching volume would risk data corruption, giving up")
+		return fmt.Errorf("LUN serial number mismatch, kernel has stale cached data")
+	}
+	return handleInvalidSerials(ctx, lunID, targetIQN, lunSerial, failHandler)
 }
 
-// getSysfsBlockDirsForLUN returns the list of directories in sysfs where the block devices should appear
-// after the scan is successful. One directory is returned for each path in the host session map.
-func getSysfsBlockDirsForLUN(lunID int, hostSessionMap map[int]int) []string {
+// verifyISCSITargetsShareMultipathDevice ensures that the devices found through each additional target belong to
+// the primary target's multipath device, so that the volume is never used through two independent devices.
+func verifyISCSITargetsShareMultipathDevice(
+	ctx context.Context, deviceInfo *ScsiDeviceInfo, additionalTargets []IscsiTarget,
+) error {
 
-	paths := make([]string, 0)
-	for hostNumber, sessionNumber := range hostSessionMap {
-		p := fmt.Sprintf(
-			chrootPathPrefix+"/sys/class/scsi_host/host%d/device/session%d/iscsi_session/session%d/device/target%d:0:0/%d:0:0:%d",
-			hostNumber, sessionNumber, sessionNumber, hostNumber, hostNumber, lunID)
-		paths = append(paths, p)
+	if len(additionalTargets) == 0 {
+		return nil
+	}
+	if deviceInfo.MultipathDevice == "" {
+		return fmt.Errorf("LUN is mapped through %d targets but no multipath device was found",
+			len(additionalTargets)+1)
 	}
-	return paths
-}
-
-// getDevicesForLUN find the /dev/sd* device names for an iSCSI LUN.
-func getDevicesForLUN(paths []string) ([]string, error) {
 
-	devices := make([]string, 0)
-	for _, p := range paths {
-		dirname := p + "/block"
-		if !PathExists(dirname) {
-			continue
-		}
-		dirFd, err := os.Open(dirname)
-		if err != nil {
-			return nil, err
-		}
-		list, err := dirFd.Readdir(1)
-		dirFd.Close()
+	for _, target := range additionalTargets {
+		targetDeviceInfo, err := getDeviceInfoForLUN(ctx, int(target.LunNumber), target.IQN, false)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("error getting iSCSI device information for target %s: %v", target.IQN, err)
+		} else if targetDeviceInfo == nil {
+			return fmt.Errorf("could not get iSCSI device information for LUN %d on target %s",
+				target.LunNumber, target.IQN)
 		}
-		if 0 == len(list) {
-			continue
+		if targetDeviceInfo.MultipathDevice != deviceInfo.MultipathDevice {
+			Logc(ctx).WithFields(log.Fields{
+				"targetIQN":             target.IQN,
+				"multipathDevice":       deviceInfo.MultipathDevice,
+				"targetMultipathDevice": targetDeviceInfo.MultipathDevice,
+				"targetDevices":         targetDeviceInfo.Devices,
+			}).Error("iSCSI target's paths are not part of the volume's multipath device.")
+			return fmt.Errorf("paths through target %s are not part of multipath device %s",
+				target.IQN, deviceInfo.MultipathDevice)
 		}
-		devices = append(devices, list[0].Name())
 	}
-	return devices, nil
+
+	return nil
 }
 
-// waitForDeviceScanIfNeeded scans all paths to a specific LUN and waits until all
-// SCSI disk-by-path devices for that LUN are present on the host.
-func waitForDeviceScanIfNeeded(ctx context.Context, lunID int, iSCSINodeName string, shouldScan bool) error {
+// ISCSILoginPolicy bounds how long Trident spends logging in to iSCSI portals and how many portals must
+// succeed for an attach to proceed.
+type ISCSILoginPolicy struct {
+	// LoginTimeout bounds each login attempt, both in the initiator and in the iscsiadm command itself
+	LoginTimeout time.Duration
+	// MaxAttempts is the number of times a login to a single portal is attempted
+	MaxAttempts int
+	// Quorum is the number of portals that must have sessions for an attach to proceed; zero means all
+	Quorum int
+}
 
-	fields := log.Fields{
-		"lunID":         lunID,
-		"iSCSINodeName": iSCSINodeName,
+var defaultISCSILoginPolicy = ISCSILoginPolicy{
+	LoginTimeout: 15 * time.Second,
+	MaxAttempts:  3,
+	Quorum:       0,
+}
+
+var iscsiLoginPolicy = defaultISCSILoginPolicy
+
+// SetISCSILoginPolicy sets the timeout, retry, and quorum policy applied to iSCSI portal logins.
+func SetISCSILoginPolicy(policy ISCSILoginPolicy) error {
+	if err := validateISCSILoginPolicy(policy); err != nil {
+		return err
 	}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.waitForDeviceScanIfNeeded")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.waitForDeviceScanIfNeeded")
+	iscsiLoginPolicy = policy
+	return nil
+}
 
-	hostSessionMap := GetISCSIHostSessionMapForTarget(ctx, iSCSINodeName)
-	if len(hostSessionMap) == 0 {
-		return fmt.Errorf("no iSCSI hosts found for target %s", iSCSINodeName)
+func validateISCSILoginPolicy(policy ISCSILoginPolicy) error {
+	if policy.LoginTimeout < time.Second {
+		return fmt.Errorf("invalid iSCSI login timeout: %v", policy.LoginTimeout)
+	}
+	if policy.MaxAttempts < 1 {
+		return fmt.Errorf("invalid iSCSI login attempts: %d", policy.MaxAttempts)
 	}
+	if policy.Quorum < 0 {
+		return fmt.Errorf("invalid iSCSI login quorum: %d", policy.Quorum)
+	}
+	return nil
+}
 
-	Logc(ctx).WithField("hostSessionMap", hostSessionMap).Debug("Built iSCSI host/session map.")
-	hosts := make([]int, 0)
-	for hostNumber := range hostSessionMap {
-		hosts = append(hosts, hostNumber)
+// loginISCSIPortals attempts a login to each of the supplied portals, retrying each up to the login policy's
+// attempt limit.  Every portal is attempted, but only the specified number of them must succeed.
+func loginISCSIPortals(ctx context.Context, portals []string, required int, login func(portal string) error) error {
+
+	logFields := log.Fields{
+		"portals":  portals,
+		"required": required,
 	}
+	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.loginISCSIPortals")
+	defer Logc(ctx).Debug("<<<< osutils.loginISCSIPortals")
 
-	if shouldScan {
-		if err := iSCSIScanTargetLUN(ctx, lunID, hosts); err != nil {
-			Logc(ctx).WithField("scanError", err).Error("Could not scan for new LUN.")
+	succeeded := 0
+	failures := make([]string, 0)
+
+	for _, portal := range portals {
+
+		attempt := func() error {
+			return login(portal)
 		}
-	}
 
-	paths := getSysfsBlockDirsForLUN(lunID, hostSessionMap)
-	Logc(ctx).Debugf("Scanning paths: %v", paths)
-	found := make([]string, 0)
+		attemptNotify := func(err error, duration time.Duration) {
+			Logc(ctx).WithFields(log.Fields{
+				"portal":    portal,
+				"increment": duration,
+				"error":     err,
+			}).Warn("iSCSI login failed, will retry.")
+		}
 
-	checkAllDevicesExist := func() error {
+		loginBackoff := newExponentialBackOff()
+		loginBackoff.InitialInterval = 1 * time.Second
+		loginBackoff.Multiplier = 1.414 // approx sqrt(2)
+		loginBackoff.RandomizationFactor = 0.1
+		loginBackoff.MaxElapsedTime = 0
 
-		found := make([]string, 0)
-		// Check if any paths present, and return nil (success) if so
-		for _, p := range paths {
-			dirname := p + "/block"
-			if !PathExists(dirname) {
-				return errors.New("device not present yet")
-			}
-			found = append(found, dirname)
+		retries := uint64(iscsiLoginPolicy.MaxAttempts - 1)
+		if err := retryNotify(attempt, backoff.WithMaxRetries(loginBackoff, retries), attemptNotify); err != nil {
+			Logc(ctx).WithFields(log.Fields{
+				"portal": portal,
+				"error":  err,
+			}).Error("Could not log in to iSCSI portal.")
+			failures = append(failures, fmt.Sprintf("%s: %v", portal, err))
+			continue
 		}
-		return nil
+		succeeded++
 	}
 
-	devicesNotify := func(err error, duration time.Duration) {
-		Logc(ctx).WithField("increment", duration).Debug("All devices not yet present, waiting.")
+	if succeeded < required {
+		return fmt.Errorf("logged in to %d of %d required iSCSI portals; %s",
+			succeeded, required, strings.Join(failures, "; "))
 	}
-
-	deviceBackoff := backoff.NewExponentialBackOff()
-	deviceBackoff.InitialInterval = 1 * time.Second
-	deviceBackoff.Multiplier = 1.414 // approx sqrt(2)
-	deviceBackoff.RandomizationFactor = 0.1
-	deviceBackoff.MaxElapsedTime = 5 * time.Second
-
-	if err := backoff.RetryNotify(checkAllDevicesExist, deviceBackoff, devicesNotify); err == nil {
-		Logc(ctx).Debugf("Paths found: %v", found)
-		return nil
+	if len(failures) > 0 {
+		Logc(ctx).WithFields(log.Fields{
+			"succeeded": succeeded,
+			"required":  required,
+			"failures":  failures,
+		}).Warn("Proceeding with a quorum of iSCSI portal logins.")
 	}
 
-	Logc(ctx).Debugf("Paths found so far: %v", found)
+	return nil
+}
 
-	checkAnyDeviceExists := func() error {
+// ISCSIScanPolicy determines how the LUNs of a target are found once this host logs in to it.
+type ISCSIScanPolicy string
 
-		found := make([]string, 0)
-		// Check if any paths present, and return nil (success) if so
-		for _, p := range paths {
-			dirname := p + "/block"
-			if PathExists(dirname) {
-				found = append(found, dirname)
-			}
-		}
-		if 0 == len(found) {
-			return errors.New("no devices present yet")
-		}
-		return nil
-	}
+const (
+	// ISCSIScanPolicyManual stops the initiator from scanning targets, so that only the LUNs being attached are
+	// scanned, by this package.  It's ignored by versions of open-iscsi too old to support it.
+	ISCSIScanPolicyManual ISCSIScanPolicy = "manual"
+	// ISCSIScanPolicyAuto lets the initiator scan every LUN of a target at login and as LUNs are mapped
+	ISCSIScanPolicyAuto ISCSIScanPolicy = "auto"
+)
 
-	devicesNotify = func(err error, duration time.Duration) {
-		Logc(ctx).WithField("increment", duration).Debug("No devices present yet, waiting.")
+var iscsiScanPolicy = ISCSIScanPolicyManual
+
+// manualScanSupportCheck records whether the installed open-iscsi supports manual scanning, once it's known
+type manualScanSupportCheck struct {
+	once      sync.Once
+	supported bool
+}
+
+var manualScanSupport = &manualScanSupportCheck{}
+
+func validateISCSIScanPolicy(policy ISCSIScanPolicy) error {
+	switch policy {
+	case ISCSIScanPolicyManual, ISCSIScanPolicyAuto:
+		return nil
+	default:
+		return fmt.Errorf("invalid iSCSI scan policy: %s", policy)
 	}
+}
 
-	deviceBackoff = backoff.NewExponentialBackOff()
-	deviceBackoff.InitialInterval = 1 * time.Second
-	deviceBackoff.Multiplier = 1.414 // approx sqrt(2)
-	deviceBackoff.RandomizationFactor = 0.1
-	deviceBackoff.MaxElapsedTime = (iSCSIDeviceDiscoveryTimeoutSecs - 5) * time.Second
+// effectiveISCSIScanPolicy returns the scan policy in effect on this host, which is automatic scanning if manual
+// scanning is configured but the installed open-iscsi can't honor it.
+func effectiveISCSIScanPolicy(ctx context.Context) ISCSIScanPolicy {
 
-	// Run the check/scan using an exponential backoff
-	if err := backoff.RetryNotify(checkAnyDeviceExists, deviceBackoff, devicesNotify); err != nil {
-		Logc(ctx).Warnf("Could not find all devices after %d seconds.", iSCSIDeviceDiscoveryTimeoutSecs)
+	if iscsiScanPolicy == ISCSIScanPolicyAuto {
+		return ISCSIScanPolicyAuto
+	}
 
-		// In the case of a failure, log info about what devices are present
-		if _, err := execCommand(ctx, "ls", "-al", "/dev"); err != nil {
-			Logc(ctx).Warnf("Could not run ls -al /dev: %v", err)
-		}
-		if _, err := execCommand(ctx, "ls", "-al", "/dev/mapper"); err != nil {
-			Logc(ctx).Warnf("Could not run ls -al /dev/mapper: %v", err)
-		}
-		if _, err := execCommand(ctx, "ls", "-al", "/dev/disk/by-path"); err != nil {
-			Logc(ctx).Warnf("Could not run ls -al /dev/disk/by-path: %v", err)
-		}
-		if _, err := execCommand(ctx, "lsscsi"); err != nil {
-			Logc(ctx).Warnf("Could not run lsscsi: %v", err)
-		}
-		if _, err := execCommand(ctx, "lsscsi", "-t"); err != nil {
-			Logc(ctx).Warnf("Could not run lsscsi -t: %v", err)
+	manualScanSupport.once.Do(func() {
+		out, err := execIscsiadmCommand(ctx, "-V")
+		if err != nil {
+			Logc(ctx).WithError(err).Warning("Could not get open-iscsi version; assuming manual scan is supported.")
+			manualScanSupport.supported = true
+			return
 		}
-		if _, err := execCommand(ctx, "free"); err != nil {
-			Logc(ctx).Warnf("Could not run free: %v", err)
+		manualScanSupport.supported = iscsi.VersionSupportsManualScan(string(out))
+		if !manualScanSupport.supported {
+			Logc(ctx).WithField("version", strings.TrimSpace(string(out))).Warning(
+				"Installed open-iscsi does not support manual scan; the initiator will scan targets itself.")
 		}
-		return err
-	}
+	})
 
-	Logc(ctx).Debugf("Paths found: %v", found)
-	return nil
+	if manualScanSupport.supported {
+		return ISCSIScanPolicyManual
+	}
+	return ISCSIScanPolicyAuto
 }
 
-// ScsiDeviceInfo contains information about SCSI devices
-type ScsiDeviceInfo struct {
-	Host            string
-	Channel         string
-	Target          string
-	LUN             string
-	Devices         []string
-	MultipathDevice string
-	Filesystem      string
-	IQN             string
-	HostSessionMap  map[int]int
+// applyISCSIScanPolicy sets the scan mode of a target's node record for a portal according to the scan policy.
+func applyISCSIScanPolicy(ctx context.Context, targetIQN, portal string) {
+	policy := effectiveISCSIScanPolicy(ctx)
+	if err := configureISCSITarget(ctx, targetIQN, portal, "node.session.scan", string(policy)); err != nil {
+		Logc(ctx).WithFields(log.Fields{
+			"targetIQN": targetIQN,
+			"portal":    portal,
+			"policy":    policy,
+		}).WithError(err).Debug("Could not set iSCSI scan mode.")
+	}
 }
 
-// getDeviceInfoForLUN finds iSCSI devices using /dev/disk/by-path values.  This method should be
-// called after calling waitForDeviceScanIfNeeded so that the device paths are known to exist.
-func getDeviceInfoForLUN(
-	ctx context.Context, lunID int, iSCSINodeName string, needFSType bool,
-) (*ScsiDeviceInfo, error) {
+// iscsiStartupKeys are the node record settings that decide whether iscsid logs in to a target as soon as it
+// starts, before this package has reconciled which targets are still in use
+var iscsiStartupKeys = []string{"node.startup", "node.conn[0].startup"}
 
-	fields := log.Fields{
-		"lunID":         lunID,
-		"iSCSINodeName": iSCSINodeName,
-		"needFSType":    needFSType,
+// applyManualISCSIStartup sets a target's node record for a portal to be logged in only when this package logs
+// in to it.  Otherwise a rebooted node logs in to every target it ever used, however stale, before the plugin
+// starts.
+func applyManualISCSIStartup(ctx context.Context, targetIQN, portal string) {
+	for _, key := range iscsiStartupKeys {
+		if err := configureISCSITarget(ctx, targetIQN, portal, key, "manual"); err != nil {
+			Logc(ctx).WithFields(log.Fields{
+				"targetIQN": targetIQN,
+				"portal":    portal,
+				"key":       key,
+			}).WithError(err).Warning("Could not set iSCSI startup mode to manual.")
+		}
 	}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.getDeviceInfoForLUN")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.getDeviceInfoForLUN")
+}
 
-	hostSessionMap := GetISCSIHostSessionMapForTarget(ctx, iSCSINodeName)
-	if len(hostSessionMap) == 0 {
-		return nil, fmt.Errorf("no iSCSI hosts found for target %s", iSCSINodeName)
-	}
+// EnsureManualISCSIStartup verifies that the node records of the supplied targets, which are those still in use,
+// are logged in to only by this package, and repairs any that aren't, as after a record was created by hand or by
+// an earlier release.  Records of other targets are left alone, since they may not belong to this package, but
+// those that would be logged in to at boot are counted in a warning.  The records that were repaired are returned.
+func EnsureManualISCSIStartup(ctx context.Context, trackedTargetIQNs []string) ([]ISCSINodeRecord, error) {
 
-	paths := getSysfsBlockDirsForLUN(lunID, hostSessionMap)
+	Logc(ctx).WithField("trackedTargetIQNs", trackedTargetIQNs).Debug(">>>> osutils.EnsureManualISCSIStartup")
+	defer Logc(ctx).Debug("<<<< osutils.EnsureManualISCSIStartup")
 
-	devices, err := getDevicesForLUN(paths)
-	if nil != err {
+	records, err := getISCSINodeRecords(ctx)
+	if err != nil {
 		return nil, err
-	} else if 0 == len(devices) {
-		return nil, fmt.Errorf("scan not completed for LUN %d on target %s", lunID, iSCSINodeName)
 	}
 
-	multipathDevice := ""
-	for _, device := range devices {
-		multipathDevice = findMultipathDeviceForDevice(ctx, device)
-		if multipathDevice != "" {
-			break
+	repaired := make([]ISCSINodeRecord, 0)
+	untrackedAutomatic := 0
+	for _, record := range records {
+
+		output, err := execIscsiadmCommand(ctx, "-m", "node", "-T", record.TargetName, "-p", record.Portal)
+		if err != nil {
+			Logc(ctx).WithFields(log.Fields{
+				"portal":    record.Portal,
+				"targetIQN": record.TargetName,
+			}).WithError(err).Warning("Could not read iSCSI node record.")
+			continue
+		}
+		settings := parseISCSIConfig(output)
+		manual := true
+		for _, key := range iscsiStartupKeys {
+			if value, ok := settings[key]; ok && value != "manual" {
+				manual = false
+			}
+		}
+		if manual {
+			continue
+		}
+
+		if !StringInSlice(record.TargetName, trackedTargetIQNs) {
+			untrackedAutomatic++
+			continue
 		}
+
+		applyManualISCSIStartup(ctx, record.TargetName, record.Portal)
+		repaired = append(repaired, record)
 	}
 
-	var devicePath string
-	if multipathDevice != "" {
-		devicePath = "/dev/" + multipathDevice
-	} else {
-		devicePath = "/dev/" + devices[0]
+	if untrackedAutomatic > 0 {
+		Logc(ctx).WithField("records", untrackedAutomatic).Warning(
+			"iSCSI node records of targets not in use are logged in to at boot; consider pruning them.")
+	}
+	if len(repaired) > 0 {
+		Logc(ctx).WithField("repaired", len(repaired)).Info("Set iSCSI node records to manual startup.")
 	}
 
-	err = ensureDeviceReadableWithRetry(ctx, devicePath)
-	if err != nil {
-		return nil, err
+	return repaired, nil
+}
+
+// defaultISCSIInterface is the iscsiadm interface that's built in, binding to no particular transport or NIC
+const defaultISCSIInterface = "default"
+
+// ISCSIInterface defines an iscsiadm interface, which binds iSCSI sessions to a transport and, optionally, to a
+// network interface or hardware address.
+type ISCSIInterface struct {
+	// Transport is the iSCSI transport, such as tcp, iser, or an offload driver like bnx2i or cxgb4i
+	Transport string
+	// NetInterface is the name of the network interface, such as eth1, through which sessions are made
+	NetInterface string
+	// HWAddress is the MAC address of the adapter through which sessions are made
+	HWAddress string
+}
+
+var iscsiInterfaces = make(map[string]ISCSIInterface)
+
+// ensureISCSIInterface verifies that an iscsiadm interface exists, creating it if it's missing and defined in this
+// package's configuration, and that its transport is loaded and any network interface it's bound to exists.
+func ensureISCSIInterface(ctx context.Context, name string) error {
+
+	if name == "" || name == defaultISCSIInterface {
+		return nil
 	}
 
-	fsType := ""
-	if needFSType {
+	fields := log.Fields{"iface": name}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.ensureISCSIInterface")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.ensureISCSIInterface")
 
-		fsType, err = getFSType(ctx, devicePath)
-		if err != nil {
-			return nil, err
+	record, err := getISCSIInterfaceRecord(ctx, name)
+	if err != nil {
+		definition, ok := iscsiInterfaces[name]
+		if !ok {
+			return fmt.Errorf("iSCSI interface %s does not exist on this host; %v", name, err)
+		}
+		if err = createISCSIInterface(ctx, name, definition); err != nil {
+			return err
+		}
+		if record, err = getISCSIInterfaceRecord(ctx, name); err != nil {
+			return fmt.Errorf("could not read iSCSI interface %s after creating it; %v", name, err)
 		}
 	}
 
-	Logc(ctx).WithFields(log.Fields{
-		"LUN":             strconv.Itoa(lunID),
-		"multipathDevice": multipathDevice,
-		"fsType":          fsType,
-		"deviceNames":     devices,
-		"hostSessionMap":  hostSessionMap,
-	}).Debug("Found SCSI device.")
-
-	info := &ScsiDeviceInfo{
-		LUN:             strconv.Itoa(lunID),
-		MultipathDevice: multipathDevice,
-		Devices:         devices,
-		Filesystem:      fsType,
-		IQN:             iSCSINodeName,
-		HostSessionMap:  hostSessionMap,
+	transport := record["iface.transport_name"]
+	if transport == "" {
+		return fmt.Errorf("iSCSI interface %s is not bound to a transport", name)
+	}
+	if definition, ok := iscsiInterfaces[name]; ok && definition.Transport != transport {
+		return fmt.Errorf("iSCSI interface %s is bound to transport %s rather than %s", name, transport,
+			definition.Transport)
+	}
+	if !PathExists(chrootPathPrefix + "/sys/class/iscsi_transport/" + transport) {
+		return fmt.Errorf("transport %s of iSCSI interface %s is not loaded", transport, name)
+	}
+	netIface := record["iface.net_ifacename"]
+	if netIface != "" && !PathExists(chrootPathPrefix+"/sys/class/net/"+netIface) {
+		return fmt.Errorf("network interface %s of iSCSI interface %s does not exist", netIface, name)
 	}
 
-	return info, nil
+	return nil
 }
 
-// getDeviceInfoForMountPath discovers the device that is currently mounted at the specified mount path.  It
-// uses the ScsiDeviceInfo struct so that it may return a multipath device (if any) plus one or more underlying
-// physical devices.
-func getDeviceInfoForMountPath(ctx context.Context, mountpath string) (*ScsiDeviceInfo, error) {
-
-	fields := log.Fields{"mountpath": mountpath}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.getDeviceInfoForMountPath")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.getDeviceInfoForMountPath")
+// getISCSIInterfaceRecord returns the settings of an iscsiadm interface, omitting those that are empty.
+func getISCSIInterfaceRecord(ctx context.Context, name string) (map[string]string, error) {
 
-	device, _, err := GetDeviceNameFromMount(ctx, mountpath)
+	out, err := execIscsiadmCommand(ctx, "-m", "iface", "-I", name)
 	if err != nil {
 		return nil, err
 	}
 
-	device, err = filepath.EvalSymlinks(device)
-	if err != nil {
-		return nil, err
+	/*
+	   # iscsiadm -m iface -I iface0
+	   # BEGIN RECORD 2.0-874
+	   iface.iscsi_ifacename = iface0
+	   iface.net_ifacename = eth1
+	   iface.hwaddress = <empty>
+	   iface.transport_name = tcp
+	   ...
+	   # END RECORD
+	*/
+	record := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if strings.HasPrefix(line, "#") || len(parts) != 2 {
+			continue
+		}
+		if value := strings.TrimSpace(parts[1]); value != "" && value != "<empty>" {
+			record[strings.TrimSpace(parts[0])] = value
+		}
 	}
+	return record, nil
+}
 
-	device = strings.TrimPrefix(device, "/dev/")
+// createISCSIInterface creates an iscsiadm interface from its definition.
+func createISCSIInterface(ctx context.Context, name string, definition ISCSIInterface) error {
 
-	var deviceInfo *ScsiDeviceInfo
+	Logc(ctx).WithFields(log.Fields{"iface": name, "definition": definition}).Info("Creating iSCSI interface.")
 
-	if !strings.HasPrefix(device, "dm-") {
-		deviceInfo = &ScsiDeviceInfo{
-			Devices: []string{device},
+	if _, err := execIscsiadmCommand(ctx, "-m", "iface", "-I", name, "-o", "new"); err != nil {
+		return fmt.Errorf("could not create iSCSI interface %s; %v", name, err)
+	}
+
+	settings := [][2]string{
+		{"iface.transport_name", definition.Transport},
+		{"iface.net_ifacename", definition.NetInterface},
+		{"iface.hwaddress", definition.HWAddress},
+	}
+	for _, setting := range settings {
+		if setting[1] == "" {
+			continue
 		}
-	} else {
-		deviceInfo = &ScsiDeviceInfo{
-			Devices:         findDevicesForMultipathDevice(ctx, device),
-			MultipathDevice: device,
+		if _, err := execIscsiadmCommand(ctx, "-m", "iface", "-I", name, "-o", "update",
+			"-n", setting[0], "-v", setting[1]); err != nil {
+			return fmt.Errorf("could not set %s of iSCSI interface %s; %v", setting[0], name, err)
 		}
 	}
-
-	Logc(ctx).WithFields(log.Fields{
-		"multipathDevice": deviceInfo.MultipathDevice,
-		"devices":         deviceInfo.Devices,
-	}).Debug("Found SCSI device.")
-
-	return deviceInfo, nil
+	return nil
 }
 
-// waitForMultipathDeviceForLUN
-func waitForMultipathDeviceForLUN(ctx context.Context, lunID int, iSCSINodeName string) error {
+// ensureISCSILogins logs in to each of the supplied portals that doesn't already have a session to the target
+// described by the publish info, using CHAP if the publish info calls for it.
+func ensureISCSILogins(ctx context.Context, publishInfo *VolumePublishInfo, targetIQN string, portals []string) error {
 
-	fields := log.Fields{
-		"lunID":         lunID,
-		"iSCSINodeName": iSCSINodeName,
+	var bkportal []string
+	for _, p := range portals {
+		bkportal = append(bkportal, formatPortal(p))
 	}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.waitForMultipathDeviceForLUN")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.waitForMultipathDeviceForLUN")
 
-	hostSessionMap := GetISCSIHostSessionMapForTarget(ctx, iSCSINodeName)
-	if len(hostSessionMap) == 0 {
-		return fmt.Errorf("no iSCSI hosts found for target %s", iSCSINodeName)
+	var iscsiInterface = publishInfo.IscsiInterface
+	if iscsiInterface == "" {
+		iscsiInterface = defaultISCSIInterface
 	}
 
-	paths := getSysfsBlockDirsForLUN(lunID, hostSessionMap)
+	// A misnamed or misconfigured interface would only fail each login after all its retries
+	if err := ensureISCSIInterface(ctx, iscsiInterface); err != nil {
+		return err
+	}
 
-	devices, err := getDevicesForLUN(paths)
-	if nil != err {
+	// Logins through portals this host can't reach only time out, so they neither count toward the quorum nor
+	// are attempted
+	bkportal = filterReachablePortals(ctx, bkportal)
+
+	bkPortalsToLogin, err := portalsToLogin(ctx, targetIQN, bkportal)
+	if err != nil {
 		return err
 	}
 
-	waitForMultipathDeviceForDevices(ctx, devices)
+	// Portals that already have sessions count toward the quorum
+	required := iscsiLoginPolicy.Quorum
+	if required == 0 || required > len(bkportal) {
+		required = len(bkportal)
+	}
+	required -= len(bkportal) - len(bkPortalsToLogin)
+	if required < 0 {
+		required = 0
+	}
+
+	if publishInfo.UseCHAP {
+		err = loginISCSIPortals(ctx, bkPortalsToLogin, required, func(portal string) error {
+			err := loginWithChap(
+				ctx, targetIQN, portal, publishInfo.IscsiUsername,
+				secretOrRef(publishInfo.IscsiInitiatorSecret, publishInfo.IscsiInitiatorSecretRef),
+				publishInfo.IscsiTargetUsername,
+				secretOrRef(publishInfo.IscsiTargetSecret, publishInfo.IscsiTargetSecretRef), iscsiInterface)
+			if err != nil {
+				Logc(ctx).Errorf("Failed to login with CHAP credentials: %+v ", err)
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("iSCSI login error: %v", err)
+		}
+		if err = verifyCHAPSessions(ctx, targetIQN, publishInfo.IscsiUsername, publishInfo.IscsiTargetUsername); err != nil {
+			return err
+		}
+	} else {
+		err = loginISCSIPortals(ctx, bkPortalsToLogin, required, func(portal string) error {
+			return ensureISCSISession(ctx, targetIQN, iscsiInterface, portal)
+		})
+		if err != nil {
+			return fmt.Errorf("iSCSI session error: %v", err)
+		}
+	}
+
 	return nil
 }
 
-// waitForMultipathDeviceForDevices accepts a list of sd* device names and waits until
-// a multipath device is present for at least one of those.  It returns the name of the
-// multipath device, or an empty string if multipathd isn't running or there is only one path.
-func waitForMultipathDeviceForDevices(ctx context.Context, devices []string) string {
+// AddISCSIPortals logs in to any portals in an updated portal list that don't yet have a session to the target,
+// then scans the target's already-attached LUNs on the new sessions so that multipathd adds the new paths to the
+// existing multipath devices.  Nothing is unmounted or remounted.
+func AddISCSIPortals(ctx context.Context, publishInfo *VolumePublishInfo, portals []string) error {
 
-	fields := log.Fields{"devices": devices}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.waitForMultipathDeviceForDevices")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.waitForMultipathDeviceForDevices")
+	targetIQN := publishInfo.IscsiTargetIQN
+	fields := log.Fields{"targetIQN": targetIQN, "portals": portals}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.AddISCSIPortals")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.AddISCSIPortals")
 
-	if len(devices) <= 1 {
-		Logc(ctx).Debugf("Skipping multipath discovery, %d device(s) specified.", len(devices))
-		return ""
-	} else if !multipathdIsRunning(ctx) {
-		Logc(ctx).Debug("Skipping multipath discovery, multipathd isn't running.")
-		return ""
+	if !ISCSISupported(ctx) {
+		return errors.New("unable to add portals: open-iscsi tools not found on host")
 	}
 
-	maxDuration := multipathDeviceDiscoveryTimeoutSecs * time.Second
-	multipathDevice := ""
+	// Note the LUNs already attached via this target, and the sessions they are attached through
+	devices, err := FindISCSIDevices(ctx, ISCSIDeviceFilter{IQN: targetIQN})
+	if err != nil {
+		return err
+	}
+	lunIDs := make(map[int]struct{})
+	multipathDevices := make(map[string]struct{})
+	for _, device := range devices {
+		if lunID, err := strconv.Atoi(device.LUN); err == nil {
+			lunIDs[lunID] = struct{}{}
+		}
+		if device.MultipathDevice != "" {
+			multipathDevices[device.MultipathDevice] = struct{}{}
+		}
+	}
+	oldHostSessionMap := GetISCSIHostSessionMapForTarget(ctx, targetIQN)
 
-	checkMultipathDeviceExists := func() error {
+	if err = ensureISCSILogins(ctx, publishInfo, targetIQN, portals); err != nil {
+		return err
+	}
 
-		for _, device := range devices {
-			multipathDevice = findMultipathDeviceForDevice(ctx, device)
-			if multipathDevice != "" {
-				return nil
-			}
-		}
-		if multipathDevice == "" {
-			return errors.New("multipath device not yet present")
+	newHosts := make([]int, 0)
+	for hostNumber := range GetISCSIHostSessionMapForTarget(ctx, targetIQN) {
+		if _, ok := oldHostSessionMap[hostNumber]; !ok {
+			newHosts = append(newHosts, hostNumber)
 		}
+	}
+	if len(newHosts) == 0 {
+		Logc(ctx).WithFields(fields).Debug("No new iSCSI sessions established.")
 		return nil
 	}
 
-	deviceNotify := func(err error, duration time.Duration) {
-		Logc(ctx).WithField("increment", duration).Debug("Multipath device not yet present, waiting.")
+	for lunID := range lunIDs {
+		if err = iSCSIScanTargetLUN(ctx, lunID, newHosts); err != nil {
+			Logc(ctx).WithFields(log.Fields{"lunID": lunID, "hosts": newHosts}).WithError(err).Error(
+				"Could not scan for LUN on new sessions.")
+			return err
+		}
 	}
 
-	multipathDeviceBackoff := backoff.NewExponentialBackOff()
-	multipathDeviceBackoff.InitialInterval = 1 * time.Second
-	multipathDeviceBackoff.Multiplier = 1.414 // approx sqrt(2)
-	multipathDeviceBackoff.RandomizationFactor = 0.1
-	multipathDeviceBackoff.MaxElapsedTime = maxDuration
-
-	// Run the check/scan using an exponential backoff
-	if err := backoff.RetryNotify(checkMultipathDeviceExists, multipathDeviceBackoff, deviceNotify); err != nil {
-		Logc(ctx).Warnf("Could not find multipath device after %3.2f seconds.", maxDuration.Seconds())
-	} else {
-		Logc(ctx).WithField("multipathDevice", multipathDevice).Debug("Multipath device found.")
+	// Give udev a chance to create the new devices, then make sure multipathd picks them up
+	clock.Sleep(time.Second)
+	for multipathDevice := range multipathDevices {
+		if err = reloadMultipathDevice(ctx, multipathDevice); err != nil {
+			Logc(ctx).WithField("multipathDevice", multipathDevice).Warning(
+				"Could not reload multipath device after adding portals.")
+		}
 	}
-	return multipathDevice
-}
+	reapplySCSITimeouts(ctx)
 
-// waitForDevice accepts a device name and waits until it is present and returns error if it times out
-func waitForDevice(ctx context.Context, device string) error {
+	Logc(ctx).WithFields(log.Fields{
+		"targetIQN": targetIQN,
+		"newHosts":  newHosts,
+		"luns":      len(lunIDs),
+	}).Info("Added new iSCSI portals to attached LUNs.")
 
-	fields := log.Fields{"device": device}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.waitForDevice")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.waitForDevice")
+	return nil
+}
 
-	maxDuration := multipathDeviceDiscoveryTimeoutSecs * time.Second
+// MigrateISCSITarget moves an attached LUN from its current target to a destination target without unmounting it,
+// as when a volume is moved between SVMs.  The LUN is attached through the destination target, and once its paths
+// have joined the LUN's multipath device, the paths through the source target are removed and the source target is
+// logged out if no other devices use it.  On success, the publish info describes the destination target.
+func MigrateISCSITarget(ctx context.Context, publishInfo *VolumePublishInfo, destination IscsiTarget) error {
 
-	checkDeviceExists := func() error {
-		if !PathExists(device) {
-			return errors.New("device not yet present")
-		}
-		return nil
+	source := getISCSITargets(publishInfo)[0]
+	fields := log.Fields{
+		"lunID":             source.LunNumber,
+		"sourceTarget":      source.IQN,
+		"destinationTarget": destination.IQN,
 	}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.MigrateISCSITarget")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.MigrateISCSITarget")
 
-	deviceNotify := func(err error, duration time.Duration) {
-		Logc(ctx).WithField("increment", duration).Debug("Device not yet present, waiting.")
+	if destination.IQN == "" || len(destination.Portals) == 0 {
+		return errors.New("destination target must have an IQN and at least one portal")
+	}
+	if destination.IQN == source.IQN {
+		return fmt.Errorf("LUN is already attached through target %s", source.IQN)
+	}
+	if !ISCSISupported(ctx) {
+		return errors.New("unable to migrate target: open-iscsi tools not found on host")
 	}
 
-	deviceBackoff := backoff.NewExponentialBackOff()
-	deviceBackoff.InitialInterval = 1 * time.Second
-	deviceBackoff.Multiplier = 1.414 // approx sqrt(2)
-	deviceBackoff.RandomizationFactor = 0.1
-	deviceBackoff.MaxElapsedTime = maxDuration
+	sourceDeviceInfo, err := getDeviceInfoForLUN(ctx, int(source.LunNumber), source.IQN, false)
+	if err != nil {
+		return fmt.Errorf("error getting iSCSI device information: %v", err)
+	} else if sourceDeviceInfo == nil {
+		return fmt.Errorf("could not get iSCSI device information for LUN %d", source.LunNumber)
+	} else if sourceDeviceInfo.MultipathDevice == "" {
+		return errors.New("cannot migrate a LUN that is not attached through a multipath device")
+	}
 
-	// Run the check using an exponential backoff
-	if err := backoff.RetryNotify(checkDeviceExists, deviceBackoff, deviceNotify); err != nil {
-		return fmt.Errorf("could not find device after %3.2f seconds", maxDuration.Seconds())
-	} else {
-		Logc(ctx).WithField("device", device).Debug("Device found.")
-		return nil
+	// Attach the LUN through the destination target
+	if err = ensureISCSILogins(ctx, publishInfo, destination.IQN, destination.Portals); err != nil {
+		return err
+	}
+	if err = scanISCSITargetForLUN(
+		ctx, int(destination.LunNumber), destination.IQN, publishInfo.IscsiLunSerial); err != nil {
+		return err
 	}
-}
 
-// findMultipathDeviceForDevice finds the devicemapper parent of a device name like /dev/sdx.
-func findMultipathDeviceForDevice(ctx context.Context, device string) string {
+	// Wait for the destination paths to join the multipath device, leaving the source paths untouched otherwise
+	joined := func() error {
+		return verifyISCSITargetsShareMultipathDevice(ctx, sourceDeviceInfo, []IscsiTarget{destination})
+	}
+	joinNotify := func(err error, duration time.Duration) {
+		Logc(ctx).WithFields(log.Fields{
+			"increment": duration,
+			"error":     err,
+		}).Debug("Destination paths have not yet joined the multipath device.")
+		_ = reloadMultipathDevice(ctx, sourceDeviceInfo.MultipathDevice)
+	}
+	joinBackoff := newExponentialBackOff()
+	joinBackoff.InitialInterval = time.Second
+	joinBackoff.Multiplier = 1.414 // approx sqrt(2)
+	joinBackoff.RandomizationFactor = 0.1
+	joinBackoff.MaxElapsedTime = targetMigrationJoinTimeoutSecs * time.Second
+
+	if err = retryNotify(joined, joinBackoff, joinNotify); err != nil {
+		Logc(ctx).WithFields(fields).WithError(err).Error(
+			"Destination paths did not join the multipath device; source paths were left in place.")
+		return err
+	}
 
-	Logc(ctx).WithField("device", device).Debug(">>>> osutils.findMultipathDeviceForDevice")
-	defer Logc(ctx).WithField("device", device).Debug("<<<< osutils.findMultipathDeviceForDevice")
+	// Gracefully remove the source paths from the multipath device, then from the host
+	for _, device := range sourceDeviceInfo.Devices {
+		if err = removeMultipathPath(ctx, device); err != nil {
+			return err
+		}
+	}
+	if err = removeDevice(ctx, &ScsiDeviceInfo{Devices: sourceDeviceInfo.Devices}, false); err != nil {
+		return err
+	}
 
-	holdersDir := chrootPathPrefix + "/sys/block/" + device + "/holders"
-	if dirs, err := ioutil.ReadDir(holdersDir); err == nil {
-		for _, f := range dirs {
-			name := f.Name()
-			if strings.HasPrefix(name, "dm-") {
-				return name
+	// Log out of the source target unless other devices are still attached through it
+	sourceInUse := false
+	if devices, err := FindISCSIDevices(ctx, ISCSIDeviceFilter{IQN: source.IQN}); err != nil {
+		Logc(ctx).WithError(err).Warning("Could not list iSCSI devices; not logging out of source target.")
+		sourceInUse = true
+	} else {
+		sourceInUse = len(devices) > 0
+	}
+	if !sourceInUse {
+		for _, portal := range source.Portals {
+			if err := ISCSILogout(ctx, source.IQN, portal); err != nil {
+				Logc(ctx).WithField("portal", portal).WithError(err).Warning("Could not log out of source portal.")
 			}
 		}
 	}
 
-	Logc(ctx).WithField("device", device).Debug("Could not find multipath device for device.")
-	return ""
+	// The destination is now the volume's primary target
+	publishInfo.IscsiTargetIQN = destination.IQN
+	publishInfo.IscsiTargetPortal = destination.Portals[0]
+	publishInfo.IscsiPortals = append([]string{}, destination.Portals[1:]...)
+	publishInfo.IscsiLunNumber = destination.LunNumber
+	additionalTargets := make([]IscsiTarget, 0)
+	for _, target := range publishInfo.IscsiAdditionalTargets {
+		if target.IQN != destination.IQN {
+			additionalTargets = append(additionalTargets, target)
+		}
+	}
+	publishInfo.IscsiAdditionalTargets = additionalTargets
+
+	// The LUN's timeout profile follows it to the destination target
+	forgetSCSITimeouts(ctx, &ScsiDeviceInfo{IQN: source.IQN, LUN: strconv.Itoa(int(source.LunNumber))})
+	if err = TrackSCSITimeouts(ctx, publishInfo); err != nil {
+		Logc(ctx).WithError(err).Warning("Could not set SCSI timeouts of LUN's destination paths.")
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"multipathDevice":   sourceDeviceInfo.MultipathDevice,
+		"sourceTarget":      source.IQN,
+		"destinationTarget": destination.IQN,
+		"sourceLoggedOut":   !sourceInUse,
+	}).Info("Migrated iSCSI LUN to destination target.")
+
+	return nil
 }
 
-// findDevicesForMultipathDevice finds the constituent devices for a devicemapper parent device like /dev/dm-0.
-func findDevicesForMultipathDevice(ctx context.Context, device string) []string {
+// iscsiSessionMonitor periodically checks the health of all iSCSI sessions, catching sessions that iscsiadm still
+// lists as active but that are failed in the kernel or accumulating errors.
+type iscsiSessionMonitor struct {
+	lock     sync.RWMutex
+	health   map[string]ISCSISessionHealth
+	stopChan chan struct{}
+}
 
-	Logc(ctx).WithField("device", device).Debug(">>>> osutils.findDevicesForMultipathDevice")
-	defer Logc(ctx).WithField("device", device).Debug("<<<< osutils.findDevicesForMultipathDevice")
+var sessionMonitor = &iscsiSessionMonitor{health: make(map[string]ISCSISessionHealth)}
 
-	devices := make([]string, 0)
+// StartISCSISessionMonitor starts checking iSCSI session health at the configured interval, calling onUpdate (if
+// not nil) with the results of each check.  It does nothing if the monitor is disabled or already running.
+func StartISCSISessionMonitor(ctx context.Context, onUpdate func([]ISCSISessionHealth)) {
 
-	slavesDir := chrootPathPrefix + "/sys/block/" + device + "/slaves"
-	if dirs, err := ioutil.ReadDir(slavesDir); err == nil {
-		for _, f := range dirs {
-			name := f.Name()
-			if strings.HasPrefix(name, "sd") {
-				devices = append(devices, name)
+	sessionMonitor.lock.Lock()
+	defer sessionMonitor.lock.Unlock()
+
+	// The goroutine is given the interval, since Init may change it before the goroutine runs
+	interval := sessionMonitorInterval
+	if interval == 0 || sessionMonitor.stopChan != nil {
+		return
+	}
+	stopChan := make(chan struct{})
+	sessionMonitor.stopChan = stopChan
+
+	Logc(ctx).WithField("interval", interval).Info("Starting iSCSI session monitor.")
+
+	go func(interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-ticker.C:
+				var health []ISCSISessionHealth
+				_, _ = RunHostOperation(ctx, HostOperationDiagnostics, "", func() (interface{}, error) {
+					health = sessionMonitor.check(ctx)
+					// Paths restored by session recovery may be new devices without their LUN's timeouts
+					reapplySCSITimeouts(ctx)
+					return nil, nil
+				})
+				if onUpdate != nil {
+					onUpdate(health)
+				}
 			}
 		}
-	}
+	}(interval)
+}
 
-	if len(devices) == 0 {
-		Logc(ctx).WithField("device", device).Debug("Could not find devices for multipath device.")
-	} else {
-		Logc(ctx).WithFields(log.Fields{
-			"device":  device,
-			"devices": devices,
-		}).Debug("Found devices for multipath device.")
-	}
+// StopISCSISessionMonitor stops the iSCSI session monitor if it is running.
+func StopISCSISessionMonitor() {
 
-	return devices
+	sessionMonitor.lock.Lock()
+	defer sessionMonitor.lock.Unlock()
+
+	if sessionMonitor.stopChan != nil {
+		close(sessionMonitor.stopChan)
+		sessionMonitor.stopChan = nil
+	}
 }
 
-// PrepareDeviceForRemoval informs Linux that a device will be removed.
-func PrepareDeviceForRemoval(ctx context.Context, lunID int, iSCSINodeName string, force bool) error {
+// GetISCSISessionHealth returns the health of each iSCSI session as of the session monitor's most recent check,
+// and whether the monitor is running.  Sessions are never checked here, so that callers such as the metrics
+// endpoint can't make this host run iscsiadm on demand.
+func GetISCSISessionHealth() ([]ISCSISessionHealth, bool) {
 
-	fields := log.Fields{
-		"lunID":            lunID,
-		"iSCSINodeName":    iSCSINodeName,
-		"chrootPathPrefix": chrootPathPrefix,
-	}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.PrepareDeviceForRemoval")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.PrepareDeviceForRemoval")
+	sessionMonitor.lock.RLock()
+	defer sessionMonitor.lock.RUnlock()
 
-	deviceInfo, err := getDeviceInfoForLUN(ctx, lunID, iSCSINodeName, false)
-	if err != nil {
-		Logc(ctx).WithFields(log.Fields{
-			"error": err,
-			"lunID": lunID,
-		}).Warn("Could not get device info for removal, skipping host removal steps.")
-		return err
+	health := make([]ISCSISessionHealth, 0, len(sessionMonitor.health))
+	for _, sessionHealth := range sessionMonitor.health {
+		health = append(health, sessionHealth)
 	}
-
-	return removeSCSIDevice(ctx, deviceInfo, force)
+	sort.Slice(health, func(i, j int) bool { return health[i].SID < health[j].SID })
+	return health, sessionMonitor.stopChan != nil
 }
 
-// PrepareDeviceAtMountPathForRemoval informs Linux that a device will be removed.
-func PrepareDeviceAtMountPathForRemoval(ctx context.Context, mountpoint string, unmount, force bool) error {
-
-	fields := log.Fields{"mountpoint": mountpoint}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.PrepareDeviceAtMountPathForRemoval")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.PrepareDeviceAtMountPathForRemoval")
+// check reads the state and error counters of each session, compares the counters with those of the previous
+// check, and records the results.
+func (m *iscsiSessionMonitor) check(ctx context.Context) []ISCSISessionHealth {
 
-	deviceInfo, err := getDeviceInfoForMountPath(ctx, mountpoint)
+	sessions, err := getISCSISessionStates(ctx)
 	if err != nil {
-		return err
+		Logc(ctx).WithError(err).Debug("Could not read iSCSI session states.")
 	}
 
-	if unmount {
-		if err := Umount(ctx, mountpoint); err != nil {
-			return err
+	now := time.Now()
+	for i := range sessions {
+		stats, err := getISCSISessionStats(ctx, sessions[i].SID)
+		if err != nil {
+			Logc(ctx).WithField("SID", sessions[i].SID).WithError(err).Debug(
+				"Could not read iSCSI session statistics.")
+		}
+		sessions[i].TimeoutErrors = stats["timeout_err"]
+		sessions[i].DigestErrors = stats["digest_err"]
+		sessions[i].FormatErrors = stats["format_err"]
+		sessions[i].TxBytes = stats["txdata_octets"]
+		sessions[i].RxBytes = stats["rxdata_octets"]
+		sessions[i].CheckedAt = now
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	health := make(map[string]ISCSISessionHealth, len(sessions))
+	for _, session := range sessions {
+		previous, ok := m.health[session.SID]
+		if ok && previous.TargetIQN != session.TargetIQN {
+			// The session ID was reused for a different session
+			ok = false
 		}
+		session = evaluateISCSISessionHealth(session, previous, ok)
+		if !session.Healthy {
+			Logc(ctx).WithFields(log.Fields{
+				"SID":       session.SID,
+				"targetIQN": session.TargetIQN,
+				"portal":    session.Portal,
+				"reason":    session.Reason,
+			}).Warning("Unhealthy iSCSI session.")
+		}
+		health[session.SID] = session
 	}
+	m.health = health
 
-	return removeSCSIDevice(ctx, deviceInfo, force)
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].SID < sessions[j].SID })
+	for i := range sessions {
+		sessions[i] = health[sessions[i].SID]
+	}
+	return sessions
 }
 
-// removeSCSIDevice informs Linux that a device will be removed.  The deviceInfo provided only needs
-// the devices and multipathDevice fields set.
-// IMPORTANT: The force argument has significant ramifications. Setting force=true will cause
-// the function to ignore errors, and try as hard as possible to remove the device, even if
-// that results in data loss, data corruption, or putting the system into an invalid state.
-// Setting force=false will fail at the first problem encountered, so that callers can be
-// assured that a successful return indicates that the device was cleanly removed.
-// This is important because while most of the time the top priority is to avoid data
-// loss or data corruption, there are times when data loss is unavoidable, or has already
-// happened, and in those cases it's better to be able to clean up than to be stuck in an
-// endless retry loop.
-func removeSCSIDevice(ctx context.Context, deviceInfo *ScsiDeviceInfo, force bool) error {
-
-	listAllISCSIDevices(ctx)
+// evaluateISCSISessionHealth decides whether a session is healthy from its kernel state, its connection's state,
+// and whether its error counters grew since the previous check, if there was one.  It also carries the count of
+// connection failures forward from the previous check.
+func evaluateISCSISessionHealth(
+	current, previous ISCSISessionHealth, hasPrevious bool,
+) ISCSISessionHealth {
 
-	// Flush multipath device
-	err := multipathFlushDevice(ctx, deviceInfo)
-	if nil != err && !force {
-		return err
+	connected := func(session ISCSISessionHealth) bool {
+		return session.State == "LOGGED_IN" && (session.ConnectionState == "" || session.ConnectionState == "up")
 	}
-
-	// Flush devices
-	err = flushDevice(ctx, deviceInfo, force)
-	if nil != err && !force {
-		return err
+	if hasPrevious {
+		current.ConnectionFailures = previous.ConnectionFailures
+		if connected(previous) && !connected(current) {
+			current.ConnectionFailures++
+		}
 	}
 
-	// Remove device
-	err = removeDevice(ctx, deviceInfo, force)
-	if nil != err && !force {
-		return err
+	var reasons []string
+	if current.State != "LOGGED_IN" {
+		reasons = append(reasons, fmt.Sprintf("session state is %s", current.State))
 	}
-
-	// Give the host a chance to fully process the removal
-	time.Sleep(time.Second)
-	listAllISCSIDevices(ctx)
-
-	return nil
-}
-
-// ISCSISupported returns true if iscsiadm is installed and in the PATH.
-func ISCSISupported(ctx context.Context) bool {
-
-	Logc(ctx).Debug(">>>> osutils.ISCSISupported")
-	defer Logc(ctx).Debug("<<<< osutils.ISCSISupported")
-
-	_, err := execIscsiadmCommand(ctx, "-V")
-	if err != nil {
-		Logc(ctx).Debug("iscsiadm tools not found on this host.")
-		return false
+	if current.ConnectionState != "" && current.ConnectionState != "up" {
+		reasons = append(reasons, fmt.Sprintf("connection state is %s", current.ConnectionState))
+	}
+	if hasPrevious && current.TimeoutErrors > previous.TimeoutErrors {
+		reasons = append(reasons, fmt.Sprintf("%d new timeout errors", current.TimeoutErrors-previous.TimeoutErrors))
+	}
+	if hasPrevious && current.DigestErrors > previous.DigestErrors {
+		reasons = append(reasons, fmt.Sprintf("%d new digest errors", current.DigestErrors-previous.DigestErrors))
 	}
-	return true
-}
 
-// ISCSIDiscoveryInfo contains information about discovered iSCSI targets.
-type ISCSIDiscoveryInfo struct {
-	Portal     string
-	PortalIP   string
-	TargetName string
+	current.Healthy = len(reasons) == 0
+	current.Reason = strings.Join(reasons, ", ")
+	return current
 }
 
-// iSCSIDiscovery uses the 'iscsiadm' command to perform discovery.
-func iSCSIDiscovery(ctx context.Context, portal string) ([]ISCSIDiscoveryInfo, error) {
-
-	Logc(ctx).WithField("portal", portal).Debug(">>>> osutils.iSCSIDiscovery")
-	defer Logc(ctx).Debug("<<<< osutils.iSCSIDiscovery")
+// getISCSISessionStates reads the state of each iSCSI session and its connection from sysfs.
+func getISCSISessionStates(ctx context.Context) ([]ISCSISessionHealth, error) {
 
-	out, err := execIscsiadmCommand(ctx, "-m", "discovery", "-t", "sendtargets", "-p", portal)
+	sysPath := chrootPathPrefix + "/sys/class/iscsi_session/"
+	sessionDirs, err := ioutil.ReadDir(sysPath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return []ISCSISessionHealth{}, nil
+		}
 		return nil, err
 	}
 
-	/*
-	   iscsiadm -m discovery -t st -p 10.63.152.249:3260
-
-	   10.63.152.249:3260,1 iqn.1992-08.com.netapp:2752.600a0980006074c20000000056b32c4d
-	   10.63.152.250:3260,2 iqn.1992-08.com.netapp:2752.600a0980006074c20000000056b32c4d
+	readAttribute := func(path string) string {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(content))
+	}
 
-	   a[0]==10.63.152.249:3260,1
-	   a[1]==iqn.1992-08.com.netapp:2752.600a0980006074c20000000056b32c4d
+	sessions := make([]ISCSISessionHealth, 0)
+	for _, sessionDir := range sessionDirs {
 
-	   For IPv6
-	   [fd20:8b1e:b258:2000:f816:3eff:feec:2]:3260,1038 iqn.1992-08.com.netapp:sn.7894d7af053711ea88b100a0b886136a
+		sessionName := sessionDir.Name()
+		sid := strings.TrimPrefix(sessionName, "session")
+		if !strings.HasPrefix(sessionName, "session") || sid == "" {
+			continue
+		}
 
-	   a[0]==[fd20:8b1e:b258:2000:f816:3eff:feec:2]:3260,1038
-	   a[1]==iqn.1992-08.com.netapp:sn.7894d7af053711ea88b100a0b886136a
-	*/
+		session := ISCSISessionHealth{
+			SID:       sid,
+			TargetIQN: readAttribute(sysPath + sessionName + "/targetname"),
+			State:     readAttribute(sysPath + sessionName + "/state"),
+		}
 
-	var discoveryInfo []ISCSIDiscoveryInfo
+		// Older kernels don't report the connection state
+		connectionPath := chrootPathPrefix + "/sys/class/iscsi_connection/connection" + sid + ":0/"
+		session.ConnectionState = readAttribute(connectionPath + "state")
+		if address := readAttribute(connectionPath + "persistent_address"); address != "" {
+			session.Portal = net.JoinHostPort(address, readAttribute(connectionPath+"persistent_port"))
+		}
 
-	lines := strings.Split(string(out), "\n")
-	for _, l := range lines {
-		a := strings.Fields(l)
-		if len(a) >= 2 {
+		sessions = append(sessions, session)
+	}
 
-			portalIP := ""
-			if IPv6Check(a[0]) {
-				// This is an IPv6 address
-				portalIP = strings.Split(a[0], "]")[0]
-				portalIP += "]"
-			} else {
-				portalIP = strings.Split(a[0], ":")[0]
-			}
+	return sessions, nil
+}
 
-			discoveryInfo = append(discoveryInfo, ISCSIDiscoveryInfo{
-				Portal:     a[0],
-				PortalIP:   portalIP,
-				TargetName: a[1],
-			})
+// getISCSISessionStats returns the cumulative statistics of an iSCSI session, such as timeout_err and
+// txdata_octets, by name.
+func getISCSISessionStats(ctx context.Context, sid string) (map[string]uint64, error) {
 
-			Logc(ctx).WithFields(log.Fields{
-				"Portal":     a[0],
-				"PortalIP":   portalIP,
-				"TargetName": a[1],
-			}).Debug("Adding iSCSI discovery info.")
-		}
+	out, err := execCommandWithTimeout(ctx, "iscsiadm", 5, false, "-m", "session", "-r", sid, "-s")
+	if err != nil {
+		return map[string]uint64{}, err
 	}
-	return discoveryInfo, nil
+	return iscsi.ParseSessionStats(string(out)), nil
 }
 
-// ISCSISessionInfo contains information about iSCSI sessions.
-type ISCSISessionInfo struct {
-	SID        string
-	Portal     string
-	PortalIP   string
-	TargetName string
+// DFInfo data structure for wrapping the parsed output from the 'df' command
+type DFInfo struct {
+	Target string
+	Source string
 }
 
-// getISCSISessionInfo parses output from 'iscsiadm -m session' and returns the parsed output.
-func getISCSISessionInfo(ctx context.Context) ([]ISCSISessionInfo, error) {
+// GetDFOutput returns parsed DF output
+func GetDFOutput(ctx context.Context) ([]DFInfo, error) {
 
-	Logc(ctx).Debug(">>>> osutils.getISCSISessionInfo")
-	defer Logc(ctx).Debug("<<<< osutils.getISCSISessionInfo")
+	Logc(ctx).Debug(">>>> osutils.GetDFOutput")
+	defer Logc(ctx).Debug("<<<< osutils.GetDFOutput")
 
-	out, err := execIscsiadmCommand(ctx, "-m", "session")
+	// Mounts are listed natively where possible, so that hosts without df are supported
+	mounted, nativeErr := getMountedFilesystems(ctx)
+	if nativeErr == nil {
+		return mounted, nil
+	}
+	Logc(ctx).WithError(nativeErr).Debug("Could not list mounted filesystems natively, running df.")
+
+	var result []DFInfo
+	out, err := execCommand(ctx, "df", "--output=target,source")
 	if err != nil {
-		exitErr, ok := err.(*exec.ExitError)
-		if ok && exitErr.ProcessState.Sys().(syscall.WaitStatus).ExitStatus() == iSCSIErrNoObjsFound {
-			Logc(ctx).Debug("No iSCSI session found.")
-			return []ISCSISessionInfo{}, nil
-		} else {
-			Logc(ctx).WithField("error", err).Error("Problem checking iSCSI sessions.")
+		// df returns an error if there's a stale file handle that we can
+		// safely ignore. There may be other reasons. Consider it a warning if
+		// it printed anything to stdout.
+		if len(out) == 0 {
+			Logc(ctx).Error("Error encountered gathering df output.")
 			return nil, err
 		}
 	}
 
-	/*
-	   # iscsiadm -m session
-
-	   tcp: [3] 10.0.207.7:3260,1028 iqn.1992-08.com.netapp:sn.afbb1784f77411e582f8080027e22798:vs.3 (non-flash)
-	   tcp: [4] 10.0.207.9:3260,1029 iqn.1992-08.com.netapp:sn.afbb1784f77411e582f8080027e22798:vs.3 (non-flash)
-
-	   a[0]==tcp:
-	   a[1]==[4]
-	   a[2]==10.0.207.9:3260,1029
-	   a[3]==iqn.1992-08.com.netapp:sn.afbb1784f77411e582f8080027e22798:vs.3
-	   a[4]==(non-flash)
-	*/
-
-	var sessionInfo []ISCSISessionInfo
-
 	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
 	for _, l := range lines {
 
 		a := strings.Fields(l)
-		if len(a) > 3 {
-			sid := a[1]
-			sid = sid[1 : len(sid)-1]
-
-			portalIP := ""
-			if IPv6Check(a[2]) {
-				// This is an IPv6 address
-				portalIP = strings.Split(a[2], "]")[0]
-				portalIP += "]"
-			} else {
-				portalIP = strings.Split(a[2], ":")[0]
-			}
-
-			sessionInfo = append(sessionInfo, ISCSISessionInfo{
-				SID:        sid,
-				Portal:     a[2],
-				PortalIP:   portalIP,
-				TargetName: a[3],
+		if len(a) > 1 {
+			result = append(result, DFInfo{
+				Target: a[0],
+				Source: a[1],
 			})
-
-			Logc(ctx).WithFields(log.Fields{
-				"SID":        sid,
-				"Portal":     a[2],
-				"PortalIP":   portalIP,
-				"TargetName": a[3],
-			}).Debug("Adding iSCSI session info.")
 		}
 	}
-
-	return sessionInfo, nil
-}
-
-// ISCSILogout logs out from the supplied target
-func ISCSILogout(ctx context.Context, targetIQN, targetPortal string) error {
-
-	logFields := log.Fields{
-		"targetIQN":    targetIQN,
-		"targetPortal": targetPortal,
-	}
-	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.ISCSILogout")
-	defer Logc(ctx).WithFields(logFields).Debug("<<<< osutils.ISCSILogout")
-
-	defer listAllISCSIDevices(ctx)
-	if _, err := execIscsiadmCommand(ctx, "-m", "node", "-T", targetIQN, "--portal", targetPortal, "-u"); err != nil {
-		Logc(ctx).WithField("error", err).Debug("Error during iSCSI logout.")
+	if len(result) > 1 {
+		return result[1:], nil
 	}
-
-	// We used to delete the iscsi "node" at this point but that could interfere with
-	// another iSCSI client (such as kubelet with and "iscsi" PV) attempting to use
-	// the same node.
-
-	listAllISCSIDevices(ctx)
-	return nil
+	return result, nil
 }
 
-// UmountAndRemoveTemporaryMountPoint unmounts and removes the TemporaryMountDir
-func UmountAndRemoveTemporaryMountPoint(ctx context.Context, mountPath string) error {
-
-	Logc(ctx).Debug(">>>> osutils.UmountAndRemoveTemporaryMountPoint")
-	defer Logc(ctx).Debug("<<<< osutils.UmountAndRemoveTemporaryMountPoint")
-
-	// Delete the temporary mount point if it exists.
-	tmpDir := path.Join(mountPath, temporaryMountDir)
-	if _, err := os.Stat(tmpDir); err == nil {
-		if err = removeMountPoint(ctx, tmpDir); err != nil {
-			return fmt.Errorf("failed to remove directory in staging target path %s; %s", tmpDir, err)
-		}
-	} else if !os.IsNotExist(err) {
-		Logc(ctx).WithField("temporaryMountPoint", tmpDir).Errorf("Can't determine if temporary dir path exists; %s", err)
-		return fmt.Errorf("can't determine if temporary dir path %s exists; %s", tmpDir, err)
-	}
+// initiatorNameFile holds the host's iSCSI initiator name
+const initiatorNameFile = "/etc/iscsi/initiatorname.iscsi"
 
-	return nil
-}
+// GetInitiatorIqns returns the initiator name from /etc/iscsi/initiatorname.iscsi, or none if it isn't set
+func GetInitiatorIqns(ctx context.Context) ([]string, error) {
 
-// removeMountPoint attempts to unmount and remove the directory of the mountPointPath
-func removeMountPoint(ctx context.Context, mountPointPath string) error {
+	Logc(ctx).Debug(">>>> osutils.GetInitiatorIqns")
+	defer Logc(ctx).Debug("<<<< osutils.GetInitiatorIqns")
 
-	Logc(ctx).Debug(">>>> osutils.removeMountPoint")
-	defer Logc(ctx).Debug("<<<< osutils.removeMountPoint")
+	iqns := make([]string, 0)
 
-	err := Umount(ctx, mountPointPath)
+	config, err := ReadInitiatorNameConfig(ctx)
 	if err != nil {
-		Logc(ctx).WithField("mountPointPath", mountPointPath).Errorf("Umount failed; %s", err)
-		return err
+		Logc(ctx).WithField("Error", err).Warn("Could not read initiatorname.iscsi; perhaps iSCSI is not installed?")
+		return nil, err
 	}
-
-	err = os.Remove(mountPointPath)
-	if err != nil {
-		Logc(ctx).WithField("mountPointPath", mountPointPath).Errorf("Remove dir failed; %s", err)
-		return fmt.Errorf("failed to remove dir %s; %s", mountPointPath, err)
+	if config.Name != "" {
+		iqns = append(iqns, config.Name)
 	}
-	return nil
+	return iqns, nil
 }
 
-// mountFilesystemForResize expands a filesystem. The xfs_growfs utility requires a mount point to expand the
-// filesystem. Determining the size of the filesystem requires that the filesystem be mounted.
-func mountFilesystemForResize(
-	ctx context.Context, devicePath string, stagedTargetPath string, mountOptions string,
-) (string, error) {
+// defaultInitiatorIQNPrefix is the naming authority of generated initiator names, unless the host's has its own
+const defaultInitiatorIQNPrefix = "iqn.2005-03.org.open-iscsi:"
+
+// defaultInitiatorIQNs are initiator names left in distribution images before a unique one is generated for
+// the host, so hosts cloned from such an image share them.
+var defaultInitiatorIQNs = []string{
+	"iqn.1993-08.org.debian:01:",
+	"iqn.2004-10.com.ubuntu:01:",
+	"iqn.1994-05.com.redhat:",
+	"iqn.2005-03.org.open-iscsi:",
+	"iqn.1996-04.de.suse:01:",
+}
 
-	logFields := log.Fields{
-		"devicePath":       devicePath,
-		"stagedTargetPath": stagedTargetPath,
-		"mountOptions":     mountOptions,
+// generateInitiatorIQN returns a new initiator name under the naming authority of the specified one, as
+// iscsi-iname does, ending in 12 random hexadecimal digits.
+func generateInitiatorIQN(iqn string) (string, error) {
+
+	prefix := defaultInitiatorIQNPrefix
+	if i := strings.LastIndex(iqn, ":"); strings.HasPrefix(strings.ToLower(iqn), "iqn.") && i >= 0 {
+		prefix = iqn[:i+1]
 	}
-	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.mountAndExpandFilesystem")
-	defer Logc(ctx).WithFields(logFields).Debug("<<<< osutils.mountAndExpandFilesystem")
 
-	tmpMountPoint := path.Join(stagedTargetPath, temporaryMountDir)
-	err := MountDevice(ctx, devicePath, tmpMountPoint, mountOptions, false)
-	if err != nil {
-		return "", fmt.Errorf("unable to mount device; %s", err)
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("could not generate iSCSI initiator name; %v", err)
 	}
-	return tmpMountPoint, nil
+	return fmt.Sprintf("%s%x", prefix, suffix), nil
 }
 
-// ExpandISCSIFilesystem will expand the filesystem of an already expanded volume.
-func ExpandISCSIFilesystem(
-	ctx context.Context, publishInfo *VolumePublishInfo, stagedTargetPath string,
-) (int64, error) {
+// CheckInitiatorIQN returns an error if a node's initiator IQN is a distribution default, or is already used by
+// another node according to the registry, which maps IQNs to the names of the nodes using them.  Nodes with the
+// same IQN, usually VMs cloned without regenerating /etc/iscsi/initiatorname.iscsi, steal each other's iSCSI
+// sessions, which shows up only as devices vanishing or never being discovered.  IQNs are compared without
+// regard to case, as RFC 3720 requires.
+func CheckInitiatorIQN(iqn, nodeName string, registry map[string]string) error {
 
-	devicePath := publishInfo.DevicePath
-	logFields := log.Fields{
-		"devicePath":       devicePath,
-		"stagedTargetPath": stagedTargetPath,
-		"mountOptions":     publishInfo.MountOptions,
-		"filesystemType":   publishInfo.FilesystemType,
+	if iqn == "" {
+		return nil
 	}
-	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.ExpandISCSIFilesystem")
-	defer Logc(ctx).WithFields(logFields).Debug("<<<< osutils.ExpandISCSIFilesystem")
 
-	tmpMountPoint, err := mountFilesystemForResize(
-		ctx, publishInfo.DevicePath, stagedTargetPath, publishInfo.MountOptions)
-	if err != nil {
-		return 0, err
-	}
-	defer removeMountPoint(ctx, tmpMountPoint) //nolint
-	// Don't need to verify the filesystem type as the resize utilities will throw an error if the filesystem
-	// is not the correct type.
-	var size int64
-	switch publishInfo.FilesystemType {
-	case "xfs":
-		size, err = expandFilesystem(ctx, "xfs_growfs", tmpMountPoint, tmpMountPoint)
-	case "ext3", "ext4":
-		size, err = expandFilesystem(ctx, "resize2fs", devicePath, tmpMountPoint)
-	default:
-		err = fmt.Errorf("unsupported file system type: %s", publishInfo.FilesystemType)
+	for _, defaultIQN := range defaultInitiatorIQNs {
+		if strings.EqualFold(iqn, defaultIQN) {
+			return DuplicateInitiatorError(fmt.Sprintf("node %s has the default iSCSI initiator name %s, "+
+				"which must be replaced with a unique one in /etc/iscsi/initiatorname.iscsi", nodeName, iqn))
+		}
 	}
-	if err != nil {
-		return 0, err
+
+	for registeredIQN, registeredNode := range registry {
+		if registeredNode != nodeName && strings.EqualFold(iqn, registeredIQN) {
+			return DuplicateInitiatorError(fmt.Sprintf("node %s has the same iSCSI initiator name %s as node %s; "+
+				"each node needs a unique one in /etc/iscsi/initiatorname.iscsi, as when a node was cloned from "+
+				"another", nodeName, iqn, registeredNode))
+		}
 	}
-	return size, nil
+
+	return nil
 }
 
-func expandFilesystem(ctx context.Context, cmd string, cmdArguments string, tmpMountPoint string) (int64, error) {
+// GetIPAddresses returns the sorted list of Global Unicast IP addresses available to Trident
+func GetIPAddresses(ctx context.Context) ([]string, error) {
 
-	logFields := log.Fields{
-		"cmd":           cmd,
-		"cmdArguments":  cmdArguments,
-		"tmpMountPoint": tmpMountPoint,
-	}
-	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.expandFilesystem")
-	defer Logc(ctx).WithFields(logFields).Debug("<<<< osutils.expandFilesystem")
+	Logc(ctx).Debug(">>>> osutils.GetIPAddresses")
+	defer Logc(ctx).Debug("<<<< osutils.GetIPAddresses")
 
-	preExpandSize, err := getFilesystemSize(ctx, tmpMountPoint)
-	if err != nil {
-		return 0, err
-	}
-	_, err = execCommand(ctx, cmd, cmdArguments)
-	if err != nil {
-		Logc(ctx).Errorf("Expanding filesystem failed; %s", err)
-		return 0, err
-	}
+	ipAddrs := make([]string, 0)
+	addrsMap := make(map[string]struct{})
 
-	postExpandSize, err := getFilesystemSize(ctx, tmpMountPoint)
+	// Get the set of potentially viable IP addresses for this host in an OS-appropriate way.
+	addrs, err := getIPAddresses(ctx)
 	if err != nil {
-		return 0, err
-	}
-
-	if postExpandSize == preExpandSize {
-		Logc(ctx).Warnf("Failed to expand filesystem; size=%d", postExpandSize)
+		err = fmt.Errorf("could not gather system IP addresses; %v", err)
+		Logc(ctx).Error(err)
+		return nil, err
 	}
 
-	return postExpandSize, nil
-}
+	// Strip netmask and use a map to ensure addresses are deduplicated.
+	for _, addr := range addrs {
 
-// iSCSISessionExists checks to see if a session exists to the specified portal.
-func iSCSISessionExists(ctx context.Context, portal string) (bool, error) {
+		// net.Addr are of form 1.2.3.4/32, but IP needs 1.2.3.4, so we must strip the netmask (also works for IPv6)
+		parsedAddr := net.ParseIP(strings.Split(addr.String(), "/")[0])
 
-	Logc(ctx).Debug(">>>> osutils.iSCSISessionExists")
-	defer Logc(ctx).Debug("<<<< osutils.iSCSISessionExists")
+		Logc(ctx).WithField("IPAddress", parsedAddr.String()).Debug("Discovered potentially viable IP address.")
 
-	sessionInfo, err := getISCSISessionInfo(ctx)
-	if err != nil {
-		Logc(ctx).WithField("error", err).Error("Problem checking iSCSI sessions.")
-		return false, err
+		addrsMap[parsedAddr.String()] = struct{}{}
 	}
 
-	for _, e := range sessionInfo {
-		if strings.Contains(e.PortalIP, portal) {
-			return true, nil
-		}
+	for addr := range addrsMap {
+		ipAddrs = append(ipAddrs, addr)
 	}
-
-	return false, nil
+	sort.Strings(ipAddrs)
+	return ipAddrs, nil
 }
 
-// iSCSISessionExistsToTargetIQN checks to see if a session exists to the specified target.
-func iSCSISessionExistsToTargetIQN(ctx context.Context, targetIQN string) (bool, error) {
+// GetNodeTopology reports the storage subnets this host can reach, the storage protocols it supports, and the
+// supplied zone labels.  Subnets are those attached to the host's usable interfaces plus any of the specified
+// portal CIDRs toward which the host has a route.
+func GetNodeTopology(
+	ctx context.Context, portalCIDRs []string, zoneLabels map[string]string,
+) (*NodeTopology, error) {
 
-	Logc(ctx).Debug(">>>> osutils.iSCSISessionExistsToTargetIQN")
-	defer Logc(ctx).Debug("<<<< osutils.iSCSISessionExistsToTargetIQN")
+	Logc(ctx).WithField("portalCIDRs", portalCIDRs).Debug(">>>> osutils.GetNodeTopology")
+	defer Logc(ctx).Debug("<<<< osutils.GetNodeTopology")
 
-	sessionInfo, err := getISCSISessionInfo(ctx)
+	addrs, err := getIPAddresses(ctx)
 	if err != nil {
-		Logc(ctx).WithField("error", err).Error("Problem checking iSCSI sessions.")
-		return false, err
+		err = fmt.Errorf("could not gather system IP addresses; %v", err)
+		Logc(ctx).Error(err)
+		return nil, err
 	}
 
-	for _, e := range sessionInfo {
-		if e.TargetName == targetIQN {
-			return true, nil
+	subnetsMap := make(map[string]struct{})
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			subnet := &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}
+			subnetsMap[subnet.String()] = struct{}{}
 		}
 	}
 
-	return false, nil
-}
-
-// portalsToLogin checks to see if session to for all the specified portals exist to the specified
-// target. If a session does not exist for a give portal it is added to list of portals that Trident
-// needs to login to.
-func portalsToLogin(ctx context.Context, targetIQN string, portals []string) ([]string, error) {
-
-	logFields := log.Fields{
-		"targetIQN": targetIQN,
-		"portals":   portals,
+	for _, cidr := range portalCIDRs {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid portal CIDR %s; %v", cidr, err)
+		}
+		reachable, err := routeExistsToSubnet(ctx, subnet)
+		if err != nil {
+			Logc(ctx).WithFields(log.Fields{
+				"subnet": subnet.String(),
+				"error":  err,
+			}).Warn("Could not look up route toward portal subnet.")
+			continue
+		}
+		if reachable {
+			subnetsMap[subnet.String()] = struct{}{}
+		} else {
+			Logc(ctx).WithField("subnet", subnet.String()).Debug("No route toward portal subnet.")
+		}
 	}
 
-	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.portalsToLogin")
-	defer Logc(ctx).Debug("<<<< osutils.portalsToLogin")
-
-	portalsNotLoggedIn := make([]string, len(portals))
-	copy(portalsNotLoggedIn, portals)
-
-	sessionInfo, err := getISCSISessionInfo(ctx)
-	if err != nil {
-		Logc(ctx).WithField("error", err).Error("Problem checking iSCSI sessions.")
-		return portalsNotLoggedIn, err
+	subnets := make([]string, 0, len(subnetsMap))
+	for subnet := range subnetsMap {
+		subnets = append(subnets, subnet)
 	}
+	sort.Strings(subnets)
 
-	for _, e := range sessionInfo {
-		if e.TargetName == targetIQN {
-
-			// Portals (portalsNotLoggedIn) may/may not contain anything after ":", so instead of matching complete
-			// portal value (with e.Portal), check if e.Portal's IP address matches portal's IP address
-			matchFunc := func(main, val string) bool {
-				mainIpAddress := getHostportIP(main)
-				valIpAddress := getHostportIP(val)
-
-				return mainIpAddress == valIpAddress
-			}
-
-			portalsNotLoggedIn = RemoveStringFromSliceConditionally(portalsNotLoggedIn, e.Portal, matchFunc)
-		}
+	zones := make(map[string]string, len(zoneLabels))
+	for k, v := range zoneLabels {
+		zones[k] = v
 	}
 
-	return portalsNotLoggedIn, nil
-}
+	topology := &NodeTopology{
+		Subnets:   subnets,
+		Protocols: getNodeProtocols(ctx),
+		Zones:     zones,
+	}
 
-// portalsIpsToLogin checks to see if session to for all the specified portal IPs exist to the specified
-// target. If a session does not exist for a give portal IP it is added to list of portals IPs that Trident
-// needs to login to.
-func portalsIpsToLogin(ctx context.Context, targetIQN string, portalsIps []string) ([]string, error) {
+	Logc(ctx).WithFields(log.Fields{
+		"subnets":   topology.Subnets,
+		"protocols": topology.Protocols,
+		"zones":     topology.Zones,
+	}).Debug("Discovered node topology.")
 
-	logFields := log.Fields{
-		"targetIQN":  targetIQN,
-		"portalsIps": portalsIps,
-	}
+	return topology, nil
+}
 
-	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.portalsIpsToLogin")
-	defer Logc(ctx).Debug("<<<< osutils.portalsIpsToLogin")
+// getNodeProtocols returns the storage protocols for which this host has initiator support.
+func getNodeProtocols(ctx context.Context) []string {
 
-	portalIpsNotLoggedIn := make([]string, len(portalsIps))
-	copy(portalIpsNotLoggedIn, portalsIps)
+	protocols := make([]string, 0)
 
-	sessionInfo, err := getISCSISessionInfo(ctx)
-	if err != nil {
-		Logc(ctx).WithField("error", err).Error("Problem checking iSCSI sessions.")
-		return portalIpsNotLoggedIn, err
+	if checkCapability(ctx, CapabilityISCSI).Supported {
+		protocols = append(protocols, "iscsi")
 	}
-
-	for _, e := range sessionInfo {
-		if e.TargetName == targetIQN {
-			portalIpsNotLoggedIn = RemoveStringFromSlice(portalIpsNotLoggedIn, e.PortalIP)
-		}
+	if checkCapability(ctx, CapabilityNFS3).Supported {
+		protocols = append(protocols, "nfs")
+	}
+	if checkCapability(ctx, CapabilityFC).Supported {
+		protocols = append(protocols, "fc")
 	}
 
-	return portalIpsNotLoggedIn, nil
+	return protocols
+}
+
+// PathExists returns true if the file/directory at the specified path exists,
+// false otherwise or if an error occurs.
+func PathExists(path string) bool {
+	if _, err := os.Stat(path); err == nil {
+		return true
+	}
+	return false
+}
+
+// EnsureFileExists makes sure that file of given name exists
+func EnsureFileExists(ctx context.Context, path string) error {
+
+	fields := log.Fields{"path": path}
+	if info, err := os.Stat(path); err == nil {
+		if info.IsDir() {
+			Logc(ctx).WithFields(fields).Error("Path exists but is a directory")
+			return fmt.Errorf("path exists but is a directory: %s", path)
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		Logc(ctx).WithFields(fields).Errorf("Can't determine if file exists; %s", err)
+		return fmt.Errorf("can't determine if file %s exists; %s", path, err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC, 0600)
+	if nil != err {
+		Logc(ctx).WithFields(fields).Errorf("OpenFile failed; %s", err)
+		return fmt.Errorf("failed to create file %s; %s", path, err)
+	}
+	file.Close()
+
+	return nil
+}
+
+// DeleteResourceAtPath makes sure that given named file or (empty) directory is removed
+func DeleteResourceAtPath(ctx context.Context, resource string) error {
+	return waitForResourceDeletionAtPath(ctx, resource)
+}
+
+// waitForResourceDeletionAtPath accepts a resource name and waits until it is deleted and returns error if it times out
+func waitForResourceDeletionAtPath(ctx context.Context, resource string) error {
+
+	fields := log.Fields{"resource": resource}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.waitForResourceDeletionAtPath")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.waitForResourceDeletionAtPath")
+
+	maxDuration := resourceDeletionTimeoutSecs * time.Second
+
+	checkResourceDeletion := func() error {
+		if _, err := os.Stat(resource); err == nil {
+			if err = os.Remove(resource); err != nil {
+				Logc(ctx).WithFields(fields).Debugf("Failed to remove resource, %s", err)
+				return fmt.Errorf("failed to remove resource %s; %s", resource, err)
+			}
+			return nil
+		} else if !os.IsNotExist(err) {
+			Logc(ctx).WithFields(fields).Debugf("Can't determine if resource exists; %s", err)
+			return fmt.Errorf("can't determine if resource %s exists; %s", resource, err)
+		}
+
+		return nil
+	}
+
+	deleteNotify := func(err error, duration time.Duration) {
+		Logc(ctx).WithField("increment", duration).Debug("Resource not deleted yet, waiting.")
+	}
+
+	deleteBackoff := newExponentialBackOff()
+	deleteBackoff.InitialInterval = 1 * time.Second
+	deleteBackoff.Multiplier = 1.414 // approx sqrt(2)
+	deleteBackoff.RandomizationFactor = 0.1
+	deleteBackoff.MaxElapsedTime = maxDuration
+
+	// Run the check using an exponential backoff
+	if err := retryNotify(checkResourceDeletion, deleteBackoff, deleteNotify); err != nil {
+		return fmt.Errorf("could not delete resource after %3.2f seconds", maxDuration.Seconds())
+	} else {
+		Logc(ctx).WithField("resource", resource).Debug("Resource deleted.")
+		return nil
+	}
+}
+
+// EnsureDirExists makes sure that given directory structure exists
+func EnsureDirExists(ctx context.Context, path string) error {
+
+	fields := log.Fields{
+		"path": path,
+	}
+	if info, err := os.Stat(path); err == nil {
+		if !info.IsDir() {
+			Logc(ctx).WithFields(fields).Error("Path exists but is not a directory")
+			return fmt.Errorf("path exists but is not a directory: %s", path)
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		Logc(ctx).WithFields(fields).Errorf("Can't determine if directory exists; %s", err)
+		return fmt.Errorf("can't determine if directory %s exists; %s", path, err)
+	}
+
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		Logc(ctx).WithFields(fields).Errorf("Mkdir failed; %s", err)
+		return fmt.Errorf("failed to mkdir %s; %s", path, err)
+	}
+
+	return nil
+}
+
+// getSysfsBlockDirsForLUN returns the list of directories in sysfs where the block devices should appear
+// after the scan is successful. One directory is returned for each path in the host session map.
+func getSysfsBlockDirsForLUN(lunID int, hostSessionMap map[int]int) []string {
+
+	paths := make([]string, 0)
+	for hostNumber, sessionNumber := range hostSessionMap {
+		p := fmt.Sprintf(
+			chrootPathPrefix+"/sys/class/scsi_host/host%d/device/session%d/iscsi_session/session%d/device/target%d:0:0/%d:0:0:%d",
+			hostNumber, sessionNumber, sessionNumber, hostNumber, hostNumber, lunID)
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// getDevicesForLUN find the /dev/sd* device names for an iSCSI LUN.
+func getDevicesForLUN(paths []string) ([]string, error) {
+
+	devices := make([]string, 0)
+	for _, p := range paths {
+		dirname := p + "/block"
+		if !PathExists(dirname) {
+			continue
+		}
+		dirFd, err := os.Open(dirname)
+		if err != nil {
+			return nil, err
+		}
+		list, err := dirFd.Readdir(1)
+		dirFd.Close()
+		if err != nil {
+			return nil, err
+		}
+		if 0 == len(list) {
+			continue
+		}
+		devices = append(devices, list[0].Name())
+	}
+	return devices, nil
+}
+
+// waitForDeviceScanIfNeeded scans all paths to a specific LUN and waits until all
+// SCSI disk-by-path devices for that LUN are present on the host.  If they are all
+// present already, it returns at once without scanning.
+func waitForDeviceScanIfNeeded(ctx context.Context, lunID int, iSCSINodeName string, shouldScan bool) error {
+
+	fields := log.Fields{
+		"lunID":         lunID,
+		"iSCSINodeName": iSCSINodeName,
+	}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.waitForDeviceScanIfNeeded")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.waitForDeviceScanIfNeeded")
+
+	hostSessionMap := GetISCSIHostSessionMapForTarget(ctx, iSCSINodeName)
+	if len(hostSessionMap) == 0 {
+		return fmt.Errorf("no iSCSI hosts found for target %s", iSCSINodeName)
+	}
+
+	paths := getSysfsBlockDirsForLUN(lunID, hostSessionMap)
+
+	// findDevices returns the block dirs present for the LUN's paths
+	findDevices := func() []string {
+		found := make([]string, 0)
+		for _, p := range paths {
+			dirname := p + "/block"
+			if PathExists(dirname) {
+				found = append(found, dirname)
+			}
+		}
+		return found
+	}
+
+	found := findDevices()
+	if len(found) == len(paths) {
+		Logc(ctx).Debugf("Paths found: %v", found)
+		return nil
+	}
+
+	Logc(ctx).WithField("hostSessionMap", hostSessionMap).Debug("Built iSCSI host/session map.")
+	hosts := make([]int, 0)
+	for hostNumber := range hostSessionMap {
+		hosts = append(hosts, hostNumber)
+	}
+
+	checkAllDevicesExist := func() error {
+		if found = findDevices(); len(found) < len(paths) {
+			return errors.New("device not present yet")
+		}
+		return nil
+	}
+
+	devicesNotify := func(err error, duration time.Duration) {
+		Logc(ctx).WithField("increment", duration).Debug("All devices not yet present, waiting.")
+	}
+
+	// With automatic scanning the initiator scans the target itself, at login and when it's told of new LUNs, so
+	// give it the chance to find the LUN before scanning for it, which would only race the initiator's scan
+	if shouldScan && effectiveISCSIScanPolicy(ctx) == ISCSIScanPolicyAuto {
+		autoScanBackoff := backoff.WithMaxRetries(backoff.NewConstantBackOff(autoScanPollInterval),
+			uint64(autoScanWait/autoScanPollInterval))
+		if err := retryNotify(checkAllDevicesExist, autoScanBackoff, devicesNotify); err == nil {
+			Logc(ctx).Debugf("Paths found by automatic scan: %v", found)
+			return nil
+		}
+	}
+
+	if shouldScan {
+		if err := iSCSIScanTargetLUN(ctx, lunID, hosts); err != nil {
+			Logc(ctx).WithField("scanError", err).Error("Could not scan for new LUN.")
+		}
+	}
+
+	Logc(ctx).Debugf("Scanning paths: %v", paths)
+
+	deviceBackoff := newExponentialBackOff()
+	deviceBackoff.InitialInterval = 1 * time.Second
+	deviceBackoff.Multiplier = 1.414 // approx sqrt(2)
+	deviceBackoff.RandomizationFactor = 0.1
+	deviceBackoff.MaxElapsedTime = allDevicesScanWait
+
+	if err := retryNotify(checkAllDevicesExist, deviceBackoff, devicesNotify); err == nil {
+		Logc(ctx).Debugf("Paths found: %v", found)
+		return nil
+	}
+
+	Logc(ctx).Debugf("Paths found so far: %v", found)
+
+	checkAnyDeviceExists := func() error {
+		if found = findDevices(); len(found) == 0 {
+			return errors.New("no devices present yet")
+		}
+		return nil
+	}
+
+	devicesNotify = func(err error, duration time.Duration) {
+		Logc(ctx).WithField("increment", duration).Debug("No devices present yet, waiting.")
+	}
+
+	deviceBackoff = newExponentialBackOff()
+	deviceBackoff.InitialInterval = 1 * time.Second
+	deviceBackoff.Multiplier = 1.414 // approx sqrt(2)
+	deviceBackoff.RandomizationFactor = 0.1
+	deviceBackoff.MaxElapsedTime = anyDeviceScanWait
+
+	// Run the check/scan using an exponential backoff
+	if err := retryNotify(checkAnyDeviceExists, deviceBackoff, devicesNotify); err != nil {
+		Logc(ctx).Warnf("Could not find all devices after %d seconds.", iSCSIDeviceDiscoveryTimeoutSecs)
+
+		// In the case of a failure, log info about what devices are present
+		listAllISCSIDevicesOnError(ctx, err)
+		logSCSIDevices(ctx)
+		if _, err := execCommand(ctx, "free"); err != nil {
+			Logc(ctx).Warnf("Could not run free: %v", err)
+		}
+		return err
+	}
+
+	Logc(ctx).Debugf("Paths found: %v", found)
+	return nil
+}
+
+// ScsiDeviceInfo contains information about SCSI devices
+type ScsiDeviceInfo struct {
+	Host            string
+	Channel         string
+	Target          string
+	LUN             string
+	Devices         []string
+	MultipathDevice string
+	Filesystem      string
+	IQN             string
+	HostSessionMap  map[int]int
+	// SupportsDiscard is true if the device (the multipath device, if any) accepts discard (SCSI UNMAP) requests
+	SupportsDiscard bool
+	// Size is the size in bytes of the device (the multipath device, if any)
+	Size int64
+	// Vendor, Model and WWID identify the LUN as reported by its first path
+	Vendor string
+	Model  string
+	WWID   string
+	// QueueDepth is the SCSI queue depth of the first path
+	QueueDepth int
+	// ReadAheadKB and Scheduler are the readahead and active I/O scheduler of the device (the multipath device,
+	// if any)
+	ReadAheadKB int
+	Scheduler   string
+	// PathStates maps each path, like sdb, to its SCSI device state, such as "running" or "offline"
+	PathStates map[string]string
+}
+
+// readSysfsAttribute returns the trimmed content of a sysfs attribute file of a block device like sdb or dm-0.
+func readSysfsAttribute(ctx context.Context, device, attribute string) (string, error) {
+	content, err := readFileWithTimeout(ctx, chrootPathPrefix+"/sys/block/"+device+"/"+attribute)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// populateDeviceAttributes fills in the size, identity, queue settings and path states of a device from sysfs.
+// Attributes that can't be read, such as those of a path that has gone away, are left unset.
+func populateDeviceAttributes(ctx context.Context, info *ScsiDeviceInfo) {
+
+	device := info.MultipathDevice
+	if device == "" && len(info.Devices) > 0 {
+		device = info.Devices[0]
+	}
+	if device == "" {
+		return
+	}
+
+	readAttribute := func(device, attribute string) string {
+		value, err := readSysfsAttribute(ctx, device, attribute)
+		if err != nil {
+			Logc(ctx).WithFields(log.Fields{
+				"device":    device,
+				"attribute": attribute,
+			}).WithError(err).Debug("Could not read device attribute.")
+		}
+		return value
+	}
+
+	// The kernel reports sizes in 512-byte sectors regardless of the device's block size
+	if sectors, err := strconv.ParseInt(readAttribute(device, "size"), 10, 64); err == nil {
+		info.Size = sectors * 512
+	}
+	if readAhead, err := strconv.Atoi(readAttribute(device, "queue/read_ahead_kb")); err == nil {
+		info.ReadAheadKB = readAhead
+	}
+
+	// The active scheduler is the bracketed one, as in "mq-deadline kyber [bfq] none"
+	for _, scheduler := range strings.Fields(readAttribute(device, "queue/scheduler")) {
+		if strings.HasPrefix(scheduler, "[") && strings.HasSuffix(scheduler, "]") {
+			info.Scheduler = strings.Trim(scheduler, "[]")
+			break
+		}
+	}
+
+	info.PathStates = make(map[string]string, len(info.Devices))
+	for _, path := range info.Devices {
+		info.PathStates[path] = readAttribute(path, "device/state")
+	}
+
+	if len(info.Devices) > 0 {
+		path := info.Devices[0]
+		info.Vendor = readAttribute(path, "device/vendor")
+		info.Model = readAttribute(path, "device/model")
+		info.WWID = readAttribute(path, "device/wwid")
+		if queueDepth, err := strconv.Atoi(readAttribute(path, "device/queue_depth")); err == nil {
+			info.QueueDepth = queueDepth
+		}
+	}
+}
+
+// deviceSupportsDiscard reports whether a block device like sdb or dm-0 advertises discard support.  The kernel
+// reports a zero discard granularity and maximum discard size for devices that don't support SCSI UNMAP, and
+// devicemapper devices inherit those limits from their slaves.
+func deviceSupportsDiscard(ctx context.Context, device string) bool {
+
+	queuePath := chrootPathPrefix + "/sys/block/" + device + "/queue/"
+
+	for _, attribute := range []string{"discard_granularity", "discard_max_bytes"} {
+		content, err := ioutil.ReadFile(queuePath + attribute)
+		if err != nil {
+			Logc(ctx).WithFields(log.Fields{
+				"device":    device,
+				"attribute": attribute,
+			}).WithError(err).Debug("Could not read discard limit.")
+			return false
+		}
+		value, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil || value == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getDeviceInfoForLUN finds iSCSI devices using /dev/disk/by-path values.  This method should be
+// called after calling waitForDeviceScanIfNeeded so that the device paths are known to exist.
+func getDeviceInfoForLUN(
+	ctx context.Context, lunID int, iSCSINodeName string, needFSType bool,
+) (*ScsiDeviceInfo, error) {
+
+	fields := log.Fields{
+		"lunID":         lunID,
+		"iSCSINodeName": iSCSINodeName,
+		"needFSType":    needFSType,
+	}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.getDeviceInfoForLUN")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.getDeviceInfoForLUN")
+
+	hostSessionMap := GetISCSIHostSessionMapForTarget(ctx, iSCSINodeName)
+	if len(hostSessionMap) == 0 {
+		return nil, fmt.Errorf("no iSCSI hosts found for target %s", iSCSINodeName)
+	}
+
+	paths := getSysfsBlockDirsForLUN(lunID, hostSessionMap)
+
+	devices, err := getDevicesForLUN(paths)
+	if nil != err {
+		return nil, err
+	} else if 0 == len(devices) {
+		return nil, fmt.Errorf("scan not completed for LUN %d on target %s", lunID, iSCSINodeName)
+	}
+
+	multipathDevice := ""
+	for _, device := range devices {
+		multipathDevice = findMultipathDeviceForDevice(ctx, device)
+		if multipathDevice != "" {
+			break
+		}
+	}
+
+	var devicePath string
+	if multipathDevice != "" {
+		devicePath = "/dev/" + multipathDevice
+	} else {
+		devicePath = "/dev/" + devices[0]
+	}
+
+	err = ensureDeviceReadableWithRetry(ctx, devicePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fsType := ""
+	if needFSType {
+
+		fsType, err = getFSType(ctx, devicePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	supportsDiscard := deviceSupportsDiscard(ctx, filepath.Base(devicePath))
+
+	Logc(ctx).WithFields(log.Fields{
+		"LUN":             strconv.Itoa(lunID),
+		"multipathDevice": multipathDevice,
+		"fsType":          fsType,
+		"deviceNames":     devices,
+		"hostSessionMap":  hostSessionMap,
+		"supportsDiscard": supportsDiscard,
+	}).Debug("Found SCSI device.")
+
+	info := &ScsiDeviceInfo{
+		LUN:             strconv.Itoa(lunID),
+		MultipathDevice: multipathDevice,
+		Devices:         devices,
+		Filesystem:      fsType,
+		IQN:             iSCSINodeName,
+		HostSessionMap:  hostSessionMap,
+		SupportsDiscard: supportsDiscard,
+	}
+	populateDeviceAttributes(ctx, info)
+
+	return info, nil
+}
+
+// getDeviceInfoForMountPath discovers the device that is currently mounted at the specified mount path.  It
+// uses the ScsiDeviceInfo struct so that it may return a multipath device (if any) plus one or more underlying
+// physical devices.
+func getDeviceInfoForMountPath(ctx context.Context, mountpath string) (*ScsiDeviceInfo, error) {
+
+	fields := log.Fields{"mountpath": mountpath}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.getDeviceInfoForMountPath")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.getDeviceInfoForMountPath")
+
+	mountedDevice, err := GetMountedDevice(ctx, mountpath)
+	if err != nil {
+		return nil, err
+	}
+	device := mountedDevice.Name
+
+	var deviceInfo *ScsiDeviceInfo
+
+	if !isDeviceMapperDevice(device) {
+		deviceInfo = &ScsiDeviceInfo{
+			Devices: []string{device},
+		}
+	} else {
+		deviceInfo = &ScsiDeviceInfo{
+			Devices:         findDevicesForMultipathDevice(ctx, device),
+			MultipathDevice: device,
+		}
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"multipathDevice": deviceInfo.MultipathDevice,
+		"devices":         deviceInfo.Devices,
+	}).Debug("Found SCSI device.")
+
+	return deviceInfo, nil
+}
+
+// MultipathPolicy determines what happens when multipathd is running but a LUN never gets a multipath device,
+// leaving it attached through a single path.
+type MultipathPolicy string
+
+const (
+	// MultipathPolicyFail fails the attach
+	MultipathPolicyFail MultipathPolicy = "fail"
+	// MultipathPolicyDegraded proceeds on the single path and reports the attach as degraded
+	MultipathPolicyDegraded MultipathPolicy = "degraded"
+	// MultipathPolicyWait waits until the multipath device appears
+	MultipathPolicyWait MultipathPolicy = "wait"
+)
+
+var multipathPolicy = MultipathPolicyDegraded
+
+// SetMultipathPolicy sets the policy applied when a LUN is left with a single path despite multipathd running.
+func SetMultipathPolicy(policy MultipathPolicy) error {
+	if err := validateMultipathPolicy(policy); err != nil {
+		return err
+	}
+	multipathPolicy = policy
+	return nil
+}
+
+func validateMultipathPolicy(policy MultipathPolicy) error {
+	switch policy {
+	case MultipathPolicyFail, MultipathPolicyDegraded, MultipathPolicyWait:
+		return nil
+	default:
+		return fmt.Errorf("invalid multipath policy: %s", policy)
+	}
+}
+
+// waitForMultipathDeviceForLUN waits for the multipath device of a LUN to appear.  If multipathd is running and
+// the LUN has, or is expected to have, more than one path but no multipath device appears, the multipath policy
+// decides whether to fail, to wait for it indefinitely, or to proceed on a single path, in which case true is
+// returned to indicate the attach is degraded.
+func waitForMultipathDeviceForLUN(ctx context.Context, lunID int, iSCSINodeName string) (bool, error) {
+
+	fields := log.Fields{
+		"lunID":         lunID,
+		"iSCSINodeName": iSCSINodeName,
+	}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.waitForMultipathDeviceForLUN")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.waitForMultipathDeviceForLUN")
+
+	hostSessionMap := GetISCSIHostSessionMapForTarget(ctx, iSCSINodeName)
+	if len(hostSessionMap) == 0 {
+		return false, fmt.Errorf("no iSCSI hosts found for target %s", iSCSINodeName)
+	}
+
+	paths := getSysfsBlockDirsForLUN(lunID, hostSessionMap)
+
+	devices, err := getDevicesForLUN(paths)
+	if nil != err {
+		return false, err
+	}
+
+	if len(devices) <= 1 && len(hostSessionMap) <= 1 {
+		Logc(ctx).Debug("Skipping multipath discovery, only one path expected.")
+		return false, nil
+	} else if !multipathdIsRunning(ctx) && !(recoverHostService(ctx, "multipathd") && multipathdIsRunning(ctx)) {
+		Logc(ctx).Debug("Skipping multipath discovery, multipathd isn't running.")
+		return false, nil
+	}
+
+	if multipathDevice := waitForMultipathDeviceForDevices(ctx, devices); multipathDevice != "" {
+		return false, nil
+	}
+
+	// A blacklisted LUN never gets a multipath device, however long the policy waits for it
+	if resolved, err := resolveMultipathBlacklist(ctx, devices); err != nil {
+		return false, err
+	} else if resolved {
+		return false, nil
+	}
+
+	fields["devices"] = devices
+	fields["policy"] = multipathPolicy
+
+	switch multipathPolicy {
+	case MultipathPolicyFail:
+		Logc(ctx).WithFields(fields).Error("No multipath device found for LUN.")
+		return false, fmt.Errorf("no multipath device found for LUN %d on target %s", lunID, iSCSINodeName)
+
+	case MultipathPolicyWait:
+		Logc(ctx).WithFields(fields).Warning("No multipath device found for LUN, waiting for it to appear.")
+
+		multipathDevice := ""
+		checkMultipathDeviceExists := func() error {
+			if devices, err = getDevicesForLUN(paths); err != nil {
+				return err
+			}
+			for _, device := range devices {
+				if multipathDevice = findMultipathDeviceForDevice(ctx, device); multipathDevice != "" {
+					return nil
+				}
+			}
+			return errors.New("multipath device not yet present")
+		}
+
+		deviceNotify := func(err error, duration time.Duration) {
+			Logc(ctx).WithField("increment", duration).Debug("Multipath device not yet present, waiting.")
+		}
+
+		multipathDeviceBackoff := newExponentialBackOff()
+		multipathDeviceBackoff.InitialInterval = 1 * time.Second
+		multipathDeviceBackoff.Multiplier = 1.414 // approx sqrt(2)
+		multipathDeviceBackoff.RandomizationFactor = 0.1
+		multipathDeviceBackoff.MaxInterval = 30 * time.Second
+		multipathDeviceBackoff.MaxElapsedTime = 0 // never stop, unless the request is cancelled
+
+		if err := retryNotify(checkMultipathDeviceExists,
+			backoff.WithContext(multipathDeviceBackoff, ctx), deviceNotify); err != nil {
+			return false, fmt.Errorf("stopped waiting for multipath device for LUN %d on target %s; %v",
+				lunID, iSCSINodeName, err)
+		}
+
+		Logc(ctx).WithField("multipathDevice", multipathDevice).Debug("Multipath device found.")
+		return false, nil
+
+	default:
+		Logc(ctx).WithFields(fields).Warning("No multipath device found for LUN, proceeding on a single path.")
+		return true, nil
+	}
+}
+
+// waitForMultipathDeviceForDevices accepts a list of sd* device names and waits until
+// a multipath device is present for at least one of those.  It returns the name of the
+// multipath device, or an empty string if multipathd isn't running or there is only one path.
+func waitForMultipathDeviceForDevices(ctx context.Context, devices []string) string {
+
+	fields := log.Fields{"devices": devices}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.waitForMultipathDeviceForDevices")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.waitForMultipathDeviceForDevices")
+
+	if len(devices) <= 1 {
+		Logc(ctx).Debugf("Skipping multipath discovery, %d device(s) specified.", len(devices))
+		return ""
+	} else if !multipathdIsRunning(ctx) {
+		Logc(ctx).Debug("Skipping multipath discovery, multipathd isn't running.")
+		return ""
+	}
+
+	maxDuration := multipathDeviceDiscoveryTimeoutSecs * time.Second
+	multipathDevice := ""
+
+	checkMultipathDeviceExists := func() error {
+
+		for _, device := range devices {
+			multipathDevice = findMultipathDeviceForDevice(ctx, device)
+			if multipathDevice != "" {
+				return nil
+			}
+		}
+		if multipathDevice == "" {
+			return errors.New("multipath device not yet present")
+		}
+		return nil
+	}
+
+	deviceNotify := func(err error, duration time.Duration) {
+		Logc(ctx).WithField("increment", duration).Debug("Multipath device not yet present, waiting.")
+	}
+
+	multipathDeviceBackoff := newExponentialBackOff()
+	multipathDeviceBackoff.InitialInterval = 1 * time.Second
+	multipathDeviceBackoff.Multiplier = 1.414 // approx sqrt(2)
+	multipathDeviceBackoff.RandomizationFactor = 0.1
+	multipathDeviceBackoff.MaxElapsedTime = maxDuration
+
+	// Run the check/scan using an exponential backoff
+	if err := retryNotify(checkMultipathDeviceExists, multipathDeviceBackoff, deviceNotify); err != nil {
+		Logc(ctx).Warnf("Could not find multipath device after %3.2f seconds.", maxDuration.Seconds())
+	} else {
+		Logc(ctx).WithField("multipathDevice", multipathDevice).Debug("Multipath device found.")
+	}
+	return multipathDevice
+}
+
+// waitForDevice accepts a device name and waits until it is present and returns error if it times out
+func waitForDevice(ctx context.Context, device string) error {
+
+	fields := log.Fields{"device": device}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.waitForDevice")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.waitForDevice")
+
+	maxDuration := multipathDeviceDiscoveryTimeoutSecs * time.Second
+
+	checkDeviceExists := func() error {
+		if !PathExists(chrootPathPrefix + device) {
+			return errors.New("device not yet present")
+		}
+		return nil
+	}
+
+	deviceNotify := func(err error, duration time.Duration) {
+		Logc(ctx).WithField("increment", duration).Debug("Device not yet present, waiting.")
+	}
+
+	deviceBackoff := newExponentialBackOff()
+	deviceBackoff.InitialInterval = 1 * time.Second
+	deviceBackoff.Multiplier = 1.414 // approx sqrt(2)
+	deviceBackoff.RandomizationFactor = 0.1
+	deviceBackoff.MaxElapsedTime = maxDuration
+
+	// Run the check using an exponential backoff
+	if err := retryNotify(checkDeviceExists, deviceBackoff, deviceNotify); err != nil {
+		return fmt.Errorf("could not find device after %3.2f seconds", maxDuration.Seconds())
+	} else {
+		Logc(ctx).WithField("device", device).Debug("Device found.")
+		return nil
+	}
+}
+
+// verifyDeviceSize compares the size of a block device with the size the volume is expected to have.  A device
+// that is smaller than expected means either the wrong LUN is mapped or the array hasn't finished resizing it, so
+// an error is returned.  A device that is larger than expected is only logged, since the volume may have been
+// expanded after the publish info was recorded.
+func verifyDeviceSize(ctx context.Context, devicePath string, expectedSize int64) error {
+
+	fields := log.Fields{"devicePath": devicePath, "expectedSize": expectedSize}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.verifyDeviceSize")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.verifyDeviceSize")
+
+	deviceSize, err := getISCSIDiskSize(ctx, devicePath)
+	if err != nil {
+		return fmt.Errorf("could not verify size of device %s; %v", devicePath, err)
+	}
+
+	sameSize, _ := VolumeSizeWithinTolerance(expectedSize, deviceSize, deviceSizeMismatchDelta)
+	if sameSize {
+		Logc(ctx).WithField("deviceSize", deviceSize).Debug("Device size matches expected volume size.")
+		return nil
+	}
+
+	if deviceSize < expectedSize {
+		Logc(ctx).WithFields(fields).WithField("deviceSize", deviceSize).Error(
+			"Device is smaller than the expected volume size.")
+		return fmt.Errorf("device %s is smaller than expected; size: %d, expected: %d",
+			devicePath, deviceSize, expectedSize)
+	}
+
+	Logc(ctx).WithFields(fields).WithField("deviceSize", deviceSize).Warning(
+		"Device is larger than the expected volume size.")
+	return nil
+}
+
+// getMultipathDevicePath returns the stable /dev/mapper path of a multipath device like dm-0.  The mapper name is
+// either the multipath alias (e.g. mpatha) or the WWID, depending on multipathd's user_friendly_names setting, and
+// unlike dm-N it survives a reboot.  If the mapper path can't be found, /dev/dm-N is returned.
+func getMultipathDevicePath(ctx context.Context, multipathDevice string) string {
+
+	devicePath := "/dev/" + multipathDevice
+
+	dmName, err := ioutil.ReadFile(chrootPathPrefix + "/sys/block/" + multipathDevice + "/dm/name")
+	if err != nil {
+		Logc(ctx).WithField("multipathDevice", multipathDevice).WithError(err).Warning(
+			"Could not read multipath device name; using unstable device path.")
+		return devicePath
+	}
+
+	mapperPath := "/dev/mapper/" + strings.TrimSpace(string(dmName))
+	if !PathExists(chrootPathPrefix + mapperPath) {
+		Logc(ctx).WithField("mapperPath", mapperPath).Warning(
+			"Multipath device mapper path not found; using unstable device path.")
+		return devicePath
+	}
+
+	return mapperPath
+}
+
+// resolveStaleMultipathDevice replaces a stale multipath device holding a LUN's paths.  An array that deletes a
+// LUN and soon creates another with the same WWID can leave multipathd presenting the old LUN's map, with its
+// paths and size, for the new one, and mounting it would read and write through whatever those paths now lead to.
+func resolveStaleMultipathDevice(ctx context.Context, lunID int, iSCSINodeName string) error {
+
+	hostSessionMap := GetISCSIHostSessionMapForTarget(ctx, iSCSINodeName)
+	devices, err := getDevicesForLUN(getSysfsBlockDirsForLUN(lunID, hostSessionMap))
+	if err != nil {
+		return err
+	}
+	return resolveStaleMultipathDeviceForDevices(ctx, devices)
+}
+
+// resolveStaleMultipathDeviceForDevices checks the multipath device holding the specified SCSI devices, all
+// paths to one LUN, for signs that it was created for an earlier LUN with the same WWID: other paths whose
+// devices are no longer running, or a size different from that of the paths.  A map whose size alone differs is
+// first reloaded, as after a resize.  Otherwise the map is flushed, which fails if it's in use, and the paths are
+// rescanned and handed to multipathd to create a fresh map.
+func resolveStaleMultipathDeviceForDevices(ctx context.Context, devices []string) error {
+
+	multipathDevice := ""
+	for _, device := range devices {
+		if multipathDevice = findMultipathDeviceForDevice(ctx, device); multipathDevice != "" {
+			break
+		}
+	}
+	if multipathDevice == "" {
+		return nil
+	}
+
+	fields := log.Fields{"multipathDevice": multipathDevice, "devices": devices}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.resolveStaleMultipathDeviceForDevices")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.resolveStaleMultipathDeviceForDevices")
+
+	orphanedPaths := make([]string, 0)
+	for _, path := range findDevicesForMultipathDevice(ctx, multipathDevice) {
+		if !StringInSlice(path, devices) && !scsiDeviceRunning(path) {
+			orphanedPaths = append(orphanedPaths, path)
+		}
+	}
+
+	sizeMatches := func() bool {
+		mapSize, mapErr := getSysfsBlockDeviceSize(multipathDevice)
+		pathSize, pathErr := getSysfsBlockDeviceSize(devices[0])
+		return mapErr != nil || pathErr != nil || mapSize == pathSize
+	}
+
+	if len(orphanedPaths) == 0 {
+		if sizeMatches() {
+			return nil
+		}
+		Logc(ctx).WithFields(fields).Warning("Multipath device size differs from its paths, reloading it.")
+		if err := reloadMultipathDevice(ctx, multipathDevice); err == nil && sizeMatches() {
+			return nil
+		}
+	}
+
+	Logc(ctx).WithFields(fields).WithField("orphanedPaths", orphanedPaths).Warning(
+		"Multipath device is stale, as when a WWID is reused; replacing it.")
+
+	if err := multipathFlushDevice(ctx, &ScsiDeviceInfo{MultipathDevice: multipathDevice}, false); err != nil {
+		return fmt.Errorf("could not flush stale multipath device %s; %v", multipathDevice, err)
+	}
+
+	for _, device := range devices {
+		if err := iSCSIRescanDisk(ctx, device); err != nil {
+			Logc(ctx).WithField("device", device).WithError(err).Warning("Could not rescan device.")
+		}
+		if _, err := execCommandWithTimeout(ctx, "multipathd", 10, true, "add", "path", device); err != nil {
+			Logc(ctx).WithField("device", device).WithError(err).Warning("Could not add path to multipathd.")
+		}
+	}
+
+	if newMultipathDevice := waitForMultipathDeviceForDevices(ctx, devices); newMultipathDevice != "" {
+		Logc(ctx).WithFields(fields).WithField("newMultipathDevice", newMultipathDevice).Info(
+			"Replaced stale multipath device.")
+	}
+	return nil
+}
+
+// scsiDeviceRunning returns true if a SCSI device like sdx exists and is in the running state.
+func scsiDeviceRunning(device string) bool {
+	state, err := ioutil.ReadFile(chrootPathPrefix + "/sys/block/" + device + "/device/state")
+	return err == nil && strings.TrimSpace(string(state)) == "running"
+}
+
+// getSysfsBlockDeviceSize returns the size in bytes of a block device like sdx or dm-0, as reported by sysfs.
+func getSysfsBlockDeviceSize(device string) (int64, error) {
+	sectors, err := ioutil.ReadFile(chrootPathPrefix + "/sys/block/" + device + "/size")
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(sectors)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	// sysfs reports sizes in 512-byte sectors, whatever the device's logical block size
+	return size * 512, nil
+}
+
+// findMultipathDeviceForDevice finds the devicemapper parent of a device name like /dev/sdx.
+func findMultipathDeviceForDevice(ctx context.Context, device string) string {
+
+	Logc(ctx).WithField("device", device).Debug(">>>> osutils.findMultipathDeviceForDevice")
+	defer Logc(ctx).WithField("device", device).Debug("<<<< osutils.findMultipathDeviceForDevice")
+
+	holdersDir := chrootPathPrefix + "/sys/block/" + device + "/holders"
+	if dirs, err := ioutil.ReadDir(holdersDir); err == nil {
+		for _, f := range dirs {
+			name := f.Name()
+			if isDeviceMapperDevice(name) {
+				return name
+			}
+		}
+	}
+
+	Logc(ctx).WithField("device", device).Debug("Could not find multipath device for device.")
+	return ""
+}
+
+// findDevicesForMultipathDevice finds the constituent devices for a devicemapper parent device like /dev/dm-0.
+func findDevicesForMultipathDevice(ctx context.Context, device string) []string {
+
+	Logc(ctx).WithField("device", device).Debug(">>>> osutils.findDevicesForMultipathDevice")
+	defer Logc(ctx).WithField("device", device).Debug("<<<< osutils.findDevicesForMultipathDevice")
+
+	devices := make([]string, 0)
+
+	slavesDir := chrootPathPrefix + "/sys/block/" + device + "/slaves"
+	if dirs, err := ioutil.ReadDir(slavesDir); err == nil {
+		for _, f := range dirs {
+			// Any path may be a SCSI, virtio or NVMe disk, but not another stacked device
+			name := f.Name()
+			if !isDeviceMapperDevice(name) {
+				devices = append(devices, name)
+			}
+		}
+	}
+
+	if len(devices) == 0 {
+		Logc(ctx).WithField("device", device).Debug("Could not find devices for multipath device.")
+	} else {
+		Logc(ctx).WithFields(log.Fields{
+			"device":  device,
+			"devices": devices,
+		}).Debug("Found devices for multipath device.")
+	}
+
+	return devices
+}
+
+// PrepareDeviceForRemoval informs Linux that a device will be removed.
+func PrepareDeviceForRemoval(ctx context.Context, lunID int, iSCSINodeName string, force bool) (err error) {
+
+	ctx = WithLogFields(ctx, log.Fields{LogFieldTargetIQN: iSCSINodeName, LogFieldLUN: lunID})
+
+	fields := log.Fields{"chrootPathPrefix": chrootPathPrefix}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.PrepareDeviceForRemoval")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.PrepareDeviceForRemoval")
+	defer func() { journalHostOutcome(ctx, "Removal of iSCSI device", err) }()
+
+	deviceInfo, err := getDeviceInfoForLUN(ctx, lunID, iSCSINodeName, false)
+	if err != nil {
+		Logc(ctx).WithFields(log.Fields{
+			"error": err,
+			"lunID": lunID,
+		}).Warn("Could not get device info for removal, skipping host removal steps.")
+		return err
+	}
+
+	return removeSCSIDevice(ctx, deviceInfo, force)
+}
+
+// PrepareDeviceAtMountPathForRemoval informs Linux that a device will be removed.
+func PrepareDeviceAtMountPathForRemoval(ctx context.Context, mountpoint string, unmount, force bool) error {
+
+	fields := log.Fields{"mountpoint": mountpoint}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.PrepareDeviceAtMountPathForRemoval")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.PrepareDeviceAtMountPathForRemoval")
+
+	deviceInfo, err := getDeviceInfoForMountPath(ctx, mountpoint)
+	if err != nil {
+		return err
+	}
+
+	if unmount {
+		if err := Umount(ctx, mountpoint); err != nil {
+			return err
+		}
+	}
+
+	return removeSCSIDevice(ctx, deviceInfo, force)
+}
+
+// DetachVolumesForTarget unmounts and removes every LUN this host has attached through a target, then logs out
+// of the target once, as when the backend serving the target is decommissioned.  Unlike detaching each volume in
+// turn, the host's devices and mounts are listed just once, and there's no need to decide after each LUN whether
+// the target is still in use.  All mounts of the LUNs are undone before any LUN is removed, and each LUN's
+// multipath device is flushed before its paths are removed.  The force argument has the same meaning as for
+// removeSCSIDevice; without it, the first failure stops the detach before the target is logged out.
+func DetachVolumesForTarget(ctx context.Context, targetIQN string, force bool) (err error) {
+
+	ctx = WithLogFields(ctx, log.Fields{LogFieldTargetIQN: targetIQN})
+
+	fields := log.Fields{"force": force}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.DetachVolumesForTarget")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.DetachVolumesForTarget")
+	defer func() { journalHostOutcome(ctx, "Detach of iSCSI target", err) }()
+
+	iscsiDevices, err := FindISCSIDevices(ctx, ISCSIDeviceFilter{IQN: targetIQN})
+	if err != nil {
+		return err
+	}
+
+	kernelLog := startKernelLogCorrelation()
+	defer func() {
+		subjects := make([]string, 0)
+		for _, deviceInfo := range iscsiDevices {
+			subjects = append(subjects, scsiDeviceKernelLogSubjects(deviceInfo)...)
+		}
+		err = kernelLog.annotate(ctx, err, subjects)
+	}()
+
+	procSelfMountinfo, err := listProcSelfMountinfo(procSelfMountinfoPath)
+	if err != nil {
+		return err
+	}
+	for _, mountpoint := range getMountpointsForDevices(ctx, procSelfMountinfo, iscsiDevices) {
+		if err = Umount(ctx, mountpoint); err != nil && !force {
+			return fmt.Errorf("could not unmount %s; %v", mountpoint, err)
+		}
+	}
+
+	listAllISCSIDevices(ctx)
+	for _, deviceInfo := range iscsiDevices {
+		lunCtx := WithLogFields(ctx, log.Fields{LogFieldLUN: deviceInfo.LUN})
+
+		err = multipathFlushDevice(lunCtx, deviceInfo, force)
+		if err == nil || force {
+			err = flushDevice(lunCtx, deviceInfo, force)
+		}
+		if err == nil || force {
+			err = removeDevice(lunCtx, deviceInfo, force)
+		}
+		listAllISCSIDevicesOnError(lunCtx, err)
+		if err != nil && !force {
+			return err
+		}
+		forgetSCSITimeouts(ctx, deviceInfo)
+	}
+
+	// Give the host a chance to fully process the removals, once rather than after each LUN
+	if len(iscsiDevices) > 0 {
+		clock.Sleep(time.Second)
+	}
+
+	// Logging out by target alone ends its sessions through every portal
+	if _, err = execIscsiadmCommand(ctx, "-m", "node", "-T", targetIQN, "-u"); err != nil {
+		Logc(ctx).WithField("error", err).Debug("Error during iSCSI logout.")
+		listAllISCSIDevicesOnError(ctx, err)
+	}
+
+	listAllISCSIDevices(ctx)
+	return nil
+}
+
+// removeSCSIDevice informs Linux that a device will be removed.  The deviceInfo provided only needs
+// the devices and multipathDevice fields set.
+// IMPORTANT: The force argument has significant ramifications. Setting force=true will cause
+// the function to ignore errors, and try as hard as possible to remove the device, even if
+// that results in data loss, data corruption, or putting the system into an invalid state.
+// Setting force=false will fail at the first problem encountered, so that callers can be
+// assured that a successful return indicates that the device was cleanly removed.
+// This is important because while most of the time the top priority is to avoid data
+// loss or data corruption, there are times when data loss is unavoidable, or has already
+// happened, and in those cases it's better to be able to clean up than to be stuck in an
+// endless retry loop.
+func removeSCSIDevice(ctx context.Context, deviceInfo *ScsiDeviceInfo, force bool) (err error) {
+
+	kernelLog := startKernelLogCorrelation()
+	defer func() { err = kernelLog.annotate(ctx, err, scsiDeviceKernelLogSubjects(deviceInfo)) }()
+
+	listAllISCSIDevices(ctx)
+
+	// Flush multipath device
+	err = multipathFlushDevice(ctx, deviceInfo, force)
+	listAllISCSIDevicesOnError(ctx, err)
+	if nil != err && !force {
+		return err
+	}
+
+	// Flush devices
+	err = flushDevice(ctx, deviceInfo, force)
+	listAllISCSIDevicesOnError(ctx, err)
+	if nil != err && !force {
+		return err
+	}
+
+	// Remove device
+	err = removeDevice(ctx, deviceInfo, force)
+	listAllISCSIDevicesOnError(ctx, err)
+	if nil != err && !force {
+		return err
+	}
+
+	forgetSCSITimeouts(ctx, deviceInfo)
+
+	// Give the host a chance to fully process the removal
+	clock.Sleep(time.Second)
+	listAllISCSIDevices(ctx)
+
+	return nil
+}
+
+// ISCSISupported returns true if iscsiadm is installed and in the PATH.
+func ISCSISupported(ctx context.Context) bool {
+
+	Logc(ctx).Debug(">>>> osutils.ISCSISupported")
+	defer Logc(ctx).Debug("<<<< osutils.ISCSISupported")
+
+	return checkCapability(ctx, CapabilityISCSI).Supported
+}
+
+// ISCSIDiscoveryInfo contains information about discovered iSCSI targets.
+type ISCSIDiscoveryInfo struct {
+	Portal     string
+	PortalIP   string
+	TargetName string
+}
+
+// iSCSIDiscovery uses the 'iscsiadm' command to perform discovery.
+func iSCSIDiscovery(ctx context.Context, portal string) ([]ISCSIDiscoveryInfo, error) {
+
+	Logc(ctx).WithField("portal", portal).Debug(">>>> osutils.iSCSIDiscovery")
+	defer Logc(ctx).Debug("<<<< osutils.iSCSIDiscovery")
+
+	out, err := execIscsiadmCommand(ctx, "-m", "discovery", "-t", "sendtargets", "-p", portal)
+	if err != nil {
+		return nil, err
+	}
+
+	/*
+	   iscsiadm -m discovery -t st -p 10.63.152.249:3260
+
+	   10.63.152.249:3260,1 iqn.1992-08.com.netapp:2752.600a0980006074c20000000056b32c4d
+	   10.63.152.250:3260,2 iqn.1992-08.com.netapp:2752.600a0980006074c20000000056b32c4d
+
+	   a[0]==10.63.152.249:3260,1
+	   a[1]==iqn.1992-08.com.netapp:2752.600a0980006074c20000000056b32c4d
+
+	   For IPv6
+	   [fd20:8b1e:b258:2000:f816:3eff:feec:2]:3260,1038 iqn.1992-08.com.netapp:sn.7894d7af053711ea88b100a0b886136a
+
+	   a[0]==[fd20:8b1e:b258:2000:f816:3eff:feec:2]:3260,1038
+	   a[1]==iqn.1992-08.com.netapp:sn.7894d7af053711ea88b100a0b886136a
+	*/
+
+	var discoveryInfo []ISCSIDiscoveryInfo
+
+	discoveryPortal := iscsi.ParsePortal(portal)
+
+	lines := strings.Split(string(out), "\n")
+	for _, l := range lines {
+		a := strings.Fields(l)
+		if len(a) >= 2 {
+
+			// Link-local portals are reported without the zone through which they were discovered
+			discovered := iscsi.ParsePortal(a[0]).WithZoneOf(discoveryPortal)
+			portalIP := discovered.HostString()
+
+			discoveryInfo = append(discoveryInfo, ISCSIDiscoveryInfo{
+				Portal:     discovered.StringWithTag(),
+				PortalIP:   portalIP,
+				TargetName: a[1],
+			})
+
+			Logc(ctx).WithFields(log.Fields{
+				"Portal":     discovered.StringWithTag(),
+				"PortalIP":   portalIP,
+				"TargetName": a[1],
+			}).Debug("Adding iSCSI discovery info.")
+		}
+	}
+	return discoveryInfo, nil
+}
+
+// ISCSISessionInfo contains information about iSCSI sessions.
+type ISCSISessionInfo struct {
+	SID        string
+	Portal     string
+	PortalIP   string
+	TargetName string
+}
+
+// getISCSISessionInfo parses output from 'iscsiadm -m session' and returns the parsed output.
+func getISCSISessionInfo(ctx context.Context) ([]ISCSISessionInfo, error) {
+
+	Logc(ctx).Debug(">>>> osutils.getISCSISessionInfo")
+	defer Logc(ctx).Debug("<<<< osutils.getISCSISessionInfo")
+
+	out, err := execIscsiadmCommand(ctx, "-m", "session")
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if ok && exitErr.ProcessState.Sys().(syscall.WaitStatus).ExitStatus() == iSCSIErrNoObjsFound {
+			Logc(ctx).Debug("No iSCSI session found.")
+			return []ISCSISessionInfo{}, nil
+		} else {
+			Logc(ctx).WithField("error", err).Error("Problem checking iSCSI sessions.")
+			return nil, err
+		}
+	}
+
+	/*
+	   # iscsiadm -m session
+
+	   tcp: [3] 10.0.207.7:3260,1028 iqn.1992-08.com.netapp:sn.afbb1784f77411e582f8080027e22798:vs.3 (non-flash)
+	   tcp: [4] 10.0.207.9:3260,1029 iqn.1992-08.com.netapp:sn.afbb1784f77411e582f8080027e22798:vs.3 (non-flash)
+
+	   a[0]==tcp:
+	   a[1]==[4]
+	   a[2]==10.0.207.9:3260,1029
+	   a[3]==iqn.1992-08.com.netapp:sn.afbb1784f77411e582f8080027e22798:vs.3
+	   a[4]==(non-flash)
+	*/
+
+	var sessionInfo []ISCSISessionInfo
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	for _, l := range lines {
+
+		a := strings.Fields(l)
+		if len(a) > 3 {
+			sid := a[1]
+			sid = sid[1 : len(sid)-1]
+
+			portalIP := iscsi.ParsePortal(a[2]).HostString()
+
+			sessionInfo = append(sessionInfo, ISCSISessionInfo{
+				SID:        sid,
+				Portal:     a[2],
+				PortalIP:   portalIP,
+				TargetName: a[3],
+			})
+
+			Logc(ctx).WithFields(log.Fields{
+				"SID":        sid,
+				"Portal":     a[2],
+				"PortalIP":   portalIP,
+				"TargetName": a[3],
+			}).Debug("Adding iSCSI session info.")
+		}
+	}
+
+	return sessionInfo, nil
+}
+
+// ISCSISessionAuthInfo describes how an iSCSI session was authenticated.  CHAP secrets are never reported.
+type ISCSISessionAuthInfo struct {
+	SID            string
+	UseCHAP        bool
+	Username       string
+	TargetUsername string
+}
+
+// GetSessionAuthInfo reports, for each session to the specified target, whether the session was established with
+// CHAP and with which usernames.  This allows callers to detect an existing session whose authentication no longer
+// matches what a volume requires, rather than silently reusing it.
+func GetSessionAuthInfo(ctx context.Context, targetIQN string) ([]ISCSISessionAuthInfo, error) {
+
+	Logc(ctx).WithField("targetIQN", targetIQN).Debug(">>>> osutils.GetSessionAuthInfo")
+	defer Logc(ctx).Debug("<<<< osutils.GetSessionAuthInfo")
+
+	sysPath := chrootPathPrefix + "/sys/class/iscsi_session/"
+	sessionDirs, err := ioutil.ReadDir(sysPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []ISCSISessionAuthInfo{}, nil
+		}
+		Logc(ctx).WithField("error", err).Errorf("Could not read %s", sysPath)
+		return nil, err
+	}
+
+	// Sysfs reports unset CHAP attributes either as empty or as "(null)"
+	readAttribute := func(filename string) (string, error) {
+		value, err := readFileWithTimeout(ctx, filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return "", nil
+			}
+			return "", err
+		}
+		if trimmed := strings.TrimSpace(string(value)); trimmed != "(null)" {
+			return trimmed, nil
+		}
+		return "", nil
+	}
+
+	authInfo := make([]ISCSISessionAuthInfo, 0)
+	for _, sessionDir := range sessionDirs {
+
+		sessionName := sessionDir.Name()
+		if !strings.HasPrefix(sessionName, "session") {
+			continue
+		}
+		sessionPath := sysPath + sessionName
+
+		targetName, err := readAttribute(sessionPath + "/targetname")
+		if err != nil {
+			return nil, err
+		} else if targetName != targetIQN {
+			continue
+		}
+
+		username, err := readAttribute(sessionPath + "/username")
+		if err != nil {
+			return nil, err
+		}
+		targetUsername, err := readAttribute(sessionPath + "/username_in")
+		if err != nil {
+			return nil, err
+		}
+
+		info := ISCSISessionAuthInfo{
+			SID:            strings.TrimPrefix(sessionName, "session"),
+			UseCHAP:        username != "",
+			Username:       username,
+			TargetUsername: targetUsername,
+		}
+
+		Logc(ctx).WithFields(log.Fields{
+			"SID":            info.SID,
+			"useCHAP":        info.UseCHAP,
+			"username":       info.Username,
+			"targetUsername": info.TargetUsername,
+		}).Debug("Found iSCSI session auth info.")
+
+		authInfo = append(authInfo, info)
+	}
+
+	return authInfo, nil
+}
+
+// validateCHAPCredentials verifies that a volume using CHAP has complete credentials: an initiator username and
+// secret, and for bidirectional CHAP, both a target username and secret.  Partial credentials would otherwise be
+// written to the node record as is and fail at login with a less helpful error, or silently skip target
+// authentication.
+func validateCHAPCredentials(publishInfo *VolumePublishInfo) error {
+
+	if !publishInfo.UseCHAP {
+		return nil
+	}
+
+	initiatorSecret := secretOrRef(publishInfo.IscsiInitiatorSecret, publishInfo.IscsiInitiatorSecretRef)
+	targetSecret := secretOrRef(publishInfo.IscsiTargetSecret, publishInfo.IscsiTargetSecretRef)
+
+	switch {
+	case publishInfo.IscsiUsername == "":
+		return errors.New("invalid CHAP credentials: no initiator username")
+	case !initiatorSecret.IsSet():
+		return fmt.Errorf("invalid CHAP credentials: no initiator secret for username %s", publishInfo.IscsiUsername)
+	case publishInfo.IscsiTargetUsername != "" && !targetSecret.IsSet():
+		return fmt.Errorf("invalid CHAP credentials: no target secret for target username %s",
+			publishInfo.IscsiTargetUsername)
+	case publishInfo.IscsiTargetUsername == "" && targetSecret.IsSet():
+		return errors.New("invalid CHAP credentials: target secret without a target username")
+	}
+	return nil
+}
+
+// verifyCHAPSessions verifies that every session to a target logged in to with CHAP was established with the
+// expected usernames, so that a session without CHAP, such as one that already existed, isn't used for a volume
+// that requires it.
+func verifyCHAPSessions(ctx context.Context, targetIQN, username, targetUsername string) error {
+
+	authInfo, err := GetSessionAuthInfo(ctx, targetIQN)
+	if err != nil {
+		return fmt.Errorf("could not verify CHAP on sessions to target %s; %v", targetIQN, err)
+	}
+
+	for _, session := range authInfo {
+		switch {
+		case !session.UseCHAP:
+			return fmt.Errorf("iSCSI session %s to target %s was established without CHAP", session.SID, targetIQN)
+		case session.Username != username:
+			return fmt.Errorf("iSCSI session %s to target %s was established with CHAP username %s, not %s",
+				session.SID, targetIQN, session.Username, username)
+		case session.TargetUsername != targetUsername:
+			return fmt.Errorf("iSCSI session %s to target %s was established with CHAP target username %q, not %q",
+				session.SID, targetIQN, session.TargetUsername, targetUsername)
+		}
+	}
+	return nil
+}
+
+// ISCSILogout logs out from the supplied target
+func ISCSILogout(ctx context.Context, targetIQN, targetPortal string) error {
+
+	ctx = WithLogFields(ctx, log.Fields{LogFieldTargetIQN: targetIQN, LogFieldPortal: targetPortal})
+
+	Logc(ctx).Debug(">>>> osutils.ISCSILogout")
+	defer Logc(ctx).Debug("<<<< osutils.ISCSILogout")
+
+	if _, err := execIscsiadmCommand(ctx, "-m", "node", "-T", targetIQN, "--portal", formatPortal(targetPortal),
+		"-u"); err != nil {
+		Logc(ctx).WithField("error", err).Debug("Error during iSCSI logout.")
+		listAllISCSIDevicesOnError(ctx, err)
+	}
+
+	// We used to delete the iscsi "node" at this point but that could interfere with
+	// another iSCSI client (such as kubelet with and "iscsi" PV) attempting to use
+	// the same node.
+
+	listAllISCSIDevices(ctx)
+	return nil
+}
+
+// removeMountPoint attempts to unmount and remove the directory of the mountPointPath
+func removeMountPoint(ctx context.Context, mountPointPath string) error {
+
+	Logc(ctx).Debug(">>>> osutils.removeMountPoint")
+	defer Logc(ctx).Debug("<<<< osutils.removeMountPoint")
+
+	err := Umount(ctx, mountPointPath)
+	if err != nil {
+		Logc(ctx).WithField("mountPointPath", mountPointPath).Errorf("Umount failed; %s", err)
+		return err
+	}
+
+	return removeMountPointDir(ctx, mountPointPath)
+}
+
+// removeMountPointDir removes the directory of an unmounted mountpoint, once it's been verified to be removable.
+func removeMountPointDir(ctx context.Context, mountPointPath string) error {
+
+	if err := ensureMountPointRemovable(ctx, mountPointPath); err != nil {
+		Logc(ctx).WithField("mountPointPath", mountPointPath).Errorf("Not removing mountpoint; %s", err)
+		return err
+	}
+
+	if err := os.Remove(mountPointPath); err != nil {
+		Logc(ctx).WithField("mountPointPath", mountPointPath).Errorf("Remove dir failed; %s", err)
+		return fmt.Errorf("failed to remove dir %s; %s", mountPointPath, err)
+	}
+	return nil
+}
+
+// ensureMountPointRemovable verifies that a directory just unmounted is no longer a mountpoint and is empty, so
+// that an unmount that silently failed, or a filesystem left mounted beneath it, can't lead to deleting a volume's
+// data along with the directory.
+func ensureMountPointRemovable(ctx context.Context, mountPointPath string) error {
+
+	notMountPoint, err := IsLikelyNotMountPoint(mountPointPath)
+	if err != nil {
+		return fmt.Errorf("could not determine whether %s is still a mountpoint; %v", mountPointPath, err)
+	} else if !notMountPoint {
+		return fmt.Errorf("%s is still a mountpoint after unmounting", mountPointPath)
+	}
+
+	// A bind mount from the parent's filesystem has the parent's device, so check the mount table too
+	if mounted, err := IsMounted(ctx, "", mountPointPath); err != nil {
+		Logc(ctx).WithField("mountPointPath", mountPointPath).WithError(err).Debug("Could not check mount table.")
+	} else if mounted {
+		return fmt.Errorf("%s is still mounted after unmounting", mountPointPath)
+	}
+
+	entries, err := ioutil.ReadDir(mountPointPath)
+	if err != nil {
+		return fmt.Errorf("could not read %s; %v", mountPointPath, err)
+	} else if len(entries) > 0 {
+		return fmt.Errorf("%s is not empty after unmounting", mountPointPath)
+	}
+
+	return nil
+}
+
+// mountFilesystemForResize expands a filesystem. The xfs_growfs utility requires a mount point to expand the
+// filesystem. Determining the size of the filesystem requires that the filesystem be mounted.
+func mountFilesystemForResize(
+	ctx context.Context, devicePath string, stagedTargetPath string, mountOptions string,
+) (string, error) {
+
+	logFields := log.Fields{
+		"devicePath":       devicePath,
+		"stagedTargetPath": stagedTargetPath,
+		"mountOptions":     mountOptions,
+	}
+	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.mountAndExpandFilesystem")
+	defer Logc(ctx).WithFields(logFields).Debug("<<<< osutils.mountAndExpandFilesystem")
+
+	tmpMountPoint, err := newTemporaryMountPoint(ctx, stagedTargetPath)
+	if err != nil {
+		return "", err
+	}
+	if err = MountDevice(ctx, devicePath, tmpMountPoint, mountOptions, false); err != nil {
+		if removeErr := removeMountPointDir(ctx, tmpMountPoint); removeErr != nil {
+			Logc(ctx).WithError(removeErr).Warning("Could not remove temporary mountpoint.")
+		}
+		return "", fmt.Errorf("unable to mount device; %s", err)
+	}
+	return tmpMountPoint, nil
+}
+
+// ExpandISCSIFilesystem will expand the filesystem of an already expanded volume.  If the device is already mounted
+// read-write somewhere on the host, that mount is used for the resize; otherwise the device is mounted temporarily.
+// An error is returned if the filesystem didn't grow although its device has room for it to.
+func ExpandISCSIFilesystem(
+	ctx context.Context, publishInfo *VolumePublishInfo, stagedTargetPath string,
+) (result FilesystemResizeResult, err error) {
+
+	devicePath := publishInfo.DevicePath
+	logFields := log.Fields{
+		"devicePath":       devicePath,
+		"stagedTargetPath": stagedTargetPath,
+		"mountOptions":     publishInfo.MountOptions,
+		"filesystemType":   publishInfo.FilesystemType,
+	}
+	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.ExpandISCSIFilesystem")
+	defer Logc(ctx).WithFields(logFields).Debug("<<<< osutils.ExpandISCSIFilesystem")
+
+	resizeStart := time.Now()
+	defer func() {
+		result.Duration = time.Since(resizeStart)
+		journalFilesystemResize(ctx, result, err)
+	}()
+	kernelLog := startKernelLogCorrelation()
+	defer func() { err = kernelLog.annotate(ctx, err, deviceKernelLogSubjects(devicePath)) }()
+
+	switch publishInfo.FilesystemType {
+	case "xfs", "ext3", "ext4":
+	case fsZFS:
+		if publishInfo.Zpool == "" {
+			return result, errors.New("no zpool recorded for volume")
+		}
+	default:
+		return result, fmt.Errorf("unsupported file system type: %s", publishInfo.FilesystemType)
+	}
+
+	// Volumes staged before stable device paths were recorded refer to dm-N, which may have changed since
+	if strings.HasPrefix(devicePath, "/dev/dm-") {
+		deviceInfo, err := getDeviceInfoForLUN(ctx, int(publishInfo.IscsiLunNumber), publishInfo.IscsiTargetIQN, false)
+		if err == nil && deviceInfo != nil && deviceInfo.MultipathDevice != "" {
+			devicePath = getMultipathDevicePath(ctx, deviceInfo.MultipathDevice)
+			publishInfo.DevicePath = devicePath
+		}
+	}
+
+	// Grow each layer beneath the filesystem, such as multipath and dm-crypt devices, from the bottom up
+	if err = resizeDeviceStack(ctx, devicePath); err != nil {
+		return result, err
+	}
+
+	if result.DeviceSize, err = getISCSIDiskSize(ctx, devicePath); err != nil {
+		return result, fmt.Errorf("could not get size of device %s; %v", devicePath, err)
+	}
+
+	// A zpool grows into its device whether or not any of its datasets are mounted
+	if publishInfo.FilesystemType == fsZFS {
+		if result.PreExpandSize, err = getZpoolSize(ctx, publishInfo.Zpool); err != nil {
+			return result, err
+		}
+		if result.PostExpandSize, err = expandZpool(ctx, publishInfo.Zpool, devicePath); err != nil {
+			return result, err
+		}
+		return result, checkFilesystemGrew(devicePath, result)
+	}
+
+	// Refuse a size the filesystem can't be grown to before it's partly grown
+	if err = validateFilesystemResize(ctx, publishInfo.FilesystemType, devicePath, result.DeviceSize); err != nil {
+		return result, err
+	}
+
+	mountPoint, err := findWritableMountPointForDevice(ctx, devicePath)
+	if err != nil {
+		return result, err
+	}
+	if mountPoint == "" {
+		mountPoint, err = mountFilesystemForResize(
+			ctx, publishInfo.DevicePath, stagedTargetPath, publishInfo.MountOptions)
+		if err != nil {
+			return result, err
+		}
+		defer removeMountPoint(ctx, mountPoint) //nolint
+	}
+
+	result.PreExpandSize, result.PostExpandSize, err = expandFilesystem(ctx, publishInfo.FilesystemType, devicePath,
+		mountPoint)
+	if err != nil {
+		return result, err
+	}
+	return result, checkFilesystemGrew(devicePath, result)
+}
+
+// Device mapper target types that are resized as part of a device stack
+const (
+	deviceLayerDisk      = "disk"
+	deviceLayerMultipath = "multipath"
+	deviceLayerCrypt     = "crypt"
+	deviceLayerOther     = "other"
+)
+
+// deviceLayer is one block device in a stack of devices, such as a dm-crypt device atop a multipath device atop
+// several SCSI disks.
+type deviceLayer struct {
+	Name   string // kernel name, as in "dm-3" or "sdb"
+	DMName string // device mapper name, if a dm device
+	Type   string
+	Slaves []*deviceLayer
+}
+
+// getDeviceStack walks /sys/block from the named device down to its physical devices.
+func getDeviceStack(ctx context.Context, name string) (*deviceLayer, error) {
+	return getDeviceStackLayer(ctx, name, make(map[string]*deviceLayer))
+}
+
+func getDeviceStackLayer(ctx context.Context, name string, visited map[string]*deviceLayer) (*deviceLayer, error) {
+
+	if layer, ok := visited[name]; ok {
+		return layer, nil
+	}
+
+	layer := &deviceLayer{Name: name, Type: deviceLayerDisk}
+	visited[name] = layer
+
+	sysPath := chrootPathPrefix + "/sys/block/" + name
+	if _, err := os.Stat(sysPath); err != nil {
+		return nil, fmt.Errorf("could not find block device %s; %v", name, err)
+	}
+
+	if uuid, err := ioutil.ReadFile(sysPath + "/dm/uuid"); err == nil {
+		dmName, _ := ioutil.ReadFile(sysPath + "/dm/name")
+		layer.DMName = strings.TrimSpace(string(dmName))
+		switch dmUUID := strings.TrimSpace(string(uuid)); {
+		case strings.HasPrefix(dmUUID, "CRYPT-"):
+			layer.Type = deviceLayerCrypt
+		case strings.HasPrefix(dmUUID, "mpath-"):
+			layer.Type = deviceLayerMultipath
+		default:
+			layer.Type = deviceLayerOther
+		}
+	}
+
+	slaves, err := ioutil.ReadDir(sysPath + "/slaves")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, slave := range slaves {
+		slaveLayer, err := getDeviceStackLayer(ctx, slave.Name(), visited)
+		if err != nil {
+			return nil, err
+		}
+		layer.Slaves = append(layer.Slaves, slaveLayer)
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"device": layer.Name,
+		"dmName": layer.DMName,
+		"type":   layer.Type,
+		"slaves": len(layer.Slaves),
+	}).Debug("Found device stack layer.")
+
+	return layer, nil
+}
+
+// orderForResize returns the layers of a device stack bottom-up, so that each layer is resized after all the
+// layers beneath it.
+func (l *deviceLayer) orderForResize() []*deviceLayer {
+
+	ordered := make([]*deviceLayer, 0)
+	seen := make(map[string]bool)
+
+	var visit func(layer *deviceLayer)
+	visit = func(layer *deviceLayer) {
+		if seen[layer.Name] {
+			return
+		}
+		seen[layer.Name] = true
+		for _, slave := range layer.Slaves {
+			visit(slave)
+		}
+		ordered = append(ordered, layer)
+	}
+	visit(l)
+
+	return ordered
+}
+
+// resizeDeviceStack grows each layer beneath a filesystem from the physical paths up: disks are rescanned,
+// multipath devices are reloaded, and dm-crypt devices are resized with cryptsetup.
+func resizeDeviceStack(ctx context.Context, devicePath string) error {
+
+	fields := log.Fields{"devicePath": devicePath}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.resizeDeviceStack")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.resizeDeviceStack")
+
+	device, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return err
+	}
+
+	stack, err := getDeviceStack(ctx, filepath.Base(device))
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range stack.orderForResize() {
+		switch layer.Type {
+		case deviceLayerDisk:
+			if err := iSCSIRescanDisk(ctx, layer.Name); err != nil {
+				return fmt.Errorf("failed to rescan disk %s: %v", layer.Name, err)
+			}
+		case deviceLayerMultipath:
+			if err := reloadMultipathDevice(ctx, layer.Name); err != nil {
+				return err
+			}
+		case deviceLayerCrypt:
+			if _, err := execCommandWithTimeout(ctx, "cryptsetup", 30, true, "resize", layer.DMName); err != nil {
+				Logc(ctx).WithFields(log.Fields{
+					"device": layer.DMName,
+					"error":  err,
+				}).Error("Failed to resize dm-crypt device.")
+				return fmt.Errorf("failed to resize dm-crypt device %s: %v", layer.DMName, err)
+			}
+		default:
+			Logc(ctx).WithField("device", layer.Name).Debug("Not resizing unrecognized device mapper layer.")
+		}
+	}
+
+	return nil
+}
+
+// findWritableMountPointForDevice returns a path at which the supplied device is already mounted read-write, or
+// an empty string if there is no such mount.
+func findWritableMountPointForDevice(ctx context.Context, devicePath string) (string, error) {
+
+	device, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return "", err
+	}
+
+	procSelfMountinfo, err := listProcSelfMountinfo(procSelfMountinfoPath)
+	if err != nil {
+		return "", err
+	}
+
+	for _, procMount := range MountsOfDevice(procSelfMountinfo, device) {
+		if procMount.IsReadOnly() {
+			continue
+		}
+
+		Logc(ctx).WithFields(log.Fields{
+			"device":     device,
+			"mountPoint": procMount.MountPoint,
+		}).Debug("Found existing mount for device.")
+		return procMount.MountPoint, nil
+	}
+
+	return "", nil
+}
+
+// expandFilesystem grows the filesystem mounted at mountPoint and returns its sizes before and after.  The kernel's
+// online resize ioctls are tried first, and the xfs_growfs/resize2fs utilities are used if that fails.
+func expandFilesystem(
+	ctx context.Context, fsType, devicePath, mountPoint string,
+) (preExpandSize, postExpandSize int64, err error) {
+
+	logFields := log.Fields{
+		"fsType":     fsType,
+		"devicePath": devicePath,
+		"mountPoint": mountPoint,
+	}
+	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.expandFilesystem")
+	defer Logc(ctx).WithFields(logFields).Debug("<<<< osutils.expandFilesystem")
+
+	if preExpandSize, err = getFilesystemSize(ctx, mountPoint); err != nil {
+		return 0, 0, err
+	}
+
+	if disableNativeFilesystemResize {
+		err = UnsupportedError("native filesystem resize is disabled")
+	} else {
+		err = growFilesystemNatively(ctx, fsType, devicePath, mountPoint)
+	}
+	if err != nil {
+		Logc(ctx).WithError(err).Debug("Native filesystem resize failed, falling back to resize utility.")
+
+		switch fsType {
+		case "xfs":
+			_, err = execCommand(ctx, "xfs_growfs", mountPoint)
+		case "ext3", "ext4":
+			_, err = execCommand(ctx, "resize2fs", devicePath)
+		default:
+			err = fmt.Errorf("unsupported file system type: %s", fsType)
+		}
+		if err != nil {
+			Logc(ctx).Errorf("Expanding filesystem failed; %s", err)
+			return preExpandSize, 0, err
+		}
+	}
+
+	if postExpandSize, err = getFilesystemSize(ctx, mountPoint); err != nil {
+		return preExpandSize, 0, err
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"preExpandSize":  preExpandSize,
+		"postExpandSize": postExpandSize,
+	}).Debug("Expanded filesystem.")
+
+	return preExpandSize, postExpandSize, nil
+}
+
+// portalMatches compares an iSCSI portal reported by iscsiadm with a requested portal.  The hosts must be
+// equal, comparing IP addresses structurally so that equivalent IPv6 forms match, and the ports must be
+// equal unless the requested portal does not specify one.  A requested portal named by hostname also matches
+// sessions to any address the hostname was resolved to, since iscsiadm reports sessions by address.
+func portalMatches(sessionPortal, portal string) bool {
+	session, requested := iscsi.ParsePortal(sessionPortal), iscsi.ParsePortal(portal)
+	if session.Matches(requested) {
+		return true
+	}
+	if requested.IP() != nil {
+		return false
+	}
+	for _, address := range cachedHostAddresses(requested.Host) {
+		resolved := requested
+		resolved.Host, resolved.Zone = address.IP.String(), address.Zone
+		if session.Matches(resolved) {
+			return true
+		}
+	}
+	return false
+}
+
+// iSCSISessionExists checks to see if a session exists to the specified portal.  If the portal does not
+// specify a port, a session to any port on the portal's host is considered a match.
+func iSCSISessionExists(ctx context.Context, portal string) (bool, error) {
+
+	Logc(ctx).WithField("portal", portal).Debug(">>>> osutils.iSCSISessionExists")
+	defer Logc(ctx).Debug("<<<< osutils.iSCSISessionExists")
+
+	sessionInfo, err := getISCSISessionInfo(ctx)
+	if err != nil {
+		Logc(ctx).WithField("error", err).Error("Problem checking iSCSI sessions.")
+		return false, err
+	}
+
+	for _, e := range sessionInfo {
+		if portalMatches(e.Portal, portal) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// iSCSISessionExistsToPortalAndTargetIQN checks to see if a session exists to the specified target through
+// the specified portal.
+func iSCSISessionExistsToPortalAndTargetIQN(ctx context.Context, portal, targetIQN string) (bool, error) {
+
+	logFields := log.Fields{
+		"portal":    portal,
+		"targetIQN": targetIQN,
+	}
+	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.iSCSISessionExistsToPortalAndTargetIQN")
+	defer Logc(ctx).Debug("<<<< osutils.iSCSISessionExistsToPortalAndTargetIQN")
+
+	sessionInfo, err := getISCSISessionInfo(ctx)
+	if err != nil {
+		Logc(ctx).WithField("error", err).Error("Problem checking iSCSI sessions.")
+		return false, err
+	}
+
+	for _, e := range sessionInfo {
+		if e.TargetName == targetIQN && portalMatches(e.Portal, portal) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// iSCSISessionExistsToTargetIQN checks to see if a session exists to the specified target.
+func iSCSISessionExistsToTargetIQN(ctx context.Context, targetIQN string) (bool, error) {
+
+	Logc(ctx).Debug(">>>> osutils.iSCSISessionExistsToTargetIQN")
+	defer Logc(ctx).Debug("<<<< osutils.iSCSISessionExistsToTargetIQN")
+
+	sessionInfo, err := getISCSISessionInfo(ctx)
+	if err != nil {
+		Logc(ctx).WithField("error", err).Error("Problem checking iSCSI sessions.")
+		return false, err
+	}
+
+	for _, e := range sessionInfo {
+		if e.TargetName == targetIQN {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// portalsToLogin checks to see if session to for all the specified portals exist to the specified
+// target. If a session does not exist for a give portal it is added to list of portals that Trident
+// needs to login to.
+func portalsToLogin(ctx context.Context, targetIQN string, portals []string) ([]string, error) {
+
+	logFields := log.Fields{
+		"targetIQN": targetIQN,
+		"portals":   portals,
+	}
+
+	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.portalsToLogin")
+	defer Logc(ctx).Debug("<<<< osutils.portalsToLogin")
+
+	portalsNotLoggedIn := make([]string, len(portals))
+	copy(portalsNotLoggedIn, portals)
+
+	sessionInfo, err := getISCSISessionInfo(ctx)
+	if err != nil {
+		Logc(ctx).WithField("error", err).Error("Problem checking iSCSI sessions.")
+		return portalsNotLoggedIn, err
+	}
+
+	for _, e := range sessionInfo {
+		if e.TargetName == targetIQN {
+
+			// Portals (portalsNotLoggedIn) may/may not contain a port, so match structurally against e.Portal,
+			// which always carries the port and target portal group tag
+			matchFunc := func(main, val string) bool {
+				return portalMatches(main, val)
+			}
+
+			portalsNotLoggedIn = RemoveStringFromSliceConditionally(portalsNotLoggedIn, e.Portal, matchFunc)
+		}
+	}
+
+	return portalsNotLoggedIn, nil
+}
+
+// routeLookup reports whether this host has a route toward a subnet
+var routeLookup = routeExistsToSubnet
+
+// inStorageCIDRs returns true if a subnet lies within one of the configured storage networks.
+func inStorageCIDRs(subnet *net.IPNet) bool {
+	ones, _ := subnet.Mask.Size()
+	for _, cidr := range storageCIDRs {
+		if cidrOnes, _ := cidr.Mask.Size(); cidr.Contains(subnet.IP) && cidrOnes <= ones {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneLookup reports whether the interface named by an IPv6 zone is up
+var zoneLookup = iscsi.ZoneInterfaceUp
+
+// filterReachablePortals returns the portals this host can reach, on a subnet it's attached to or on a configured
+// storage network, so that logins aren't left to time out through portals on subnets the host isn't attached to,
+// such as a storage VLAN that reaches only some nodes.  A portal whose reachability can't be determined is kept,
+// and if no portal is reachable, all of them are returned so that the logins report the failure.
+func filterReachablePortals(ctx context.Context, portals []string) []string {
+
+	if disablePortalReachabilityCheck || len(portals) < 2 {
+		return portals
+	}
+
+	reachable := make([]string, 0, len(portals))
+	for _, portal := range portals {
+		p := iscsi.ParsePortal(portal)
+		ip := p.IP()
+		if ip == nil {
+			reachable = append(reachable, portal)
+			continue
+		}
+
+		// Every interface has a route toward link-local addresses, so only the zone's interface matters
+		if p.IsLinkLocal() && p.Zone != "" {
+			if up, err := zoneLookup(p.Zone); err != nil {
+				Logc(ctx).WithField("portal", portal).WithError(err).Warning(
+					"No interface for zone of iSCSI portal, not logging in through it.")
+			} else if !up {
+				Logc(ctx).WithField("portal", portal).Warning(
+					"Interface for zone of iSCSI portal is down, not logging in through it.")
+			} else {
+				reachable = append(reachable, portal)
+			}
+			continue
+		}
+
+		if ipv4 := ip.To4(); ipv4 != nil {
+			ip = ipv4
+		}
+		hostBits := 8 * len(ip)
+		ok, err := routeLookup(ctx, &net.IPNet{IP: ip, Mask: net.CIDRMask(hostBits, hostBits)})
+		if err != nil {
+			Logc(ctx).WithField("portal", portal).WithError(err).Debug("Could not look up route toward portal.")
+			reachable = append(reachable, portal)
+		} else if ok {
+			reachable = append(reachable, portal)
+		} else {
+			Logc(ctx).WithField("portal", portal).Warning("No route toward iSCSI portal, not logging in through it.")
+		}
+	}
+
+	if len(reachable) == 0 {
+		Logc(ctx).WithField("portals", portals).Warning("No route toward any iSCSI portal.")
+		return portals
+	}
+	return reachable
 }
 
 // getHostportIP returns just the IP address part of the given input IP address and strips any port information
 func getHostportIP(hostport string) string {
-	ipAddress := ""
-	if IPv6Check(hostport) {
-		// this is an IPv6 address, remove port value and add square brackets around the IP address
-		if hostport[0] == '[' {
-			ipAddress = strings.Split(hostport, "]")[0] + "]"
+	return iscsi.ParsePortal(hostport).HostString()
+}
+
+// ensureHostportFormatted ensures IPv6 hostport is in correct format
+func ensureHostportFormatted(hostport string) string {
+	return iscsi.ParsePortal(hostport).String()
+}
+
+// formatPortal returns the iSCSI portal string, ensuring an IPv6 address is enclosed in square brackets and
+// appending the default port number if one isn't already present
+func formatPortal(portal string) string {
+	return iscsi.ParsePortal(portal).WithDefaultPort().String()
+}
+
+// ISCSIRescanDevices rescans the paths of a LUN until they and any multipath device reflect at least the
+// specified size.  Paths that can't be read or rescanned are dropped from the multipath device, as long as a
+// healthy path remains, and are returned so the caller can report them.
+func ISCSIRescanDevices(ctx context.Context, targetIQN string, lunID int32, minSize int64) ([]string, error) {
+
+	fields := log.Fields{"targetIQN": targetIQN, "lunID": lunID}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.ISCSIRescanDevices")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.ISCSIRescanDevices")
+
+	deviceInfo, err := getDeviceInfoForLUN(ctx, int(lunID), targetIQN, false)
+	if err != nil {
+		return nil, fmt.Errorf("error getting iSCSI device information: %s", err)
+	} else if deviceInfo == nil {
+		return nil, fmt.Errorf("could not get iSCSI device information for LUN: %d", lunID)
+	}
+
+	// Every path is checked before any is dropped, so that a LUN whose paths have all failed keeps them
+	failedPaths := make([]failedPath, 0)
+	healthyDevices := make([]string, 0)
+	allLargeEnough := true
+	for _, diskDevice := range deviceInfo.Devices {
+		size, err := getISCSIDiskSize(ctx, "/dev/"+diskDevice)
+		if err != nil {
+			failedPaths = append(failedPaths, failedPath{diskDevice, err})
+			continue
+		}
+		if size < minSize {
+			allLargeEnough = false
+		} else {
+			healthyDevices = append(healthyDevices, diskDevice)
+			continue
+		}
+
+		err = iSCSIRescanDisk(ctx, diskDevice)
+		if err != nil {
+			Logc(ctx).WithField("diskDevice", diskDevice).Error("Failed to rescan disk.")
+			failedPaths = append(failedPaths, failedPath{diskDevice,
+				fmt.Errorf("failed to rescan disk %s: %s", diskDevice, err)})
+			continue
+		}
+		healthyDevices = append(healthyDevices, diskDevice)
+	}
+
+	droppedPaths, err := dropFailedPaths(ctx, deviceInfo.MultipathDevice, failedPaths, healthyDevices)
+	if err != nil {
+		return droppedPaths, err
+	}
+	if len(healthyDevices) == 0 {
+		return droppedPaths, fmt.Errorf("no healthy paths remain for LUN %d on target %s", lunID, targetIQN)
+	}
+
+	if !allLargeEnough {
+		clock.Sleep(time.Second)
+		for _, diskDevice := range healthyDevices {
+			size, err := getISCSIDiskSize(ctx, "/dev/"+diskDevice)
+			if err != nil {
+				return droppedPaths, err
+			}
+			if size < minSize {
+				Logc(ctx).Error("Disk size not large enough after resize.")
+				return droppedPaths, fmt.Errorf("disk size not large enough after resize: %d, %d", size, minSize)
+			}
+		}
+	}
+
+	if deviceInfo.MultipathDevice != "" {
+		multipathDevice := deviceInfo.MultipathDevice
+		size, err := getISCSIDiskSize(ctx, "/dev/"+multipathDevice)
+		if err != nil {
+			return droppedPaths, err
+		}
+
+		fields = log.Fields{"size": size, "minSize": minSize}
+		if size < minSize {
+			Logc(ctx).WithFields(fields).Debug("Reloading the multipath device.")
+			err := reloadMultipathDevice(ctx, multipathDevice)
+			if err != nil {
+				return droppedPaths, err
+			}
+			clock.Sleep(time.Second)
+			size, err = getISCSIDiskSize(ctx, "/dev/"+multipathDevice)
+			if err != nil {
+				return droppedPaths, err
+			}
+			if size < minSize {
+				Logc(ctx).Error("Multipath device not large enough after resize.")
+				return droppedPaths, fmt.Errorf("multipath device not large enough after resize: %d < %d", size, minSize)
+			}
+		} else {
+			Logc(ctx).WithFields(fields).Debug("Not reloading the multipath device because the size is greater than or equal to the minimum size.")
+		}
+	}
+
+	return droppedPaths, nil
+}
+
+// failedPath is a SCSI path of a LUN that failed to be sized or rescanned.
+type failedPath struct {
+	diskDevice string
+	err        error
+}
+
+// dropFailedPaths removes failed paths from a LUN's multipath device so that a resize can continue on its healthy
+// paths, returning the paths dropped.  Paths are dropped only while a healthy path remains, so the multipath device
+// never loses its last path, and a LUN without a multipath device has no path to spare, so its first failure is
+// returned instead.
+func dropFailedPaths(
+	ctx context.Context, multipathDevice string, failedPaths []failedPath, healthyDevices []string,
+) ([]string, error) {
+
+	droppedPaths := make([]string, 0)
+	if len(failedPaths) == 0 {
+		return droppedPaths, nil
+	}
+	if multipathDevice == "" {
+		return droppedPaths, failedPaths[0].err
+	}
+	if len(healthyDevices) == 0 {
+		Logc(ctx).WithFields(log.Fields{
+			"multipathDevice": multipathDevice,
+			"failedPaths":     len(failedPaths),
+		}).Error("Every path of the multipath device failed; keeping them all.")
+		return droppedPaths, failedPaths[0].err
+	}
+
+	for _, failed := range failedPaths {
+		Logc(ctx).WithFields(log.Fields{
+			"diskDevice":      failed.diskDevice,
+			"multipathDevice": multipathDevice,
+			"error":           failed.err,
+		}).Warning("Dropping failed path from multipath device.")
+		if err := removeMultipathPath(ctx, failed.diskDevice); err != nil {
+			Logc(ctx).WithField("diskDevice", failed.diskDevice).Warning(
+				"Could not remove failed path from multipath device.")
+		}
+		droppedPaths = append(droppedPaths, failed.diskDevice)
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"droppedPaths": droppedPaths,
+		"healthyPaths": healthyDevices,
+	}).Warning("Continuing resize on healthy paths.")
+
+	return droppedPaths, nil
+}
+
+// removeMultipathPath removes a single path from its multipath device, leaving the SCSI device in place.
+func removeMultipathPath(ctx context.Context, diskDevice string) error {
+
+	fields := log.Fields{"diskDevice": diskDevice}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.removeMultipathPath")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.removeMultipathPath")
+
+	if _, err := execCommandWithTimeout(ctx, "multipathd", 10, true, "del", "path", diskDevice); err != nil {
+		Logc(ctx).WithFields(log.Fields{
+			"diskDevice": diskDevice,
+			"error":      err,
+		}).Error("Failed to remove path from multipath device.")
+		return fmt.Errorf("failed to remove path %s from multipath device: %s", diskDevice, err)
+	}
+
+	return nil
+}
+
+func reloadMultipathDevice(ctx context.Context, multipathDevice string) error {
+
+	fields := log.Fields{"multipathDevice": multipathDevice}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.reloadMultipathDevice")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.reloadMultipathDevice")
+
+	if multipathDevice == "" {
+		return fmt.Errorf("cannot reload an empty multipathDevice")
+	}
+
+	_, err := execCommandWithTimeout(ctx, "multipath", 30, true, "-r", "/dev/"+multipathDevice)
+	if err != nil {
+		Logc(ctx).WithFields(log.Fields{
+			"device": multipathDevice,
+			"error":  err,
+		}).Error("Failed to reload multipathDevice.")
+		return fmt.Errorf("failed to reload multipathDevice %s: %s", multipathDevice, err)
+	}
+
+	Logc(ctx).WithFields(fields).Debug("Multipath device reloaded.")
+	return nil
+}
+
+// iSCSIRescanDisk causes the kernel to rescan a single iSCSI disk/block device.
+// This is how size changes are found when expanding a volume.
+func iSCSIRescanDisk(ctx context.Context, deviceName string) error {
+
+	fields := log.Fields{"deviceName": deviceName}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.iSCSIRescanDisk")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.iSCSIRescanDisk")
+
+	listAllISCSIDevices(ctx)
+	filename := fmt.Sprintf(chrootPathPrefix+"/sys/block/%s/device/rescan", deviceName)
+	Logc(ctx).WithField("filename", filename).Debug("Opening file for writing.")
+
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		Logc(ctx).WithField("file", filename).Warning("Could not open file for writing.")
+		return err
+	}
+	defer f.Close()
+
+	written, err := f.WriteString("1")
+	if err != nil {
+		Logc(ctx).WithFields(log.Fields{
+			"file":  filename,
+			"error": err,
+		}).Warning("Could not write to file.")
+		return err
+	} else if written == 0 {
+		Logc(ctx).WithField("file", filename).Warning("Zero bytes written to file.")
+		return fmt.Errorf("no data written to %s", filename)
+	}
+
+	listAllISCSIDevices(ctx)
+	return nil
+}
+
+// iSCSIScanTargetLUN scans a single LUN on an iSCSI target to discover it.
+func iSCSIScanTargetLUN(ctx context.Context, lunID int, hosts []int) error {
+
+	fields := log.Fields{"hosts": hosts, "lunID": lunID}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.iSCSIScanTargetLUN")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.iSCSIScanTargetLUN")
+
+	var (
+		f   *os.File
+		err error
+	)
+
+	listAllISCSIDevices(ctx)
+	for _, hostNumber := range hosts {
+
+		filename := fmt.Sprintf(chrootPathPrefix+"/sys/class/scsi_host/host%d/scan", hostNumber)
+		if f, err = os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0200); err != nil {
+			Logc(ctx).WithField("file", filename).Warning("Could not open file for writing.")
+			return err
+		}
+
+		scanCmd := fmt.Sprintf("0 0 %d", lunID)
+		if written, err := f.WriteString(scanCmd); err != nil {
+			Logc(ctx).WithFields(log.Fields{"file": filename, "error": err}).Warning("Could not write to file.")
+			f.Close()
+			return err
+		} else if written == 0 {
+			Logc(ctx).WithField("file", filename).Warning("No data written to file.")
+			f.Close()
+			return fmt.Errorf("no data written to %s", filename)
+		}
+
+		f.Close()
+
+		listAllISCSIDevices(ctx)
+		Logc(ctx).WithFields(log.Fields{
+			"scanCmd":  scanCmd,
+			"scanFile": filename,
+		}).Debug("Invoked single-LUN scan.")
+	}
+
+	return nil
+}
+
+// IsAlreadyAttached checks if there is already an established iSCSI session to the specified LUN.
+func IsAlreadyAttached(ctx context.Context, lunID int, targetIqn string) bool {
+
+	hostSessionMap := GetISCSIHostSessionMapForTarget(ctx, targetIqn)
+	if len(hostSessionMap) == 0 {
+		return false
+	}
+
+	paths := getSysfsBlockDirsForLUN(lunID, hostSessionMap)
+
+	devices, err := getDevicesForLUN(paths)
+	if nil != err {
+		return false
+	}
+
+	return 0 < len(devices)
+}
+
+// getLunSerial get Linux's idea of what the LUN serial number is
+func getLunSerial(ctx context.Context, path string) (string, error) {
+	Logc(ctx).WithField("path", path).Debug("Get LUN Serial")
+	// We're going to read the SCSI VPD page 80 serial number
+	// information. Linux helpfully provides this through sysfs
+	// so we don't need to open the device and send the ioctl
+	// ourselves.
+	filename := path + "/vpd_pg80"
+	b, err := readFileWithTimeout(ctx, filename)
+	if err != nil {
+		return "", err
+	}
+	if 4 > len(b) || 0x80 != b[1] {
+		Logc(ctx).WithFields(log.Fields{
+			"data": b,
+		}).Error("VPD page 80 format check failed")
+		return "", fmt.Errorf("malformed VPD page 80 data")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if len(b) != length+4 {
+		Logc(ctx).WithFields(log.Fields{
+			"actual":   len(b),
+			"expected": length + 4,
+		}).Error("VPD page 80 length check failed")
+		return "", fmt.Errorf("incorrect length for VPD page 80 serial number")
+	}
+	return string(b[4:]), nil
+}
+
+// readFileResult is used to return file contents via channels between goroutines
+type readFileResult struct {
+	Output []byte
+	Error  error
+}
+
+// readFileWithTimeout reads a file in a separate goroutine so that a sysfs attribute backed by a faulty path
+// can't block the caller indefinitely.  A TimeoutError is returned if the read doesn't complete in time.
+func readFileWithTimeout(ctx context.Context, filename string) ([]byte, error) {
+
+	timeout := deviceReadTimeout
+	done := make(chan readFileResult, 1)
+
+	go func() {
+		out, err := ioutil.ReadFile(filename)
+		done <- readFileResult{Output: out, Error: err}
+	}()
+
+	select {
+	case <-time.After(timeout):
+		Logc(ctx).WithFields(log.Fields{
+			"file":    filename,
+			"timeout": timeout,
+		}).Error("Timed out reading file.")
+		return nil, TimeoutError(fmt.Sprintf("timed out reading %s", filename))
+	case result := <-done:
+		return result.Output, result.Error
+	}
+}
+
+// purgeOneLun issues a delete for one LUN, based on the sysfs path
+func purgeOneLun(ctx context.Context, path string) error {
+	Logc(ctx).WithField("path", path).Debug("Purging one LUN")
+	filename := path + "/delete"
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0200)
+	if err != nil {
+		Logc(ctx).WithField("file", filename).Warning("Could not open file for writing.")
+		return err
+	}
+	defer f.Close()
+
+	// Deleting a LUN is achieved by writing the string "1" to the "delete" file
+	written, err := f.WriteString("1")
+	if err != nil {
+		Logc(ctx).WithFields(log.Fields{"file": filename, "error": err}).Warning("Could not write to file.")
+		return err
+	}
+	if written == 0 {
+		Logc(ctx).WithField("file", filename).Warning("No data written to file.")
+		return errors.New("too few bytes written to sysfs file")
+	}
+
+	return nil
+}
+
+// rescanOneLun issues a rescan for one LUN, based on the sysfs path
+func rescanOneLun(ctx context.Context, path string) error {
+	Logc(ctx).WithField("path", path).Debug("Rescaning one LUN")
+	filename := path + "/rescan"
+
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0200)
+	if err != nil {
+		Logc(ctx).WithField("file", filename).Warning("Could not open file for writing.")
+		return err
+	}
+	defer f.Close()
+
+	written, err := f.WriteString("1")
+	if err != nil {
+		Logc(ctx).WithFields(log.Fields{"file": filename, "error": err}).Warning("Could not write to file.")
+		return err
+	}
+	if written == 0 {
+		Logc(ctx).WithField("file", filename).Warning("No data written to file.")
+		return errors.New("too few bytes written to sysfs file")
+	}
+
+	return nil
+}
+
+// handleInvalidSerials checks the LUN serial number for each path of a given LUN, and
+// if it doesn't match the expected value, runs a handler function.
+func handleInvalidSerials(ctx context.Context, lunID int, targetIqn, expectedSerial string,
+	handler func(ctx context.Context, path string) error,
+) error {
+	if "" == expectedSerial {
+		// Empty string means don't care
+		return nil
+	}
+
+	hostSessionMap := GetISCSIHostSessionMapForTarget(ctx, targetIqn)
+	paths := getSysfsBlockDirsForLUN(lunID, hostSessionMap)
+	for _, path := range paths {
+		serial, err := getLunSerial(ctx, path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// LUN either isn't scanned yet, or this kernel
+				// doesn't support VPD page 80 in sysfs. Assume
+				// correctness and move on
+				Logc(ctx).WithFields(log.Fields{
+					"lun":    lunID,
+					"target": targetIqn,
+					"path":   path,
+				}).Debug("LUN serial check skipped")
+				continue
+			}
+			return err
+		}
+
+		if serial != expectedSerial {
+			Logc(ctx).WithFields(log.Fields{
+				"expected": expectedSerial,
+				"actual":   serial,
+				"lun":      lunID,
+				"target":   targetIqn,
+				"path":     path,
+			}).Warn("LUN serial check failed")
+			err = handler(ctx, path)
+			if err != nil {
+				return err
+			}
 		} else {
-			// assumption here is that without the square brackets its only IP address without port information
-			ipAddress = "[" + hostport + "]"
+			Logc(ctx).WithFields(log.Fields{
+				"serial": serial,
+				"lun":    lunID,
+				"target": targetIqn,
+				"path":   path,
+			}).Debug("LUN serial check passed")
+		}
+	}
+
+	return nil
+}
+
+// GetISCSIHostSessionMapForTarget returns a map of iSCSI host numbers to iSCSI session numbers
+// for a given iSCSI target.
+func GetISCSIHostSessionMapForTarget(ctx context.Context, iSCSINodeName string) map[int]int {
+
+	fields := log.Fields{"iSCSINodeName": iSCSINodeName}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.GetISCSIHostSessionMapForTarget")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.GetISCSIHostSessionMapForTarget")
+
+	var (
+		hostNumber    int
+		sessionNumber int
+	)
+
+	hostSessionMap := make(map[int]int)
+
+	sysPath := chrootPathPrefix + "/sys/class/iscsi_host/"
+	if hostDirs, err := ioutil.ReadDir(sysPath); err != nil {
+		Logc(ctx).WithField("error", err).Errorf("Could not read %s", sysPath)
+		return hostSessionMap
+	} else {
+		for _, hostDir := range hostDirs {
+
+			hostName := hostDir.Name()
+			if !strings.HasPrefix(hostName, "host") {
+				continue
+			} else if hostNumber, err = strconv.Atoi(strings.TrimPrefix(hostName, "host")); err != nil {
+				Logc(ctx).WithField("host", hostName).Error("Could not parse host number")
+				continue
+			}
+
+			devicePath := sysPath + hostName + "/device/"
+			if deviceDirs, err := ioutil.ReadDir(devicePath); err != nil {
+				Logc(ctx).WithFields(log.Fields{
+					"error":      err,
+					"devicePath": devicePath,
+				}).Error("Could not read device path.")
+				return hostSessionMap
+			} else {
+				for _, deviceDir := range deviceDirs {
+
+					sessionName := deviceDir.Name()
+					if !strings.HasPrefix(sessionName, "session") {
+						continue
+					} else if sessionNumber, err = strconv.Atoi(strings.TrimPrefix(sessionName, "session")); err != nil {
+						Logc(ctx).WithField("session", sessionName).Error("Could not parse session number")
+						continue
+					}
+
+					targetNamePath := devicePath + sessionName + "/iscsi_session/" + sessionName + "/targetname"
+					if targetName, err := readFileWithTimeout(ctx, targetNamePath); err != nil {
+
+						Logc(ctx).WithFields(log.Fields{
+							"path":  targetNamePath,
+							"error": err,
+						}).Error("Could not read targetname file")
+
+					} else if strings.TrimSpace(string(targetName)) == iSCSINodeName {
+
+						Logc(ctx).WithFields(log.Fields{
+							"hostNumber":    hostNumber,
+							"sessionNumber": sessionNumber,
+						}).Debug("Found iSCSI host/session.")
+
+						hostSessionMap[hostNumber] = sessionNumber
+					}
+				}
+			}
+		}
+	}
+
+	return hostSessionMap
+}
+
+// LUNRange is an inclusive range of LUN numbers.
+type LUNRange struct {
+	Min int
+	Max int
+}
+
+// ISCSIDeviceFilter selects iSCSI devices.  Zero values match every device.
+type ISCSIDeviceFilter struct {
+	// IQN matches only devices attached through the target with this IQN
+	IQN string
+	// LUNs, if set, matches only devices whose LUN number is in the range
+	LUNs *LUNRange
+	// MountedOnly matches only devices that are mounted, directly or through their multipath device
+	MountedOnly bool
+}
+
+// iSCSIDeviceWalkWorkers bounds how many iSCSI sessions are read from sysfs at once
+const iSCSIDeviceWalkWorkers = 8
+
+// GetISCSIDevices returns a list of iSCSI devices that are attached to (but not necessarily mounted on) this host.
+func GetISCSIDevices(ctx context.Context) ([]*ScsiDeviceInfo, error) {
+	return FindISCSIDevices(ctx, ISCSIDeviceFilter{})
+}
+
+// FindISCSIDevices returns a list of the iSCSI devices attached to this host that match a filter, ordered by
+// host and LUN number.
+func FindISCSIDevices(ctx context.Context, filter ISCSIDeviceFilter) ([]*ScsiDeviceInfo, error) {
+
+	devices := make([]*ScsiDeviceInfo, 0)
+	err := WalkISCSIDevices(ctx, filter, func(device *ScsiDeviceInfo) error {
+		devices = append(devices, device)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Sessions are walked in parallel, so restore a stable order
+	sort.Slice(devices, func(i, j int) bool {
+		hostI, _ := strconv.Atoi(devices[i].Host)
+		hostJ, _ := strconv.Atoi(devices[j].Host)
+		if hostI != hostJ {
+			return hostI < hostJ
+		}
+		lunI, _ := strconv.Atoi(devices[i].LUN)
+		lunJ, _ := strconv.Atoi(devices[j].LUN)
+		return lunI < lunJ
+	})
+
+	return devices, nil
+}
+
+// WalkISCSIDevices calls fn for each iSCSI device attached to this host that matches a filter, as the device is
+// found rather than after every device has been found.  Sessions are read from sysfs in parallel by a bounded
+// pool of workers, so devices are visited in no particular order, but fn is never called concurrently.  If fn
+// returns an error, the walk stops and returns that error.
+func WalkISCSIDevices(ctx context.Context, filter ISCSIDeviceFilter, fn func(*ScsiDeviceInfo) error) error {
+
+	Logc(ctx).WithField("filter", filter).Debug(">>>> osutils.WalkISCSIDevices")
+	defer Logc(ctx).Debug("<<<< osutils.WalkISCSIDevices")
+
+	walk := &iSCSIDeviceWalk{
+		filter:          filter,
+		fn:              fn,
+		hostSessionMaps: make(map[string]map[int]int),
+		stop:            make(chan struct{}),
+	}
+
+	if filter.MountedOnly {
+		mountedDevices, err := getMountedDeviceNames(ctx)
+		if err != nil {
+			return err
+		}
+		walk.mounted = make(map[string]bool, len(mountedDevices))
+		for _, device := range mountedDevices {
+			walk.mounted[device] = true
+		}
+	}
+
+	// Start by reading the sessions from /sys/class/iscsi_session
+	sysPath := chrootPathPrefix + "/sys/class/iscsi_session/"
+	sessionDirs, err := ioutil.ReadDir(sysPath)
+	if err != nil {
+		Logc(ctx).WithField("error", err).Errorf("Could not read %s", sysPath)
+		return err
+	}
+
+	workers := iSCSIDeviceWalkWorkers
+	if len(sessionDirs) < workers {
+		workers = len(sessionDirs)
+	}
+
+	sessions := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sessionName := range sessions {
+				if err := walk.walkSession(ctx, sysPath, sessionName); err != nil {
+					walk.fail(err)
+				}
+			}
+		}()
+	}
+
+sessionLoop:
+	for _, sessionDir := range sessionDirs {
+		select {
+		case sessions <- sessionDir.Name():
+		case <-walk.stop:
+			break sessionLoop
+		}
+	}
+	close(sessions)
+	wg.Wait()
+
+	return walk.err
+}
+
+// iSCSIDeviceWalk is the state shared by the workers of WalkISCSIDevices.
+type iSCSIDeviceWalk struct {
+	filter  ISCSIDeviceFilter
+	mounted map[string]bool
+	fn      func(*ScsiDeviceInfo) error
+
+	// mutex serializes calls to fn and guards err
+	mutex sync.Mutex
+	err   error
+	stop  chan struct{}
+
+	cacheMutex      sync.Mutex
+	hostSessionMaps map[string]map[int]int
+}
+
+// fail records the first error of a walk and stops it.
+func (w *iSCSIDeviceWalk) fail(err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err == nil {
+		w.err = err
+		close(w.stop)
+	}
+}
+
+// visit passes a device to the walk's callback, unless the walk has stopped.
+func (w *iSCSIDeviceWalk) visit(device *ScsiDeviceInfo) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.fn(device); err != nil {
+		w.err = err
+		close(w.stop)
+		return err
+	}
+	return nil
+}
+
+// hostSessionMap returns the host/session map for a target, reading it only once per walk.
+func (w *iSCSIDeviceWalk) hostSessionMap(ctx context.Context, targetIQN string) map[int]int {
+	w.cacheMutex.Lock()
+	defer w.cacheMutex.Unlock()
+	hostSessionMap, ok := w.hostSessionMaps[targetIQN]
+	if !ok {
+		hostSessionMap = GetISCSIHostSessionMapForTarget(ctx, targetIQN)
+		w.hostSessionMaps[targetIQN] = hostSessionMap
+	}
+	return hostSessionMap
+}
+
+// isMounted returns true if a device, or the multipath device over it, is mounted.
+func (w *iSCSIDeviceWalk) isMounted(device *ScsiDeviceInfo) bool {
+	if w.mounted[device.MultipathDevice] {
+		return true
+	}
+	for _, path := range device.Devices {
+		if w.mounted[path] {
+			return true
 		}
-	} else {
-		ipAddress = strings.Split(hostport, ":")[0]
 	}
-
-	return ipAddress
+	return false
 }
 
-// ensureHostportFormatted ensures IPv6 hostport is in correct format
-func ensureHostportFormatted(hostport string) string {
-	// If this is an IPv6 address, ensure IP address is enclosed in square
-	// brackets, as in "[::1]:80".
-	if IPv6Check(hostport) && hostport[0] != '[' {
-		// assumption here is that without the square brackets its only IP address without port information
-		return "[" + hostport + "]"
-	}
+// walkSession visits the matching devices attached through one iSCSI session.
+func (w *iSCSIDeviceWalk) walkSession(ctx context.Context, sysPath, sessionName string) error {
 
-	return hostport
-}
+	if !strings.HasPrefix(sessionName, "session") {
+		return nil
+	} else if _, err := strconv.Atoi(strings.TrimPrefix(sessionName, "session")); err != nil {
+		Logc(ctx).WithField("session", sessionName).Error("Could not parse session number")
+		return err
+	}
 
-// formatPortal returns the iSCSI portal string, appending a port number if one isn't
-// already present, and also appending a target portal group tag if one is not present
-func formatPortal(portal string) string {
-	if portalPortPattern.MatchString(portal) {
-		return portal
-	} else {
-		return portal + ":3260"
+	// Find the target IQN from the session at /sys/class/iscsi_session/sessionXXX/targetname
+	sessionPath := sysPath + sessionName
+	targetNamePath := sessionPath + "/targetname"
+	targetNameBytes, err := readFileWithTimeout(ctx, targetNamePath)
+	if err != nil {
+		Logc(ctx).WithFields(log.Fields{
+			"path":  targetNamePath,
+			"error": err,
+		}).Error("Could not read targetname file")
+		return err
 	}
-}
 
-func ISCSIRescanDevices(ctx context.Context, targetIQN string, lunID int32, minSize int64) error {
+	targetIQN := strings.TrimSpace(string(targetNameBytes))
+	if w.filter.IQN != "" && targetIQN != w.filter.IQN {
+		return nil
+	}
 
-	fields := log.Fields{"targetIQN": targetIQN, "lunID": lunID}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.ISCSIRescanDevices")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.ISCSIRescanDevices")
+	Logc(ctx).WithFields(log.Fields{
+		"targetIQN":   targetIQN,
+		"sessionName": sessionName,
+	}).Debug("Found iSCSI session / target IQN.")
 
-	deviceInfo, err := getDeviceInfoForLUN(ctx, int(lunID), targetIQN, false)
+	// Find the one target at /sys/class/iscsi_session/sessionXXX/device/targetHH:BB:DD (host:bus:device)
+	sessionDevicePath := sessionPath + "/device/"
+	targetDirs, err := ioutil.ReadDir(sessionDevicePath)
 	if err != nil {
-		return fmt.Errorf("error getting iSCSI device information: %s", err)
-	} else if deviceInfo == nil {
-		return fmt.Errorf("could not get iSCSI device information for LUN: %d", lunID)
+		Logc(ctx).WithField("error", err).Errorf("Could not read %s", sessionDevicePath)
+		return err
 	}
 
-	allLargeEnough := true
-	for _, diskDevice := range deviceInfo.Devices {
-		size, err := getISCSIDiskSize(ctx, "/dev/"+diskDevice)
-		if err != nil {
-			return err
+	// Get the one target directory
+	hostBusDeviceName := ""
+	targetDirName := ""
+	for _, targetDir := range targetDirs {
+
+		targetDirName = targetDir.Name()
+
+		if strings.HasPrefix(targetDirName, "target") {
+			hostBusDeviceName = strings.TrimPrefix(targetDirName, "target")
+			break
 		}
-		if size < minSize {
-			allLargeEnough = false
-		} else {
+	}
+
+	if hostBusDeviceName == "" {
+		Logc(ctx).Warningf("Could not find a host:bus:device directory at %s", sessionDevicePath)
+		return nil
+	}
+
+	sessionDeviceHBDPath := sessionDevicePath + targetDirName + "/"
+
+	Logc(ctx).WithFields(log.Fields{
+		"hbdPath": sessionDeviceHBDPath,
+		"hbdName": hostBusDeviceName,
+	}).Debug("Found host/bus/device path.")
+
+	// Find the devices at /sys/class/iscsi_session/sessionXXX/device/targetHH:BB:DD/HH:BB:DD:LL (host:bus:device:lun)
+	hostBusDeviceLunDirs, err := ioutil.ReadDir(sessionDeviceHBDPath)
+	if err != nil {
+		Logc(ctx).WithField("error", err).Errorf("Could not read %s", sessionDeviceHBDPath)
+		return err
+	}
+
+	for _, hostBusDeviceLunDir := range hostBusDeviceLunDirs {
+
+		hostBusDeviceLunDirName := hostBusDeviceLunDir.Name()
+		if !strings.HasPrefix(hostBusDeviceLunDirName, hostBusDeviceName) {
 			continue
 		}
 
-		err = iSCSIRescanDisk(ctx, diskDevice)
-		if err != nil {
-			Logc(ctx).WithField("diskDevice", diskDevice).Error("Failed to rescan disk.")
-			return fmt.Errorf("failed to rescan disk %s: %s", diskDevice, err)
+		sessionDeviceHBDLPath := sessionDeviceHBDPath + hostBusDeviceLunDirName + "/"
+
+		Logc(ctx).WithFields(log.Fields{
+			"hbdlPath": sessionDeviceHBDLPath,
+			"hbdlName": hostBusDeviceLunDirName,
+		}).Debug("Found host/bus/device/LUN path.")
+
+		hbdlValues := strings.Split(hostBusDeviceLunDirName, ":")
+		if len(hbdlValues) != 4 {
+			Logc(ctx).Errorf("Could not parse values from %s", hostBusDeviceLunDirName)
+			return fmt.Errorf("could not parse values from %s", hostBusDeviceLunDirName)
 		}
-	}
 
-	if !allLargeEnough {
-		time.Sleep(time.Second)
-		for _, diskDevice := range deviceInfo.Devices {
-			size, err := getISCSIDiskSize(ctx, "/dev/"+diskDevice)
-			if err != nil {
-				return err
-			}
-			if size < minSize {
-				Logc(ctx).Error("Disk size not large enough after resize.")
-				return fmt.Errorf("disk size not large enough after resize: %d, %d", size, minSize)
+		hostNum := hbdlValues[0]
+		busNum := hbdlValues[1]
+		deviceNum := hbdlValues[2]
+		lunNum := hbdlValues[3]
+
+		// Skip LUNs outside the requested range before doing any further work on them
+		if w.filter.LUNs != nil {
+			lunID, err := strconv.Atoi(lunNum)
+			if err != nil || lunID < w.filter.LUNs.Min || lunID > w.filter.LUNs.Max {
+				continue
 			}
 		}
-	}
 
-	if deviceInfo.MultipathDevice != "" {
-		multipathDevice := deviceInfo.MultipathDevice
-		size, err := getISCSIDiskSize(ctx, "/dev/"+multipathDevice)
+		blockPath := sessionDeviceHBDLPath + "/block/"
+
+		// Find the block device at /sys/class/iscsi_session/sessionXXX/device/targetHH:BB:DD/HH:BB:DD:LL/block
+		blockDeviceDirs, err := ioutil.ReadDir(blockPath)
 		if err != nil {
+			Logc(ctx).WithField("error", err).Errorf("Could not read %s", blockPath)
 			return err
 		}
 
-		fields = log.Fields{"size": size, "minSize": minSize}
-		if size < minSize {
-			Logc(ctx).WithFields(fields).Debug("Reloading the multipath device.")
-			err := reloadMultipathDevice(ctx, multipathDevice)
-			if err != nil {
-				return err
+		for _, blockDeviceDir := range blockDeviceDirs {
+
+			blockDeviceName := blockDeviceDir.Name()
+
+			Logc(ctx).WithField("blockDeviceName", blockDeviceName).Debug("Found block device.")
+
+			// Find multipath device, if any
+			var slaveDevices []string
+			multipathDevice := findMultipathDeviceForDevice(ctx, blockDeviceName)
+			if multipathDevice != "" {
+				slaveDevices = findDevicesForMultipathDevice(ctx, multipathDevice)
+			} else {
+				slaveDevices = []string{blockDeviceName}
 			}
-			time.Sleep(time.Second)
-			size, err = getISCSIDiskSize(ctx, "/dev/"+multipathDevice)
-			if err != nil {
-				return err
+
+			// Get the host/session map, using a cached value if available
+			hostSessionMap := w.hostSessionMap(ctx, targetIQN)
+
+			Logc(ctx).WithFields(log.Fields{
+				"host":            hostNum,
+				"lun":             lunNum,
+				"devices":         slaveDevices,
+				"multipathDevice": multipathDevice,
+				"iqn":             targetIQN,
+				"hostSessionMap":  hostSessionMap,
+			}).Debug("Found iSCSI device.")
+
+			discardDevice := blockDeviceName
+			if multipathDevice != "" {
+				discardDevice = multipathDevice
 			}
-			if size < minSize {
-				Logc(ctx).Error("Multipath device not large enough after resize.")
-				return fmt.Errorf("multipath device not large enough after resize: %d < %d", size, minSize)
+
+			device := &ScsiDeviceInfo{
+				Host:            hostNum,
+				Channel:         busNum,
+				Target:          deviceNum,
+				LUN:             lunNum,
+				Devices:         slaveDevices,
+				MultipathDevice: multipathDevice,
+				IQN:             targetIQN,
+				HostSessionMap:  hostSessionMap,
+			}
+			if w.mounted != nil && !w.isMounted(device) {
+				continue
+			}
+			device.SupportsDiscard = deviceSupportsDiscard(ctx, discardDevice)
+			populateDeviceAttributes(ctx, device)
+
+			if err = w.visit(device); err != nil {
+				return err
 			}
-		} else {
-			Logc(ctx).WithFields(fields).Debug("Not reloading the multipath device because the size is greater than or equal to the minimum size.")
 		}
 	}
 
 	return nil
 }
 
-func reloadMultipathDevice(ctx context.Context, multipathDevice string) error {
+// MountpointMatch selects how a requested mountpoint is compared with the mountpoints in /proc/self/mountinfo.
+//
+// Deprecated: use mount.Match.
+type MountpointMatch = mount.Match
 
-	fields := log.Fields{"multipathDevice": multipathDevice}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.reloadMultipathDevice")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.reloadMultipathDevice")
+const (
+	// MountpointExact matches only a mount at exactly the requested path.
+	//
+	// Deprecated: use mount.MountpointExact.
+	MountpointExact = mount.MountpointExact
+	// MountpointOrChild matches a mount at the requested path or at any path beneath it.
+	//
+	// Deprecated: use mount.MountpointOrChild.
+	MountpointOrChild = mount.MountpointOrChild
+)
 
-	if multipathDevice == "" {
-		return fmt.Errorf("cannot reload an empty multipathDevice")
+// IsMounted verifies if the supplied device is attached at exactly the supplied location.
+func IsMounted(ctx context.Context, sourceDevice, mountpoint string) (bool, error) {
+	return IsMountedMatching(ctx, sourceDevice, mountpoint, MountpointExact)
+}
+
+// IsMountedMatching verifies if the supplied device is attached at the supplied location, or beneath it if
+// MountpointOrChild is specified.  If no device is supplied, any mount at a matching location suffices.
+func IsMountedMatching(ctx context.Context, sourceDevice, mountpoint string, match MountpointMatch) (bool, error) {
+
+	fields := log.Fields{
+		"source": sourceDevice,
+		"target": mountpoint,
+		"match":  match,
 	}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.IsMountedMatching")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.IsMountedMatching")
+
+	// Mountpoints are host-relative, so they're found among the host's mounts
+	procSelfMountinfo, err := listProcSelfMountinfo(hostMountinfoPath())
 
-	_, err := execCommandWithTimeout(ctx, "multipath", 30, true, "-r", "/dev/"+multipathDevice)
 	if err != nil {
-		Logc(ctx).WithFields(log.Fields{
-			"device": multipathDevice,
-			"error":  err,
-		}).Error("Failed to reload multipathDevice.")
-		return fmt.Errorf("failed to reload multipathDevice %s: %s", multipathDevice, err)
+		Logc(ctx).WithFields(fields).Errorf("checking mounted failed; %s", err)
+		return false, fmt.Errorf("checking mounted failed; %s", err)
 	}
 
-	Logc(ctx).WithFields(fields).Debug("Multipath device reloaded.")
-	return nil
+	var sourceDeviceName string
+	if sourceDevice != "" && strings.HasPrefix(sourceDevice, "/dev/") {
+		if name, err := getBlockDeviceNameForPath(sourceDevice); err == nil {
+			sourceDeviceName = name
+		} else {
+			sourceDeviceName = strings.TrimPrefix(sourceDevice, "/dev/")
+		}
+	}
+
+	normalizedMountpoint := mount.NormalizeMountpoint(mountpoint)
+
+	for _, procMount := range procSelfMountinfo {
+
+		if !mount.MountpointMatches(procMount.MountPoint, normalizedMountpoint, match) {
+			continue
+		}
+
+		Logc(ctx).Debugf("Mountpoint found: %v", procMount)
+
+		if sourceDevice == "" {
+			Logc(ctx).Debugf("Source device: none, Target: %s, is mounted: true", mountpoint)
+			return true, nil
+		}
+
+		if mountedDevice := getMountedDeviceName(ctx, procMount); sourceDeviceName == mountedDevice {
+			Logc(ctx).Debugf("Source device: %s, Target: %s, is mounted: true", sourceDeviceName, mountpoint)
+			return true, nil
+		}
+	}
+
+	Logc(ctx).Debugf("Source device: %s, Target: %s, is mounted: false", sourceDevice, mountpoint)
+	return false, nil
 }
 
-// iSCSIRescanDisk causes the kernel to rescan a single iSCSI disk/block device.
-// This is how size changes are found when expanding a volume.
-func iSCSIRescanDisk(ctx context.Context, deviceName string) error {
+// GetMountInfo returns the list of mounts found in /proc/self/mountinfo
+func GetMountInfo(ctx context.Context) ([]MountInfo, error) {
+	Logc(ctx).Debug(">>>> osutils.GetMountInfo")
+	defer Logc(ctx).Debug("<<<< osutils.GetMountInfo")
 
-	fields := log.Fields{"deviceName": deviceName}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.iSCSIRescanDisk")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.iSCSIRescanDisk")
+	return listProcSelfMountinfo(procSelfMountinfoPath)
+}
 
-	listAllISCSIDevices(ctx)
-	filename := fmt.Sprintf(chrootPathPrefix+"/sys/block/%s/device/rescan", deviceName)
-	Logc(ctx).WithField("filename", filename).Debug("Opening file for writing.")
+// GetMountedISCSIDevices returns a list of iSCSI devices that are *mounted* on this host.
+func GetMountedISCSIDevices(ctx context.Context) ([]*ScsiDeviceInfo, error) {
 
-	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	Logc(ctx).Debug(">>>> osutils.GetMountedISCSIDevices")
+	defer Logc(ctx).Debug("<<<< osutils.GetMountedISCSIDevices")
+
+	mountedDevices, err := getMountedDeviceNames(ctx)
 	if err != nil {
-		Logc(ctx).WithField("file", filename).Warning("Could not open file for writing.")
-		return err
+		return nil, err
 	}
-	defer f.Close()
 
-	written, err := f.WriteString("1")
+	// Get all known iSCSI devices
+	iscsiDevices, err := GetISCSIDevices(ctx)
 	if err != nil {
+		return nil, err
+	}
+
+	mountedISCSIDevices := filterMountedISCSIDevices(mountedDevices, iscsiDevices)
+
+	for _, md := range mountedISCSIDevices {
 		Logc(ctx).WithFields(log.Fields{
-			"file":  filename,
-			"error": err,
-		}).Warning("Could not write to file.")
-		return err
-	} else if written == 0 {
-		Logc(ctx).WithField("file", filename).Warning("Zero bytes written to file.")
-		return fmt.Errorf("no data written to %s", filename)
+			"host":            md.Host,
+			"lun":             md.LUN,
+			"devices":         md.Devices,
+			"multipathDevice": md.MultipathDevice,
+			"iqn":             md.IQN,
+			"hostSessionMap":  md.HostSessionMap,
+		}).Debug("Found mounted iSCSI device.")
 	}
 
-	listAllISCSIDevices(ctx)
-	return nil
+	return mountedISCSIDevices, nil
 }
 
-// iSCSIScanTargetLUN scans a single LUN on an iSCSI target to discover it.
-func iSCSIScanTargetLUN(ctx context.Context, lunID int, hosts []int) error {
+// getMountedDeviceNames returns the names, like sdb or dm-0, of the devices that are mounted on this host,
+// including raw block devices bind mounted from devtmpfs.
+func getMountedDeviceNames(ctx context.Context) ([]string, error) {
 
-	fields := log.Fields{"hosts": hosts, "lunID": lunID}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.iSCSIScanTargetLUN")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.iSCSIScanTargetLUN")
+	procSelfMountinfo, err := listProcSelfMountinfo(procSelfMountinfoPath)
+	if err != nil {
+		return nil, err
+	}
 
-	var (
-		f   *os.File
-		err error
-	)
+	// Get a list of all mounted /dev devices.  Rather than guessing from the mountpoint's name which mounts belong
+	// to Trident, every device-backed mount is considered and matched against iSCSI devices by the caller.
+	mountedDevices := make([]string, 0)
+	for _, procMount := range procSelfMountinfo {
+		mountedDevice := getMountedDeviceName(ctx, procMount)
+		if mountedDevice == "" || StringInSlice(mountedDevice, mountedDevices) {
+			continue
+		}
+		mountedDevices = append(mountedDevices, mountedDevice)
+	}
 
-	listAllISCSIDevices(ctx)
-	for _, hostNumber := range hosts {
+	return mountedDevices, nil
+}
 
-		filename := fmt.Sprintf(chrootPathPrefix+"/sys/class/scsi_host/host%d/scan", hostNumber)
-		if f, err = os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0200); err != nil {
-			Logc(ctx).WithField("file", filename).Warning("Could not open file for writing.")
-			return err
+// getMountedDeviceName returns the name, like sdb or dm-0, of the device behind a mount, or an empty string if
+// the mount isn't backed by a device.
+func getMountedDeviceName(ctx context.Context, procMount MountInfo) string {
+
+	if procMount.FsType == "devtmpfs" {
+		// Raw block volumes are bind mounted from the device node within devtmpfs
+		return strings.TrimPrefix(procMount.Root, "/")
+	}
+	return getBlockDeviceName(ctx, procMount)
+}
+
+// getMountpointsForDevices returns the mountpoints of the iSCSI devices, whether mounted through their multipath
+// device or one of their paths, in the order they should be unmounted, which is the reverse of the order they were
+// mounted.  That way a volume's publish mounts are unmounted before the staging mount they were bound from.
+func getMountpointsForDevices(
+	ctx context.Context, procSelfMountinfo []MountInfo, iscsiDevices []*ScsiDeviceInfo,
+) []string {
+
+	deviceNames := make(map[string]bool)
+	for _, iscsiDevice := range iscsiDevices {
+		if iscsiDevice.MultipathDevice != "" {
+			deviceNames[iscsiDevice.MultipathDevice] = true
 		}
+		for _, device := range iscsiDevice.Devices {
+			deviceNames[device] = true
+		}
+	}
 
-		scanCmd := fmt.Sprintf("0 0 %d", lunID)
-		if written, err := f.WriteString(scanCmd); err != nil {
-			Logc(ctx).WithFields(log.Fields{"file": filename, "error": err}).Warning("Could not write to file.")
-			f.Close()
-			return err
-		} else if written == 0 {
-			Logc(ctx).WithField("file", filename).Warning("No data written to file.")
-			f.Close()
-			return fmt.Errorf("no data written to %s", filename)
+	mountpoints := make([]string, 0)
+	for i := len(procSelfMountinfo) - 1; i >= 0; i-- {
+		procMount := procSelfMountinfo[i]
+		if !deviceNames[getMountedDeviceName(ctx, procMount)] || StringInSlice(procMount.MountPoint, mountpoints) {
+			continue
 		}
+		mountpoints = append(mountpoints, procMount.MountPoint)
+	}
 
-		f.Close()
+	return mountpoints
+}
+
+// filterMountedISCSIDevices returns the iSCSI devices whose multipath device or any of whose slave devices appear
+// in the list of mounted device names.
+func filterMountedISCSIDevices(mountedDevices []string, iscsiDevices []*ScsiDeviceInfo) []*ScsiDeviceInfo {
+
+	mountedISCSIDevices := make([]*ScsiDeviceInfo, 0)
+
+	// For each mounted device, look for a matching iSCSI device
+	for _, mountedDevice := range mountedDevices {
+	iSCSIDeviceLoop:
+		for _, iscsiDevice := range iscsiDevices {
+
+			// First look for a multipath device match, then look for a slave device match
+			matched := mountedDevice == iscsiDevice.MultipathDevice
+			for _, iscsiSlaveDevice := range iscsiDevice.Devices {
+				matched = matched || mountedDevice == iscsiSlaveDevice
+			}
+			if !matched {
+				continue
+			}
 
-		listAllISCSIDevices(ctx)
-		Logc(ctx).WithFields(log.Fields{
-			"scanCmd":  scanCmd,
-			"scanFile": filename,
-		}).Debug("Invoked single-LUN scan.")
+			// A device may be mounted at several places, such as its staging and publish paths
+			for _, md := range mountedISCSIDevices {
+				if md == iscsiDevice {
+					break iSCSIDeviceLoop
+				}
+			}
+			mountedISCSIDevices = append(mountedISCSIDevices, iscsiDevice)
+			break iSCSIDeviceLoop
+		}
 	}
 
-	return nil
+	return mountedISCSIDevices
 }
 
-// IsAlreadyAttached checks if there is already an established iSCSI session to the specified LUN.
-func IsAlreadyAttached(ctx context.Context, lunID int, targetIqn string) bool {
+// ISCSITargetHasMountedDevice returns true if this host has any mounted devices on the specified target.
+func ISCSITargetHasMountedDevice(ctx context.Context, targetIQN string) (bool, error) {
 
-	hostSessionMap := GetISCSIHostSessionMapForTarget(ctx, targetIqn)
-	if len(hostSessionMap) == 0 {
-		return false
+	mountedISCSIDevices, err := GetMountedISCSIDevices(ctx)
+	if err != nil {
+		return false, err
 	}
 
-	paths := getSysfsBlockDirsForLUN(lunID, hostSessionMap)
-
-	devices, err := getDevicesForLUN(paths)
-	if nil != err {
-		return false
+	for _, device := range mountedISCSIDevices {
+		if device.IQN == targetIQN {
+			return true, nil
+		}
 	}
 
-	return 0 < len(devices)
+	return false, nil
 }
 
-// getLunSerial get Linux's idea of what the LUN serial number is
-func getLunSerial(ctx context.Context, path string) (string, error) {
-	Logc(ctx).WithField("path", path).Debug("Get LUN Serial")
-	// We're going to read the SCSI VPD page 80 serial number
-	// information. Linux helpfully provides this through sysfs
-	// so we don't need to open the device and send the ioctl
-	// ourselves.
-	filename := path + "/vpd_pg80"
-	b, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return "", err
-	}
-	if 4 > len(b) || 0x80 != b[1] {
-		Logc(ctx).WithFields(log.Fields{
-			"data": b,
-		}).Error("VPD page 80 format check failed")
-		return "", fmt.Errorf("malformed VPD page 80 data")
-	}
-	length := int(binary.BigEndian.Uint16(b[2:4]))
-	if len(b) != length+4 {
-		Logc(ctx).WithFields(log.Fields{
-			"actual":   len(b),
-			"expected": length + 4,
-		}).Error("VPD page 80 length check failed")
-		return "", fmt.Errorf("incorrect length for VPD page 80 serial number")
+// multipathFlushDevice invokes the 'multipath' commands to flush paths for a single device.  A device that would
+// hang the flush, because it queues I/O and has no working paths, is handled per the no-path queueing policy,
+// given whether the detach is forced.
+func multipathFlushDevice(ctx context.Context, deviceInfo *ScsiDeviceInfo, force bool) error {
+
+	Logc(ctx).WithField("device", deviceInfo.MultipathDevice).Debug(">>>> osutils.multipathFlushDevice")
+	defer Logc(ctx).Debug("<<<< osutils.multipathFlushDevice")
+
+	if deviceInfo.MultipathDevice == "" {
+		return nil
 	}
-	return string(b[4:]), nil
-}
 
-// purgeOneLun issues a delete for one LUN, based on the sysfs path
-func purgeOneLun(ctx context.Context, path string) error {
-	Logc(ctx).WithField("path", path).Debug("Purging one LUN")
-	filename := path + "/delete"
+	if err := ensureMultipathDeviceNotStuck(ctx, deviceInfo.MultipathDevice, force); err != nil {
+		return err
+	}
 
-	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0200)
+	err := flushOneDevice(ctx, "/dev/"+deviceInfo.MultipathDevice)
 	if err != nil {
-		Logc(ctx).WithField("file", filename).Warning("Could not open file for writing.")
 		return err
 	}
-	defer f.Close()
 
-	// Deleting a LUN is achieved by writing the string "1" to the "delete" file
-	written, err := f.WriteString("1")
+	_, err = execCommandWithTimeout(ctx, "multipath", 30, true, "-f", "/dev/"+deviceInfo.MultipathDevice)
 	if err != nil {
-		Logc(ctx).WithFields(log.Fields{"file": filename, "error": err}).Warning("Could not write to file.")
+		// nothing to do if it generates an error but log it
+		Logc(ctx).WithFields(log.Fields{
+			"device": deviceInfo.MultipathDevice,
+			"error":  err,
+		}).Error("Error encountered in multipath flush device command.")
 		return err
 	}
-	if written == 0 {
-		Logc(ctx).WithField("file", filename).Warning("No data written to file.")
-		return errors.New("too few bytes written to sysfs file")
-	}
 
 	return nil
 }
 
-// rescanOneLun issues a rescan for one LUN, based on the sysfs path
-func rescanOneLun(ctx context.Context, path string) error {
-	Logc(ctx).WithField("path", path).Debug("Rescaning one LUN")
-	filename := path + "/rescan"
+// flushDevice flushes any outstanding I/O to all paths to a device.
+func flushDevice(ctx context.Context, deviceInfo *ScsiDeviceInfo, force bool) error {
 
-	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0200)
-	if err != nil {
-		Logc(ctx).WithField("file", filename).Warning("Could not open file for writing.")
-		return err
-	}
-	defer f.Close()
+	Logc(ctx).Debug(">>>> osutils.flushDevice")
+	defer Logc(ctx).Debug("<<<< osutils.flushDevice")
 
-	written, err := f.WriteString("1")
-	if err != nil {
-		Logc(ctx).WithFields(log.Fields{"file": filename, "error": err}).Warning("Could not write to file.")
-		return err
-	}
-	if written == 0 {
-		Logc(ctx).WithField("file", filename).Warning("No data written to file.")
-		return errors.New("too few bytes written to sysfs file")
+	for _, device := range deviceInfo.Devices {
+		err := flushOneDevice(ctx, "/dev/"+device)
+		if err != nil && !force {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// handleInvalidSerials checks the LUN serial number for each path of a given LUN, and
-// if it doesn't match the expected value, runs a handler function.
-func handleInvalidSerials(ctx context.Context, lunID int, targetIqn, expectedSerial string,
-	handler func(ctx context.Context, path string) error,
-) error {
-	if "" == expectedSerial {
-		// Empty string means don't care
-		return nil
-	}
+// removeDevice tells Linux to remove the SCSI devices backing a volume.  Each device is first set offline, as the
+// kernel recommends, so that I/O still queued to it is failed rather than left waiting on a deleted device, and is
+// then deleted.  A device already gone is skipped.  Without force, removal stops at the first device that can't be
+// deleted; with force, every device is attempted, and an error naming those that couldn't be deleted is returned
+// so callers may still log it.
+func removeDevice(ctx context.Context, deviceInfo *ScsiDeviceInfo, force bool) error {
 
-	hostSessionMap := GetISCSIHostSessionMapForTarget(ctx, targetIqn)
-	paths := getSysfsBlockDirsForLUN(lunID, hostSessionMap)
-	for _, path := range paths {
-		serial, err := getLunSerial(ctx, path)
-		if err != nil {
-			if os.IsNotExist(err) {
-				// LUN either isn't scanned yet, or this kernel
-				// doesn't support VPD page 80 in sysfs. Assume
-				// correctness and move on
-				Logc(ctx).WithFields(log.Fields{
-					"lun":    lunID,
-					"target": targetIqn,
-					"path":   path,
-				}).Debug("LUN serial check skipped")
-				continue
-			}
-			return err
-		}
+	Logc(ctx).Debug(">>>> osutils.removeDevice")
+	defer Logc(ctx).Debug("<<<< osutils.removeDevice")
 
-		if serial != expectedSerial {
-			Logc(ctx).WithFields(log.Fields{
-				"expected": expectedSerial,
-				"actual":   serial,
-				"lun":      lunID,
-				"target":   targetIqn,
-				"path":     path,
-			}).Warn("LUN serial check failed")
-			err = handler(ctx, path)
-			if err != nil {
+	failed := make([]string, 0)
+
+	listAllISCSIDevices(ctx)
+	for _, deviceName := range deviceInfo.Devices {
+
+		if err := removeOneDevice(ctx, deviceName); err != nil {
+			if !force {
 				return err
 			}
-		} else {
-			Logc(ctx).WithFields(log.Fields{
-				"serial": serial,
-				"lun":    lunID,
-				"target": targetIqn,
-				"path":   path,
-			}).Debug("LUN serial check passed")
+			failed = append(failed, err.Error())
+			continue
 		}
+
+		listAllISCSIDevices(ctx)
 	}
 
+	if len(failed) > 0 {
+		return fmt.Errorf("could not remove all devices; %s", strings.Join(failed, "; "))
+	}
 	return nil
 }
 
-// GetISCSIHostSessionMapForTarget returns a map of iSCSI host numbers to iSCSI session numbers
-// for a given iSCSI target.
-func GetISCSIHostSessionMapForTarget(ctx context.Context, iSCSINodeName string) map[int]int {
+// removeOneDevice sets a SCSI device like sdx offline, unless it's already offline or failed, and deletes it.
+func removeOneDevice(ctx context.Context, deviceName string) error {
 
-	fields := log.Fields{"iSCSINodeName": iSCSINodeName}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.GetISCSIHostSessionMapForTarget")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.GetISCSIHostSessionMapForTarget")
+	fields := log.Fields{"device": deviceName}
 
-	var (
-		hostNumber    int
-		sessionNumber int
-	)
+	if _, err := os.Stat(chrootPathPrefix + "/sys/block/" + deviceName); os.IsNotExist(err) {
+		Logc(ctx).WithFields(fields).Debug("Device already removed.")
+		return nil
+	}
 
-	hostSessionMap := make(map[int]int)
+	state, _ := ioutil.ReadFile(chrootPathPrefix + "/sys/block/" + deviceName + "/device/state")
+	switch deviceState := strings.TrimSpace(string(state)); deviceState {
+	case "offline", "transport-offline":
+		// Outstanding I/O has already been failed, and the kernel won't move a device from transport-offline
+		Logc(ctx).WithFields(fields).WithField("state", deviceState).Debug("Device already offline.")
+	default:
+		// A blocked device, as during session recovery, may be set offline, failing the I/O waiting on it
+		if err := writeSysfsDeviceFile(ctx, deviceName, "state", "offline"); err != nil {
+			Logc(ctx).WithFields(fields).WithField("state", deviceState).WithError(err).Warning(
+				"Could not set device offline; deleting it anyway.")
+		}
+	}
 
-	sysPath := chrootPathPrefix + "/sys/class/iscsi_host/"
-	if hostDirs, err := ioutil.ReadDir(sysPath); err != nil {
-		Logc(ctx).WithField("error", err).Errorf("Could not read %s", sysPath)
-		return hostSessionMap
-	} else {
-		for _, hostDir := range hostDirs {
+	if err := writeSysfsDeviceFile(ctx, deviceName, "delete", "1"); err != nil {
+		return fmt.Errorf("could not delete device %s; %v", deviceName, err)
+	}
 
-			hostName := hostDir.Name()
-			if !strings.HasPrefix(hostName, "host") {
-				continue
-			} else if hostNumber, err = strconv.Atoi(strings.TrimPrefix(hostName, "host")); err != nil {
-				Logc(ctx).WithField("host", hostName).Error("Could not parse host number")
-				continue
-			}
+	Logc(ctx).WithFields(fields).Debug("Invoked device delete.")
+	return nil
+}
 
-			devicePath := sysPath + hostName + "/device/"
-			if deviceDirs, err := ioutil.ReadDir(devicePath); err != nil {
-				Logc(ctx).WithFields(log.Fields{
-					"error":      err,
-					"devicePath": devicePath,
-				}).Error("Could not read device path.")
-				return hostSessionMap
-			} else {
-				for _, deviceDir := range deviceDirs {
+// writeSysfsDeviceFile writes a value to a file in a SCSI device's sysfs device directory, such as its state.
+func writeSysfsDeviceFile(ctx context.Context, deviceName, file, value string) error {
 
-					sessionName := deviceDir.Name()
-					if !strings.HasPrefix(sessionName, "session") {
-						continue
-					} else if sessionNumber, err = strconv.Atoi(strings.TrimPrefix(sessionName, "session")); err != nil {
-						Logc(ctx).WithField("session", sessionName).Error("Could not parse session number")
-						continue
-					}
+	filename := fmt.Sprintf(chrootPathPrefix+"/sys/block/%s/device/%s", deviceName, file)
 
-					targetNamePath := devicePath + sessionName + "/iscsi_session/" + sessionName + "/targetname"
-					if targetName, err := ioutil.ReadFile(targetNamePath); err != nil {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0200)
+	if err != nil {
+		Logc(ctx).WithField("file", filename).Warning("Could not open file for writing.")
+		return err
+	}
+	defer f.Close()
 
-						Logc(ctx).WithFields(log.Fields{
-							"path":  targetNamePath,
-							"error": err,
-						}).Error("Could not read targetname file")
+	if written, err := f.WriteString(value); err != nil {
+		Logc(ctx).WithFields(log.Fields{"file": filename, "error": err}).Warning("Could not write to file.")
+		return err
+	} else if written == 0 {
+		Logc(ctx).WithField("file", filename).Warning("No data written to file.")
+		return errors.New("too few bytes written to sysfs file")
+	}
 
-					} else if strings.TrimSpace(string(targetName)) == iSCSINodeName {
+	return nil
+}
 
-						Logc(ctx).WithFields(log.Fields{
-							"hostNumber":    hostNumber,
-							"sessionNumber": sessionNumber,
-						}).Debug("Found iSCSI host/session.")
+// recoverHostService starts a host service that is enabled but not running, as when its daemon crashed
+// mid-operation, if host service recovery is enabled.  Services that aren't enabled are left alone, since the
+// administrator evidently doesn't want them running.  It returns true if the service was started.
+func recoverHostService(ctx context.Context, service string) bool {
 
-						hostSessionMap[hostNumber] = sessionNumber
-					}
-				}
-			}
-		}
+	if !recoverHostServices {
+		return false
 	}
 
-	return hostSessionMap
+	fields := log.Fields{"service": service}
+
+	if active, err := ServiceActiveOnHost(ctx, service); err != nil || active {
+		return false
+	}
+	if enabled, err := ServiceEnabledOnHost(ctx, service); err != nil || !enabled {
+		Logc(ctx).WithFields(fields).Debug("Service is not running but is not enabled; not starting it.")
+		return false
+	}
+
+	Logc(ctx).WithFields(fields).Warning("Enabled host service is not running; starting it.")
+	if err := StartServiceOnHost(ctx, service); err != nil {
+		Logc(ctx).WithFields(fields).WithError(err).Error("Could not start host service.")
+		return false
+	}
+	return true
 }
 
-// GetISCSIDevices returns a list of iSCSI devices that are attached to (but not necessarily mounted on) this host.
-func GetISCSIDevices(ctx context.Context) ([]*ScsiDeviceInfo, error) {
-
-	Logc(ctx).Debug(">>>> osutils.GetISCSIDevices")
-	defer Logc(ctx).Debug("<<<< osutils.GetISCSIDevices")
+// multipathdIsRunning returns true if the multipath daemon is running.
+func multipathdIsRunning(ctx context.Context) bool {
 
-	devices := make([]*ScsiDeviceInfo, 0)
-	hostSessionMapCache := make(map[string]map[int]int)
+	Logc(ctx).Debug(">>>> osutils.multipathdIsRunning")
+	defer Logc(ctx).Debug("<<<< osutils.multipathdIsRunning")
 
-	// Start by reading the sessions from /sys/class/iscsi_session
-	sysPath := chrootPathPrefix + "/sys/class/iscsi_session/"
-	sessionDirs, err := ioutil.ReadDir(sysPath)
-	if err != nil {
-		Logc(ctx).WithField("error", err).Errorf("Could not read %s", sysPath)
-		return nil, err
+	out, err := execCommand(ctx, "pgrep", "multipathd")
+	if err == nil {
+		pid := strings.TrimSpace(string(out))
+		if pidRegex.MatchString(pid) {
+			Logc(ctx).WithField("pid", pid).Debug("multipathd is running")
+			return true
+		}
+	} else {
+		Logc(ctx).Error(err)
 	}
 
-	// Loop through each of the iSCSI sessions
-	for _, sessionDir := range sessionDirs {
-
-		sessionName := sessionDir.Name()
-		if !strings.HasPrefix(sessionName, "session") {
-			continue
-		} else if _, err = strconv.Atoi(strings.TrimPrefix(sessionName, "session")); err != nil {
-			Logc(ctx).WithField("session", sessionName).Error("Could not parse session number")
-			return nil, err
+	out, err = execCommand(ctx, "multipathd", "show", "daemon")
+	if err == nil {
+		if pidRunningOrIdleRegex.MatchString(string(out)) {
+			Logc(ctx).Debug("multipathd is running")
+			return true
 		}
+	} else {
+		Logc(ctx).Error(err)
+	}
 
-		// Find the target IQN from the session at /sys/class/iscsi_session/sessionXXX/targetname
-		sessionPath := sysPath + sessionName
-		targetNamePath := sessionPath + "/targetname"
-		targetNameBytes, err := ioutil.ReadFile(targetNamePath)
-		if err != nil {
-			Logc(ctx).WithFields(log.Fields{
-				"path":  targetNamePath,
-				"error": err,
-			}).Error("Could not read targetname file")
-			return nil, err
-		}
+	return false
+}
 
-		targetIQN := strings.TrimSpace(string(targetNameBytes))
+// getFSType returns the filesystem for the supplied device.
+func getFSType(ctx context.Context, device string) (string, error) {
 
-		Logc(ctx).WithFields(log.Fields{
-			"targetIQN":   targetIQN,
-			"sessionName": sessionName,
-		}).Debug("Found iSCSI session / target IQN.")
+	Logc(ctx).WithField("device", device).Debug(">>>> osutils.getFSType")
+	defer Logc(ctx).Debug("<<<< osutils.getFSType")
 
-		// Find the one target at /sys/class/iscsi_session/sessionXXX/device/targetHH:BB:DD (host:bus:device)
-		sessionDevicePath := sessionPath + "/device/"
-		targetDirs, err := ioutil.ReadDir(sessionDevicePath)
-		if err != nil {
-			Logc(ctx).WithField("error", err).Errorf("Could not read %s", sessionDevicePath)
-			return nil, err
-		}
+	// blkid return status=2 both in case of an unformatted filesystem as well as for the case when it is
+	// unable to get the filesystem (e.g. IO error), therefore ensure device is available before calling blkid
+	if err := waitForDevice(ctx, device); err != nil {
+		return "", fmt.Errorf("could not find device before checking for the filesystem %v; %s", device, err)
+	}
 
-		// Get the one target directory
-		hostBusDeviceName := ""
-		targetDirName := ""
-		for _, targetDir := range targetDirs {
+	out, err := execCommandWithTimeout(ctx, "blkid", 5, true, device)
+	if err != nil {
+		if isCommandNotFound(err) {
+			// Hosts without blkid can still attach volumes with the filesystems the superblock probe knows
+			return probeFSType(ctx, device)
+		} else if IsTimeoutError(err) {
+			listAllISCSIDevices(ctx)
+			return "", err
+		} else if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			// EITHER: Disk device is unformatted.
+			// OR: For 'blkid', if the specified token (TYPE/PTTYPE, etc) was
+			// not found, or no (specified) devices could be identified, an
+			// exit code of 2 is returned.
 
-			targetDirName = targetDir.Name()
+			Logc(ctx).WithField("device", device).Infof("Could not get FSType for device; err: %v", err)
 
-			if strings.HasPrefix(targetDirName, "target") {
-				hostBusDeviceName = strings.TrimPrefix(targetDirName, "target")
-				break
+			if unformatted, err := isDeviceUnformatted(ctx, device); err != nil {
+				Logc(ctx).WithField("device",
+					device).Errorf("Unable to identify if the device is unformatted; err: %v", err)
+				return "", err
+			} else if !unformatted {
+				Logc(ctx).WithField("device", device).Errorf("Device is not unformatted; err: %v", err)
+				return "", fmt.Errorf("device %v is not unformatted", device)
 			}
-		}
 
-		if hostBusDeviceName == "" {
-			Logc(ctx).Warningf("Could not find a host:bus:device directory at %s", sessionDevicePath)
-			continue
+			return "", nil
 		}
 
-		sessionDeviceHBDPath := sessionDevicePath + targetDirName + "/"
-
-		Logc(ctx).WithFields(log.Fields{
-			"hbdPath": sessionDeviceHBDPath,
-			"hbdName": hostBusDeviceName,
-		}).Debug("Found host/bus/device path.")
-
-		// Find the devices at /sys/class/iscsi_session/sessionXXX/device/targetHH:BB:DD/HH:BB:DD:LL (host:bus:device:lun)
-		hostBusDeviceLunDirs, err := ioutil.ReadDir(sessionDeviceHBDPath)
-		if err != nil {
-			Logc(ctx).WithField("error", err).Errorf("Could not read %s", sessionDeviceHBDPath)
-			return nil, err
-		}
+		Logc(ctx).WithField("device", device).Errorf("Could not determine FSType for device; err: %v", err)
+		return "", err
+	}
 
-		for _, hostBusDeviceLunDir := range hostBusDeviceLunDirs {
+	var fsType string
 
-			hostBusDeviceLunDirName := hostBusDeviceLunDir.Name()
-			if !strings.HasPrefix(hostBusDeviceLunDirName, hostBusDeviceName) {
-				continue
+	if strings.Contains(string(out), "TYPE=") {
+		for _, v := range strings.Split(string(out), " ") {
+			if strings.Contains(v, "TYPE=") {
+				fsType = strings.Split(v, "=")[1]
+				fsType = strings.Replace(fsType, "\"", "", -1)
+				fsType = strings.TrimSpace(fsType)
 			}
+		}
+	}
 
-			sessionDeviceHBDLPath := sessionDeviceHBDPath + hostBusDeviceLunDirName + "/"
+	if fsType == "" {
+		Logc(ctx).WithField("out", string(out)).Errorf("Unable to identify fsType.")
 
+		//  Read the device to see if it is in fact formatted
+		if unformatted, err := isDeviceUnformatted(ctx, device); err != nil {
 			Logc(ctx).WithFields(log.Fields{
-				"hbdlPath": sessionDeviceHBDLPath,
-				"hbdlName": hostBusDeviceLunDirName,
-			}).Debug("Found host/bus/device/LUN path.")
-
-			hbdlValues := strings.Split(hostBusDeviceLunDirName, ":")
-			if len(hbdlValues) != 4 {
-				Logc(ctx).Errorf("Could not parse values from %s", hostBusDeviceLunDirName)
-				return nil, err
-			}
+				"device": device,
+				"err": err,
+			}).Debugf("Unable to identify if the device is not unformatted.")
+		} else if !unformatted {
+			Logc(ctx).WithField("device", device).Debugf("Device is not unformatted.")
+			return unknownFstype, nil
+		} else {
+			// If we are here blkid should have not retured exit status 0, we need to retry.
+			Logc(ctx).WithField("device", device).Errorf("Device is unformatted.")
+		}
 
-			hostNum := hbdlValues[0]
-			busNum := hbdlValues[1]
-			deviceNum := hbdlValues[2]
-			lunNum := hbdlValues[3]
+		return "", fmt.Errorf("unable to identify fsType")
+	}
 
-			blockPath := sessionDeviceHBDLPath + "/block/"
+	return fsType, nil
+}
 
-			// Find the block device at /sys/class/iscsi_session/sessionXXX/device/targetHH:BB:DD/HH:BB:DD:LL/block
-			blockDeviceDirs, err := ioutil.ReadDir(blockPath)
-			if err != nil {
-				Logc(ctx).WithField("error", err).Errorf("Could not read %s", blockPath)
-				return nil, err
-			}
+// probeFSType identifies the filesystem on a device from its superblock, for hosts without blkid.  blkid knows
+// many more signatures than the probe, so it's preferred wherever it's installed.
+func probeFSType(ctx context.Context, device string) (string, error) {
 
-			for _, blockDeviceDir := range blockDeviceDirs {
+	probe, err := ProbeFilesystem(ctx, device)
+	if err != nil {
+		Logc(ctx).WithField("device", device).WithError(err).Error("Could not probe device for a filesystem.")
+		return "", err
+	} else if probe.Type != "" {
+		return probe.Type, nil
+	} else if !probe.Zeroed {
+		// The device has data, but nothing this host can identify
+		Logc(ctx).WithField("device", device).Warning("blkid is not installed; filesystem not recognized.")
+		return unknownFstype, nil
+	}
 
-				blockDeviceName := blockDeviceDir.Name()
+	Logc(ctx).WithField("device", device).Info("Device is unformatted.")
+	return "", nil
+}
 
-				Logc(ctx).WithField("blockDeviceName", blockDeviceName).Debug("Found block device.")
+// ensureDeviceReadableWithRetry reads first 4 KiBs of the device to ensures it is readable and retries on errors
+func ensureDeviceReadableWithRetry(ctx context.Context, device string) error {
+	readNotify := func(err error, duration time.Duration) {
+		Logc(ctx).WithField("increment", duration).Debug("Failed to read the device, retrying.")
+	}
 
-				// Find multipath device, if any
-				var slaveDevices []string
-				multipathDevice := findMultipathDeviceForDevice(ctx, blockDeviceName)
-				if multipathDevice != "" {
-					slaveDevices = findDevicesForMultipathDevice(ctx, multipathDevice)
-				} else {
-					slaveDevices = []string{blockDeviceName}
-				}
+	attemptToRead := func() error {
+		return ensureDeviceReadable(ctx, device)
+	}
 
-				// Get the host/session map, using a cached value if available
-				hostSessionMap, ok := hostSessionMapCache[targetIQN]
-				if !ok {
-					hostSessionMap = GetISCSIHostSessionMapForTarget(ctx, targetIQN)
-					hostSessionMapCache[targetIQN] = hostSessionMap
-				}
+	maxDuration := 30 * time.Second
 
-				Logc(ctx).WithFields(log.Fields{
-					"host":            hostNum,
-					"lun":             lunNum,
-					"devices":         slaveDevices,
-					"multipathDevice": multipathDevice,
-					"iqn":             targetIQN,
-					"hostSessionMap":  hostSessionMap,
-				}).Debug("Found iSCSI device.")
-
-				device := &ScsiDeviceInfo{
-					Host:            hostNum,
-					Channel:         busNum,
-					Target:          deviceNum,
-					LUN:             lunNum,
-					Devices:         slaveDevices,
-					MultipathDevice: multipathDevice,
-					IQN:             targetIQN,
-					HostSessionMap:  hostSessionMap,
-				}
+	readBackoff := newExponentialBackOff()
+	readBackoff.InitialInterval = 2 * time.Second
+	readBackoff.Multiplier = 2
+	readBackoff.RandomizationFactor = 0.1
+	readBackoff.MaxElapsedTime = maxDuration
 
-				devices = append(devices, device)
-			}
-		}
+	// Run the read check using an exponential backoff
+	if err := retryNotify(attemptToRead, readBackoff, readNotify); err != nil {
+		Logc(ctx).Errorf("Could not read device %v after %3.2f seconds.", device, maxDuration.Seconds())
+		return err
 	}
 
-	return devices, nil
+	return nil
 }
 
-// IsMounted verifies if the supplied device is attached at the supplied location.
-func IsMounted(ctx context.Context, sourceDevice, mountpoint string) (bool, error) {
+// ensureDeviceReadable reads first 4 KiBs of the device to ensures it is readable
+func ensureDeviceReadable(ctx context.Context, device string) error {
 
-	fields := log.Fields{
-		"source": sourceDevice,
-		"target": mountpoint,
-	}
-	Logc(ctx).WithFields(fields).Debug(">>>> osutils.IsMounted")
-	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.IsMounted")
+	Logc(ctx).WithField("device", device).Debug(">>>> osutils.ensureDeviceReadable")
+	defer Logc(ctx).Debug("<<<< osutils.ensureDeviceReadable")
 
-	procSelfMountinfo, err := listProcSelfMountinfo(procSelfMountinfoPath)
+	// Reading the device directly needs no dd on the host
+	if _, err := readDeviceHead(ctx, chrootPathPrefix+device, 4096); err == nil {
+		return nil
+	} else if IsTimeoutError(err) {
+		return err
+	}
 
+	args := []string{"if=" + device, "bs=4096", "count=1", "status=none"}
+	out, err := execCommandWithTimeout(ctx, "dd", 5, false, args...)
 	if err != nil {
-		Logc(ctx).WithFields(fields).Errorf("checking mounted failed; %s", err)
-		return false, fmt.Errorf("checking mounted failed; %s", err)
+		Logc(ctx).WithFields(log.Fields{"error": err, "device": device}).Error("failed to read the device")
+		return err
 	}
 
-	var sourceDeviceName string
-	if sourceDevice != "" && strings.HasPrefix(sourceDevice, "/dev/") {
-		sourceDeviceName = strings.TrimPrefix(sourceDevice, "/dev/")
+	// Ensure 4KiB of data read
+	if len(out) != 4096 {
+		Logc(ctx).WithFields(log.Fields{"error": err, "device": device}).Error("read number of bytes not 4KiB")
+		return fmt.Errorf("did not read 4KiB bytes from the device %v, instead read %d bytes", device, len(out))
 	}
 
-	for _, procMount := range procSelfMountinfo {
+	return nil
+}
 
-		if !strings.Contains(procMount.MountPoint, mountpoint) {
-			continue
-		}
+// isDeviceUnformatted reads first 2 MiBs of the device to identify if it is unformatted and contains all zeros
+func isDeviceUnformatted(ctx context.Context, device string) (bool, error) {
 
-		Logc(ctx).Debugf("Mountpoint found: %v", procMount)
+	Logc(ctx).WithField("device", device).Debug(">>>> osutils.isDeviceUnformatted")
+	defer Logc(ctx).Debug("<<<< osutils.isDeviceUnformatted")
 
-		if sourceDevice == "" {
-			Logc(ctx).Debugf("Source device: none, Target: %s, is mounted: true", mountpoint)
-			return true, nil
-		}
+	args := []string{"if=" + device, "bs=4096", "count=512", "status=none"}
+	out, err := execCommandWithTimeout(ctx, "dd", 5, false, args...)
+	if err != nil {
+		Logc(ctx).WithFields(log.Fields{"error": err, "device": device}).Error("failed to read the device")
+		return false, err
+	}
 
-		hasDevMountSourcePrefix := strings.HasPrefix(procMount.MountSource, "/dev/")
+	// Ensure 2MiB of data read
+	if len(out) != 2097152 {
+		Logc(ctx).WithFields(log.Fields{"error": err, "device": device}).Error("read number of bytes not 2MiB")
+		return false, fmt.Errorf("did not read 2MiB bytes from the device %v, instead read %d bytes; unable to "+
+			"ensure if the device is actually unformatted", device, len(out))
+	}
 
-		var mountedDevice string
-		// Resolve any symlinks to get the real device
-		if hasDevMountSourcePrefix {
-			device, err := filepath.EvalSymlinks(procMount.MountSource)
-			if err != nil {
-				Logc(ctx).Error(err)
-				continue
-			}
-			mountedDevice = strings.TrimPrefix(device, "/dev/")
-		} else {
-			mountedDevice = strings.TrimPrefix(procMount.Root, "/")
-		}
+	Logc(ctx).WithField("device", device).Debug("Verified correct number of bytes read.")
 
-		if sourceDeviceName == mountedDevice {
-			Logc(ctx).Debugf("Source device: %s, Target: %s, is mounted: true", sourceDeviceName, mountpoint)
-			return true, nil
-		}
+	// Ensure all zeros
+	if outWithoutZeros := bytes.Trim(out, "\x00"); len(outWithoutZeros) != 0 {
+		Logc(ctx).WithFields(log.Fields{"error": err, "device": device}).Error("device contains non-zero values")
+		return false, nil
 	}
 
-	Logc(ctx).Debugf("Source device: %s, Target: %s, is mounted: false", sourceDevice, mountpoint)
-	return false, nil
-}
-
-// GetMountInfo returns the list of mounts found in /proc/self/mountinfo
-func GetMountInfo(ctx context.Context) ([]MountInfo, error) {
-	Logc(ctx).Debug(">>>> osutils.GetMountInfo")
-	defer Logc(ctx).Debug("<<<< osutils.GetMountInfo")
+	Logc(ctx).WithFields(log.Fields{"device": device}).Info("Device in unformatted.")
 
-	return listProcSelfMountinfo(procSelfMountinfoPath)
+	return true, nil
 }
 
-// GetMountedISCSIDevices returns a list of iSCSI devices that are *mounted* on this host.
-func GetMountedISCSIDevices(ctx context.Context) ([]*ScsiDeviceInfo, error) {
-
-	Logc(ctx).Debug(">>>> osutils.GetMountedISCSIDevices")
-	defer Logc(ctx).Debug("<<<< osutils.GetMountedISCSIDevices")
+// NFSLockPolicy determines what happens when an NFSv3 volume is to be mounted with locking but rpc.statd, which
+// NFSv3 locking depends on, isn't working.
+type NFSLockPolicy string
 
-	procSelfMountinfo, err := listProcSelfMountinfo(procSelfMountinfoPath)
-	if err != nil {
-		return nil, err
-	}
+const (
+	// NFSLockPolicyIgnore mounts as requested without checking rpc.statd
+	NFSLockPolicyIgnore NFSLockPolicy = "ignore"
+	// NFSLockPolicyRequire fails the mount, after trying to start rpc-statd if host service recovery is enabled
+	NFSLockPolicyRequire NFSLockPolicy = "require"
+	// NFSLockPolicyNoLock mounts with the nolock option, so locks are local to the node, and logs a warning
+	NFSLockPolicyNoLock NFSLockPolicy = "nolock"
+)
 
-	// Get a list of all mounted /dev devices
-	mountedDevices := make([]string, 0)
-	for _, procMount := range procSelfMountinfo {
+var nfsLockPolicy = NFSLockPolicyIgnore
 
-		hasDevMountSourcePrefix := strings.HasPrefix(procMount.MountSource, "/dev/")
-		hasPvcMountPoint := strings.Contains(procMount.MountPoint, "/pvc-")
+func validateNFSLockPolicy(policy NFSLockPolicy) error {
+	switch policy {
+	case NFSLockPolicyIgnore, NFSLockPolicyRequire, NFSLockPolicyNoLock:
+		return nil
+	default:
+		return fmt.Errorf("invalid NFS lock policy: %s", policy)
+	}
+}
 
-		if !hasPvcMountPoint {
-			continue
+// nfsMountNeedsStatd returns true if the NFS mount options call for NFSv3 with network locking, which requires
+// rpc.statd.  Mounts that don't specify a version are assumed to negotiate NFSv4, which has locking built in.
+func nfsMountNeedsStatd(options string) bool {
+
+	needsStatd := false
+	for _, option := range strings.Split(strings.TrimPrefix(options, "-o "), ",") {
+		switch strings.TrimSpace(option) {
+		case "vers=3", "nfsvers=3", "vers=3.0", "nfsvers=3.0":
+			needsStatd = true
+		case "nolock", "local_lock=all", "local_lock=posix":
+			return false
 		}
+	}
+	return needsStatd
+}
 
-		var mountedDevice string
-		// Resolve any symlinks to get the real device
-		if hasDevMountSourcePrefix {
-			device, err := filepath.EvalSymlinks(procMount.MountSource)
-			if err != nil {
-				Logc(ctx).Error(err)
-				continue
-			}
-			mountedDevice = strings.TrimPrefix(device, "/dev/")
-		} else {
-			mountedDevice = strings.TrimPrefix(procMount.Root, "/")
-		}
+// statdIsRunning returns true if rpc.statd is registered with the local rpcbind and answering requests.
+func statdIsRunning(ctx context.Context) bool {
 
-		mountedDevices = append(mountedDevices, mountedDevice)
+	// The NSM status program is RPC program 100024
+	if _, err := execCommandWithTimeout(ctx, "rpcinfo", 10, false, "-T", "udp", "127.0.0.1", "100024"); err != nil {
+		Logc(ctx).WithError(err).Debug("rpc.statd is not responding.")
+		return false
 	}
+	return true
+}
 
-	// Get all known iSCSI devices
-	iscsiDevices, err := GetISCSIDevices(ctx)
-	if err != nil {
-		return nil, err
-	}
+// ensureNFSLocking verifies that rpc.statd is working if the NFS mount options call for NFSv3 locking, and applies
+// the NFS lock policy if it isn't.  It returns the mount options to use.
+func ensureNFSLocking(ctx context.Context, options string) (string, error) {
 
-	mountedISCSIDevices := make([]*ScsiDeviceInfo, 0)
+	if nfsLockPolicy == NFSLockPolicyIgnore || !nfsMountNeedsStatd(options) || statdIsRunning(ctx) {
+		return options, nil
+	}
 
-	// For each mounted device, look for a matching iSCSI device
-	for _, mountedDevice := range mountedDevices {
-	iSCSIDeviceLoop:
-		for _, iscsiDevice := range iscsiDevices {
+	if recoverHostService(ctx, "rpc-statd") && statdIsRunning(ctx) {
+		return options, nil
+	}
 
-			// First look for a multipath device match
-			if mountedDevice == iscsiDevice.MultipathDevice {
-				mountedISCSIDevices = append(mountedISCSIDevices, iscsiDevice)
-				break iSCSIDeviceLoop
+	switch nfsLockPolicy {
+	case NFSLockPolicyNoLock:
+		Logc(ctx).WithField("options", options).Warning(
+			"rpc.statd is not running; mounting NFSv3 volume with nolock, so file locks are not shared between nodes.")
+		return mount.MergeOptions("nfs", options, "nolock"), nil
+	default:
+		Logc(ctx).WithField("options", options).Error("rpc.statd is not running; cannot mount NFSv3 volume with locking.")
+		return options, errors.New("rpc.statd is required for NFSv3 locking but is not running on the host")
+	}
+}
 
-			} else {
+// nfsTLSMode returns the transport security mode requested by the xprtsec option in the NFS mount options, which
+// is "none" if the option isn't present.
+func nfsTLSMode(options string) (string, error) {
 
-				// Then look for a slave device match
-				for _, iscsiSlaveDevice := range iscsiDevice.Devices {
-					if mountedDevice == iscsiSlaveDevice {
-						mountedISCSIDevices = append(mountedISCSIDevices, iscsiDevice)
-						break iSCSIDeviceLoop
-					}
-				}
-			}
+	mode := "none"
+	for _, option := range strings.Split(strings.TrimPrefix(options, "-o "), ",") {
+		option = strings.TrimSpace(option)
+		if strings.HasPrefix(option, "xprtsec=") {
+			mode = strings.TrimPrefix(option, "xprtsec=")
 		}
 	}
 
-	for _, md := range mountedISCSIDevices {
-		Logc(ctx).WithFields(log.Fields{
-			"host":            md.Host,
-			"lun":             md.LUN,
-			"devices":         md.Devices,
-			"multipathDevice": md.MultipathDevice,
-			"iqn":             md.IQN,
-			"hostSessionMap":  md.HostSessionMap,
-		}).Debug("Found mounted iSCSI device.")
+	switch mode {
+	case "none", "tls", "mtls":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid NFS mount option xprtsec=%s; must be one of none, tls or mtls", mode)
 	}
-
-	return mountedISCSIDevices, nil
 }
 
-// ISCSITargetHasMountedDevice returns true if this host has any mounted devices on the specified target.
-func ISCSITargetHasMountedDevice(ctx context.Context, targetIQN string) (bool, error) {
+// ensureNFSTLS verifies, if the NFS mount options call for NFS over TLS (RFC 9289), that the kernel supports
+// handing off TLS handshakes and that tlshd, the user-space agent that performs them, is running.  It tries to
+// start tlshd if host service recovery is enabled.
+func ensureNFSTLS(ctx context.Context, options string) error {
 
-	mountedISCSIDevices, err := GetMountedISCSIDevices(ctx)
+	mode, err := nfsTLSMode(options)
+	if err != nil || mode == "none" {
+		return err
+	}
+
+	fields := log.Fields{"xprtsec": mode}
+
+	supported, err := kernelSupportsNFSTLS(ctx)
 	if err != nil {
-		return false, err
+		Logc(ctx).WithFields(fields).WithError(err).Error("Could not determine whether the kernel supports NFS over TLS.")
+		return fmt.Errorf("could not determine whether the kernel supports NFS over TLS; %v", err)
+	}
+	if !supported {
+		Logc(ctx).WithFields(fields).Error("Kernel does not support NFS over TLS.")
+		return errors.New("NFS over TLS requires kernel support for TLS handshake upcalls (Linux 6.5 or later) " +
+			"but the host kernel does not provide it")
 	}
 
-	for _, device := range mountedISCSIDevices {
-		if device.IQN == targetIQN {
-			return true, nil
-		}
+	if active, err := ServiceActiveOnHost(ctx, "tlshd"); err == nil && active {
+		return nil
+	}
+	if recoverHostService(ctx, "tlshd") {
+		return nil
 	}
 
-	return false, nil
+	Logc(ctx).WithFields(fields).Error("tlshd is not running; cannot mount NFS volume over TLS.")
+	return errors.New("NFS over TLS requires the tlshd service (ktls-utils) to be running on the host " +
+		"but it is not running")
 }
 
-// multipathFlushDevice invokes the 'multipath' commands to flush paths for a single device.
-func multipathFlushDevice(ctx context.Context, deviceInfo *ScsiDeviceInfo) error {
+// UUIDConflictPolicy determines what happens when an attached filesystem has the same UUID as one already
+// mounted on the host, as when a clone is attached to the same node as its source.
+type UUIDConflictPolicy string
 
-	Logc(ctx).WithField("device", deviceInfo.MultipathDevice).Debug(">>>> osutils.multipathFlushDevice")
-	defer Logc(ctx).Debug("<<<< osutils.multipathFlushDevice")
+const (
+	// UUIDConflictPolicyNoUUID mounts XFS with the nouuid option; ext3/ext4 mount with duplicate UUIDs as is
+	UUIDConflictPolicyNoUUID UUIDConflictPolicy = "nouuid"
+	// UUIDConflictPolicyRegenerate gives the attached filesystem a new random UUID
+	UUIDConflictPolicyRegenerate UUIDConflictPolicy = "regenerate"
+	// UUIDConflictPolicyFail fails the attach
+	UUIDConflictPolicyFail UUIDConflictPolicy = "fail"
+)
 
-	if deviceInfo.MultipathDevice == "" {
+var uuidConflictPolicy = UUIDConflictPolicyNoUUID
+
+func validateUUIDConflictPolicy(policy UUIDConflictPolicy) error {
+	switch policy {
+	case UUIDConflictPolicyNoUUID, UUIDConflictPolicyRegenerate, UUIDConflictPolicyFail:
 		return nil
+	default:
+		return fmt.Errorf("invalid UUID conflict policy: %s", policy)
 	}
+}
 
-	err := flushOneDevice(ctx, "/dev/"+deviceInfo.MultipathDevice)
-	if err != nil {
-		return err
+// MultiAttachPolicy determines how the filesystem on a LUN attached to more than one node, such as a shared
+// block volume for a cluster filesystem, is checked.  Whatever the policy, such a LUN never has its filesystem
+// UUID changed.
+type MultiAttachPolicy string
+
+const (
+	// MultiAttachPolicyVerify requires the LUN to carry the requested filesystem already, and never formats it
+	MultiAttachPolicyVerify MultiAttachPolicy = "verify"
+	// MultiAttachPolicySkip neither checks nor formats the LUN, for filesystems the node can't identify
+	MultiAttachPolicySkip MultiAttachPolicy = "skip"
+	// MultiAttachPolicyFormat formats an unformatted LUN as if it were attached to one node, which is only
+	// safe if the volume is always staged on one node before any other
+	MultiAttachPolicyFormat MultiAttachPolicy = "format"
+)
+
+var multiAttachPolicy = MultiAttachPolicyVerify
+
+func validateMultiAttachPolicy(policy MultiAttachPolicy) error {
+	switch policy {
+	case MultiAttachPolicyVerify, MultiAttachPolicySkip, MultiAttachPolicyFormat:
+		return nil
+	default:
+		return fmt.Errorf("invalid multi-attach policy: %s", policy)
 	}
+}
 
-	_, err = execCommandWithTimeout(ctx, "multipath", 30, true, "-f", "/dev/"+deviceInfo.MultipathDevice)
-	if err != nil {
-		// nothing to do if it generates an error but log it
-		Logc(ctx).WithFields(log.Fields{
-			"device": deviceInfo.MultipathDevice,
-			"error":  err,
-		}).Error("Error encountered in multipath flush device command.")
-		return err
+// FencingHook fences LUNs attached to more than one node, so that a node that has lost its attachment, or has
+// been evicted, can no longer write to them.  Register is called once such a LUN is attached, before anything
+// on it is read, and must succeed even if the node is registered already.  Unregister is called before the LUN
+// is detached.
+type FencingHook interface {
+	Register(ctx context.Context, devicePath string, publishInfo *VolumePublishInfo) error
+	Unregister(ctx context.Context, devicePath string, publishInfo *VolumePublishInfo) error
+}
+
+var fencingHook FencingHook
+
+// ReleaseMultiAttachDevice unregisters this node from the fencing of a LUN attached to more than one node, and
+// should be called before the LUN is detached.  It does nothing for other LUNs or if no fencing hook is set.
+func ReleaseMultiAttachDevice(ctx context.Context, publishInfo *VolumePublishInfo) error {
+
+	if !publishInfo.MultiAttach || fencingHook == nil || publishInfo.DevicePath == "" {
+		return nil
 	}
 
-	return nil
+	fields := log.Fields{"devicePath": publishInfo.DevicePath}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.ReleaseMultiAttachDevice")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.ReleaseMultiAttachDevice")
+
+	return fencingHook.Unregister(ctx, publishInfo.DevicePath, publishInfo)
 }
 
-// flushDevice flushes any outstanding I/O to all paths to a device.
-func flushDevice(ctx context.Context, deviceInfo *ScsiDeviceInfo, force bool) error {
+// PersistentReservationFencer is a FencingHook that fences LUNs with SCSI-3 persistent reservations.  Each node
+// registers its own key and takes a Write Exclusive, All Registrants reservation, which every registered node
+// holds, so any node may write to the LUN until its registration is removed or preempted by another node.
+type PersistentReservationFencer struct {
+	// Key is this node's reservation key, which must be nonzero and unique among the nodes sharing a LUN
+	Key uint64
+}
 
-	Logc(ctx).Debug(">>>> osutils.flushDevice")
-	defer Logc(ctx).Debug("<<<< osutils.flushDevice")
+const persistentReservationTypeWriteExclusiveAllRegistrants = "7"
 
-	for _, device := range deviceInfo.Devices {
-		err := flushOneDevice(ctx, "/dev/"+device)
-		if err != nil && !force {
-			return err
-		}
+// Register registers this node's key with the LUN and reserves it, if not already reserved.
+func (f PersistentReservationFencer) Register(
+	ctx context.Context, devicePath string, _ *VolumePublishInfo,
+) error {
+
+	if f.Key == 0 {
+		return errors.New("persistent reservation key must not be zero")
+	}
+	command := persistentReservationCommand(devicePath)
+	key := fmt.Sprintf("0x%x", f.Key)
+
+	// Registering while ignoring any existing key succeeds whether or not this node is registered already
+	if _, err := execCommandWithTimeout(ctx, command, 30, true, "--out", "--register-ignore",
+		"--param-sark="+key, devicePath); err != nil {
+		return fmt.Errorf("could not register persistent reservation key; %v", err)
+	}
+
+	// Every registrant holds an all-registrants reservation, so reserving succeeds if another node got there first
+	if _, err := execCommandWithTimeout(ctx, command, 30, true, "--out", "--reserve", "--param-rk="+key,
+		"--prout-type="+persistentReservationTypeWriteExclusiveAllRegistrants, devicePath); err != nil {
+		return fmt.Errorf("could not reserve LUN; %v", err)
 	}
 
+	Logc(ctx).WithFields(log.Fields{"devicePath": devicePath, "key": key}).Info("Registered for persistent reservation.")
 	return nil
 }
 
-// removeDevice tells Linux that a device will be removed.
-func removeDevice(ctx context.Context, deviceInfo *ScsiDeviceInfo, force bool) error {
+// Unregister removes this node's key from the LUN.  The reservation itself lasts until the last node unregisters.
+func (f PersistentReservationFencer) Unregister(
+	ctx context.Context, devicePath string, _ *VolumePublishInfo,
+) error {
 
-	Logc(ctx).Debug(">>>> osutils.removeDevice")
-	defer Logc(ctx).Debug("<<<< osutils.removeDevice")
+	if _, err := execCommandWithTimeout(ctx, persistentReservationCommand(devicePath), 30, true, "--out",
+		"--register-ignore", "--param-sark=0", devicePath); err != nil {
+		return fmt.Errorf("could not unregister persistent reservation key; %v", err)
+	}
+	return nil
+}
 
-	var (
-		f   *os.File
-		err error
-	)
+// persistentReservationCommand returns the utility that manages persistent reservations on a device.  A
+// multipath device needs mpathpersist, which registers the key through every path.
+func persistentReservationCommand(devicePath string) string {
+	if name, err := getBlockDeviceNameForPath(devicePath); err == nil && isMultipathDevice(name) {
+		return "mpathpersist"
+	}
+	return "sg_persist"
+}
 
-	listAllISCSIDevices(ctx)
-	for _, deviceName := range deviceInfo.Devices {
+// DetachFailure describes a stage of a detach that couldn't complete, as when I/O to a LUN is stuck so its
+// devices can't be flushed, for a DetachFencer to decide on.
+type DetachFailure struct {
+	VolumeID    string
+	Stage       string
+	TargetIQN   string
+	LUN         int
+	PublishInfo *VolumePublishInfo
+	Err         error
+}
 
-		filename := fmt.Sprintf(chrootPathPrefix+"/sys/block/%s/device/delete", deviceName)
-		if f, err = os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0200); err != nil {
-			Logc(ctx).WithField("file", filename).Warning("Could not open file for writing.")
-			if force {
-				continue
-			}
-			return err
-		}
+// DetachFenceDecision is a DetachFencer's verdict on a failed detach stage.
+type DetachFenceDecision string
 
-		if written, err := f.WriteString("1"); err != nil {
-			Logc(ctx).WithFields(log.Fields{"file": filename, "error": err}).Warning("Could not write to file.")
-			f.Close()
-			if force {
-				continue
-			}
-			return err
-		} else if written == 0 {
-			Logc(ctx).WithField("file", filename).Warning("No data written to file.")
-			f.Close()
-			if force {
-				continue
-			}
-			return errors.New("too few bytes written to sysfs file")
-		}
+const (
+	// DetachFenceRetry leaves the stage failed, so the detach is retried later
+	DetachFenceRetry DetachFenceDecision = "retry"
+	// DetachFenceForce reports that this node has been fenced from the LUN, so the stage may be forced through,
+	// discarding any I/O still pending, without risk of stale writes reaching the LUN
+	DetachFenceForce DetachFenceDecision = "force"
+)
 
-		f.Close()
+// DetachFencer is consulted when a stage of a detach fails and the detach isn't already unsafe.  It lets higher
+// layers fence this node from the LUN, as by removing the node from the LUN's igroup on the array or having
+// another node preempt its persistent reservation, so the workload can be moved safely even though the detach
+// couldn't complete cleanly.
+type DetachFencer interface {
+	FenceDetach(ctx context.Context, failure DetachFailure) (DetachFenceDecision, error)
+}
 
-		listAllISCSIDevices(ctx)
-		Logc(ctx).WithField("scanFile", filename).Debug("Invoked device delete.")
-	}
+// DetachFencerFunc adapts a function to a DetachFencer.
+type DetachFencerFunc func(ctx context.Context, failure DetachFailure) (DetachFenceDecision, error)
 
-	return nil
+// FenceDetach calls the function.
+func (f DetachFencerFunc) FenceDetach(ctx context.Context, failure DetachFailure) (DetachFenceDecision, error) {
+	return f(ctx, failure)
 }
 
-// multipathdIsRunning returns true if the multipath daemon is running.
-func multipathdIsRunning(ctx context.Context) bool {
+var detachFencer DetachFencer
 
-	Logc(ctx).Debug(">>>> osutils.multipathdIsRunning")
-	defer Logc(ctx).Debug("<<<< osutils.multipathdIsRunning")
+// FenceFailedDetach asks the detach fencer, if any, whether a failed detach stage may be forced.  Without a
+// fencer, or if the fencer fails, the stage is left failed.
+func FenceFailedDetach(ctx context.Context, failure DetachFailure) DetachFenceDecision {
 
-	out, err := execCommand(ctx, "pgrep", "multipathd")
-	if err == nil {
-		pid := strings.TrimSpace(string(out))
-		if pidRegex.MatchString(pid) {
-			Logc(ctx).WithField("pid", pid).Debug("multipathd is running")
-			return true
-		}
-	} else {
-		Logc(ctx).Error(err)
+	if detachFencer == nil {
+		return DetachFenceRetry
 	}
 
-	out, err = execCommand(ctx, "multipathd", "show", "daemon")
-	if err == nil {
-		if pidRunningOrIdleRegex.MatchString(string(out)) {
-			Logc(ctx).Debug("multipathd is running")
-			return true
-		}
-	} else {
-		Logc(ctx).Error(err)
-	}
+	fields := log.Fields{"stage": failure.Stage, "targetIQN": failure.TargetIQN, "lun": failure.LUN}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils.FenceFailedDetach")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils.FenceFailedDetach")
 
-	return false
+	decision, err := detachFencer.FenceDetach(ctx, failure)
+	if err != nil {
+		Logc(ctx).WithFields(fields).WithError(err).Warning("Could not fence failed detach.")
+		return DetachFenceRetry
+	}
+	switch decision {
+	case DetachFenceForce:
+		Logc(ctx).WithFields(fields).WithError(failure.Err).Warning("Node fenced, forcing failed detach stage.")
+		journalHostOutcome(ctx, "Fencing of stuck detach", nil)
+		return DetachFenceForce
+	case DetachFenceRetry:
+		return DetachFenceRetry
+	default:
+		Logc(ctx).WithFields(fields).WithField("decision", decision).Warning("Unknown detach fence decision.")
+		return DetachFenceRetry
+	}
 }
 
-// getFSType returns the filesystem for the supplied device.
-func getFSType(ctx context.Context, device string) (string, error) {
+// CommandDetachFencer is a DetachFencer that runs a command on the host, such as a script that asks the array to
+// remove this node from the LUN's igroup.  The failure is described to the command in environment variables, and
+// the stage is forced if the command succeeds.
+type CommandDetachFencer struct {
+	// Command is the path of the command
+	Command string
+	// TimeoutSecs bounds the command; zero selects 60 seconds
+	TimeoutSecs int
+}
 
-	Logc(ctx).WithField("device", device).Debug(">>>> osutils.getFSType")
-	defer Logc(ctx).Debug("<<<< osutils.getFSType")
+// FenceDetach runs the fencing command.
+func (f CommandDetachFencer) FenceDetach(ctx context.Context, failure DetachFailure) (DetachFenceDecision, error) {
 
-	// blkid return status=2 both in case of an unformatted filesystem as well as for the case when it is
-	// unable to get the filesystem (e.g. IO error), therefore ensure device is available before calling blkid
-	if err := waitForDevice(ctx, device); err != nil {
-		return "", fmt.Errorf("could not find device before checking for the filesystem %v; %s", device, err)
+	timeout := time.Duration(f.TimeoutSecs)
+	if timeout == 0 {
+		timeout = 60
 	}
 
-	out, err := execCommandWithTimeout(ctx, "blkid", 5, true, device)
-	if err != nil {
-		if IsTimeoutError(err) {
-			listAllISCSIDevices(ctx)
-			return "", err
-		} else if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
-			// EITHER: Disk device is unformatted.
-			// OR: For 'blkid', if the specified token (TYPE/PTTYPE, etc) was
-			// not found, or no (specified) devices could be identified, an
-			// exit code of 2 is returned.
+	env := []string{
+		"TRIDENT_VOLUME_ID=" + failure.VolumeID,
+		"TRIDENT_DETACH_STAGE=" + failure.Stage,
+		"TRIDENT_TARGET_IQN=" + failure.TargetIQN,
+		"TRIDENT_LUN=" + strconv.Itoa(failure.LUN),
+	}
+	if failure.PublishInfo != nil {
+		env = append(env, "TRIDENT_DEVICE_PATH="+failure.PublishInfo.DevicePath)
+	}
+	if failure.Err != nil {
+		env = append(env, "TRIDENT_DETACH_ERROR="+failure.Err.Error())
+	}
 
-			Logc(ctx).WithField("device", device).Infof("Could not get FSType for device; err: %v", err)
+	if _, err := execCommandWithTimeoutAndEnv(ctx, f.Command, timeout, true, env); err != nil {
+		return DetachFenceRetry, fmt.Errorf("fencing command %s failed; %v", f.Command, err)
+	}
+	return DetachFenceForce, nil
+}
 
-			if unformatted, err := isDeviceUnformatted(ctx, device); err != nil {
-				Logc(ctx).WithField("device",
-					device).Errorf("Unable to identify if the device is unformatted; err: %v", err)
-				return "", err
-			} else if !unformatted {
-				Logc(ctx).WithField("device", device).Errorf("Device is not unformatted; err: %v", err)
-				return "", fmt.Errorf("device %v is not unformatted", device)
-			}
+// resolveFilesystemUUIDConflict checks whether the filesystem on a device has the same UUID as a mounted
+// filesystem on another device and, if so, applies the specified UUID conflict policy.  It returns the mount
+// options to use for the device.
+func resolveFilesystemUUIDConflict(
+	ctx context.Context, device, fstype, options string, policy UUIDConflictPolicy,
+) (string, error) {
 
-			return "", nil
-		}
+	logFields := log.Fields{"device": device, "fsType": fstype, "policy": policy}
+	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.resolveFilesystemUUIDConflict")
+	defer Logc(ctx).WithFields(logFields).Debug("<<<< osutils.resolveFilesystemUUIDConflict")
 
-		Logc(ctx).WithField("device", device).Errorf("Could not determine FSType for device; err: %v", err)
-		return "", err
+	if fstype != "xfs" && fstype != "ext3" && fstype != "ext4" {
+		return options, nil
 	}
 
-	var fsType string
+	uuid, err := getFilesystemUUID(ctx, device)
+	if err != nil || uuid == "" {
+		Logc(ctx).WithFields(logFields).WithError(err).Debug("Could not get filesystem UUID, not checking conflicts.")
+		return options, nil
+	}
 
-	if strings.Contains(string(out), "TYPE=") {
-		for _, v := range strings.Split(string(out), " ") {
-			if strings.Contains(v, "TYPE=") {
-				fsType = strings.Split(v, "=")[1]
-				fsType = strings.Replace(fsType, "\"", "", -1)
-				fsType = strings.TrimSpace(fsType)
-			}
-		}
+	conflicts, err := getMountedDevicesWithUUID(ctx, uuid, device)
+	if err != nil {
+		return options, err
+	}
+	if len(conflicts) == 0 {
+		return options, nil
 	}
 
-	if fsType == "" {
-		Logc(ctx).WithField("out", string(out)).Errorf("Unable to identify fsType.")
+	logFields["uuid"] = uuid
+	logFields["conflicts"] = conflicts
+	Logc(ctx).WithFields(logFields).Warning("Filesystem UUID is already in use by a mounted filesystem.")
 
-		//  Read the device to see if it is in fact formatted
-		if unformatted, err := isDeviceUnformatted(ctx, device); err != nil {
-			Logc(ctx).WithFields(log.Fields{
-				"device": device,
-				"err": err,
-			}).Debugf("Unable to identify if the device is not unformatted.")
-		} else if !unformatted {
-			Logc(ctx).WithField("device", device).Debugf("Device is not unformatted.")
-			return unknownFstype, nil
+	switch policy {
+	case UUIDConflictPolicyFail:
+		return options, fmt.Errorf("filesystem UUID %s is already mounted from %s", uuid, strings.Join(conflicts, ", "))
+	case UUIDConflictPolicyRegenerate:
+		if fstype == "xfs" {
+			_, err = execCommandWithTimeout(ctx, "xfs_admin", 30, true, "-U", "generate", device)
 		} else {
-			// If we are here blkid should have not retured exit status 0, we need to retry.
-			Logc(ctx).WithField("device", device).Errorf("Device is unformatted.")
+			_, err = execCommandWithTimeout(ctx, "tune2fs", 30, true, "-f", "-U", "random", device)
+		}
+		if err != nil {
+			return options, fmt.Errorf("could not regenerate filesystem UUID; %v", err)
 		}
+		Logc(ctx).WithFields(logFields).Info("Regenerated filesystem UUID.")
+		return options, nil
+	default:
+		if fstype == "xfs" {
+			options = mount.MergeOptions("", options, "nouuid")
+		}
+		return options, nil
+	}
+}
 
-		return "", fmt.Errorf("unable to identify fsType")
+// getFilesystemUUID returns the UUID of the filesystem on a device.
+func getFilesystemUUID(ctx context.Context, device string) (string, error) {
+
+	if probe, err := ProbeFilesystem(ctx, device); err == nil && probe.Type != "" {
+		return probe.UUID, nil
 	}
 
-	return fsType, nil
+	out, err := execCommandWithTimeout(ctx, "blkid", 5, true, "-s", "UUID", "-o", "value", device)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
 }
 
-// ensureDeviceReadableWithRetry reads first 4 KiBs of the device to ensures it is readable and retries on errors
-func ensureDeviceReadableWithRetry(ctx context.Context, device string) error {
-	readNotify := func(err error, duration time.Duration) {
-		Logc(ctx).WithField("increment", duration).Debug("Failed to read the device, retrying.")
+// getMountedDevicesWithUUID returns the mounted devices, other than the specified device and its paths, that
+// carry a filesystem with the specified UUID.
+func getMountedDevicesWithUUID(ctx context.Context, uuid, device string) ([]string, error) {
+
+	conflicts := make([]string, 0)
+
+	// blkid finds every device with the UUID from its cache; without it, each mounted device is probed instead
+	var candidates []string
+	out, err := execCommandWithTimeout(ctx, "blkid", 5, true, "-t", "UUID="+uuid, "-o", "device")
+	probeMounted := isCommandNotFound(err)
+	if err != nil && !probeMounted {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			return conflicts, nil
+		}
+		return nil, err
+	} else if err == nil {
+		candidates = strings.Fields(string(out))
 	}
 
-	attemptToRead := func() error {
-		return ensureDeviceReadable(ctx, device)
+	resolvedDevice, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil, err
 	}
 
-	maxDuration := 30 * time.Second
+	procSelfMountinfo, err := listProcSelfMountinfo(procSelfMountinfoPath)
+	if err != nil {
+		return nil, err
+	}
+	mountedDevices := make(map[string]bool)
+	for _, procMount := range procSelfMountinfo {
+		if !strings.HasPrefix(procMount.MountSource, "/dev/") {
+			continue
+		}
+		if mountedDevice, err := filepath.EvalSymlinks(procMount.MountSource); err == nil {
+			mountedDevices[mountedDevice] = true
+		}
+	}
 
-	readBackoff := backoff.NewExponentialBackOff()
-	readBackoff.InitialInterval = 2 * time.Second
-	readBackoff.Multiplier = 2
-	readBackoff.RandomizationFactor = 0.1
-	readBackoff.MaxElapsedTime = maxDuration
+	if probeMounted {
+		for mountedDevice := range mountedDevices {
+			if probe, err := ProbeFilesystem(ctx, mountedDevice); err == nil && probe.UUID == uuid {
+				candidates = append(candidates, mountedDevice)
+			}
+		}
+		sort.Strings(candidates)
+	}
 
-	// Run the read check using an exponential backoff
-	if err := backoff.RetryNotify(attemptToRead, readBackoff, readNotify); err != nil {
-		Logc(ctx).Errorf("Could not read device %v after %3.2f seconds.", device, maxDuration.Seconds())
-		return err
+	for _, candidate := range candidates {
+		resolvedCandidate, err := filepath.EvalSymlinks(candidate)
+		if err != nil || resolvedCandidate == resolvedDevice {
+			continue
+		}
+		if mountedDevices[resolvedCandidate] {
+			conflicts = append(conflicts, resolvedCandidate)
+		}
 	}
 
-	return nil
+	return conflicts, nil
 }
 
-// ensureDeviceReadable reads first 4 KiBs of the device to ensures it is readable
-func ensureDeviceReadable(ctx context.Context, device string) error {
+// MergeMountOptions combines mount options, in increasing order of precedence, from the default mount options
+// for the filesystem type, the user's options, and any options the caller requires.
+//
+// Deprecated: use mount.MergeOptions.
+func MergeMountOptions(fstype, userOptions string, requiredOptions ...string) string {
+	return mount.MergeOptions(fstype, userOptions, requiredOptions...)
+}
 
-	Logc(ctx).WithField("device", device).Debug(">>>> osutils.ensureDeviceReadable")
-	defer Logc(ctx).Debug("<<<< osutils.ensureDeviceReadable")
+// FormatPolicy controls how new filesystems are created.  Large LUNs can take minutes to format by default, mostly
+// initializing ext4 inode tables and discarding blocks, which may exceed CSI timeouts.
+type FormatPolicy struct {
+	// LazyInit defers ext3/ext4 inode table and journal initialization until after mount
+	LazyInit bool
+	// NoDiscard skips discarding the device's blocks before formatting
+	NoDiscard bool
+	// Timeout bounds a single mkfs run; zero means no limit
+	Timeout time.Duration
+	// ProgressInterval is how often a still-running mkfs is logged
+	ProgressInterval time.Duration
+}
 
-	args := []string{"if=" + device, "bs=4096", "count=1", "status=none"}
-	out, err := execCommandWithTimeout(ctx, "dd", 5, false, args...)
-	if err != nil {
-		Logc(ctx).WithFields(log.Fields{"error": err, "device": device}).Error("failed to read the device")
-		return err
-	}
+// getMkfsCommand returns the command and arguments that create a filesystem of the specified type on a device
+// according to the format policy.  The features a filesystem of the device's size needs are enabled; a size of
+// zero means it isn't known.
+func getMkfsCommand(fstype, device string, size int64, policy FormatPolicy) (string, []string, error) {
 
-	// Ensure 4KiB of data read
-	if len(out) != 4096 {
-		Logc(ctx).WithFields(log.Fields{"error": err, "device": device}).Error("read number of bytes not 4KiB")
-		return fmt.Errorf("did not read 4KiB bytes from the device %v, instead read %d bytes", device, len(out))
+	switch fstype {
+	case "xfs":
+		args := []string{"-f"}
+		if policy.NoDiscard {
+			args = append(args, "-K")
+		}
+		return "mkfs.xfs", append(args, device), nil
+	case "ext3", "ext4":
+		args := []string{"-F"}
+		extendedOptions := make([]string, 0)
+		if policy.LazyInit {
+			extendedOptions = append(extendedOptions, "lazy_itable_init=1", "lazy_journal_init=1")
+		}
+		if policy.NoDiscard {
+			extendedOptions = append(extendedOptions, "nodiscard")
+		}
+		if len(extendedOptions) > 0 {
+			args = append(args, "-E", strings.Join(extendedOptions, ","))
+		}
+		if features := getExtFeaturesForSize(fstype, size); len(features) > 0 {
+			args = append(args, "-O", strings.Join(features, ","))
+			if StringInSlice(ext4FeatureBigalloc, features) {
+				args = append(args, "-C", strconv.Itoa(ext4BigallocClusterSize))
+			}
+		}
+		return "mkfs." + fstype, append(args, device), nil
+	default:
+		return "", nil, fmt.Errorf("unsupported file system type: %s", fstype)
 	}
-
-	return nil
 }
 
-// isDeviceUnformatted reads first 2 MiBs of the device to identify if it is unformatted and contains all zeros
-func isDeviceUnformatted(ctx context.Context, device string) (bool, error) {
+// mkfsFailures maps output of mkfs.xfs and mke2fs that marks a failure that recurs however often mkfs is run to
+// the reason reported for it.  Failures not listed, such as a device that's briefly busy, are retried.
+var mkfsFailures = []struct {
+	pattern *regexp.Regexp
+	reason  string
+}{
+	{regexp.MustCompile(`(?i)too small|device size .* is less than|not enough space to build`),
+		"device is too small for the filesystem"},
+	{regexp.MustCompile(`(?i)contains a mounted filesystem|is mounted; will not make`),
+		"device has a mounted filesystem"},
+	{regexp.MustCompile(`(?i)appears to contain an existing filesystem|use the -f option to force`),
+		"device has an existing filesystem signature that mkfs will not overwrite"},
+	{regexp.MustCompile(`(?i)read-only file system|write-protected|is write protected`),
+		"device is read-only"},
+	{regexp.MustCompile(`(?i)invalid option|unknown option|bad option|illegal .* value|usage:`),
+		"mkfs rejected its options"},
+}
 
-	Logc(ctx).WithField("device", device).Debug(">>>> osutils.isDeviceUnformatted")
-	defer Logc(ctx).Debug("<<<< osutils.isDeviceUnformatted")
+// classifyMkfsFailure returns why mkfs failed, and whether running it again would fail the same way.  A mkfs that
+// isn't installed or that timed out is not run again either, since another attempt would only use up the time
+// the container orchestrator allows the stage.
+func classifyMkfsFailure(out []byte, err error) (string, bool) {
 
-	args := []string{"if=" + device, "bs=4096", "count=512", "status=none"}
-	out, err := execCommandWithTimeout(ctx, "dd", 5, false, args...)
-	if err != nil {
-		Logc(ctx).WithFields(log.Fields{"error": err, "device": device}).Error("failed to read the device")
-		return false, err
+	if isCommandNotFound(err) {
+		return "mkfs is not installed", true
 	}
-
-	// Ensure 2MiB of data read
-	if len(out) != 2097152 {
-		Logc(ctx).WithFields(log.Fields{"error": err, "device": device}).Error("read number of bytes not 2MiB")
-		return false, fmt.Errorf("did not read 2MiB bytes from the device %v, instead read %d bytes; unable to "+
-			"ensure if the device is actually unformatted", device, len(out))
+	if IsTimeoutError(err) {
+		return fmt.Sprintf("mkfs did not finish; %v", err), true
 	}
-
-	Logc(ctx).WithField("device", device).Debug("Verified correct number of bytes read.")
-
-	// Ensure all zeros
-	if outWithoutZeros := bytes.Trim(out, "\x00"); len(outWithoutZeros) != 0 {
-		Logc(ctx).WithFields(log.Fields{"error": err, "device": device}).Error("device contains non-zero values")
-		return false, nil
+	for _, failure := range mkfsFailures {
+		if failure.pattern.Match(out) {
+			return fmt.Sprintf("%s: %s", failure.reason, strings.TrimSpace(sanitizeString(string(out)))), true
+		}
 	}
+	return "", false
+}
 
-	Logc(ctx).WithFields(log.Fields{"device": device}).Info("Device in unformatted.")
-
-	return true, nil
+// isCommandNotFound returns whether a command failed because it isn't installed, either here or, when run through
+// chwrap, on the host, where the shell's exit status for a missing command is returned.
+func isCommandNotFound(err error) bool {
+	if errors.Is(err, exec.ErrNotFound) {
+		return true
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	return ok && exitErr.ExitCode() == 127
 }
 
-// formatVolume creates a filesystem for the supplied device of the supplied type.
-func formatVolume(ctx context.Context, device, fstype string) error {
+// formatVolume creates a filesystem for the supplied device of the supplied type, with the supplied label.
+func formatVolume(ctx context.Context, device, fstype, label string) error {
 
 	logFields := log.Fields{"device": device, "fsType": fstype}
 	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.formatVolume")
@@ -2508,36 +6300,53 @@ func formatVolume(ctx context.Context, device, fstype string) error {
 
 	maxDuration := 30 * time.Second
 
+	size, err := getISCSIDiskSize(ctx, device)
+	if err != nil {
+		Logc(ctx).WithFields(logFields).WithError(err).Warning("Could not get device size, not checking it.")
+		size = 0
+	}
+	if err = validateFilesystemSize(ctx, fstype, size); err != nil {
+		return err
+	}
+
 	formatVolume := func() error {
 
 		var err error
 
-		switch fstype {
-		case "xfs":
-			_, err = execCommand(ctx, "mkfs.xfs", "-f", device)
-		case "ext3":
-			_, err = execCommand(ctx, "mkfs.ext3", "-F", device)
-		case "ext4":
-			_, err = execCommand(ctx, "mkfs.ext4", "-F", device)
-		default:
-			return fmt.Errorf("unsupported file system type: %s", fstype)
+		// Never format a device that another stack still holds, such as a LUN reused by the array
+		if err = ensureDeviceNotInUse(ctx, device); err != nil {
+			return err
+		}
+
+		command, args, err := getMkfsCommand(fstype, device, size, formatPolicy)
+		if err != nil {
+			return err
 		}
+		args = withFilesystemLabel(args, label)
 
+		out, err := execCommandWithProgress(
+			ctx, command, formatPolicy.Timeout, formatPolicy.ProgressInterval, args...)
+		if err != nil {
+			// Running mkfs again can't help when the device or the command itself is the problem
+			if reason, permanent := classifyMkfsFailure(out, err); permanent {
+				return backoff.Permanent(FormatFailedError(fmt.Sprintf("%s failed; %s", command, reason)))
+			}
+		}
 		return err
 	}
 
 	formatNotify := func(err error, duration time.Duration) {
-		Logc(ctx).WithField("increment", duration).Debug("Format failed, retrying.")
+		Logc(ctx).WithField("increment", duration).WithError(err).Debug("Format failed, retrying.")
 	}
 
-	formatBackoff := backoff.NewExponentialBackOff()
+	formatBackoff := newExponentialBackOff()
 	formatBackoff.InitialInterval = 2 * time.Second
 	formatBackoff.Multiplier = 2
 	formatBackoff.RandomizationFactor = 0.1
 	formatBackoff.MaxElapsedTime = maxDuration
 
 	// Run the check/scan using an exponential backoff
-	if err := backoff.RetryNotify(formatVolume, formatBackoff, formatNotify); err != nil {
+	if err := retryNotify(formatVolume, formatBackoff, formatNotify); err != nil {
 		Logc(ctx).Warnf("Could not format device after %3.2f seconds.", maxDuration.Seconds())
 		return err
 	}
@@ -2546,6 +6355,115 @@ func formatVolume(ctx context.Context, device, fstype string) error {
 	return nil
 }
 
+// ensureDeviceNotInUse verifies that nothing holds a device.  The device is claimed with O_EXCL, which fails if it
+// is mounted or claimed as a device mapper, md, or LVM member, and while the claim is held it must have no holders
+// and no other process may have it open.  The claim is released on return so that mkfs, which makes its own
+// exclusive claim, can open the device; if anything claims the device in between, mkfs fails rather than
+// formatting it.
+func ensureDeviceNotInUse(ctx context.Context, device string) error {
+
+	Logc(ctx).WithField("device", device).Debug(">>>> osutils.ensureDeviceNotInUse")
+	defer Logc(ctx).Debug("<<<< osutils.ensureDeviceNotInUse")
+
+	resolvedPath, err := filepath.EvalSymlinks(chrootPathPrefix + device)
+	if err != nil {
+		return err
+	}
+
+	file, err := openDeviceExclusively(ctx, resolvedPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Open descriptors link to the device's path as the host sees it
+	resolvedDevice := strings.TrimPrefix(resolvedPath, chrootPathPrefix)
+
+	holders, err := getDeviceHolders(ctx, filepath.Base(resolvedDevice))
+	if err != nil {
+		return err
+	}
+	if len(holders) > 0 {
+		return fmt.Errorf("device %s is in use by %s", device, strings.Join(holders, ", "))
+	}
+
+	pids, err := getProcessesUsingDevice(ctx, resolvedDevice)
+	if err != nil {
+		return err
+	}
+	if len(pids) > 0 {
+		return fmt.Errorf("device %s is open by process(es) %s", device, strings.Join(pids, ", "))
+	}
+
+	return nil
+}
+
+// getDeviceHolders returns the kernel names of the devices, such as dm or md devices, stacked on a device.
+func getDeviceHolders(ctx context.Context, name string) ([]string, error) {
+
+	holders := make([]string, 0)
+
+	dirs, err := ioutil.ReadDir(chrootPathPrefix + "/sys/block/" + name + "/holders")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return holders, nil
+		}
+		return nil, err
+	}
+	for _, dir := range dirs {
+		holders = append(holders, dir.Name())
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"device":  name,
+		"holders": holders,
+	}).Debug("Found device holders.")
+
+	return holders, nil
+}
+
+// getProcessesUsingDevice returns the IDs of other processes with a file descriptor open on a device.
+func getProcessesUsingDevice(ctx context.Context, device string) ([]string, error) {
+
+	pids := make([]string, 0)
+
+	procDirs, err := ioutil.ReadDir(chrootPathPrefix + "/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	// Our own descriptors don't count, and our PID depends on which PID namespace the proc filesystem belongs to
+	selfPID, _ := os.Readlink(chrootPathPrefix + "/proc/self")
+
+	for _, procDir := range procDirs {
+		if !pidRegex.MatchString(procDir.Name()) || procDir.Name() == selfPID {
+			continue
+		}
+		fdPath := chrootPathPrefix + "/proc/" + procDir.Name() + "/fd"
+
+		// Processes come and go, and others' descriptors may not be readable, so skip any errors
+		fds, err := ioutil.ReadDir(fdPath)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if target, err := os.Readlink(fdPath + "/" + fd.Name()); err == nil && target == device {
+				pids = append(pids, procDir.Name())
+				break
+			}
+		}
+	}
+
+	if len(pids) > 0 {
+		Logc(ctx).WithFields(log.Fields{
+			"device": device,
+			"pids":   pids,
+		}).Warning("Device is open by other processes.")
+	}
+
+	return pids, nil
+}
+
 // MountDevice attaches the supplied device at the supplied location.  Use this for iSCSI devices.
 func MountDevice(ctx context.Context, device, mountpoint, options string, isMountPointFile bool) (err error) {
 
@@ -2565,24 +6483,26 @@ func MountDevice(ctx context.Context, device, mountpoint, options string, isMoun
 	}
 
 	mounted, _ := IsMounted(ctx, device, mountpoint)
-	exists := PathExists(mountpoint)
+	exists := PathExists(LocalPath(mountpoint))
 
 	Logc(ctx).Debugf("Already mounted: %v, mountpoint exists: %v", mounted, exists)
 
 	if !exists {
 		if isMountPointFile {
-			if err = EnsureFileExists(ctx, mountpoint); err != nil {
-				Logc(ctx).WithField("error", err).Warning("File check failed.")
+			// A device can't be bound onto a file that couldn't be made, so there's no point mounting it
+			if err = ensureBlockTargetFile(ctx, mountpoint); err != nil {
+				Logc(ctx).WithField("error", err).Error("File check failed.")
+				return err
 			}
 		} else {
-			if err = EnsureDirExists(ctx, mountpoint); err != nil {
+			if err = EnsureDirExists(ctx, LocalPath(mountpoint)); err != nil {
 				Logc(ctx).WithField("error", err).Warning("Mkdir failed.")
 			}
 		}
 	}
 
 	if !mounted {
-		if _, err = execCommand(ctx, "mount", args...); err != nil {
+		if _, err = execMountCommand(ctx, "mount", 0, args...); err != nil {
 			Logc(ctx).WithField("error", err).Error("Mount failed.")
 		}
 	}
@@ -2609,11 +6529,11 @@ func mountNFSPath(ctx context.Context, exportPath, mountpoint, options string) (
 	}
 
 	// Create the mount point dir if necessary
-	if _, err = execCommand(ctx, "mkdir", "-p", mountpoint); err != nil {
+	if _, err = execCommand(ctx, "mkdir", "-p", LocalPath(mountpoint)); err != nil {
 		Logc(ctx).WithField("error", err).Warning("Mkdir failed.")
 	}
 
-	if out, err := execCommand(ctx, "mount", args...); err != nil {
+	if out, err := execMountCommand(ctx, "mount", 0, args...); err != nil {
 		Logc(ctx).WithField("output", string(out)).Debug("Mount failed.")
 		return fmt.Errorf("error mounting NFS volume %v on mountpoint %v: %v", exportPath, mountpoint, err)
 	}
@@ -2627,19 +6547,227 @@ func Umount(ctx context.Context, mountpoint string) (err error) {
 	Logc(ctx).WithField("mountpoint", mountpoint).Debug(">>>> osutils.Umount")
 	defer Logc(ctx).Debug("<<<< osutils.Umount")
 
-	if _, err = execCommandWithTimeout(ctx, "umount", 10, true, mountpoint); err != nil {
+	var out []byte
+	if out, err = execMountCommand(ctx, "umount", 10, mountpoint); err != nil {
 		Logc(ctx).WithField("error", err).Error("Umount failed.")
 		if IsTimeoutError(err) {
-			var out []byte
-			out, err = execCommandWithTimeout(ctx, "umount", 10, true, mountpoint, "-f")
+			// Queued I/O to a multipath device with no working paths would keep even a forced unmount waiting
+			unstickMountedMultipathDevice(ctx, mountpoint)
+			out, err = execMountCommand(ctx, "umount", 10, mountpoint, "-f")
 			if strings.Contains(string(out), "not mounted") {
 				err = nil
 			}
+		} else if isMountBusyOutput(out) {
+			err = umountBusy(ctx, mountpoint)
 		}
 	}
 	return
 }
 
+// UnmountPolicy determines what happens when a filesystem can't be unmounted because processes are using it.  The
+// processes are found by scanning /proc, and are named in the error returned if the filesystem stays mounted.
+type UnmountPolicy struct {
+	// TerminateCommands lists the commands, as named in /proc/<pid>/comm, of processes that may be sent SIGTERM
+	// when they keep a filesystem busy; processes running other commands are never signaled
+	TerminateCommands []string
+	// TerminateGracePeriod is how long signaled processes are given to exit before unmounting is retried
+	TerminateGracePeriod time.Duration
+	// Lazy detaches a filesystem that's still busy, leaving the kernel to finish unmounting it once it's unused
+	Lazy bool
+}
+
+var unmountPolicy = UnmountPolicy{TerminateGracePeriod: defaultUnmountGracePeriod}
+
+// mountHolder is a process keeping a filesystem busy.
+type mountHolder struct {
+	PID     string
+	Command string
+	// StartTime is when the process started, from /proc/<pid>/stat, which tells it apart from a later process
+	// given the same ID
+	StartTime string
+}
+
+// fileDeviceID and signalProcess are called through variables so that tests can fake the filesystems of
+// processes' files and the signals sent to them.
+var fileDeviceID = getFileDeviceID
+var signalProcess = syscall.Kill
+
+func (h mountHolder) String() string {
+	return fmt.Sprintf("%s (%s)", h.PID, h.Command)
+}
+
+// isMountBusyOutput returns true if umount's output says the filesystem is in use.
+func isMountBusyOutput(out []byte) bool {
+	return strings.Contains(string(out), "target is busy") || strings.Contains(string(out), "device is busy")
+}
+
+// umountBusy handles a filesystem that umount reported busy.  Processes holding it whose commands the unmount
+// policy allows are sent SIGTERM and unmounting is retried, and then, if the policy allows, the filesystem is
+// lazily unmounted.  Otherwise, a MountBusyError naming the processes still holding it is returned.
+func umountBusy(ctx context.Context, mountpoint string) error {
+
+	fields := log.Fields{"mountpoint": mountpoint}
+
+	holders, err := getProcessesUsingMount(ctx, mountpoint)
+	if err != nil {
+		Logc(ctx).WithFields(fields).WithError(err).Warning("Could not find processes using mountpoint.")
+	}
+	Logc(ctx).WithFields(fields).WithField("processes", holders).Warning("Mountpoint is busy.")
+
+	if terminated := terminateMountHolders(ctx, holders); len(terminated) > 0 {
+		waitForProcessesToExit(terminated, unmountPolicy.TerminateGracePeriod)
+
+		out, err := execMountCommand(ctx, "umount", 10, mountpoint)
+		if err == nil {
+			return nil
+		} else if !isMountBusyOutput(out) {
+			return err
+		}
+		holders, _ = getProcessesUsingMount(ctx, mountpoint)
+	}
+
+	if unmountPolicy.Lazy {
+		Logc(ctx).WithFields(fields).WithField("processes", holders).Warning(
+			"Lazily unmounting busy mountpoint; it will be fully unmounted once no longer in use.")
+		if _, err := execMountCommand(ctx, "umount", 10, "-l", mountpoint); err != nil {
+			return fmt.Errorf("could not lazily unmount %s; %v", mountpoint, err)
+		}
+		return nil
+	}
+
+	if len(holders) == 0 {
+		return MountBusyError(fmt.Sprintf("could not unmount %s; it is busy, but no process using it was found, "+
+			"so it may have filesystems mounted beneath it or be in use in another mount namespace", mountpoint))
+	}
+	described := make([]string, 0, len(holders))
+	for _, holder := range holders {
+		described = append(described, holder.String())
+	}
+	return MountBusyError(fmt.Sprintf("could not unmount %s; it is in use by processes %s", mountpoint,
+		strings.Join(described, ", ")))
+}
+
+// getProcessesUsingMount returns the processes with a working directory, root, executable, or open file on the
+// filesystem mounted at a mountpoint, much as fuser -m does.  Files are matched by the device number of the
+// filesystem they're on rather than by path, since a process's links name files as its own mount namespace sees
+// them, which may not be where the host mounted them.
+func getProcessesUsingMount(ctx context.Context, mountpoint string) ([]mountHolder, error) {
+
+	holders := make([]mountHolder, 0)
+
+	// The topmost mount at the mountpoint is the one umount found busy
+	mounts, err := listProcSelfMountinfo(hostMountinfoPath())
+	if err != nil {
+		return nil, err
+	}
+	mountpoint = path.Clean(mountpoint)
+	deviceID := ""
+	for _, procMount := range mounts {
+		if procMount.MountPoint == mountpoint {
+			deviceID = procMount.DeviceId
+		}
+	}
+	if deviceID == "" {
+		Logc(ctx).WithField("mountpoint", mountpoint).Debug("Nothing is mounted at mountpoint.")
+		return holders, nil
+	}
+
+	procDirs, err := ioutil.ReadDir(chrootPathPrefix + "/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	selfPID, _ := os.Readlink(chrootPathPrefix + "/proc/self")
+
+	for _, procDir := range procDirs {
+		if !pidRegex.MatchString(procDir.Name()) || procDir.Name() == selfPID {
+			continue
+		}
+		pidPath := chrootPathPrefix + "/proc/" + procDir.Name()
+
+		// Processes come and go, and others' links may not be readable, so skip any errors
+		links := []string{pidPath + "/cwd", pidPath + "/root", pidPath + "/exe"}
+		if fds, err := ioutil.ReadDir(pidPath + "/fd"); err == nil {
+			for _, fd := range fds {
+				links = append(links, pidPath+"/fd/"+fd.Name())
+			}
+		}
+		for _, link := range links {
+			if linkDeviceID, err := fileDeviceID(link); err == nil && linkDeviceID == deviceID {
+				comm, _ := ioutil.ReadFile(pidPath + "/comm")
+				holders = append(holders, mountHolder{
+					PID:       procDir.Name(),
+					Command:   strings.TrimSpace(string(comm)),
+					StartTime: getProcessStartTime(procDir.Name()),
+				})
+				break
+			}
+		}
+	}
+
+	return holders, nil
+}
+
+// getProcessStartTime returns when a process started, in clock ticks since boot, as the 22nd field of
+// /proc/<pid>/stat gives it, or an empty string if it can't be read.  The fields are counted from the end of the
+// command, which is in parentheses and may contain spaces.
+func getProcessStartTime(pid string) string {
+	stat, err := ioutil.ReadFile(chrootPathPrefix + "/proc/" + pid + "/stat")
+	if err != nil {
+		return ""
+	}
+	commandEnd := strings.LastIndex(string(stat), ")")
+	if commandEnd < 0 {
+		return ""
+	}
+	fields := strings.Fields(string(stat)[commandEnd+1:])
+	if len(fields) < 20 {
+		return ""
+	}
+	return fields[19]
+}
+
+// terminateMountHolders sends SIGTERM to the processes whose commands the unmount policy allows to be terminated,
+// and returns the IDs of those signaled.  A process is signaled only if it's still the one found holding the
+// mount, started at the same time, so that a process given a reused ID isn't.
+func terminateMountHolders(ctx context.Context, holders []mountHolder) []string {
+
+	terminated := make([]string, 0)
+	for _, holder := range holders {
+		if !StringInSlice(holder.Command, unmountPolicy.TerminateCommands) {
+			continue
+		}
+		pid, err := strconv.Atoi(holder.PID)
+		if err != nil || holder.StartTime == "" || getProcessStartTime(holder.PID) != holder.StartTime {
+			Logc(ctx).WithField("process", holder.String()).Debug("Process has exited; not terminating it.")
+			continue
+		}
+		Logc(ctx).WithField("process", holder.String()).Warning("Terminating process keeping mountpoint busy.")
+		if err := signalProcess(pid, syscall.SIGTERM); err != nil {
+			Logc(ctx).WithField("process", holder.String()).WithError(err).Warning("Could not terminate process.")
+			continue
+		}
+		terminated = append(terminated, holder.PID)
+	}
+	return terminated
+}
+
+// waitForProcessesToExit waits until none of the processes remain in /proc, or until the timeout elapses.
+func waitForProcessesToExit(pids []string, timeout time.Duration) {
+	for deadline := clock.Now().Add(timeout); clock.Now().Before(deadline); clock.Sleep(100 * time.Millisecond) {
+		running := false
+		for _, pid := range pids {
+			if _, err := os.Stat(chrootPathPrefix + "/proc/" + pid); err == nil {
+				running = true
+				break
+			}
+		}
+		if !running {
+			return
+		}
+	}
+}
+
 // filterTargets parses the output of iscsiadm -m node or -m discoverydb -t st -D
 // and returns the target IQNs for a given portal
 func filterTargets(ctx context.Context, output, tp string) ([]string, error) {
@@ -2666,21 +6794,51 @@ func filterTargets(ctx context.Context, output, tp string) ([]string, error) {
 	return targets, nil
 }
 
-// getTargets gets a list of discovered iSCSI targets
-func getTargets(ctx context.Context, tp string) ([]string, error) {
-	Logc(ctx).WithFields(log.Fields{
-		"Portal": tp,
-	}).Debug(">>>> osutils.getTargets")
-	defer Logc(ctx).Debug("<<<< osutils.getTargets")
+// getTargets gets a list of discovered iSCSI targets
+func getTargets(ctx context.Context, tp string) ([]string, error) {
+	Logc(ctx).WithFields(log.Fields{
+		"Portal": tp,
+	}).Debug(">>>> osutils.getTargets")
+	defer Logc(ctx).Debug("<<<< osutils.getTargets")
+
+	output, err := execCommand(ctx, "iscsiadm", "-m", "node")
+	if nil != err {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				if iSCSIErrNoObjsFound == status.ExitStatus() {
+					Logc(ctx).Debug("No iSCSI nodes found.")
+					// No records
+					return nil, nil
+				}
+			}
+		}
+		Logc(ctx).WithFields(log.Fields{
+			"error":  err,
+			"output": string(output),
+		}).Error("Failed to list nodes")
+		return nil, fmt.Errorf("failed to list nodes: %v", err)
+	}
+	return filterTargets(ctx, string(output), tp)
+}
+
+// ISCSINodeRecord contains information about a record in the iSCSI node database.
+//
+// Deprecated: use iscsi.NodeRecord.
+type ISCSINodeRecord = iscsi.NodeRecord
 
-	output, err := execCommand(ctx, "iscsiadm", "-m", "node")
+// getISCSINodeRecords lists the records in the iSCSI node database
+func getISCSINodeRecords(ctx context.Context) ([]ISCSINodeRecord, error) {
+
+	Logc(ctx).Debug(">>>> osutils.getISCSINodeRecords")
+	defer Logc(ctx).Debug("<<<< osutils.getISCSINodeRecords")
+
+	output, err := execIscsiadmCommand(ctx, "-m", "node")
 	if nil != err {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
 				if iSCSIErrNoObjsFound == status.ExitStatus() {
 					Logc(ctx).Debug("No iSCSI nodes found.")
-					// No records
-					return nil, nil
+					return []ISCSINodeRecord{}, nil
 				}
 			}
 		}
@@ -2690,7 +6848,62 @@ func getTargets(ctx context.Context, tp string) ([]string, error) {
 		}).Error("Failed to list nodes")
 		return nil, fmt.Errorf("failed to list nodes: %v", err)
 	}
-	return filterTargets(ctx, string(output), tp)
+	records, err := iscsi.ParseNodeRecords(string(output))
+	if err != nil {
+		Logc(ctx).WithField("output", string(output)).WithError(err).Error("Failed to parse node list")
+	}
+	return records, err
+}
+
+// PruneISCSINodeRecords deletes iSCSI node records for targets that are neither in the supplied list of targets
+// still in use nor have an active session on this host.  Stale node records accumulate over time, slow down
+// every iscsiadm operation and confuse operators.  The records that were deleted are returned.
+func PruneISCSINodeRecords(ctx context.Context, trackedTargetIQNs []string) ([]ISCSINodeRecord, error) {
+
+	Logc(ctx).WithField("trackedTargetIQNs", trackedTargetIQNs).Debug(">>>> osutils.PruneISCSINodeRecords")
+	defer Logc(ctx).Debug("<<<< osutils.PruneISCSINodeRecords")
+
+	records, err := getISCSINodeRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionInfo, err := getISCSISessionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	inUseTargets := make(map[string]struct{})
+	for _, iqn := range trackedTargetIQNs {
+		inUseTargets[iqn] = struct{}{}
+	}
+	for _, session := range sessionInfo {
+		inUseTargets[session.TargetName] = struct{}{}
+	}
+
+	pruned := make([]ISCSINodeRecord, 0)
+	for _, record := range records {
+		if _, ok := inUseTargets[record.TargetName]; ok {
+			continue
+		}
+
+		fields := log.Fields{"portal": record.Portal, "targetIQN": record.TargetName}
+		if _, err := execIscsiadmCommand(ctx, "-m", "node", "-T", record.TargetName, "-p", record.Portal,
+			"-o", "delete"); err != nil {
+			Logc(ctx).WithFields(fields).WithError(err).Warning("Could not delete stale iSCSI node record.")
+			continue
+		}
+
+		Logc(ctx).WithFields(fields).Debug("Deleted stale iSCSI node record.")
+		pruned = append(pruned, record)
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"records": len(records),
+		"pruned":  len(pruned),
+	}).Info("Pruned stale iSCSI node records.")
+
+	return pruned, nil
 }
 
 func updateDiscoveryDb(ctx context.Context, tp, iface, key, value string) error {
@@ -2851,78 +7064,114 @@ func loginISCSITarget(ctx context.Context, iqn, portal string) error {
 
 	args := []string{"-m", "node", "-T", iqn, "-l", "-p", formatPortal(portal)}
 	listAllISCSIDevices(ctx)
-	if _, err := execIscsiadmCommand(ctx, args...); err != nil {
+	if _, err := execIscsiadmLogin(ctx, iqn, portal, args...); err != nil {
 		Logc(ctx).WithField("error", err).Error("Error logging in to iSCSI target.")
+		listAllISCSIDevicesOnError(ctx, err)
 		return err
 	}
 	listAllISCSIDevices(ctx)
 	return nil
 }
 
-// loginWithChap will login to the iSCSI target with the supplied credentials.
+// execIscsiadmLogin runs an iscsiadm login command for the specified target and portal, bounding the login
+// both in the initiator, via the node record's login timeout, and in the command itself.
+func execIscsiadmLogin(ctx context.Context, iqn, portal string, args ...string) ([]byte, error) {
+
+	loginTimeoutSecs := int(iscsiLoginPolicy.LoginTimeout / time.Second)
+
+	// Swallow this error, the initiator's default login timeout applies if it can't be set
+	_ = configureISCSITarget(ctx, iqn, portal, "node.conn[0].timeo.login_timeout", strconv.Itoa(loginTimeoutSecs))
+
+	// Allow the initiator to give up on its own before the command is killed
+	return execCommandWithTimeout(ctx, "iscsiadm", time.Duration(2*loginTimeoutSecs), true, args...)
+}
+
+// loginWithChap will login to the iSCSI target with the supplied credentials.  The secrets are resolved only
+// while the node record is being prepared, and aren't kept afterward.
 func loginWithChap(
-	ctx context.Context, tiqn, portal, username, password, targetUsername, targetInitiatorSecret, iface string,
-	logSensitiveInfo bool,
+	ctx context.Context, tiqn, portal, username string, passwordRef *SecretRef, targetUsername string,
+	targetInitiatorSecretRef *SecretRef, iface string,
 ) error {
 
 	logFields := log.Fields{
 		"IQN":                   tiqn,
 		"portal":                portal,
 		"username":              username,
-		"password":              "****",
+		"password":              passwordRef.String(),
 		"targetUsername":        targetUsername,
-		"targetInitiatorSecret": "****",
+		"targetInitiatorSecret": targetInitiatorSecretRef.String(),
 		"iface":                 iface,
 	}
-	if logSensitiveInfo {
-		logFields["password"] = password
-		logFields["targetInitiatorSecret"] = targetInitiatorSecret
-	}
 	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.loginWithChap")
 	defer Logc(ctx).Debug("<<<< osutils.loginWithChap")
 
 	args := []string{"-m", "node", "-T", tiqn, "-p", formatPortal(portal)}
 
 	listAllISCSIDevices(ctx)
-	if err := ensureIscsiTarget(ctx, formatPortal(portal), tiqn, username, password, targetUsername, targetInitiatorSecret, iface); err != nil {
-		Logc(ctx).Error("Error running iscsiadm node create.")
-		return err
-	}
-
-	authMethodArgs := append(args, []string{"--op=update", "--name", "node.session.auth.authmethod", "--value=CHAP"}...)
-	if _, err := execIscsiadmCommand(ctx, authMethodArgs...); err != nil {
-		Logc(ctx).Error("Error running iscsiadm set authmethod.")
-		return err
-	}
+	prepare := func() error {
+		password, err := passwordRef.Get(ctx)
+		if err != nil {
+			return fmt.Errorf("could not resolve CHAP initiator secret; %v", err)
+		}
+		targetInitiatorSecret, err := targetInitiatorSecretRef.Get(ctx)
+		if err != nil {
+			return fmt.Errorf("could not resolve CHAP target secret; %v", err)
+		}
 
-	authUserArgs := append(args, []string{"--op=update", "--name", "node.session.auth.username", "--value=" + username}...)
-	if _, err := execIscsiadmCommand(ctx, authUserArgs...); err != nil {
-		Logc(ctx).Error("Error running iscsiadm set authuser.")
-		return err
-	}
+		if err := ensureIscsiTarget(ctx, formatPortal(portal), tiqn, username, password, targetUsername, targetInitiatorSecret, iface); err != nil {
+			Logc(ctx).Error("Error running iscsiadm node create.")
+			return err
+		}
 
-	authPasswordArgs := append(args, []string{"--op=update", "--name", "node.session.auth.password", "--value=" + password}...)
-	if _, err := execIscsiadmCommand(ctx, authPasswordArgs...); err != nil {
-		Logc(ctx).Error("Error running iscsiadm set authpassword.")
-		return err
-	}
+		authMethodArgs := append(args, []string{"--op=update", "--name", "node.session.auth.authmethod", "--value=CHAP"}...)
+		if _, err := execIscsiadmCommand(ctx, authMethodArgs...); err != nil {
+			Logc(ctx).Error("Error running iscsiadm set authmethod.")
+			return err
+		}
 
-	if targetUsername != "" && targetInitiatorSecret != "" {
-		targetAuthUserArgs := append(args, []string{"--op=update", "--name", "node.session.auth.username_in", "--value=" + targetUsername}...)
-		if _, err := execIscsiadmCommand(ctx, targetAuthUserArgs...); err != nil {
-			Logc(ctx).Error("Error running iscsiadm set authuser_in.")
+		authUserArgs := append(args, []string{"--op=update", "--name", "node.session.auth.username", "--value=" + username}...)
+		if _, err := execIscsiadmCommand(ctx, authUserArgs...); err != nil {
+			Logc(ctx).Error("Error running iscsiadm set authuser.")
 			return err
 		}
 
-		targetAuthPasswordArgs := append(args, []string{"--op=update", "--name", "node.session.auth.password_in", "--value=" + targetInitiatorSecret}...)
-		if _, err := execIscsiadmCommand(ctx, targetAuthPasswordArgs...); err != nil {
-			Logc(ctx).Error("Error running iscsiadm set authpassword_in.")
+		authPasswordArgs := append(args, []string{"--op=update", "--name", "node.session.auth.password", "--value=" + password}...)
+		if _, err := execIscsiadmCommand(ctx, authPasswordArgs...); err != nil {
+			Logc(ctx).Error("Error running iscsiadm set authpassword.")
 			return err
 		}
+
+		if targetUsername != "" && targetInitiatorSecret != "" {
+			targetAuthUserArgs := append(args, []string{"--op=update", "--name", "node.session.auth.username_in", "--value=" + targetUsername}...)
+			if _, err := execIscsiadmCommand(ctx, targetAuthUserArgs...); err != nil {
+				Logc(ctx).Error("Error running iscsiadm set authuser_in.")
+				return err
+			}
+
+			targetAuthPasswordArgs := append(args, []string{"--op=update", "--name", "node.session.auth.password_in", "--value=" + targetInitiatorSecret}...)
+			if _, err := execIscsiadmCommand(ctx, targetAuthPasswordArgs...); err != nil {
+				Logc(ctx).Error("Error running iscsiadm set authpassword_in.")
+				return err
+			}
+		}
+
+		applyISCSIScanPolicy(ctx, tiqn, formatPortal(portal))
+		applyManualISCSIStartup(ctx, tiqn, formatPortal(portal))
+		return nil
+	}
+	if err := prepare(); err != nil {
+		return err
 	}
 
+	// Log in, rediscovering the target once if its node record has gone stale
 	loginArgs := append(args, []string{"--login"}...)
-	if _, err := execIscsiadmCommand(ctx, loginArgs...); err != nil {
+	_, err := execIscsiadmLogin(ctx, tiqn, portal, loginArgs...)
+	if isStaleISCSINodeRecordError(err) {
+		if err = refreshISCSINodeRecord(ctx, tiqn, formatPortal(portal), prepare); err == nil {
+			_, err = execIscsiadmLogin(ctx, tiqn, portal, loginArgs...)
+		}
+	}
+	if err != nil {
 		Logc(ctx).Error("Error running iscsiadm login.")
 		return err
 	}
@@ -2930,53 +7179,107 @@ func loginWithChap(
 	return nil
 }
 
-func EnsureISCSISessions(ctx context.Context, targetIQN, iface string, portalsIps []string) error {
+// isStaleISCSINodeRecordError returns true if an iscsiadm login failed in a way that suggests the node record it
+// used is stale, as when the array's portal list changed since the target was discovered, so that either the
+// record is gone or the portal no longer leads to the target.
+func isStaleISCSINodeRecordError(err error) bool {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus() == iSCSIErrNoObjsFound || status.ExitStatus() == iSCSIErrFatalLogin
+		}
+	}
+	return false
+}
+
+// refreshISCSINodeRecord deletes a stale node record and recreates it with the supplied function, which reruns
+// sendtargets discovery since the record no longer exists.
+func refreshISCSINodeRecord(ctx context.Context, targetIQN, portal string, prepare func() error) error {
+
+	fields := log.Fields{"targetIQN": targetIQN, "portal": portal}
+	Logc(ctx).WithFields(fields).Warning("iSCSI login failed on a possibly stale node record; rediscovering target.")
+
+	if _, err := execIscsiadmCommand(ctx, "-m", "node", "-T", targetIQN, "-p", portal, "-o", "delete"); err != nil {
+		Logc(ctx).WithFields(fields).WithError(err).Debug("Could not delete iSCSI node record.")
+	}
+	if err := prepare(); err != nil {
+		return fmt.Errorf("could not rediscover target %s through portal %s; %v", targetIQN, portal, err)
+	}
+	return nil
+}
+
+func EnsureISCSISessions(ctx context.Context, targetIQN, iface string, portals []string) error {
 
 	logFields := log.Fields{
-		"targetIQN":  targetIQN,
-		"portalsIps": portalsIps,
+		"targetIQN": targetIQN,
+		"portals":   portals,
 	}
 
 	Logc(ctx).WithFields(logFields).Debug(">>>> osutils.EnsureISCSISessions")
 	defer Logc(ctx).Debug("<<<< osutils.EnsureISCSISessions")
 
-	for _, portalIp := range portalsIps {
-		listAllISCSIDevices(ctx)
+	if err := ensureISCSIInterface(ctx, iface); err != nil {
+		return err
+	}
 
-		if err := ensureIscsiTarget(ctx, formatPortal(portalIp), targetIQN, "", "", "", "", iface); nil != err {
+	for _, portal := range portals {
+		if err := ensureISCSISession(ctx, targetIQN, iface, portal); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureISCSISession configures the node record for a single portal, logs in, and verifies that a session
+// to the target through that portal now exists.
+func ensureISCSISession(ctx context.Context, targetIQN, iface, portal string) error {
+
+	listAllISCSIDevices(ctx)
+
+	portal = formatPortal(portal)
+	prepare := func() error {
+		if err := ensureIscsiTarget(ctx, portal, targetIQN, "", "", "", "", iface); nil != err {
 			// Logged
 			return err
 		}
 
-		// Set scanning to manual
-		// Swallow this error, someone is running an old version of Debian/Ubuntu
-		_ = configureISCSITarget(ctx, targetIQN, portalIp, "node.session.scan", "manual")
+		applyISCSIScanPolicy(ctx, targetIQN, portal)
+		applyManualISCSIStartup(ctx, targetIQN, portal)
 
 		// Update replacement timeout
 		if err := configureISCSITarget(
-			ctx, targetIQN, portalIp, "node.session.timeo.replacement_timeout", "5"); err != nil {
+			ctx, targetIQN, portal, "node.session.timeo.replacement_timeout", "5"); err != nil {
 			return fmt.Errorf("set replacement timeout failed: %v", err)
 		}
+		return nil
+	}
 
-		// Log in to target
-		if err := loginISCSITarget(ctx, targetIQN, portalIp); err != nil {
-			return fmt.Errorf("login to iSCSI target failed: %v", err)
-		}
+	if err := prepare(); err != nil {
+		return err
 	}
 
-	for _, portalIp := range portalsIps {
-		// Recheck to ensure a session is now open
-		sessionExists, err := iSCSISessionExists(ctx, portalIp)
-		if err != nil {
-			return fmt.Errorf("could not recheck for iSCSI session: %v", err)
-		}
-		if !sessionExists {
-			return fmt.Errorf("expected iSCSI session %v NOT found, please login to the iSCSI portal", portalIp)
+	// Log in to target, rediscovering it once if its node record has gone stale
+	err := loginISCSITarget(ctx, targetIQN, portal)
+	if isStaleISCSINodeRecordError(err) {
+		if err = refreshISCSINodeRecord(ctx, targetIQN, portal, prepare); err == nil {
+			err = loginISCSITarget(ctx, targetIQN, portal)
 		}
+	}
+	if err != nil {
+		return fmt.Errorf("login to iSCSI target failed: %v", err)
+	}
 
-		Logc(ctx).WithField("portalIp", portalIp).Debug("Session established with iSCSI portal.")
+	// Recheck to ensure a session is now open
+	sessionExists, err := iSCSISessionExistsToPortalAndTargetIQN(ctx, portal, targetIQN)
+	if err != nil {
+		return fmt.Errorf("could not recheck for iSCSI session: %v", err)
+	}
+	if !sessionExists {
+		return fmt.Errorf("expected iSCSI session %v NOT found, please login to the iSCSI portal", portal)
 	}
 
+	Logc(ctx).WithField("portal", portal).Debug("Session established with iSCSI portal.")
+
 	return nil
 }
 
@@ -3023,7 +7326,7 @@ func EnsureISCSISessionWithPortalDiscovery(ctx context.Context, hostDataIP strin
 		// Determine which target matches the portal we requested
 		targetIndex := -1
 		for i, target := range targets {
-			if strings.Contains(target.PortalIP, hostDataIP) {
+			if portalMatches(target.Portal, hostDataIP) {
 				targetIndex = i
 				break
 			}
@@ -3033,25 +7336,30 @@ func EnsureISCSISessionWithPortalDiscovery(ctx context.Context, hostDataIP strin
 			return fmt.Errorf("iSCSI discovery found no targets with portal %s", hostDataIP)
 		}
 
-		// To enable multipath, log in to each discovered target with the same IQN (target name)
+		// To enable multipath, log in to each discovered target with the same IQN (target name), through
+		// those of its portals this host can reach
 		targetName := targets[targetIndex].TargetName
+		portals := make([]string, 0)
 		for _, target := range targets {
 			if target.TargetName == targetName {
-				// Set scan to manual
-				// Swallow this error, someone is running an old version of Debian/Ubuntu
-				_ = configureISCSITarget(ctx, target.TargetName, target.PortalIP, "node.session.scan", "manual")
-
-				// Update replacement timeout
-				err = configureISCSITarget(
-					ctx, target.TargetName, target.PortalIP, "node.session.timeo.replacement_timeout", "5")
-				if err != nil {
-					return fmt.Errorf("set replacement timeout failed: %v", err)
-				}
-				// Log in to target
-				err = loginISCSITarget(ctx, target.TargetName, target.PortalIP)
-				if err != nil {
-					return fmt.Errorf("login to iSCSI target failed: %v", err)
-				}
+				// Use the discovered portal, minus the target portal group tag, so non-default ports are honored
+				portals = append(portals, iscsi.ParsePortal(target.Portal).String())
+			}
+		}
+		for _, portal := range filterReachablePortals(ctx, portals) {
+
+			applyISCSIScanPolicy(ctx, targetName, portal)
+			applyManualISCSIStartup(ctx, targetName, portal)
+
+			// Update replacement timeout
+			err = configureISCSITarget(ctx, targetName, portal, "node.session.timeo.replacement_timeout", "5")
+			if err != nil {
+				return fmt.Errorf("set replacement timeout failed: %v", err)
+			}
+			// Log in to target
+			err = loginISCSITarget(ctx, targetName, portal)
+			if err != nil {
+				return fmt.Errorf("login to iSCSI target failed: %v", err)
 			}
 		}
 
@@ -3075,6 +7383,99 @@ func execIscsiadmCommand(ctx context.Context, args ...string) ([]byte, error) {
 	return execCommand(ctx, "iscsiadm", args...)
 }
 
+// Command describes an external command for an Executor to run.
+type Command struct {
+	Name string
+	Args []string
+	// Stdin is fed to the command's standard input.  It is never logged, so secrets such as passphrases and
+	// keys should be passed this way rather than as arguments.
+	Stdin []byte
+	// Env holds additional environment variables for the command, in "key=value" form
+	Env []string
+	// ClearEnv runs the command with only the variables in Env rather than adding them to this process's
+	ClearEnv bool
+	// Dir is the command's working directory; empty means this process's
+	Dir string
+	// MountNamespace and NetworkNamespace are paths, such as /proc/1/ns/mnt, to namespaces to run the command
+	// in via nsenter; empty means this process's
+	MountNamespace   string
+	NetworkNamespace string
+	// Timeout bounds how long the command may run; zero means no limit
+	Timeout time.Duration
+}
+
+// nsenterArgs returns the nsenter arguments that enter the command's namespaces, or nil if it has none.
+func (c Command) nsenterArgs() []string {
+
+	var args []string
+	if c.MountNamespace != "" {
+		args = append(args, "--mount="+c.MountNamespace)
+	}
+	if c.NetworkNamespace != "" {
+		args = append(args, "--net="+c.NetworkNamespace)
+	}
+	return args
+}
+
+// Executor runs external commands on the host.  The default runs them with os/exec; another may be supplied
+// via Config, such as a fake that lets the attach and detach logic run without touching the host.
+type Executor interface {
+	// Execute runs a command to completion and returns its combined output.  If the command runs longer than
+	// its timeout, it is killed and a TimeoutError is returned.
+	Execute(ctx context.Context, cmd Command) ([]byte, error)
+}
+
+// osExecutor runs commands as child processes.
+type osExecutor struct{}
+
+var executor Executor = osExecutor{}
+
+// Execute runs a command as a child process.
+func (osExecutor) Execute(ctx context.Context, command Command) ([]byte, error) {
+
+	cmd := exec.Command(command.Name, command.Args...)
+	if nsenterArgs := command.nsenterArgs(); nsenterArgs != nil {
+		args := append(append(nsenterArgs, "--", command.Name), command.Args...)
+		cmd = exec.Command("nsenter", args...)
+	}
+	if command.ClearEnv {
+		cmd.Env = append([]string{}, command.Env...)
+	} else if len(command.Env) > 0 {
+		cmd.Env = append(os.Environ(), command.Env...)
+	}
+	cmd.Dir = command.Dir
+	if command.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(command.Stdin)
+	}
+
+	if command.Timeout == 0 {
+		return cmd.CombinedOutput()
+	}
+
+	done := make(chan execCommandResult, 1)
+	go func() {
+		out, err := cmd.CombinedOutput()
+		done <- execCommandResult{Output: out, Error: err}
+	}()
+
+	select {
+	case <-time.After(command.Timeout):
+		if err := cmd.Process.Kill(); err != nil {
+			Logc(ctx).WithFields(log.Fields{
+				"process": command.Name,
+				"error":   err,
+			}).Error("failed to kill process")
+			return nil, err
+		}
+		Logc(ctx).WithFields(log.Fields{
+			"process": command.Name,
+		}).Error("process killed after timeout")
+		return nil, TimeoutError("process killed after timeout")
+	case result := <-done:
+		return result.Output, result.Error
+	}
+}
+
 // execCommand invokes an external process
 func execCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
 
@@ -3083,17 +7484,39 @@ func execCommand(ctx context.Context, name string, args ...string) ([]byte, erro
 		"args":    args,
 	}).Debug(">>>> osutils.execCommand.")
 
-	out, err := exec.Command(name, args...).CombinedOutput()
+	out, err := executor.Execute(ctx, Command{Name: name, Args: args})
+	journalCommand(ctx, name, args, err)
 
 	Logc(ctx).WithFields(log.Fields{
 		"command": name,
-		"output":  sanitizeString(string(out)),
+		"output":  sanitizeCommandOutput(out),
 		"error":   err,
 	}).Debug("<<<< osutils.execCommand.")
 
 	return out, err
 }
 
+// execCommandWithInput invokes an external process, feeding it input on stdin.  The input isn't logged, so it
+// may carry secrets.
+func execCommandWithInput(ctx context.Context, name string, input []byte, args ...string) ([]byte, error) {
+
+	Logc(ctx).WithFields(log.Fields{
+		"command": name,
+		"args":    args,
+	}).Debug(">>>> osutils.execCommandWithInput.")
+
+	out, err := executor.Execute(ctx, Command{Name: name, Args: args, Stdin: input})
+	journalCommand(ctx, name, args, err)
+
+	Logc(ctx).WithFields(log.Fields{
+		"command": name,
+		"output":  sanitizeCommandOutput(out),
+		"error":   err,
+	}).Debug("<<<< osutils.execCommandWithInput.")
+
+	return out, err
+}
+
 // execCommandResult is used to return shell command results via channels between goroutines
 type execCommandResult struct {
 	Output []byte
@@ -3104,6 +7527,14 @@ type execCommandResult struct {
 func execCommandWithTimeout(
 	ctx context.Context, name string, timeoutSeconds time.Duration, logOutput bool, args ...string,
 ) ([]byte, error) {
+	return execCommandWithTimeoutAndEnv(ctx, name, timeoutSeconds, logOutput, nil, args...)
+}
+
+// execCommandWithTimeoutAndEnv is execCommandWithTimeout with additional environment variables, in "key=value"
+// form, set for the command.
+func execCommandWithTimeoutAndEnv(
+	ctx context.Context, name string, timeoutSeconds time.Duration, logOutput bool, env []string, args ...string,
+) ([]byte, error) {
 
 	timeout := timeoutSeconds * time.Second
 
@@ -3113,45 +7544,66 @@ func execCommandWithTimeout(
 		"args":           args,
 	}).Debug(">>>> osutils.execCommandWithTimeout.")
 
-	cmd := exec.Command(name, args...)
+	out, err := executor.Execute(ctx, Command{Name: name, Args: args, Env: env, Timeout: timeout})
+	journalCommand(ctx, name, args, err)
+
+	logFields := Logc(ctx).WithFields(log.Fields{
+		"command": name,
+		"error":   err,
+	})
+
+	if logOutput {
+		logFields = logFields.WithField("output", sanitizeCommandOutput(out))
+	}
+
+	logFields.Debug("<<<< osutils.execCommandWithTimeout.")
+
+	return out, err
+}
+
+// execCommandWithProgress invokes an external command, logging periodically while it runs and killing it if it
+// runs longer than the timeout.  A zero timeout means no limit.
+func execCommandWithProgress(
+	ctx context.Context, name string, timeout, progressInterval time.Duration, args ...string,
+) ([]byte, error) {
+
+	Logc(ctx).WithFields(log.Fields{
+		"command": name,
+		"timeout": timeout,
+		"args":    args,
+	}).Debug(">>>> osutils.execCommandWithProgress.")
+
 	done := make(chan execCommandResult, 1)
 	var result execCommandResult
 
+	start := time.Now()
 	go func() {
-		out, err := cmd.CombinedOutput()
+		out, err := executor.Execute(ctx, Command{Name: name, Args: args, Timeout: timeout})
 		done <- execCommandResult{Output: out, Error: err}
 	}()
 
-	select {
-	case <-time.After(timeout):
-		if err := cmd.Process.Kill(); err != nil {
-			Logc(ctx).WithFields(log.Fields{
-				"process": name,
-				"error":   err,
-			}).Error("failed to kill process")
-			result = execCommandResult{Output: nil, Error: err}
-		} else {
+	progress := time.NewTicker(progressInterval)
+	defer progress.Stop()
+
+	for running := true; running; {
+		select {
+		case <-progress.C:
 			Logc(ctx).WithFields(log.Fields{
-				"process": name,
-			}).Error("process killed after timeout")
-			result = execCommandResult{Output: nil, Error: TimeoutError("process killed after timeout")}
+				"command": name,
+				"elapsed": time.Since(start).Round(time.Second).String(),
+			}).Info("Command still running.")
+		case result = <-done:
+			running = false
 		}
-	case result = <-done:
-		break
 	}
+	journalCommand(ctx, name, args, result.Error)
 
-	logFields := Logc(ctx).WithFields(log.Fields{
+	Logc(ctx).WithFields(log.Fields{
 		"command": name,
+		"output":  sanitizeCommandOutput(result.Output),
 		"error":   result.Error,
-	})
-
-	if logOutput {
-		logFields.WithFields(log.Fields{
-			"output": sanitizeString(string(result.Output)),
-		})
-	}
-
-	logFields.Debug("<<<< osutils.execCommandWithTimeout.")
+		"elapsed": time.Since(start).String(),
+	}).Debug("<<<< osutils.execCommandWithProgress.")
 
 	return result.Output, result.Error
 }
@@ -3159,11 +7611,40 @@ func execCommandWithTimeout(
 func sanitizeString(s string) string {
 	// Strip xterm color & movement characters
 	s = xtermControlRegex.ReplaceAllString(s, "")
+	// Strip any other control characters but tabs and newlines
+	s = controlCharRegex.ReplaceAllString(s, "")
 	// Strip trailing newline
 	s = strings.TrimSuffix(s, "\n")
 	return s
 }
 
+// sanitizeCommandOutput prepares the output of an external command for logging.  Binary output is summarized
+// by its size, and text output is sanitized and, unless full command output logging is enabled, cut down to its
+// head and tail so that commands listing many devices don't flood the log.
+func sanitizeCommandOutput(out []byte) string {
+
+	if bytes.IndexByte(out, 0) >= 0 || !utf8.Valid(out) {
+		return fmt.Sprintf("<%d bytes of binary output>", len(out))
+	}
+
+	s := sanitizeString(string(out))
+	if logFullCommandOutput || len(s) <= commandOutputLogHead+commandOutputLogTail {
+		return s
+	}
+
+	// Cut on character boundaries
+	head := commandOutputLogHead
+	for head > 0 && !utf8.RuneStart(s[head]) {
+		head--
+	}
+	tail := len(s) - commandOutputLogTail
+	for tail < len(s) && !utf8.RuneStart(s[tail]) {
+		tail++
+	}
+
+	return fmt.Sprintf("%s\n<%d bytes omitted>\n%s", s[:head], tail-head, s[tail:])
+}
+
 // SafeToLogOut looks for remaining block devices on a given iSCSI host, and returns
 // true if there are none, indicating that logging out would be safe.
 func SafeToLogOut(ctx context.Context, hostNumber, sessionNumber int) bool {
@@ -3171,7 +7652,7 @@ func SafeToLogOut(ctx context.Context, hostNumber, sessionNumber int) bool {
 	Logc(ctx).Debug(">>>> osutils.SafeToLogOut")
 	defer Logc(ctx).Debug("<<<< osutils.SafeToLogOut")
 
-	devicePath := fmt.Sprintf("/sys/class/iscsi_host/host%d/device", hostNumber)
+	devicePath := fmt.Sprintf(chrootPathPrefix+"/sys/class/iscsi_host/host%d/device", hostNumber)
 
 	// The list of block devices on the scsi bus will be in a
 	// directory called "target%d:%d:%d".
@@ -3199,41 +7680,93 @@ func SafeToLogOut(ctx context.Context, hostNumber, sessionNumber int) bool {
 	return true
 }
 
-// In the case of a iscsi trace debug, log info about session and what devices are present
+// iSCSIDeviceSnapshot describes the iSCSI sessions and block devices on the host at a point in time.
+type iSCSIDeviceSnapshot struct {
+	taken            time.Time
+	sessions         []string
+	scsiDevices      []string
+	multipathDevices []string
+}
+
+var (
+	iSCSIDeviceSnapshotMutex sync.Mutex
+	lastISCSIDeviceSnapshot  *iSCSIDeviceSnapshot
+)
+
+// listAllISCSIDevices logs the host's iSCSI sessions and devices if trace logging is enabled.
 func listAllISCSIDevices(ctx context.Context) {
 
 	if !Logc(ctx).Logger.IsLevelEnabled(log.TraceLevel) {
-		// Don't even run the commands if trace logging is not enabled
+		// Don't even look at the host if trace logging is not enabled
 		return
 	}
 
-	Logc(ctx).Trace(">>>> osutils.listAllISCSIDevices")
-	defer Logc(ctx).Trace("<<<< osutils.listAllISCSIDevices")
-	// Log information about all the devices
-	dmLog := make([]string, 0)
-	sdLog := make([]string, 0)
-	sysLog := make([]string, 0)
-	entries, _ := ioutil.ReadDir("/dev/")
-	for _, entry := range entries {
-		if strings.HasPrefix(entry.Name(), "dm-") {
-			dmLog = append(dmLog, entry.Name())
-		}
-		if strings.HasPrefix(entry.Name(), "sd") {
-			sdLog = append(sdLog, entry.Name())
+	getISCSIDeviceSnapshot(ctx).log(ctx, log.TraceLevel, "Listing all iSCSI Devices.")
+}
+
+// listAllISCSIDevicesOnError logs the host's iSCSI sessions and devices at debug level if an operation failed,
+// so that the failure can be diagnosed without trace logging.
+func listAllISCSIDevicesOnError(ctx context.Context, err error) {
+
+	if err == nil || !Logc(ctx).Logger.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+
+	getISCSIDeviceSnapshot(ctx).log(ctx, log.DebugLevel, "Listing all iSCSI Devices after error.")
+}
+
+// getISCSIDeviceSnapshot returns a snapshot of the host's iSCSI sessions and devices, reusing the last one if it
+// was taken within iSCSIDeviceSnapshotMaxAge.  The snapshot is read from sysfs rather than from iscsiadm and
+// multipath, which are slow to run and contend with the operation being logged.
+func getISCSIDeviceSnapshot(ctx context.Context) *iSCSIDeviceSnapshot {
+
+	iSCSIDeviceSnapshotMutex.Lock()
+	defer iSCSIDeviceSnapshotMutex.Unlock()
+
+	if lastISCSIDeviceSnapshot != nil && time.Since(lastISCSIDeviceSnapshot.taken) < iSCSIDeviceSnapshotMaxAge {
+		return lastISCSIDeviceSnapshot
+	}
+
+	snapshot := &iSCSIDeviceSnapshot{
+		taken:            time.Now(),
+		sessions:         make([]string, 0),
+		scsiDevices:      make([]string, 0),
+		multipathDevices: make([]string, 0),
+	}
+
+	if sessions, err := getISCSISessionStates(ctx); err == nil {
+		for _, session := range sessions {
+			snapshot.sessions = append(snapshot.sessions, fmt.Sprintf("session%s %s %s %s",
+				session.SID, session.Portal, session.TargetIQN, session.State))
 		}
 	}
 
-	entries, _ = ioutil.ReadDir("/sys/block/")
+	entries, _ := ioutil.ReadDir(chrootPathPrefix + "/sys/block/")
 	for _, entry := range entries {
-		sysLog = append(sysLog, entry.Name())
+		name := entry.Name()
+		if isDiskDevice(name) {
+			snapshot.scsiDevices = append(snapshot.scsiDevices, name)
+		} else if isDeviceMapperDevice(name) {
+			dmName, _ := ioutil.ReadFile(chrootPathPrefix + "/sys/block/" + name + "/dm/name")
+			slaves := make([]string, 0)
+			slaveDirs, _ := ioutil.ReadDir(chrootPathPrefix + "/sys/block/" + name + "/slaves")
+			for _, slaveDir := range slaveDirs {
+				slaves = append(slaves, slaveDir.Name())
+			}
+			snapshot.multipathDevices = append(snapshot.multipathDevices, fmt.Sprintf("%s (%s) [%s]",
+				name, strings.TrimSpace(string(dmName)), strings.Join(slaves, ",")))
+		}
 	}
-	out1, _ := execCommandWithTimeout(ctx, "multipath", 5, true, "-ll")
-	out2, _ := execIscsiadmCommand(ctx, "-m", "session")
+
+	lastISCSIDeviceSnapshot = snapshot
+	return snapshot
+}
+
+func (s *iSCSIDeviceSnapshot) log(ctx context.Context, level log.Level, message string) {
 	Logc(ctx).WithFields(log.Fields{
-		"/dev/dm-*":                  dmLog,
-		"/dev/sd*":                   sdLog,
-		"/sys/block/*":               sysLog,
-		"multipath -ll output":       string(out1),
-		"iscsiadm -m session output": string(out2),
-	}).Trace("Listing all iSCSI Devices.")
+		"sessions":         s.sessions,
+		"scsiDevices":      s.scsiDevices,
+		"multipathDevices": s.multipathDevices,
+		"age":              time.Since(s.taken).Round(time.Millisecond),
+	}).Log(level, message)
 }
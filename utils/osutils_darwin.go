@@ -6,6 +6,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"os"
 
 	. "github.com/netapp/trident/logger"
 )
@@ -35,6 +36,12 @@ func GetFilesystemStats(ctx context.Context, _ string) (int64, int64, int64, int
 	return 0, 0, 0, 0, 0, 0, errors.New("GetFilesystemStats is not supported for darwin")
 }
 
+func getMountedFilesystems(ctx context.Context) ([]DFInfo, error) {
+	Logc(ctx).Debug(">>>> osutils_darwin.getMountedFilesystems")
+	defer Logc(ctx).Debug("<<<< osutils_darwin.getMountedFilesystems")
+	return nil, UnsupportedError("getMountedFilesystems is not supported for darwin")
+}
+
 func getISCSIDiskSize(ctx context.Context, _ string) (int64, error) {
 
 	Logc(ctx).Debug(">>>> osutils_darwin.getISCSIDiskSize")
@@ -48,6 +55,30 @@ func flushOneDevice(ctx context.Context, devicePath string) error {
 	return errors.New("flushOneDevice is not supported for darwin")
 }
 
+func growFilesystemNatively(ctx context.Context, _, _, _ string) error {
+	Logc(ctx).Debug(">>>> osutils_darwin.growFilesystemNatively")
+	defer Logc(ctx).Debug("<<<< osutils_darwin.growFilesystemNatively")
+	return UnsupportedError("growFilesystemNatively is not supported for darwin")
+}
+
+func openDeviceExclusively(ctx context.Context, _ string) (*os.File, error) {
+	Logc(ctx).Debug(">>>> osutils_darwin.openDeviceExclusively")
+	defer Logc(ctx).Debug("<<<< osutils_darwin.openDeviceExclusively")
+	return nil, UnsupportedError("openDeviceExclusively is not supported for darwin")
+}
+
+func routeExistsToSubnet(ctx context.Context, _ *net.IPNet) (bool, error) {
+	Logc(ctx).Debug(">>>> osutils_darwin.routeExistsToSubnet")
+	defer Logc(ctx).Debug("<<<< osutils_darwin.routeExistsToSubnet")
+	return false, UnsupportedError("routeExistsToSubnet is not supported for darwin")
+}
+
+func kernelSupportsNFSTLS(ctx context.Context) (bool, error) {
+	Logc(ctx).Debug(">>>> osutils_darwin.kernelSupportsNFSTLS")
+	defer Logc(ctx).Debug("<<<< osutils_darwin.kernelSupportsNFSTLS")
+	return false, UnsupportedError("kernelSupportsNFSTLS is not supported for darwin")
+}
+
 func GetHostSystemInfo(ctx context.Context) (*HostSystem, error) {
 
 	Logc(ctx).Debug(">>>> osutils_darwin.GetHostSystemInfo")
@@ -85,6 +116,27 @@ func ServiceEnabledOnHost(ctx context.Context, service string) (bool, error) {
 	return false, UnsupportedError(msg)
 }
 
+func StartServiceOnHost(ctx context.Context, service string) error {
+	Logc(ctx).Debug(">>>> osutils_darwin.StartServiceOnHost")
+	defer Logc(ctx).Debug("<<<< osutils_darwin.StartServiceOnHost")
+	msg := "StartServiceOnHost is not supported for darwin"
+	return UnsupportedError(msg)
+}
+
+func RestartServiceOnHost(ctx context.Context, service string) error {
+	Logc(ctx).Debug(">>>> osutils_darwin.RestartServiceOnHost")
+	defer Logc(ctx).Debug("<<<< osutils_darwin.RestartServiceOnHost")
+	msg := "RestartServiceOnHost is not supported for darwin"
+	return UnsupportedError(msg)
+}
+
+func EnableServiceOnHost(ctx context.Context, service string) error {
+	Logc(ctx).Debug(">>>> osutils_darwin.EnableServiceOnHost")
+	defer Logc(ctx).Debug("<<<< osutils_darwin.EnableServiceOnHost")
+	msg := "EnableServiceOnHost is not supported for darwin"
+	return UnsupportedError(msg)
+}
+
 func ISCSIActiveOnHost(ctx context.Context, host HostSystem) (bool, error) {
 	Logc(ctx).Debug(">>>> osutils_darwin.ISCSIActiveOnHost")
 	defer Logc(ctx).Debug("<<<< osutils_darwin.ISCSIActiveOnHost")
@@ -92,6 +144,13 @@ func ISCSIActiveOnHost(ctx context.Context, host HostSystem) (bool, error) {
 	return false, UnsupportedError(msg)
 }
 
+func RegenerateInitiatorIQN(ctx context.Context, host HostSystem, iqn string) (string, error) {
+	Logc(ctx).Debug(">>>> osutils_darwin.RegenerateInitiatorIQN")
+	defer Logc(ctx).Debug("<<<< osutils_darwin.RegenerateInitiatorIQN")
+	msg := "RegenerateInitiatorIQN is not supported for darwin"
+	return "", UnsupportedError(msg)
+}
+
 func PrepareISCSIPackagesOnHost(ctx context.Context, host HostSystem, iscsiPreconfigured bool) error {
 	Logc(ctx).Debug(">>>> osutils_darwin.PrepareISCSIPackagesOnHost")
 	defer Logc(ctx).Debug("<<<< osutils_darwin.PrepareISCSIPackagesOnHost")
@@ -16,6 +16,7 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/cenkalti/backoff/v4"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 	"github.com/zcalusic/sysinfo"
@@ -101,13 +102,82 @@ func getFilesystemSize(ctx context.Context, path string) (int64, error) {
 	return size, nil
 }
 
-// getISCSIDiskSize queries the current block size in bytes
+// networkFilesystems are listed as mounted without being statfs'd, since statfs hangs on a filesystem whose
+// server has gone away.
+var networkFilesystems = map[string]bool{
+	"nfs": true, "nfs4": true, "cifs": true, "smb3": true, "ceph": true, "glusterfs": true, "fuse.glusterfs": true,
+}
+
+// getMountedFilesystems lists the host's mounted filesystems from its mountinfo, as df does without running it.
+// Like df, it leaves out filesystems, such as proc and sysfs, that have no blocks.
+func getMountedFilesystems(ctx context.Context) ([]DFInfo, error) {
+
+	Logc(ctx).Debug(">>>> osutils_linux.getMountedFilesystems")
+	defer Logc(ctx).Debug("<<<< osutils_linux.getMountedFilesystems")
+
+	mounts, err := listProcSelfMountinfo(hostMountinfoPath())
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]DFInfo, 0, len(mounts))
+	for _, mount := range mounts {
+		if !networkFilesystems[mount.FsType] {
+			done := make(chan statFSResult, 1)
+			go func(path string) {
+				var buf unix.Statfs_t
+				err := unix.Statfs(path, &buf)
+				done <- statFSResult{Output: buf, Error: err}
+			}(LocalPath(mount.MountPoint))
+
+			select {
+			case <-time.After(deviceReadTimeout):
+				Logc(ctx).WithField("mountpoint", mount.MountPoint).Warning("Timed out querying filesystem.")
+				continue
+			case statfs := <-done:
+				if statfs.Error != nil || statfs.Output.Blocks == 0 {
+					continue
+				}
+			}
+		}
+		result = append(result, DFInfo{Target: mount.MountPoint, Source: mount.MountSource})
+	}
+	return result, nil
+}
+
+type diskSizeResult struct {
+	Size  int64
+	Error error
+}
+
+// getISCSIDiskSize queries the current block size in bytes.  The ioctl is issued in a separate goroutine so that
+// a device in a hung state can't block the caller indefinitely.
 func getISCSIDiskSize(ctx context.Context, devicePath string) (int64, error) {
 
 	fields := log.Fields{"devicePath": devicePath}
 	Logc(ctx).WithFields(fields).Debug(">>>> osutils_linux.getISCSIDiskSize")
 	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils_linux.getISCSIDiskSize")
 
+	var timeout = deviceReadTimeout
+	done := make(chan diskSizeResult, 1)
+
+	go func() {
+		size, err := getDiskSizeWithIoctl(ctx, devicePath)
+		done <- diskSizeResult{Size: size, Error: err}
+	}()
+
+	select {
+	case <-time.After(timeout):
+		Logc(ctx).WithFields(fields).Error("Timed out querying disk size.")
+		return 0, TimeoutError(fmt.Sprintf("timed out querying size of disk %s", devicePath))
+	case result := <-done:
+		return result.Size, result.Error
+	}
+}
+
+// getDiskSizeWithIoctl issues the BLKGETSIZE64 ioctl against a disk and returns its size in bytes.
+func getDiskSizeWithIoctl(ctx context.Context, devicePath string) (int64, error) {
+
 	disk, err := os.Open(devicePath)
 	if err != nil {
 		Logc(ctx).Error("Failed to open disk.")
@@ -132,13 +202,19 @@ func flushOneDevice(ctx context.Context, devicePath string) error {
 	Logc(ctx).WithFields(fields).Debug(">>>> osutils_linux.flushOneDevice")
 	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils_linux.flushOneDevice")
 
-	disk, err := os.Open(devicePath)
+	disk, err := os.Open(chrootPathPrefix + devicePath)
 	if err != nil {
 		Logc(ctx).Error("Failed to open disk.")
 		return fmt.Errorf("failed to open disk %s: %s", devicePath, err)
 	}
 	defer disk.Close()
 
+	// Only block devices have buffers to flush
+	if info, err := disk.Stat(); err == nil && info.Mode()&os.ModeDevice == 0 {
+		Logc(ctx).WithFields(fields).Debug("Not a block device, nothing to flush.")
+		return nil
+	}
+
 	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, disk.Fd(), unix.BLKFLSBUF, 0)
 	if errno != 0 {
 		err := os.NewSyscallError("ioctl", errno)
@@ -149,6 +225,116 @@ func flushOneDevice(ctx context.Context, devicePath string) error {
 	return nil
 }
 
+const (
+	// ioctl request numbers from linux/fs/xfs/libxfs/xfs_fs.h and linux/fs/ext4/ext4.h
+	xfsIocFSGeometryV1 = 0x80705864 // _IOR('X', 100, struct xfs_fsop_geom_v1)
+	xfsIocFSGrowFSData = 0x4010586e // _IOW('X', 110, struct xfs_growfs_data)
+	ext4IocResizeFS    = 0x40086610 // _IOW('f', 16, __u64)
+)
+
+// xfsFSOpGeomV1 mirrors struct xfs_fsop_geom_v1
+type xfsFSOpGeomV1 struct {
+	BlockSize    uint32
+	RTExtSize    uint32
+	AGBlocks     uint32
+	AGCount      uint32
+	LogBlocks    uint32
+	SectSize     uint32
+	InodeSize    uint32
+	IMaxPct      uint32
+	DataBlocks   uint64
+	RTBlocks     uint64
+	RTExtents    uint64
+	LogStart     uint64
+	UUID         [16]byte
+	SUnit        uint32
+	SWidth       uint32
+	Version      int32
+	Flags        uint32
+	LogSectSize  uint32
+	RTSectSize   uint32
+	DirBlockSize uint32
+}
+
+// xfsGrowFSData mirrors struct xfs_growfs_data
+type xfsGrowFSData struct {
+	NewBlocks uint64
+	IMaxPct   uint32
+	_         uint32
+}
+
+// growFilesystemNatively grows a mounted filesystem to fill its device using the kernel's online resize ioctls,
+// so that no xfsprogs or e2fsprogs binaries are needed on the host.
+func growFilesystemNatively(ctx context.Context, fsType, devicePath, mountPoint string) error {
+
+	fields := log.Fields{"fsType": fsType, "devicePath": devicePath, "mountPoint": mountPoint}
+	Logc(ctx).WithFields(fields).Debug(">>>> osutils_linux.growFilesystemNatively")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< osutils_linux.growFilesystemNatively")
+
+	deviceSize, err := getISCSIDiskSize(ctx, devicePath)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.Open(mountPoint)
+	if err != nil {
+		return fmt.Errorf("failed to open mount point %s: %s", mountPoint, err)
+	}
+	defer dir.Close()
+
+	switch fsType {
+	case "xfs":
+		var geometry xfsFSOpGeomV1
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dir.Fd(), xfsIocFSGeometryV1,
+			uintptr(unsafe.Pointer(&geometry)))
+		if errno != 0 {
+			return fmt.Errorf("XFS_IOC_FSGEOMETRY_V1 ioctl failed %s: %s", mountPoint,
+				os.NewSyscallError("ioctl", errno))
+		}
+		if geometry.BlockSize == 0 {
+			return fmt.Errorf("XFS_IOC_FSGEOMETRY_V1 returned a zero block size for %s", mountPoint)
+		}
+
+		growData := xfsGrowFSData{
+			NewBlocks: uint64(deviceSize) / uint64(geometry.BlockSize),
+			IMaxPct:   geometry.IMaxPct,
+		}
+		if growData.NewBlocks <= geometry.DataBlocks {
+			Logc(ctx).WithFields(fields).Debug("Filesystem already fills the device.")
+			return nil
+		}
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, dir.Fd(), xfsIocFSGrowFSData,
+			uintptr(unsafe.Pointer(&growData)))
+		if errno != 0 {
+			return fmt.Errorf("XFS_IOC_FSGROWFSDATA ioctl failed %s: %s", mountPoint,
+				os.NewSyscallError("ioctl", errno))
+		}
+
+	case "ext3", "ext4":
+		var buf unix.Statfs_t
+		if err := unix.Statfs(mountPoint, &buf); err != nil {
+			return fmt.Errorf("couldn't get filesystem stats %s: %s", mountPoint, err)
+		}
+		if buf.Bsize <= 0 {
+			return fmt.Errorf("statfs returned an invalid block size for %s", mountPoint)
+		}
+
+		newBlocks := uint64(deviceSize) / uint64(buf.Bsize)
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dir.Fd(), ext4IocResizeFS,
+			uintptr(unsafe.Pointer(&newBlocks)))
+		if errno != 0 {
+			return fmt.Errorf("EXT4_IOC_RESIZE_FS ioctl failed %s: %s", mountPoint,
+				os.NewSyscallError("ioctl", errno))
+		}
+
+	default:
+		return UnsupportedError(fmt.Sprintf("native resize is not supported for file system type %s", fsType))
+	}
+
+	Logc(ctx).WithFields(fields).Debug("Filesystem grown natively.")
+	return nil
+}
+
 func determineNFSPackages(ctx context.Context, host HostSystem) ([]string, error) {
 
 	var packages []string
@@ -480,6 +666,14 @@ func PrepareISCSIServicesOnHost(ctx context.Context, host HostSystem) error {
 		return err
 	}
 
+	// Leave logging in to Trident, so a rebooted node doesn't log in to every target it ever used before Trident
+	// has reconciled which are still in use
+	if _, err = UpdateISCSIDConfig(ctx, ISCSIDConfig{NodeStartup: "manual"}); err != nil {
+		err = fmt.Errorf("error configuring iSCSI daemon; %+v", err)
+		Logc(ctx).Error(err)
+		return err
+	}
+
 	// Re/Start and enable the services
 	for _, service := range services {
 		err = enableAndStartServiceOnHost(ctx, service)
@@ -520,20 +714,86 @@ func ISCSIActiveOnHost(ctx context.Context, host HostSystem) (bool, error) {
 	Logc(ctx).Debug(">>>> osutils_linux.ISCSIActiveOnHost")
 	defer Logc(ctx).Debug("<<<< osutils_linux.ISCSIActiveOnHost")
 
-	var serviceName string
+	serviceName, err := iscsiServiceName(host)
+	if err != nil {
+		Logc(ctx).Error(err)
+		return false, err
+	}
+
+	return ServiceActiveOnHost(ctx, serviceName)
+}
 
+// iscsiServiceName returns the name of the service that runs the iSCSI daemon on the given host
+func iscsiServiceName(host HostSystem) (string, error) {
 	switch host.OS.Distro {
 	case Centos, RHEL:
-		serviceName = "iscsid"
+		return "iscsid", nil
 	case Ubuntu:
-		serviceName = "open-iscsi"
+		return "open-iscsi", nil
 	default:
-		err := fmt.Errorf("unsupported distro: %s", host.OS.Distro)
-		Logc(ctx).Error(err)
-		return false, err
+		return "", fmt.Errorf("unsupported distro: %s", host.OS.Distro)
 	}
+}
 
-	return ServiceActiveOnHost(ctx, serviceName)
+// RegenerateInitiatorIQN replaces the host's iSCSI initiator name, which is a distribution default or is shared
+// with another node, with a newly generated one, and restarts the iSCSI daemon so that it takes effect.  It does
+// nothing unless enabled with Config.RegenerateInitiatorIQN, and refuses while the host has iSCSI sessions, since
+// those were established, and mapped by the storage, under the current name.  It returns the new name.
+func RegenerateInitiatorIQN(ctx context.Context, host HostSystem, iqn string) (string, error) {
+
+	Logc(ctx).WithField("IQN", iqn).Debug(">>>> osutils_linux.RegenerateInitiatorIQN")
+	defer Logc(ctx).Debug("<<<< osutils_linux.RegenerateInitiatorIQN")
+
+	if !regenerateInitiatorIQN {
+		return "", fmt.Errorf("iSCSI initiator name regeneration is not enabled")
+	}
+
+	serviceName, err := iscsiServiceName(host)
+	if err != nil {
+		return "", err
+	}
+
+	sessions, err := getISCSISessionInfo(ctx)
+	if err != nil {
+		return "", err
+	} else if len(sessions) > 0 {
+		return "", fmt.Errorf("not replacing iSCSI initiator name %s while the host has %d iSCSI sessions",
+			iqn, len(sessions))
+	}
+
+	newIQN, err := generateInitiatorIQN(iqn)
+	if err != nil {
+		return "", err
+	}
+
+	// Any alias and comments are kept
+	if _, err = WriteInitiatorNameConfig(ctx, InitiatorNameConfig{Name: newIQN}); err != nil {
+		return "", fmt.Errorf("could not write iSCSI initiator name; %v", err)
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"oldIQN": iqn,
+		"newIQN": newIQN,
+	}).Warning("Replaced iSCSI initiator name.")
+	journalHostOperation(ctx, log.WarnLevel, "Replaced iSCSI initiator name.",
+		log.Fields{"oldIQN": iqn, "newIQN": newIQN})
+
+	if err = RestartServiceOnHost(ctx, serviceName); err != nil {
+		return "", err
+	}
+
+	return newIQN, nil
+}
+
+// hostSystemBusSocket is the path of the host's D-Bus system bus socket, as the host sees it
+const hostSystemBusSocket = "/run/dbus/system_bus_socket"
+
+// systemctl asks the host's systemd, over D-Bus, to perform the specified command.  In a container, systemctl is
+// run through chwrap, chrooted into the host's root, so the host's system bus socket is named by its path on the
+// host rather than through the host root, and any bus address in this process's environment is overridden.
+func systemctl(ctx context.Context, args ...string) ([]byte, error) {
+	env := []string{"DBUS_SYSTEM_BUS_ADDRESS=unix:path=" + hostSystemBusSocket}
+	return execCommandWithTimeoutAndEnv(ctx, "systemctl", 30, true, env, args...)
 }
 
 func enableAndStartServiceOnHost(ctx context.Context, service string) error {
@@ -541,37 +801,59 @@ func enableAndStartServiceOnHost(ctx context.Context, service string) error {
 	var (
 		active, enabled bool
 		err             error
-		output          []byte
 	)
 
 	// Re/start service
 	if active, err = ServiceActiveOnHost(ctx, service); err != nil {
 		return err
 	} else if active {
-		Logc(ctx).WithField("service", service).Debug("Restarting service.")
-		output, err = execCommandWithTimeout(ctx, "systemctl", 30, true, "restart", service)
+		err = RestartServiceOnHost(ctx, service)
 	} else {
-		Logc(ctx).WithField("service", service).Debug("Starting service.")
-		output, err = execCommandWithTimeout(ctx, "systemctl", 30, true, "start", service)
+		err = StartServiceOnHost(ctx, service)
 	}
 	if err != nil {
-		err = fmt.Errorf("error re/starting service; %s; %+v", string(output), err)
 		return err
 	}
-	Logc(ctx).WithField("service", service).Debug("Service re/started.")
 
 	// Enable service if not currently enabled
 	if enabled, err = ServiceEnabledOnHost(ctx, service); err != nil {
 		return err
 	} else if !enabled {
-		Logc(ctx).WithField("service", service).Debug("Enabling service.")
-		output, err = execCommandWithTimeout(ctx, "systemctl", 30, true, "enable", service)
-		if err != nil {
-			err = fmt.Errorf("error enabling service; %s; %+v", string(output), err)
-			return err
-		}
-		Logc(ctx).WithField("service", service).Debug("Service enabled.")
+		return EnableServiceOnHost(ctx, service)
+	}
+	return nil
+}
+
+// StartServiceOnHost starts a host service
+func StartServiceOnHost(ctx context.Context, service string) error {
+
+	Logc(ctx).WithField("service", service).Debug("Starting service.")
+	if output, err := systemctl(ctx, "start", service); err != nil {
+		return fmt.Errorf("error starting service; %s; %+v", string(output), err)
+	}
+	Logc(ctx).WithField("service", service).Debug("Service started.")
+	return nil
+}
+
+// RestartServiceOnHost restarts a host service, starting it if it isn't running
+func RestartServiceOnHost(ctx context.Context, service string) error {
+
+	Logc(ctx).WithField("service", service).Debug("Restarting service.")
+	if output, err := systemctl(ctx, "restart", service); err != nil {
+		return fmt.Errorf("error restarting service; %s; %+v", string(output), err)
+	}
+	Logc(ctx).WithField("service", service).Debug("Service restarted.")
+	return nil
+}
+
+// EnableServiceOnHost enables a host service to start automatically on boot
+func EnableServiceOnHost(ctx context.Context, service string) error {
+
+	Logc(ctx).WithField("service", service).Debug("Enabling service.")
+	if output, err := systemctl(ctx, "enable", service); err != nil {
+		return fmt.Errorf("error enabling service; %s; %+v", string(output), err)
 	}
+	Logc(ctx).WithField("service", service).Debug("Service enabled.")
 	return nil
 }
 
@@ -581,7 +863,7 @@ func ServiceActiveOnHost(ctx context.Context, service string) (bool, error) {
 	Logc(ctx).Debug(">>>> osutils_linux.ServiceActiveOnHost")
 	defer Logc(ctx).Debug("<<<< osutils_linux.ServiceActiveOnHost")
 
-	output, err := execCommandWithTimeout(ctx, "systemctl", 30, true, "is-active", service)
+	output, err := systemctl(ctx, "is-active", service)
 	if err != nil {
 		if _, ok := err.(*exec.ExitError); ok {
 			Logc(ctx).WithField("service", service).Debug("Service is not active on the host.")
@@ -602,7 +884,7 @@ func ServiceEnabledOnHost(ctx context.Context, service string) (bool, error) {
 	Logc(ctx).Debug(">>>> osutils_linux.ServiceEnabledOnHost")
 	defer Logc(ctx).Debug("<<<< osutils_linux.ServiceEnabledOnHost")
 
-	output, err := execCommandWithTimeout(ctx, "systemctl", 30, true, "is-enabled", service)
+	output, err := systemctl(ctx, "is-enabled", service)
 	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
 			if exitError.ExitCode() == 1 {
@@ -758,6 +1040,100 @@ func getIPAddressesExceptingNondefaultRoutes(ctx context.Context) ([]net.Addr, e
 	return getUsableAddressesFromLinks(ctx, links), nil
 }
 
+// openDeviceExclusively opens a device with O_EXCL, which the kernel refuses with EBUSY while the device is
+// mounted or claimed by device mapper, md, or another exclusive opener such as mkfs.  Transient claims, as
+// while udev rules run, are retried for a few seconds.
+func openDeviceExclusively(ctx context.Context, device string) (*os.File, error) {
+
+	Logc(ctx).WithField("device", device).Debug(">>>> osutils_linux.openDeviceExclusively")
+	defer Logc(ctx).Debug("<<<< osutils_linux.openDeviceExclusively")
+
+	var file *os.File
+
+	open := func() error {
+		var err error
+		file, err = os.OpenFile(device, os.O_RDONLY|syscall.O_EXCL, 0)
+		if err != nil {
+			if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EBUSY {
+				return fmt.Errorf("device %s is in use", device)
+			}
+			return backoff.Permanent(err)
+		}
+		return nil
+	}
+
+	openNotify := func(err error, duration time.Duration) {
+		Logc(ctx).WithFields(log.Fields{
+			"device":    device,
+			"increment": duration,
+		}).Debug("Device is busy, waiting.")
+	}
+
+	openBackoff := newExponentialBackOff()
+	openBackoff.InitialInterval = 500 * time.Millisecond
+	openBackoff.Multiplier = 1.414 // approx sqrt(2)
+	openBackoff.RandomizationFactor = 0.1
+	openBackoff.MaxElapsedTime = 10 * time.Second
+
+	if err := retryNotify(open, openBackoff, openNotify); err != nil {
+		Logc(ctx).WithField("device", device).Warning("Could not open device exclusively.")
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// routeGet looks up the routes the kernel would use toward an address
+var routeGet = netlink.RouteGet
+
+// routeExistsToSubnet uses the routing table to determine whether this host can reach the specified subnet.  Any
+// address has a route through the default gateway, so a route through a gateway counts only toward a configured
+// storage network; toward any other subnet, the route must be on-link.
+func routeExistsToSubnet(ctx context.Context, subnet *net.IPNet) (bool, error) {
+
+	Logc(ctx).WithField("subnet", subnet.String()).Debug(">>>> osutils_linux.routeExistsToSubnet")
+	defer Logc(ctx).Debug("<<<< osutils_linux.routeExistsToSubnet")
+
+	routes, err := routeGet(subnet.IP)
+	if err != nil {
+		if err == syscall.ENETUNREACH || err == syscall.EHOSTUNREACH {
+			return false, nil
+		}
+		return false, err
+	}
+
+	for _, route := range routes {
+		if route.Gw == nil && len(route.MultiPath) == 0 {
+			return true, nil
+		}
+		if inStorageCIDRs(subnet) {
+			return true, nil
+		}
+		Logc(ctx).WithFields(log.Fields{
+			"subnet":  subnet.String(),
+			"gateway": route.Gw,
+		}).Debug("Route toward subnet is through a gateway and the subnet is not a storage network.")
+	}
+	return false, nil
+}
+
+// kernelSupportsNFSTLS checks whether the kernel can hand off TLS handshakes for RPC transports to a user-space
+// agent, which NFS over TLS (RFC 9289) requires.  The handshake upcall is provided by the "handshake" generic
+// netlink family, which first appeared in Linux 6.4.
+func kernelSupportsNFSTLS(ctx context.Context) (bool, error) {
+
+	Logc(ctx).Debug(">>>> osutils_linux.kernelSupportsNFSTLS")
+	defer Logc(ctx).Debug("<<<< osutils_linux.kernelSupportsNFSTLS")
+
+	if _, err := netlink.GenlFamilyGet("handshake"); err != nil {
+		if err == syscall.ENOENT {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
 // getUsableAddressesFromLinks returns all global unicast addresses on the specified interfaces.
 func getUsableAddressesFromLinks(ctx context.Context, links []netlink.Link) []net.Addr {
 
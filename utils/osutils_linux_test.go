@@ -6,12 +6,18 @@ package utils
 
 import (
 	"context"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path"
 	"strings"
+	"syscall"
 	"testing"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
 )
 
 func TestDetermineNFSPackages(t *testing.T) {
@@ -189,3 +195,353 @@ func TestGetIPAddressesExceptingNondefaultRoutes(t *testing.T) {
 		assert.True(t, parsedAddr.IsGlobalUnicast(), "Address is not global unicast")
 	}
 }
+
+func TestGetNodeTopology(t *testing.T) {
+
+	zones := map[string]string{"topology.kubernetes.io/zone": "us-east-1a"}
+
+	topology, err := GetNodeTopology(context.TODO(), nil, zones)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Greater(t, len(topology.Subnets), 0, "No subnets found")
+	assert.Equal(t, zones, topology.Zones, "Zone labels not reported")
+
+	for _, subnet := range topology.Subnets {
+		_, _, err := net.ParseCIDR(subnet)
+		assert.NoError(t, err, "Subnet is not a CIDR")
+	}
+
+	_, err = GetNodeTopology(context.TODO(), []string{"not-a-cidr"}, zones)
+	assert.Error(t, err, "Expected error for invalid portal CIDR")
+}
+
+func TestOpenDeviceExclusively(t *testing.T) {
+
+	file, err := ioutil.TempFile("", "TestOpenDeviceExclusively")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+	_ = file.Close()
+
+	exclusiveFile, err := openDeviceExclusively(context.TODO(), file.Name())
+	assert.NoError(t, err)
+	_ = exclusiveFile.Close()
+
+	_, err = openDeviceExclusively(context.TODO(), file.Name()+"-missing")
+	assert.True(t, os.IsNotExist(err), "Expected missing device error, got %v", err)
+}
+
+func TestDetachVolumesForTarget(t *testing.T) {
+	log.Debug("Running TestDetachVolumesForTarget...")
+
+	dir, err := ioutil.TempDir("", "TestDetachVolumesForTarget")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: recorder}))
+	defer func() { _ = Init(Config{}) }()
+
+	// Two LUNs on the target being detached, and one on another target
+	luns := []struct {
+		session, iqn, device string
+		host, lun            int
+	}{
+		{"session1", "iqn.a", "sdb", 2, 0},
+		{"session1", "iqn.a", "sdc", 2, 1},
+		{"session2", "iqn.b", "sdd", 3, 0},
+	}
+	for _, l := range luns {
+		sessionPath := path.Join(dir, "sys/class/iscsi_session", l.session)
+		lunPath := path.Join(sessionPath, "device", fmt.Sprintf("target%d:0:0", l.host),
+			fmt.Sprintf("%d:0:0:%d", l.host, l.lun))
+		assert.NoError(t, os.MkdirAll(path.Join(lunPath, "block", l.device), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(sessionPath, "targetname"), []byte(l.iqn+"\n"), 0600))
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block", l.device, "device"), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/block", l.device, "device/delete"), nil, 0600))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/block", l.device, "device/state"), nil, 0600))
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "dev"), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "dev", l.device), nil, 0600))
+	}
+
+	assert.NoError(t, DetachVolumesForTarget(context.TODO(), "iqn.a", false))
+
+	for _, l := range luns {
+		deleted, err := ioutil.ReadFile(path.Join(dir, "sys/block", l.device, "device/delete"))
+		assert.NoError(t, err)
+		state, err := ioutil.ReadFile(path.Join(dir, "sys/block", l.device, "device/state"))
+		assert.NoError(t, err)
+		if l.iqn == "iqn.a" {
+			assert.Equal(t, "1", string(deleted), l.device)
+			assert.Equal(t, "offline", string(state), l.device)
+		} else {
+			assert.Empty(t, deleted, l.device)
+			assert.Empty(t, state, l.device)
+		}
+	}
+	assert.Equal(t, []string{"iscsiadm -m node -T iqn.a -u"}, recorder.commands)
+}
+
+func TestRegenerateInitiatorIQN(t *testing.T) {
+	log.Debug("Running TestRegenerateInitiatorIQN...")
+
+	dir, err := ioutil.TempDir("", "TestRegenerateInitiatorIQN")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "etc/iscsi"), 0755))
+
+	ctx := context.TODO()
+	host := HostSystem{OS: SystemOS{Distro: Ubuntu}}
+	iqn := "iqn.1993-08.org.debian:01:"
+
+	// Regeneration is opt-in
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: recorder}))
+	defer func() { _ = Init(Config{}) }()
+	_, err = RegenerateInitiatorIQN(ctx, host, iqn)
+	assert.Error(t, err)
+	assert.Empty(t, recorder.commands)
+
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: recorder, RegenerateInitiatorIQN: true}))
+	newIQN, err := RegenerateInitiatorIQN(ctx, host, iqn)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^iqn\.1993-08\.org\.debian:01:[0-9a-f]{12}$`, newIQN)
+
+	content, err := ioutil.ReadFile(path.Join(dir, "etc/iscsi/initiatorname.iscsi"))
+	assert.NoError(t, err)
+	assert.Equal(t, "InitiatorName="+newIQN+"\n", string(content))
+	assert.Equal(t, []string{"iscsiadm -m session", "systemctl restart open-iscsi"}, recorder.commands)
+}
+
+func TestResolveStaleMultipathDevice(t *testing.T) {
+	log.Debug("Running TestResolveStaleMultipathDevice...")
+
+	dir, err := ioutil.TempDir("", "TestResolveStaleMultipathDevice")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name, content string) {
+		assert.NoError(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644))
+	}
+	makeDir := func(name string) {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, name), 0755))
+	}
+
+	// sdb and sdc are the new LUN's paths, held by dm-0 along with sda, an offline path to the old LUN
+	for _, device := range []string{"sdb", "sdc"} {
+		writeFile("sys/block/"+device+"/size", "2097152\n")
+		writeFile("sys/block/"+device+"/device/state", "running\n")
+		writeFile("sys/block/"+device+"/device/rescan", "")
+		makeDir("sys/block/" + device + "/holders/dm-0")
+		makeDir("sys/block/dm-0/slaves/" + device)
+	}
+	writeFile("sys/block/sda/device/state", "offline\n")
+	makeDir("sys/block/dm-0/slaves/sda")
+	writeFile("sys/block/dm-0/size", "2097152\n")
+	makeDir("sys/block/dm-0/dm")
+	writeFile("dev/dm-0", "")
+
+	ctx := context.TODO()
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: recorder}))
+	defer func() { _ = Init(Config{}) }()
+
+	assert.NoError(t, resolveStaleMultipathDeviceForDevices(ctx, []string{"sdb", "sdc"}))
+	assert.Contains(t, recorder.commands, "multipath -f /dev/dm-0")
+	assert.Contains(t, recorder.commands, "multipathd add path sdb")
+	assert.Contains(t, recorder.commands, "multipathd add path sdc")
+
+	// A map of the old LUN's size is reloaded, and replaced only if that doesn't correct its size
+	assert.NoError(t, os.Remove(path.Join(dir, "sys/block/dm-0/slaves/sda")))
+	writeFile("sys/block/dm-0/size", "1048576\n")
+	recorder.commands = nil
+	assert.NoError(t, resolveStaleMultipathDeviceForDevices(ctx, []string{"sdb", "sdc"}))
+	assert.Contains(t, recorder.commands, "multipath -r /dev/dm-0")
+	assert.Contains(t, recorder.commands, "multipath -f /dev/dm-0")
+
+	// A map matching its paths is left alone
+	writeFile("sys/block/dm-0/size", "2097152\n")
+	recorder.commands = nil
+	assert.NoError(t, resolveStaleMultipathDeviceForDevices(ctx, []string{"sdb", "sdc"}))
+	assert.Empty(t, recorder.commands)
+}
+
+func TestRemoveDevice(t *testing.T) {
+	log.Debug("Running TestRemoveDevice...")
+
+	dir, err := ioutil.TempDir("", "TestRemoveDevice")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: &recordingExecutor{}}))
+	defer func() { _ = Init(Config{}) }()
+
+	// sdb is running, sdc already failed by the transport, sdd has no delete file, and sde is already gone
+	for device, state := range map[string]string{"sdb": "", "sdc": "transport-offline", "sdd": ""} {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block", device, "device"), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/block", device, "device/state"), []byte(state), 0600))
+		if device != "sdd" {
+			assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/block", device, "device/delete"), nil, 0600))
+		}
+	}
+
+	ctx := context.TODO()
+	assert.NoError(t, removeDevice(ctx, &ScsiDeviceInfo{Devices: []string{"sdb", "sdc", "sde"}}, false))
+
+	state, _ := ioutil.ReadFile(path.Join(dir, "sys/block/sdb/device/state"))
+	assert.Equal(t, "offline", string(state))
+	state, _ = ioutil.ReadFile(path.Join(dir, "sys/block/sdc/device/state"))
+	assert.Equal(t, "transport-offline", string(state))
+	for _, device := range []string{"sdb", "sdc"} {
+		deleted, _ := ioutil.ReadFile(path.Join(dir, "sys/block", device, "device/delete"))
+		assert.Equal(t, "1", string(deleted), device)
+	}
+
+	// A device that can't be deleted is reported, even when forced
+	assert.Error(t, removeDevice(ctx, &ScsiDeviceInfo{Devices: []string{"sdd"}}, false))
+	err = removeDevice(ctx, &ScsiDeviceInfo{Devices: []string{"sdd", "sdb"}}, true)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "sdd")
+	deleted, _ := ioutil.ReadFile(path.Join(dir, "sys/block/sdb/device/delete"))
+	assert.Equal(t, "11", string(deleted))
+}
+
+func TestAdoptISCSIDevice(t *testing.T) {
+	log.Debug("Running TestAdoptISCSIDevice...")
+
+	dir, err := ioutil.TempDir("", "TestAdoptISCSIDevice")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: &recordingExecutor{}}))
+	defer func() { _ = Init(Config{}) }()
+
+	sessionPath := path.Join(dir, "sys/class/iscsi_session/session1")
+	lunPath := path.Join(sessionPath, "device/target2:0:0/2:0:0:4")
+	assert.NoError(t, os.MkdirAll(path.Join(lunPath, "block/sdb"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(sessionPath, "targetname"), []byte("iqn.a\n"), 0600))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block/sdb/device"), 0755))
+
+	ctx := context.TODO()
+	tests := []struct {
+		Device      string
+		Fstype      string
+		PublishInfo VolumePublishInfo
+		Valid       bool
+	}{
+		{"sdb", "ext4", VolumePublishInfo{}, true},
+		{"sdb", "ext4", VolumePublishInfo{FilesystemType: "ext4"}, true},
+		{"sdb", "ext4", VolumePublishInfo{FilesystemType: "xfs"}, false},
+		{"sdc", "ext4", VolumePublishInfo{}, false},
+	}
+	for _, testCase := range tests {
+		publishInfo := testCase.PublishInfo
+		publishInfo.IscsiTargetIQN = "iqn.a"
+		publishInfo.IscsiLunNumber = 4
+		err := adoptISCSIDevice(ctx, "vol1", testCase.Device, testCase.Fstype, &publishInfo)
+		assert.Equal(t, testCase.Valid, err == nil, "%+v", testCase)
+		if testCase.Valid {
+			assert.Equal(t, "/dev/sdb", publishInfo.DevicePath)
+			assert.Equal(t, "ext4", publishInfo.FilesystemType)
+		}
+	}
+
+	// The device must be the expected LUN of the expected target
+	publishInfo := VolumePublishInfo{}
+	publishInfo.IscsiTargetIQN = "iqn.a"
+	publishInfo.IscsiLunNumber = 5
+	assert.Error(t, adoptISCSIDevice(ctx, "vol1", "sdb", "ext4", &publishInfo))
+	publishInfo.IscsiTargetIQN = "iqn.b"
+	publishInfo.IscsiLunNumber = 4
+	assert.Error(t, adoptISCSIDevice(ctx, "vol1", "sdb", "ext4", &publishInfo))
+	assert.Empty(t, publishInfo.DevicePath)
+
+	assert.Error(t, AdoptExistingAttachment(ctx, "vol1", "/mnt/vol1", &VolumePublishInfo{}))
+}
+
+func TestGetMountedFilesystems(t *testing.T) {
+	log.Debug("Running TestGetMountedFilesystems...")
+
+	dir, err := ioutil.TempDir("", "TestGetMountedFilesystems")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "proc/1"), 0755))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "mnt/data"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "proc/1/mountinfo"), []byte(
+		"100 29 8:16 / /mnt/data rw,relatime shared:1 - ext4 /dev/sdb rw\n"+
+			"101 29 8:32 / /mnt/gone rw,relatime shared:2 - ext4 /dev/sdc rw\n"+
+			"102 29 0:50 / /mnt/nfs rw,relatime shared:3 - nfs4 10.0.0.1:/vol1 rw,vers=4.1\n"), 0644))
+
+	assert.NoError(t, Init(Config{DockerPluginMode: true, HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	// Network filesystems are listed without being queried, and others only if they can be
+	mounted, err := getMountedFilesystems(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, []DFInfo{
+		{Target: "/mnt/data", Source: "/dev/sdb"},
+		{Target: "/mnt/nfs", Source: "10.0.0.1:/vol1"},
+	}, mounted)
+}
+
+func TestSystemctlBusAddress(t *testing.T) {
+	log.Debug("Running TestSystemctlBusAddress...")
+
+	executor := &commandExecutor{}
+	assert.NoError(t, Init(Config{DockerPluginMode: true, Executor: executor}))
+	defer func() { _ = Init(Config{}) }()
+
+	// systemctl runs chrooted into the host's root, where the bus socket has its host path
+	_, err := systemctl(context.TODO(), "is-active", "iscsid")
+	assert.NoError(t, err)
+	assert.Len(t, executor.commands, 1)
+	assert.Equal(t, []string{"DBUS_SYSTEM_BUS_ADDRESS=unix:path=/run/dbus/system_bus_socket"},
+		executor.commands[0].Env)
+}
+
+func TestRouteExistsToSubnet(t *testing.T) {
+	log.Debug("Running TestRouteExistsToSubnet...")
+
+	defer func() { routeGet = netlink.RouteGet }()
+	defer func() { _ = Init(Config{}) }()
+
+	portal := &net.IPNet{IP: net.ParseIP("10.20.30.40").To4(), Mask: net.CIDRMask(32, 32)}
+	var routes []netlink.Route
+	var routeErr error
+	routeGet = func(net.IP) ([]netlink.Route, error) { return routes, routeErr }
+
+	// The only route toward the portal is the default route
+	routes = []netlink.Route{{Gw: net.ParseIP("192.168.1.1"), Src: net.ParseIP("192.168.1.10")}}
+	ok, err := routeExistsToSubnet(context.TODO(), portal)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// A route through a gateway counts once the portal's network is a configured storage network
+	assert.NoError(t, Init(Config{StorageCIDRs: []string{"10.20.0.0/16"}}))
+	ok, err = routeExistsToSubnet(context.TODO(), portal)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// A larger subnet than the storage network isn't within it
+	ok, err = routeExistsToSubnet(context.TODO(), &net.IPNet{IP: net.ParseIP("10.0.0.0").To4(),
+		Mask: net.CIDRMask(8, 32)})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// An on-link route always counts
+	assert.NoError(t, Init(Config{}))
+	routes = []netlink.Route{{Src: net.ParseIP("10.20.30.10")}}
+	ok, err = routeExistsToSubnet(context.TODO(), portal)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	routes, routeErr = nil, syscall.ENETUNREACH
+	ok, err = routeExistsToSubnet(context.TODO(), portal)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.Error(t, Init(Config{StorageCIDRs: []string{"10.20.0.0"}}))
+}
@@ -3,13 +3,29 @@
 package utils
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+
+	. "github.com/netapp/trident/logger"
+	"github.com/netapp/trident/utils/iscsi"
 )
 
 func TestParseIPv6Valid(t *testing.T) {
@@ -136,6 +152,14 @@ func TestSanitizeString(t *testing.T) {
 			input:  "\n\n",
 			output: "\n",
 		},
+		"Replace xterm title and cursor sequences": {
+			input:  "\x1B]0;title\x07Hello\x1B[?25lWorld",
+			output: "HelloWorld",
+		},
+		"Strip control characters": {
+			input:  "50%\r100%\x08\tdone\n",
+			output: "50%100%\tdone",
+		},
 	}
 	for testName, test := range tests {
 		t.Logf("Running test case '%s'", testName)
@@ -147,6 +171,28 @@ func TestSanitizeString(t *testing.T) {
 	}
 }
 
+func TestSanitizeCommandOutput(t *testing.T) {
+	log.Debug("Running TestSanitizeCommandOutput...")
+
+	defer func() { _ = Init(Config{}) }()
+
+	assert.Equal(t, "hello", sanitizeCommandOutput([]byte("hello\n")))
+	assert.Equal(t, "<4 bytes of binary output>", sanitizeCommandOutput([]byte{'a', 0, 'b', 'c'}))
+	assert.Equal(t, "<2 bytes of binary output>", sanitizeCommandOutput([]byte{0xff, 0xfe}))
+
+	head := strings.Repeat("h", commandOutputLogHead)
+	tail := strings.Repeat("t", commandOutputLogTail)
+	long := head + strings.Repeat("m", 1000) + tail
+	assert.Equal(t, head+"\n<1000 bytes omitted>\n"+tail, sanitizeCommandOutput([]byte(long)))
+
+	// Multi-byte characters aren't split
+	long = strings.Repeat("h", commandOutputLogHead-1) + "é" + strings.Repeat("m", 1000) + tail
+	assert.True(t, utf8.ValidString(sanitizeCommandOutput([]byte(long))))
+
+	assert.NoError(t, Init(Config{LogFullCommandOutput: true}))
+	assert.Equal(t, long, sanitizeCommandOutput([]byte(long)))
+}
+
 func TestPidRunningOrIdleRegex(t *testing.T) {
 	log.Debug("Running TestPidRegexes...")
 
@@ -312,6 +358,18 @@ func TestFormatPortal(t *testing.T) {
 			InputPortal:  "[2001:db8::1]:3261",
 			OutputPortal: "[2001:db8::1]:3261",
 		},
+		{
+			InputPortal:  "2001:db8::1",
+			OutputPortal: "[2001:db8::1]:3260",
+		},
+		{
+			InputPortal:  "iscsi.example.com",
+			OutputPortal: "iscsi.example.com:3260",
+		},
+		{
+			InputPortal:  "iscsi.example.com:3262",
+			OutputPortal: "iscsi.example.com:3262",
+		},
 	}
 	for _, testCase := range tests {
 		assert.Equal(t, testCase.OutputPortal, formatPortal(testCase.InputPortal),
@@ -319,6 +377,70 @@ func TestFormatPortal(t *testing.T) {
 	}
 }
 
+func TestPortalMatches(t *testing.T) {
+	log.Debug("Running TestPortalMatches...")
+
+	tests := []struct {
+		SessionPortal string
+		Portal        string
+		Match         bool
+	}{
+		{"10.0.0.1:3260,1028", "10.0.0.1", true},
+		{"10.0.0.1:3260,1028", "10.0.0.1:3260", true},
+		{"10.0.0.10:3260,1028", "10.0.0.1", false},
+		{"10.0.0.1:3260,1028", "10.0.0.10:3260", false},
+		{"10.0.0.1:3261,1028", "10.0.0.1:3260", false},
+		{"10.0.0.1:3261,1028", "10.0.0.1:3261", true},
+		{"[2001:db8::1]:3260,1038", "2001:db8::1", true},
+		{"[2001:db8::1]:3260,1038", "[2001:db8:0::1]:3260", true},
+		{"[2001:db8::10]:3260,1038", "[2001:db8::1]", false},
+		{"[2001:db8::1]:3260,1038", "[2001:db8::1]:3261", false},
+	}
+	for _, testCase := range tests {
+		assert.Equal(t, testCase.Match, portalMatches(testCase.SessionPortal, testCase.Portal),
+			"Unexpected match result for %s and %s", testCase.SessionPortal, testCase.Portal)
+	}
+}
+
+func TestCheckInitiatorIQN(t *testing.T) {
+	log.Debug("Running TestCheckInitiatorIQN...")
+
+	registry := map[string]string{
+		"iqn.1994-05.com.redhat:1a2b3c4d": "node1",
+		"iqn.1993-08.org.debian:01:5e6f":  "node2",
+	}
+
+	assert.NoError(t, CheckInitiatorIQN("", "node3", registry))
+	assert.NoError(t, CheckInitiatorIQN("iqn.1994-05.com.redhat:9f8e7d6c", "node3", registry))
+	assert.NoError(t, CheckInitiatorIQN("iqn.1994-05.com.redhat:1a2b3c4d", "node1", registry),
+		"A node re-registering with its own IQN is fine")
+
+	err := CheckInitiatorIQN("IQN.1994-05.com.redhat:1A2B3C4D", "node3", registry)
+	assert.True(t, IsDuplicateInitiatorError(err))
+	assert.Contains(t, err.Error(), "node1")
+
+	err = CheckInitiatorIQN("iqn.1993-08.org.debian:01:", "node3", nil)
+	assert.True(t, IsDuplicateInitiatorError(err))
+	assert.Contains(t, err.Error(), "default")
+}
+
+func TestGenerateInitiatorIQN(t *testing.T) {
+	log.Debug("Running TestGenerateInitiatorIQN...")
+
+	iqn, err := generateInitiatorIQN("iqn.1994-05.com.redhat:1a2b3c4d")
+	assert.NoError(t, err)
+	assert.Regexp(t, `^iqn\.1994-05\.com\.redhat:[0-9a-f]{12}$`, iqn)
+
+	other, err := generateInitiatorIQN("iqn.1994-05.com.redhat:1a2b3c4d")
+	assert.NoError(t, err)
+	assert.NotEqual(t, iqn, other)
+
+	// Names that aren't IQNs get the open-iscsi naming authority
+	iqn, err = generateInitiatorIQN("eui.0123456789abcdef")
+	assert.NoError(t, err)
+	assert.Regexp(t, `^iqn\.2005-03\.org\.open-iscsi:[0-9a-f]{12}$`, iqn)
+}
+
 func TestFilterTargets(t *testing.T) {
 	log.Debug("Running TestFilterTargets...")
 
@@ -402,3 +524,1777 @@ func TestFilterTargets(t *testing.T) {
 		assert.Equal(t, testCase.OutputIQNs, targets, "Wrong targets returned")
 	}
 }
+
+func TestReadFileWithTimeout(t *testing.T) {
+	log.Debug("Running TestReadFileWithTimeout...")
+
+	dir, err := ioutil.TempDir("", "TestReadFileWithTimeout")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "targetname")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("iqn.1992-08.com.netapp:foo\n"), 0600))
+
+	out, err := readFileWithTimeout(context.TODO(), filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "iqn.1992-08.com.netapp:foo\n", string(out))
+
+	_, err = readFileWithTimeout(context.TODO(), path.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err), "Expected not exist error")
+}
+
+func TestGetSessionAuthInfo(t *testing.T) {
+	log.Debug("Running TestGetSessionAuthInfo...")
+
+	dir, err := ioutil.TempDir("", "TestGetSessionAuthInfo")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	sessions := map[string]map[string]string{
+		"session1": {"targetname": "iqn.1992-08.com.netapp:foo", "username": "user", "username_in": "(null)"},
+		"session2": {"targetname": "iqn.1992-08.com.netapp:foo", "username": "(null)", "username_in": "(null)"},
+		"session3": {"targetname": "iqn.1992-08.com.netapp:bar", "username": "other", "username_in": "target"},
+	}
+	for session, attributes := range sessions {
+		sessionPath := path.Join(dir, "sys/class/iscsi_session", session)
+		assert.NoError(t, os.MkdirAll(sessionPath, 0755))
+		for name, value := range attributes {
+			assert.NoError(t, ioutil.WriteFile(path.Join(sessionPath, name), []byte(value+"\n"), 0600))
+		}
+	}
+
+	authInfo, err := GetSessionAuthInfo(context.TODO(), "iqn.1992-08.com.netapp:foo")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []ISCSISessionAuthInfo{
+		{SID: "1", UseCHAP: true, Username: "user"},
+		{SID: "2", UseCHAP: false},
+	}, authInfo)
+
+	authInfo, err = GetSessionAuthInfo(context.TODO(), "iqn.1992-08.com.netapp:bar")
+	assert.NoError(t, err)
+	assert.Equal(t, []ISCSISessionAuthInfo{
+		{SID: "3", UseCHAP: true, Username: "other", TargetUsername: "target"},
+	}, authInfo)
+}
+
+func TestSetMultipathPolicy(t *testing.T) {
+	log.Debug("Running TestSetMultipathPolicy...")
+
+	defer func() { multipathPolicy = MultipathPolicyDegraded }()
+
+	for _, policy := range []MultipathPolicy{MultipathPolicyFail, MultipathPolicyWait, MultipathPolicyDegraded} {
+		assert.NoError(t, SetMultipathPolicy(policy))
+		assert.Equal(t, policy, multipathPolicy)
+	}
+
+	assert.Error(t, SetMultipathPolicy("sometimes"))
+	assert.Equal(t, MultipathPolicyDegraded, multipathPolicy)
+}
+
+func TestSetISCSILoginPolicy(t *testing.T) {
+	log.Debug("Running TestSetISCSILoginPolicy...")
+
+	defaultPolicy := iscsiLoginPolicy
+	defer func() { iscsiLoginPolicy = defaultPolicy }()
+
+	policy := ISCSILoginPolicy{LoginTimeout: 5 * time.Second, MaxAttempts: 2, Quorum: 1}
+	assert.NoError(t, SetISCSILoginPolicy(policy))
+	assert.Equal(t, policy, iscsiLoginPolicy)
+
+	assert.Error(t, SetISCSILoginPolicy(ISCSILoginPolicy{LoginTimeout: 0, MaxAttempts: 2}))
+	assert.Error(t, SetISCSILoginPolicy(ISCSILoginPolicy{LoginTimeout: 5 * time.Second, MaxAttempts: 0}))
+	assert.Error(t, SetISCSILoginPolicy(ISCSILoginPolicy{LoginTimeout: 5 * time.Second, MaxAttempts: 2, Quorum: -1}))
+	assert.Equal(t, policy, iscsiLoginPolicy)
+}
+
+func TestLoginISCSIPortals(t *testing.T) {
+	log.Debug("Running TestLoginISCSIPortals...")
+
+	defaultPolicy := iscsiLoginPolicy
+	defer func() { iscsiLoginPolicy = defaultPolicy }()
+	iscsiLoginPolicy.MaxAttempts = 2
+
+	portals := []string{"203.0.113.1:3260", "203.0.113.2:3260", "203.0.113.3:3260"}
+	attempts := make(map[string]int)
+	login := func(portal string) error {
+		attempts[portal]++
+		switch portal {
+		case "203.0.113.2:3260":
+			// Succeeds on retry
+			if attempts[portal] < 2 {
+				return fmt.Errorf("login timed out")
+			}
+			return nil
+		case "203.0.113.3:3260":
+			return fmt.Errorf("no route to host")
+		}
+		return nil
+	}
+
+	assert.NoError(t, loginISCSIPortals(context.TODO(), portals, 2, login))
+	assert.Equal(t, map[string]int{"203.0.113.1:3260": 1, "203.0.113.2:3260": 2, "203.0.113.3:3260": 2}, attempts)
+
+	attempts = make(map[string]int)
+	assert.Error(t, loginISCSIPortals(context.TODO(), portals, 3, login))
+}
+
+func TestInit(t *testing.T) {
+	log.Debug("Running TestInit...")
+
+	defer func() { _ = Init(Config{}) }()
+
+	assert.NoError(t, Init(Config{DockerPluginMode: true}))
+	assert.Equal(t, "/host", chrootPathPrefix)
+
+	assert.NoError(t, Init(Config{DockerPluginMode: true, HostRoot: "/rootfs/"}))
+	assert.Equal(t, "/rootfs", chrootPathPrefix)
+
+	config := Config{
+		DeviceReadTimeout:             time.Second,
+		MultipathPolicy:               MultipathPolicyFail,
+		ISCSILoginPolicy:              ISCSILoginPolicy{LoginTimeout: 5 * time.Second, MaxAttempts: 1},
+		DisableNativeFilesystemResize: true,
+		DisableDeviceSizeCheck:        true,
+	}
+	assert.NoError(t, Init(config))
+	assert.Equal(t, "", chrootPathPrefix)
+	assert.Equal(t, time.Second, deviceReadTimeout)
+	assert.Equal(t, MultipathPolicyFail, multipathPolicy)
+	assert.Equal(t, config.ISCSILoginPolicy, iscsiLoginPolicy)
+	assert.True(t, disableNativeFilesystemResize)
+	assert.True(t, disableDeviceSizeCheck)
+
+	// Invalid settings leave the existing configuration untouched
+	assert.Error(t, Init(Config{MultipathPolicy: "sometimes"}))
+	assert.Error(t, Init(Config{DeviceReadTimeout: -time.Second}))
+	assert.Error(t, Init(Config{ISCSILoginPolicy: ISCSILoginPolicy{MaxAttempts: 1}}))
+	assert.Equal(t, MultipathPolicyFail, multipathPolicy)
+
+	assert.NoError(t, Init(Config{}))
+	assert.Equal(t, defaultDeviceReadTimeout, deviceReadTimeout)
+	assert.Equal(t, MultipathPolicyDegraded, multipathPolicy)
+	assert.Equal(t, defaultISCSILoginPolicy, iscsiLoginPolicy)
+	assert.False(t, disableNativeFilesystemResize)
+	assert.False(t, disableDeviceSizeCheck)
+	assert.Equal(t, FormatPolicy{ProgressInterval: defaultFormatProgressInterval}, formatPolicy)
+
+	assert.Error(t, Init(Config{FormatPolicy: FormatPolicy{Timeout: -time.Second}}))
+
+	assert.Equal(t, UUIDConflictPolicyNoUUID, uuidConflictPolicy)
+	assert.NoError(t, Init(Config{UUIDConflictPolicy: UUIDConflictPolicyRegenerate}))
+	assert.Equal(t, UUIDConflictPolicyRegenerate, uuidConflictPolicy)
+	assert.Error(t, Init(Config{UUIDConflictPolicy: "rename"}))
+
+	assert.NoError(t, Init(Config{}))
+	assert.Equal(t, MultiAttachPolicyVerify, multiAttachPolicy)
+	assert.NoError(t, Init(Config{MultiAttachPolicy: MultiAttachPolicySkip}))
+	assert.Equal(t, MultiAttachPolicySkip, multiAttachPolicy)
+	assert.Error(t, Init(Config{MultiAttachPolicy: "wipe"}))
+
+	assert.Error(t, Init(Config{ISCSIInterfaces: map[string]ISCSIInterface{"iface0": {NetInterface: "eth1"}}}))
+	assert.Error(t, Init(Config{ISCSIInterfaces: map[string]ISCSIInterface{"default": {Transport: "tcp"}}}))
+
+	assert.NoError(t, Init(Config{}))
+	assert.Equal(t, ISCSIScanPolicyManual, iscsiScanPolicy)
+	assert.Error(t, Init(Config{ISCSIScanPolicy: "sometimes"}))
+}
+
+func TestEffectiveISCSIScanPolicy(t *testing.T) {
+	log.Debug("Running TestEffectiveISCSIScanPolicy...")
+
+	defer func() { _ = Init(Config{}) }()
+
+	// Manual scanning falls back to automatic on old versions, which are checked for only once
+	recorder := &versionExecutor{version: "iscsiadm version 2.0-871"}
+	assert.NoError(t, Init(Config{Executor: recorder}))
+	assert.Equal(t, ISCSIScanPolicyAuto, effectiveISCSIScanPolicy(context.TODO()))
+	assert.Equal(t, ISCSIScanPolicyAuto, effectiveISCSIScanPolicy(context.TODO()))
+	assert.Equal(t, 1, len(recorder.commands))
+
+	recorder = &versionExecutor{version: "iscsiadm version 2.1.4"}
+	assert.NoError(t, Init(Config{Executor: recorder}))
+	assert.Equal(t, ISCSIScanPolicyManual, effectiveISCSIScanPolicy(context.TODO()))
+
+	recorder = &versionExecutor{version: "iscsiadm version 2.1.4"}
+	assert.NoError(t, Init(Config{Executor: recorder, ISCSIScanPolicy: ISCSIScanPolicyAuto}))
+	assert.Equal(t, ISCSIScanPolicyAuto, effectiveISCSIScanPolicy(context.TODO()))
+	assert.Empty(t, recorder.commands)
+}
+
+// versionExecutor reports an iscsiadm version
+type versionExecutor struct {
+	recordingExecutor
+	version string
+}
+
+func (e *versionExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	return []byte(e.version), nil
+}
+
+func TestLogSlowAttach(t *testing.T) {
+	log.Debug("Running TestLogSlowAttach...")
+
+	defer func() { _ = Init(Config{}) }()
+	assert.NoError(t, Init(Config{SlowAttachThreshold: time.Minute}))
+
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.Out = &buf
+	ctx := WithLogger(context.Background(), log.NewEntry(logger))
+
+	latency := &AttachLatency{Login: 5 * time.Second, Total: 10 * time.Second}
+	logSlowAttach(ctx, "fast", latency)
+	assert.Empty(t, buf.String(), "Fast attach should not be logged")
+
+	latency = &AttachLatency{Login: 50 * time.Second, MultipathWait: 20 * time.Second, Total: 70 * time.Second}
+	logSlowAttach(ctx, "slow", latency)
+	assert.Contains(t, buf.String(), "Slow iSCSI attach.")
+	assert.Contains(t, buf.String(), "login=50s")
+	assert.Contains(t, buf.String(), "multipathWait=20s")
+}
+
+func TestPopulateDeviceAttributes(t *testing.T) {
+	log.Debug("Running TestPopulateDeviceAttributes...")
+
+	dir, err := ioutil.TempDir("", "TestPopulateDeviceAttributes")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	// A multipath device atop two SCSI disks, one of which is offline
+	attributes := map[string]string{
+		"dm-0/size":                "2097152\n",
+		"dm-0/queue/read_ahead_kb": "4096\n",
+		"dm-0/queue/scheduler":     "none\n",
+		"sdb/size":                 "2097152\n",
+		"sdb/queue/scheduler":      "mq-deadline kyber [bfq] none\n",
+		"sdb/device/vendor":        "NETAPP  \n",
+		"sdb/device/model":         "LUN C-Mode      \n",
+		"sdb/device/wwid":          "naa.600a098038303053453f463045727a6d\n",
+		"sdb/device/queue_depth":   "64\n",
+		"sdb/device/state":         "running\n",
+		"sdc/device/state":         "offline\n",
+	}
+	for attribute, content := range attributes {
+		attributePath := path.Join(dir, "sys/block", attribute)
+		assert.NoError(t, os.MkdirAll(path.Dir(attributePath), 0755))
+		assert.NoError(t, ioutil.WriteFile(attributePath, []byte(content), 0600))
+	}
+
+	info := &ScsiDeviceInfo{MultipathDevice: "dm-0", Devices: []string{"sdb", "sdc"}}
+	populateDeviceAttributes(context.TODO(), info)
+	assert.Equal(t, int64(1073741824), info.Size)
+	assert.Equal(t, 4096, info.ReadAheadKB)
+	assert.Equal(t, "", info.Scheduler)
+	assert.Equal(t, "NETAPP", info.Vendor)
+	assert.Equal(t, "LUN C-Mode", info.Model)
+	assert.Equal(t, "naa.600a098038303053453f463045727a6d", info.WWID)
+	assert.Equal(t, 64, info.QueueDepth)
+	assert.Equal(t, map[string]string{"sdb": "running", "sdc": "offline"}, info.PathStates)
+
+	// Without a multipath device, the first path is described
+	info = &ScsiDeviceInfo{Devices: []string{"sdb"}}
+	populateDeviceAttributes(context.TODO(), info)
+	assert.Equal(t, int64(1073741824), info.Size)
+	assert.Equal(t, "bfq", info.Scheduler)
+	assert.Equal(t, 0, info.ReadAheadKB)
+}
+
+func TestGetDeviceStack(t *testing.T) {
+	log.Debug("Running TestGetDeviceStack...")
+
+	dir, err := ioutil.TempDir("", "TestGetDeviceStack")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	// A dm-crypt device atop a multipath device atop two SCSI disks
+	devices := map[string]struct {
+		uuid, name string
+		slaves     []string
+	}{
+		"dm-1": {"CRYPT-LUKS2-1234-luks-pvc", "luks-pvc", []string{"dm-0"}},
+		"dm-0": {"mpath-3600a0980", "3600a0980", []string{"sdb", "sdc"}},
+		"sdb":  {},
+		"sdc":  {},
+	}
+	for device, info := range devices {
+		sysPath := path.Join(dir, "sys/block", device)
+		assert.NoError(t, os.MkdirAll(path.Join(sysPath, "slaves"), 0755))
+		if info.uuid != "" {
+			assert.NoError(t, os.MkdirAll(path.Join(sysPath, "dm"), 0755))
+			assert.NoError(t, ioutil.WriteFile(path.Join(sysPath, "dm/uuid"), []byte(info.uuid+"\n"), 0600))
+			assert.NoError(t, ioutil.WriteFile(path.Join(sysPath, "dm/name"), []byte(info.name+"\n"), 0600))
+		}
+		for _, slave := range info.slaves {
+			assert.NoError(t, os.MkdirAll(path.Join(sysPath, "slaves", slave), 0755))
+		}
+	}
+
+	stack, err := getDeviceStack(context.TODO(), "dm-1")
+	assert.NoError(t, err)
+	assert.Equal(t, deviceLayerCrypt, stack.Type)
+	assert.Equal(t, "luks-pvc", stack.DMName)
+
+	var order []string
+	var types []string
+	for _, layer := range stack.orderForResize() {
+		order = append(order, layer.Name)
+		types = append(types, layer.Type)
+	}
+	assert.Equal(t, []string{"sdb", "sdc", "dm-0", "dm-1"}, order)
+	assert.Equal(t, []string{deviceLayerDisk, deviceLayerDisk, deviceLayerMultipath, deviceLayerCrypt}, types)
+
+	_, err = getDeviceStack(context.TODO(), "dm-9")
+	assert.Error(t, err)
+}
+
+func TestDeviceInUseChecks(t *testing.T) {
+	log.Debug("Running TestDeviceInUseChecks...")
+
+	dir, err := ioutil.TempDir("", "TestDeviceInUseChecks")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block/sdb/holders/dm-0"), 0755))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block/sdc/holders"), 0755))
+
+	holders, err := getDeviceHolders(context.TODO(), "sdb")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dm-0"}, holders)
+
+	holders, err = getDeviceHolders(context.TODO(), "sdc")
+	assert.NoError(t, err)
+	assert.Empty(t, holders)
+
+	holders, err = getDeviceHolders(context.TODO(), "sdd")
+	assert.NoError(t, err)
+	assert.Empty(t, holders)
+
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "proc/100/fd"), 0755))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "proc/200/fd"), 0755))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "proc/300/fd"), 0755))
+	assert.NoError(t, os.Symlink("300", path.Join(dir, "proc/self")))
+	assert.NoError(t, os.Symlink("/dev/sdb", path.Join(dir, "proc/100/fd/3")))
+	assert.NoError(t, os.Symlink("/dev/sdb", path.Join(dir, "proc/300/fd/3")))
+	assert.NoError(t, os.Symlink("/dev/null", path.Join(dir, "proc/200/fd/0")))
+
+	pids, err := getProcessesUsingDevice(context.TODO(), "/dev/sdb")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"100"}, pids)
+
+	pids, err = getProcessesUsingDevice(context.TODO(), "/dev/sdc")
+	assert.NoError(t, err)
+	assert.Empty(t, pids)
+}
+
+func TestGetMkfsCommand(t *testing.T) {
+	log.Debug("Running TestGetMkfsCommand...")
+
+	tests := []struct {
+		FsType  string
+		Size    int64
+		Policy  FormatPolicy
+		Command string
+		Args    []string
+	}{
+		{"xfs", 0, FormatPolicy{}, "mkfs.xfs", []string{"-f", "/dev/sdb"}},
+		{"xfs", 0, FormatPolicy{LazyInit: true, NoDiscard: true}, "mkfs.xfs", []string{"-f", "-K", "/dev/sdb"}},
+		{"xfs", 100 * tib, FormatPolicy{}, "mkfs.xfs", []string{"-f", "/dev/sdb"}},
+		{"ext3", 0, FormatPolicy{}, "mkfs.ext3", []string{"-F", "/dev/sdb"}},
+		{"ext4", 0, FormatPolicy{NoDiscard: true}, "mkfs.ext4", []string{"-F", "-E", "nodiscard", "/dev/sdb"}},
+		{"ext4", 0, FormatPolicy{LazyInit: true, NoDiscard: true}, "mkfs.ext4",
+			[]string{"-F", "-E", "lazy_itable_init=1,lazy_journal_init=1,nodiscard", "/dev/sdb"}},
+		{"ext4", 16 * tib, FormatPolicy{}, "mkfs.ext4", []string{"-F", "/dev/sdb"}},
+		{"ext4", 20 * tib, FormatPolicy{NoDiscard: true}, "mkfs.ext4",
+			[]string{"-F", "-E", "nodiscard", "-O", "64bit", "/dev/sdb"}},
+		{"ext4", 300 * tib, FormatPolicy{}, "mkfs.ext4",
+			[]string{"-F", "-O", "64bit,bigalloc", "-C", "65536", "/dev/sdb"}},
+	}
+	for _, testCase := range tests {
+		command, args, err := getMkfsCommand(testCase.FsType, "/dev/sdb", testCase.Size, testCase.Policy)
+		assert.NoError(t, err)
+		assert.Equal(t, testCase.Command, command)
+		assert.Equal(t, testCase.Args, args)
+	}
+
+	_, _, err := getMkfsCommand("btrfs", "/dev/sdb", 0, FormatPolicy{})
+	assert.Error(t, err)
+}
+
+func TestExecCommandWithProgress(t *testing.T) {
+	log.Debug("Running TestExecCommandWithProgress...")
+
+	out, err := execCommandWithProgress(context.TODO(), "echo", 0, 10*time.Millisecond, "formatted")
+	assert.NoError(t, err)
+	assert.Equal(t, "formatted\n", string(out))
+
+	_, err = execCommandWithProgress(context.TODO(), "sleep", 100*time.Millisecond, 10*time.Millisecond, "5")
+	assert.True(t, IsTimeoutError(err), "Expected timeout error, got %v", err)
+}
+
+func TestMergeMountOptions(t *testing.T) {
+	log.Debug("Running TestMergeMountOptions...")
+
+	// The node's default mount options are configured through Init
+	defer func() { _ = Init(Config{}) }()
+	assert.NoError(t, Init(Config{DefaultMountOptions: map[string]string{"xfs": "noatime,discard"}}))
+	assert.Equal(t, "noatime,discard,ro", MergeMountOptions("xfs", "", "ro"))
+	assert.Equal(t, "ro", MergeMountOptions("ext4", "ro"))
+}
+
+func TestFilterMountedISCSIDevices(t *testing.T) {
+	log.Debug("Running TestFilterMountedISCSIDevices...")
+
+	multipathDevice := &ScsiDeviceInfo{LUN: "0", MultipathDevice: "dm-0", Devices: []string{"sda", "sdb"}}
+	singleDevice := &ScsiDeviceInfo{LUN: "1", Devices: []string{"sdc"}}
+	unmountedDevice := &ScsiDeviceInfo{LUN: "2", Devices: []string{"sdd"}}
+	iscsiDevices := []*ScsiDeviceInfo{multipathDevice, singleDevice, unmountedDevice}
+
+	// Devices may be mounted more than once and by either their multipath or slave names
+	mounted := filterMountedISCSIDevices([]string{"dm-0", "sdc", "sda", "sde"}, iscsiDevices)
+	assert.Equal(t, []*ScsiDeviceInfo{multipathDevice, singleDevice}, mounted)
+
+	assert.Empty(t, filterMountedISCSIDevices([]string{}, iscsiDevices))
+}
+
+func TestGetISCSITargets(t *testing.T) {
+	log.Debug("Running TestGetISCSITargets...")
+
+	publishInfo := &VolumePublishInfo{}
+	publishInfo.IscsiTargetIQN = "iqn.1992-08.com.netapp:sn.primary"
+	publishInfo.IscsiTargetPortal = "10.0.0.1"
+	publishInfo.IscsiPortals = []string{"10.0.0.2"}
+	publishInfo.IscsiLunNumber = 3
+
+	targets := getISCSITargets(publishInfo)
+	assert.Equal(t, []IscsiTarget{{
+		IQN:       "iqn.1992-08.com.netapp:sn.primary",
+		Portals:   []string{"10.0.0.1", "10.0.0.2"},
+		LunNumber: 3,
+	}}, targets)
+
+	failover := IscsiTarget{IQN: "iqn.1992-08.com.netapp:sn.failover", Portals: []string{"10.0.1.1"}, LunNumber: 5}
+	publishInfo.IscsiAdditionalTargets = []IscsiTarget{
+		failover,
+		{IQN: "iqn.1992-08.com.netapp:sn.primary", Portals: []string{"10.0.0.3"}},
+		{IQN: "iqn.1992-08.com.netapp:sn.noportals"},
+		failover,
+	}
+
+	targets = getISCSITargets(publishInfo)
+	assert.Len(t, targets, 2)
+	assert.Equal(t, "iqn.1992-08.com.netapp:sn.primary", targets[0].IQN)
+	assert.Equal(t, failover, targets[1])
+}
+
+func TestVerifyISCSITargetsShareMultipathDevice(t *testing.T) {
+	log.Debug("Running TestVerifyISCSITargetsShareMultipathDevice...")
+
+	ctx := context.Background()
+	deviceInfo := &ScsiDeviceInfo{Devices: []string{"sda"}}
+
+	assert.NoError(t, verifyISCSITargetsShareMultipathDevice(ctx, deviceInfo, nil))
+
+	// Paths through several targets can only be combined by multipath
+	err := verifyISCSITargetsShareMultipathDevice(ctx, deviceInfo, []IscsiTarget{{IQN: "iqn.failover"}})
+	assert.Error(t, err)
+}
+
+func TestMigrateISCSITargetValidation(t *testing.T) {
+	log.Debug("Running TestMigrateISCSITargetValidation...")
+
+	ctx := context.Background()
+	publishInfo := &VolumePublishInfo{}
+	publishInfo.IscsiTargetIQN = "iqn.1992-08.com.netapp:sn.source"
+	publishInfo.IscsiTargetPortal = "10.0.0.1"
+
+	tests := []IscsiTarget{
+		{Portals: []string{"10.0.1.1"}},
+		{IQN: "iqn.1992-08.com.netapp:sn.destination"},
+		{IQN: "iqn.1992-08.com.netapp:sn.source", Portals: []string{"10.0.1.1"}},
+	}
+	for _, destination := range tests {
+		assert.Error(t, MigrateISCSITarget(ctx, publishInfo, destination), "Expected error for %v", destination)
+		assert.Equal(t, "iqn.1992-08.com.netapp:sn.source", publishInfo.IscsiTargetIQN)
+	}
+}
+
+func TestGetMultipathDevicePath(t *testing.T) {
+	log.Debug("Running TestGetMultipathDevicePath...")
+
+	dir, err := ioutil.TempDir("", "TestGetMultipathDevicePath")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	// dm-0 is named by its alias and dm-1 by its WWID; dm-2 has no mapper entry and dm-3 has no sysfs entry
+	for device, name := range map[string]string{"dm-0": "mpatha", "dm-1": "3600a0980", "dm-2": "mpathc"} {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block", device, "dm"), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/block", device, "dm/name"), []byte(name+"\n"), 0600))
+	}
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "dev/mapper"), 0755))
+	for _, name := range []string{"mpatha", "3600a0980"} {
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "dev/mapper", name), nil, 0600))
+	}
+
+	ctx := context.TODO()
+	assert.Equal(t, "/dev/mapper/mpatha", getMultipathDevicePath(ctx, "dm-0"))
+	assert.Equal(t, "/dev/mapper/3600a0980", getMultipathDevicePath(ctx, "dm-1"))
+	assert.Equal(t, "/dev/dm-2", getMultipathDevicePath(ctx, "dm-2"))
+	assert.Equal(t, "/dev/dm-3", getMultipathDevicePath(ctx, "dm-3"))
+}
+
+func TestDeviceSupportsDiscard(t *testing.T) {
+	log.Debug("Running TestDeviceSupportsDiscard...")
+
+	dir, err := ioutil.TempDir("", "TestDeviceSupportsDiscard")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	limits := map[string][2]string{
+		"dm-0": {"4096", "4294966784"},
+		"sdb":  {"0", "0"},
+		"sdc":  {"4096", "0"},
+		"sdd":  {"invalid", "4294966784"},
+	}
+	for device, limit := range limits {
+		queuePath := path.Join(dir, "sys/block", device, "queue")
+		assert.NoError(t, os.MkdirAll(queuePath, 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(queuePath, "discard_granularity"), []byte(limit[0]+"\n"), 0600))
+		assert.NoError(t, ioutil.WriteFile(path.Join(queuePath, "discard_max_bytes"), []byte(limit[1]+"\n"), 0600))
+	}
+
+	ctx := context.TODO()
+	assert.True(t, deviceSupportsDiscard(ctx, "dm-0"))
+	assert.False(t, deviceSupportsDiscard(ctx, "sdb"))
+	assert.False(t, deviceSupportsDiscard(ctx, "sdc"))
+	assert.False(t, deviceSupportsDiscard(ctx, "sdd"))
+	assert.False(t, deviceSupportsDiscard(ctx, "sde"))
+}
+
+func TestCheckAttachLimits(t *testing.T) {
+	log.Debug("Running TestCheckAttachLimits...")
+
+	ctx := context.TODO()
+	usage := NodeAttachUsage{Sessions: 8, LUNs: 9, DMDevices: 9}
+
+	assert.NoError(t, checkAttachLimits(ctx, AttachLimits{}, usage, 4))
+	assert.NoError(t, checkAttachLimits(ctx, AttachLimits{MaxSessions: 12, MaxLUNs: 10, MaxDMDevices: 10}, usage, 4))
+
+	tests := []struct {
+		Limits      AttachLimits
+		NewSessions int
+	}{
+		{AttachLimits{MaxLUNs: 9}, 0},
+		{AttachLimits{MaxDMDevices: 9}, 0},
+		{AttachLimits{MaxSessions: 12}, 5},
+	}
+	for _, testCase := range tests {
+		err := checkAttachLimits(ctx, testCase.Limits, usage, testCase.NewSessions)
+		assert.True(t, IsNodeSaturatedError(err), "Expected node saturated error for %+v", testCase.Limits)
+	}
+}
+
+func TestDropFailedPaths(t *testing.T) {
+	log.Debug("Running TestDropFailedPaths...")
+
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{Executor: recorder}))
+	defer func() { _ = Init(Config{}) }()
+	ctx := context.TODO()
+	failed := []failedPath{{"sdb", errors.New("sdb failed")}, {"sdc", errors.New("sdc failed")}}
+
+	// If every path fails, none is dropped, so the multipath device keeps its last path
+	dropped, err := dropFailedPaths(ctx, "dm-0", failed, nil)
+	assert.EqualError(t, err, "sdb failed")
+	assert.Empty(t, dropped)
+	assert.Empty(t, recorder.commands)
+
+	// Nor is a path of a LUN without a multipath device
+	dropped, err = dropFailedPaths(ctx, "", failed[:1], []string{"sdd"})
+	assert.Error(t, err)
+	assert.Empty(t, dropped)
+	assert.Empty(t, recorder.commands)
+
+	// Failed paths are dropped only once every path is known and a healthy one remains
+	dropped, err = dropFailedPaths(ctx, "dm-0", failed, []string{"sdd"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sdb", "sdc"}, dropped)
+	assert.Equal(t, []string{"multipathd del path sdb", "multipathd del path sdc"}, recorder.commands)
+
+	dropped, err = dropFailedPaths(ctx, "dm-0", nil, []string{"sdd"})
+	assert.NoError(t, err)
+	assert.Empty(t, dropped)
+}
+
+func TestGetNodeAttachUsage(t *testing.T) {
+	log.Debug("Running TestGetNodeAttachUsage...")
+
+	dir, err := ioutil.TempDir("", "TestGetNodeAttachUsage")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir, AttachLimits: AttachLimits{MaxLUNs: 10}}))
+	defer func() { _ = Init(Config{}) }()
+	assert.Equal(t, AttachLimits{MaxLUNs: 10}, GetAttachLimits())
+
+	for _, dirname := range []string{"sda/device", "vda/device", "dm-0/dm", "dm-1/dm"} {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block", dirname), 0755))
+	}
+
+	usage, err := GetNodeAttachUsage(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, NodeAttachUsage{DMDevices: 2}, usage)
+
+	assert.Error(t, Init(Config{AttachLimits: AttachLimits{MaxSessions: -1}}))
+}
+
+func TestEvaluateISCSISessionHealth(t *testing.T) {
+	log.Debug("Running TestEvaluateISCSISessionHealth...")
+
+	healthy := ISCSISessionHealth{SID: "1", State: "LOGGED_IN", ConnectionState: "up", TimeoutErrors: 3}
+
+	assert.True(t, evaluateISCSISessionHealth(healthy, ISCSISessionHealth{}, false).Healthy)
+	assert.True(t, evaluateISCSISessionHealth(healthy, healthy, true).Healthy)
+
+	// Old kernels don't report connection state
+	noConnectionState := healthy
+	noConnectionState.ConnectionState = ""
+	assert.True(t, evaluateISCSISessionHealth(noConnectionState, ISCSISessionHealth{}, false).Healthy)
+
+	failed := healthy
+	failed.State = "FAILED"
+	result := evaluateISCSISessionHealth(failed, ISCSISessionHealth{}, false)
+	assert.False(t, result.Healthy)
+	assert.Contains(t, result.Reason, "FAILED")
+
+	connectionDown := healthy
+	connectionDown.ConnectionState = "down"
+	assert.False(t, evaluateISCSISessionHealth(connectionDown, ISCSISessionHealth{}, false).Healthy)
+
+	newErrors := healthy
+	newErrors.TimeoutErrors = 5
+	result = evaluateISCSISessionHealth(newErrors, healthy, true)
+	assert.False(t, result.Healthy)
+	assert.Equal(t, "2 new timeout errors", result.Reason)
+
+	// Connection failures are counted when a connection is newly found down, and carried forward
+	result = evaluateISCSISessionHealth(connectionDown, healthy, true)
+	assert.Equal(t, uint64(1), result.ConnectionFailures)
+	result = evaluateISCSISessionHealth(connectionDown, result, true)
+	assert.Equal(t, uint64(1), result.ConnectionFailures)
+	result = evaluateISCSISessionHealth(healthy, result, true)
+	assert.Equal(t, uint64(1), result.ConnectionFailures)
+	result = evaluateISCSISessionHealth(failed, result, true)
+	assert.Equal(t, uint64(2), result.ConnectionFailures)
+}
+
+func TestGetISCSISessionStates(t *testing.T) {
+	log.Debug("Running TestGetISCSISessionStates...")
+
+	dir, err := ioutil.TempDir("", "TestGetISCSISessionStates")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	sessions, err := getISCSISessionStates(context.TODO())
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+
+	sessionPath := path.Join(dir, "sys/class/iscsi_session/session4")
+	connectionPath := path.Join(dir, "sys/class/iscsi_connection/connection4:0")
+	assert.NoError(t, os.MkdirAll(sessionPath, 0755))
+	assert.NoError(t, os.MkdirAll(connectionPath, 0755))
+	attributes := map[string]string{
+		path.Join(sessionPath, "targetname"):            "iqn.1992-08.com.netapp:sn.1",
+		path.Join(sessionPath, "state"):                 "LOGGED_IN",
+		path.Join(connectionPath, "state"):              "up",
+		path.Join(connectionPath, "persistent_address"): "10.0.0.1",
+		path.Join(connectionPath, "persistent_port"):    "3260",
+	}
+	for file, value := range attributes {
+		assert.NoError(t, ioutil.WriteFile(file, []byte(value+"\n"), 0600))
+	}
+
+	sessions, err = getISCSISessionStates(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, []ISCSISessionHealth{{
+		SID:             "4",
+		TargetIQN:       "iqn.1992-08.com.netapp:sn.1",
+		Portal:          "10.0.0.1:3260",
+		State:           "LOGGED_IN",
+		ConnectionState: "up",
+	}}, sessions)
+}
+
+func TestGetISCSISessionHealth(t *testing.T) {
+	log.Debug("Running TestGetISCSISessionHealth...")
+
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{Executor: recorder, SessionMonitorInterval: time.Hour}))
+	defer func() { _ = Init(Config{}) }()
+
+	// Without the monitor nothing is reported, and nothing is run to find out
+	sessions, monitored := GetISCSISessionHealth()
+	assert.False(t, monitored)
+	assert.Empty(t, sessions)
+
+	// With it, its last results are reported as they are
+	StartISCSISessionMonitor(context.TODO(), nil)
+	defer StopISCSISessionMonitor()
+	sessionMonitor.lock.Lock()
+	sessionMonitor.health = map[string]ISCSISessionHealth{"5": {SID: "5"}, "4": {SID: "4", Healthy: true}}
+	sessionMonitor.lock.Unlock()
+	defer func() { sessionMonitor.health = make(map[string]ISCSISessionHealth) }()
+
+	sessions, monitored = GetISCSISessionHealth()
+	assert.True(t, monitored)
+	assert.Equal(t, []ISCSISessionHealth{{SID: "4", Healthy: true}, {SID: "5"}}, sessions)
+	assert.Empty(t, recorder.commands)
+}
+
+func TestExecCommandWithTimeoutAndEnv(t *testing.T) {
+	log.Debug("Running TestExecCommandWithTimeoutAndEnv...")
+
+	out, err := execCommandWithTimeoutAndEnv(context.TODO(), "sh", 5, true,
+		[]string{"TRIDENT_TEST_VALUE=bus"}, "-c", "echo $TRIDENT_TEST_VALUE")
+	assert.NoError(t, err)
+	assert.Equal(t, "bus\n", string(out))
+}
+
+func TestOSExecutor(t *testing.T) {
+	log.Debug("Running TestOSExecutor...")
+
+	ctx := context.TODO()
+
+	out, err := execCommandWithInput(ctx, "cat", []byte("secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", string(out))
+
+	out, err = osExecutor{}.Execute(ctx, Command{
+		Name:     "sh",
+		Args:     []string{"-c", "echo ${HOME:-none} $TRIDENT_TEST_VALUE"},
+		Env:      []string{"TRIDENT_TEST_VALUE=clear"},
+		ClearEnv: true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "none clear\n", string(out))
+
+	dir, err := ioutil.TempDir("", "TestOSExecutor")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	assert.NoError(t, err)
+
+	out, err = osExecutor{}.Execute(ctx, Command{Name: "pwd", Dir: dir})
+	assert.NoError(t, err)
+	assert.Equal(t, dir+"\n", string(out))
+
+	assert.Nil(t, Command{Name: "ls"}.nsenterArgs())
+	assert.Equal(t, []string{"--mount=/proc/1/ns/mnt", "--net=/proc/1/ns/net"},
+		Command{MountNamespace: "/proc/1/ns/mnt", NetworkNamespace: "/proc/1/ns/net"}.nsenterArgs())
+}
+
+func TestRecoverHostServiceDisabled(t *testing.T) {
+	log.Debug("Running TestRecoverHostServiceDisabled...")
+
+	assert.NoError(t, Init(Config{}))
+	assert.False(t, recoverHostService(context.TODO(), "iscsid"))
+}
+
+func TestNFSMountNeedsStatd(t *testing.T) {
+	log.Debug("Running TestNFSMountNeedsStatd...")
+
+	tests := map[string]bool{
+		"":                           false,
+		"vers=4.1":                   false,
+		"nfsvers=3":                  true,
+		"-o vers=3,hard":             true,
+		"vers=3,nolock":              false,
+		"nfsvers=3.0,local_lock=all": false,
+		"hard,lock":                  false,
+	}
+	for options, expected := range tests {
+		assert.Equal(t, expected, nfsMountNeedsStatd(options), "Unexpected result for %s", options)
+	}
+}
+
+func TestNFSTLSMode(t *testing.T) {
+	log.Debug("Running TestNFSTLSMode...")
+
+	tests := map[string]string{
+		"":                         "none",
+		"vers=4.2":                 "none",
+		"-o vers=4.2,xprtsec=tls":  "tls",
+		"xprtsec=mtls,vers=4.2":    "mtls",
+		"xprtsec=tls,xprtsec=none": "none",
+	}
+	for options, expected := range tests {
+		mode, err := nfsTLSMode(options)
+		assert.NoError(t, err, options)
+		assert.Equal(t, expected, mode, options)
+	}
+
+	_, err := nfsTLSMode("vers=4.2,xprtsec=ssl")
+	assert.Error(t, err)
+
+	// Mounts that don't ask for TLS don't depend on tlshd
+	assert.NoError(t, ensureNFSTLS(context.TODO(), "vers=4.1"))
+	assert.Error(t, ensureNFSTLS(context.TODO(), "xprtsec=ssl"))
+}
+
+func TestEnsureNFSLockingPolicies(t *testing.T) {
+	log.Debug("Running TestEnsureNFSLockingPolicies...")
+
+	defer func() { _ = Init(Config{}) }()
+	ctx := context.TODO()
+
+	// Options that don't need rpc.statd pass through regardless of policy
+	options, err := ensureNFSLocking(ctx, "vers=4.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "vers=4.1", options)
+
+	// By default rpc.statd isn't checked at all
+	options, err = ensureNFSLocking(ctx, "vers=3")
+	assert.NoError(t, err)
+	assert.Equal(t, "vers=3", options)
+
+	assert.Error(t, Init(Config{NFSLockPolicy: "invalid"}))
+	assert.NoError(t, Init(Config{NFSLockPolicy: NFSLockPolicyNoLock}))
+	if !statdIsRunning(ctx) {
+		options, err = ensureNFSLocking(ctx, "vers=3,lock")
+		assert.NoError(t, err)
+		assert.Equal(t, "vers=3,nolock", options)
+
+		assert.NoError(t, Init(Config{NFSLockPolicy: NFSLockPolicyRequire}))
+		_, err = ensureNFSLocking(ctx, "vers=3")
+		assert.Error(t, err)
+	}
+}
+
+func TestGetISCSIDeviceSnapshot(t *testing.T) {
+	log.Debug("Running TestGetISCSIDeviceSnapshot...")
+
+	dir, err := ioutil.TempDir("", "TestGetISCSIDeviceSnapshot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	sessionPath := path.Join(dir, "sys/class/iscsi_session/session3")
+	connectionPath := path.Join(dir, "sys/class/iscsi_connection/connection3:0")
+	assert.NoError(t, os.MkdirAll(sessionPath, 0755))
+	assert.NoError(t, os.MkdirAll(connectionPath, 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(sessionPath, "targetname"), []byte("iqn.x\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(path.Join(sessionPath, "state"), []byte("LOGGED_IN\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(path.Join(connectionPath, "persistent_address"), []byte("10.0.0.1\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(path.Join(connectionPath, "persistent_port"), []byte("3260\n"), 0600))
+
+	for _, dirname := range []string{"sys/block/sdb/device", "sys/block/sdc/device", "sys/block/dm-0/slaves/sdb",
+		"sys/block/dm-0/slaves/sdc", "sys/block/dm-0/dm"} {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, dirname), 0755))
+	}
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/block/dm-0/dm/name"), []byte("mpatha\n"), 0600))
+
+	lastISCSIDeviceSnapshot = nil
+	snapshot := getISCSIDeviceSnapshot(context.TODO())
+	assert.Equal(t, []string{"session3 10.0.0.1:3260 iqn.x LOGGED_IN"}, snapshot.sessions)
+	assert.Equal(t, []string{"sdb", "sdc"}, snapshot.scsiDevices)
+	assert.Equal(t, []string{"dm-0 (mpatha) [sdb,sdc]"}, snapshot.multipathDevices)
+
+	// A recent snapshot is reused rather than retaken
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block/sdd/device"), 0755))
+	assert.Same(t, snapshot, getISCSIDeviceSnapshot(context.TODO()))
+
+	snapshot.taken = snapshot.taken.Add(-iSCSIDeviceSnapshotMaxAge)
+	assert.Equal(t, []string{"sdb", "sdc", "sdd"}, getISCSIDeviceSnapshot(context.TODO()).scsiDevices)
+}
+
+func TestWalkISCSIDevices(t *testing.T) {
+	log.Debug("Running TestWalkISCSIDevices...")
+
+	dir, err := ioutil.TempDir("", "TestWalkISCSIDevices")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	// Three sessions to two targets, with one device per LUN
+	sessions := []struct {
+		name, iqn string
+		host      int
+		luns      map[int]string
+	}{
+		{"session1", "iqn.a", 2, map[int]string{0: "sdb", 1: "sdc"}},
+		{"session2", "iqn.b", 3, map[int]string{0: "sdd"}},
+		{"session10", "iqn.a", 4, map[int]string{5: "sde"}},
+	}
+	for _, session := range sessions {
+		sessionPath := path.Join(dir, "sys/class/iscsi_session", session.name)
+		targetPath := path.Join(sessionPath, "device", fmt.Sprintf("target%d:0:0", session.host))
+		assert.NoError(t, os.MkdirAll(targetPath, 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(sessionPath, "targetname"), []byte(session.iqn+"\n"), 0600))
+		for lun, device := range session.luns {
+			lunPath := path.Join(targetPath, fmt.Sprintf("%d:0:0:%d", session.host, lun))
+			assert.NoError(t, os.MkdirAll(path.Join(lunPath, "block", device), 0755))
+		}
+	}
+
+	names := func(devices []*ScsiDeviceInfo) []string {
+		result := make([]string, 0)
+		for _, device := range devices {
+			result = append(result, device.Devices...)
+		}
+		return result
+	}
+
+	devices, err := GetISCSIDevices(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sdb", "sdc", "sdd", "sde"}, names(devices))
+	assert.Equal(t, "iqn.a", devices[3].IQN)
+	assert.Equal(t, "5", devices[3].LUN)
+
+	devices, err = FindISCSIDevices(context.TODO(), ISCSIDeviceFilter{IQN: "iqn.a"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sdb", "sdc", "sde"}, names(devices))
+
+	devices, err = FindISCSIDevices(context.TODO(), ISCSIDeviceFilter{LUNs: &LUNRange{Min: 1, Max: 5}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sdc", "sde"}, names(devices))
+
+	// An error from the callback stops the walk
+	visits := 0
+	err = WalkISCSIDevices(context.TODO(), ISCSIDeviceFilter{}, func(*ScsiDeviceInfo) error {
+		visits++
+		return fmt.Errorf("stop")
+	})
+	assert.EqualError(t, err, "stop")
+	assert.Equal(t, 1, visits)
+}
+
+func TestGetMountpointsForDevices(t *testing.T) {
+	log.Debug("Running TestGetMountpointsForDevices...")
+
+	// A filesystem volume staged and published twice, and a raw block volume published from devtmpfs
+	procSelfMountinfo := []MountInfo{
+		{MountPoint: "/", MountSource: "overlay", FsType: "overlay", Root: "/"},
+		{MountPoint: "/staging/pvc-1", MountSource: "/dev/dm-0", FsType: "ext4", Root: "/"},
+		{MountPoint: "/publish/pvc-1/a", MountSource: "/dev/dm-0", FsType: "ext4", Root: "/"},
+		{MountPoint: "/publish/pvc-2", MountSource: "udev", FsType: "devtmpfs", Root: "/dm-1"},
+		{MountPoint: "/publish/pvc-3", MountSource: "udev", FsType: "devtmpfs", Root: "/dm-2"},
+		{MountPoint: "/publish/pvc-1/b", MountSource: "/dev/dm-0", FsType: "ext4", Root: "/"},
+		{MountPoint: "/publish/pvc-4", MountSource: "udev", FsType: "devtmpfs", Root: "/sdf"},
+	}
+
+	// Two of the target's LUNs, one multipathed, are among the devices mounted; dm-0 and dm-2 are on other targets
+	iscsiDevices := []*ScsiDeviceInfo{
+		{Devices: []string{"sdb", "sdc"}, MultipathDevice: "dm-1"},
+		{Devices: []string{"sdf"}},
+	}
+	assert.Equal(t, []string{"/publish/pvc-4", "/publish/pvc-2"},
+		getMountpointsForDevices(context.TODO(), procSelfMountinfo, iscsiDevices))
+
+	assert.Empty(t, getMountpointsForDevices(context.TODO(), procSelfMountinfo, nil))
+}
+
+func TestWaitForDeviceScanIfNeeded(t *testing.T) {
+	log.Debug("Running TestWaitForDeviceScanIfNeeded...")
+
+	defer func(allWait, anyWait time.Duration) {
+		allDevicesScanWait, anyDeviceScanWait = allWait, anyWait
+	}(allDevicesScanWait, anyDeviceScanWait)
+	allDevicesScanWait, anyDeviceScanWait = time.Millisecond, time.Millisecond
+	defer func() { _ = Init(Config{}) }()
+
+	const iqn = "iqn.1992-08.com.netapp:sn.test:vs.1"
+	const lunID = 1
+
+	// makeHost lays out sysfs for a target reached through two sessions, on hosts 3 and 4, with the LUN's
+	// devices present on the specified number of them
+	makeHost := func(t *testing.T, present int) string {
+		dir, err := ioutil.TempDir("", "TestWaitForDeviceScanIfNeeded")
+		assert.NoError(t, err)
+		assert.NoError(t, Init(Config{HostRoot: dir}))
+
+		for i, host := range []int{3, 4} {
+			session := fmt.Sprintf("session%d", i+1)
+			hostPath := path.Join(dir, "sys/class/iscsi_host", fmt.Sprintf("host%d", host))
+			sessionPath := path.Join(hostPath, "device", session, "iscsi_session", session)
+			assert.NoError(t, os.MkdirAll(sessionPath, 0755))
+			assert.NoError(t, ioutil.WriteFile(path.Join(sessionPath, "targetname"), []byte(iqn+"\n"), 0600))
+			assert.NoError(t, ioutil.WriteFile(path.Join(hostPath, "scan"), nil, 0600))
+			assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/class/scsi_host"), 0755))
+			assert.NoError(t, os.Symlink(hostPath, path.Join(dir, "sys/class/scsi_host", fmt.Sprintf("host%d", host))))
+			if i < present {
+				lunPath := path.Join(sessionPath, "device", fmt.Sprintf("target%d:0:0/%d:0:0:%d", host, host, lunID))
+				assert.NoError(t, os.MkdirAll(path.Join(lunPath, "block"), 0755))
+			}
+		}
+		return dir
+	}
+
+	scanned := func(t *testing.T, dir string) bool {
+		content, err := ioutil.ReadFile(path.Join(dir, "sys/class/iscsi_host/host3/scan"))
+		assert.NoError(t, err)
+		return string(content) != ""
+	}
+
+	tests := []struct {
+		name       string
+		present    int
+		shouldScan bool
+		scanned    bool
+		fails      bool
+	}{
+		{"present-scan", 2, true, false, false},
+		{"present-noscan", 2, false, false, false},
+		{"partial-scan", 1, true, true, false},
+		{"partial-noscan", 1, false, false, false},
+		{"absent-scan", 0, true, true, true},
+		{"absent-noscan", 0, false, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := makeHost(t, test.present)
+			defer os.RemoveAll(dir)
+
+			err := waitForDeviceScanIfNeeded(context.TODO(), lunID, iqn, test.shouldScan)
+			assert.Equal(t, test.fails, err != nil, "unexpected result %v", err)
+			assert.Equal(t, test.scanned, scanned(t, dir))
+		})
+	}
+}
+
+func TestAttachStageProgress(t *testing.T) {
+	log.Debug("Running TestAttachStageProgress...")
+
+	// Without a progress callback, a stage is just timed
+	stage := startAttachStage(context.TODO(), "mkfs")
+	assert.True(t, stage.end() >= 0)
+
+	var mutex sync.Mutex
+	calls := make(map[string]int)
+	ctx := WithAttachProgress(context.TODO(), 5*time.Millisecond, func(stage string, elapsed time.Duration) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls[stage]++
+	})
+
+	stage = startAttachStage(ctx, "mkfs")
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, stage.end() >= 50*time.Millisecond)
+
+	mutex.Lock()
+	count := calls["mkfs"]
+	mutex.Unlock()
+	assert.NotZero(t, count)
+
+	// No progress is reported once the stage has ended
+	time.Sleep(20 * time.Millisecond)
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, count, calls["mkfs"])
+}
+
+// recordingExecutor records the commands it is asked to run, and runs none of them.
+type recordingExecutor struct {
+	commands []string
+}
+
+func (e *recordingExecutor) Execute(_ context.Context, cmd Command) ([]byte, error) {
+	e.commands = append(e.commands, strings.Join(append([]string{cmd.Name}, cmd.Args...), " "))
+	return nil, nil
+}
+
+// staleNodeRecordExecutor simulates a target whose node record went stale: the record lists the target, but the
+// first login through it fails as iscsiadm does when the portal no longer leads to the target.
+type staleNodeRecordExecutor struct {
+	recordingExecutor
+	logins int
+}
+
+func (e *staleNodeRecordExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	args := strings.Join(cmd.Args, " ")
+	switch {
+	case args == "-m node" && e.logins == 0:
+		return []byte("10.0.0.1:3260,1 iqn.t\n"), nil
+	case args == "-m node":
+		return nil, exec.Command("sh", "-c", fmt.Sprintf("exit %d", iSCSIErrNoObjsFound)).Run()
+	case strings.Contains(args, "-D"):
+		return []byte("10.0.0.1:3260,1 iqn.t\n"), nil
+	case strings.HasSuffix(args, " -l -p 10.0.0.1:3260"):
+		e.logins++
+		if e.logins == 1 {
+			return nil, exec.Command("sh", "-c", fmt.Sprintf("exit %d", iSCSIErrFatalLogin)).Run()
+		}
+	case args == "-m session":
+		if e.logins > 1 {
+			return []byte("tcp: [3] 10.0.0.1:3260,1 iqn.t (non-flash)\n"), nil
+		}
+		return nil, exec.Command("sh", "-c", fmt.Sprintf("exit %d", iSCSIErrNoObjsFound)).Run()
+	}
+	return nil, nil
+}
+
+func TestEnsureISCSISessionRefreshesStaleNodeRecord(t *testing.T) {
+	log.Debug("Running TestEnsureISCSISessionRefreshesStaleNodeRecord...")
+
+	executor := &staleNodeRecordExecutor{}
+	assert.NoError(t, Init(Config{Executor: executor}))
+	defer func() { _ = Init(Config{}) }()
+
+	assert.NoError(t, ensureISCSISession(context.TODO(), "iqn.t", "default", "10.0.0.1"))
+	assert.Equal(t, 2, executor.logins)
+	assert.Contains(t, executor.commands, "iscsiadm -m node -T iqn.t -p 10.0.0.1:3260 -o delete")
+	assert.Contains(t, executor.commands, "iscsiadm -m discoverydb -t st -p 10.0.0.1:3260 -I default -D")
+
+	// Other login failures aren't retried
+	assert.False(t, isStaleISCSINodeRecordError(fmt.Errorf("login timed out")))
+	assert.False(t, isStaleISCSINodeRecordError(nil))
+}
+
+// ifaceExecutor simulates iscsiadm's interface records, which start out with none but the built-in ones
+type ifaceExecutor struct {
+	recordingExecutor
+	ifaces map[string]string
+}
+
+func (e *ifaceExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	if len(cmd.Args) < 4 || cmd.Args[1] != "iface" {
+		return nil, nil
+	}
+	name := cmd.Args[3]
+	switch {
+	case len(cmd.Args) == 4:
+		if record, ok := e.ifaces[name]; ok {
+			return []byte(record), nil
+		}
+		return []byte(fmt.Sprintf("iscsiadm: Could not read iface %s (6)\n", name)), fmt.Errorf("exit status 6")
+	case cmd.Args[5] == "new":
+		e.ifaces[name] = "# BEGIN RECORD\niface.iscsi_ifacename = " + name + "\niface.net_ifacename = <empty>\n"
+	case cmd.Args[5] == "update":
+		e.ifaces[name] += cmd.Args[7] + " = " + cmd.Args[9] + "\n"
+	}
+	return nil, nil
+}
+
+func TestEnsureISCSIInterface(t *testing.T) {
+	log.Debug("Running TestEnsureISCSIInterface...")
+
+	dir, err := ioutil.TempDir("", "TestEnsureISCSIInterface")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/class/iscsi_transport/tcp"), 0755))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/class/net/eth1"), 0755))
+
+	executor := &ifaceExecutor{ifaces: map[string]string{
+		"typo":    "",
+		"offload": "iface.transport_name = bnx2i\n",
+		"nonic":   "iface.transport_name = tcp\niface.net_ifacename = eth9\n",
+	}}
+	assert.NoError(t, Init(Config{
+		HostRoot: dir,
+		Executor: executor,
+		ISCSIInterfaces: map[string]ISCSIInterface{
+			"iface0":  {Transport: "tcp", NetInterface: "eth1"},
+			"offload": {Transport: "tcp"},
+		},
+	}))
+	defer func() { _ = Init(Config{}) }()
+
+	ctx := context.TODO()
+
+	// The built-in interface needs no checking
+	assert.NoError(t, ensureISCSIInterface(ctx, defaultISCSIInterface))
+	assert.Empty(t, executor.commands)
+
+	// A missing interface is created from its definition
+	assert.NoError(t, ensureISCSIInterface(ctx, "iface0"))
+	assert.Equal(t, []string{
+		"iscsiadm -m iface -I iface0",
+		"iscsiadm -m iface -I iface0 -o new",
+		"iscsiadm -m iface -I iface0 -o update -n iface.transport_name -v tcp",
+		"iscsiadm -m iface -I iface0 -o update -n iface.net_ifacename -v eth1",
+		"iscsiadm -m iface -I iface0",
+	}, executor.commands)
+
+	// Undefined interfaces aren't created, and interfaces must be bound to loaded transports and existing NICs
+	assert.Error(t, ensureISCSIInterface(ctx, "missing"))
+	assert.Error(t, ensureISCSIInterface(ctx, "typo"))
+	assert.Error(t, ensureISCSIInterface(ctx, "offload"))
+	assert.Error(t, ensureISCSIInterface(ctx, "nonic"))
+	_, exists := executor.ifaces["missing"]
+	assert.False(t, exists)
+}
+
+func TestPersistentReservationFencer(t *testing.T) {
+	log.Debug("Running TestPersistentReservationFencer...")
+
+	dir, err := ioutil.TempDir("", "TestPersistentReservationFencer")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	recorder := &recordingExecutor{}
+	fencer := PersistentReservationFencer{Key: 0xabc}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: recorder, FencingHook: fencer}))
+	defer func() { _ = Init(Config{}) }()
+
+	// The multipath device's node links to dm-2, which sysfs shows is a multipath device
+	mpathDevice := path.Join(dir, "dev/mapper/3600a0980")
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "dev/mapper"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "dev/dm-2"), nil, 0600))
+	assert.NoError(t, os.Symlink("../dm-2", mpathDevice))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block/dm-2/dm"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/block/dm-2/dm/uuid"), []byte("mpath-3600a0980\n"), 0600))
+
+	assert.NoError(t, fencer.Register(context.TODO(), "/dev/sdb", nil))
+	assert.NoError(t, fencer.Register(context.TODO(), mpathDevice, nil))
+	assert.Equal(t, []string{
+		"sg_persist --out --register-ignore --param-sark=0xabc /dev/sdb",
+		"sg_persist --out --reserve --param-rk=0xabc --prout-type=7 /dev/sdb",
+		"mpathpersist --out --register-ignore --param-sark=0xabc " + mpathDevice,
+		"mpathpersist --out --reserve --param-rk=0xabc --prout-type=7 " + mpathDevice,
+	}, recorder.commands)
+
+	// Only shared LUNs are released
+	recorder.commands = nil
+	publishInfo := &VolumePublishInfo{DevicePath: mpathDevice}
+	assert.NoError(t, ReleaseMultiAttachDevice(context.TODO(), publishInfo))
+	assert.Empty(t, recorder.commands)
+
+	publishInfo.MultiAttach = true
+	assert.NoError(t, ReleaseMultiAttachDevice(context.TODO(), publishInfo))
+	assert.Equal(t, []string{
+		"mpathpersist --out --register-ignore --param-sark=0 " + mpathDevice,
+	}, recorder.commands)
+
+	assert.Error(t, PersistentReservationFencer{}.Register(context.TODO(), "/dev/sdb", nil))
+}
+
+// fenceCommandExecutor records the environment of the commands it runs, and fails those named "false".
+type fenceCommandExecutor struct {
+	recordingExecutor
+	env []string
+}
+
+func (e *fenceCommandExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	e.env = cmd.Env
+	if cmd.Name == "false" {
+		return nil, errors.New("exit status 1")
+	}
+	return nil, nil
+}
+
+func TestFenceFailedDetach(t *testing.T) {
+	log.Debug("Running TestFenceFailedDetach...")
+
+	ctx := context.TODO()
+	failure := DetachFailure{
+		VolumeID:    "pvc-1",
+		Stage:       "removeDevice",
+		TargetIQN:   "iqn.1992-08.com.netapp:sn.1",
+		LUN:         3,
+		PublishInfo: &VolumePublishInfo{DevicePath: "/dev/dm-2"},
+		Err:         errors.New("flush timed out"),
+	}
+
+	// Without a fencer, failed stages are retried
+	assert.NoError(t, Init(Config{}))
+	assert.Equal(t, DetachFenceRetry, FenceFailedDetach(ctx, failure))
+
+	executor := &fenceCommandExecutor{}
+	assert.NoError(t, Init(Config{Executor: executor, DetachFencer: CommandDetachFencer{Command: "/usr/local/bin/fence"}}))
+	defer func() { _ = Init(Config{}) }()
+	assert.Equal(t, DetachFenceForce, FenceFailedDetach(ctx, failure))
+	assert.Equal(t, []string{"/usr/local/bin/fence"}, executor.commands)
+	assert.ElementsMatch(t, []string{
+		"TRIDENT_VOLUME_ID=pvc-1",
+		"TRIDENT_DETACH_STAGE=removeDevice",
+		"TRIDENT_TARGET_IQN=iqn.1992-08.com.netapp:sn.1",
+		"TRIDENT_LUN=3",
+		"TRIDENT_DEVICE_PATH=/dev/dm-2",
+		"TRIDENT_DETACH_ERROR=flush timed out",
+	}, executor.env)
+
+	// A failed fencing command leaves the stage to be retried
+	assert.NoError(t, Init(Config{Executor: executor, DetachFencer: CommandDetachFencer{Command: "false"}}))
+	assert.Equal(t, DetachFenceRetry, FenceFailedDetach(ctx, failure))
+
+	// Callbacks may decide for themselves, and unknown decisions are treated as retries
+	for decision, expected := range map[DetachFenceDecision]DetachFenceDecision{
+		DetachFenceForce: DetachFenceForce,
+		DetachFenceRetry: DetachFenceRetry,
+		"maybe":          DetachFenceRetry,
+	} {
+		decision := decision
+		assert.NoError(t, Init(Config{DetachFencer: DetachFencerFunc(
+			func(_ context.Context, f DetachFailure) (DetachFenceDecision, error) {
+				assert.Equal(t, failure.Stage, f.Stage)
+				return decision, nil
+			})}))
+		assert.Equal(t, expected, FenceFailedDetach(ctx, failure), string(decision))
+	}
+}
+
+// nodeStartupExecutor simulates an iSCSI node database with records for a tracked target, one of whose portals
+// starts automatically, and an untracked target that starts automatically.
+type nodeStartupExecutor struct {
+	recordingExecutor
+}
+
+func (e *nodeStartupExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	switch strings.Join(cmd.Args, " ") {
+	case "-m node":
+		return []byte("10.0.0.1:3260,1000 iqn.tracked\n10.0.0.2:3260,1001 iqn.tracked\n" +
+			"10.0.0.3:3260,1 iqn.stale\n"), nil
+	case "-m node -T iqn.tracked -p 10.0.0.1:3260":
+		return []byte("# BEGIN RECORD 2.0-874\nnode.name = iqn.tracked\nnode.startup = manual\n" +
+			"node.conn[0].startup = manual\n# END RECORD\n"), nil
+	case "-m node -T iqn.tracked -p 10.0.0.2:3260":
+		return []byte("node.name = iqn.tracked\nnode.startup = manual\nnode.conn[0].startup = automatic\n"), nil
+	case "-m node -T iqn.stale -p 10.0.0.3:3260":
+		return []byte("node.name = iqn.stale\nnode.startup = automatic\nnode.conn[0].startup = automatic\n"), nil
+	}
+	return nil, nil
+}
+
+func TestEnsureManualISCSIStartup(t *testing.T) {
+	log.Debug("Running TestEnsureManualISCSIStartup...")
+
+	executor := &nodeStartupExecutor{}
+	assert.NoError(t, Init(Config{Executor: executor}))
+	defer func() { _ = Init(Config{}) }()
+
+	repaired, err := EnsureManualISCSIStartup(context.TODO(), []string{"iqn.tracked"})
+	assert.NoError(t, err)
+	assert.Equal(t, []ISCSINodeRecord{{Portal: "10.0.0.2:3260", TPGT: "1001", TargetName: "iqn.tracked"}}, repaired)
+	assert.Equal(t, []string{
+		"iscsiadm -m node",
+		"iscsiadm -m node -T iqn.tracked -p 10.0.0.1:3260",
+		"iscsiadm -m node -T iqn.tracked -p 10.0.0.2:3260",
+		"iscsiadm -m node -T iqn.tracked -p 10.0.0.2:3260 -o update -n node.startup -v manual",
+		"iscsiadm -m node -T iqn.tracked -p 10.0.0.2:3260 -o update -n node.conn[0].startup -v manual",
+		"iscsiadm -m node -T iqn.stale -p 10.0.0.3:3260",
+	}, executor.commands)
+}
+
+func TestFilterReachablePortals(t *testing.T) {
+	log.Debug("Running TestFilterReachablePortals...")
+
+	defer func() { routeLookup = routeExistsToSubnet }()
+	defer func() { _ = Init(Config{}) }()
+
+	// Only 10.0.1.0/24 and fd00::/64 are routed; 10.0.3.1 can't be looked up
+	routeLookup = func(_ context.Context, subnet *net.IPNet) (bool, error) {
+		switch {
+		case subnet.IP.Equal(net.ParseIP("10.0.3.1")):
+			return false, fmt.Errorf("netlink error")
+		case strings.HasPrefix(subnet.IP.String(), "10.0.1."), strings.HasPrefix(subnet.IP.String(), "fd00::"):
+			return true, nil
+		default:
+			return false, nil
+		}
+	}
+
+	portals := []string{"10.0.1.1:3260", "10.0.2.1:3260", "10.0.3.1", "[fd00::1]:3260", "[fd01::1]:3260",
+		"filer.example.com:3260"}
+	assert.Equal(t, []string{"10.0.1.1:3260", "10.0.3.1", "[fd00::1]:3260", "filer.example.com:3260"},
+		filterReachablePortals(context.TODO(), portals))
+
+	// Rather than logging in through no portal, every portal is tried
+	unreachable := []string{"10.0.2.1:3260", "10.0.2.2:3260"}
+	assert.Equal(t, unreachable, filterReachablePortals(context.TODO(), unreachable))
+
+	assert.NoError(t, Init(Config{DisablePortalReachabilityCheck: true}))
+	assert.Equal(t, portals, filterReachablePortals(context.TODO(), portals))
+}
+
+func TestFilterReachableLinkLocalPortals(t *testing.T) {
+	log.Debug("Running TestFilterReachableLinkLocalPortals...")
+
+	defer func() { routeLookup = routeExistsToSubnet }()
+	defer func() { zoneLookup = iscsi.ZoneInterfaceUp }()
+
+	// Every link-local address is routed, but only through the interfaces that are up
+	routeLookup = func(context.Context, *net.IPNet) (bool, error) { return true, nil }
+	zoneLookup = func(zone string) (bool, error) {
+		switch zone {
+		case "ens192":
+			return true, nil
+		case "ens224":
+			return false, nil
+		default:
+			return false, fmt.Errorf("no such interface")
+		}
+	}
+
+	portals := []string{"[fe80::1%ens192]:3260", "[fe80::2%ens224]:3260", "[fe80::3%ens256]:3260",
+		"[fd00::1]:3260"}
+	assert.Equal(t, []string{"[fe80::1%ens192]:3260", "[fd00::1]:3260"},
+		filterReachablePortals(context.TODO(), portals))
+}
+
+// linkLocalDiscoveryExecutor answers discovery as a target with link-local portals, which it reports without zones.
+type linkLocalDiscoveryExecutor struct {
+	recordingExecutor
+}
+
+func (e *linkLocalDiscoveryExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	if len(cmd.Args) > 1 && cmd.Args[1] == "discovery" {
+		return []byte("[fe80::a0:98ff:fe00:1]:3260,1030 iqn.1992-08.com.netapp:sn.1:vs.3\n" +
+			"[fd00::1]:3260,1031 iqn.1992-08.com.netapp:sn.1:vs.3\n"), nil
+	}
+	return nil, nil
+}
+
+func TestISCSIDiscoveryLinkLocal(t *testing.T) {
+	log.Debug("Running TestISCSIDiscoveryLinkLocal...")
+
+	assert.NoError(t, Init(Config{Executor: &linkLocalDiscoveryExecutor{}}))
+	defer func() { _ = Init(Config{}) }()
+
+	// Link-local portals are reached through the interface they were discovered through
+	targets, err := iSCSIDiscovery(context.TODO(), "[fe80::a0:98ff:fe00:1%ens192]:3260")
+	assert.NoError(t, err)
+	assert.Equal(t, []ISCSIDiscoveryInfo{
+		{
+			Portal:     "[fe80::a0:98ff:fe00:1%ens192]:3260,1030",
+			PortalIP:   "[fe80::a0:98ff:fe00:1%ens192]",
+			TargetName: "iqn.1992-08.com.netapp:sn.1:vs.3",
+		},
+		{
+			Portal:     "[fd00::1]:3260,1031",
+			PortalIP:   "[fd00::1]",
+			TargetName: "iqn.1992-08.com.netapp:sn.1:vs.3",
+		},
+	}, targets)
+	assert.True(t, portalMatches(targets[0].Portal, "fe80::a0:98ff:fe00:1%ens192"))
+	assert.False(t, portalMatches(targets[0].Portal, "fe80::a0:98ff:fe00:1%ens224"))
+
+	// Sessions, as sysfs reports them, don't have zones but still match
+	assert.True(t, portalMatches("[fe80::a0:98ff:fe00:1]:3260,1030", "[fe80::a0:98ff:fe00:1%ens192]:3260"))
+}
+
+// busyMountExecutor simulates umount refusing to unmount a filesystem until the process using it is signaled.
+type busyMountExecutor struct {
+	recordingExecutor
+	busy bool
+}
+
+func (e *busyMountExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	if cmd.Name == "umount" && e.busy && cmd.Args[0] != "-l" {
+		return []byte("umount: /mnt/vol: target is busy.\n"), errors.New("exit status 32")
+	}
+	return nil, nil
+}
+
+func (e *busyMountExecutor) signal(pid int, signal syscall.Signal) error {
+	e.commands = append(e.commands, fmt.Sprintf("signal %d %d", signal, pid))
+	e.busy = false
+	return nil
+}
+
+func TestUmountBusy(t *testing.T) {
+	log.Debug("Running TestUmountBusy...")
+
+	dir, err := ioutil.TempDir("", "TestUmountBusy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The volume is mounted at /mnt/vol, and /mnt/volume is on another filesystem
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "proc/1"), 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "proc/1/mountinfo"), []byte(
+		"22 1 8:1 / / rw - ext4 /dev/sda1 rw\n"+
+			"40 22 253:3 / /mnt/vol rw - xfs /dev/dm-3 rw\n"), 0644))
+
+	// A shell whose working directory is on the mount, and a process with a file open on another filesystem
+	addProcess := func(pid, comm, link, target string) {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "proc", pid, "fd"), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "proc", pid, "comm"), []byte(comm+"\n"), 0644))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "proc", pid, "stat"),
+			[]byte(pid+" ("+comm+") S 1 "+pid+" 1 0 -1 4194560 0 0 0 0 0 0 0 0 20 0 1 0 9"+pid+" 0 0\n"), 0644))
+		assert.NoError(t, os.Symlink(target, path.Join(dir, "proc", pid, link)))
+	}
+	addProcess("100", "sh", "cwd", "/mnt/vol/data")
+	addProcess("200", "sleep", "fd/3", "/mnt/volume/file")
+
+	// Links are matched by the filesystem the file they name is on, which the kernel finds by following them
+	defer func() { fileDeviceID = getFileDeviceID }()
+	fileDeviceID = func(link string) (string, error) {
+		target, err := os.Readlink(link)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(target, "/mnt/vol/") {
+			return "253:3", nil
+		}
+		return "8:1", nil
+	}
+
+	ctx := context.TODO()
+	defer func() { _ = Init(Config{}) }()
+	defer func() { signalProcess = syscall.Kill }()
+
+	// By default, the processes keeping the mount busy are reported
+	executor := &busyMountExecutor{busy: true}
+	signalProcess = executor.signal
+	assert.NoError(t, Init(Config{DockerPluginMode: true, HostRoot: dir, Executor: executor}))
+	err = Umount(ctx, "/mnt/vol")
+	assert.True(t, IsMountBusyError(err))
+	assert.Contains(t, err.Error(), "100 (sh)")
+	assert.NotContains(t, err.Error(), "200")
+	assert.Equal(t, []string{"umount /mnt/vol"}, executor.commands)
+
+	// Processes may be terminated if their commands are allowed
+	executor = &busyMountExecutor{busy: true}
+	signalProcess = executor.signal
+	assert.NoError(t, Init(Config{DockerPluginMode: true, HostRoot: dir, Executor: executor,
+		UnmountPolicy: UnmountPolicy{TerminateCommands: []string{"sh"}, TerminateGracePeriod: time.Millisecond}}))
+	assert.NoError(t, Umount(ctx, "/mnt/vol"))
+	assert.Equal(t, []string{"umount /mnt/vol", "signal 15 100", "umount /mnt/vol"}, executor.commands)
+
+	// But not if the process has since exited and its ID been reused
+	executor = &busyMountExecutor{busy: true}
+	signalProcess = executor.signal
+	holders, err := getProcessesUsingMount(ctx, "/mnt/vol")
+	assert.NoError(t, err)
+	assert.Equal(t, []mountHolder{{PID: "100", Command: "sh", StartTime: "9100"}}, holders)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "proc/100/stat"),
+		[]byte("100 (sh) S 1 100 1 0 -1 4194560 0 0 0 0 0 0 0 0 20 0 1 0 9999 0 0\n"), 0644))
+	assert.Empty(t, terminateMountHolders(ctx, holders))
+	assert.Empty(t, executor.commands)
+
+	// Or the mount lazily unmounted
+	executor = &busyMountExecutor{busy: true}
+	assert.NoError(t, Init(Config{DockerPluginMode: true, HostRoot: dir, Executor: executor,
+		UnmountPolicy: UnmountPolicy{TerminateCommands: []string{"bash"}, Lazy: true}}))
+	assert.NoError(t, Umount(ctx, "/mnt/vol"))
+	assert.Equal(t, []string{"umount /mnt/vol", "umount -l /mnt/vol"}, executor.commands)
+
+	// Nothing holds a mountpoint with nothing mounted at it
+	holders, err = getProcessesUsingMount(ctx, "/mnt/volume")
+	assert.NoError(t, err)
+	assert.Empty(t, holders)
+
+	assert.Error(t, Init(Config{UnmountPolicy: UnmountPolicy{TerminateGracePeriod: -time.Second}}))
+}
+
+func TestRemoveMountPoint(t *testing.T) {
+	log.Debug("Running TestRemoveMountPoint...")
+
+	dir, err := ioutil.TempDir("", "TestRemoveMountPoint")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{Executor: recorder}))
+	defer func() { _ = Init(Config{}) }()
+
+	// Files left in the directory after unmounting may be the volume's, so it isn't removed
+	mountPoint := path.Join(dir, "mnt")
+	assert.NoError(t, os.MkdirAll(path.Join(mountPoint, "data"), 0755))
+	assert.Error(t, removeMountPoint(context.TODO(), mountPoint))
+	assert.DirExists(t, path.Join(mountPoint, "data"))
+
+	assert.NoError(t, os.Remove(path.Join(mountPoint, "data")))
+	assert.NoError(t, removeMountPoint(context.TODO(), mountPoint))
+	assert.NoDirExists(t, mountPoint)
+	assert.Equal(t, []string{"umount " + mountPoint, "umount " + mountPoint}, recorder.commands)
+}
+
+func TestValidateCHAPCredentials(t *testing.T) {
+	log.Debug("Running TestValidateCHAPCredentials...")
+
+	chap := func(username, secret, targetUsername, targetSecret string) *VolumePublishInfo {
+		info := &VolumePublishInfo{UseCHAP: true}
+		info.IscsiUsername, info.IscsiInitiatorSecret = username, secret
+		info.IscsiTargetUsername, info.IscsiTargetSecret = targetUsername, targetSecret
+		return info
+	}
+
+	tests := []struct {
+		PublishInfo *VolumePublishInfo
+		Valid       bool
+	}{
+		{&VolumePublishInfo{}, true},
+		{chap("user", "secret", "", ""), true},
+		{chap("user", "secret", "target", "targetsecret"), true},
+		{chap("", "secret", "", ""), false},
+		{chap("user", "", "", ""), false},
+		{chap("user", "secret", "target", ""), false},
+		{chap("user", "secret", "", "targetsecret"), false},
+	}
+	for _, testCase := range tests {
+		err := validateCHAPCredentials(testCase.PublishInfo)
+		assert.Equal(t, testCase.Valid, err == nil, "%+v", testCase.PublishInfo.IscsiAccessInfo)
+	}
+
+	// Secrets may be given by reference instead
+	info := chap("user", "", "", "")
+	info.IscsiInitiatorSecretRef = &SecretRef{File: "/etc/chap/secret"}
+	assert.NoError(t, validateCHAPCredentials(info))
+}
+
+func TestVerifyCHAPSessions(t *testing.T) {
+	log.Debug("Running TestVerifyCHAPSessions...")
+
+	dir, err := ioutil.TempDir("", "TestVerifyCHAPSessions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	writeSession := func(session, iqn, username, targetUsername string) {
+		sessionPath := path.Join(dir, "sys/class/iscsi_session", session)
+		assert.NoError(t, os.MkdirAll(sessionPath, 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(sessionPath, "targetname"), []byte(iqn+"\n"), 0644))
+		assert.NoError(t, ioutil.WriteFile(path.Join(sessionPath, "username"), []byte(username+"\n"), 0644))
+		assert.NoError(t, ioutil.WriteFile(path.Join(sessionPath, "username_in"), []byte(targetUsername+"\n"), 0644))
+	}
+
+	ctx := context.TODO()
+	writeSession("session1", "iqn.a", "user", "(null)")
+	writeSession("session2", "iqn.b", "(null)", "(null)")
+	assert.NoError(t, verifyCHAPSessions(ctx, "iqn.a", "user", ""))
+	assert.Error(t, verifyCHAPSessions(ctx, "iqn.a", "other", ""))
+	assert.Error(t, verifyCHAPSessions(ctx, "iqn.a", "user", "target"))
+	assert.Error(t, verifyCHAPSessions(ctx, "iqn.b", "user", ""))
+}
+
+func TestReadOnlyCloneMountOptions(t *testing.T) {
+	log.Debug("Running TestReadOnlyCloneMountOptions...")
+
+	tests := []struct {
+		Fstype   string
+		Options  string
+		Expected string
+	}{
+		{"xfs", "", "ro,nouuid,norecovery"},
+		{"xfs", "rw,noatime", "ro,noatime,nouuid,norecovery"},
+		{"ext4", "discard", "discard,ro,noload"},
+		{"ext3", "", "ro,noload"},
+		{"btrfs", "", "ro"},
+	}
+	for _, testCase := range tests {
+		options := MergeMountOptions("", testCase.Options, readOnlyCloneMountOptions(testCase.Fstype)...)
+		assert.Equal(t, testCase.Expected, options, testCase.Fstype)
+	}
+}
+
+// dumpe2fsExecutor answers dumpe2fs with the header of a filesystem that has the given features.
+type dumpe2fsExecutor struct {
+	recordingExecutor
+	features string
+}
+
+func (e *dumpe2fsExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	if cmd.Name == "dumpe2fs" {
+		return []byte("dumpe2fs 1.45.6 (20-Mar-2020)\nFilesystem volume name:   <none>\n" +
+			"Filesystem features:      has_journal ext_attr resize_inode dir_index filetype extent " +
+			e.features + " flex_bg sparse_super\nBlock size:               4096\n"), nil
+	}
+	return nil, nil
+}
+
+func TestValidateFilesystemSize(t *testing.T) {
+	log.Debug("Running TestValidateFilesystemSize...")
+
+	ctx := context.TODO()
+	tests := []struct {
+		FsType string
+		Size   int64
+		Valid  bool
+	}{
+		{"xfs", 0, true},
+		{"xfs", 100 * mib, false},
+		{"xfs", 1 * tib, true},
+		{"xfs", 2048 * tib, true},
+		{"ext3", 16 * tib, true},
+		{"ext3", 17 * tib, false},
+		{"ext4", 512 * 1024, false},
+		{"ext4", 100 * tib, true},
+		{"ext4", 2 * eib, false},
+		{"zfs", 2 * eib, true},
+	}
+	for _, testCase := range tests {
+		err := validateFilesystemSize(ctx, testCase.FsType, testCase.Size)
+		assert.Equal(t, testCase.Valid, err == nil, "%s %d", testCase.FsType, testCase.Size)
+	}
+}
+
+func TestValidateFilesystemResize(t *testing.T) {
+	log.Debug("Running TestValidateFilesystemResize...")
+
+	ctx := context.TODO()
+	executor := &dumpe2fsExecutor{}
+	assert.NoError(t, Init(Config{Executor: executor}))
+	defer func() { _ = Init(Config{}) }()
+
+	// Features aren't read until a filesystem grows past 16TiB
+	assert.NoError(t, validateFilesystemResize(ctx, "ext4", "/dev/sdb", 16*tib))
+	assert.Empty(t, executor.commands)
+
+	assert.Error(t, validateFilesystemResize(ctx, "ext4", "/dev/sdb", 20*tib))
+	assert.Equal(t, []string{"dumpe2fs -h /dev/sdb"}, executor.commands)
+
+	executor.features = "64bit"
+	assert.NoError(t, validateFilesystemResize(ctx, "ext4", "/dev/sdb", 20*tib))
+	assert.Error(t, validateFilesystemResize(ctx, "ext3", "/dev/sdb", 20*tib))
+	assert.NoError(t, validateFilesystemResize(ctx, "xfs", "/dev/sdb", 20*tib))
+}
+
+func TestClassifyMkfsFailure(t *testing.T) {
+	log.Debug("Running TestClassifyMkfsFailure...")
+
+	failed := errors.New("exit status 1")
+	tests := []struct {
+		output    string
+		err       error
+		permanent bool
+	}{
+		{"mkfs.xfs: /dev/dm-0 appears to contain an existing filesystem (ext4).\n" +
+			"mkfs.xfs: Use the -f option to force overwrite.", failed, true},
+		{"agsize (4096 blocks) too small, need at least 4096 blocks", failed, true},
+		{"mke2fs: Filesystem larger than apparent device size.\nProceed anyway? (y,N)", failed, false},
+		{"/dev/sdb is mounted; will not make a filesystem here!", failed, true},
+		{"mke2fs: Read-only file system while setting up superblock", failed, true},
+		{"mkfs.xfs: cannot open /dev/dm-0: Device or resource busy", failed, false},
+		{"", exec.ErrNotFound, true},
+		{"", TimeoutError("process killed after timeout"), true},
+	}
+	for _, test := range tests {
+		reason, permanent := classifyMkfsFailure([]byte(test.output), test.err)
+		assert.Equal(t, test.permanent, permanent, test.output)
+		assert.Equal(t, test.permanent, reason != "", test.output)
+	}
+}
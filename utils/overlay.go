@@ -0,0 +1,147 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+const (
+	// fsOverlay is the filesystem type of an overlay mount
+	fsOverlay = "overlay"
+	// overlayUpperDir and overlayWorkDir are created within an overlay's scratch directory
+	overlayUpperDir = "upper"
+	overlayWorkDir  = "work"
+)
+
+// OverlayVolume is a writable overlay of a read-only volume, such as a golden image on a LUN snapshot, so that
+// the volume can be published writable to each pod while pods' changes are kept apart and the image unchanged.
+type OverlayVolume struct {
+	// LowerDir is where the read-only volume is mounted
+	LowerDir string
+	// ScratchDir holds the overlay's changes, in directories created within it, and may be on a local filesystem
+	// or a second LUN; it must not be within the lower directory
+	ScratchDir string
+	// Target is where the writable overlay is mounted
+	Target string
+	// Options are additional overlay mount options, such as "redirect_dir=on"
+	Options string
+}
+
+func (o OverlayVolume) upperDir() string {
+	return path.Join(o.ScratchDir, overlayUpperDir)
+}
+
+func (o OverlayVolume) workDir() string {
+	return path.Join(o.ScratchDir, overlayWorkDir)
+}
+
+// validate checks an overlay's directories.  Overlay mount options separate values with commas and lower
+// directories with colons, so paths containing either are refused rather than escaped.
+func (o OverlayVolume) validate() error {
+
+	for name, dir := range map[string]string{"lower": o.LowerDir, "scratch": o.ScratchDir, "target": o.Target} {
+		if dir == "" || !path.IsAbs(dir) {
+			return fmt.Errorf("overlay %s directory must be an absolute path: %q", name, dir)
+		}
+		if strings.ContainsAny(dir, ",:") {
+			return fmt.Errorf("overlay %s directory may not contain commas or colons: %s", name, dir)
+		}
+	}
+
+	lower, scratch := path.Clean(o.LowerDir), path.Clean(o.ScratchDir)
+	if scratch == lower || strings.HasPrefix(scratch, lower+"/") || strings.HasPrefix(lower, scratch+"/") {
+		return fmt.Errorf("overlay scratch directory %s may not overlap lower directory %s", scratch, lower)
+	}
+
+	return nil
+}
+
+// MountOverlay mounts a writable overlay of a read-only volume already mounted at the overlay's lower directory,
+// creating its scratch and target directories as needed.  An overlay already mounted at the target is left as is.
+func MountOverlay(ctx context.Context, overlay OverlayVolume) error {
+
+	fields := log.Fields{"lowerDir": overlay.LowerDir, "scratchDir": overlay.ScratchDir, "target": overlay.Target}
+	Logc(ctx).WithFields(fields).Debug(">>>> overlay.MountOverlay")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< overlay.MountOverlay")
+
+	if err := overlay.validate(); err != nil {
+		return err
+	}
+
+	if isDir, err := IsLikelyDir(overlay.LowerDir); err != nil || !isDir {
+		return fmt.Errorf("overlay lower directory %s is not a directory", overlay.LowerDir)
+	}
+
+	if mounted, err := IsMounted(ctx, "", overlay.Target); err != nil {
+		return err
+	} else if mounted {
+		Logc(ctx).WithFields(fields).Debug("Overlay already mounted.")
+		return nil
+	}
+
+	for _, dir := range []string{overlay.upperDir(), overlay.workDir(), overlay.Target} {
+		if err := EnsureDirExists(ctx, dir); err != nil {
+			return err
+		}
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", overlay.LowerDir, overlay.upperDir(),
+		overlay.workDir())
+	if overlay.Options != "" {
+		options += "," + overlay.Options
+	}
+
+	if out, err := execCommand(ctx, "mount", "-t", fsOverlay, "-o", options, fsOverlay, overlay.Target); err != nil {
+		Logc(ctx).WithFields(fields).WithField("output", string(out)).Debug("Mount failed.")
+		return fmt.Errorf("error mounting overlay of %s on %s: %v", overlay.LowerDir, overlay.Target, err)
+	}
+
+	Logc(ctx).WithFields(fields).Info("Mounted overlay.")
+	return nil
+}
+
+// UnmountOverlay unmounts an overlay and removes its target directory and the changes held in its scratch
+// directory, leaving the scratch directory itself and the lower directory as they were.
+func UnmountOverlay(ctx context.Context, overlay OverlayVolume) error {
+
+	fields := log.Fields{"lowerDir": overlay.LowerDir, "scratchDir": overlay.ScratchDir, "target": overlay.Target}
+	Logc(ctx).WithFields(fields).Debug(">>>> overlay.UnmountOverlay")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< overlay.UnmountOverlay")
+
+	if err := overlay.validate(); err != nil {
+		return err
+	}
+
+	if mounted, err := IsMounted(ctx, "", overlay.Target); err != nil {
+		return err
+	} else if mounted {
+		if err = Umount(ctx, overlay.Target); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(overlay.Target); err == nil {
+		if err = removeMountPointDir(ctx, overlay.Target); err != nil {
+			return err
+		}
+	}
+
+	// The changes are only removed once the overlay is gone, as removing them beneath it would corrupt it
+	for _, dir := range []string{overlay.upperDir(), overlay.workDir()} {
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("could not remove overlay directory %s; %v", dir, err)
+		}
+	}
+
+	Logc(ctx).WithFields(fields).Info("Unmounted overlay.")
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverlayVolumeValidate(t *testing.T) {
+	log.Debug("Running TestOverlayVolumeValidate...")
+
+	tests := []struct {
+		Overlay OverlayVolume
+		Valid   bool
+	}{
+		{OverlayVolume{LowerDir: "/mnt/image", ScratchDir: "/var/scratch/pod1", Target: "/mnt/pod1"}, true},
+		{OverlayVolume{LowerDir: "/mnt/image", ScratchDir: "/mnt/image/scratch", Target: "/mnt/pod1"}, false},
+		{OverlayVolume{LowerDir: "/mnt/image/a", ScratchDir: "/mnt/image", Target: "/mnt/pod1"}, false},
+		{OverlayVolume{LowerDir: "/mnt/image", ScratchDir: "/mnt/image2", Target: "/mnt/pod1"}, true},
+		{OverlayVolume{LowerDir: "/mnt/image", ScratchDir: "relative", Target: "/mnt/pod1"}, false},
+		{OverlayVolume{LowerDir: "/mnt/image", ScratchDir: "/var/scratch", Target: ""}, false},
+		{OverlayVolume{LowerDir: "/mnt/a,b", ScratchDir: "/var/scratch", Target: "/mnt/pod1"}, false},
+		{OverlayVolume{LowerDir: "/mnt/image", ScratchDir: "/var/a:b", Target: "/mnt/pod1"}, false},
+	}
+	for _, testCase := range tests {
+		err := testCase.Overlay.validate()
+		assert.Equal(t, testCase.Valid, err == nil, "%+v", testCase.Overlay)
+	}
+}
+
+func TestMountAndUnmountOverlay(t *testing.T) {
+	log.Debug("Running TestMountAndUnmountOverlay...")
+
+	dir, err := ioutil.TempDir("", "TestMountAndUnmountOverlay")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{Executor: recorder}))
+	defer func() { _ = Init(Config{}) }()
+
+	ctx := context.TODO()
+	overlay := OverlayVolume{
+		LowerDir:   path.Join(dir, "image"),
+		ScratchDir: path.Join(dir, "scratch"),
+		Target:     path.Join(dir, "pod1"),
+		Options:    "redirect_dir=on",
+	}
+
+	// The read-only volume must be mounted first
+	assert.Error(t, MountOverlay(ctx, overlay))
+	assert.Empty(t, recorder.commands)
+
+	assert.NoError(t, os.MkdirAll(overlay.LowerDir, 0755))
+	assert.NoError(t, MountOverlay(ctx, overlay))
+	assert.Equal(t, []string{"mount -t overlay -o lowerdir=" + overlay.LowerDir + ",upperdir=" + dir +
+		"/scratch/upper,workdir=" + dir + "/scratch/work,redirect_dir=on overlay " + overlay.Target},
+		recorder.commands)
+	for _, d := range []string{"scratch/upper", "scratch/work", "pod1"} {
+		assert.DirExists(t, path.Join(dir, d))
+	}
+
+	// Changes are discarded with the overlay, but the image and scratch directory remain
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "scratch/upper/changed"), nil, 0644))
+	assert.NoError(t, UnmountOverlay(ctx, overlay))
+	assert.NoDirExists(t, path.Join(dir, "pod1"))
+	assert.NoDirExists(t, path.Join(dir, "scratch/upper"))
+	assert.NoDirExists(t, path.Join(dir, "scratch/work"))
+	assert.DirExists(t, path.Join(dir, "scratch"))
+	assert.DirExists(t, path.Join(dir, "image"))
+
+	// Unmounting is idempotent
+	assert.NoError(t, UnmountOverlay(ctx, overlay))
+}
@@ -0,0 +1,28 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"net"
+
+	"github.com/netapp/trident/utils/iscsi"
+)
+
+// Portal is an iSCSI portal.
+//
+// Deprecated: use iscsi.Portal.
+type Portal = iscsi.Portal
+
+// ParsePortal parses an iSCSI portal.
+//
+// Deprecated: use iscsi.ParsePortal.
+func ParsePortal(portal string) Portal {
+	return iscsi.ParsePortal(portal)
+}
+
+// FilterPortalsBySubnet returns the portals whose IP addresses are within any of the subnets.
+//
+// Deprecated: use iscsi.FilterPortalsBySubnet.
+func FilterPortalsBySubnet(portals []string, subnets []*net.IPNet) []string {
+	return iscsi.FilterPortalsBySubnet(portals, subnets)
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// AttachPreAttachedVolume attaches a volume that a hypervisor already presents to this host as a local disk, such
+// as a virtio-blk or virtio-scsi device passed through to a virtual node.  The disk is found by the WWN or serial
+// number in the publish info, verified, and then formatted and mounted as an iSCSI LUN would be, but no iSCSI
+// session is needed or touched.  The device path is set on the in-out publishInfo parameter so that it may be
+// mounted later instead.
+func AttachPreAttachedVolume(
+	ctx context.Context, name, mountpoint string, publishInfo *VolumePublishInfo,
+) (err error) {
+
+	ctx = WithLogFields(ctx, log.Fields{
+		LogFieldVolume: name,
+		"wwn":          publishInfo.PreAttachedDeviceWWN,
+		"serial":       publishInfo.PreAttachedDeviceSerial,
+	})
+
+	Logc(ctx).Debug(">>>> preattached.AttachPreAttachedVolume")
+	defer Logc(ctx).Debug("<<<< preattached.AttachPreAttachedVolume")
+	defer func() { journalHostOutcome(ctx, "Attach of pre-attached volume", err) }()
+
+	if !publishInfo.IsPreAttached() {
+		return fmt.Errorf("volume %s has no WWN or serial number of a pre-attached device", name)
+	}
+
+	latency := &AttachLatency{}
+	publishInfo.AttachLatency = latency
+	attachStart := time.Now()
+	defer func() {
+		latency.Total = time.Since(attachStart)
+		logSlowAttach(ctx, name, latency)
+	}()
+
+	// The hypervisor may still be hot-plugging the disk, so wait for it as for the paths of a new LUN
+	stage := startAttachStage(ctx, "scanWait")
+	deviceToUse, err := waitForPreAttachedDevice(ctx, publishInfo.PreAttachedAccessInfo)
+	latency.ScanWait = stage.end()
+	if err != nil {
+		return err
+	}
+
+	devicePath := "/dev/" + deviceToUse
+	if isMultipathDevice(deviceToUse) {
+		devicePath = getMultipathDevicePath(ctx, deviceToUse)
+	}
+	if err = waitForDevice(ctx, devicePath); err != nil {
+		return fmt.Errorf("could not find device %v; %s", devicePath, err)
+	}
+
+	if publishInfo.VolumeSize > 0 && !disableDeviceSizeCheck {
+		if err = verifyDeviceSize(ctx, devicePath, publishInfo.VolumeSize); err != nil {
+			return err
+		}
+	}
+
+	skipFSCheck := publishInfo.MultiAttach && multiAttachPolicy == MultiAttachPolicySkip
+	var existingFstype string
+	if publishInfo.FilesystemType != fsRaw && !skipFSCheck {
+		stage = startAttachStage(ctx, "blkid")
+		existingFstype, err = getFSType(ctx, "/dev/"+deviceToUse)
+		latency.Blkid = stage.end()
+		if err != nil {
+			return fmt.Errorf("could not get filesystem type of device %s; %v", deviceToUse, err)
+		}
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"device": deviceToUse,
+		"fsType": existingFstype,
+	}).Debug("Found pre-attached device.")
+
+	// Return the device in the publish info in case the mount will be done later
+	publishInfo.DevicePath = devicePath
+	publishInfo.SupportsDiscard = deviceSupportsDiscard(ctx, deviceToUse)
+
+	if publishInfo.MultiAttach && fencingHook != nil {
+		if err = fencingHook.Register(ctx, devicePath, publishInfo); err != nil {
+			return fmt.Errorf("could not fence LUN %s, device %s; %v", name, deviceToUse, err)
+		}
+	}
+
+	return setUpAttachedDevice(ctx, name, mountpoint, devicePath, deviceToUse, existingFstype, skipFSCheck,
+		publishInfo)
+}
+
+// waitForPreAttachedDevice waits for the disk a pre-attached volume is presented as, and returns its kernel name.
+func waitForPreAttachedDevice(ctx context.Context, info PreAttachedAccessInfo) (string, error) {
+
+	var device string
+	findDevice := func() (err error) {
+		device, err = findPreAttachedDevice(ctx, info)
+		return err
+	}
+	findNotify := func(err error, duration time.Duration) {
+		Logc(ctx).WithField("increment", duration).WithError(err).Debug("Pre-attached device not found yet.")
+	}
+
+	findBackoff := newExponentialBackOff()
+	findBackoff.InitialInterval = 1 * time.Second
+	findBackoff.Multiplier = 1.414 // approx sqrt(2)
+	findBackoff.RandomizationFactor = 0.1
+	findBackoff.MaxElapsedTime = multipathDeviceDiscoveryTimeoutSecs * time.Second
+
+	if err := retryNotify(findDevice, findBackoff, findNotify); err != nil {
+		return "", err
+	}
+	return device, nil
+}
+
+// findPreAttachedDevice returns the kernel name of the disk with the WWN or serial number of a pre-attached
+// volume, or of the multipath device holding it if the hypervisor presents the LUN through several disks.  An
+// error is returned unless the disks found all belong to exactly one device.
+func findPreAttachedDevice(ctx context.Context, info PreAttachedAccessInfo) (string, error) {
+
+	entries, err := ioutil.ReadDir(chrootPathPrefix + "/sys/block/")
+	if err != nil {
+		return "", err
+	}
+
+	disks := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !isDiskDevice(name) {
+			continue
+		}
+		if info.PreAttachedDeviceWWN != "" &&
+			normalizeWWN(getDiskWWN(ctx, name)) != normalizeWWN(info.PreAttachedDeviceWWN) {
+			continue
+		}
+		if info.PreAttachedDeviceSerial != "" && getDiskSerial(ctx, name) != info.PreAttachedDeviceSerial {
+			continue
+		}
+		disks = append(disks, name)
+	}
+
+	if len(disks) == 0 {
+		return "", errors.New("no disk with the volume's WWN or serial number is present")
+	}
+
+	// Several disks are several paths to the LUN only if multipath has combined them
+	devices := combineMultipathDisks(ctx, disks)
+	if len(devices) > 1 {
+		return "", fmt.Errorf("disks %v all have the volume's WWN or serial number but aren't paths of one "+
+			"multipath device", disks)
+	}
+
+	Logc(ctx).WithFields(log.Fields{
+		"disks":  disks,
+		"device": devices[0],
+	}).Debug("Found disks of pre-attached volume.")
+
+	return devices[0], nil
+}
+
+// combineMultipathDisks returns the devices to use for disks that may be paths to one LUN or namespace: the
+// multipath device holding each disk, or the disk itself if multipath doesn't hold it.
+func combineMultipathDisks(ctx context.Context, disks []string) []string {
+	devices := make([]string, 0)
+	for _, disk := range disks {
+		device := disk
+		if holder := findMultipathDeviceForDevice(ctx, disk); holder != "" && isMultipathDevice(holder) {
+			device = holder
+		}
+		if !StringInSlice(device, devices) {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+// getDiskWWN returns the WWN of a disk, as its driver reports it, or an empty string if it reports none.  SCSI
+// disks report it in their device's wwid attribute, while NVMe namespaces and recent kernels report it in the
+// disk's own.  Virtio-blk disks report none.
+func getDiskWWN(ctx context.Context, name string) string {
+	for _, attribute := range []string{"wwid", "device/wwid"} {
+		if wwn, err := readSysfsAttribute(ctx, name, attribute); err == nil && wwn != "" {
+			return wwn
+		}
+	}
+	return ""
+}
+
+// normalizeWWN puts a WWN into one form whether it's given as it appears in sysfs, as in "naa.600a0980...", as
+// multipath's WWID, as in "3600a0980...", or as bare hex digits.
+func normalizeWWN(wwn string) string {
+	wwn = strings.ToLower(strings.TrimSpace(wwn))
+	for _, prefix := range []string{"naa.", "eui.", "0x"} {
+		wwn = strings.TrimPrefix(wwn, prefix)
+	}
+	// NAA type 6 identifiers are 32 hex digits, which multipath prefixes with the SCSI designator type 3
+	if len(wwn) == 33 && strings.HasPrefix(wwn, "3") {
+		wwn = wwn[1:]
+	}
+	return wwn
+}
+
+// getDiskSerial returns the serial number of a disk, or an empty string if it reports none.  Virtio-blk disks
+// report it in the disk's serial attribute and NVMe controllers in their device's, while SCSI disks report it only
+// in the unit serial number VPD page.
+func getDiskSerial(ctx context.Context, name string) string {
+	for _, attribute := range []string{"serial", "device/serial"} {
+		if serial, err := readSysfsAttribute(ctx, name, attribute); err == nil && serial != "" {
+			return serial
+		}
+	}
+
+	// The VPD page has a four byte header whose last byte is the length of the serial number that follows
+	page, err := ioutil.ReadFile(chrootPathPrefix + "/sys/block/" + name + "/device/vpd_pg80")
+	if err != nil || len(page) < 4 || len(page) < 4+int(page[3]) {
+		return ""
+	}
+	return strings.TrimSpace(string(page[4 : 4+int(page[3])]))
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeWWN(t *testing.T) {
+	log.Debug("Running TestNormalizeWWN...")
+
+	for _, wwn := range []string{
+		"600a098038303634722b4d59614c6f42",
+		"naa.600a098038303634722b4d59614c6f42",
+		"3600a098038303634722b4d59614c6f42",
+		"0x600A098038303634722B4D59614C6F42\n",
+	} {
+		assert.Equal(t, "600a098038303634722b4d59614c6f42", normalizeWWN(wwn), wwn)
+	}
+	assert.Equal(t, "002538b471b40718", normalizeWWN("eui.002538b471b40718"))
+}
+
+func TestFindPreAttachedDevice(t *testing.T) {
+	log.Debug("Running TestFindPreAttachedDevice...")
+
+	dir, err := ioutil.TempDir("", "TestFindPreAttachedDevice")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	writeFile := func(name, content string) {
+		assert.NoError(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644))
+	}
+	makeDir := func(name string) {
+		assert.NoError(t, os.MkdirAll(path.Join(dir, name), 0755))
+	}
+
+	// vdb is a virtio-blk disk known by its serial number
+	writeFile("sys/block/vdb/serial", "pvc-1234\n")
+	makeDir("sys/block/vdb/device")
+
+	// sdb and sdc are virtio-scsi paths to one LUN, combined by multipath, and sdd has its serial number only in
+	// the unit serial number VPD page
+	for _, device := range []string{"sdb", "sdc"} {
+		writeFile("sys/block/"+device+"/device/wwid", "naa.600a098038303634722b4d59614c6f42\n")
+		makeDir("sys/block/" + device + "/holders/dm-0")
+	}
+	writeFile("sys/block/dm-0/dm/uuid", "mpath-3600a098038303634722b4d59614c6f42\n")
+	writeFile("sys/block/sdd/device/vpd_pg80", "\x00\x80\x00\x0cD8CUV0sFWsZk")
+
+	ctx := context.TODO()
+
+	device, err := findPreAttachedDevice(ctx, PreAttachedAccessInfo{PreAttachedDeviceSerial: "pvc-1234"})
+	assert.NoError(t, err)
+	assert.Equal(t, "vdb", device)
+
+	device, err = findPreAttachedDevice(ctx, PreAttachedAccessInfo{
+		PreAttachedDeviceWWN: "3600a098038303634722b4d59614c6f42",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "dm-0", device)
+
+	device, err = findPreAttachedDevice(ctx, PreAttachedAccessInfo{PreAttachedDeviceSerial: "D8CUV0sFWsZk"})
+	assert.NoError(t, err)
+	assert.Equal(t, "sdd", device)
+
+	// Both identifiers must match if both are given
+	_, err = findPreAttachedDevice(ctx, PreAttachedAccessInfo{
+		PreAttachedDeviceWWN:    "600a098038303634722b4d59614c6f42",
+		PreAttachedDeviceSerial: "pvc-1234",
+	})
+	assert.Error(t, err)
+
+	// Disks with the same WWN that multipath hasn't combined can't be told apart
+	assert.NoError(t, os.RemoveAll(path.Join(dir, "sys/block/sdc/holders")))
+	_, err = findPreAttachedDevice(ctx, PreAttachedAccessInfo{
+		PreAttachedDeviceWWN: "600a098038303634722b4d59614c6f42",
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+	"github.com/netapp/trident/utils/devices"
+)
+
+// SCSIDevice describes a SCSI device as sysfs shows it.
+//
+// Deprecated: use devices.SCSIDevice.
+type SCSIDevice = devices.SCSIDevice
+
+// GetSCSIDevices returns the host's SCSI devices, ordered by address.
+//
+// Deprecated: use devices.ListSCSIDevices.
+func GetSCSIDevices(ctx context.Context) ([]SCSIDevice, error) {
+	return devices.ListSCSIDevices(ctx, chrootPathPrefix, deviceReadTimeout)
+}
+
+// logSCSIDevices logs the host's SCSI devices, as when devices expected to appear don't.
+func logSCSIDevices(ctx context.Context) {
+
+	scsiDevices, err := devices.ListSCSIDevices(ctx, chrootPathPrefix, deviceReadTimeout)
+	if err != nil {
+		Logc(ctx).WithError(err).Warning("Could not list SCSI devices.")
+		return
+	}
+	for _, device := range scsiDevices {
+		Logc(ctx).WithFields(log.Fields{
+			"address":  device.Address,
+			"vendor":   device.Vendor,
+			"model":    device.Model,
+			"revision": device.Revision,
+			"state":    device.State,
+			"device":   device.Device,
+		}).Debug("SCSI device.")
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// The SCSI layer's timeouts for each path of a LUN bound how quickly a failing path is given up on and its I/O
+// retried on another, so they determine how long a failover takes.  Hosts usually set them with udev rules; a
+// volume's publish info may instead carry a profile that is applied to each of its paths when it's attached.
+// Paths that appear later, as when portals are added or sessions are recovered, are new SCSI devices with the
+// kernel's default timeouts, so the profiles of attached LUNs are remembered and applied to such paths as well.
+
+const (
+	scsiCommandTimeoutFile      = "timeout"
+	scsiErrorHandlerTimeoutFile = "eh_timeout"
+)
+
+// SCSITimeoutProfile is the SCSI timeouts to set on each path of an attached LUN.  A zero timeout is left as the
+// host has it.
+type SCSITimeoutProfile struct {
+	// CommandTimeoutSeconds is how long a SCSI command may take before it's aborted, as in device/timeout
+	CommandTimeoutSeconds int `json:"commandTimeoutSeconds,omitempty"`
+	// ErrorHandlerTimeoutSeconds is how long each step of SCSI error recovery may take, as in device/eh_timeout
+	ErrorHandlerTimeoutSeconds int `json:"errorHandlerTimeoutSeconds,omitempty"`
+}
+
+// IsZero returns whether the profile leaves every timeout as the host has it.
+func (p SCSITimeoutProfile) IsZero() bool {
+	return p.CommandTimeoutSeconds == 0 && p.ErrorHandlerTimeoutSeconds == 0
+}
+
+// timeouts returns the sysfs device files the profile sets, with their values.
+func (p SCSITimeoutProfile) timeouts() map[string]int {
+	timeouts := make(map[string]int)
+	if p.CommandTimeoutSeconds > 0 {
+		timeouts[scsiCommandTimeoutFile] = p.CommandTimeoutSeconds
+	}
+	if p.ErrorHandlerTimeoutSeconds > 0 {
+		timeouts[scsiErrorHandlerTimeoutFile] = p.ErrorHandlerTimeoutSeconds
+	}
+	return timeouts
+}
+
+func validateSCSITimeoutProfile(profile SCSITimeoutProfile) error {
+	if profile.CommandTimeoutSeconds < 0 {
+		return fmt.Errorf("invalid SCSI command timeout: %d", profile.CommandTimeoutSeconds)
+	}
+	if profile.ErrorHandlerTimeoutSeconds < 0 {
+		return fmt.Errorf("invalid SCSI error handler timeout: %d", profile.ErrorHandlerTimeoutSeconds)
+	}
+	return nil
+}
+
+// applySCSITimeouts sets a profile's timeouts on SCSI devices such as sdb, skipping those already set.  A kernel
+// without the error handler timeout is only warned about, since the command timeout matters more to failover.
+func applySCSITimeouts(ctx context.Context, devices []string, profile SCSITimeoutProfile) error {
+
+	for _, device := range devices {
+		for file, seconds := range profile.timeouts() {
+			fields := log.Fields{"device": device, "timeout": file, "seconds": seconds}
+
+			current, err := ioutil.ReadFile(fmt.Sprintf(chrootPathPrefix+"/sys/block/%s/device/%s", device, file))
+			if os.IsNotExist(err) && file == scsiErrorHandlerTimeoutFile {
+				Logc(ctx).WithFields(fields).Warning("Kernel does not support the SCSI error handler timeout.")
+				continue
+			} else if err != nil {
+				return fmt.Errorf("could not read SCSI %s of device %s; %v", file, device, err)
+			}
+			if strings.TrimSpace(string(current)) == strconv.Itoa(seconds) {
+				continue
+			}
+
+			if err = writeSysfsDeviceFile(ctx, device, file, strconv.Itoa(seconds)); err != nil {
+				return fmt.Errorf("could not set SCSI %s of device %s; %v", file, device, err)
+			}
+			Logc(ctx).WithFields(fields).WithField("previous", strings.TrimSpace(string(current))).Debug(
+				"Set SCSI timeout.")
+		}
+	}
+	return nil
+}
+
+// trackedSCSITimeouts is the timeout profile of an attached LUN, with the targets through which it's reached and
+// the LUN's WWID, as its paths report it.
+type trackedSCSITimeouts struct {
+	targets []IscsiTarget
+	wwid    string
+	profile SCSITimeoutProfile
+}
+
+// scsiTimeoutTracker remembers the timeout profiles of attached LUNs, by their primary target and LUN number.
+type scsiTimeoutTracker struct {
+	lock     sync.Mutex
+	profiles map[string]trackedSCSITimeouts
+}
+
+var scsiTimeouts = &scsiTimeoutTracker{profiles: make(map[string]trackedSCSITimeouts)}
+
+func scsiTimeoutKey(targetIQN string, lunID int32) string {
+	return fmt.Sprintf("%s:%d", targetIQN, lunID)
+}
+
+// forget stops tracking the profile of the LUN reached through a target, whether or not it's the primary target.
+// It returns whether the LUN was tracked.
+func (t *scsiTimeoutTracker) forget(targetIQN string, lunID int32) bool {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	forgotten := false
+	for key, tracked := range t.profiles {
+		for _, target := range tracked.targets {
+			if target.IQN == targetIQN && target.LunNumber == lunID {
+				delete(t.profiles, key)
+				forgotten = true
+				break
+			}
+		}
+	}
+	return forgotten
+}
+
+// list returns the tracked profiles.
+func (t *scsiTimeoutTracker) list() []trackedSCSITimeouts {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	profiles := make([]trackedSCSITimeouts, 0, len(t.profiles))
+	for _, tracked := range t.profiles {
+		profiles = append(profiles, tracked)
+	}
+	return profiles
+}
+
+// TrackSCSITimeouts applies an attached LUN's SCSI timeout profile, if its publish info has one, to each of its
+// paths, and remembers it so that paths that appear later get it too.  A LUN attached without a profile is
+// forgotten, so that it doesn't inherit the profile of an earlier LUN with the same number.
+func TrackSCSITimeouts(ctx context.Context, publishInfo *VolumePublishInfo) error {
+
+	targets := getISCSITargets(publishInfo)
+	forgotten := false
+	for _, target := range targets {
+		forgotten = scsiTimeouts.forget(target.IQN, target.LunNumber) || forgotten
+	}
+	if publishInfo.SCSITimeouts == nil || publishInfo.SCSITimeouts.IsZero() {
+		if forgotten {
+			updateUdevRules(ctx)
+		}
+		return nil
+	}
+	profile := *publishInfo.SCSITimeouts
+	if err := validateSCSITimeoutProfile(profile); err != nil {
+		return err
+	}
+
+	tracked := trackedSCSITimeouts{targets: targets, profile: profile}
+	if devices, err := getDevicesForISCSITarget(ctx, targets[0]); err == nil && len(devices) > 0 {
+		tracked.wwid = getSCSIDeviceWWID(devices[0])
+	}
+
+	scsiTimeouts.lock.Lock()
+	scsiTimeouts.profiles[scsiTimeoutKey(publishInfo.IscsiTargetIQN, publishInfo.IscsiLunNumber)] = tracked
+	scsiTimeouts.lock.Unlock()
+
+	// Paths added while this node plugin isn't running get the profile from the host's udev rules, if enabled
+	updateUdevRules(ctx)
+
+	return applyTrackedSCSITimeouts(ctx, tracked)
+}
+
+// getDevicesForISCSITarget returns the current paths, such as sdb, of a LUN through a target.
+func getDevicesForISCSITarget(ctx context.Context, target IscsiTarget) ([]string, error) {
+	hostSessionMap := GetISCSIHostSessionMapForTarget(ctx, target.IQN)
+	return getDevicesForLUN(getSysfsBlockDirsForLUN(int(target.LunNumber), hostSessionMap))
+}
+
+// getSCSIDeviceWWID returns the WWID of a SCSI device such as sdb, as in "naa.600a098038303053453f463045727a42".
+func getSCSIDeviceWWID(device string) string {
+	wwid, _ := ioutil.ReadFile(chrootPathPrefix + "/sys/block/" + device + "/device/wwid")
+	return strings.TrimSpace(string(wwid))
+}
+
+// applyTrackedSCSITimeouts applies a tracked profile to the current paths of its LUN through each of its targets.
+func applyTrackedSCSITimeouts(ctx context.Context, tracked trackedSCSITimeouts) error {
+
+	for _, target := range tracked.targets {
+		devices, err := getDevicesForISCSITarget(ctx, target)
+		if err != nil {
+			return err
+		}
+		if err = applySCSITimeouts(ctx, devices, tracked.profile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reapplySCSITimeouts applies the tracked profile of each attached LUN to any of its paths that don't have it,
+// such as those added since the LUN was attached.
+func reapplySCSITimeouts(ctx context.Context) {
+	for _, tracked := range scsiTimeouts.list() {
+		if err := applyTrackedSCSITimeouts(ctx, tracked); err != nil {
+			Logc(ctx).WithFields(log.Fields{
+				"targetIQN": tracked.targets[0].IQN,
+				"lunID":     tracked.targets[0].LunNumber,
+			}).WithError(err).Warning("Could not apply SCSI timeouts to LUN's paths.")
+		}
+	}
+}
+
+// forgetSCSITimeouts stops tracking the profile of a removed LUN.
+func forgetSCSITimeouts(ctx context.Context, deviceInfo *ScsiDeviceInfo) {
+	if lunID, err := strconv.Atoi(deviceInfo.LUN); err == nil && deviceInfo.IQN != "" {
+		if scsiTimeouts.forget(deviceInfo.IQN, int32(lunID)) {
+			updateUdevRules(ctx)
+		}
+	}
+}
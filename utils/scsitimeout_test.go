@@ -0,0 +1,76 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackSCSITimeouts(t *testing.T) {
+	log.Debug("Running TestTrackSCSITimeouts...")
+
+	dir, err := ioutil.TempDir("", "TestTrackSCSITimeouts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, Init(Config{HostRoot: dir}))
+	defer func() { _ = Init(Config{}) }()
+
+	const iqn = "iqn.1992-08.com.netapp:sn.test:vs.1"
+	const lunID = 1
+
+	// addPath lays out sysfs for a path to the LUN through a new session, with a device lacking eh_timeout
+	addPath := func(host, session int, device string) {
+		sessionName := fmt.Sprintf("session%d", session)
+		hostPath := path.Join(dir, "sys/class/iscsi_host", fmt.Sprintf("host%d", host))
+		sessionPath := path.Join(hostPath, "device", sessionName, "iscsi_session", sessionName)
+		lunPath := path.Join(sessionPath, "device", fmt.Sprintf("target%d:0:0/%d:0:0:%d", host, host, lunID))
+		assert.NoError(t, os.MkdirAll(path.Join(lunPath, "block", device), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(sessionPath, "targetname"), []byte(iqn+"\n"), 0600))
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/class/scsi_host"), 0755))
+		assert.NoError(t, os.Symlink(hostPath, path.Join(dir, "sys/class/scsi_host", fmt.Sprintf("host%d", host))))
+		assert.NoError(t, os.MkdirAll(path.Join(dir, "sys/block", device, "device"), 0755))
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, "sys/block", device, "device/timeout"), nil, 0600))
+	}
+	timeout := func(device string) string {
+		content, err := ioutil.ReadFile(path.Join(dir, "sys/block", device, "device/timeout"))
+		assert.NoError(t, err)
+		return string(content)
+	}
+
+	ctx := context.TODO()
+	publishInfo := &VolumePublishInfo{SCSITimeouts: &SCSITimeoutProfile{
+		CommandTimeoutSeconds:      60,
+		ErrorHandlerTimeoutSeconds: 10,
+	}}
+	publishInfo.IscsiTargetIQN = iqn
+	publishInfo.IscsiLunNumber = lunID
+	defer scsiTimeouts.forget(iqn, lunID)
+
+	addPath(3, 1, "sdb")
+	assert.NoError(t, TrackSCSITimeouts(ctx, publishInfo))
+	assert.Equal(t, "60", timeout("sdb"))
+
+	// A path that appears later gets the profile, and one that has it already isn't written again
+	addPath(4, 2, "sdc")
+	reapplySCSITimeouts(ctx)
+	assert.Equal(t, "60", timeout("sdb"))
+	assert.Equal(t, "60", timeout("sdc"))
+
+	// Once the LUN is removed, its profile is no longer applied
+	forgetSCSITimeouts(ctx, &ScsiDeviceInfo{IQN: iqn, LUN: "1"})
+	addPath(5, 3, "sdd")
+	reapplySCSITimeouts(ctx)
+	assert.Empty(t, timeout("sdd"))
+
+	publishInfo.SCSITimeouts = &SCSITimeoutProfile{CommandTimeoutSeconds: -1}
+	assert.Error(t, TrackSCSITimeouts(ctx, publishInfo))
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"syscall"
+)
+
+// maxSecretSize bounds the secret read from a file or descriptor, which is far larger than any CHAP secret
+const maxSecretSize = 4096
+
+// SecretRef refers to a secret, such as a CHAP secret, that's resolved only when it's used, so the secret itself
+// needn't be held in memory or carried in structures that are logged or serialized.  Exactly one source should be
+// set; a reference's string form never includes the secret.
+type SecretRef struct {
+	// File is the path of a file holding the secret, with any trailing newline ignored
+	File string `json:"file,omitempty"`
+	// FD is a positive, seekable file descriptor, such as a memfd passed by a credential agent, holding the secret
+	FD int `json:"fd,omitempty"`
+	// Resolve returns the secret, as from a credential agent; it's never serialized
+	Resolve func(ctx context.Context) (string, error) `json:"-"`
+
+	value string
+}
+
+// SecretValue returns a reference to a secret already held as a string.
+func SecretValue(secret string) *SecretRef {
+	return &SecretRef{value: secret}
+}
+
+// IsSet returns true if the reference has a source for its secret.
+func (r *SecretRef) IsSet() bool {
+	return r != nil && (r.value != "" || r.File != "" || r.FD > 0 || r.Resolve != nil)
+}
+
+// Get resolves the secret.  An unset reference resolves to an empty secret.
+func (r *SecretRef) Get(ctx context.Context) (string, error) {
+
+	switch {
+	case r == nil:
+		return "", nil
+	case r.value != "":
+		return r.value, nil
+	case r.Resolve != nil:
+		return r.Resolve(ctx)
+	case r.File != "":
+		content, err := ioutil.ReadFile(r.File)
+		if err != nil {
+			return "", fmt.Errorf("could not read secret file %s; %v", r.File, err)
+		} else if len(content) > maxSecretSize {
+			return "", fmt.Errorf("secret file %s is too large", r.File)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	case r.FD > 0:
+		// Read from the start without moving the offset or taking ownership, so it can be resolved again
+		buf := make([]byte, maxSecretSize+1)
+		n, err := syscall.Pread(r.FD, buf, 0)
+		if err != nil {
+			return "", fmt.Errorf("could not read secret from descriptor %d; %v", r.FD, err)
+		} else if n > maxSecretSize {
+			return "", fmt.Errorf("secret in descriptor %d is too large", r.FD)
+		}
+		return strings.TrimRight(string(buf[:n]), "\r\n"), nil
+	default:
+		return "", errors.New("secret reference has no source")
+	}
+}
+
+// String describes where the secret comes from, without the secret.
+func (r *SecretRef) String() string {
+	switch {
+	case r == nil:
+		return "<none>"
+	case r.value != "":
+		return redactedValue
+	case r.Resolve != nil:
+		return "callback"
+	case r.File != "":
+		return "file:" + r.File
+	case r.FD > 0:
+		return fmt.Sprintf("fd:%d", r.FD)
+	default:
+		return "<none>"
+	}
+}
+
+// GoString keeps %#v from printing the secret.
+func (r *SecretRef) GoString() string {
+	return r.String()
+}
+
+// secretOrRef returns a reference to a secret given either as a string or by reference, preferring the reference.
+func secretOrRef(secret string, ref *SecretRef) *SecretRef {
+	if ref.IsSet() {
+		return ref
+	}
+	return SecretValue(secret)
+}
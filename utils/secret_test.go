@@ -0,0 +1,80 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretRef(t *testing.T) {
+	log.Debug("Running TestSecretRef...")
+
+	dir, err := ioutil.TempDir("", "TestSecretRef")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	secretFile := path.Join(dir, "chap")
+	assert.NoError(t, ioutil.WriteFile(secretFile, []byte("fromfile\n"), 0600))
+	f, err := os.Open(secretFile)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	ctx := context.TODO()
+	tests := []struct {
+		Ref    *SecretRef
+		Secret string
+		String string
+	}{
+		{nil, "", "<none>"},
+		{SecretValue("literal"), "literal", redactedValue},
+		{&SecretRef{File: secretFile}, "fromfile", "file:" + secretFile},
+		{&SecretRef{FD: int(f.Fd())}, "fromfile", fmt.Sprintf("fd:%d", f.Fd())},
+		{&SecretRef{Resolve: func(context.Context) (string, error) { return "fromagent", nil }}, "fromagent",
+			"callback"},
+	}
+	for _, testCase := range tests {
+		secret, err := testCase.Ref.Get(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, testCase.Secret, secret)
+		assert.Equal(t, testCase.String, fmt.Sprintf("%v", testCase.Ref))
+	}
+	assert.NotContains(t, fmt.Sprintf("%#v %+v", SecretValue("literal"), SecretValue("literal")), "literal")
+
+	// A descriptor can be resolved more than once
+	secret, err := (&SecretRef{FD: int(f.Fd())}).Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "fromfile", secret)
+
+	_, err = (&SecretRef{File: path.Join(dir, "missing")}).Get(ctx)
+	assert.Error(t, err)
+	_, err = (&SecretRef{}).Get(ctx)
+	assert.Error(t, err)
+
+	// Secrets given as strings or callbacks are never serialized
+	info := IscsiAccessInfo{
+		IscsiInitiatorSecretRef: SecretValue("literal"),
+		IscsiTargetSecretRef:    &SecretRef{File: secretFile},
+	}
+	serialized, err := json.Marshal(info)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(serialized), "literal")
+	assert.Contains(t, string(serialized), secretFile)
+
+	assert.Equal(t, "fromfile", mustGetSecret(t, secretOrRef("literal", &SecretRef{File: secretFile})))
+	assert.Equal(t, "literal", mustGetSecret(t, secretOrRef("literal", nil)))
+}
+
+func mustGetSecret(t *testing.T, ref *SecretRef) string {
+	secret, err := ref.Get(context.TODO())
+	assert.NoError(t, err)
+	return secret
+}
@@ -0,0 +1,428 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netapp/trident/utils"
+)
+
+// iscsiadmArgs holds the options of an iscsiadm command line, which may be given as "-o update", "--op update"
+// or "--op=update".
+type iscsiadmArgs struct {
+	mode     string
+	target   string
+	portal   string
+	op       string
+	sid      string
+	discover bool
+	login    bool
+	logout   bool
+	stats    bool
+	version  bool
+}
+
+func parseIscsiadmArgs(args []string) iscsiadmArgs {
+
+	var parsed iscsiadmArgs
+
+	for i := 0; i < len(args); i++ {
+		arg, value := args[i], ""
+		if strings.HasPrefix(arg, "--") && strings.Contains(arg, "=") {
+			parts := strings.SplitN(arg, "=", 2)
+			arg, value = parts[0], parts[1]
+		}
+		next := func() string {
+			if value != "" {
+				return value
+			}
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+
+		switch arg {
+		case "-m", "--mode":
+			parsed.mode = next()
+		case "-T", "--targetname":
+			parsed.target = next()
+		case "-p", "--portal":
+			parsed.portal = formatPortal(next())
+		case "-o", "--op":
+			parsed.op = next()
+		case "-r", "--sid":
+			parsed.sid = next()
+		case "-t", "--type", "-I", "--interface", "-n", "--name", "-v", "--value":
+			next()
+		case "-D", "--discover":
+			parsed.discover = true
+		case "-l", "--login":
+			parsed.login = true
+		case "-u", "--logout":
+			parsed.logout = true
+		case "-s", "--stats":
+			parsed.stats = true
+		case "-V", "--version":
+			parsed.version = true
+		}
+	}
+
+	return parsed
+}
+
+// iscsiadm emulates the open-iscsi administration utility.
+func (h *Host) iscsiadm(ctx context.Context, cmd utils.Command) ([]byte, error) {
+
+	args := parseIscsiadmArgs(cmd.Args)
+
+	if args.version {
+		return []byte("iscsiadm version 2.0-874\n"), nil
+	}
+
+	switch args.mode {
+	case "session":
+		return h.listSessions(args)
+	case "node":
+		switch {
+		case args.login:
+			return h.loginCommand(cmd, args)
+		case args.logout:
+			return h.logoutCommand(args)
+		case args.op != "" || args.target != "":
+			h.mutex.Lock()
+			defer h.mutex.Unlock()
+			if !h.nodes[nodeKey(args.target, args.portal)] {
+				return []byte("iscsiadm: No records found\n"), ExitError(iscsiErrNoObjsFound)
+			}
+			return nil, nil
+		default:
+			return h.listNodes()
+		}
+	case "discoverydb", "discovery":
+		if args.discover {
+			return h.discover(args.portal)
+		}
+		return nil, nil
+	default:
+		return []byte("iscsiadm: Invalid mode\n"), ExitError(7)
+	}
+}
+
+func (h *Host) listSessions(args iscsiadmArgs) ([]byte, error) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.sessions) == 0 {
+		return []byte("iscsiadm: No active sessions.\n"), ExitError(iscsiErrNoObjsFound)
+	}
+	if args.stats {
+		return []byte(fmt.Sprintf("Stats for session [sid: %s]\n", args.sid)), nil
+	}
+
+	var out strings.Builder
+	for _, s := range h.sortedSessions() {
+		fmt.Fprintf(&out, "tcp: [%d] %s,1 %s (non-flash)\n", s.id, s.portal, s.target.iqn)
+	}
+	return []byte(out.String()), nil
+}
+
+func (h *Host) listNodes() ([]byte, error) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.nodes) == 0 {
+		return []byte("iscsiadm: No records found\n"), ExitError(iscsiErrNoObjsFound)
+	}
+
+	nodes := make([]string, 0, len(h.nodes))
+	for node := range h.nodes {
+		parts := strings.SplitN(node, " ", 2)
+		nodes = append(nodes, fmt.Sprintf("%s,1 %s", parts[1], parts[0]))
+	}
+	sort.Strings(nodes)
+	return []byte(strings.Join(nodes, "\n") + "\n"), nil
+}
+
+// discover records a node for every target reachable through the portal, as sendtargets discovery does.
+func (h *Host) discover(portal string) ([]byte, error) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var out strings.Builder
+	for _, t := range h.targets {
+		for _, p := range t.portals {
+			if p == portal {
+				h.nodes[nodeKey(t.iqn, portal)] = true
+				fmt.Fprintf(&out, "%s,1 %s\n", portal, t.iqn)
+			}
+		}
+	}
+
+	if out.Len() == 0 {
+		return []byte(fmt.Sprintf("iscsiadm: cannot make connection to %s: Connection refused\n", portal)),
+			ExitError(iscsiErrTransTimeout)
+	}
+	return []byte(out.String()), nil
+}
+
+// loginCommand logs in to a target through a portal, applying any faults injected for the portal.
+func (h *Host) loginCommand(cmd utils.Command, args iscsiadmArgs) ([]byte, error) {
+
+	description := fmt.Sprintf("[iface: default, target: %s, portal: %s]", args.target, args.portal)
+
+	h.mutex.Lock()
+	t, ok := h.targets[args.target]
+	if !ok || !h.nodes[nodeKey(args.target, args.portal)] {
+		h.mutex.Unlock()
+		return []byte("iscsiadm: No records found\n"), ExitError(iscsiErrNoObjsFound)
+	}
+	if h.findSession(args.target, args.portal) != nil {
+		h.mutex.Unlock()
+		return []byte("iscsiadm: default: 1 session requested, but 1 already present.\n"),
+			ExitError(iscsiErrSessExists)
+	}
+
+	f := h.faults(args.portal)
+	var delay time.Duration
+	if f.slowLogins > 0 {
+		f.slowLogins--
+		delay = f.delay
+	}
+	h.mutex.Unlock()
+
+	// A login that outlives the command's timeout is killed, leaving no session
+	if cmd.Timeout > 0 && delay >= cmd.Timeout {
+		time.Sleep(cmd.Timeout)
+		return nil, utils.TimeoutError("process killed after timeout")
+	}
+	time.Sleep(delay)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	out := fmt.Sprintf("Logging in to %s (multiple)\n", description)
+
+	if f.failures > 0 {
+		f.failures--
+		out += fmt.Sprintf("iscsiadm: Could not login to %s.\n"+
+			"iscsiadm: initiator reported error (8 - connection timed out)\n", description)
+		return []byte(out), ExitError(iscsiErrTransTimeout)
+	}
+
+	out += fmt.Sprintf("Login to %s successful.\n", description)
+
+	if f.flaps > 0 {
+		// The connection drops as soon as the login completes
+		f.flaps--
+		return []byte(out), nil
+	}
+
+	if err := h.createSession(t, args.portal); err != nil {
+		return []byte(out), err
+	}
+	return []byte(out), nil
+}
+
+func (h *Host) logoutCommand(args iscsiadmArgs) ([]byte, error) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s := h.findSession(args.target, args.portal)
+	if s == nil {
+		return []byte("iscsiadm: No matching sessions found\n"), ExitError(iscsiErrNoObjsFound)
+	}
+	if err := h.removeSession(s); err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("Logout of [sid: %d, target: %s, portal: %s] successful.\n",
+		s.id, args.target, args.portal)), nil
+}
+
+// multipath emulates the multipath utility, which can flush a multipath device.
+func (h *Host) multipath(ctx context.Context, cmd utils.Command) ([]byte, error) {
+
+	if len(cmd.Args) < 2 || cmd.Args[0] != "-f" {
+		return nil, nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	name := filepath.Base(cmd.Args[1])
+	for _, l := range h.luns {
+		if l.multipath != nil && (l.multipath.name == name || l.multipath.alias == name) {
+			return nil, h.removeMultipath(l)
+		}
+	}
+	return []byte(fmt.Sprintf("%s: map in use or not found\n", name)), ExitError(1)
+}
+
+// multipathdCommand emulates the multipathd client commands used to query the daemon and remove paths.
+func (h *Host) multipathdCommand(ctx context.Context, cmd utils.Command) ([]byte, error) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.multipathd {
+		return []byte("error -104 receiving packet\n"), ExitError(1)
+	}
+
+	switch {
+	case len(cmd.Args) >= 2 && cmd.Args[0] == "show" && cmd.Args[1] == "daemon":
+		return []byte(fmt.Sprintf("pid %s idle\n", multipathdPID)), nil
+	case len(cmd.Args) >= 3 && cmd.Args[0] == "del" && cmd.Args[1] == "path":
+		name := filepath.Base(cmd.Args[2])
+		for _, l := range h.luns {
+			if l.multipath == nil {
+				continue
+			}
+			for _, p := range l.paths {
+				if p.name == name {
+					holders := p.lunDir() + "/block/" + p.name + "/holders/" + l.multipath.name
+					_ = os.RemoveAll(h.path("sys/block/" + l.multipath.name + "/slaves/" + name))
+					_ = os.RemoveAll(h.path(holders))
+					return []byte("ok\n"), nil
+				}
+			}
+		}
+		return []byte("fail\n"), nil
+	default:
+		return []byte("ok\n"), nil
+	}
+}
+
+func (h *Host) pgrep(ctx context.Context, cmd utils.Command) ([]byte, error) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(cmd.Args) == 1 && cmd.Args[0] == "multipathd" && h.multipathd {
+		return []byte(multipathdPID + "\n"), nil
+	}
+	return nil, ExitError(1)
+}
+
+// blkid emulates the block device attribute utility for the forms used to find a device's filesystem type and
+// UUID, and the devices carrying a UUID.
+func (h *Host) blkid(ctx context.Context, cmd utils.Command) ([]byte, error) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	args := cmd.Args
+	if len(args) == 0 {
+		return nil, ExitError(2)
+	}
+
+	// blkid -t UUID=<uuid> -o device
+	if args[0] == "-t" && len(args) > 1 {
+		uuid := strings.TrimPrefix(args[1], "UUID=")
+		devices := make([]string, 0)
+		for _, l := range h.luns {
+			if l.uuid == "" || l.uuid != uuid {
+				continue
+			}
+			for _, p := range l.paths {
+				devices = append(devices, "/dev/"+p.name)
+			}
+			if l.multipath != nil {
+				devices = append(devices, "/dev/mapper/"+l.multipath.alias)
+			}
+		}
+		if len(devices) == 0 {
+			return nil, ExitError(2)
+		}
+		sort.Strings(devices)
+		return []byte(strings.Join(devices, "\n") + "\n"), nil
+	}
+
+	device := args[len(args)-1]
+	l, ok := h.resolveDevice(device)
+	if !ok || l.fstype == "" {
+		return nil, ExitError(2)
+	}
+
+	// blkid -s UUID -o value <device>
+	if args[0] == "-s" {
+		return []byte(l.uuid + "\n"), nil
+	}
+	return []byte(fmt.Sprintf("%s: UUID=\"%s\" TYPE=\"%s\"\n", device, l.uuid, l.fstype)), nil
+}
+
+// dd emulates reads of a device, which is all zeros unless it holds a filesystem.
+func (h *Host) dd(ctx context.Context, cmd utils.Command) ([]byte, error) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	device, blockSize, count := "", 512, 0
+	for _, arg := range cmd.Args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "if":
+			device = parts[1]
+		case "bs":
+			blockSize, _ = strconv.Atoi(parts[1])
+		case "count":
+			count, _ = strconv.Atoi(parts[1])
+		}
+	}
+
+	l, ok := h.resolveDevice(device)
+	if !ok {
+		return []byte(fmt.Sprintf("dd: failed to open '%s': No such file or directory\n", device)), ExitError(1)
+	}
+
+	data := make([]byte, blockSize*count)
+	if l.fstype != "" && len(data) > 0 {
+		copy(data, l.fstype)
+	}
+	return data, nil
+}
+
+// mkfs emulates the filesystem creation utilities, applying any injected format failures.
+func (h *Host) mkfs(ctx context.Context, cmd utils.Command) ([]byte, error) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(cmd.Args) == 0 {
+		return nil, ExitError(1)
+	}
+	device := cmd.Args[len(cmd.Args)-1]
+
+	if h.formatFailures != 0 {
+		if h.formatFailures > 0 {
+			h.formatFailures--
+		}
+		return []byte(fmt.Sprintf("%s: Input/output error while writing out and closing file system\n",
+			cmd.Name)), ExitError(1)
+	}
+
+	l, ok := h.resolveDevice(device)
+	if !ok {
+		return []byte(fmt.Sprintf("The file %s does not exist and no size was specified.\n", device)), ExitError(1)
+	}
+
+	h.nextUUID++
+	l.fstype = strings.TrimPrefix(cmd.Name, "mkfs.")
+	l.uuid = fmt.Sprintf("00000000-0000-4000-8000-%012d", h.nextUUID)
+	return nil, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sync"
+
+	"github.com/netapp/trident/utils"
+)
+
+// Handler emulates an external command, returning what the command would have written to stdout and stderr.
+type Handler func(ctx context.Context, cmd utils.Command) ([]byte, error)
+
+// Call is a command run by a FakeExecutor, with the operation it was run for, if any.
+type Call struct {
+	utils.Command
+	Operation string
+}
+
+type operationKey struct{}
+
+// WithOperation returns a context under which the commands a FakeExecutor runs are recorded as part of the named
+// operation, such as "attach".
+func WithOperation(ctx context.Context, operation string) context.Context {
+	return context.WithValue(ctx, operationKey{}, operation)
+}
+
+// FakeExecutor is a utils.Executor that dispatches commands to handlers by command name instead of running
+// them, and records every command it is asked to run.  Commands without a handler fail as if not installed.
+type FakeExecutor struct {
+	mutex    sync.Mutex
+	handlers map[string]Handler
+	calls    []Call
+}
+
+// NewFakeExecutor returns a FakeExecutor with no handlers.
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{handlers: make(map[string]Handler)}
+}
+
+// Handle registers the handler for a command, replacing any earlier one.
+func (e *FakeExecutor) Handle(name string, handler Handler) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.handlers[name] = handler
+}
+
+// Execute records the command and runs its handler.
+func (e *FakeExecutor) Execute(ctx context.Context, cmd utils.Command) ([]byte, error) {
+
+	operation, _ := ctx.Value(operationKey{}).(string)
+
+	e.mutex.Lock()
+	e.calls = append(e.calls, Call{Command: cmd, Operation: operation})
+	handler, ok := e.handlers[cmd.Name]
+	e.mutex.Unlock()
+
+	if !ok {
+		return nil, &exec.Error{Name: cmd.Name, Err: exec.ErrNotFound}
+	}
+	return handler(ctx, cmd)
+}
+
+// Calls returns the commands run so far, in order.
+func (e *FakeExecutor) Calls() []Call {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]Call(nil), e.calls...)
+}
+
+// OperationCounts returns how many times each command was run for the named operation.
+func (e *FakeExecutor) OperationCounts(operation string) map[string]int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	counts := make(map[string]int)
+	for _, call := range e.calls {
+		if call.Operation == operation {
+			counts[call.Name]++
+		}
+	}
+	return counts
+}
+
+// Count returns how many times the named command was run.
+func (e *FakeExecutor) Count(name string) int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	count := 0
+	for _, call := range e.calls {
+		if call.Name == name {
+			count++
+		}
+	}
+	return count
+}
+
+// Reset forgets the commands run so far.
+func (e *FakeExecutor) Reset() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.calls = nil
+}
+
+var exitErrors sync.Map
+
+// ExitError returns an *exec.ExitError with the specified exit status, as the utils package inspects exit
+// statuses through that type.  An ExitError can only come from a real process, so one is made the first time
+// each status is needed by running a trivial shell command.
+func ExitError(status int) error {
+
+	if err, ok := exitErrors.Load(status); ok {
+		return err.(error)
+	}
+
+	err := exec.Command("sh", "-c", fmt.Sprintf("exit %d", status)).Run()
+	if _, ok := err.(*exec.ExitError); !ok {
+		panic(fmt.Sprintf("could not make exit status %d; %v", status, err))
+	}
+	exitErrors.Store(status, err)
+	return err
+}
@@ -0,0 +1,690 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package simulation
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netapp/trident/utils"
+)
+
+const (
+	iscsiErrTransTimeout = 8
+	iscsiErrSessExists   = 15
+	iscsiErrNoObjsFound  = 21
+	iscsiDefaultPort     = "3260"
+	kernelPollInterval   = 5 * time.Millisecond
+	firstISCSIHostNumber = 2
+	multipathdPID        = "1234"
+)
+
+// Host simulates the parts of a Linux iSCSI initiator host that the utils package depends on.  It keeps a
+// sysfs and /dev tree under Root, which is used as the utils package's host root, and emulates iscsiadm,
+// multipath, multipathd, blkid, dd and mkfs through its Executor.  A background loop plays the kernel's part,
+// acting on LUN scans and device deletions written to sysfs.
+//
+// Logging in to a target creates devices for every LUN then mapped on it, as a kernel that ignores manual
+// scanning would; LUNs mapped later appear only when scanned.  multipathd, if running, assembles a multipath
+// device as soon as a LUN has two paths.
+type Host struct {
+	// Root is the directory holding the simulated host's sysfs and /dev trees
+	Root string
+	// Executor emulates the host's commands
+	Executor *FakeExecutor
+
+	mutex          sync.Mutex
+	multipathd     bool
+	targets        map[string]*target
+	luns           map[string]*lun
+	nodes          map[string]bool
+	sessions       map[int]*session
+	nextSession    int
+	nextHost       int
+	nextDisk       int
+	nextDM         int
+	nextUUID       int
+	portalFaults   map[string]*portalFaults
+	formatFailures int
+	stop           chan struct{}
+	stopped        chan struct{}
+}
+
+type target struct {
+	iqn     string
+	portals []string
+	luns    map[int]*lun
+}
+
+type lun struct {
+	serial    string
+	fstype    string
+	uuid      string
+	paths     []*scsiPath
+	multipath *multipathDevice
+}
+
+type multipathDevice struct {
+	name  string
+	alias string
+}
+
+type session struct {
+	id     int
+	host   int
+	target *target
+	portal string
+	paths  map[int]*scsiPath
+}
+
+type scsiPath struct {
+	session *session
+	lunID   int
+	lun     *lun
+	name    string
+}
+
+type portalFaults struct {
+	failures   int
+	flaps      int
+	slowLogins int
+	delay      time.Duration
+}
+
+// NewHost creates a simulated host with no targets, with multipathd running, and starts its kernel loop.
+// Close must be called to stop the loop and remove the host's files.
+func NewHost() (*Host, error) {
+
+	root, err := ioutil.TempDir("", "trident-simulation")
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Host{
+		Root:         root,
+		Executor:     NewFakeExecutor(),
+		multipathd:   true,
+		targets:      make(map[string]*target),
+		luns:         make(map[string]*lun),
+		nodes:        make(map[string]bool),
+		sessions:     make(map[int]*session),
+		nextSession:  1,
+		nextHost:     firstISCSIHostNumber,
+		nextDisk:     1,
+		portalFaults: make(map[string]*portalFaults),
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+
+	for _, dir := range []string{
+		"sys/class/iscsi_session", "sys/class/iscsi_host", "sys/class/scsi_host", "sys/block",
+		"sys/devices/platform", "dev/mapper", "proc",
+	} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			_ = os.RemoveAll(root)
+			return nil, err
+		}
+	}
+
+	h.Executor.Handle("iscsiadm", h.iscsiadm)
+	h.Executor.Handle("multipath", h.multipath)
+	h.Executor.Handle("multipathd", h.multipathdCommand)
+	h.Executor.Handle("pgrep", h.pgrep)
+	h.Executor.Handle("blkid", h.blkid)
+	h.Executor.Handle("dd", h.dd)
+	h.Executor.Handle("mkfs.ext3", h.mkfs)
+	h.Executor.Handle("mkfs.ext4", h.mkfs)
+	h.Executor.Handle("mkfs.xfs", h.mkfs)
+	for _, name := range []string{"blockdev", "ls", "lsscsi"} {
+		h.Executor.Handle(name, func(context.Context, utils.Command) ([]byte, error) { return nil, nil })
+	}
+
+	go h.runKernel()
+
+	return h, nil
+}
+
+// Close stops the kernel loop and removes the host's files.
+func (h *Host) Close() error {
+	close(h.stop)
+	<-h.stopped
+	return os.RemoveAll(h.Root)
+}
+
+// Config returns a utils configuration that directs the utils package at the simulated host.
+func (h *Host) Config() utils.Config {
+	return utils.Config{HostRoot: h.Root, Executor: h.Executor}
+}
+
+// SetMultipathd starts or stops the simulated multipathd.  Existing multipath devices are unaffected.
+func (h *Host) SetMultipathd(running bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.multipathd = running
+}
+
+// AddTarget adds a target reachable through the specified portals.  Portals without a port use 3260.
+func (h *Host) AddTarget(iqn string, portals ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	t := &target{iqn: iqn, luns: make(map[int]*lun)}
+	for _, portal := range portals {
+		t.portals = append(t.portals, formatPortal(portal))
+	}
+	h.targets[iqn] = t
+}
+
+// MapLUN maps the LUN with the specified serial number to a target under the specified LUN number.  The same
+// serial number may be mapped to several targets, in which case their paths lead to the same LUN.
+func (h *Host) MapLUN(iqn string, lunID int, serial string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	t, ok := h.targets[iqn]
+	if !ok {
+		return fmt.Errorf("no target %s", iqn)
+	}
+	l, ok := h.luns[serial]
+	if !ok {
+		l = &lun{serial: serial}
+		h.luns[serial] = l
+	}
+	t.luns[lunID] = l
+	return nil
+}
+
+// Login establishes a session to a target through a portal directly, as if it had been established before the
+// utils package was asked to attach anything.
+func (h *Host) Login(iqn, portal string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	t, ok := h.targets[iqn]
+	if !ok {
+		return fmt.Errorf("no target %s", iqn)
+	}
+	portal = formatPortal(portal)
+	h.nodes[nodeKey(iqn, portal)] = true
+	return h.createSession(t, portal)
+}
+
+// FailLogins makes the next count logins through a portal fail as if the portal were unreachable.
+func (h *Host) FailLogins(portal string, count int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.faults(portal).failures = count
+}
+
+// FlapLogins makes the next count logins through a portal report success, but lose the session immediately,
+// as when a path flaps during login.
+func (h *Host) FlapLogins(portal string, count int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.faults(portal).flaps = count
+}
+
+// DelayLogins makes the next count logins through a portal take the specified time.  A login that takes longer
+// than the command's timeout is killed.
+func (h *Host) DelayLogins(portal string, delay time.Duration, count int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	f := h.faults(portal)
+	f.delay = delay
+	f.slowLogins = count
+}
+
+// FailFormats makes the next count mkfs runs fail; a negative count makes every run fail.
+func (h *Host) FailFormats(count int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.formatFailures = count
+}
+
+// Sessions returns the host's sessions, each as "portal iqn", in order of creation.
+func (h *Host) Sessions() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sessions := make([]string, 0)
+	for _, s := range h.sortedSessions() {
+		sessions = append(sessions, s.portal+" "+s.target.iqn)
+	}
+	return sessions
+}
+
+// Paths returns the names of the SCSI disks through which the LUN with the specified serial number is attached.
+func (h *Host) Paths(serial string) []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	paths := make([]string, 0)
+	if l, ok := h.luns[serial]; ok {
+		for _, p := range l.paths {
+			paths = append(paths, p.name)
+		}
+	}
+	return paths
+}
+
+// MultipathDevice returns the /dev/mapper path of the LUN's multipath device, or "" if it has none.
+func (h *Host) MultipathDevice(serial string) string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if l, ok := h.luns[serial]; ok && l.multipath != nil {
+		return "/dev/mapper/" + l.multipath.alias
+	}
+	return ""
+}
+
+// Filesystem returns the type of the filesystem on the LUN, or "" if it is unformatted.
+func (h *Host) Filesystem(serial string) string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if l, ok := h.luns[serial]; ok {
+		return l.fstype
+	}
+	return ""
+}
+
+// PublishInfo returns the publish info for the LUN mapped to a target under the specified LUN number, as a
+// storage driver would provide it.  The first of the target's portals is the primary portal.
+func (h *Host) PublishInfo(iqn string, lunID int, fstype string) *utils.VolumePublishInfo {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	info := &utils.VolumePublishInfo{FilesystemType: fstype}
+	info.IscsiTargetIQN = iqn
+	info.IscsiLunNumber = int32(lunID)
+	if t, ok := h.targets[iqn]; ok {
+		if len(t.portals) > 0 {
+			info.IscsiTargetPortal = t.portals[0]
+			info.IscsiPortals = append([]string(nil), t.portals[1:]...)
+		}
+		if l, ok := t.luns[lunID]; ok {
+			info.IscsiLunSerial = l.serial
+		}
+	}
+	return info
+}
+
+func (h *Host) faults(portal string) *portalFaults {
+	portal = formatPortal(portal)
+	f, ok := h.portalFaults[portal]
+	if !ok {
+		f = &portalFaults{}
+		h.portalFaults[portal] = f
+	}
+	return f
+}
+
+func (h *Host) sortedSessions() []*session {
+	sessions := make([]*session, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+	return sessions
+}
+
+func (h *Host) findSession(iqn, portal string) *session {
+	for _, s := range h.sessions {
+		if s.target.iqn == iqn && s.portal == portal {
+			return s
+		}
+	}
+	return nil
+}
+
+// Paths within the simulated sysfs, relative to Root
+
+func (s *session) hostDir() string {
+	return fmt.Sprintf("sys/devices/platform/host%d", s.host)
+}
+
+func (s *session) sessionDir() string {
+	return fmt.Sprintf("%s/session%d", s.hostDir(), s.id)
+}
+
+func (s *session) targetDir() string {
+	return fmt.Sprintf("%s/target%d:0:0", s.sessionDir(), s.host)
+}
+
+func (p *scsiPath) lunDir() string {
+	return fmt.Sprintf("%s/%d:0:0:%d", p.session.targetDir(), p.session.host, p.lunID)
+}
+
+func (h *Host) path(relative string) string {
+	return filepath.Join(h.Root, relative)
+}
+
+func (h *Host) mkdir(relative string) error {
+	return os.MkdirAll(h.path(relative), 0755)
+}
+
+func (h *Host) writeFile(relative, content string) error {
+	return ioutil.WriteFile(h.path(relative), []byte(content), 0644)
+}
+
+func (h *Host) symlink(target, relative string) error {
+	return os.Symlink(target, h.path(relative))
+}
+
+// createSession adds a session and its sysfs entries, laid out as the kernel lays them out for software iSCSI,
+// with one SCSI host per session.
+func (h *Host) createSession(t *target, portal string) error {
+
+	s := &session{id: h.nextSession, host: h.nextHost, target: t, portal: portal, paths: make(map[int]*scsiPath)}
+	h.nextSession++
+	h.nextHost++
+
+	sessionName := fmt.Sprintf("session%d", s.id)
+	hostName := fmt.Sprintf("host%d", s.host)
+	iscsiSessionDir := s.sessionDir() + "/iscsi_session/" + sessionName
+
+	steps := []func() error{
+		func() error { return h.mkdir(iscsiSessionDir) },
+		func() error { return h.mkdir(s.targetDir()) },
+		func() error { return h.writeFile(iscsiSessionDir+"/targetname", t.iqn+"\n") },
+		func() error { return h.writeFile(iscsiSessionDir+"/state", "LOGGED_IN\n") },
+		func() error { return h.symlink("../..", iscsiSessionDir+"/device") },
+		func() error {
+			return h.symlink("../../devices/platform/"+hostName+"/"+sessionName+"/iscsi_session/"+sessionName,
+				"sys/class/iscsi_session/"+sessionName)
+		},
+		func() error { return h.mkdir("sys/class/iscsi_host/" + hostName) },
+		func() error {
+			return h.symlink("../../../devices/platform/"+hostName, "sys/class/iscsi_host/"+hostName+"/device")
+		},
+		func() error { return h.mkdir("sys/class/scsi_host/" + hostName) },
+		func() error {
+			return h.symlink("../../../devices/platform/"+hostName, "sys/class/scsi_host/"+hostName+"/device")
+		},
+		func() error { return h.writeFile("sys/class/scsi_host/"+hostName+"/scan", "") },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	h.sessions[s.id] = s
+
+	for lunID := range t.luns {
+		if err := h.addPath(s, lunID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSession removes a session, its paths, and its sysfs entries.
+func (h *Host) removeSession(s *session) error {
+
+	for _, p := range s.paths {
+		if err := h.removePath(p); err != nil {
+			return err
+		}
+	}
+
+	hostName := fmt.Sprintf("host%d", s.host)
+	for _, relative := range []string{
+		fmt.Sprintf("sys/class/iscsi_session/session%d", s.id),
+		"sys/class/iscsi_host/" + hostName,
+		"sys/class/scsi_host/" + hostName,
+		s.hostDir(),
+	} {
+		if err := os.RemoveAll(h.path(relative)); err != nil {
+			return err
+		}
+	}
+
+	delete(h.sessions, s.id)
+	return nil
+}
+
+// addPath adds a SCSI disk for a LUN on a session, unless the session already has one.
+func (h *Host) addPath(s *session, lunID int) error {
+
+	l, ok := s.target.luns[lunID]
+	if !ok {
+		return nil
+	}
+	if _, ok := s.paths[lunID]; ok {
+		return nil
+	}
+
+	p := &scsiPath{session: s, lunID: lunID, lun: l, name: "sd" + diskLetters(h.nextDisk)}
+	h.nextDisk++
+
+	blockDir := p.lunDir() + "/block/" + p.name
+
+	// VPD page 80: a 4-byte header, with the page length in bytes 2-3, followed by the serial number
+	vpd := make([]byte, 4+len(l.serial))
+	vpd[1] = 0x80
+	binary.BigEndian.PutUint16(vpd[2:4], uint16(len(l.serial)))
+	copy(vpd[4:], l.serial)
+
+	steps := []func() error{
+		func() error { return h.mkdir(blockDir + "/holders") },
+		func() error { return h.symlink("../..", blockDir+"/device") },
+		func() error { return h.writeFile(p.lunDir()+"/vpd_pg80", string(vpd)) },
+		func() error { return h.writeFile(p.lunDir()+"/delete", "") },
+		func() error { return h.writeFile(p.lunDir()+"/rescan", "") },
+		func() error { return h.symlink("../"+strings.TrimPrefix(blockDir, "sys/"), "sys/block/"+p.name) },
+		func() error { return h.writeFile("dev/"+p.name, "") },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	s.paths[lunID] = p
+	l.paths = append(l.paths, p)
+
+	return h.assembleMultipath(l)
+}
+
+// removePath removes a SCSI disk, as the kernel does when the disk is deleted or its session ends.
+func (h *Host) removePath(p *scsiPath) error {
+
+	if l := p.lun; l.multipath != nil {
+		if err := os.RemoveAll(h.path("sys/block/" + l.multipath.name + "/slaves/" + p.name)); err != nil {
+			return err
+		}
+	}
+	for _, relative := range []string{p.lunDir(), "sys/block/" + p.name, "dev/" + p.name} {
+		if err := os.RemoveAll(h.path(relative)); err != nil {
+			return err
+		}
+	}
+
+	delete(p.session.paths, p.lunID)
+	for i, other := range p.lun.paths {
+		if other == p {
+			p.lun.paths = append(p.lun.paths[:i], p.lun.paths[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// assembleMultipath creates the LUN's multipath device once it has two paths, if multipathd is running, and adds
+// any new paths to an existing one.
+func (h *Host) assembleMultipath(l *lun) error {
+
+	if l.multipath == nil {
+		if !h.multipathd || len(l.paths) < 2 {
+			return nil
+		}
+
+		m := &multipathDevice{name: fmt.Sprintf("dm-%d", h.nextDM), alias: "mpath" + diskLetters(h.nextDM)}
+		h.nextDM++
+
+		dmDir := "sys/block/" + m.name
+		steps := []func() error{
+			func() error { return h.mkdir(dmDir + "/dm") },
+			func() error { return h.mkdir(dmDir + "/slaves") },
+			func() error { return h.mkdir(dmDir + "/holders") },
+			func() error { return h.writeFile(dmDir+"/dm/name", m.alias+"\n") },
+			func() error { return h.writeFile(dmDir+"/dm/uuid", "mpath-"+l.serial+"\n") },
+			func() error { return h.writeFile("dev/"+m.name, "") },
+			func() error { return h.symlink("../"+m.name, "dev/mapper/"+m.alias) },
+		}
+		for _, step := range steps {
+			if err := step(); err != nil {
+				return err
+			}
+		}
+		l.multipath = m
+	}
+
+	dmDir := "sys/block/" + l.multipath.name
+	for _, p := range l.paths {
+		if _, err := os.Lstat(h.path(dmDir + "/slaves/" + p.name)); err == nil {
+			continue
+		}
+		if err := h.symlink("../../"+p.name, dmDir+"/slaves/"+p.name); err != nil {
+			return err
+		}
+		holders := p.lunDir() + "/block/" + p.name + "/holders"
+		dmPath, err := filepath.Rel(holders, dmDir)
+		if err != nil {
+			return err
+		}
+		if err := h.symlink(dmPath, holders+"/"+l.multipath.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeMultipath removes the LUN's multipath device, as multipath -f does.
+func (h *Host) removeMultipath(l *lun) error {
+
+	m := l.multipath
+	for _, p := range l.paths {
+		if err := os.RemoveAll(h.path("sys/block/" + p.name + "/holders/" + m.name)); err != nil {
+			return err
+		}
+	}
+	for _, relative := range []string{"sys/block/" + m.name, "dev/" + m.name, "dev/mapper/" + m.alias} {
+		if err := os.RemoveAll(h.path(relative)); err != nil {
+			return err
+		}
+	}
+	l.multipath = nil
+	return nil
+}
+
+// runKernel acts on LUN scans and device deletions written to sysfs until the host is closed.
+func (h *Host) runKernel() {
+
+	defer close(h.stopped)
+
+	ticker := time.NewTicker(kernelPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.mutex.Lock()
+			h.processScans()
+			h.processDeletes()
+			h.mutex.Unlock()
+		}
+	}
+}
+
+// processScans adds the devices requested by writes to each SCSI host's scan file, which take the form
+// "channel target lun", with "-" as a wildcard.
+func (h *Host) processScans() {
+
+	for _, s := range h.sortedSessions() {
+		scanFile := h.path(fmt.Sprintf("sys/class/scsi_host/host%d/scan", s.host))
+		content, err := ioutil.ReadFile(scanFile)
+		if err != nil || len(content) == 0 {
+			continue
+		}
+		_ = ioutil.WriteFile(scanFile, nil, 0644)
+
+		fields := strings.Fields(string(content))
+		if len(fields) < 3 {
+			continue
+		}
+		for lunID := range s.target.luns {
+			if fields[2] == "-" || fields[2] == strconv.Itoa(lunID) {
+				_ = h.addPath(s, lunID)
+			}
+		}
+	}
+}
+
+// processDeletes removes the devices whose delete files have been written.
+func (h *Host) processDeletes() {
+
+	for _, s := range h.sortedSessions() {
+		for _, p := range s.paths {
+			if content, err := ioutil.ReadFile(h.path(p.lunDir() + "/delete")); err == nil && len(content) > 0 {
+				_ = h.removePath(p)
+			}
+		}
+	}
+}
+
+// resolveDevice returns the LUN behind a device path such as /dev/sdb, /dev/dm-0 or /dev/mapper/mpatha.
+func (h *Host) resolveDevice(device string) (*lun, bool) {
+
+	name := filepath.Base(device)
+	if resolved, err := filepath.EvalSymlinks(h.path(device)); err == nil {
+		name = filepath.Base(resolved)
+	}
+
+	for _, l := range h.luns {
+		if l.multipath != nil && l.multipath.name == name {
+			return l, true
+		}
+		for _, p := range l.paths {
+			if p.name == name {
+				return l, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func nodeKey(iqn, portal string) string {
+	return iqn + " " + portal
+}
+
+// formatPortal appends the default iSCSI port to a portal without one.
+func formatPortal(portal string) string {
+	if _, _, err := net.SplitHostPort(portal); err == nil {
+		return portal
+	}
+	return net.JoinHostPort(strings.Trim(portal, "[]"), iscsiDefaultPort)
+}
+
+// diskLetters returns the suffix the kernel gives the nth disk: a, b, ..., z, aa, ab, ...
+func diskLetters(n int) string {
+	letters := ""
+	for n++; n > 0; n = (n - 1) / 26 {
+		letters = string(rune('a'+(n-1)%26)) + letters
+	}
+	return letters
+}
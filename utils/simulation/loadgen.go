@@ -0,0 +1,239 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netapp/trident/utils"
+)
+
+const (
+	OperationAttach = "attach"
+	OperationDetach = "detach"
+)
+
+// LoadConfig describes a load run against a simulated host.
+type LoadConfig struct {
+	// Volumes is the number of volumes attached, then detached
+	Volumes int
+	// Concurrency is the number of attaches or detaches in flight at once; zero runs every one at once
+	Concurrency int
+	// Portals is the number of portals through which each volume is reachable; zero means one
+	Portals int
+	// FilesystemType is the filesystem type of every volume; empty means raw block volumes
+	FilesystemType string
+}
+
+// OperationStats summarizes the runs of one operation during a load run.
+type OperationStats struct {
+	Operation string
+	Failures  int
+	// Latencies holds the duration of every run, shortest first
+	Latencies []time.Duration
+	// Execs holds how many times each command was run for the operation, over all its runs
+	Execs map[string]int
+}
+
+// Count returns the number of runs of the operation.
+func (s *OperationStats) Count() int {
+	return len(s.Latencies)
+}
+
+// Percentile returns the latency below which the specified fraction of runs completed, such as 0.99.
+func (s *OperationStats) Percentile(fraction float64) time.Duration {
+	if len(s.Latencies) == 0 {
+		return 0
+	}
+	index := int(fraction*float64(len(s.Latencies))+0.5) - 1
+	if index < 0 {
+		index = 0
+	} else if index >= len(s.Latencies) {
+		index = len(s.Latencies) - 1
+	}
+	return s.Latencies[index]
+}
+
+// ExecsPerRun returns the average number of commands run per run of the operation.
+func (s *OperationStats) ExecsPerRun() float64 {
+	if len(s.Latencies) == 0 {
+		return 0
+	}
+	total := 0
+	for _, count := range s.Execs {
+		total += count
+	}
+	return float64(total) / float64(len(s.Latencies))
+}
+
+// LoadReport is the outcome of a load run.
+type LoadReport struct {
+	Config  LoadConfig
+	Elapsed time.Duration
+	Attach  *OperationStats
+	Detach  *OperationStats
+}
+
+// String formats the report as a table of latencies, followed by the commands run per operation.
+func (r *LoadReport) String() string {
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d volumes, concurrency %d, %d portal(s), %s, in %v\n", r.Config.Volumes,
+		r.Config.Concurrency, r.Config.Portals, r.Config.FilesystemType, r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(&b, "%-8s %6s %6s %10s %10s %10s %10s %10s %10s\n", "op", "runs", "failed", "min", "p50",
+		"p90", "p99", "max", "execs/op")
+
+	for _, stats := range []*OperationStats{r.Attach, r.Detach} {
+		if stats.Count() == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "%-8s %6d %6d %10v %10v %10v %10v %10v %10.1f\n", stats.Operation, stats.Count(),
+			stats.Failures, roundLatency(stats.Latencies[0]), roundLatency(stats.Percentile(0.5)),
+			roundLatency(stats.Percentile(0.9)), roundLatency(stats.Percentile(0.99)),
+			roundLatency(stats.Latencies[stats.Count()-1]), stats.ExecsPerRun())
+	}
+
+	for _, stats := range []*OperationStats{r.Attach, r.Detach} {
+		names := make([]string, 0, len(stats.Execs))
+		for name := range stats.Execs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		execs := make([]string, 0, len(names))
+		for _, name := range names {
+			execs = append(execs, fmt.Sprintf("%s=%d", name, stats.Execs[name]))
+		}
+		fmt.Fprintf(&b, "%s execs: %s\n", stats.Operation, strings.Join(execs, " "))
+	}
+
+	return b.String()
+}
+
+// Load attaches volumes to a new simulated host, as many at once as the configuration allows, then detaches
+// them all the same way, and reports the latency of each attach and detach and the commands each ran.  Each
+// volume is on its own target, so a detach logs out of the target as a node does for unshared targets.  Like
+// Run, Load configures the utils package for the host, so it must not run concurrently with other simulations.
+func Load(ctx context.Context, config LoadConfig) (*LoadReport, error) {
+
+	if config.Volumes < 1 {
+		return nil, fmt.Errorf("at least one volume is required")
+	}
+	if config.Concurrency < 1 || config.Concurrency > config.Volumes {
+		config.Concurrency = config.Volumes
+	}
+	if config.Portals < 1 {
+		config.Portals = 1
+	}
+	if config.FilesystemType == "" {
+		config.FilesystemType = "raw"
+	}
+
+	h, err := NewHost()
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+
+	portals := make([]string, config.Portals)
+	for i := range portals {
+		portals[i] = fmt.Sprintf("10.0.1.%d", i+1)
+	}
+
+	volumes := make([]*utils.VolumePublishInfo, config.Volumes)
+	for i := range volumes {
+		iqn := fmt.Sprintf("iqn.1992-08.com.netapp:sn.simulation:vs.load%d", i)
+		h.AddTarget(iqn, portals...)
+		if err := h.MapLUN(iqn, 0, fmt.Sprintf("load%08d", i)); err != nil {
+			return nil, err
+		}
+		volumes[i] = h.PublishInfo(iqn, 0, config.FilesystemType)
+	}
+
+	if err := utils.Init(h.Config()); err != nil {
+		return nil, err
+	}
+	defer func() { _ = utils.Init(utils.Config{}) }()
+
+	start := time.Now()
+	report := &LoadReport{Config: config}
+
+	report.Attach = runOperation(ctx, OperationAttach, volumes, config.Concurrency,
+		func(ctx context.Context, i int, publishInfo *utils.VolumePublishInfo) error {
+			return utils.AttachISCSIVolume(ctx, fmt.Sprintf("load%d", i), "", publishInfo)
+		})
+	report.Detach = runOperation(ctx, OperationDetach, volumes, config.Concurrency,
+		func(ctx context.Context, _ int, publishInfo *utils.VolumePublishInfo) error {
+			return detachVolume(ctx, publishInfo)
+		})
+
+	report.Elapsed = time.Since(start)
+	report.Attach.Execs = h.Executor.OperationCounts(OperationAttach)
+	report.Detach.Execs = h.Executor.OperationCounts(OperationDetach)
+
+	return report, nil
+}
+
+// runOperation runs an operation on every volume, with at most concurrency runs in flight, and times each run.
+func runOperation(
+	ctx context.Context, operation string, volumes []*utils.VolumePublishInfo, concurrency int,
+	run func(context.Context, int, *utils.VolumePublishInfo) error,
+) *OperationStats {
+
+	stats := &OperationStats{Operation: operation, Latencies: make([]time.Duration, 0, len(volumes))}
+	ctx = WithOperation(ctx, operation)
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+
+	for i, publishInfo := range volumes {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, publishInfo *utils.VolumePublishInfo) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			start := time.Now()
+			err := run(ctx, i, publishInfo)
+			latency := time.Since(start)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			stats.Latencies = append(stats.Latencies, latency)
+			if err != nil {
+				stats.Failures++
+			}
+		}(i, publishInfo)
+	}
+	wg.Wait()
+
+	sort.Slice(stats.Latencies, func(i, j int) bool { return stats.Latencies[i] < stats.Latencies[j] })
+	return stats
+}
+
+// detachVolume removes a volume's devices and logs out of its target, as a node unstaging a volume on an
+// unshared target does.
+func detachVolume(ctx context.Context, publishInfo *utils.VolumePublishInfo) error {
+
+	err := utils.PrepareDeviceForRemoval(ctx, int(publishInfo.IscsiLunNumber), publishInfo.IscsiTargetIQN, false)
+	if err != nil {
+		return err
+	}
+	for _, portal := range append([]string{publishInfo.IscsiTargetPortal}, publishInfo.IscsiPortals...) {
+		if err := utils.ISCSILogout(ctx, publishInfo.IscsiTargetIQN, portal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func roundLatency(latency time.Duration) time.Duration {
+	return latency.Round(100 * time.Microsecond)
+}
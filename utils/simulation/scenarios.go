@@ -0,0 +1,253 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/netapp/trident/utils"
+)
+
+const (
+	simTargetIQN = "iqn.1992-08.com.netapp:sn.simulation:vs.1"
+	simPortalA   = "10.0.0.1"
+	simPortalB   = "10.0.0.2"
+	simSerial    = "80BsT?Oq8/Ap"
+)
+
+// Scenario scripts the behaviour of a simulated host while a volume is attached to it.
+type Scenario struct {
+	Name        string
+	Description string
+	// Long marks scenarios that take tens of seconds, as they wait out the utils package's retry limits
+	Long bool
+	// Setup shapes the host and returns the publish info of the volume to attach
+	Setup func(h *Host) (*utils.VolumePublishInfo, error)
+	// Configure adjusts the utils package's configuration, if set
+	Configure func(config *utils.Config)
+	// Verify checks the outcome of the attach
+	Verify func(h *Host, publishInfo *utils.VolumePublishInfo, attachErr error) error
+}
+
+// Run attaches a volume to a new simulated host as the scenario directs and verifies the outcome.  It configures
+// the utils package for the host, so scenarios must not be run concurrently, and leaves it with the default
+// configuration.
+func Run(ctx context.Context, scenario Scenario) error {
+
+	h, err := NewHost()
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	publishInfo, err := scenario.Setup(h)
+	if err != nil {
+		return fmt.Errorf("scenario %s setup failed; %v", scenario.Name, err)
+	}
+
+	config := h.Config()
+	if scenario.Configure != nil {
+		scenario.Configure(&config)
+	}
+	if err := utils.Init(config); err != nil {
+		return err
+	}
+	defer func() { _ = utils.Init(utils.Config{}) }()
+
+	attachErr := utils.AttachISCSIVolume(ctx, scenario.Name, "", publishInfo)
+
+	if err := scenario.Verify(h, publishInfo, attachErr); err != nil {
+		return fmt.Errorf("scenario %s failed; %v", scenario.Name, err)
+	}
+	return nil
+}
+
+// Scenarios returns the standard scenarios.
+func Scenarios() []Scenario {
+	return []Scenario{
+		{
+			Name:        "single-path",
+			Description: "Attach a raw block volume through one portal.",
+			Setup:       setupTarget(simPortalA),
+			Verify: func(h *Host, publishInfo *utils.VolumePublishInfo, attachErr error) error {
+				if attachErr != nil {
+					return attachErr
+				}
+				paths := h.Paths(simSerial)
+				if len(paths) != 1 {
+					return fmt.Errorf("expected 1 path, found %v", paths)
+				}
+				return expectDevicePath(publishInfo, "/dev/"+paths[0])
+			},
+		},
+		{
+			Name:        "multipath",
+			Description: "Attach and format a volume through two portals, using the multipath device.",
+			Setup:       setupFilesystemTarget("ext4", simPortalA, simPortalB),
+			Verify:      verifyFormattedMultipath("ext4"),
+		},
+		{
+			Name:        "late-lun-scan",
+			Description: "Attach a volume mapped after the session to its target was established, which must be scanned.",
+			Setup: func(h *Host) (*utils.VolumePublishInfo, error) {
+				h.AddTarget(simTargetIQN, simPortalA)
+				if err := h.Login(simTargetIQN, simPortalA); err != nil {
+					return nil, err
+				}
+				if err := h.MapLUN(simTargetIQN, 1, simSerial); err != nil {
+					return nil, err
+				}
+				return h.PublishInfo(simTargetIQN, 1, "raw"), nil
+			},
+			Verify: func(h *Host, publishInfo *utils.VolumePublishInfo, attachErr error) error {
+				if attachErr != nil {
+					return attachErr
+				}
+				if sessions := h.Sessions(); len(sessions) != 1 {
+					return fmt.Errorf("expected the existing session to be reused, found %v", sessions)
+				}
+				return expectPaths(h, 1)
+			},
+		},
+		{
+			Name:        "path-flap",
+			Description: "One portal's session drops right after login, so the login must be retried.",
+			Setup: func(h *Host) (*utils.VolumePublishInfo, error) {
+				publishInfo, err := setupFilesystemTarget("xfs", simPortalA, simPortalB)(h)
+				h.FlapLogins(simPortalB, 1)
+				return publishInfo, err
+			},
+			Verify: func(h *Host, publishInfo *utils.VolumePublishInfo, attachErr error) error {
+				if err := verifyFormattedMultipath("xfs")(h, publishInfo, attachErr); err != nil {
+					return err
+				}
+				return expectLogins(h, 3)
+			},
+		},
+		{
+			Name:        "slow-login",
+			Description: "A login outlives the login timeout and is killed, then succeeds on retry.",
+			Setup: func(h *Host) (*utils.VolumePublishInfo, error) {
+				publishInfo, err := setupTarget(simPortalA)(h)
+				h.DelayLogins(simPortalA, time.Minute, 1)
+				return publishInfo, err
+			},
+			Configure: func(config *utils.Config) {
+				config.ISCSILoginPolicy = utils.ISCSILoginPolicy{LoginTimeout: time.Second, MaxAttempts: 2}
+			},
+			Verify: func(h *Host, publishInfo *utils.VolumePublishInfo, attachErr error) error {
+				if attachErr != nil {
+					return attachErr
+				}
+				if err := expectPaths(h, 1); err != nil {
+					return err
+				}
+				return expectLogins(h, 2)
+			},
+		},
+		{
+			Name:        "format-failure",
+			Description: "The first attempt to create a filesystem fails, then succeeds on retry.",
+			Setup: func(h *Host) (*utils.VolumePublishInfo, error) {
+				publishInfo, err := setupFilesystemTarget("ext4", simPortalA, simPortalB)(h)
+				h.FailFormats(1)
+				return publishInfo, err
+			},
+			Verify: func(h *Host, publishInfo *utils.VolumePublishInfo, attachErr error) error {
+				if err := verifyFormattedMultipath("ext4")(h, publishInfo, attachErr); err != nil {
+					return err
+				}
+				if count := h.Executor.Count("mkfs.ext4"); count != 2 {
+					return fmt.Errorf("expected 2 format attempts, found %d", count)
+				}
+				return nil
+			},
+		},
+		{
+			Name:        "persistent-format-failure",
+			Description: "Every attempt to create a filesystem fails, so the attach fails once retries run out.",
+			Long:        true,
+			Setup: func(h *Host) (*utils.VolumePublishInfo, error) {
+				publishInfo, err := setupFilesystemTarget("ext4", simPortalA)(h)
+				h.FailFormats(-1)
+				return publishInfo, err
+			},
+			Verify: func(h *Host, publishInfo *utils.VolumePublishInfo, attachErr error) error {
+				if attachErr == nil {
+					return fmt.Errorf("expected the attach to fail")
+				}
+				if fstype := h.Filesystem(simSerial); fstype != "" {
+					return fmt.Errorf("expected no filesystem, found %s", fstype)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// setupTarget returns a setup function that adds the simulation target, reachable through the specified
+// portals, with one LUN mapped, and returns a raw block volume on that LUN.
+func setupTarget(portals ...string) func(h *Host) (*utils.VolumePublishInfo, error) {
+	return setupFilesystemTarget("raw", portals...)
+}
+
+// setupFilesystemTarget is setupTarget for a volume with the specified filesystem type.
+func setupFilesystemTarget(fstype string, portals ...string) func(h *Host) (*utils.VolumePublishInfo, error) {
+	return func(h *Host) (*utils.VolumePublishInfo, error) {
+		h.AddTarget(simTargetIQN, portals...)
+		if err := h.MapLUN(simTargetIQN, 1, simSerial); err != nil {
+			return nil, err
+		}
+		return h.PublishInfo(simTargetIQN, 1, fstype), nil
+	}
+}
+
+// verifyFormattedMultipath returns a verify function that checks that the attach succeeded through two paths
+// combined under a multipath device holding a filesystem of the specified type.
+func verifyFormattedMultipath(fstype string) func(*Host, *utils.VolumePublishInfo, error) error {
+	return func(h *Host, publishInfo *utils.VolumePublishInfo, attachErr error) error {
+		if attachErr != nil {
+			return attachErr
+		}
+		if err := expectPaths(h, 2); err != nil {
+			return err
+		}
+		if err := expectDevicePath(publishInfo, h.MultipathDevice(simSerial)); err != nil {
+			return err
+		}
+		if found := h.Filesystem(simSerial); found != fstype {
+			return fmt.Errorf("expected a %s filesystem, found %q", fstype, found)
+		}
+		return nil
+	}
+}
+
+func expectPaths(h *Host, count int) error {
+	if paths := h.Paths(simSerial); len(paths) != count {
+		return fmt.Errorf("expected %d paths, found %v", count, paths)
+	}
+	return nil
+}
+
+func expectDevicePath(publishInfo *utils.VolumePublishInfo, devicePath string) error {
+	if devicePath == "" || publishInfo.DevicePath != devicePath {
+		return fmt.Errorf("expected device path %q, found %q", devicePath, publishInfo.DevicePath)
+	}
+	return nil
+}
+
+// expectLogins checks the number of iscsiadm login commands run.
+func expectLogins(h *Host, count int) error {
+	logins := 0
+	for _, call := range h.Executor.Calls() {
+		if call.Name == "iscsiadm" && parseIscsiadmArgs(call.Args).login {
+			logins++
+		}
+	}
+	if logins != count {
+		return fmt.Errorf("expected %d logins, found %d", count, logins)
+	}
+	return nil
+}
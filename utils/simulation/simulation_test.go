@@ -0,0 +1,116 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package simulation
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	loadVolumes     = flag.Int("volumes", 0, "Run the load generator with this many volumes")
+	loadConcurrency = flag.Int("concurrency", 0, "Attach or detach this many volumes at once under load")
+	loadPortals     = flag.Int("portals", 1, "Reach each volume through this many portals under load")
+	loadFilesystem  = flag.String("fstype", "raw", "Filesystem type of each volume under load")
+)
+
+func TestScenarios(t *testing.T) {
+	for _, scenario := range Scenarios() {
+		t.Run(scenario.Name, func(t *testing.T) {
+			if scenario.Long && testing.Short() {
+				t.Skip("skipping long scenario in short mode")
+			}
+			assert.NoError(t, Run(context.TODO(), scenario))
+		})
+	}
+}
+
+func TestDiskLetters(t *testing.T) {
+	assert.Equal(t, "a", diskLetters(0))
+	assert.Equal(t, "z", diskLetters(25))
+	assert.Equal(t, "aa", diskLetters(26))
+	assert.Equal(t, "ba", diskLetters(52))
+}
+
+func TestParseIscsiadmArgs(t *testing.T) {
+	args := parseIscsiadmArgs([]string{"-m", "node", "-T", "iqn.x", "-p", "10.0.0.1", "--op=update",
+		"--name", "node.session.auth.authmethod", "--value=CHAP"})
+	assert.Equal(t, "node", args.mode)
+	assert.Equal(t, "iqn.x", args.target)
+	assert.Equal(t, "10.0.0.1:3260", args.portal)
+	assert.Equal(t, "update", args.op)
+	assert.False(t, args.login)
+}
+
+func TestLoad(t *testing.T) {
+	report, err := Load(context.TODO(), LoadConfig{Volumes: 4, Concurrency: 2, Portals: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, report.Attach.Count())
+	assert.Equal(t, 0, report.Attach.Failures)
+	assert.Equal(t, 4, report.Detach.Count())
+	assert.Equal(t, 0, report.Detach.Failures)
+	assert.NotZero(t, report.Attach.Execs["iscsiadm"])
+	assert.NotZero(t, report.Detach.Execs["multipath"])
+}
+
+// TestLoadGen runs the load generator when a number of volumes is given, and logs its report, as in
+// go test -v -run TestLoadGen ./utils/simulation -args -volumes=100 -concurrency=10
+func TestLoadGen(t *testing.T) {
+	if *loadVolumes == 0 {
+		t.Skip("no load requested")
+	}
+	report, err := Load(context.TODO(), LoadConfig{
+		Volumes:        *loadVolumes,
+		Concurrency:    *loadConcurrency,
+		Portals:        *loadPortals,
+		FilesystemType: *loadFilesystem,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	t.Log(report)
+	assert.Zero(t, report.Attach.Failures+report.Detach.Failures, "operations failed under load")
+}
+
+func TestPercentile(t *testing.T) {
+	stats := &OperationStats{}
+	assert.Equal(t, time.Duration(0), stats.Percentile(0.5))
+
+	for i := 1; i <= 100; i++ {
+		stats.Latencies = append(stats.Latencies, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, time.Millisecond, stats.Percentile(0))
+	assert.Equal(t, 50*time.Millisecond, stats.Percentile(0.5))
+	assert.Equal(t, 99*time.Millisecond, stats.Percentile(0.99))
+	assert.Equal(t, 100*time.Millisecond, stats.Percentile(1))
+}
+
+func BenchmarkLoad(b *testing.B) {
+	for _, config := range []LoadConfig{
+		{Concurrency: 1, Portals: 1, FilesystemType: "raw"},
+		{Concurrency: 1, Portals: 2, FilesystemType: "ext4"},
+		{Concurrency: 8, Portals: 2, FilesystemType: "ext4"},
+	} {
+		name := fmt.Sprintf("%s-%dportals-concurrency%d", config.FilesystemType, config.Portals, config.Concurrency)
+		b.Run(name, func(b *testing.B) {
+			config.Volumes = b.N
+			report, err := Load(context.TODO(), config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, stats := range []*OperationStats{report.Attach, report.Detach} {
+				if stats.Failures > 0 {
+					b.Fatalf("%d of %d %s operations failed", stats.Failures, stats.Count(), stats.Operation)
+				}
+				b.ReportMetric(float64(stats.Percentile(0.5))/float64(time.Millisecond), stats.Operation+"-p50-ms")
+				b.ReportMetric(float64(stats.Percentile(0.99))/float64(time.Millisecond), stats.Operation+"-p99-ms")
+				b.ReportMetric(stats.ExecsPerRun(), stats.Operation+"-execs/op")
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// Filesystems that aren't mounted anywhere, such as those of staged block volumes, are mounted temporarily to grow
+// them.  Each such mount gets a mountpoint of its own, with a random suffix, so that concurrent operations never
+// share one.  A relative temporary mount directory names mountpoints beneath each volume's staging path, while an
+// absolute one holds the mountpoints of all volumes, each prefixed with the SHA-256 hash of its volume's staging
+// path so that the mountpoints a crash leaves behind can be found again from the staging path alone.
+//
+// A filesystem examined before its volume has a staging path, such as one found on a LUN being attached, is
+// mounted in the absolute temporary mount directory, or in a fixed host directory if it's relative.  Since these
+// mountpoints are made in the host's mount namespace, they're created through the host's root.
+
+const (
+	defaultTemporaryMountDir = "tmp_mnt"
+	// legacyTemporaryMountDir is the fixed mountpoint, beneath the staging path, that earlier releases used
+	legacyTemporaryMountDir = "tmp_mnt"
+	// unstagedTemporaryMountDir is the host directory of the temporary mountpoints of filesystems not yet staged,
+	// unless the temporary mount directory is absolute
+	unstagedTemporaryMountDir = "/var/lib/trident/tmp_mnt"
+)
+
+var temporaryMountDir = defaultTemporaryMountDir
+
+// validateTemporaryMountDir accepts an absolute path or a single relative path element.
+func validateTemporaryMountDir(dir string) error {
+	if path.IsAbs(dir) {
+		return nil
+	}
+	if dir == "." || dir == ".." || strings.Contains(dir, "/") {
+		return fmt.Errorf("invalid temporary mount directory %q; must be absolute or a single path element", dir)
+	}
+	return nil
+}
+
+// temporaryMountPointPattern returns the directory holding the temporary mountpoints of the volume staged at a
+// path, and the prefix of their names.
+func temporaryMountPointPattern(stagingTargetPath string) (dir, prefix string) {
+	if !path.IsAbs(temporaryMountDir) {
+		return stagingTargetPath, temporaryMountDir + "-"
+	}
+	// A collision would have one volume's cleanup unmount another's filesystem, so the hash is a strong one
+	return temporaryMountDir, fmt.Sprintf("%x-", sha256.Sum256([]byte(path.Clean(stagingTargetPath))))
+}
+
+// newTemporaryMountPoint creates a uniquely named, empty mountpoint for a temporary mount of the filesystem of
+// the volume staged at a path, and returns its path.
+func newTemporaryMountPoint(ctx context.Context, stagingTargetPath string) (string, error) {
+
+	dir, prefix := temporaryMountPointPattern(stagingTargetPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("could not create temporary mount directory %s; %v", dir, err)
+	}
+	mountPoint, err := ioutil.TempDir(dir, prefix)
+	if err != nil {
+		return "", fmt.Errorf("could not create temporary mountpoint in %s; %v", dir, err)
+	}
+
+	Logc(ctx).WithField("temporaryMountPoint", mountPoint).Debug("Created temporary mountpoint.")
+
+	return mountPoint, nil
+}
+
+// newUnstagedTemporaryMountPoint creates a uniquely named, empty mountpoint, with a name beginning with a prefix,
+// for a temporary mount of a filesystem not yet staged, and returns its path on the host.
+func newUnstagedTemporaryMountPoint(ctx context.Context, prefix string) (string, error) {
+
+	dir := unstagedTemporaryMountDir
+	if path.IsAbs(temporaryMountDir) {
+		dir = temporaryMountDir
+	}
+	if err := os.MkdirAll(LocalPath(dir), 0755); err != nil {
+		return "", fmt.Errorf("could not create temporary mount directory %s; %v", dir, err)
+	}
+	localMountPoint, err := ioutil.TempDir(LocalPath(dir), prefix)
+	if err != nil {
+		return "", fmt.Errorf("could not create temporary mountpoint in %s; %v", dir, err)
+	}
+	mountPoint := path.Join(dir, path.Base(localMountPoint))
+
+	Logc(ctx).WithField("temporaryMountPoint", mountPoint).Debug("Created temporary mountpoint.")
+
+	return mountPoint, nil
+}
+
+// findTemporaryMountPoints returns the paths of the temporary mountpoints, including one an earlier release
+// may have left, of the volume staged at a path.
+func findTemporaryMountPoints(stagingTargetPath string) ([]string, error) {
+
+	dir, prefix := temporaryMountPointPattern(stagingTargetPath)
+	mountPoints, err := filepath.Glob(path.Join(dir, prefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	legacyMountPoint := path.Join(stagingTargetPath, legacyTemporaryMountDir)
+	if _, err = os.Stat(legacyMountPoint); err == nil {
+		mountPoints = append([]string{legacyMountPoint}, mountPoints...)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("can't determine if temporary dir path %s exists; %v", legacyMountPoint, err)
+	}
+
+	return mountPoints, nil
+}
+
+// removeTemporaryMountPoint unmounts a temporary mountpoint if it's mounted and removes it.  A mountpoint found
+// unmounted is one whose removal was interrupted, as by a crash.
+func removeTemporaryMountPoint(ctx context.Context, mountPoint string) error {
+
+	mounted, err := IsMounted(ctx, "", mountPoint)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return removeMountPoint(ctx, mountPoint)
+	}
+	return removeMountPointDir(ctx, mountPoint)
+}
+
+// UmountAndRemoveTemporaryMountPoint unmounts and removes every temporary mountpoint of the volume staged at a
+// path.  It's safe to call when there are none, and is called when unstaging a volume and at startup, to clean up
+// after operations interrupted before they removed their mountpoints.
+func UmountAndRemoveTemporaryMountPoint(ctx context.Context, stagingTargetPath string) error {
+
+	Logc(ctx).Debug(">>>> tempmount.UmountAndRemoveTemporaryMountPoint")
+	defer Logc(ctx).Debug("<<<< tempmount.UmountAndRemoveTemporaryMountPoint")
+
+	mountPoints, err := findTemporaryMountPoints(stagingTargetPath)
+	if err != nil {
+		Logc(ctx).WithField("stagingTargetPath", stagingTargetPath).WithError(err).Error(
+			"Can't list temporary mountpoints.")
+		return fmt.Errorf("can't list temporary mountpoints of staging target path %s; %v", stagingTargetPath, err)
+	}
+
+	for _, mountPoint := range mountPoints {
+		Logc(ctx).WithFields(log.Fields{
+			"stagingTargetPath":   stagingTargetPath,
+			"temporaryMountPoint": mountPoint,
+		}).Debug("Removing temporary mountpoint.")
+		if err = removeTemporaryMountPoint(ctx, mountPoint); err != nil {
+			return fmt.Errorf("failed to remove temporary mountpoint %s; %v", mountPoint, err)
+		}
+	}
+
+	return nil
+}
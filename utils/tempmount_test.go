@@ -0,0 +1,112 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemporaryMountDirConfig(t *testing.T) {
+	log.Debug("Running TestTemporaryMountDirConfig...")
+
+	defer func() { _ = Init(Config{}) }()
+
+	assert.NoError(t, Init(Config{}))
+	assert.Equal(t, defaultTemporaryMountDir, temporaryMountDir)
+	assert.NoError(t, Init(Config{TemporaryMountDir: "resize"}))
+	assert.Equal(t, "resize", temporaryMountDir)
+	assert.NoError(t, Init(Config{TemporaryMountDir: "/var/lib/trident/tmp"}))
+	assert.Equal(t, "/var/lib/trident/tmp", temporaryMountDir)
+
+	for _, dir := range []string{".", "..", "tmp/mnt", "../tmp"} {
+		assert.Error(t, Init(Config{TemporaryMountDir: dir}), dir)
+	}
+}
+
+func TestTemporaryMountPoints(t *testing.T) {
+	log.Debug("Running TestTemporaryMountPoints...")
+
+	dir, err := ioutil.TempDir("", "TestTemporaryMountPoints")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { _ = Init(Config{}) }()
+
+	ctx := context.TODO()
+	stagingPath1 := path.Join(dir, "staging/pvc-1")
+	stagingPath2 := path.Join(dir, "staging/pvc-2")
+	for _, stagingPath := range []string{stagingPath1, stagingPath2} {
+		assert.NoError(t, os.MkdirAll(stagingPath, 0755))
+	}
+
+	for _, mountDir := range []string{"", path.Join(dir, "tmp")} {
+		assert.NoError(t, Init(Config{TemporaryMountDir: mountDir}))
+
+		// Each operation gets a mountpoint of its own, even on the same volume
+		mountPoint1, err := newTemporaryMountPoint(ctx, stagingPath1)
+		assert.NoError(t, err)
+		mountPoint2, err := newTemporaryMountPoint(ctx, stagingPath1)
+		assert.NoError(t, err)
+		mountPoint3, err := newTemporaryMountPoint(ctx, stagingPath2)
+		assert.NoError(t, err)
+		assert.NotEqual(t, mountPoint1, mountPoint2)
+		assert.DirExists(t, mountPoint1)
+		assert.DirExists(t, mountPoint2)
+		if mountDir == "" {
+			assert.True(t, strings.HasPrefix(mountPoint1, path.Join(stagingPath1, "tmp_mnt-")), mountPoint1)
+		} else {
+			assert.Equal(t, mountDir, path.Dir(mountPoint1))
+			assert.Regexp(t, "^[0-9a-f]{64}-", path.Base(mountPoint1))
+		}
+
+		// A volume's mountpoints, including the fixed one of earlier releases, are found from its staging path
+		legacyMountPoint := path.Join(stagingPath1, "tmp_mnt")
+		assert.NoError(t, os.Mkdir(legacyMountPoint, 0755))
+		mountPoints, err := findTemporaryMountPoints(stagingPath1)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{legacyMountPoint, mountPoint1, mountPoint2}, mountPoints)
+
+		// Mountpoints left unmounted, as by a crash, are removed along with the rest, leaving other volumes' alone
+		assert.NoError(t, UmountAndRemoveTemporaryMountPoint(ctx, stagingPath1))
+		for _, mountPoint := range []string{legacyMountPoint, mountPoint1, mountPoint2} {
+			_, err = os.Stat(mountPoint)
+			assert.True(t, os.IsNotExist(err), mountPoint)
+		}
+		assert.DirExists(t, mountPoint3)
+		assert.NoError(t, UmountAndRemoveTemporaryMountPoint(ctx, stagingPath2))
+		assert.NoError(t, UmountAndRemoveTemporaryMountPoint(ctx, stagingPath2))
+		_, err = os.Stat(mountPoint3)
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestUnstagedTemporaryMountPoint(t *testing.T) {
+	log.Debug("Running TestUnstagedTemporaryMountPoint...")
+
+	dir, err := ioutil.TempDir("", "TestUnstagedTemporaryMountPoint")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { _ = Init(Config{}) }()
+
+	// Mountpoints are made through the host's root, in the absolute temporary mount directory or the default
+	for mountDir, expectedDir := range map[string]string{
+		"":                     unstagedTemporaryMountDir,
+		"resize":               unstagedTemporaryMountDir,
+		"/var/lib/trident/tmp": "/var/lib/trident/tmp",
+	} {
+		assert.NoError(t, Init(Config{DockerPluginMode: true, HostRoot: dir, TemporaryMountDir: mountDir}))
+
+		mountPoint, err := newUnstagedTemporaryMountPoint(context.TODO(), "fs-check-")
+		assert.NoError(t, err)
+		assert.Equal(t, expectedDir, path.Dir(mountPoint), mountDir)
+		assert.True(t, strings.HasPrefix(path.Base(mountPoint), "fs-check-"), mountPoint)
+		assert.DirExists(t, path.Join(dir, mountPoint))
+	}
+}
@@ -2,9 +2,13 @@
 
 package utils
 
+import "time"
+
 type VolumeAccessInfo struct {
 	IscsiAccessInfo
 	NfsAccessInfo
+	PreAttachedAccessInfo
+	NVMeAccessInfo
 	MountOptions string `json:"mountOptions,omitempty"`
 }
 
@@ -21,6 +25,20 @@ type IscsiAccessInfo struct {
 	IscsiTargetUsername  string   `json:"iscsiTargetUsername,omitempty"`
 	IscsiTargetSecret    string   `json:"iscsiTargetSecret,omitempty"`
 	IscsiLunSerial       string   `json:"iscsiLunSerial,omitempty"`
+	// IscsiAdditionalTargets lists any other targets through which the same LUN is mapped, such as
+	// failover targets, whose paths are combined with those of the primary target under one multipath device.
+	IscsiAdditionalTargets []IscsiTarget `json:"iscsiAdditionalTargets,omitempty"`
+	// IscsiInitiatorSecretRef and IscsiTargetSecretRef, if set, take the place of the CHAP secrets above and are
+	// resolved only when logging in
+	IscsiInitiatorSecretRef *SecretRef `json:"iscsiInitiatorSecretRef,omitempty"`
+	IscsiTargetSecretRef    *SecretRef `json:"iscsiTargetSecretRef,omitempty"`
+}
+
+// IscsiTarget is a target IQN, with its portals and the LUN number the volume has through it.
+type IscsiTarget struct {
+	IQN       string   `json:"iqn"`
+	Portals   []string `json:"portals,omitempty"`
+	LunNumber int32    `json:"lunNumber"`
 }
 
 type NfsAccessInfo struct {
@@ -28,21 +46,107 @@ type NfsAccessInfo struct {
 	NfsPath     string `json:"nfsPath,omitempty"`
 }
 
+// PreAttachedAccessInfo identifies a LUN that a hypervisor presents to this node as a local disk, such as a
+// virtio-blk or virtio-scsi device, by its WWN or its serial number.  A volume with either set is attached by
+// finding that disk, without any iSCSI work on the node.
+type PreAttachedAccessInfo struct {
+	PreAttachedDeviceWWN    string `json:"preAttachedDeviceWwn,omitempty"`
+	PreAttachedDeviceSerial string `json:"preAttachedDeviceSerial,omitempty"`
+}
+
+// IsPreAttached returns true if the volume is presented to the node as a local disk rather than attached by it.
+func (i PreAttachedAccessInfo) IsPreAttached() bool {
+	return i.PreAttachedDeviceWWN != "" || i.PreAttachedDeviceSerial != ""
+}
+
+// NVMeAccessInfo identifies an NVMe namespace reached over Fibre Channel (FC-NVMe) by the NQN of the subsystem
+// exporting it and the namespace's UUID.  NVMeTargetPorts, each as "nn-0x<WWNN>:pn-0x<WWPN>", limit the
+// subsystem's FC ports that are connected to; if none are given, every NVMe target port the node can see is tried.
+type NVMeAccessInfo struct {
+	NVMeSubsystemNQN  string   `json:"nvmeSubsystemNqn,omitempty"`
+	NVMeNamespaceUUID string   `json:"nvmeNamespaceUuid,omitempty"`
+	NVMeTargetPorts   []string `json:"nvmeTargetPorts,omitempty"`
+}
+
+// IsNVMe returns true if the volume is an NVMe namespace rather than a SCSI LUN.
+func (i NVMeAccessInfo) IsNVMe() bool {
+	return i.NVMeSubsystemNQN != ""
+}
+
 type VolumePublishInfo struct {
-	Localhost      bool     `json:"localhost,omitempty"`
-	HostIQN        []string `json:"hostIQN,omitempty"`
-	HostIP         []string `json:"hostIP,omitempty"`
-	BackendUUID    string   `json:"backendUUID,omitempty"`
-	Nodes          []*Node  `json:"nodes,omitempty"`
-	HostName       string   `json:"hostName,omitempty"`
-	FilesystemType string   `json:"fstype,omitempty"`
-	UseCHAP        bool     `json:"useCHAP,omitempty"`
-	SharedTarget   bool     `json:"sharedTarget,omitempty"`
-	DevicePath     string   `json:"devicePath,omitempty"`
-	Unmanaged      bool     `json:"unmanaged,omitempty"`
+	Localhost       bool           `json:"localhost,omitempty"`
+	HostIQN         []string       `json:"hostIQN,omitempty"`
+	HostIP          []string       `json:"hostIP,omitempty"`
+	BackendUUID     string         `json:"backendUUID,omitempty"`
+	Nodes           []*Node        `json:"nodes,omitempty"`
+	HostName        string         `json:"hostName,omitempty"`
+	FilesystemType  string         `json:"fstype,omitempty"`
+	UseCHAP         bool           `json:"useCHAP,omitempty"`
+	SharedTarget    bool           `json:"sharedTarget,omitempty"`
+	MultiAttach     bool           `json:"multiAttach,omitempty"`
+	Zpool           string         `json:"zpool,omitempty"`
+	DevicePath      string         `json:"devicePath,omitempty"`
+	Unmanaged       bool           `json:"unmanaged,omitempty"`
+	VolumeSize      int64          `json:"volumeSize,omitempty"`
+	Degraded        bool           `json:"degraded,omitempty"`
+	SupportsDiscard bool           `json:"supportsDiscard,omitempty"`
+	AttachLatency   *AttachLatency `json:"-"`
+	// ReadOnlyClone attaches a snapshot clone temporarily and read-only, as for a backup or verification job,
+	// mounting it without replaying its journal and never formatting or otherwise writing to it
+	ReadOnlyClone bool `json:"readOnlyClone,omitempty"`
+	// SCSITimeouts, if set, are applied to each path of an attached LUN, including paths that appear later
+	SCSITimeouts *SCSITimeoutProfile `json:"scsiTimeouts,omitempty"`
+	// FilesystemOrigin records who created the filesystem found on the LUN when it was last attached
+	FilesystemOrigin FilesystemOrigin `json:"filesystemOrigin,omitempty"`
 	VolumeAccessInfo
 }
 
+// AttachLatency breaks down the time spent in each stage of the most recent attach of a volume.
+type AttachLatency struct {
+	Login         time.Duration `json:"login"`
+	ScanWait      time.Duration `json:"scanWait"`
+	MultipathWait time.Duration `json:"multipathWait"`
+	Blkid         time.Duration `json:"blkid"`
+	Mkfs          time.Duration `json:"mkfs"`
+	Mount         time.Duration `json:"mount"`
+	Total         time.Duration `json:"total"`
+}
+
+// AttachLimits are the per-node maximums enforced before attaching a volume.  A zero value means no limit.
+type AttachLimits struct {
+	MaxSessions  int `json:"maxSessions,omitempty"`
+	MaxLUNs      int `json:"maxLUNs,omitempty"`
+	MaxDMDevices int `json:"maxDMDevices,omitempty"`
+}
+
+// NodeAttachUsage counts the iSCSI sessions, attached iSCSI LUNs, and devicemapper devices on a node.
+type NodeAttachUsage struct {
+	Sessions  int `json:"sessions"`
+	LUNs      int `json:"luns"`
+	DMDevices int `json:"dmDevices"`
+}
+
+// ISCSISessionHealth is the result of a lightweight health check of one iSCSI session.  The error and byte
+// counters are cumulative for the life of the session; a session is unhealthy if its error counters grew since
+// the previous check.  ConnectionFailures counts the checks that found the session's connection newly down, so
+// it covers only the time the session has been monitored.
+type ISCSISessionHealth struct {
+	SID                string    `json:"sid"`
+	TargetIQN          string    `json:"targetIQN"`
+	Portal             string    `json:"portal"`
+	State              string    `json:"state"`
+	ConnectionState    string    `json:"connectionState,omitempty"`
+	TimeoutErrors      uint64    `json:"timeoutErrors"`
+	DigestErrors       uint64    `json:"digestErrors"`
+	FormatErrors       uint64    `json:"formatErrors"`
+	ConnectionFailures uint64    `json:"connectionFailures"`
+	TxBytes            uint64    `json:"txBytes"`
+	RxBytes            uint64    `json:"rxBytes"`
+	Healthy            bool      `json:"healthy"`
+	Reason             string    `json:"reason,omitempty"`
+	CheckedAt          time.Time `json:"checkedAt"`
+}
+
 type VolumeTrackingPublishInfo struct {
 	StagingTargetPath string `json:"stagingTargetPath"`
 }
@@ -54,6 +158,14 @@ type Node struct {
 	TopologyLabels map[string]string `json:"topologyLabels,omitempty"`
 	NodePrep       *NodePrep         `json:"nodePrep"`
 	HostInfo       *HostSystem       `json:"hostInfo,omitempty"`
+	Capabilities   CapabilitySet     `json:"capabilities,omitempty"`
+}
+
+// NodeTopology describes the storage connectivity of a host, for use in CSI topology segments.
+type NodeTopology struct {
+	Subnets   []string          `json:"subnets,omitempty"`
+	Protocols []string          `json:"protocols,omitempty"`
+	Zones     map[string]string `json:"zones,omitempty"`
 }
 
 type NodePrep struct {
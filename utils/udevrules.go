@@ -0,0 +1,191 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// Settings applied to devices by this package last only as long as the devices do, so a path that the kernel
+// adds while this node plugin isn't running, as when the host reboots, starts with the kernel's defaults.  A udev
+// rules file on the host applies them whenever the kernel adds a path instead: the scheduler and readahead of
+// every NetApp LUN's devices, and each attached LUN's SCSI timeouts, by its WWID.
+
+const (
+	udevRulesDir = "/etc/udev/rules.d"
+	// udevRulesFile sorts late, so that its settings override those of the host's own rules
+	udevRulesFile = "99-trident.rules"
+
+	udevRulesHeader = "# Written by Trident to tune the devices of NetApp LUNs.  Trident rewrites this file as\n" +
+		"# LUNs are attached and detached, and removes it when it stops with no volumes staged.\n"
+)
+
+// UdevRulesPolicy controls the udev rules file that tunes NetApp LUNs' devices as the kernel adds them.
+type UdevRulesPolicy struct {
+	// Enabled installs the rules file; otherwise any rules file left by an earlier run is removed
+	Enabled bool
+	// Scheduler, if set, is the I/O scheduler of each path of a NetApp LUN, such as mq-deadline or none
+	Scheduler string
+	// ReadAheadKB, if not zero, is the readahead of each NetApp LUN's paths and multipath device
+	ReadAheadKB int
+}
+
+var (
+	udevRulesPolicy UdevRulesPolicy
+	// udevRulesLock serializes rewrites of the rules file
+	udevRulesLock sync.Mutex
+
+	udevSchedulerRegex = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	udevWWIDRegex      = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+)
+
+func validateUdevRulesPolicy(policy UdevRulesPolicy) error {
+	if policy.Scheduler != "" && !udevSchedulerRegex.MatchString(policy.Scheduler) {
+		return fmt.Errorf("invalid I/O scheduler: %s", policy.Scheduler)
+	}
+	if policy.ReadAheadKB < 0 {
+		return fmt.Errorf("invalid readahead: %d", policy.ReadAheadKB)
+	}
+	return nil
+}
+
+// renderUdevRules returns the rules that apply a policy to NetApp LUNs' devices, and the timeouts of each tracked
+// LUN to its paths.  Rules are sorted by WWID, so that the same LUNs always render the same rules.
+func renderUdevRules(policy UdevRulesPolicy, luns []trackedSCSITimeouts) []byte {
+
+	var buf bytes.Buffer
+	buf.WriteString(udevRulesHeader)
+
+	// NetApp LUNs' paths report the padded vendor "NETAPP  " and a product of "LUN" or "LUN C-Mode"
+	netappPath := `ACTION=="add|change", SUBSYSTEM=="block", ENV{DEVTYPE}=="disk", KERNEL=="sd*", ` +
+		`ATTRS{vendor}=="NETAPP*", ATTRS{model}=="LUN*"`
+	if policy.Scheduler != "" {
+		fmt.Fprintf(&buf, "%s, ATTR{queue/scheduler}=\"%s\"\n", netappPath, policy.Scheduler)
+	}
+	if policy.ReadAheadKB > 0 {
+		fmt.Fprintf(&buf, "%s, ATTR{queue/read_ahead_kb}=\"%d\"\n", netappPath, policy.ReadAheadKB)
+		// NetApp LUNs' multipath devices are named by their NAA WWIDs, as in mpath-3600a098...
+		fmt.Fprintf(&buf, "ACTION==\"add|change\", SUBSYSTEM==\"block\", KERNEL==\"dm-*\", "+
+			"ENV{DM_UUID}==\"mpath-3600a098*\", ATTR{queue/read_ahead_kb}=\"%d\"\n", policy.ReadAheadKB)
+	}
+
+	sorted := make([]trackedSCSITimeouts, 0, len(luns))
+	for _, lun := range luns {
+		if lun.wwid != "" && udevWWIDRegex.MatchString(lun.wwid) {
+			sorted = append(sorted, lun)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].wwid < sorted[j].wwid })
+
+	for _, lun := range sorted {
+		timeouts := lun.profile.timeouts()
+		files := make([]string, 0, len(timeouts))
+		for file := range timeouts {
+			files = append(files, file)
+		}
+		sort.Strings(files)
+
+		rule := fmt.Sprintf(`ACTION=="add", SUBSYSTEM=="scsi", ENV{DEVTYPE}=="scsi_device", ATTR{wwid}=="%s"`,
+			lun.wwid)
+		for _, file := range files {
+			rule += fmt.Sprintf(`, ATTR{%s}="%d"`, file, timeouts[file])
+		}
+		buf.WriteString(rule + "\n")
+	}
+
+	return buf.Bytes()
+}
+
+// updateUdevRules rewrites the host's udev rules file for the current policy and tracked LUNs, if the policy
+// enables it, and has udev reload its rules if the file changed.  Failures are only logged, since the settings
+// are applied to existing devices directly; the rules only keep them across the re-adding of paths.
+func updateUdevRules(ctx context.Context) {
+
+	if !udevRulesPolicy.Enabled {
+		return
+	}
+
+	udevRulesLock.Lock()
+	defer udevRulesLock.Unlock()
+
+	if err := writeUdevRules(ctx, renderUdevRules(udevRulesPolicy, scsiTimeouts.list())); err != nil {
+		Logc(ctx).WithError(err).Warning("Could not write udev rules.")
+	}
+}
+
+// writeUdevRules replaces the host's udev rules file, if its content differs, and reloads udev's rules.
+func writeUdevRules(ctx context.Context, rules []byte) error {
+
+	dir := chrootPathPrefix + udevRulesDir
+	filename := path.Join(dir, udevRulesFile)
+
+	if content, err := ioutil.ReadFile(filename); err == nil && bytes.Equal(content, rules) {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create %s; %v", dir, err)
+	}
+	tempFilename := filename + ".tmp"
+	if err := ioutil.WriteFile(tempFilename, rules, 0644); err != nil {
+		return fmt.Errorf("could not write %s; %v", filename, err)
+	}
+	if err := os.Rename(tempFilename, filename); err != nil {
+		_ = os.Remove(tempFilename)
+		return fmt.Errorf("could not write %s; %v", filename, err)
+	}
+
+	Logc(ctx).WithField("file", filename).Debug("Wrote udev rules.")
+	journalHostOperation(ctx, log.InfoLevel, "Wrote udev rules.", log.Fields{"file": filename})
+	reloadUdevRules(ctx)
+	return nil
+}
+
+// reloadUdevRules has udev read its rules again, so that they apply to the next devices added.
+func reloadUdevRules(ctx context.Context) {
+	if _, err := execCommandWithTimeout(ctx, "udevadm", 10, true, "control", "--reload-rules"); err != nil {
+		Logc(ctx).WithError(err).Warning("Could not reload udev rules.")
+	}
+}
+
+// InstallUdevRules writes the host's udev rules file for the tracked LUNs if the policy enables it, or removes
+// one left by an earlier run if it doesn't.  It should be called once at startup, after the LUNs of staged
+// volumes are tracked.
+func InstallUdevRules(ctx context.Context) {
+	if udevRulesPolicy.Enabled {
+		updateUdevRules(ctx)
+	} else if err := RemoveUdevRules(ctx); err != nil {
+		Logc(ctx).WithError(err).Warning("Could not remove udev rules.")
+	}
+}
+
+// RemoveUdevRules removes the host's udev rules file, if there is one, as when Trident is uninstalled.
+func RemoveUdevRules(ctx context.Context) error {
+
+	udevRulesLock.Lock()
+	defer udevRulesLock.Unlock()
+
+	filename := path.Join(chrootPathPrefix+udevRulesDir, udevRulesFile)
+	if err := os.Remove(filename); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not remove %s; %v", filename, err)
+	}
+
+	Logc(ctx).WithField("file", filename).Info("Removed udev rules.")
+	journalHostOperation(ctx, log.InfoLevel, "Removed udev rules.", log.Fields{"file": filename})
+	reloadUdevRules(ctx)
+	return nil
+}
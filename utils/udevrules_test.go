@@ -0,0 +1,81 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderUdevRules(t *testing.T) {
+	log.Debug("Running TestRenderUdevRules...")
+
+	policy := UdevRulesPolicy{Enabled: true, Scheduler: "mq-deadline", ReadAheadKB: 128}
+	luns := []trackedSCSITimeouts{
+		{wwid: "naa.600a0980383030534b3f463045727a43", profile: SCSITimeoutProfile{CommandTimeoutSeconds: 60}},
+		{wwid: "naa.600a0980383030534b3f463045727a42", profile: SCSITimeoutProfile{
+			CommandTimeoutSeconds: 30, ErrorHandlerTimeoutSeconds: 10,
+		}},
+		{wwid: "", profile: SCSITimeoutProfile{CommandTimeoutSeconds: 60}},
+		{wwid: `naa.600a098" RUN+="x`, profile: SCSITimeoutProfile{CommandTimeoutSeconds: 60}},
+	}
+
+	assert.Equal(t, udevRulesHeader+
+		`ACTION=="add|change", SUBSYSTEM=="block", ENV{DEVTYPE}=="disk", KERNEL=="sd*", ATTRS{vendor}=="NETAPP*", `+
+		`ATTRS{model}=="LUN*", ATTR{queue/scheduler}="mq-deadline"`+"\n"+
+		`ACTION=="add|change", SUBSYSTEM=="block", ENV{DEVTYPE}=="disk", KERNEL=="sd*", ATTRS{vendor}=="NETAPP*", `+
+		`ATTRS{model}=="LUN*", ATTR{queue/read_ahead_kb}="128"`+"\n"+
+		`ACTION=="add|change", SUBSYSTEM=="block", KERNEL=="dm-*", ENV{DM_UUID}=="mpath-3600a098*", `+
+		`ATTR{queue/read_ahead_kb}="128"`+"\n"+
+		`ACTION=="add", SUBSYSTEM=="scsi", ENV{DEVTYPE}=="scsi_device", `+
+		`ATTR{wwid}=="naa.600a0980383030534b3f463045727a42", ATTR{eh_timeout}="10", ATTR{timeout}="30"`+"\n"+
+		`ACTION=="add", SUBSYSTEM=="scsi", ENV{DEVTYPE}=="scsi_device", `+
+		`ATTR{wwid}=="naa.600a0980383030534b3f463045727a43", ATTR{timeout}="60"`+"\n",
+		string(renderUdevRules(policy, luns)))
+
+	// Without a scheduler or readahead, only the LUNs' timeouts are set
+	assert.Equal(t, udevRulesHeader, string(renderUdevRules(UdevRulesPolicy{Enabled: true}, nil)))
+}
+
+func TestInstallUdevRules(t *testing.T) {
+	log.Debug("Running TestInstallUdevRules...")
+
+	dir, err := ioutil.TempDir("", "TestInstallUdevRules")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.TODO()
+	filename := path.Join(dir, udevRulesDir, udevRulesFile)
+	recorder := &recordingExecutor{}
+	defer func() { _ = Init(Config{}) }()
+
+	// The rules are written, and udev reloads them, only when they change
+	policy := UdevRulesPolicy{Enabled: true, ReadAheadKB: 128}
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: recorder, UdevRulesPolicy: policy}))
+	InstallUdevRules(ctx)
+	content, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, string(renderUdevRules(policy, nil)), string(content))
+	assert.Equal(t, []string{"udevadm control --reload-rules"}, recorder.commands)
+
+	InstallUdevRules(ctx)
+	assert.Len(t, recorder.commands, 1)
+
+	// Disabling the rules removes those an earlier run installed
+	recorder.commands = nil
+	assert.NoError(t, Init(Config{HostRoot: dir, Executor: recorder}))
+	InstallUdevRules(ctx)
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, []string{"udevadm control --reload-rules"}, recorder.commands)
+	assert.NoError(t, RemoveUdevRules(ctx))
+
+	assert.Error(t, Init(Config{UdevRulesPolicy: UdevRulesPolicy{Enabled: true, Scheduler: `none" RUN+="x`}}))
+	assert.Error(t, Init(Config{UdevRulesPolicy: UdevRulesPolicy{Enabled: true, ReadAheadKB: -1}}))
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+	"github.com/netapp/trident/utils/mount"
+)
+
+// A volume is used on a node in two steps, as CSI's node service splits them.  Staging readies the volume on the
+// node once: an iSCSI LUN is logged in to, its devices are found and checked, and it's formatted if it has no
+// filesystem.  NFS volumes need no staging.  Publishing then makes the staged volume available at each target path
+// a workload uses: a filesystem, zpool or NFS export is mounted there, and a raw block device is bound onto a file
+// there.  A staged LUN isn't itself mounted on the node, so each publish mounts its device directly, and a
+// read-only publish doesn't affect the others.  Each step has its inverse.
+
+// StageVolume readies a volume for publishing on this node, setting the device path of an iSCSI LUN in the
+// publish info.
+func StageVolume(ctx context.Context, name string, publishInfo *VolumePublishInfo) error {
+
+	switch {
+	case publishInfo.IscsiTargetIQN != "":
+		return AttachISCSIVolume(ctx, name, "", publishInfo)
+	case publishInfo.NfsServerIP != "":
+		return nil
+	default:
+		return fmt.Errorf("cannot stage volume %s; unsupported protocol", name)
+	}
+}
+
+// UnstageVolume undoes StageVolume for a volume no longer published anywhere on this node, releasing an iSCSI
+// LUN and removing its devices through each of its targets.  Sessions are left for the caller to log out of, since
+// only it knows whether other volumes still use them.  Callers that must resume interrupted detaches run these
+// steps themselves, recording each as it completes.
+func UnstageVolume(ctx context.Context, publishInfo *VolumePublishInfo, force bool) error {
+
+	if publishInfo.IscsiTargetIQN == "" {
+		return nil
+	}
+
+	if err := ExportZpool(ctx, publishInfo); err != nil && !force {
+		return err
+	}
+	if err := ReleaseMultiAttachDevice(ctx, publishInfo); err != nil {
+		Logc(ctx).WithError(err).Warning("Could not release fencing of shared LUN.")
+	}
+
+	for _, target := range getISCSITargets(publishInfo) {
+		if err := PrepareDeviceForRemoval(ctx, int(target.LunNumber), target.IQN, force); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PublishVolume makes a staged volume available at a target path, mounting it read-only if asked.  The publish
+// info's mount options are set to those the volume is mounted with.  A volume already published at the target
+// path is left as it is.
+func PublishVolume(
+	ctx context.Context, name, targetPath string, publishInfo *VolumePublishInfo, readOnly bool,
+) error {
+
+	fields := log.Fields{"volume": name, "targetPath": targetPath, "readOnly": readOnly}
+	Logc(ctx).WithFields(fields).Debug(">>>> volumestage.PublishVolume")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< volumestage.PublishVolume")
+
+	fstype := publishInfo.FilesystemType
+	if publishInfo.NfsServerIP != "" {
+		fstype = "nfs"
+	}
+
+	var requiredOptions []string
+	if readOnly {
+		requiredOptions = append(requiredOptions, "ro")
+	}
+	if fstype == fsRaw {
+		requiredOptions = append(requiredOptions, "bind")
+	}
+	publishInfo.MountOptions = mount.MergeOptions(fstype, publishInfo.MountOptions, requiredOptions...)
+
+	switch {
+	case fstype == fsRaw:
+		return PublishBlockDevice(ctx, publishInfo.DevicePath, targetPath, publishInfo.MountOptions)
+	case publishInfo.Zpool != "":
+		return MountZpool(ctx, publishInfo.Zpool, targetPath, publishInfo.MountOptions)
+	case fstype == "nfs":
+		if err := os.MkdirAll(LocalPath(targetPath), 0750); err != nil {
+			return err
+		}
+		if mounted, err := IsMounted(ctx, "", targetPath); err != nil {
+			return err
+		} else if mounted {
+			return nil
+		}
+		return AttachNFSVolume(ctx, name, targetPath, publishInfo)
+	default:
+		return MountDevice(ctx, publishInfo.DevicePath, targetPath, publishInfo.MountOptions, false)
+	}
+}
+
+// UnpublishVolume undoes PublishVolume, unmounting whatever is published at a target path.  A raw block volume's
+// file is removed too, while a directory is left for the caller to remove.  A target path that doesn't exist is
+// already unpublished, but a directory with nothing mounted on it returns a not found error.
+func UnpublishVolume(ctx context.Context, targetPath string) error {
+
+	Logc(ctx).WithField("targetPath", targetPath).Debug(">>>> volumestage.UnpublishVolume")
+	defer Logc(ctx).WithField("targetPath", targetPath).Debug("<<<< volumestage.UnpublishVolume")
+
+	isDir, err := IsLikelyDir(LocalPath(targetPath))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not check target path %s; %v", targetPath, err)
+	}
+
+	if !isDir {
+		return UnpublishBlockDevice(ctx, targetPath)
+	}
+
+	mounted, err := IsMounted(ctx, "", targetPath)
+	if err != nil {
+		return err
+	} else if !mounted {
+		return NotFoundError(fmt.Sprintf("volume not mounted at %s", targetPath))
+	}
+	return Umount(ctx, targetPath)
+}
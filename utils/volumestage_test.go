@@ -0,0 +1,58 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishAndUnpublishVolume(t *testing.T) {
+	log.Debug("Running TestPublishAndUnpublishVolume...")
+
+	dir, err := ioutil.TempDir("", "TestPublishAndUnpublishVolume")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mountinfo := path.Join(dir, "proc/1/mountinfo")
+	assert.NoError(t, os.MkdirAll(path.Dir(mountinfo), 0755))
+	assert.NoError(t, ioutil.WriteFile(mountinfo, nil, 0644))
+
+	recorder := &recordingExecutor{}
+	assert.NoError(t, Init(Config{DockerPluginMode: true, HostRoot: dir, Executor: recorder}))
+	defer func() { _ = Init(Config{}) }()
+
+	ctx := context.TODO()
+	target := "/pods/volumes/pvc-1/mount"
+
+	// A filesystem is mounted read-only from the staged device
+	publishInfo := &VolumePublishInfo{DevicePath: "/dev/dm-0", FilesystemType: "ext4"}
+	publishInfo.MountOptions = "noatime"
+	assert.NoError(t, PublishVolume(ctx, "vol1", target, publishInfo, true))
+	assert.Equal(t, "noatime,ro", publishInfo.MountOptions)
+	assert.Equal(t, []string{"mount -o noatime,ro /dev/dm-0 " + target}, recorder.commands)
+	assert.DirExists(t, path.Join(dir, target))
+
+	// An NFS volume already mounted is left as it is
+	recorder.commands = nil
+	assert.NoError(t, ioutil.WriteFile(mountinfo, []byte("100 29 0:50 / "+target+
+		" rw,relatime shared:1 - nfs4 10.0.0.1:/vol1 rw,vers=4.1\n"), 0644))
+	nfsInfo := &VolumePublishInfo{FilesystemType: "nfs"}
+	nfsInfo.NfsServerIP = "10.0.0.1"
+	nfsInfo.NfsPath = "/vol1"
+	assert.NoError(t, PublishVolume(ctx, "vol2", target, nfsInfo, false))
+	assert.Empty(t, recorder.commands)
+
+	// Unpublishing unmounts the target, which must have something mounted on it unless it's gone
+	assert.NoError(t, UnpublishVolume(ctx, target))
+	assert.Equal(t, []string{"umount " + target}, recorder.commands)
+	assert.NoError(t, ioutil.WriteFile(mountinfo, nil, 0644))
+	assert.True(t, IsNotFoundError(UnpublishVolume(ctx, target)))
+	assert.NoError(t, UnpublishVolume(ctx, "/pods/volumes/pvc-2/mount"))
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+)
+
+// HostOperationClass is the kind of a host operation, which decides its priority in the host operation queue.
+// Classes are listed from the most urgent, so that a flood of attaches can't hold up the detaches that let a node
+// drain.
+type HostOperationClass int
+
+const (
+	HostOperationDetach HostOperationClass = iota
+	HostOperationAttach
+	HostOperationReconcile
+	HostOperationDiagnostics
+)
+
+func (c HostOperationClass) String() string {
+	switch c {
+	case HostOperationDetach:
+		return "detach"
+	case HostOperationAttach:
+		return "attach"
+	case HostOperationReconcile:
+		return "reconcile"
+	case HostOperationDiagnostics:
+		return "diagnostics"
+	default:
+		return fmt.Sprintf("class%d", int(c))
+	}
+}
+
+// HostOperationPolicy bounds how many host operations run at once.  Whatever the bounds, operations on the same
+// volume run one at a time, and waiting operations start in order of their class, then of their arrival.
+type HostOperationPolicy struct {
+	// MaxConcurrent bounds the operations of all classes together; zero means no bound
+	MaxConcurrent int
+	// MaxConcurrentByClass bounds the operations of a class; classes not listed are bounded only by MaxConcurrent
+	MaxConcurrentByClass map[HostOperationClass]int
+}
+
+// queuedHostOperation is an operation waiting in, or started by, the host operation queue.
+type queuedHostOperation struct {
+	class    HostOperationClass
+	volumeID string
+	start    chan struct{}
+}
+
+type hostOperationQueue struct {
+	lock    sync.Mutex
+	policy  HostOperationPolicy
+	waiting []*queuedHostOperation
+	running map[HostOperationClass]int
+	total   int
+	volumes map[string]bool
+}
+
+var hostOperations = newHostOperationQueue(HostOperationPolicy{})
+
+func newHostOperationQueue(policy HostOperationPolicy) *hostOperationQueue {
+	return &hostOperationQueue{
+		policy:  policy,
+		running: make(map[HostOperationClass]int),
+		volumes: make(map[string]bool),
+	}
+}
+
+// RunHostOperation runs an operation on the host once the host operation queue lets it start, and returns its
+// result.  The volume ID, if not empty, keeps the operation from running alongside any other on the same volume.
+// A caller whose context is done before the operation starts gives up its place, with the context's error.
+func RunHostOperation(
+	ctx context.Context, class HostOperationClass, volumeID string, operation func() (interface{}, error),
+) (interface{}, error) {
+
+	queue := hostOperations
+	op, err := queue.acquire(ctx, class, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	defer queue.release(op)
+
+	return operation()
+}
+
+// acquire queues an operation and waits for it to start.
+func (q *hostOperationQueue) acquire(
+	ctx context.Context, class HostOperationClass, volumeID string,
+) (*queuedHostOperation, error) {
+
+	op := &queuedHostOperation{class: class, volumeID: volumeID, start: make(chan struct{})}
+
+	q.lock.Lock()
+	// Keep the waiting operations ordered by class, and by arrival within a class
+	i := len(q.waiting)
+	for i > 0 && q.waiting[i-1].class > class {
+		i--
+	}
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[i+1:], q.waiting[i:])
+	q.waiting[i] = op
+	q.dispatch()
+	position := len(q.waiting)
+	q.lock.Unlock()
+
+	select {
+	case <-op.start:
+		return op, nil
+	default:
+	}
+
+	fields := log.Fields{"class": class, "volumeID": volumeID, "waiting": position}
+	Logc(ctx).WithFields(fields).Debug("Host operation queued.")
+
+	select {
+	case <-op.start:
+		Logc(ctx).WithFields(fields).Debug("Queued host operation started.")
+		return op, nil
+	case <-ctx.Done():
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		select {
+		case <-op.start:
+			// It started just as the caller gave up, so its place is released instead
+			q.finish(op)
+		default:
+			q.remove(op)
+		}
+		q.dispatch()
+		return nil, fmt.Errorf("stopped waiting to run %s operation; %v", class, ctx.Err())
+	}
+}
+
+// release ends a started operation, letting waiting operations start in its place.
+func (q *hostOperationQueue) release(op *queuedHostOperation) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.finish(op)
+	q.dispatch()
+}
+
+// dispatch starts each waiting operation, in order, that the policy's bounds allow.  The caller must hold the lock.
+func (q *hostOperationQueue) dispatch() {
+
+	waiting := q.waiting[:0]
+	for _, op := range q.waiting {
+		classLimit := q.policy.MaxConcurrentByClass[op.class]
+		if (q.policy.MaxConcurrent == 0 || q.total < q.policy.MaxConcurrent) &&
+			(classLimit == 0 || q.running[op.class] < classLimit) &&
+			(op.volumeID == "" || !q.volumes[op.volumeID]) {
+
+			q.total++
+			q.running[op.class]++
+			if op.volumeID != "" {
+				q.volumes[op.volumeID] = true
+			}
+			close(op.start)
+		} else {
+			waiting = append(waiting, op)
+		}
+	}
+	for i := len(waiting); i < len(q.waiting); i++ {
+		q.waiting[i] = nil
+	}
+	q.waiting = waiting
+}
+
+// finish accounts for the end of a started operation.  The caller must hold the lock.
+func (q *hostOperationQueue) finish(op *queuedHostOperation) {
+	q.total--
+	q.running[op.class]--
+	if op.volumeID != "" {
+		delete(q.volumes, op.volumeID)
+	}
+}
+
+// remove takes a waiting operation out of the queue.  The caller must hold the lock.
+func (q *hostOperationQueue) remove(op *queuedHostOperation) {
+	for i, waiting := range q.waiting {
+		if waiting == op {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return
+		}
+	}
+}
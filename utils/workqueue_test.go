@@ -0,0 +1,138 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// startHostOperation runs a host operation in the background that holds its place until released, and records its
+// name when it starts.
+func startHostOperation(
+	class HostOperationClass, volumeID, name string, started chan<- string, release <-chan struct{},
+) {
+	go func() {
+		_, _ = RunHostOperation(context.TODO(), class, volumeID, func() (interface{}, error) {
+			started <- name
+			<-release
+			return nil, nil
+		})
+	}()
+}
+
+// waitForQueuedHostOperations waits until the given number of host operations are waiting to start.
+func waitForQueuedHostOperations(t *testing.T, count int) {
+	assert.Eventually(t, func() bool {
+		hostOperations.lock.Lock()
+		defer hostOperations.lock.Unlock()
+		return len(hostOperations.waiting) == count
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestRunHostOperationPriority(t *testing.T) {
+	log.Debug("Running TestRunHostOperationPriority...")
+
+	assert.NoError(t, Init(Config{HostOperationPolicy: HostOperationPolicy{MaxConcurrent: 1}}))
+	defer func() { _ = Init(Config{}) }()
+
+	started := make(chan string, 4)
+	release := make(chan struct{})
+
+	startHostOperation(HostOperationAttach, "vol1", "attach1", started, release)
+	assert.Equal(t, "attach1", <-started)
+
+	// Operations wait in order of class, then of arrival, while one at a time may run
+	startHostOperation(HostOperationDiagnostics, "", "diagnostics", started, release)
+	waitForQueuedHostOperations(t, 1)
+	startHostOperation(HostOperationAttach, "vol2", "attach2", started, release)
+	waitForQueuedHostOperations(t, 2)
+	startHostOperation(HostOperationDetach, "vol3", "detach", started, release)
+	waitForQueuedHostOperations(t, 3)
+
+	var order []string
+	for i := 0; i < 3; i++ {
+		release <- struct{}{}
+		order = append(order, <-started)
+	}
+	release <- struct{}{}
+	assert.Equal(t, []string{"detach", "attach2", "diagnostics"}, order)
+}
+
+func TestRunHostOperationLimits(t *testing.T) {
+	log.Debug("Running TestRunHostOperationLimits...")
+
+	assert.NoError(t, Init(Config{HostOperationPolicy: HostOperationPolicy{
+		MaxConcurrent:        3,
+		MaxConcurrentByClass: map[HostOperationClass]int{HostOperationAttach: 1},
+	}}))
+	defer func() { _ = Init(Config{}) }()
+
+	started := make(chan string, 4)
+	release := make(chan struct{})
+
+	startHostOperation(HostOperationAttach, "vol1", "attach1", started, release)
+	assert.Equal(t, "attach1", <-started)
+
+	// A second attach waits for the first, and a detach of the same volume waits too
+	startHostOperation(HostOperationAttach, "vol2", "attach2", started, release)
+	waitForQueuedHostOperations(t, 1)
+	startHostOperation(HostOperationDetach, "vol1", "detach1", started, release)
+	waitForQueuedHostOperations(t, 2)
+
+	// A detach of another volume goes ahead of both
+	startHostOperation(HostOperationDetach, "vol3", "detach3", started, release)
+	assert.Equal(t, "detach3", <-started)
+	waitForQueuedHostOperations(t, 2)
+
+	// A caller that gives up leaves the queue
+	ctx, cancel := context.WithCancel(context.TODO())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := RunHostOperation(ctx, HostOperationAttach, "vol4", func() (interface{}, error) {
+			t.Error("operation ran after its caller gave up")
+			return nil, nil
+		})
+		assert.Error(t, err)
+	}()
+	waitForQueuedHostOperations(t, 3)
+	cancel()
+	wg.Wait()
+	waitForQueuedHostOperations(t, 2)
+
+	// Once the running operations end, the waiting ones start
+	release <- struct{}{}
+	release <- struct{}{}
+	assert.ElementsMatch(t, []string{"attach2", "detach1"}, []string{<-started, <-started})
+	release <- struct{}{}
+	release <- struct{}{}
+}
+
+func TestRunHostOperationDefaults(t *testing.T) {
+	log.Debug("Running TestRunHostOperationDefaults...")
+
+	assert.NoError(t, Init(Config{}))
+	defer func() { _ = Init(Config{}) }()
+
+	started := make(chan string, 3)
+	release := make(chan struct{})
+
+	// Operations on different volumes run at once, while those on the same volume run one at a time
+	startHostOperation(HostOperationAttach, "vol1", "attach1", started, release)
+	startHostOperation(HostOperationAttach, "vol2", "attach2", started, release)
+	assert.ElementsMatch(t, []string{"attach1", "attach2"}, []string{<-started, <-started})
+	startHostOperation(HostOperationDetach, "vol1", "detach1", started, release)
+	waitForQueuedHostOperations(t, 1)
+
+	release <- struct{}{}
+	release <- struct{}{}
+	assert.Equal(t, "detach1", <-started)
+	release <- struct{}{}
+}
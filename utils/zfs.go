@@ -0,0 +1,278 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/netapp/trident/logger"
+	"github.com/netapp/trident/utils/fs"
+)
+
+const (
+	// fsZFS is the filesystem type that places a single-disk zpool on a LUN rather than running mkfs
+	fsZFS = "zfs"
+	// zfsMemberFstype is the type blkid reports for a device belonging to a zpool
+	zfsMemberFstype  = fs.ZFSMemberType
+	zpoolTimeoutSecs = 60
+)
+
+var zpoolNameInvalidCharRegex = regexp.MustCompile(`[^A-Za-z0-9_.:-]`)
+
+// forceZpoolImport allows importing zpools last used by another host
+var forceZpoolImport = false
+
+// zpoolName returns the name of the zpool for a volume.  Pool names must begin with a letter and may contain
+// only alphanumerics and the characters _ - . and :.
+func zpoolName(volumeName string) string {
+	name := zpoolNameInvalidCharRegex.ReplaceAllString(volumeName, "_")
+	if name == "" || !((name[0] >= 'a' && name[0] <= 'z') || (name[0] >= 'A' && name[0] <= 'Z')) {
+		name = "z" + name
+	}
+	return name
+}
+
+// attachZpool ensures that the zpool on an attached LUN is imported, creating it if the LUN is unformatted, and
+// records its name in the publish info.  The pool's root dataset has a legacy mountpoint, so it's mounted and
+// unmounted like any other filesystem rather than by ZFS, and the pool isn't added to the host's cache file, so
+// it's never imported at boot behind this package's back.
+func attachZpool(
+	ctx context.Context, name, devicePath, existingFstype string, publishInfo *VolumePublishInfo,
+) error {
+
+	pool := publishInfo.Zpool
+	if pool == "" {
+		pool = zpoolName(name)
+	}
+
+	logFields := log.Fields{"volume": name, "device": devicePath, "zpool": pool, "existingFstype": existingFstype}
+	Logc(ctx).WithFields(logFields).Debug(">>>> zfs.attachZpool")
+	defer Logc(ctx).WithFields(logFields).Debug("<<<< zfs.attachZpool")
+
+	// Only one host may import a pool at a time
+	if publishInfo.MultiAttach {
+		return errors.New("a zpool cannot be attached to multiple nodes")
+	}
+
+	imported, err := isZpoolImported(ctx, pool, devicePath)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case imported:
+		Logc(ctx).WithFields(logFields).Debug("Zpool already imported.")
+	case existingFstype == zfsMemberFstype:
+		if err = importZpool(ctx, pool, devicePath); err != nil {
+			return err
+		}
+		Logc(ctx).WithFields(logFields).Info("Imported zpool.")
+	case existingFstype == "":
+		if err = ensureDeviceNotInUse(ctx, devicePath); err != nil {
+			return err
+		}
+		if _, err = execCommandWithTimeout(ctx, "zpool", zpoolTimeoutSecs, true, "create",
+			"-o", "cachefile=none", "-o", "ashift=12", "-O", "mountpoint=legacy", pool, devicePath); err != nil {
+			return fmt.Errorf("could not create zpool %s; %v", pool, err)
+		}
+		Logc(ctx).WithFields(logFields).Info("Created zpool.")
+	default:
+		return fmt.Errorf("device %s already formatted with other filesystem: %s", devicePath, existingFstype)
+	}
+
+	publishInfo.Zpool = pool
+	return nil
+}
+
+// importZpool imports the zpool on a device under the specified name.  The pool is found on the device and imported
+// by its GUID rather than by the name it was created with, which for a clone is its source's name, and is renamed as
+// it's imported.  A pool last imported by another host, as one that died, is still marked as in use by it, and is
+// imported only if forced imports are configured, since it may still be in use there.
+func importZpool(ctx context.Context, pool, devicePath string) error {
+
+	guid, existingName, err := findZpoolOnDevice(ctx, devicePath)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"import"}
+	if forceZpoolImport {
+		args = append(args, "-f")
+	}
+	args = append(args, "-N", "-o", "cachefile=none", "-d", devicePath, guid, pool)
+	if _, err = execCommandWithTimeout(ctx, "zpool", zpoolTimeoutSecs, true, args...); err != nil {
+		return fmt.Errorf("could not import zpool %s (%s) from %s; it may be in use by another host, and must be "+
+			"exported there first unless forced imports are configured; %v", existingName, guid, devicePath, err)
+	}
+
+	// A clone shares its source's GUID, which would keep the two pools from being imported on the same host
+	if existingName != pool {
+		if _, err = execCommandWithTimeout(ctx, "zpool", zpoolTimeoutSecs, true, "reguid", pool); err != nil {
+			Logc(ctx).WithField("zpool", pool).WithError(err).Warning("Could not give renamed zpool a new GUID.")
+		}
+	}
+	return nil
+}
+
+// findZpoolOnDevice returns the GUID and name of the exported zpool on a device, as zpool import lists it.
+func findZpoolOnDevice(ctx context.Context, devicePath string) (string, string, error) {
+
+	out, err := execCommandWithTimeout(ctx, "zpool", zpoolTimeoutSecs, false, "import", "-d", devicePath)
+	if err != nil {
+		return "", "", fmt.Errorf("could not find zpool on %s; %v", devicePath, err)
+	}
+
+	var names, guids []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) != 2:
+		case fields[0] == "pool:":
+			names = append(names, fields[1])
+		case fields[0] == "id:":
+			guids = append(guids, fields[1])
+		}
+	}
+	if len(guids) != 1 || len(names) != 1 {
+		return "", "", fmt.Errorf("found %d zpools rather than one on %s", len(guids), devicePath)
+	}
+	return guids[0], names[0], nil
+}
+
+// isZpoolImported returns true if the named zpool is imported on this host.  If a device is specified, the pool
+// must be on it, and a pool of the same name on another device, as a clone's source, is an error.
+func isZpoolImported(ctx context.Context, pool, devicePath string) (bool, error) {
+
+	out, err := execCommandWithTimeout(ctx, "zpool", zpoolTimeoutSecs, false, "list", "-H", "-o", "name")
+	if err != nil {
+		return false, fmt.Errorf("could not list zpools; %v", err)
+	}
+	imported := false
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) == pool {
+			imported = true
+		}
+	}
+	if !imported || devicePath == "" {
+		return imported, nil
+	}
+
+	// Vdevs are listed, indented, beneath the pool, by the paths they were imported through
+	out, err = execCommandWithTimeout(ctx, "zpool", zpoolTimeoutSecs, false, "list", "-H", "-v", "-P", "-o",
+		"name", pool)
+	if err != nil {
+		return false, fmt.Errorf("could not list vdevs of zpool %s; %v", pool, err)
+	}
+	vdevs := make([]string, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		if vdev := strings.TrimSpace(line); vdev != pool && strings.HasPrefix(vdev, "/") {
+			if isZpoolVdevOnDevice(vdev, devicePath) {
+				return true, nil
+			}
+			vdevs = append(vdevs, vdev)
+		}
+	}
+	return false, fmt.Errorf("a zpool named %s is already imported from %v rather than %s", pool, vdevs, devicePath)
+}
+
+var zpoolPartitionSuffixRegex = regexp.MustCompile(`^(-part|p)?[0-9]+$`)
+
+// isZpoolVdevOnDevice returns true if a vdev is a device, by the same path or another leading to the same device
+// node, or one of its partitions, which ZFS creates when given a whole disk.
+func isZpoolVdevOnDevice(vdev, devicePath string) bool {
+	if vdev == devicePath ||
+		(strings.HasPrefix(vdev, devicePath) && zpoolPartitionSuffixRegex.MatchString(vdev[len(devicePath):])) {
+		return true
+	}
+	resolvedVdev, err := filepath.EvalSymlinks(chrootPathPrefix + vdev)
+	if err != nil {
+		return false
+	}
+	resolvedDevice, err := filepath.EvalSymlinks(chrootPathPrefix + devicePath)
+	return err == nil && resolvedVdev == resolvedDevice
+}
+
+// MountZpool mounts the root dataset of a zpool at the specified location.
+func MountZpool(ctx context.Context, pool, mountpoint, options string) error {
+
+	fields := log.Fields{"zpool": pool, "mountpoint": mountpoint, "options": options}
+	Logc(ctx).WithFields(fields).Debug(">>>> zfs.MountZpool")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< zfs.MountZpool")
+
+	if mounted, _ := IsMounted(ctx, pool, mountpoint); mounted {
+		return nil
+	}
+	if err := EnsureDirExists(ctx, mountpoint); err != nil {
+		return err
+	}
+
+	args := []string{"-t", fsZFS}
+	if options = strings.TrimPrefix(options, "-o "); options != "" {
+		args = append(args, "-o", options)
+	}
+	args = append(args, pool, mountpoint)
+
+	if _, err := execCommand(ctx, "mount", args...); err != nil {
+		return fmt.Errorf("could not mount zpool %s; %v", pool, err)
+	}
+	return nil
+}
+
+// ExportZpool exports the zpool on a volume, if it has one, so that the LUN may be detached cleanly and the pool
+// imported elsewhere.  Every dataset in the pool must have been unmounted.
+func ExportZpool(ctx context.Context, publishInfo *VolumePublishInfo) error {
+
+	if publishInfo.Zpool == "" {
+		return nil
+	}
+
+	fields := log.Fields{"zpool": publishInfo.Zpool}
+	Logc(ctx).WithFields(fields).Debug(">>>> zfs.ExportZpool")
+	defer Logc(ctx).WithFields(fields).Debug("<<<< zfs.ExportZpool")
+
+	imported, err := isZpoolImported(ctx, publishInfo.Zpool, publishInfo.DevicePath)
+	if err != nil {
+		return err
+	} else if !imported {
+		return nil
+	}
+
+	if _, err = execCommandWithTimeout(ctx, "zpool", zpoolTimeoutSecs, true, "export",
+		publishInfo.Zpool); err != nil {
+		return fmt.Errorf("could not export zpool %s; %v", publishInfo.Zpool, err)
+	}
+	return nil
+}
+
+// expandZpool grows a zpool to fill its resized LUN and returns the pool's new size in bytes.
+func expandZpool(ctx context.Context, pool, devicePath string) (int64, error) {
+
+	if _, err := execCommandWithTimeout(ctx, "zpool", zpoolTimeoutSecs, true, "online", "-e", pool,
+		devicePath); err != nil {
+		return 0, fmt.Errorf("could not expand zpool %s; %v", pool, err)
+	}
+	return getZpoolSize(ctx, pool)
+}
+
+// getZpoolSize returns the size of a zpool in bytes.
+func getZpoolSize(ctx context.Context, pool string) (int64, error) {
+
+	out, err := execCommandWithTimeout(ctx, "zpool", zpoolTimeoutSecs, false, "list", "-H", "-p", "-o", "size",
+		pool)
+	if err != nil {
+		return 0, fmt.Errorf("could not get size of zpool %s; %v", pool, err)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse size of zpool %s; %v", pool, err)
+	}
+	return size, nil
+}
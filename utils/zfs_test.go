@@ -0,0 +1,136 @@
+// Copyright 2020 NetApp, Inc. All Rights Reserved.
+
+package utils
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZpoolName(t *testing.T) {
+	log.Debug("Running TestZpoolName...")
+
+	tests := map[string]string{
+		"trident_pvc_1234":     "trident_pvc_1234",
+		"pvc-1234":             "pvc-1234",
+		"1234":                 "z1234",
+		"_volume":              "z_volume",
+		"vol/with spaces":      "vol_with_spaces",
+		"":                     "z",
+		"ns:vol.snapshot-copy": "ns:vol.snapshot-copy",
+	}
+	for volumeName, expected := range tests {
+		assert.Equal(t, expected, zpoolName(volumeName), volumeName)
+	}
+}
+
+// zpoolExecutor simulates zpool: an exported pool is found on any device, and imported pools are listed with
+// their vdevs.
+type zpoolExecutor struct {
+	recordingExecutor
+	imported map[string]string
+}
+
+func (e *zpoolExecutor) Execute(ctx context.Context, cmd Command) ([]byte, error) {
+	_, _ = e.recordingExecutor.Execute(ctx, cmd)
+	args := strings.Join(cmd.Args, " ")
+	switch {
+	case args == "list -H -o name":
+		var names []string
+		for name := range e.imported {
+			names = append(names, name)
+		}
+		return []byte(strings.Join(names, "\n")), nil
+	case strings.HasPrefix(args, "list -H -v -P -o name "):
+		pool := cmd.Args[len(cmd.Args)-1]
+		return []byte(pool + "\n\t" + e.imported[pool] + "\n"), nil
+	case strings.HasPrefix(args, "import -d "):
+		return []byte("   pool: pvc-src\n     id: 123\n  state: ONLINE\n"), nil
+	}
+	return nil, nil
+}
+
+func TestAttachZpool(t *testing.T) {
+	log.Debug("Running TestAttachZpool...")
+
+	executor := &zpoolExecutor{}
+	assert.NoError(t, Init(Config{Executor: executor}))
+	defer func() { _ = Init(Config{}) }()
+
+	// An existing pool, such as a clone's, is imported by its GUID under the volume's name, without forcing it or
+	// touching the host's cache file, and given a new GUID
+	publishInfo := &VolumePublishInfo{}
+	assert.NoError(t, attachZpool(context.TODO(), "pvc-1", "/dev/mapper/3600a0980", zfsMemberFstype, publishInfo))
+	assert.Equal(t, "pvc-1", publishInfo.Zpool)
+	assert.Equal(t, []string{
+		"zpool list -H -o name",
+		"zpool import -d /dev/mapper/3600a0980",
+		"zpool import -N -o cachefile=none -d /dev/mapper/3600a0980 123 pvc-1",
+		"zpool reguid pvc-1",
+	}, executor.commands)
+
+	// Imports are forced only if configured
+	assert.NoError(t, Init(Config{Executor: executor, ForceZpoolImport: true}))
+	executor.commands = nil
+	assert.NoError(t, attachZpool(context.TODO(), "pvc-src", "/dev/mapper/3600a0980", zfsMemberFstype,
+		&VolumePublishInfo{}))
+	assert.Equal(t, []string{
+		"zpool list -H -o name",
+		"zpool import -d /dev/mapper/3600a0980",
+		"zpool import -f -N -o cachefile=none -d /dev/mapper/3600a0980 123 pvc-src",
+	}, executor.commands)
+
+	// A pool already imported from the device, as one of its partitions, is used as is
+	executor.imported = map[string]string{"pvc-1": "/dev/mapper/3600a0980-part1"}
+	executor.commands = nil
+	assert.NoError(t, attachZpool(context.TODO(), "pvc-1", "/dev/mapper/3600a0980", zfsMemberFstype,
+		&VolumePublishInfo{}))
+	assert.Equal(t, []string{
+		"zpool list -H -o name",
+		"zpool list -H -v -P -o name pvc-1",
+	}, executor.commands)
+
+	// A pool of the same name imported from another device is not
+	executor.imported = map[string]string{"pvc-1": "/dev/mapper/3600a0981"}
+	assert.Error(t, attachZpool(context.TODO(), "pvc-1", "/dev/mapper/3600a0980", zfsMemberFstype,
+		&VolumePublishInfo{}))
+	assert.Error(t, ExportZpool(context.TODO(), &VolumePublishInfo{
+		DevicePath:     "/dev/mapper/3600a0980",
+		FilesystemType: zfsMemberFstype,
+		Zpool:          "pvc-1",
+	}))
+	executor.imported = nil
+
+	// Other filesystems are left alone
+	executor.commands = nil
+	publishInfo = &VolumePublishInfo{}
+	assert.Error(t, attachZpool(context.TODO(), "pvc-1", "/dev/mapper/3600a0980", "xfs", publishInfo))
+	assert.Empty(t, publishInfo.Zpool)
+
+	// A pool can't be shared between nodes
+	executor.commands = nil
+	publishInfo = &VolumePublishInfo{MultiAttach: true}
+	assert.Error(t, attachZpool(context.TODO(), "pvc-1", "/dev/mapper/3600a0980", zfsMemberFstype, publishInfo))
+	assert.Empty(t, executor.commands)
+
+	// Nothing is exported for volumes without a pool
+	executor.commands = nil
+	assert.NoError(t, ExportZpool(context.TODO(), &VolumePublishInfo{}))
+	assert.Empty(t, executor.commands)
+}
+
+func TestIsZpoolVdevOnDevice(t *testing.T) {
+	log.Debug("Running TestIsZpoolVdevOnDevice...")
+
+	assert.True(t, isZpoolVdevOnDevice("/dev/mapper/3600a0980", "/dev/mapper/3600a0980"))
+	assert.True(t, isZpoolVdevOnDevice("/dev/mapper/3600a0980-part1", "/dev/mapper/3600a0980"))
+	assert.True(t, isZpoolVdevOnDevice("/dev/mapper/3600a0980p1", "/dev/mapper/3600a0980"))
+	assert.True(t, isZpoolVdevOnDevice("/dev/sdb1", "/dev/sdb"))
+	assert.False(t, isZpoolVdevOnDevice("/dev/mapper/3600a09801", "/dev/mapper/3600a0980x"))
+	assert.False(t, isZpoolVdevOnDevice("/dev/mapper/3600a0981", "/dev/mapper/3600a0980"))
+	assert.False(t, isZpoolVdevOnDevice("/dev/sdbc", "/dev/sdb"))
+}